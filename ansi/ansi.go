@@ -0,0 +1,329 @@
+package ansi
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	stateText = iota
+	stateEsc
+	stateCSI
+	stateOSC
+	stateOSCEsc
+)
+
+// parser splits a byte stream into text and SGR (color) sequences, dropping
+// every other escape sequence. It keeps state between calls so sequences
+// split across writes are handled.
+type parser struct {
+	state  int
+	params []byte
+}
+
+func (p *parser) parse(b []byte, text func([]byte), sgr func([]int)) {
+	start := 0
+	flush := func(i int) {
+		if p.state == stateText && i > start {
+			text(b[start:i])
+		}
+	}
+	for i, c := range b {
+		switch p.state {
+		case stateText:
+			if c == 0x1b {
+				flush(i)
+				p.state = stateEsc
+			}
+		case stateEsc:
+			switch c {
+			case '[':
+				p.state = stateCSI
+				p.params = p.params[:0]
+			case ']':
+				p.state = stateOSC
+			default:
+				p.state = stateText
+				start = i + 1
+			}
+		case stateCSI:
+			if c >= 0x40 && c <= 0x7e {
+				if c == 'm' {
+					sgr(parseParams(p.params))
+				}
+				p.state = stateText
+				start = i + 1
+			} else {
+				p.params = append(p.params, c)
+			}
+		case stateOSC:
+			switch c {
+			case 0x07:
+				p.state = stateText
+				start = i + 1
+			case 0x1b:
+				p.state = stateOSCEsc
+			}
+		case stateOSCEsc:
+			p.state = stateText
+			start = i + 1
+		}
+	}
+	flush(len(b))
+}
+
+func parseParams(b []byte) []int {
+	if len(b) == 0 {
+		return []int{0}
+	}
+	fields := strings.Split(string(b), ";")
+	params := make([]int, len(fields))
+	for i, f := range fields {
+		params[i], _ = strconv.Atoi(f)
+	}
+	return params
+}
+
+// Strip removes all ANSI escape sequences from b.
+func Strip(b []byte) []byte {
+	var out bytes.Buffer
+	var p parser
+	p.parse(b, func(t []byte) { out.Write(t) }, func([]int) {})
+	return out.Bytes()
+}
+
+// NormalizeCR collapses carriage-return progress output so that only the final
+// state of each line is kept, the same way it appears on a terminal.
+func NormalizeCR(b []byte) []byte {
+	var out bytes.Buffer
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	for _, line := range lines {
+		nl := bytes.HasSuffix(line, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if i := bytes.LastIndex(line, []byte("\r")); i >= 0 {
+			line = line[i+1:]
+		}
+		out.Write(line)
+		if nl {
+			out.WriteByte('\n')
+		}
+	}
+	return out.Bytes()
+}
+
+// Plain returns the plaintext version of terminal output b.
+func Plain(b []byte) []byte {
+	return NormalizeCR(Strip(b))
+}
+
+type stripWriter struct {
+	w io.Writer
+	p parser
+}
+
+// NewStripWriter returns a writer which removes ANSI escape sequences from
+// everything written to it before passing it on to w.
+func NewStripWriter(w io.Writer) io.Writer {
+	return &stripWriter{w: w}
+}
+
+func (s *stripWriter) Write(b []byte) (int, error) {
+	var err error
+	s.p.parse(b, func(t []byte) {
+		if err == nil {
+			_, err = s.w.Write(t)
+		}
+	}, func([]int) {})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+type style struct {
+	fg, bg                  string
+	bold, italic, underline bool
+}
+
+func (s style) classes() []string {
+	var classes []string
+	if s.bold {
+		classes = append(classes, "ansi-bold")
+	}
+	if s.italic {
+		classes = append(classes, "ansi-italic")
+	}
+	if s.underline {
+		classes = append(classes, "ansi-underline")
+	}
+	if s.fg != "" && s.fg[0] != '#' {
+		classes = append(classes, "ansi-fg-"+s.fg)
+	}
+	if s.bg != "" && s.bg[0] != '#' {
+		classes = append(classes, "ansi-bg-"+s.bg)
+	}
+	return classes
+}
+
+func (s style) open() string {
+	var attrs []string
+	if classes := s.classes(); len(classes) > 0 {
+		attrs = append(attrs, fmt.Sprintf(`class="%s"`, strings.Join(classes, " ")))
+	}
+	var css []string
+	if s.fg != "" && s.fg[0] == '#' {
+		css = append(css, "color:"+s.fg)
+	}
+	if s.bg != "" && s.bg[0] == '#' {
+		css = append(css, "background-color:"+s.bg)
+	}
+	if len(css) > 0 {
+		attrs = append(attrs, fmt.Sprintf(`style="%s"`, strings.Join(css, ";")))
+	}
+	if len(attrs) == 0 {
+		return ""
+	}
+	return "<span " + strings.Join(attrs, " ") + ">"
+}
+
+var colorNames = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// extendedColor parses the arguments of a 38/48 SGR code and returns the
+// color along with the number of parameters consumed. Colors outside the 256
+// color palette are ignored.
+func extendedColor(params []int) (string, int) {
+	if len(params) >= 2 && params[0] == 5 {
+		n := params[1]
+		if n < 0 || n > 255 {
+			return "", 2
+		} else if n < 8 {
+			return colorNames[n], 2
+		} else if n < 16 {
+			return "bright-" + colorNames[n-8], 2
+		}
+		return xterm256(n), 2
+	}
+	if len(params) >= 4 && params[0] == 2 {
+		return fmt.Sprintf("#%02x%02x%02x", params[1]&0xff, params[2]&0xff, params[3]&0xff), 4
+	}
+	return "", len(params)
+}
+
+func xterm256(n int) string {
+	if n >= 232 {
+		v := 8 + (n-232)*10
+		return fmt.Sprintf("#%02x%02x%02x", v, v, v)
+	}
+	n -= 16
+	levels := []int{0, 95, 135, 175, 215, 255}
+	return fmt.Sprintf("#%02x%02x%02x", levels[(n/36)%6], levels[(n/6)%6], levels[n%6])
+}
+
+func (s *style) apply(params []int) {
+	for i := 0; i < len(params); i++ {
+		switch p := params[i]; {
+		case p == 0:
+			*s = style{}
+		case p == 1:
+			s.bold = true
+		case p == 3:
+			s.italic = true
+		case p == 4:
+			s.underline = true
+		case p == 22:
+			s.bold = false
+		case p == 23:
+			s.italic = false
+		case p == 24:
+			s.underline = false
+		case p >= 30 && p <= 37:
+			s.fg = colorNames[p-30]
+		case p == 38:
+			c, n := extendedColor(params[i+1:])
+			s.fg = c
+			i += n
+		case p == 39:
+			s.fg = ""
+		case p >= 40 && p <= 47:
+			s.bg = colorNames[p-40]
+		case p == 48:
+			c, n := extendedColor(params[i+1:])
+			s.bg = c
+			i += n
+		case p == 49:
+			s.bg = ""
+		case p >= 90 && p <= 97:
+			s.fg = "bright-" + colorNames[p-90]
+		case p >= 100 && p <= 107:
+			s.bg = "bright-" + colorNames[p-100]
+		}
+	}
+}
+
+// HTML renders terminal output b as HTML, translating SGR color sequences to
+// <span> elements styled by the classes defined in CSS. Carriage-return
+// progress output is normalized first.
+func HTML(b []byte) string {
+	var out bytes.Buffer
+	var p parser
+	var cur style
+	open := ""
+	p.parse(NormalizeCR(b), func(t []byte) {
+		out.WriteString(html.EscapeString(string(t)))
+	}, func(params []int) {
+		if open != "" {
+			out.WriteString("</span>")
+		}
+		cur.apply(params)
+		open = cur.open()
+		out.WriteString(open)
+	})
+	if open != "" {
+		out.WriteString("</span>")
+	}
+	return out.String()
+}
+
+// CSS is the stylesheet for the classes emitted by HTML.
+var CSS = `
+.ansi-bold { font-weight: bold; }
+.ansi-italic { font-style: italic; }
+.ansi-underline { text-decoration: underline; }
+.ansi-fg-black { color: #000000; }
+.ansi-fg-red { color: #cd0000; }
+.ansi-fg-green { color: #00cd00; }
+.ansi-fg-yellow { color: #cdcd00; }
+.ansi-fg-blue { color: #0000ee; }
+.ansi-fg-magenta { color: #cd00cd; }
+.ansi-fg-cyan { color: #00cdcd; }
+.ansi-fg-white { color: #e5e5e5; }
+.ansi-fg-bright-black { color: #7f7f7f; }
+.ansi-fg-bright-red { color: #ff0000; }
+.ansi-fg-bright-green { color: #00ff00; }
+.ansi-fg-bright-yellow { color: #ffff00; }
+.ansi-fg-bright-blue { color: #5c5cff; }
+.ansi-fg-bright-magenta { color: #ff00ff; }
+.ansi-fg-bright-cyan { color: #00ffff; }
+.ansi-fg-bright-white { color: #ffffff; }
+.ansi-bg-black { background-color: #000000; }
+.ansi-bg-red { background-color: #cd0000; }
+.ansi-bg-green { background-color: #00cd00; }
+.ansi-bg-yellow { background-color: #cdcd00; }
+.ansi-bg-blue { background-color: #0000ee; }
+.ansi-bg-magenta { background-color: #cd00cd; }
+.ansi-bg-cyan { background-color: #00cdcd; }
+.ansi-bg-white { background-color: #e5e5e5; }
+.ansi-bg-bright-black { background-color: #7f7f7f; }
+.ansi-bg-bright-red { background-color: #ff0000; }
+.ansi-bg-bright-green { background-color: #00ff00; }
+.ansi-bg-bright-yellow { background-color: #ffff00; }
+.ansi-bg-bright-blue { background-color: #5c5cff; }
+.ansi-bg-bright-magenta { background-color: #ff00ff; }
+.ansi-bg-bright-cyan { background-color: #00ffff; }
+.ansi-bg-bright-white { background-color: #ffffff; }
+`[1:]
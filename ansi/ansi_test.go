@@ -0,0 +1,17 @@
+package ansi
+
+import "testing"
+
+func TestHTMLExtendedColor(t *testing.T) {
+	for _, test := range []struct {
+		in, out string
+	}{
+		{"\x1b[38;5;1mx\x1b[0m", `<span class="ansi-fg-red">x</span>`},
+		{"\x1b[38;5;-1mx\x1b[0m", "x"},
+		{"\x1b[48;5;256mx\x1b[0m", "x"},
+	} {
+		if out := HTML([]byte(test.in)); out != test.out {
+			t.Errorf("HTML(%q) = %q, want %q", test.in, out, test.out)
+		}
+	}
+}
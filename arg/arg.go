@@ -2,20 +2,44 @@ package arg
 
 import (
 	"flag"
+	"fmt"
 
+	"github.com/flynn/flynn-test/assets"
 	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/config"
 )
 
 type Args struct {
-	BootConfig   cluster.BootConfig
-	CLI          string
-	DockerFS     string
-	Flynnrc      string
-	Debug        bool
-	Kill         bool
-	KeepDockerFS bool
-	DBPath       string
-	TestsPath    string
+	BootConfig    cluster.BootConfig
+	CLI           string
+	DockerFS      string
+	Flynnrc       string
+	Debug         bool
+	Kill          bool
+	KeepDockerFS  bool
+	DBPath        string
+	SnapshotDir   string
+	BuildCache    string
+	CacheSize     int
+	SecretsDir    string
+	TLSCert       string
+	TLSKey        string
+	TLSSelfSigned bool
+	TestsPath     string
+	ConfigPath    string
+	Profile       string
+	ClusterSize   int
+	Filter        string
+	ListRetries   bool
+	ListOwners    bool
+	ListTests     bool
+	Cleanup       bool
+	Shard         string
+	ArtifactsDir  string
+	RestoreURL    string
+	External      string
+	Seed          int64
+	Features      string
 }
 
 func Parse() *Args {
@@ -24,13 +48,56 @@ func Parse() *Args {
 	flag.StringVar(&args.BootConfig.User, "user", "ubuntu", "user to run QEMU as")
 	flag.StringVar(&args.BootConfig.RootFS, "rootfs", "rootfs/rootfs.img", "fs image to use with QEMU")
 	flag.StringVar(&args.BootConfig.Kernel, "kernel", "rootfs/vmlinuz", "path to the Linux binary")
+	flag.StringVar(&args.BootConfig.Initrd, "initrd", "", "path to an initrd image")
+	flag.StringVar(&args.BootConfig.ImageCatalog, "image-catalog", "rootfs/images.json", "path to the image catalog used to verify the kernel and initrd")
 	flag.StringVar(&args.BootConfig.Network, "network", "10.52.0.1/24", "the network to use for vms")
 	flag.StringVar(&args.BootConfig.NatIface, "nat", "eth0", "the interface to provide NAT to vms")
+	flag.StringVar(&args.BootConfig.BridgePrefix, "bridge-prefix", cluster.DefaultBridgePrefix, "prefix of the names of the network bridges of clusters")
+	flag.StringVar(&args.BootConfig.TapPrefix, "tap-prefix", cluster.DefaultTapPrefix, "prefix of the names of the taps of instances")
+	flag.StringVar(&args.BootConfig.InjectDiscovery, "inject-discovery", "metadata,dns", "comma separated ways instances booted into a bootstrapped cluster are told where it is: cmdline, metadata or dns")
+	flag.IntVar(&args.BootConfig.MTU, "mtu", 0, "MTU of the vm network, such as 9000 for jumbo frames, defaulting to the kernel's")
+	flag.StringVar(&args.BootConfig.Workdir, "workdir", "", "directory available to vm configs as {{.Workdir}}")
+	flag.StringVar(&args.BootConfig.GitMirror, "git-mirror", "", "directory of bare git mirrors to clone repos from")
+	flag.StringVar(&args.BootConfig.NetbootRoot, "netboot-root", "", "directory of files served to netboot instances over TFTP and HTTP")
+	flag.StringVar(&args.BootConfig.Harness, "harness", "", "path to the guest harness binary to install in instances")
+	flag.StringVar(&args.BootConfig.CrashDumpDir, "crash-dump-dir", "", "directory to dump guest memory to when a guest kernel panics")
+	flag.StringVar(&args.BootConfig.SSHUser, "ssh-user", "ubuntu", "user to ssh into instances as")
+	flag.StringVar(&args.BootConfig.SSHKey, "ssh-key", "", "path to a private key to ssh into instances with, besides the generated key")
+	flag.StringVar(&args.BootConfig.BuildScript, "build-script", "", "path to a template replacing the built in build script")
+	flag.BoolVar(&args.BootConfig.Confine, "confine", false, "confine QEMU with seccomp and a per-instance AppArmor profile")
+	flag.StringVar(&args.BootConfig.Backend, "backend", "qemu", "how to provision instances, either qemu, libvirt or remote")
+	flag.StringVar(&args.BootConfig.LibvirtURI, "libvirt-uri", "qemu:///system", "libvirt connection URI used by the libvirt backend")
+	flag.StringVar(&args.BootConfig.RemoteHost, "remote-host", "", "comma separated hosts to run QEMU on over SSH with the remote backend, as ssh://user@host[:port]")
+	flag.StringVar(&args.BootConfig.Placement, "placement", "", "placement of instances across remote hosts: colocate or spread")
+	flag.StringVar(&args.BootConfig.RemoteDir, "remote-dir", cluster.DefaultRemoteDir, "directory of instance files on the remote host")
+	flag.StringVar(&args.BootConfig.Macvtap, "macvtap", "", "host NIC to attach instances to through macvtap devices, as a second interface")
 	flag.StringVar(&args.DockerFS, "dockerfs", "", "docker fs")
 	flag.StringVar(&args.CLI, "cli", "flynn", "path to flynn-cli binary")
 	flag.StringVar(&args.Flynnrc, "flynnrc", "", "path to flynnrc file")
 	flag.StringVar(&args.DBPath, "db", "flynn-test.db", "path to BoltDB database to store pending builds")
+	flag.StringVar(&args.SnapshotDir, "snapshot-dir", "snapshots", "directory to keep build snapshots in so builds which fail to bootstrap can be resumed")
+	flag.StringVar(&args.BuildCache, "build-cache", "", "directory to cache built docker fs images in, to reuse or build on them")
+	flag.IntVar(&args.CacheSize, "build-cache-size", 5, "number of images to keep in the build cache")
+	flag.StringVar(&args.SecretsDir, "secrets-dir", "secrets", "directory of secret files, named after the secrets in the config, which are given to trusted builds")
+	flag.StringVar(&args.TLSCert, "tls-cert", "", "path to a TLS certificate to serve the runner API over HTTPS with")
+	flag.StringVar(&args.TLSKey, "tls-key", "", "path to the private key of --tls-cert")
+	flag.BoolVar(&args.TLSSelfSigned, "tls-self-signed", false, "serve the runner API over HTTPS with a self-signed certificate, generated if --tls-cert doesn't exist")
 	flag.StringVar(&args.TestsPath, "tests", "flynn-test", "path to the tests binary")
+	flag.StringVar(&args.ConfigPath, "config", "", "path to a JSON config file")
+	flag.StringVar(&assets.Dir, "assets", "", "directory of files overriding the embedded scripts, apps and templates")
+	flag.StringVar(&args.Profile, "profile", "", "name of the run profile to use")
+	flag.IntVar(&args.ClusterSize, "size", 0, "number of worker instances to boot, overriding the profile")
+	flag.StringVar(&args.Filter, "filter", "", "regular expression selecting which tests to run")
+	flag.StringVar(&args.ArtifactsDir, "artifacts", "", "directory tests save artifacts to")
+	flag.StringVar(&args.External, "external-cluster", "", "comma separated ssh://user@host[:port] URLs of machines to bootstrap and test rather than booting instances")
+	flag.StringVar(&args.RestoreURL, "restore-url", "", "URL of the runner to POST to to restore the cluster snapshot before destructive tests")
+	flag.StringVar(&args.Shard, "shard", "", "only run the tests in shard i/n of the suite")
+	flag.StringVar(&args.Features, "features", "", "comma separated feature flags to set for the tests, as name=value or name, overriding the profile's")
+	flag.Int64Var(&args.Seed, "seed", 0, "seed for random names, shard assignment and chaos faults, to replay a run")
+	flag.BoolVar(&args.ListRetries, "list-retries", false, "print the retry budget of each test as JSON and exit")
+	flag.BoolVar(&args.ListOwners, "list-owners", false, "print the owners of each test and suite as JSON and exit")
+	flag.BoolVar(&args.ListTests, "list", false, "print the names of the tests matching --filter as JSON and exit")
+	flag.BoolVar(&args.Cleanup, "cleanup", false, "remove the qemu processes, taps, bridges and images left behind by crashed runs, and exit")
 	flag.BoolVar(&args.Debug, "debug", false, "enable debug output")
 	flag.BoolVar(&args.Kill, "kill", true, "kill the cluster after running the tests")
 	flag.BoolVar(&args.KeepDockerFS, "keep-dockerfs", false, "don't remove the dockerfs which was built to run the tests")
@@ -38,3 +105,26 @@ func Parse() *Args {
 
 	return args
 }
+
+// Config loads the config file, and sets the flags which weren't given on the
+// command line to its defaults.
+func (a *Args) Config() (*config.Config, error) {
+	conf, err := config.Load(a.ConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, value := range conf.Flags {
+		if set[name] {
+			continue
+		}
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("config: unknown flag %q", name)
+		}
+		if err := flag.Set(name, value); err != nil {
+			return nil, fmt.Errorf("config: invalid value %q for flag %s: %s", value, name, err)
+		}
+	}
+	return conf, nil
+}
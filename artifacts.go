@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	c "gopkg.in/check.v1"
+)
+
+// artifactPath returns a path for the test to save a file named name to,
+// such as a response dump or profile. Files saved under --artifacts are
+// collected by the runner and linked from the build report.
+func artifactPath(t *c.C, name string) string {
+	base := args.ArtifactsDir
+	if base == "" {
+		base = t.MkDir()
+	}
+	path := filepath.Join(base, t.TestName(), name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,66 @@
+// Package assets holds the files the runner needs on a host: the scripts
+// which provision it and build the rootfs, the apps the tests deploy, and
+// templates replacing the dashboard pages and build script. They are
+// embedded in the binary by gen.go, so deploying the runner is copying it and
+// a config file, and files in Dir override the embedded ones.
+package assets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Dir is a directory of files overriding the embedded assets, by the same
+// names.
+var Dir string
+
+type file struct {
+	mode os.FileMode
+	data string
+}
+
+// Asset returns the named asset, such as "scripts/setup.sh", reading it from
+// Dir if it is there.
+func Asset(name string) ([]byte, error) {
+	if Dir != "" {
+		data, err := ioutil.ReadFile(filepath.Join(Dir, filepath.FromSlash(name)))
+		if err == nil || !os.IsNotExist(err) {
+			return data, err
+		}
+	}
+	f, ok := files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return []byte(f.data), nil
+}
+
+// Names returns the names of the embedded assets.
+func Names() []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Extract writes the embedded assets, or their overrides, to dir.
+func Extract(dir string) error {
+	for _, name := range Names() {
+		data, err := Asset(name)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, data, files[name].mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+//go:build ignore
+// +build ignore
+
+// gen.go embeds the assets in bindata.go. Run it from the root of the repo
+// after changing them:
+//
+//	go run assets/gen.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// roots are the directories whose files are embedded, leaving out dotfiles,
+// READMEs and Makefiles.
+var roots = []string{"apps", "rootfs", "scripts"}
+
+func main() {
+	var buf bytes.Buffer
+	buf.WriteString("// generated by gen.go, DO NOT EDIT\n\npackage assets\n\nvar files = map[string]file{\n")
+	for _, root := range roots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			name := info.Name()
+			if strings.HasPrefix(name, ".") || name == "README.md" || name == "Makefile" {
+				return nil
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			mode := os.FileMode(0644)
+			if info.Mode()&0111 != 0 {
+				mode = 0755
+			}
+			fmt.Fprintf(&buf, "\t%q: {mode: %#o, data: %q},\n", filepath.ToSlash(path), mode, data)
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	buf.WriteString("}\n")
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile("assets/bindata.go", src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,279 @@
+// Package client is a client for the runner API, for tooling which triggers
+// builds and follows their progress.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Run struct {
+	ID          string   `json:"id,omitempty"`
+	Repo        string   `json:"repo"`
+	Commit      string   `json:"commit"`
+	Branch      string   `json:"branch,omitempty"`
+	CloneUrl    string   `json:"clone_url,omitempty"`
+	PullRequest int      `json:"pull_request,omitempty"`
+	State       string   `json:"state,omitempty"`
+	Profile     string   `json:"profile,omitempty"`
+	ClusterSize int      `json:"cluster_size,omitempty"`
+	Seed        int64    `json:"seed,omitempty"`
+	Env         []string `json:"env,omitempty"`
+	KeepOnFail  bool     `json:"keep_on_fail,omitempty"`
+
+	Author   string        `json:"author,omitempty"`
+	Created  time.Time     `json:"created"`
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// LogUrl is the report of the run once it has finished.
+	LogUrl string `json:"log_url,omitempty"`
+
+	Instances []*Instance   `json:"instances,omitempty"`
+	Results   []*TestResult `json:"results,omitempty"`
+	Passed    int           `json:"passed,omitempty"`
+	Failed    int           `json:"failed,omitempty"`
+	Cost      float64       `json:"cost,omitempty"`
+}
+
+// Finished reports whether the run has finished, successfully or not.
+func (r *Run) Finished() bool {
+	return r.State == "success" || r.State == "failure" || r.State == "error"
+}
+
+type Instance struct {
+	Role string `json:"role"`
+	IP   string `json:"ip"`
+}
+
+type TestResult struct {
+	Name      string        `json:"name"`
+	File      string        `json:"file"`
+	Line      int           `json:"line"`
+	Status    string        `json:"status"`
+	Duration  time.Duration `json:"duration"`
+	Output    string        `json:"output,omitempty"`
+	Attempts  int           `json:"attempts,omitempty"`
+	Artifacts []*Artifact   `json:"artifacts,omitempty"`
+}
+
+type Artifact struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+type Client struct {
+	URL   string
+	Token string
+
+	// HTTP is the client requests are made with, http.DefaultClient if nil.
+	HTTP *http.Client
+}
+
+// Error is returned for requests the runner responded to with an error.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("runner responded with %d: %s", e.Status, e.Message)
+}
+
+func New(url, token string) *Client {
+	return &Client{URL: strings.TrimSuffix(url, "/"), Token: token}
+}
+
+func (c *Client) do(method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.SetBasicAuth("", c.Token)
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		msg, _ := ioutil.ReadAll(res.Body)
+		return nil, &Error{Status: res.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return res, nil
+}
+
+// action POSTs to path, returning the runner's message.
+func (c *Client) action(path string) (string, error) {
+	res, err := c.do("POST", path, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	msg, err := ioutil.ReadAll(res.Body)
+	return string(msg), err
+}
+
+// CreateRun triggers a run of run.Repo at run.Commit, returning the run
+// with its ID set.
+func (c *Client) CreateRun(run *Run) (*Run, error) {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do("POST", "/builds", bytes.NewReader(data), "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	created := &Run{}
+	return created, json.NewDecoder(res.Body).Decode(created)
+}
+
+func (c *Client) GetRun(id string) (*Run, error) {
+	res, err := c.do("GET", "/builds/"+id, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	run := &Run{}
+	return run, json.NewDecoder(res.Body).Decode(run)
+}
+
+// RunQuery filters, sorts and paginates runs. Sort is created or duration,
+// prefixed with - for descending order, the default being -created.
+type RunQuery struct {
+	Repo        string
+	Branch      string
+	Author      string
+	State       string
+	Since       time.Time
+	Until       time.Time
+	MinDuration time.Duration
+	MaxDuration time.Duration
+	Sort        string
+	Limit       int
+	Offset      int
+}
+
+func (q *RunQuery) values() url.Values {
+	v := url.Values{}
+	set := func(key, val string) {
+		if val != "" {
+			v.Set(key, val)
+		}
+	}
+	set("repo", q.Repo)
+	set("branch", q.Branch)
+	set("author", q.Author)
+	set("state", q.State)
+	set("sort", q.Sort)
+	if !q.Since.IsZero() {
+		v.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		v.Set("until", q.Until.Format(time.RFC3339))
+	}
+	if q.MinDuration > 0 {
+		v.Set("min_duration", q.MinDuration.String())
+	}
+	if q.MaxDuration > 0 {
+		v.Set("max_duration", q.MaxDuration.String())
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Offset > 0 {
+		v.Set("offset", strconv.Itoa(q.Offset))
+	}
+	return v
+}
+
+// ListRuns returns the runs matching q, and the offset of the next page, or
+// zero if there are no more.
+func (c *Client) ListRuns(q *RunQuery) ([]*Run, int, error) {
+	res, err := c.do("GET", "/builds?"+q.values().Encode(), nil, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	var list struct {
+		Builds     []*Run `json:"builds"`
+		NextOffset int    `json:"next_offset"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, 0, err
+	}
+	return list.Builds, list.NextOffset, nil
+}
+
+// WaitRun polls the run until it has finished.
+func (c *Client) WaitRun(id string, interval time.Duration) (*Run, error) {
+	for {
+		run, err := c.GetRun(id)
+		if err != nil {
+			return nil, err
+		}
+		if run.Finished() {
+			return run, nil
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Resume resumes a run which failed to bootstrap from its snapshot.
+func (c *Client) Resume(id string) (string, error) {
+	return c.action("/builds/" + id + "/resume")
+}
+
+// Approve approves a run of an untrusted pull request.
+func (c *Client) Approve(id string) (string, error) {
+	return c.action("/builds/" + id + "/approve")
+}
+
+// Rerun reruns the build step of repo on the builder kept by a failed run,
+// writing its output to w.
+func (c *Client) Rerun(id, repo string, w io.Writer) error {
+	res, err := c.do("POST", fmt.Sprintf("/builds/%s/rerun?step=%s", id, repo), nil, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// StreamLog writes the log of a running run to w from offset until the run
+// finishes, reconnecting from the last offset received if the connection
+// drops. It returns the offset the log was written up to.
+func (c *Client) StreamLog(id string, offset int, w io.Writer) (int, error) {
+	for {
+		res, err := c.do("GET", fmt.Sprintf("/builds/%s/log?offset=%d", id, offset), nil, "")
+		if _, ok := err.(*Error); ok {
+			return offset, err
+		}
+		if err == nil {
+			var n int64
+			n, err = io.Copy(w, res.Body)
+			res.Body.Close()
+			offset += int(n)
+			if err == nil {
+				return offset, nil
+			}
+		}
+		time.Sleep(time.Second)
+	}
+}
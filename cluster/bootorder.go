@@ -0,0 +1,88 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// bootOrder orders roles so that the instances of each role come after
+// those of the roles it is booted after, otherwise keeping their order.
+// Roles which aren't in roles are ignored, as there is nothing to wait for.
+func (bc BootConfig) bootOrder(roles []string) ([]string, error) {
+	counts := make(map[string]int)
+	var names []string
+	for _, name := range roles {
+		if counts[name] == 0 {
+			names = append(names, name)
+		}
+		counts[name]++
+	}
+	ordered := make([]string, 0, len(roles))
+	state := make(map[string]int) // 1 while visiting, 2 once ordered
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("cluster: roles have a boot order cycle: %v", append(path, name))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		role, err := bc.Role(name)
+		if err != nil {
+			return err
+		}
+		for _, after := range role.After {
+			if counts[after] == 0 {
+				continue
+			}
+			if err := visit(after, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		for i := 0; i < counts[name]; i++ {
+			ordered = append(ordered, name)
+		}
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// waitAfter waits for the started instances of the roles the role name is
+// booted after to be reachable over SSH before instance i is started,
+// recording how long each dependency took in the timeline.
+func (c *Cluster) waitAfter(i int, name string, roleInstances map[string][]int, ready map[int]bool) error {
+	role, err := c.bc.Role(name)
+	if err != nil {
+		return err
+	}
+	timeout := 5 * time.Minute
+	if role.AfterTimeout > 0 {
+		timeout = time.Duration(role.AfterTimeout) * time.Second
+	}
+	for _, after := range role.After {
+		start := time.Now()
+		for _, j := range roleInstances[after] {
+			if ready[j] {
+				continue
+			}
+			s := attempts
+			s.Total = timeout
+			if err := c.instances[j].Run("true", s, ioutil.Discard, ioutil.Discard); err != nil {
+				return fmt.Errorf("instance %d (%s) was not ready before instance %d (%s) within %s: %s", j, after, i, name, timeout, err)
+			}
+			ready[j] = true
+		}
+		if len(roleInstances[after]) > 0 {
+			c.event("instance %d (%s) waited %s for %s", i, name, time.Since(start), after)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package cluster
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BootProfile is what instances need to know about the OS of their guest to
+// boot it: the emulator and machine, how drives and the cluster NIC are
+// attached, the kernel command line and console, and the console output
+// which shows the guest has booted. Experimental guests are supported by
+// adding a profile and pointing a role's Boot at it.
+type BootProfile struct {
+	// QEMU is the path of the emulator, defaulting to qemu-system-x86_64.
+	// Emulated guests, such as aarch64 guests on x86 hosts, run without
+	// KVM.
+	QEMU     string `json:"qemu"`
+	Emulated bool   `json:"emulated"`
+
+	// Machine is passed to QEMU as -machine, and CPU as -cpu unless the
+	// role sets its own.
+	Machine string `json:"machine"`
+	CPU     string `json:"cpu"`
+
+	// Root and Console are the guest's root device and console, passed on
+	// the command line of directly booted kernels along with Cmdline.
+	Root    string `json:"root"`
+	Console string `json:"console"`
+	Cmdline string `json:"cmdline"`
+
+	// DiskInterface attaches drives with -drive if=DiskInterface, such as
+	// "virtio", rather than as IDE disks, and NIC is the model of the
+	// cluster network interface.
+	DiskInterface string `json:"disk_interface"`
+	NIC           string `json:"nic"`
+
+	// PanicDevice is the QEMU device through which the guest reports
+	// kernel panics, such as "pvpanic" on x86.
+	PanicDevice string `json:"panic_device"`
+
+	// Ready is a regular expression matching the console output of a guest
+	// which has finished booting, after which ssh is attempted.
+	Ready string `json:"ready"`
+}
+
+// DefaultBootProfile is the profile of instances whose role sets none, which
+// boots the Ubuntu rootfs.
+const DefaultBootProfile = "ubuntu"
+
+var DefaultBootProfiles = map[string]*BootProfile{
+	"ubuntu": {
+		Root:        "/dev/sda",
+		Console:     "ttyS0",
+		PanicDevice: "pvpanic",
+		Ready:       readyPattern.String(),
+	},
+	"alpine": {
+		Root:          "/dev/vda",
+		Console:       "ttyS0",
+		Cmdline:       "modules=virtio_blk,ext4 rootfstype=ext4",
+		DiskInterface: "virtio",
+		NIC:           "virtio",
+		PanicDevice:   "pvpanic",
+		Ready:         `login: ?$`,
+	},
+	"coreos": {
+		Root:        "/dev/sda",
+		Console:     "ttyS0",
+		Cmdline:     "coreos.autologin=ttyS0",
+		PanicDevice: "pvpanic",
+		Ready:       `login: ?$|Reached target Multi-User System`,
+	},
+	"ubuntu-arm64": {
+		QEMU:          "/usr/bin/qemu-system-aarch64",
+		Emulated:      true,
+		Machine:       "virt",
+		CPU:           "cortex-a57",
+		Root:          "/dev/vda",
+		Console:       "ttyAMA0",
+		DiskInterface: "virtio",
+		NIC:           "virtio",
+		Ready:         readyPattern.String(),
+	},
+}
+
+// BootProfile returns the named boot profile, with profiles in
+// bc.BootProfiles taking precedence over the defaults.
+func (bc BootConfig) BootProfile(name string) (*BootProfile, error) {
+	if name == "" {
+		name = DefaultBootProfile
+	}
+	p, ok := bc.BootProfiles[name]
+	if !ok {
+		if p, ok = DefaultBootProfiles[name]; !ok {
+			return nil, fmt.Errorf("cluster: unknown boot profile %q", name)
+		}
+	}
+	if _, err := p.readyPattern(); err != nil {
+		return nil, fmt.Errorf("cluster: boot profile %s has invalid ready pattern: %s", name, err)
+	}
+	return p, nil
+}
+
+func (p *BootProfile) readyPattern() (*regexp.Regexp, error) {
+	if p.Ready == "" {
+		return readyPattern, nil
+	}
+	return regexp.Compile(p.Ready)
+}
+
+func (p *BootProfile) qemu() string {
+	if p.QEMU == "" {
+		return "/usr/bin/qemu-system-x86_64"
+	}
+	return p.QEMU
+}
+
+func (p *BootProfile) cmdline() string {
+	cmdline := fmt.Sprintf("root=%s console=%s", p.Root, p.Console)
+	if p.Cmdline != "" {
+		cmdline += " " + p.Cmdline
+	}
+	return cmdline
+}
+
+// driveArgs returns the QEMU args attaching the drive named like "hdb" with
+// the image fs.
+func (p *BootProfile) driveArgs(name, fs string) []string {
+	if p.DiskInterface == "" || len(name) != 3 || !strings.HasPrefix(name, "hd") {
+		return []string{"-" + name, fs}
+	}
+	// keep the order of the IDE names, so that hdb is the second disk
+	index := strconv.Itoa(int(name[2] - 'a'))
+	return []string{"-drive", "file=" + fs + ",if=" + p.DiskInterface + ",index=" + index}
+}
@@ -0,0 +1,229 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BuildCache keeps flattened copies of the docker fs images of earlier builds,
+// keyed by the repo refs and env they were built with. An image built from
+// the same commits is reused without building, and otherwise the image
+// sharing the most refs is built on, so that the build script only rebuilds
+// the repos which changed.
+type BuildCache struct {
+	Dir  string
+	Size int
+
+	mtx sync.Mutex
+}
+
+type cacheEntry struct {
+	Key   string            `json:"key"`
+	Repos map[string]string `json:"repos"`
+	Used  time.Time         `json:"used"`
+}
+
+func NewBuildCache(dir string, size int) (*BuildCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &BuildCache{Dir: dir, Size: size}, nil
+}
+
+func buildCacheKey(repos map[string]string, env []string) string {
+	lines := make([]string, 0, len(repos)+len(env))
+	for repo, ref := range repos {
+		lines = append(lines, "repo "+repo+"="+ref)
+	}
+	for _, e := range env {
+		lines = append(lines, "env "+e)
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// isCommit reports whether ref is a full commit SHA, unlike branches which
+// may have moved since a build was cached.
+func isCommit(ref string) bool {
+	if len(ref) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(ref)
+	return err == nil
+}
+
+func (c *BuildCache) image(key string) string {
+	return filepath.Join(c.Dir, key+".img")
+}
+
+func (c *BuildCache) meta(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+func (c *BuildCache) entries() []*cacheEntry {
+	files, _ := filepath.Glob(filepath.Join(c.Dir, "*.json"))
+	entries := make([]*cacheEntry, 0, len(files))
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		e := &cacheEntry{}
+		if err := json.Unmarshal(data, e); err != nil {
+			continue
+		}
+		if _, err := os.Stat(c.image(e.Key)); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func (c *BuildCache) touch(e *cacheEntry) {
+	e.Used = time.Now()
+	data, _ := json.Marshal(e)
+	ioutil.WriteFile(c.meta(e.Key), data, 0644)
+}
+
+// Lookup returns the cached image built from repos with env, with exact set,
+// if every ref is a commit. Otherwise it returns the cached image which was
+// built from the most of the same refs, or an empty string if there is none.
+func (c *BuildCache) Lookup(repos map[string]string, env []string) (image string, exact bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	commits := true
+	for _, ref := range repos {
+		commits = commits && isCommit(ref)
+	}
+	key := buildCacheKey(repos, env)
+	var best *cacheEntry
+	var bestShared int
+	for _, e := range c.entries() {
+		if e.Key == key && commits {
+			c.touch(e)
+			cacheHit("build", 0)
+			return c.image(key), true
+		}
+		var shared int
+		for repo, ref := range e.Repos {
+			if isCommit(ref) && repos[repo] == ref {
+				shared++
+			}
+		}
+		if shared > bestShared || best == nil || (shared == bestShared && e.Used.After(best.Used)) {
+			best, bestShared = e, shared
+		}
+	}
+	cacheMiss("build")
+	if best == nil {
+		return "", false
+	}
+	c.touch(best)
+	return c.image(best.Key), false
+}
+
+// Put stores a flattened copy of the image built from repos with env, and
+// evicts the least recently used images beyond Size which aren't referenced
+// or in use.
+func (c *BuildCache) Put(repos map[string]string, env []string, image string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	key := buildCacheKey(repos, env)
+	tmp := c.image(key) + ".tmp"
+	if out, err := exec.Command("qemu-img", "convert", "-O", "qcow2", image, tmp).CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not copy %s to the build cache: %s: %s", image, err, out)
+	}
+	if err := sealImage(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, c.image(key)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	c.touch(&cacheEntry{Key: key, Repos: repos})
+
+	entries := c.entries()
+	if len(entries) <= c.Size {
+		return nil
+	}
+	sort.Sort(sort.Reverse(byUsed(entries)))
+	for _, e := range entries[c.Size:] {
+		c.remove(e)
+	}
+	return nil
+}
+
+// remove deletes the image of e unless it is referenced or in use.
+func (c *BuildCache) remove(e *cacheEntry) bool {
+	if !RemoveImage(c.image(e.Key)) {
+		return false
+	}
+	os.Remove(c.meta(e.Key))
+	return true
+}
+
+// GC removes the images which haven't been used for maxAge and aren't
+// referenced or in use, returning how many were removed.
+func (c *BuildCache) GC(maxAge time.Duration) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var n int
+	for _, e := range c.entries() {
+		if time.Since(e.Used) > maxAge && c.remove(e) {
+			n++
+		}
+	}
+	return n
+}
+
+// PruneOldest removes the least recently used image which isn't referenced
+// or in use, to free disk space, returning false if there is none.
+func (c *BuildCache) PruneOldest() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	entries := c.entries()
+	sort.Sort(byUsed(entries))
+	for _, e := range entries {
+		if c.remove(e) {
+			return true
+		}
+	}
+	return false
+}
+
+type byUsed []*cacheEntry
+
+func (b byUsed) Len() int           { return len(b) }
+func (b byUsed) Less(i, j int) bool { return b[i].Used.Before(b[j].Used) }
+func (b byUsed) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Find returns the most recently used cached image built with a repo at a
+// commit starting with commit, or an empty string if there is none.
+func (c *BuildCache) Find(commit string) string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	entries := c.entries()
+	sort.Sort(sort.Reverse(byUsed(entries)))
+	for _, e := range entries {
+		for _, ref := range e.Repos {
+			if isCommit(ref) && strings.HasPrefix(ref, commit) {
+				return c.image(e.Key)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,299 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// Builder is a booted and provisioned build instance. BuildFlynn uses a
+// builder for a single build, but a builder can also be kept running and
+// reused, so that repo checkouts, build caches and docker layers from
+// earlier builds are reused.
+type Builder struct {
+	c    *Cluster
+	inst Instance
+
+	mtx    sync.Mutex
+	builds int
+
+	// the repos, urls and env of the last build, which RunStep reruns steps
+	// of
+	repos map[string]string
+	urls  map[string]string
+	env   []string
+}
+
+// NewBuilder boots a build instance with a COW derivation of dockerFS, or a
+// new empty fs if it is empty, for docker data.
+func (c *Cluster) NewBuilder(dockerFS string) (*Builder, error) {
+	if err := c.setup(); err != nil {
+		return nil, err
+	}
+	uid, gid, err := lookupUser(c.bc.User)
+	if err != nil {
+		return nil, err
+	}
+	role, err := c.bc.Role("builder")
+	if err != nil {
+		return nil, err
+	}
+
+	dockerDrive := VMDrive{FS: dockerFS, COW: true, Temp: false}
+	if dockerDrive.FS == "" {
+		// store docker data on a layer of an empty fs image
+		if dockerDrive.FS, err = emptyDockerFS(role.DiskSize, uid, gid); err != nil {
+			return nil, err
+		}
+	}
+
+	conf := role.vmConfig(0)
+	c.setKernel(conf)
+	conf.CrashDumpDir = c.bc.CrashDumpDir
+	conf.User = uid
+	conf.Group = gid
+	conf.Drives["hda"] = &VMDrive{FS: c.bc.RootFS, COW: true, Temp: true, DiskSize: role.RootSize}
+	conf.Drives["hdb"] = &dockerDrive
+	if c.bc.GitMirror != "" {
+		if conf.SharedDirs == nil {
+			conf.SharedDirs = make(map[string]string)
+		}
+		conf.SharedDirs["gitmirror"] = c.bc.GitMirror
+	}
+	if c.ForwardAgent {
+		conf.AgentSocket = os.Getenv("SSH_AUTH_SOCK")
+		if conf.AgentSocket == "" {
+			return nil, errors.New("cluster: agent forwarding enabled but SSH_AUTH_SOCK is not set")
+		}
+	}
+	inst, err := c.backend.NewInstance(conf)
+	if err != nil {
+		return nil, err
+	}
+	c.log("Booting build instance...")
+	if err := inst.Start(); err != nil {
+		return nil, fmt.Errorf("error starting build instance: %s", err)
+	}
+
+	c.log("Waiting for instance to boot...")
+	if err := c.checkClock(inst); err != nil {
+		inst.Kill()
+		return nil, err
+	}
+	if err := c.provision(inst, role); err != nil {
+		inst.Kill()
+		return nil, fmt.Errorf("error provisioning build instance: %s", err)
+	}
+	return &Builder{c: c, inst: inst}, nil
+}
+
+// Build runs a build of repos on a running builder, writing its output to
+// out, and returns a copy of the resulting docker fs which the builder
+// doesn't use.
+func (b *Builder) Build(repos, urls map[string]string, env []string, out io.Writer) (string, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.builds > 0 {
+		if err := b.prepare(out); err != nil {
+			return "", err
+		}
+	}
+	b.builds++
+	if err := b.run(repos, urls, env, out); err != nil {
+		return "", err
+	}
+
+	fmt.Fprintln(out, "Copying docker fs from build instance...")
+	return copyDockerFS(b.inst.Drive("hdb").FS)
+}
+
+// copyDockerFS copies the docker fs image src, flattening any backing
+// images, to a sealed image in a new temp dir.
+func copyDockerFS(src string) (string, error) {
+	dir, err := ioutil.TempDir("", "dockerfs-")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "fs.img")
+	if output, err := exec.Command("qemu-img", "convert", "-O", "qcow2", src, path).CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("could not copy docker fs: %s: %s", err, output)
+	}
+	if err := sealImage(path); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return path, nil
+}
+
+// DiffImage writes the clusters of image which differ from base to a qcow2
+// layer in a new temp dir, so that an image built on base can be distributed
+// as base plus the layer. The layer's backing file is set to backing, the
+// name which it expects base to be kept as beside it.
+func DiffImage(base, image, backing string) (string, error) {
+	dir, err := ioutil.TempDir("", "layer-")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "layer.qcow2")
+	if output, err := exec.Command("qemu-img", "convert", "-O", "qcow2", "-B", base, image, path).CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("could not diff image: %s: %s", err, output)
+	}
+	if output, err := exec.Command("qemu-img", "rebase", "-u", "-b", backing, path).CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("could not set backing file of layer: %s: %s", err, output)
+	}
+	return path, nil
+}
+
+// warmScript pulls the base images of the Dockerfiles of the built repos and
+// the images of the bootstrap manifest which the build doesn't produce, so
+// that builds and bootstraps starting from the docker fs don't pull them.
+const warmScript = `
+flynn=/var/lib/docker/flynn/go/src/github.com/flynn
+mountpoint -q /var/lib/docker || sudo mount /var/lib/docker
+sudo start docker || true
+bases=$(cat $flynn/*/Dockerfile $flynn/*/*/Dockerfile 2>/dev/null | awk '$1 == "FROM" { print $2 }')
+manifest=$(sudo docker run --rm --entrypoint cat flynn/bootstrap /etc/manifest.json 2>/dev/null | grep -o '"image": *"[^"]*"' | cut -d '"' -f 4)
+for image in $bases; do
+  sudo docker pull $image
+done
+for image in $manifest; do
+  sudo docker inspect $image >/dev/null 2>&1 || sudo docker pull $image
+done
+sudo stop docker
+sudo umount /var/lib/docker
+`
+
+// WarmImages boots a build instance with a copy-on-write layer of dockerFS,
+// pre-pulls the images builds of it would otherwise pull, and returns a
+// standalone copy of the resulting docker fs.
+func WarmImages(bc BootConfig, dockerFS string, out io.Writer) (string, error) {
+	if dockerFS == "" {
+		return "", errors.New("cluster: no docker fs to warm")
+	}
+	c := New(bc, out)
+	defer func() {
+		c.Shutdown()
+		CleanupRun(c.bc.RunID)
+	}()
+	b, err := c.NewBuilder(dockerFS)
+	if err != nil {
+		return "", err
+	}
+	c.log("Pulling images...")
+	if err := b.inst.Run(warmScript, attempts, out, out); err != nil {
+		b.inst.Kill()
+		return "", fmt.Errorf("error pulling images: %s", err)
+	}
+	if err := b.inst.Shutdown(); err != nil {
+		return "", fmt.Errorf("error while stopping build instance: %s", err)
+	}
+	layer := b.inst.Drive("hdb").FS
+	defer os.RemoveAll(filepath.Dir(layer))
+	return copyDockerFS(layer)
+}
+
+// prepare mounts the docker fs and starts docker, which the build script
+// stops when finishing.
+func (b *Builder) prepare(out io.Writer) error {
+	prepare := "mountpoint -q /var/lib/docker || sudo mount /var/lib/docker\nsudo start docker || true\n"
+	if err := b.inst.Run(prepare, attempts, out, out); err != nil {
+		return fmt.Errorf("error preparing build instance: %s", err)
+	}
+	return nil
+}
+
+// RunStep reruns the build of repo from the last build on the builder,
+// without starting a new build, for debugging build failures.
+func (b *Builder) RunStep(repo string, out io.Writer) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if _, ok := b.repos[repo]; !ok {
+		return fmt.Errorf("unknown build step %q", repo)
+	}
+	if err := b.prepare(out); err != nil {
+		return err
+	}
+	script, err := b.c.buildScript(b.repos, b.urls, b.env, repo)
+	if err != nil {
+		return err
+	}
+	if err := b.inst.Run(script, attempts, out, out); err != nil {
+		return fmt.Errorf("error running build step %s: %s", repo, err)
+	}
+	return nil
+}
+
+// Builds returns the number of builds the builder has run.
+func (b *Builder) Builds() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.builds
+}
+
+func (b *Builder) run(repos, urls map[string]string, env []string, out io.Writer) error {
+	b.repos, b.urls, b.env = repos, urls, env
+	if b.c.bc.GitMirror != "" {
+		if err := updateMirrors(b.c.bc.GitMirror, repos, out); err != nil {
+			fmt.Fprintf(out, "%s, cloning from a stale mirror\n", err)
+		}
+	}
+	for repo, src := range b.c.Sources {
+		if _, ok := repos[repo]; !ok {
+			continue
+		}
+		fmt.Fprintf(out, "Fetching the source of %s...\n", repo)
+		if err := src.Fetch(b.inst, guestSrcDir+"/"+repo, out); err != nil {
+			return fmt.Errorf("could not fetch the source of %s: %s", repo, err)
+		}
+	}
+	script, err := b.c.buildScript(repos, urls, env, "")
+	if err != nil {
+		return err
+	}
+	if err := b.c.runWithTimeout(b.inst, "build", b.c.bc.BuildTimeout, func() error {
+		return b.inst.Run(script, attempts, out, out)
+	}); err != nil {
+		if _, ok := err.(*TimeoutError); ok {
+			return err
+		}
+		return fmt.Errorf("error running build script: %s", err)
+	}
+	if b.c.registry != nil {
+		fmt.Fprintln(out, "Pushing images to the registry...")
+		return b.c.pushImages(b.inst, out)
+	}
+	return nil
+}
+
+// Close stops the builder and shuts down its cluster.
+func (b *Builder) Close() {
+	b.inst.Kill()
+	b.c.Shutdown()
+}
+
+// SaveDockerFS copies the docker fs of the cluster's first instance to a
+// sealed image in a new temp dir, syncing the guest's disks and pausing it
+// while it is copied.
+func (c *Cluster) SaveDockerFS() (string, error) {
+	if len(c.instances) == 0 {
+		return "", errors.New("cluster: no instances to save the docker fs of")
+	}
+	inst := c.instances[0]
+	if err := inst.Run("sync", attempts, c.out, c.out); err != nil {
+		return "", err
+	}
+	if err := inst.Pause(); err != nil {
+		return "", err
+	}
+	defer inst.Resume()
+	return copyDockerFS(inst.Drive("hdb").FS)
+}
@@ -0,0 +1,57 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+)
+
+// Size returns the number of instances in the cluster.
+func (c *Cluster) Size() int {
+	return len(c.instances)
+}
+
+// RestartInstance resets instance i like a power cycle, then starts its
+// flynn-host container again once docker is back up, which fails while it
+// isn't so the command is retried.
+func (c *Cluster) RestartInstance(i int) error {
+	c.event("restarting instance %d", i)
+	if err := c.instances[i].Reset(); err != nil {
+		return err
+	}
+	return c.instances[i].Run(`id=$(docker ps -a | awk '/flynn\/host/ { print $1 }') && test -n "$id" && docker start $id`, attempts, c.out, c.out)
+}
+
+// Partition drops all traffic between instances i and j until Heal is
+// called.
+func (c *Cluster) Partition(i, j int) error {
+	c.event("partitioning instances %d and %d", i, j)
+	return c.partition("-I", i, j)
+}
+
+func (c *Cluster) Heal(i, j int) error {
+	c.event("healing partition between instances %d and %d", i, j)
+	return c.partition("-D", i, j)
+}
+
+func (c *Cluster) partition(op string, i, j int) error {
+	for _, p := range [][2]int{{i, j}, {j, i}} {
+		command := fmt.Sprintf("sudo iptables %s INPUT -s %s -j DROP", op, c.instances[p[1]].IP())
+		if err := c.instances[p[0]].Run(command, attempts, c.out, c.out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddLatency delays all packets sent by instance i by d until RemoveLatency
+// is called.
+func (c *Cluster) AddLatency(i int, d time.Duration) error {
+	c.event("adding %s latency to instance %d", d, i)
+	command := fmt.Sprintf("sudo tc qdisc add dev eth0 root netem delay %dms", d/time.Millisecond)
+	return c.instances[i].Run(command, attempts, c.out, c.out)
+}
+
+func (c *Cluster) RemoveLatency(i int) error {
+	c.event("removing latency from instance %d", i)
+	return c.instances[i].Run("sudo tc qdisc del dev eth0 root netem", attempts, c.out, c.out)
+}
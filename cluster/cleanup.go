@@ -0,0 +1,211 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// liveClusters are the clusters which have host resources, so they can be
+// torn down if the process is interrupted.
+var (
+	liveMtx      sync.Mutex
+	liveClusters = make(map[*Cluster]struct{})
+)
+
+func trackCluster(c *Cluster) {
+	liveMtx.Lock()
+	defer liveMtx.Unlock()
+	liveClusters[c] = struct{}{}
+}
+
+func untrackCluster(c *Cluster) {
+	liveMtx.Lock()
+	defer liveMtx.Unlock()
+	delete(liveClusters, c)
+}
+
+// RunConsoleTails returns the latest n console lines of the instances of the
+// running clusters booted with runID, keyed by IP, or nil if there are none.
+func RunConsoleTails(runID string, n int) map[string][]string {
+	liveMtx.Lock()
+	defer liveMtx.Unlock()
+	var tails map[string][]string
+	for c := range liveClusters {
+		if c.bc.RunID != runID {
+			continue
+		}
+		if tails == nil {
+			tails = make(map[string][]string)
+		}
+		for ip, lines := range c.ConsoleTails(n) {
+			tails[ip] = lines
+		}
+	}
+	return tails
+}
+
+// ShutdownRun shuts down the running clusters booted with runID, returning
+// how many there were.
+func ShutdownRun(runID string) int {
+	liveMtx.Lock()
+	var clusters []*Cluster
+	for c := range liveClusters {
+		if c.bc.RunID == runID {
+			clusters = append(clusters, c)
+		}
+	}
+	liveMtx.Unlock()
+	for _, c := range clusters {
+		c.Shutdown()
+	}
+	return len(clusters)
+}
+
+// ShutdownAll shuts down every cluster which hasn't been shut down, killing
+// their qemu processes and removing their taps, bridges and temp files, then
+// removes the run dirs.
+func ShutdownAll() {
+	liveMtx.Lock()
+	clusters := make([]*Cluster, 0, len(liveClusters))
+	for c := range liveClusters {
+		clusters = append(clusters, c)
+	}
+	liveMtx.Unlock()
+	for _, c := range clusters {
+		c.Shutdown()
+	}
+	resourcesMtx.Lock()
+	var runs []string
+	for runID := range runDirs {
+		runs = append(runs, runID)
+	}
+	resourcesMtx.Unlock()
+	for _, runID := range runs {
+		CleanupRun(runID)
+	}
+}
+
+// HandleSignals shuts down all clusters and exits when the process receives
+// SIGINT or SIGTERM.
+func HandleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		fmt.Fprintf(os.Stderr, "received %s, shutting down clusters\n", sig)
+		ShutdownAll()
+		os.Exit(1)
+	}()
+}
+
+// CleanupOnPanic shuts down all clusters if the calling goroutine panics,
+// before continuing to panic. It must be deferred.
+func CleanupOnPanic() {
+	if err := recover(); err != nil {
+		ShutdownAll()
+		panic(err)
+	}
+}
+
+// CleanupOrphans removes the qemu processes, taps, bridges, loop devices, run
+// dirs in workdir and temp docker fs images and registries left behind by
+// runs which crashed, except the image keep, writing what it removes to out.
+// Taps and bridges are found by the prefixes of bc. It must not be called
+// while clusters are running.
+func CleanupOrphans(bc BootConfig, keep string, out io.Writer) error {
+	workdir := bc.Workdir
+	tapPrefix, bridgePrefix := bc.TapPrefix, bc.BridgePrefix
+	if tapPrefix == "" {
+		tapPrefix = DefaultTapPrefix
+	}
+	if bridgePrefix == "" {
+		bridgePrefix = DefaultBridgePrefix
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	for _, iface := range ifaces {
+		if !strings.HasPrefix(iface.Name, tapPrefix) {
+			continue
+		}
+		for _, pid := range qemuProcesses(iface.Name) {
+			fmt.Fprintf(out, "killing qemu process %s\n", pid)
+			if n, err := strconv.Atoi(pid); err == nil {
+				syscall.Kill(n, syscall.SIGKILL)
+			}
+		}
+		fmt.Fprintf(out, "removing tap %s\n", iface.Name)
+		if err := deleteTap(iface.Name); err != nil {
+			fmt.Fprintf(out, "could not remove tap %s: %s\n", iface.Name, err)
+		}
+	}
+	for _, iface := range ifaces {
+		if !strings.HasPrefix(iface.Name, bridgePrefix) {
+			continue
+		}
+		fmt.Fprintf(out, "removing bridge %s\n", iface.Name)
+		iface := iface
+		if err := deleteBridge(&Bridge{name: iface.Name, iface: &iface}); err != nil {
+			fmt.Fprintf(out, "could not remove bridge %s: %s\n", iface.Name, err)
+		}
+	}
+
+	if workdir == "" {
+		workdir = os.TempDir()
+	}
+	runsDir := filepath.Join(workdir, "runs")
+	runs, err := ioutil.ReadDir(runsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(runs) > 0 {
+		detachLoops(runsDir, out)
+	}
+	for _, run := range runs {
+		path := filepath.Join(runsDir, run.Name())
+		fmt.Fprintf(out, "removing run dir %s\n", path)
+		if err := os.RemoveAll(path); err != nil {
+			fmt.Fprintf(out, "could not remove run dir %s: %s\n", path, err)
+		}
+	}
+
+	for _, pattern := range []string{"dockerfs-*", "registry-*"} {
+		paths, _ := filepath.Glob(filepath.Join(os.TempDir(), pattern))
+		for _, path := range paths {
+			if keep != "" && (path == keep || strings.HasPrefix(keep, path+"/")) {
+				continue
+			}
+			fmt.Fprintf(out, "removing %s\n", path)
+			if err := os.RemoveAll(path); err != nil {
+				fmt.Fprintf(out, "could not remove %s: %s\n", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// detachLoops detaches loop devices backed by files under dir.
+func detachLoops(dir string, out io.Writer) {
+	output, _ := exec.Command("losetup", "-a").Output()
+	for _, line := range strings.Split(string(output), "\n") {
+		if !strings.Contains(line, "("+dir+"/") {
+			continue
+		}
+		dev := strings.SplitN(line, ":", 2)[0]
+		fmt.Fprintf(out, "detaching loop device %s\n", dev)
+		if output, err := exec.Command("losetup", "-d", dev).CombinedOutput(); err != nil {
+			fmt.Fprintf(out, "could not detach loop device %s: %s: %s\n", dev, err, output)
+		}
+	}
+}
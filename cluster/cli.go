@@ -0,0 +1,128 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// InstallCLI copies the flynn CLI binary at path into a sandbox directory,
+// with its own HOME and a flynnrc configured for the cluster, which is used
+// by FlynnCLI and removed on Shutdown.
+func (c *Cluster) InstallCLI(path string) error {
+	if c.ControllerDomain == "" {
+		return errors.New("cluster: controller not bootstrapped")
+	}
+	runDir, err := RunDir(c.bc.Workdir, c.bc.RunID)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir(runDir, "cli-")
+	if err != nil {
+		return err
+	}
+	c.cliDir = dir
+	for _, d := range []string{"bin", "home"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			return err
+		}
+	}
+	if err := copyFile(path, filepath.Join(dir, "bin", "flynn"), 0755); err != nil {
+		return fmt.Errorf("cluster: could not install CLI: %s", err)
+	}
+
+	githost := fmt.Sprintf("%s:2222", c.ControllerDomain)
+	url := fmt.Sprintf("https://%s:443", c.ControllerDomain)
+	if out, err := c.FlynnCLI("server-add", "-g", githost, "-p", c.ControllerPin, "default", url, c.ControllerKey); err != nil {
+		return fmt.Errorf("cluster: flynn server-add failed: %s: %s", err, out)
+	}
+	return nil
+}
+
+// Flynnrc returns the path of the flynnrc created by InstallCLI.
+func (c *Cluster) Flynnrc() string {
+	return filepath.Join(c.cliDir, "flynnrc")
+}
+
+// RemoveCLI removes the sandbox created by InstallCLI, if there is one.
+func (c *Cluster) RemoveCLI() {
+	if c.cliDir != "" {
+		os.RemoveAll(c.cliDir)
+		c.cliDir = ""
+	}
+}
+
+// CLIEnv returns the environment CLI commands run with: the sandbox HOME,
+// FLYNNRC and the CLI first in PATH.
+func (c *Cluster) CLIEnv() []string {
+	return sandboxEnv(c.cliDir)
+}
+
+// SandboxCommand returns a command running the CLI of the sandbox which
+// flynnrc was created in by InstallCLI, with the sandbox's environment, or
+// nil if flynnrc isn't in a sandbox. It lets the tests, which are only given
+// the flynnrc, run the CLI of the cluster's sandbox.
+func SandboxCommand(flynnrc string, args ...string) *exec.Cmd {
+	dir := filepath.Dir(flynnrc)
+	bin := filepath.Join(dir, "bin", "flynn")
+	if filepath.Base(flynnrc) != "flynnrc" {
+		return nil
+	}
+	if _, err := os.Stat(bin); err != nil {
+		return nil
+	}
+	cmd := exec.Command(bin, args...)
+	cmd.Env = sandboxEnv(dir)
+	return cmd
+}
+
+func sandboxEnv(dir string) []string {
+	env := []string{
+		"HOME=" + filepath.Join(dir, "home"),
+		"FLYNNRC=" + filepath.Join(dir, "flynnrc"),
+		"PATH=" + filepath.Join(dir, "bin") + ":" + os.Getenv("PATH"),
+	}
+	for _, e := range os.Environ() {
+		switch strings.SplitN(e, "=", 2)[0] {
+		case "HOME", "FLYNNRC", "PATH":
+		default:
+			env = append(env, e)
+		}
+	}
+	return env
+}
+
+// FlynnCLI runs the installed CLI against the cluster, returning its
+// combined output.
+func (c *Cluster) FlynnCLI(args ...string) ([]byte, error) {
+	if c.cliDir == "" {
+		return nil, errors.New("cluster: CLI not installed")
+	}
+	cmd := SandboxCommand(c.Flynnrc(), args...)
+	if cmd == nil {
+		return nil, errors.New("cluster: CLI sandbox is missing the CLI")
+	}
+	return cmd.CombinedOutput()
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,81 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxClockSkew is the largest difference between the clocks of a guest and
+// the host which is left alone. Guests whose clocks are further off, such as
+// those of images without a working RTC or NTP, are set to the host's time
+// before anything runs in them, as a skewed clock makes the certificates of
+// the controller and registry invalid and fails bootstrapping in ways which
+// look unrelated.
+var maxClockSkew = 2 * time.Second
+
+// clockRoundTrip is the longest a clock measurement may take, as the guest's
+// time is compared with the host's halfway through it. The first run of a
+// guest waits for it to boot, so is taken again.
+const clockRoundTrip = time.Second
+
+// ClockSkewError is returned when the clock of a guest is skewed and can't
+// be corrected, which is a fault of the rootfs image rather than of the code
+// under test.
+type ClockSkewError struct {
+	Instance string
+	Skew     time.Duration
+}
+
+func (e *ClockSkewError) Error() string {
+	return fmt.Sprintf("the clock of guest %s is %s off the host's and could not be corrected", e.Instance, e.Skew)
+}
+
+// guestClockSkew returns how far ahead of the host's clock the clock of inst
+// is.
+func (c *Cluster) guestClockSkew(inst Instance) (time.Duration, error) {
+	for i := 0; ; i++ {
+		var out bytes.Buffer
+		start := time.Now()
+		if err := inst.Run("date -u +%s.%N", attempts, &out, c.out); err != nil {
+			return 0, err
+		}
+		rtt := time.Since(start)
+		if rtt > clockRoundTrip && i < 3 {
+			continue
+		}
+		secs, err := strconv.ParseFloat(strings.TrimSpace(out.String()), 64)
+		if err != nil {
+			return 0, fmt.Errorf("could not read the clock of guest %s: %q", inst.IP(), out.String())
+		}
+		guest := time.Unix(0, int64(secs*float64(time.Second)))
+		return guest.Sub(start.Add(rtt / 2)), nil
+	}
+}
+
+// checkClock compares the clock of inst with the host's on first connecting
+// to it, setting the guest's clock if it is more than maxClockSkew off.
+func (c *Cluster) checkClock(inst Instance) error {
+	skew, err := c.guestClockSkew(inst)
+	if err != nil {
+		return err
+	}
+	if skew < maxClockSkew && skew > -maxClockSkew {
+		return nil
+	}
+	c.logf("clock of guest %s is %s off the host's, setting it\n", inst.IP(), skew)
+	c.event("clock of %s was %s off", inst.IP(), skew)
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	if err := inst.Run(fmt.Sprintf("sudo date -u -s @%.3f >/dev/null", now), attempts, c.out, c.out); err != nil {
+		return &ClockSkewError{Instance: inst.IP(), Skew: skew}
+	}
+	if skew, err = c.guestClockSkew(inst); err != nil {
+		return err
+	}
+	if skew >= maxClockSkew || skew <= -maxClockSkew {
+		return &ClockSkewError{Instance: inst.IP(), Skew: skew}
+	}
+	return nil
+}
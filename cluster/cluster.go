@@ -5,26 +5,355 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
 	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
+	"github.com/flynn/flynn-test/assets"
 	"github.com/flynn/flynn-test/util"
 	"github.com/flynn/go-discoverd"
-	"github.com/flynn/go-flynn/attempt"
 )
 
 type BootConfig struct {
 	User     string
 	RootFS   string
 	Kernel   string
+	Initrd   string
 	Network  string
 	NatIface string
+
+	// BridgePrefix and TapPrefix name the cluster's bridge and the taps of
+	// its instances, defaulting to DefaultBridgePrefix and
+	// DefaultTapPrefix, for hosts whose other virtualization tooling uses
+	// those names.
+	BridgePrefix string
+	TapPrefix    string
+
+	// InjectDiscovery is a comma separated list of the DiscoveryMethods by
+	// which instances booted once the cluster is bootstrapped are told
+	// where its discoverd and etcd are.
+	InjectDiscovery string
+
+	// MTU is the MTU of the cluster network, its bridge, taps and guest
+	// interfaces, such as 9000 for jumbo frames, or zero for the kernel
+	// default. TCP connections out of a network with jumbo frames have
+	// their MSS clamped, so they are NATed out of NatIface with standard
+	// frames.
+	MTU int
+
+	// ImageCatalog is the path of the catalog written by rootfs/build.sh,
+	// used to verify the kernel and initrd before booting. Verification is
+	// skipped if the catalog doesn't exist.
+	ImageCatalog string
+
+	// RunID and Workdir are exposed to VMConfig templates. RunID defaults
+	// to a random string and Workdir to the system temp dir.
+	RunID   string
+	Workdir string
+
+	// GitMirror is a directory of bare repo mirrors kept up to date on the
+	// host and shared with the build instance to speed up cloning.
+	GitMirror string
+
+	// NetbootRoot is a directory of boot files served to instances of roles
+	// with Netboot set. The netboot server only runs if it is set.
+	NetbootRoot string
+
+	// CrashDumpDir is where instance memory is dumped if a guest kernel
+	// panics, and may contain VMConfig placeholders.
+	CrashDumpDir string
+
+	// Harness is the path of the guest harness binary, which is installed
+	// in instances as they are provisioned if set, see RunGuestTests.
+	Harness string
+
+	// Roles overrides the resources of the default instance roles.
+	Roles map[string]*Role
+
+	// BootProfiles adds to or overrides DefaultBootProfiles, for roles
+	// booting other guests.
+	BootProfiles map[string]*BootProfile
+
+	// RestrictEgress limits instances to sending traffic to the CIDRs and
+	// hostnames in EgressAllow, blocking everything else including the host
+	// and its LAN, for runs of untrusted code.
+	RestrictEgress bool
+	EgressAllow    []string
+
+	// Confine runs QEMU under seccomp and a per-instance AppArmor profile.
+	Confine bool
+
+	// Backend is how instances are provisioned, either "qemu" to run QEMU
+	// directly, the default, "libvirt" to define libvirt domains through
+	// LibvirtURI, or "remote" to run QEMU over SSH on RemoteHost, a comma
+	// separated list of hosts, keeping instance files in RemoteDir there,
+	// see RemoteBackend.
+	Backend    string
+	LibvirtURI string
+	RemoteHost string
+	RemoteDir  string
+
+	// Placement constrains which of several remote hosts instances run on:
+	// "colocate" runs every instance on the first host, for a low latency
+	// cluster network, and "spread" runs each on a different host, for
+	// host failure tests. By default instances are spread as evenly as the
+	// hosts allow.
+	Placement string
+
+	// Macvtap is a host NIC instances are attached to as eth1 through
+	// macvtap devices, bypassing the bridge and NAT, see VMManager. It
+	// can't be combined with RestrictEgress.
+	Macvtap string
+
+	// Seed seeds the random names of the cluster's bridge, taps and
+	// controller domain so that a run can be replayed. It is combined with
+	// Network so concurrent clusters of a run get distinct names.
+	Seed int64
+
+	// SSHUser is the user commands are run as in instances, defaulting to
+	// ubuntu. SSHKey is the path of a private key which is also tried, for
+	// root filesystems which don't install the per-run key.
+	SSHUser string
+	SSHKey  string
+
+	// BuildScript is the path of a template replacing the built in script
+	// which builds repos in the build instance.
+	BuildScript string
+
+	// Registry is the run's docker registry, which builders push images
+	// to and instances pull them from if it has any, each booting with an
+	// empty docker fs rather than a copy of the built one.
+	Registry *Registry
+
+	// Labels tag the resources the run creates, see Labels.
+	Labels Labels
+
+	// ReservedIPs maps names to IPs of the cluster subnet reserved before
+	// any instance boots, see ReserveIP. An empty IP reserves any free one.
+	ReservedIPs map[string]string
+
+	// Resources is shared by the clusters booted on the host to limit
+	// their instances.
+	Resources *ResourcePool
+
+	// ConsoleLines is the number of console lines of each instance kept in
+	// memory, see Instance.ConsoleTail.
+	ConsoleLines int
+
+	// BootTimeout and SSHTimeout bound how long instances are given to
+	// show they have booted on the console and then to accept ssh, and
+	// BuildTimeout how long the build script may run. Instances which
+	// exceed them fail with a *TimeoutError. Guests which don't show they
+	// have booted are dialed anyway unless BootTimeout is set.
+	BootTimeout  time.Duration
+	SSHTimeout   time.Duration
+	BuildTimeout time.Duration
+}
+
+// Role describes the resources given to instances which fill a particular
+// role in a cluster.
+type Role struct {
+	Memory string `json:"memory"`
+	Cores  int    `json:"cores"`
+
+	// Boot names the boot profile of the role's guest OS, defaulting to
+	// DefaultBootProfile.
+	Boot string `json:"boot"`
+
+	// Kernel and Initrd override those of the BootConfig.
+	Kernel string `json:"kernel"`
+	Initrd string `json:"initrd"`
+
+	// Drives are extra fs images attached copy-on-write to the instance,
+	// keyed by QEMU drive name such as "hdc", as hda and hdb hold the root
+	// and docker filesystems. Paths may contain placeholders.
+	Drives map[string]string `json:"drives"`
+
+	// DiskSize is the size in bytes of the docker filesystem created for
+	// the instance, used by the builder and instances which pull their
+	// images from a Registry.
+	DiskSize int64 `json:"disk_size"`
+
+	// RootSize is the size in bytes the root filesystem is grown to on
+	// first boot, for builds which need more space than the root fs image
+	// has.
+	RootSize int64 `json:"root_size"`
+
+	// Args and SharedDirs are added to the instance's VMConfig, and may
+	// contain placeholders such as {{.RunID}} and {{.InstanceIndex}}.
+	Args       []string          `json:"args"`
+	SharedDirs map[string]string `json:"shared_dirs"`
+
+	Netboot   bool   `json:"netboot"`
+	BootOrder string `json:"boot_order"`
+
+	// Devices are host devices passed through to the instance, see
+	// ValidateDevice for the format.
+	Devices []string `json:"devices"`
+
+	// CPU is the QEMU CPU model, and NestedVirt exposes the host's
+	// virtualization extensions so that the guest can run KVM.
+	CPU        string `json:"cpu"`
+	NestedVirt bool   `json:"nested_virt"`
+
+	// HugePages backs the instance's memory with huge pages, which must be
+	// reserved on the host. Prealloc allocates all of it at boot.
+	HugePages bool `json:"hugepages"`
+	Prealloc  bool `json:"prealloc"`
+
+	// CPUSets pin the QEMU process of each instance to host CPUs, the nth
+	// instance of the role using CPUSets[n % len(CPUSets)].
+	CPUSets []string `json:"cpusets"`
+
+	// Swap is the size in MB of a swap file created in the instance after
+	// boot, and Sysctl are kernel parameters set at the same time.
+	Swap   int               `json:"swap"`
+	Sysctl map[string]string `json:"sysctl"`
+
+	// After names roles whose instances are started first and must be
+	// reachable over SSH before those of this role start, e.g. to boot
+	// workers once the discovery node is up. AfterTimeout is how long in
+	// seconds to wait for each, defaulting to five minutes.
+	After        []string `json:"after"`
+	AfterTimeout int      `json:"after_timeout"`
+
+	boot *BootProfile
+}
+
+// vmConfig returns a VMConfig with the resources of the role for the index'th
+// instance with that role.
+func (r *Role) vmConfig(index int) *VMConfig {
+	c := &VMConfig{
+		Kernel: r.Kernel,
+		Initrd: r.Initrd,
+		Memory: r.Memory,
+		Cores:  r.Cores,
+		Boot:   r.boot,
+		Drives: make(map[string]*VMDrive, len(r.Drives)+2),
+		Args:   append([]string(nil), r.Args...),
+
+		Netboot:   r.Netboot,
+		BootOrder: r.BootOrder,
+		Devices:   append([]string(nil), r.Devices...),
+
+		CPU:        r.CPU,
+		NestedVirt: r.NestedVirt,
+		HugePages:  r.HugePages,
+		Prealloc:   r.Prealloc,
+	}
+	if len(r.CPUSets) > 0 {
+		c.CPUSet = r.CPUSets[index%len(r.CPUSets)]
+	}
+	for name, fs := range r.Drives {
+		c.Drives[name] = &VMDrive{FS: fs, COW: true, Temp: true}
+	}
+	if len(r.SharedDirs) > 0 {
+		c.SharedDirs = make(map[string]string, len(r.SharedDirs))
+		for tag, path := range r.SharedDirs {
+			c.SharedDirs[tag] = path
+		}
+	}
+	return c
+}
+
+var DefaultRoles = map[string]*Role{
+	"builder": {Memory: "2048", Cores: 4, DiskSize: 17179869184},
+	"worker":  {Memory: "512", Cores: 1, Swap: 1024, DiskSize: 8589934592},
+	"router":  {Memory: "256", Cores: 1, DiskSize: 4294967296},
+}
+
+// Role returns the named role, with any fields set in bc.Roles overriding the
+// defaults.
+func (bc BootConfig) Role(name string) (*Role, error) {
+	def, isDefault := DefaultRoles[name]
+	override, isOverride := bc.Roles[name]
+	if !isDefault && !isOverride {
+		return nil, fmt.Errorf("cluster: unknown role %q", name)
+	}
+	role := &Role{}
+	if isDefault {
+		*role = *def
+	}
+	if isOverride {
+		if override.Memory != "" {
+			role.Memory = override.Memory
+		}
+		if override.Cores > 0 {
+			role.Cores = override.Cores
+		}
+		if override.Kernel != "" {
+			role.Kernel = override.Kernel
+			role.Initrd = override.Initrd
+		}
+		if len(override.Drives) > 0 {
+			role.Drives = override.Drives
+		}
+		if override.DiskSize > 0 {
+			role.DiskSize = override.DiskSize
+		}
+		if len(override.Args) > 0 {
+			role.Args = override.Args
+		}
+		if len(override.SharedDirs) > 0 {
+			role.SharedDirs = override.SharedDirs
+		}
+		if override.Netboot {
+			role.Netboot = true
+		}
+		if override.BootOrder != "" {
+			role.BootOrder = override.BootOrder
+		}
+		if len(override.Devices) > 0 {
+			role.Devices = override.Devices
+		}
+		if override.CPU != "" {
+			role.CPU = override.CPU
+		}
+		if override.NestedVirt {
+			role.NestedVirt = true
+		}
+		if override.HugePages {
+			role.HugePages = true
+		}
+		if override.Prealloc {
+			role.Prealloc = true
+		}
+		if len(override.CPUSets) > 0 {
+			role.CPUSets = override.CPUSets
+		}
+		if override.Swap > 0 {
+			role.Swap = override.Swap
+		}
+		if len(override.Sysctl) > 0 {
+			role.Sysctl = override.Sysctl
+		}
+		if override.Boot != "" {
+			role.Boot = override.Boot
+		}
+	}
+	var err error
+	if role.boot, err = bc.BootProfile(role.Boot); err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+// WorkerRoles returns the roles for a cluster of count workers.
+func WorkerRoles(count int) []string {
+	roles := make([]string, count)
+	for i := range roles {
+		roles[i] = "worker"
+	}
+	return roles
 }
 
 type Cluster struct {
@@ -32,23 +361,82 @@ type Cluster struct {
 	ControllerPin    string
 	ControllerKey    string
 
+	// RepoURLs overrides the URL repos are fetched from during the build,
+	// keyed by repo name. Repos default to https://github.com/flynn/<repo>.
+	RepoURLs map[string]string
+
+	// Sources fetch the source of repos onto the build instance, which are
+	// then built as they are rather than cloned at their ref.
+	Sources map[string]SourceFetcher
+
+	// BuildEnv is a list of extra KEY=VALUE environment variables exported
+	// by the build script.
+	BuildEnv []string
+
+	// Downloads and PinnedImages are fetched by the build script, which
+	// fails if their checksum or digest doesn't match.
+	Downloads    []*Download
+	PinnedImages []string
+
+	// ForwardAgent forwards the ssh-agent listening on $SSH_AUTH_SOCK into
+	// the build instance, and DeployKey is the path of a private key which is
+	// installed in it, so that private repos can be cloned over SSH.
+	ForwardAgent bool
+	DeployKey    string
+
+	// OnBootFailure is called before the instances are shut down if they
+	// started but the cluster failed to bootstrap, so their logs can be
+	// collected.
+	OnBootFailure func(*Cluster)
+
+	// SyslogPath is a file which the syslog of instances, forwarded to the
+	// host as they run, is appended to. Syslog isn't forwarded if it is
+	// empty.
+	SyslogPath string
+
 	bc        BootConfig
 	vm        *VMManager
+	discovery *Discovery
+	backend   Backend
+	remotes   []*remoteHost
+	rawDisks  []*RawDisk
+	netConfig string
 	instances []Instance
 	out       io.Writer
 	bridge    *Bridge
+	taps      *TapManager
+	netboot   *NetbootServer
+	netServer *NetServer
+	ipam      *IPAM
+	syslog    *SyslogCollector
+	registry  net.Listener
+	cliDir    string
+	verified  bool
+	rand      *rand.Rand
 }
 
 func New(bc BootConfig, out io.Writer) *Cluster {
+	seed := bc.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	} else {
+		h := fnv.New64a()
+		io.WriteString(h, bc.Network)
+		seed ^= int64(h.Sum64())
+	}
 	return &Cluster{
-		bc:  bc,
-		out: out,
+		bc:   bc,
+		out:  out,
+		rand: rand.New(rand.NewSource(seed)),
 	}
 }
 
 func BuildFlynn(bc BootConfig, dockerFS string, repos map[string]string, out io.Writer) (string, error) {
 	c := New(bc, out)
-	defer c.Shutdown()
+	defer func() {
+		c.Shutdown()
+		CleanupRun(c.bc.RunID)
+	}()
 	return c.BuildFlynn(dockerFS, repos)
 }
 
@@ -63,58 +451,31 @@ func (c *Cluster) logf(f string, a ...interface{}) (int, error) {
 func (c *Cluster) BuildFlynn(dockerFS string, repos map[string]string) (string, error) {
 	c.log("Building Flynn...")
 
-	if err := c.setup(); err != nil {
-		return "", err
-	}
-
-	uid, gid, err := lookupUser(c.bc.User)
+	b, err := c.NewBuilder(dockerFS)
 	if err != nil {
 		return "", err
 	}
-
-	dockerDrive := VMDrive{FS: dockerFS, COW: true, Temp: false}
-	if dockerDrive.FS == "" {
-		// create 16GB sparse fs image to store docker data on
-		dockerFS, err := createBtrfs(17179869184, "dockerfs", uid, gid)
-		if err != nil {
-			os.RemoveAll(dockerFS)
-			return "", err
-		}
-		dockerDrive.FS = dockerFS
-		dockerDrive.COW = false
-	}
-
-	build, err := c.vm.NewInstance(&VMConfig{
-		Kernel: c.bc.Kernel,
-		User:   uid,
-		Group:  gid,
-		Memory: "512",
-		Drives: map[string]*VMDrive{
-			"hda": &VMDrive{FS: c.bc.RootFS, COW: true, Temp: true},
-			"hdb": &dockerDrive,
-		},
-	})
-	if err != nil {
+	if err := b.run(repos, c.RepoURLs, c.BuildEnv, c.out); err != nil {
+		b.inst.Kill()
 		return "", err
 	}
-	c.log("Booting build instance...")
-	if err := build.Start(); err != nil {
-		return "", fmt.Errorf("error starting build instance: %s", err)
-	}
-
-	c.log("Waiting for instance to boot...")
-	if err := buildFlynn(build, repos, c.out); err != nil {
-		build.Kill()
-		return "", fmt.Errorf("error running build script: %s", err)
-	}
-
-	if err := build.Kill(); err != nil {
+	if err := b.inst.Shutdown(); err != nil {
 		return "", fmt.Errorf("error while stopping build instance: %s", err)
 	}
-	return build.Drive("hdb").FS, nil
+	fs := b.inst.Drive("hdb").FS
+	if err := sealImage(fs); err != nil {
+		return "", err
+	}
+	return fs, nil
 }
 
 func (c *Cluster) Boot(dockerfs string, count int) error {
+	return c.BootRoles(dockerfs, WorkerRoles(count))
+}
+
+// BootRoles boots and bootstraps a cluster with one instance per entry in
+// roles, each sized according to its role.
+func (c *Cluster) BootRoles(dockerfs string, roles []string) error {
 	if err := c.setup(); err != nil {
 		return err
 	}
@@ -123,113 +484,633 @@ func (c *Cluster) Boot(dockerfs string, count int) error {
 		return err
 	}
 
-	c.log("Booting", count, "instances")
-	for i := 0; i < count; i++ {
-		inst, err := c.vm.NewInstance(&VMConfig{
-			Kernel: c.bc.Kernel,
-			User:   uid,
-			Group:  gid,
-			Memory: "512",
-			Drives: map[string]*VMDrive{
-				"hda": &VMDrive{FS: c.bc.RootFS, COW: true, Temp: true},
-				"hdb": &VMDrive{FS: dockerfs, COW: true, Temp: true},
-			},
-		})
-		if err != nil {
-			c.Shutdown()
-			return fmt.Errorf("error creating instance %d: %s", i, err)
+	var images []string
+	if c.registry != nil {
+		images = c.bc.Registry.Images()
+	}
+	if len(images) > 0 {
+		c.log("Booting", len(roles), "instances with images from the registry")
+	} else {
+		c.log("Booting", len(roles), "instances")
+	}
+	roles, err = c.bc.bootOrder(roles)
+	if err != nil {
+		c.Shutdown()
+		return err
+	}
+	roleCounts := make(map[string]int)
+	roleInstances := make(map[string][]int)
+	ready := make(map[int]bool)
+	instRoles := make([]*Role, 0, len(roles))
+	for i, name := range roles {
+		if err := c.waitAfter(i, name, roleInstances, ready); err != nil {
+			c.bootFailed()
+			return err
 		}
-		if err = inst.Start(); err != nil {
+		inst, role, err := c.startInstance(name, roleCounts[name], dockerfs, images, uid, gid)
+		if err != nil {
 			c.Shutdown()
 			return fmt.Errorf("error starting instance %d: %s", i, err)
 		}
+		roleCounts[name]++
+		roleInstances[name] = append(roleInstances[name], i)
 		c.instances = append(c.instances, inst)
+		instRoles = append(instRoles, role)
+	}
+
+	for i, inst := range c.instances {
+		if err := c.checkClock(inst); err != nil {
+			c.bootFailed()
+			return err
+		}
+		if err := c.provision(inst, instRoles[i]); err != nil {
+			c.bootFailed()
+			return fmt.Errorf("error provisioning instance %d: %s", i, err)
+		}
+		if c.bc.Harness != "" {
+			if err := c.installHarness(inst); err != nil {
+				c.bootFailed()
+				return fmt.Errorf("error installing the guest harness in instance %d: %s", i, err)
+			}
+		}
+		if len(images) > 0 {
+			if err := c.pullImages(inst, images); err != nil {
+				c.bootFailed()
+				return fmt.Errorf("error pulling images into instance %d: %s", i, err)
+			}
+		}
 	}
 
+	if err := c.checkPrereqs(); err != nil {
+		c.bootFailed()
+		return err
+	}
 	c.log("Bootstrapping layer 0...")
+	c.event("bootstrapping layer 0")
 	if err := c.bootstrapGrid(); err != nil {
-		c.Shutdown()
+		c.bootFailed()
+		return err
+	}
+	if err := c.setDiscovery(); err != nil {
+		c.bootFailed()
 		return err
 	}
 	c.log("Bootstrapping layer 1...")
+	c.event("bootstrapping layer 1")
 	if err := c.bootstrapFlynn(); err != nil {
-		c.Shutdown()
+		c.bootFailed()
 		return err
 	}
 	return nil
 }
 
+// startInstance creates and starts the index'th instance of the role name
+// with a COW layer of dockerfs, or an empty docker fs if it pulls images.
+func (c *Cluster) startInstance(name string, index int, dockerfs string, images []string, uid, gid int) (Instance, *Role, error) {
+	role, err := c.bc.Role(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	conf := role.vmConfig(index)
+	c.setKernel(conf)
+	conf.CrashDumpDir = c.bc.CrashDumpDir
+	conf.User = uid
+	conf.Group = gid
+	conf.Drives["hda"] = &VMDrive{FS: c.bc.RootFS, COW: true, Temp: true, DiskSize: role.RootSize}
+	conf.Drives["hdb"] = &VMDrive{FS: dockerfs, COW: true, Temp: true}
+	if len(images) > 0 {
+		size := role.DiskSize
+		if size == 0 {
+			size = DefaultRoles["worker"].DiskSize
+		}
+		fs, err := emptyDockerFS(size, uid, gid)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating docker fs: %s", err)
+		}
+		conf.Drives["hdb"] = &VMDrive{FS: fs, COW: true, Temp: true}
+	}
+	inst, err := c.backend.NewInstance(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = inst.Start(); err != nil {
+		return nil, nil, err
+	}
+	return inst, role, nil
+}
+
+// setKernel boots conf with the kernel of the BootConfig unless its role has
+// its own.
+func (c *Cluster) setKernel(conf *VMConfig) {
+	if conf.Kernel == "" {
+		conf.Kernel = c.bc.Kernel
+		conf.Initrd = c.bc.Initrd
+	}
+}
+
+func (c *Cluster) bootFailed() {
+	if c.OnBootFailure != nil {
+		c.OnBootFailure(c)
+	}
+	c.Shutdown()
+}
+
 func (c *Cluster) setup() error {
 	if _, err := os.Stat(c.bc.Kernel); os.IsNotExist(err) {
 		return fmt.Errorf("cluster: not a kernel file: %s", c.bc.Kernel)
 	}
+	if err := c.verifyImages(); err != nil {
+		return err
+	}
+	if c.bc.RunID == "" {
+		c.bc.RunID = util.SeededString(c.rand, 8)
+	}
+	if len(c.bc.Labels) > 0 {
+		runDir, err := RunDir(c.bc.Workdir, c.bc.RunID)
+		if err != nil {
+			return err
+		}
+		if err := c.bc.Labels.writeFile(runDir); err != nil {
+			return err
+		}
+	}
+	if c.bc.Macvtap != "" {
+		if c.bc.RestrictEgress {
+			return errors.New("cluster: macvtap interfaces would bypass egress restrictions")
+		}
+		if _, err := net.InterfaceByName(c.bc.Macvtap); err != nil {
+			return fmt.Errorf("cluster: invalid macvtap interface %s: %s", c.bc.Macvtap, err)
+		}
+	}
+	if _, err := parseDiscoveryMethods(c.bc.InjectDiscovery); err != nil {
+		return fmt.Errorf("cluster: %s", err)
+	}
 	if c.bridge == nil {
-		var err error
-		name := "flynnbr." + util.RandomString(5)
+		name, err := ifaceName(c.bc.BridgePrefix, DefaultBridgePrefix, c.rand)
+		if err != nil {
+			return fmt.Errorf("cluster: %s", err)
+		}
 		c.logf("creating network bridge %s\n", name)
-		c.bridge, err = createBridge(name, c.bc.Network, c.bc.NatIface)
+		recordBridge(c.bc.RunID, name)
+		c.bridge, err = createBridge(name, c.bc.Network, c.bc.NatIface, c.bc.MTU)
 		if err != nil {
 			return fmt.Errorf("could not create network bridge: %s", err)
 		}
+		if err := c.bc.Labels.setAlias(name); err != nil {
+			c.logf("could not label network bridge %s: %s\n", name, err)
+		}
+		trackCluster(c)
+		if c.bc.RestrictEgress {
+			c.logf("restricting egress of %s to %v\n", name, c.bc.EgressAllow)
+			if err := restrictEgress(name, c.bc.EgressAllow); err != nil {
+				return err
+			}
+		}
+	}
+	if c.bc.NetbootRoot != "" && c.netboot == nil {
+		var err error
+		c.netboot, err = NewNetbootServer(c.bridge, c.bc.NetbootRoot)
+		if err != nil {
+			return err
+		}
+		c.logf("serving netboot files from %s at %s\n", c.bc.NetbootRoot, c.netboot.HTTPURL())
+		if c.bc.RestrictEgress {
+			if err := allowHostPort(c.bridge.name, c.netboot.httpPort()); err != nil {
+				return err
+			}
+		}
+	}
+	if c.netServer == nil {
+		var err error
+		if c.netServer, err = NewNetServer(c.bridge, c.netboot); err != nil {
+			return err
+		}
+	}
+	if c.ipam == nil {
+		runDir, err := RunDir(c.bc.Workdir, c.bc.RunID)
+		if err != nil {
+			return err
+		}
+		c.ipam = newIPAM(c.bridge, c.netServer, runDir)
+		for name, addr := range c.bc.ReservedIPs {
+			var ip net.IP
+			if addr != "" {
+				if ip = net.ParseIP(addr); ip == nil {
+					return fmt.Errorf("cluster: invalid IP %q reserved for %s", addr, name)
+				}
+			}
+			if ip, err = c.ipam.Reserve(name, ip); err != nil {
+				return err
+			}
+			c.logf("reserved %s for %s\n", ip, name)
+		}
+	}
+	if c.SyslogPath != "" && c.syslog == nil {
+		var err error
+		c.syslog, err = NewSyslogCollector(c.bridge, c.SyslogPath)
+		if err != nil {
+			return err
+		}
+		if c.bc.RestrictEgress {
+			if err := allowHostPort(c.bridge.name, c.syslog.port()); err != nil {
+				return err
+			}
+		}
+	}
+	if c.bc.Registry != nil && c.registry == nil {
+		var err error
+		if c.registry, err = c.bc.Registry.listen(c.bridge); err != nil {
+			return err
+		}
+		if c.bc.RestrictEgress {
+			if err := allowHostPort(c.bridge.name, c.registry.Addr().(*net.TCPAddr).Port); err != nil {
+				return err
+			}
+		}
+	}
+	if c.taps == nil {
+		c.taps = NewTapManager(c.bridge, c.bc.TapPrefix, c.rand.Int63())
+	}
+	c.vm = NewVMManager(c.taps)
+	c.vm.Netboot = c.netboot
+	c.vm.Net = c.netServer
+	c.vm.Syslog = c.syslog
+	c.vm.RunID = c.bc.RunID
+	c.vm.Labels = c.bc.Labels
+	c.vm.Workdir = c.bc.Workdir
+	c.vm.Confine = c.bc.Confine
+	c.vm.SSHUser = c.bc.SSHUser
+	c.vm.SSHKey = c.bc.SSHKey
+	c.vm.NetConfig = c.netConfig
+	c.vm.IPs = c.ipam
+	c.vm.Macvtap = c.bc.Macvtap
+	c.vm.Resources = c.bc.Resources
+	c.vm.ConsoleLines = c.bc.ConsoleLines
+	c.vm.BootTimeout = c.bc.BootTimeout
+	c.vm.SSHTimeout = c.bc.SSHTimeout
+	switch c.bc.Backend {
+	case "", "qemu":
+		c.backend = c.vm
+	case "libvirt":
+		c.backend = &LibvirtBackend{VMManager: c.vm, URI: c.bc.LibvirtURI}
+	case "remote":
+		if c.bc.RemoteHost == "" {
+			return errors.New("cluster: the remote backend requires a remote host")
+		}
+		switch c.bc.Placement {
+		case "", "colocate", "spread":
+		default:
+			return fmt.Errorf("cluster: unknown placement %q", c.bc.Placement)
+		}
+		for i, url := range strings.Split(c.bc.RemoteHost, ",") {
+			name := "remote-host"
+			if i > 0 {
+				name = fmt.Sprintf("remote-host-%d", i)
+			}
+			ip, err := c.ipam.Reserve(name, nil)
+			if err != nil {
+				return err
+			}
+			h, err := newRemoteHost(strings.TrimSpace(url), c.bc.RemoteDir, &c.bc, c.bridge, ip, c.rand, c.out)
+			if err != nil {
+				return err
+			}
+			// hosts already connected are closed by Shutdown
+			c.remotes = append(c.remotes, h)
+		}
+		c.backend = &RemoteBackend{VMManager: c.vm, hosts: c.remotes, placement: c.bc.Placement}
+	default:
+		return fmt.Errorf("cluster: unknown backend %q", c.bc.Backend)
+	}
+	return nil
+}
+
+// ReserveIP reserves ip of the cluster subnet under name, or any free IP if
+// ip is nil, so that no instance is given it. The reservation is resolvable
+// as name by instances and written to the metadata dir of their netfs.
+func (c *Cluster) ReserveIP(name string, ip net.IP) (net.IP, error) {
+	if c.ipam == nil {
+		if err := c.setup(); err != nil {
+			return nil, err
+		}
+	}
+	return c.ipam.Reserve(name, ip)
+}
+
+// ReservedIPs returns the IPs reserved in the cluster keyed by name.
+func (c *Cluster) ReservedIPs() map[string]string {
+	if c.ipam == nil {
+		return nil
+	}
+	return c.ipam.Reserved()
+}
+
+func (c *Cluster) verifyImages() error {
+	if c.verified || c.bc.ImageCatalog == "" {
+		return nil
+	}
+	catalog, err := LoadImageCatalog(c.bc.ImageCatalog)
+	if os.IsNotExist(err) {
+		c.logf("image catalog %s not found, skipping kernel verification\n", c.bc.ImageCatalog)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cluster: %s", err)
+	}
+	if err := catalog.VerifyKernel(c.bc.Kernel); err != nil {
+		return fmt.Errorf("cluster: %s", err)
+	}
+	if err := validateNetConfig(catalog.NetworkConfig); err != nil {
+		return fmt.Errorf("cluster: %s", err)
+	}
+	c.netConfig = catalog.NetworkConfig
+	if c.bc.Initrd != "" {
+		if err := catalog.VerifyChecksum(c.bc.Initrd); err != nil {
+			return fmt.Errorf("cluster: %s", err)
+		}
+	}
+	c.verified = true
+	return nil
+}
+
+// GuestPanics returns the indexes of instances whose kernel has panicked.
+func (c *Cluster) GuestPanics() []int {
+	var panicked []int
+	for i, inst := range c.instances {
+		if inst.Panic() != nil {
+			panicked = append(panicked, i)
+		}
+	}
+	return panicked
+}
+
+// ConsoleTails returns the latest n console lines of each instance, keyed by
+// IP.
+func (c *Cluster) ConsoleTails(n int) map[string][]string {
+	tails := make(map[string][]string, len(c.instances))
+	for _, inst := range c.instances {
+		tails[inst.IP()] = inst.ConsoleTail(n)
+	}
+	return tails
+}
+
+// Instances returns the booted instances of the cluster.
+func (c *Cluster) Instances() []Instance {
+	return c.instances
+}
+
+// Run runs cmd on every instance of the cluster, stopping at the first
+// instance it fails on.
+func (c *Cluster) Run(cmd string) error {
+	for i, inst := range c.instances {
+		if err := inst.Run(cmd, attempts, c.out, c.out); err != nil {
+			return fmt.Errorf("instance %d: %s", i, err)
+		}
 	}
-	c.vm = NewVMManager(c.bridge)
 	return nil
 }
 
 func (c *Cluster) Shutdown() {
 	for i, inst := range c.instances {
+		for _, msg := range inst.OOMKills() {
+			c.logf("instance %d ran out of memory: %s\n", i, msg)
+		}
+		if p := inst.Panic(); p != nil {
+			c.logf("instance %d guest kernel panic, console:\n%s\n", i, p.Console)
+			if p.Dump != "" {
+				c.logf("instance %d memory dumped to %s\n", i, p.Dump)
+			}
+		}
 		c.log("killing instance", i)
 		if err := inst.Kill(); err != nil {
 			c.logf("error killing instance %d: %s\n", i, err)
 		}
 	}
+	c.instances = nil
+	for _, d := range c.rawDisks {
+		if err := d.release(); err != nil {
+			c.logf("error removing raw disk %s: %s\n", d.ID, err)
+		}
+	}
+	c.rawDisks = nil
+	c.RemoveCLI()
+	if c.ipam != nil {
+		c.ipam.release()
+		c.ipam = nil
+	}
+	if c.netServer != nil {
+		c.netServer.Close()
+		c.netServer = nil
+	}
+	if c.netboot != nil {
+		c.netboot.Close()
+		c.netboot = nil
+	}
+	if c.syslog != nil {
+		c.syslog.Close()
+		c.syslog = nil
+	}
+	if c.registry != nil {
+		c.registry.Close()
+		c.registry = nil
+	}
+	if c.taps != nil {
+		c.taps.Close()
+		c.taps = nil
+	}
+	for _, h := range c.remotes {
+		h.Close()
+	}
+	c.remotes = nil
 	if c.bridge != nil {
 		c.logf("deleting network bridge %s\n", c.bridge.name)
 		if err := deleteBridge(c.bridge); err != nil {
 			c.logf("error deleting network bridge %s: %s\n", c.bridge.name, err)
 		}
+		c.bridge = nil
 	}
+	untrackCluster(c)
 }
 
-var attempts = attempt.Strategy{
+var attempts = util.Strategy{
 	Min:   5,
 	Total: 5 * time.Minute,
 	Delay: time.Second,
 }
 
-var flynnBuildScript = template.Must(template.New("flynn-build").Parse(`
+var buildScriptFuncs = template.FuncMap{
+	"shellquote": shellQuote,
+	"imagename":  imageName,
+}
+
+var flynnBuildScript = template.Must(template.New("flynn-build").Funcs(buildScriptFuncs).Parse(`
 #!/bin/bash
 set -e -x
+{{- if .Env }}
+# the environment holds the build's secrets, so it is exported untraced
+set +x
+{{- range .Env }}
+export {{ shellquote . }}
+{{- end }}
+set -x
+{{- end }}
+
+{{ if .SSH }}
+mkdir -p ~/.ssh
+chmod 700 ~/.ssh
+cat > ~/.ssh/config <<EOF
+Host *
+  StrictHostKeyChecking no
+  UserKnownHostsFile /dev/null
+{{- if .DeployKey }}
+  IdentityFile ~/.ssh/deploy_key
+{{- end }}
+EOF
+{{ end }}
+{{- if .DeployKey }}
+(umask 077 && cat > ~/.ssh/deploy_key) <<'DEPLOY_KEY'
+{{ .DeployKey }}
+DEPLOY_KEY
+{{ end }}
 
+{{ if .Mirror }}
+sudo mkdir -p /mnt/gitmirror
+mountpoint -q /mnt/gitmirror || sudo mount -t 9p -o trans=virtio,version=9p2000.L,ro gitmirror /mnt/gitmirror
+{{ end }}
 export GOPATH=/var/lib/docker/flynn/go
 flynn=$GOPATH/src/github.com/flynn
 sudo mkdir -p $flynn
 sudo chown -R ubuntu:ubuntu $GOPATH
 
+fetch() {
+  url=$1
+  sum=$2
+  dest=$3
+  extract=$4
+  tmp=$(mktemp)
+  curl -fsSL -o $tmp "$url"
+  if ! echo "$sum  $tmp" | sha256sum -c --quiet -; then
+    echo "checksum mismatch for $url, expected $sum" >&2
+    rm -f $tmp
+    exit 1
+  fi
+  if test -n "$extract"; then
+    sudo mkdir -p "$dest"
+    sudo tar -xzf $tmp -C "$dest"
+    rm -f $tmp
+  else
+    sudo mkdir -p "$(dirname "$dest")"
+    sudo mv $tmp "$dest"
+  fi
+}
+{{ if not .Step }}
+{{- range .Downloads }}
+fetch {{ shellquote .URL }} {{ shellquote .SHA256 }} {{ shellquote .Dest }} {{ if .Extract }}extract{{ end }}
+{{- end }}
+{{ range .PinnedImages }}
+sudo docker pull {{ shellquote . }}
+sudo docker tag {{ shellquote . }} {{ shellquote (imagename .) }}
+{{- end }}
+{{- end }}
+
 build() {
   repo=$1
   ref=$2
+  url=$3
+  source=$4
   dir=$flynn/$repo
-  test -d $dir || git clone https://github.com/flynn/$repo $dir
+  if test -n "$source"; then
+    # the source was fetched in place of a git checkout, so is always built
+    pushd $dir > /dev/null
+    test -f Makefile && make clean && make
+    popd > /dev/null
+    return
+  fi
+  mirror=/mnt/gitmirror/$repo.git
+  if test -d $mirror; then
+    test -d $dir || git clone --reference $mirror --dissociate -- "${url:-https://github.com/flynn/$repo}" $dir
+  else
+    test -d $dir || git clone -- "${url:-https://github.com/flynn/$repo}" $dir
+  fi
   pushd $dir > /dev/null
   git fetch
-  git checkout $ref
-  test -f Makefile && make clean && make
+  test -n "$url" && git fetch -- "$url" "+refs/heads/*:refs/remotes/build/*"
+  git checkout "$ref"
+  # repos already built at the same commit, such as those of a cached build
+  # image, aren't rebuilt unless forced
+  built="$(git rev-parse HEAD) {{ .EnvKey }}"
+  if test -z "$force" && test "$(cat .git/flynn-test-built 2>/dev/null)" = "$built"; then
+    echo "$repo is already built at $ref"
+  else
+    rm -f .git/flynn-test-built
+    test -f Makefile && make clean && make
+    echo "$built" > .git/flynn-test-built
+  fi
   popd > /dev/null
 }
 
-{{ range $repo, $ref := . }}
-build "{{ $repo }}" "{{ $ref }}"
+{{ if .Step }}
+force=1 build {{ shellquote .Step }} {{ shellquote (index .Repos .Step) }} {{ shellquote (index .URLs .Step) }} {{ if index .Sources .Step }}source{{ end }}
+{{ else }}
+{{- range $repo, $ref := .Repos }}
+build {{ shellquote $repo }} {{ shellquote $ref }} {{ shellquote (index $.URLs $repo) }} {{ if index $.Sources $repo }}source{{ end }}
 {{ end }}
-
 sudo stop docker
 sudo umount /var/lib/docker
+{{- end }}
 `[1:]))
 
-func buildFlynn(inst Instance, repos map[string]string, out io.Writer) error {
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// buildScript returns the script which builds repos, or only the repo step if
+// it is set, leaving docker running.
+func (c *Cluster) buildScript(repos, urls map[string]string, env []string, step string) (string, error) {
+	var deployKey string
+	if c.DeployKey != "" {
+		key, err := ioutil.ReadFile(c.DeployKey)
+		if err != nil {
+			return "", fmt.Errorf("could not read deploy key: %s", err)
+		}
+		deployKey = strings.TrimSpace(string(key))
+	}
+	tmpl := flynnBuildScript
+	// the script is the template given by --build-script or in the assets
+	// dir, or else the built in one
+	name := c.bc.BuildScript
+	var data []byte
+	var err error
+	if name != "" {
+		data, err = ioutil.ReadFile(name)
+	} else if assets.Dir != "" {
+		name = "templates/build.sh"
+		if data, err = assets.Asset(name); os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read build script: %s", err)
+	}
+	if data != nil {
+		if tmpl, err = template.New("flynn-build").Funcs(buildScriptFuncs).Parse(string(data)); err != nil {
+			return "", fmt.Errorf("invalid build script %s: %s", name, err)
+		}
+	}
 	var b bytes.Buffer
-	flynnBuildScript.Execute(&b, repos)
-	return inst.Run(b.String(), attempts, out, out)
+	err = tmpl.Execute(&b, map[string]interface{}{
+		"Repos":        repos,
+		"URLs":         urls,
+		"Env":          env,
+		"SSH":          c.ForwardAgent || deployKey != "",
+		"DeployKey":    deployKey,
+		"Mirror":       c.bc.GitMirror != "",
+		"Downloads":    c.Downloads,
+		"PinnedImages": c.PinnedImages,
+		"Step":         step,
+		"Sources":      c.Sources,
+		"EnvKey":       buildCacheKey(nil, env)[:12],
+	})
+	return b.String(), err
 }
 
 func (c *Cluster) bootstrapGrid() error {
@@ -258,7 +1139,7 @@ type controllerCert struct {
 
 func (c *Cluster) bootstrapFlynn() error {
 	inst := c.instances[0]
-	c.ControllerDomain = fmt.Sprintf("flynn-%s.local", util.RandomString(16))
+	c.ControllerDomain = fmt.Sprintf("flynn-%s.local", util.SeededString(c.rand, 16))
 	c.ControllerKey = util.RandomString(16)
 	rd, wr := io.Pipe()
 	var cmdErr error
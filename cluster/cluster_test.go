@@ -0,0 +1,27 @@
+package cluster
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestBuildScriptHidesEnv(t *testing.T) {
+	c := &Cluster{}
+	script, err := c.buildScript(map[string]string{"flynn": "master"}, nil, []string{"FOO=bar", "SECRET=s3cr3t value"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only run the script up to where it starts building
+	i := strings.Index(script, "export GOPATH")
+	if i < 0 {
+		t.Fatal("GOPATH export not found in the build script")
+	}
+	out, err := exec.Command("bash", "-c", script[:i]+`set +x; echo "env: $FOO $SECRET"`).CombinedOutput()
+	if err != nil {
+		t.Fatalf("script failed: %s: %s", err, out)
+	}
+	if strings.Count(string(out), "s3cr3t") != 1 || !strings.Contains(string(out), "env: bar s3cr3t value") {
+		t.Errorf("secret was traced or not exported:\n%s", out)
+	}
+}
@@ -0,0 +1,165 @@
+package cluster
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/flynn/flynn-test/util"
+)
+
+var collectAttempts = util.Strategy{
+	Min:   3,
+	Total: 30 * time.Second,
+	Delay: time.Second,
+}
+
+// guestCollectPath is where the guest's artifacts are archived before they
+// are downloaded.
+const guestCollectPath = "/tmp/flynn-test-artifacts.tar.gz"
+
+var collectScript = template.Must(template.New("collect").Parse(`
+#!/bin/bash
+dir=$(mktemp -d)
+{{- if .DockerLogs }}
+mkdir -p "${dir}/docker"
+for id in $(sudo docker ps -aq); do
+  sudo docker logs "${id}" > "${dir}/docker/${id}.log" 2>&1
+  sudo docker inspect "${id}" > "${dir}/docker/${id}.json" 2>&1
+done
+{{- end }}
+sudo tar czf {{ .Archive }} --ignore-failed-read --warning=no-file-changed -C "${dir}" . {{ range .Paths }} -C / {{ . }}{{ end }}
+sudo chown ubuntu {{ .Archive }}
+rm -rf "${dir}"
+`[1:]))
+
+// CollectArtifacts bundles paths, the logs of docker containers if dockerLogs
+// is set and the console log of each instance into a timestamped tarball per
+// instance in dir, returning the paths of the tarballs. Instances which
+// can't be reached, such as after a guest kernel panic, still get a tarball
+// with their console log.
+func (c *Cluster) CollectArtifacts(dir string, paths []string, dockerLogs bool) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var rel []string
+	for _, p := range paths {
+		rel = append(rel, shellQuote(strings.TrimPrefix(p, "/")))
+	}
+	var script bytes.Buffer
+	if err := collectScript.Execute(&script, map[string]interface{}{
+		"Archive":    guestCollectPath,
+		"Paths":      rel,
+		"DockerLogs": dockerLogs,
+	}); err != nil {
+		return nil, err
+	}
+	now := time.Now().Format("20060102-150405")
+	var tarballs []string
+	for i, inst := range c.instances {
+		name := fmt.Sprintf("instance-%d", i)
+		if v, ok := asVM(inst); ok {
+			name = v.ID
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%s-%s.tar.gz", name, now))
+		if err := c.collectInstance(inst, script.String(), path); err != nil {
+			c.logf("could not collect artifacts of %s: %s\n", name, err)
+			continue
+		}
+		tarballs = append(tarballs, path)
+	}
+	return tarballs, nil
+}
+
+func (c *Cluster) collectInstance(inst Instance, script, path string) error {
+	tmp, err := ioutil.TempFile("", "guest-artifacts-")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	var guestErr error
+	var stderr bytes.Buffer
+	if err := inst.Run(script, collectAttempts, ioutil.Discard, &stderr); err != nil {
+		guestErr = fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	} else {
+		guestErr = inst.Download(guestCollectPath, tmp.Name())
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	if guestErr == nil {
+		if err := copyTarball(tw, tmp.Name(), "guest/"); err != nil {
+			guestErr = err
+		}
+	}
+	if guestErr != nil {
+		c.logf("could not collect guest artifacts of %s, only saving its console log: %s\n", inst.IP(), guestErr)
+		addTarFile(tw, "collect-error.txt", []byte(guestErr.Error()+"\n"))
+	}
+	if v, ok := asVM(inst); ok && v.dir != "" {
+		if data, err := ioutil.ReadFile(filepath.Join(v.dir, "console.log")); err == nil {
+			addTarFile(tw, "console.log", data)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// copyTarball copies the entries of the gzipped tarball at path to tw,
+// prefixing their names.
+func copyTarball(tw *tar.Writer, path, prefix string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		hdr.Name = prefix + strings.TrimPrefix(hdr.Name, "./")
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func addTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
@@ -0,0 +1,84 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ComponentStats is the memory used by the running containers of a Flynn
+// component on an instance, and the number of its containers which have
+// exited, each of which was restarted by the host.
+type ComponentStats struct {
+	Instance  string `json:"instance"`
+	Component string `json:"component"`
+	Memory    int64  `json:"memory"`
+	Restarts  int    `json:"restarts"`
+}
+
+// componentsScript prints the image, state and memory usage of each docker
+// container of the guest.
+const componentsScript = `
+for id in $(sudo docker ps -aq --no-trunc); do
+  image=$(sudo docker inspect --format '{{.Config.Image}}' "${id}")
+  running=$(sudo docker inspect --format '{{.State.Running}}' "${id}")
+  mem=$(cat "/sys/fs/cgroup/memory/docker/${id}/memory.usage_in_bytes" 2>/dev/null || echo 0)
+  echo "${image} ${running} ${mem}"
+done
+`
+
+// ComponentStats returns the stats of the components running on each
+// instance of the cluster, sorted by instance and component.
+func (c *Cluster) ComponentStats() ([]*ComponentStats, error) {
+	var stats []*ComponentStats
+	for i, inst := range c.instances {
+		var out bytes.Buffer
+		if err := inst.Run(componentsScript, attempts, &out, c.out); err != nil {
+			return nil, fmt.Errorf("instance %d: %s", i, err)
+		}
+		components := make(map[string]*ComponentStats)
+		s := bufio.NewScanner(&out)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) != 3 {
+				continue
+			}
+			// the component is the image name without the registry or tag
+			name := fields[0]
+			if j := strings.LastIndex(name, "/"); j >= 0 {
+				name = name[j+1:]
+			}
+			if j := strings.IndexAny(name, ":@"); j >= 0 {
+				name = name[:j]
+			}
+			cs, ok := components[name]
+			if !ok {
+				cs = &ComponentStats{Instance: inst.IP(), Component: name}
+				components[name] = cs
+				stats = append(stats, cs)
+			}
+			if fields[1] == "true" {
+				mem, _ := strconv.ParseInt(fields[2], 10, 64)
+				cs.Memory += mem
+			} else {
+				cs.Restarts++
+			}
+		}
+	}
+	sort.Sort(componentStatsSorter(stats))
+	return stats, nil
+}
+
+type componentStatsSorter []*ComponentStats
+
+func (s componentStatsSorter) Len() int      { return len(s) }
+func (s componentStatsSorter) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s componentStatsSorter) Less(i, j int) bool {
+	if s[i].Instance != s[j].Instance {
+		return s[i].Instance < s[j].Instance
+	}
+	return s[i].Component < s[j].Component
+}
@@ -0,0 +1,137 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+var apparmorTemplate = template.Must(template.New("apparmor").Parse(`
+#include <tunables/global>
+
+profile {{.Name}} flags=(attach_disconnected) {
+  #include <abstractions/base>
+
+  {{.QEMU}} mrix,
+  /usr/bin/taskset mrix,
+  /usr/share/qemu/** r,
+  /usr/share/seabios/** r,
+  /usr/share/misc/** r,
+  /usr/lib/** mr,
+  /etc/ld.so.cache r,
+  # QEMU's own process, and only the system files it reads
+  @{PROC}/@{pid}/** r,
+  @{PROC}/@{pid}/task/*/comm rw,
+  @{PROC}/cpuinfo r,
+  @{PROC}/meminfo r,
+  @{PROC}/filesystems r,
+  @{PROC}/sys/vm/overcommit_memory r,
+  @{PROC}/sys/kernel/cap_last_cap r,
+  /sys/devices/system/** r,
+  /dev/kvm rw,
+  /dev/net/tun rw,
+{{- if .Devices }}
+  /dev/vfio/** rw,
+  /dev/bus/usb/** rw,
+  /sys/bus/** r,
+  /sys/devices/** rw,
+{{- end }}
+{{- range .Read }}
+  "{{ . }}" r,
+{{- end }}
+{{- range .ReadWrite }}
+  "{{ . }}" rwk,
+{{- end }}
+{{- range .ReadDirs }}
+  "{{ . }}/" r,
+  "{{ . }}/**" r,
+{{- end }}
+{{- range .ReadWriteDirs }}
+  "{{ . }}/" rw,
+  "{{ . }}/**" rwk,
+{{- end }}
+}
+`[1:]))
+
+type apparmorProfile struct {
+	Name          string
+	QEMU          string
+	Devices       bool
+	Read          []string
+	ReadWrite     []string
+	ReadDirs      []string
+	ReadWriteDirs []string
+
+	path string
+}
+
+// confine generates and loads an AppArmor profile for the instance which only
+// allows QEMU to access the instance's own files, images and devices.
+func (v *vm) confine(qmpDir string) error {
+	p := &apparmorProfile{
+		Name:          fmt.Sprintf("flynn-test-%s-%s", v.runID, v.ID),
+		QEMU:          v.bootProfile().qemu(),
+		Devices:       len(v.Devices) > 0,
+		Read:          []string{v.Kernel},
+		ReadDirs:      []string{v.netFS},
+		ReadWriteDirs: []string{qmpDir},
+		path:          filepath.Join(v.dir, "apparmor.profile"),
+	}
+	if v.Initrd != "" {
+		p.Read = append(p.Read, v.Initrd)
+	}
+	for _, d := range v.Drives {
+		chain, err := backingChain(d.FS)
+		if err != nil {
+			return err
+		}
+		p.ReadWrite = append(p.ReadWrite, chain[0])
+		p.Read = append(p.Read, chain[1:]...)
+	}
+	for _, dir := range v.SharedDirs {
+		p.ReadDirs = append(p.ReadDirs, dir)
+	}
+	if v.CrashDumpDir != "" {
+		p.ReadWriteDirs = append(p.ReadWriteDirs, v.CrashDumpDir)
+	}
+	if v.macvtap != nil {
+		p.ReadWrite = append(p.ReadWrite, v.macvtap.Dev)
+	}
+	for _, paths := range [][]string{p.Read, p.ReadWrite, p.ReadDirs, p.ReadWriteDirs} {
+		for i, path := range paths {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+			if strings.ContainsAny(abs, "\"\n") {
+				return fmt.Errorf("cannot confine QEMU to path %q", abs)
+			}
+			paths[i] = abs
+		}
+	}
+
+	f, err := os.Create(p.path)
+	if err != nil {
+		return err
+	}
+	err = apparmorTemplate.Execute(f, p)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if out, err := exec.Command("apparmor_parser", "-r", "-W", p.path).CombinedOutput(); err != nil {
+		return fmt.Errorf("could not load AppArmor profile %s: %s: %s", p.Name, err, strings.TrimSpace(string(out)))
+	}
+	v.apparmor = p
+	return nil
+}
+
+func (p *apparmorProfile) unload() error {
+	if out, err := exec.Command("apparmor_parser", "-R", p.path).CombinedOutput(); err != nil {
+		return fmt.Errorf("could not unload AppArmor profile %s: %s: %s", p.Name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
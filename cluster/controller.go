@@ -0,0 +1,173 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ControllerClient is an authenticated client for the Flynn controller API.
+type ControllerClient struct {
+	url  string
+	key  string
+	http *http.Client
+}
+
+// NewControllerClient returns a client for the controller at url which only
+// trusts the TLS certificate with the base64 encoded SHA-256 pin.
+func NewControllerClient(url, key, pin string) (*ControllerClient, error) {
+	pinBytes, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil {
+		return nil, fmt.Errorf("controller: invalid TLS pin: %s", err)
+	}
+	// TLS is done by the pinned dialer, so the transport speaks plain HTTP
+	// over the connection it returns.
+	if strings.HasPrefix(url, "https://") {
+		url = "http://" + strings.TrimPrefix(url, "https://")
+		if !strings.Contains(strings.TrimPrefix(url, "http://"), ":") {
+			url += ":443"
+		}
+	}
+	return &ControllerClient{
+		url:  url,
+		key:  key,
+		http: &http.Client{Transport: &http.Transport{Dial: pinnedDial(pinBytes)}},
+	}, nil
+}
+
+// ControllerClient returns a client for the cluster's controller, which is
+// only available once the cluster is bootstrapped.
+func (c *Cluster) ControllerClient() (*ControllerClient, error) {
+	if c.ControllerDomain == "" {
+		return nil, errors.New("cluster: controller not bootstrapped")
+	}
+	return NewControllerClient("https://"+c.ControllerDomain, c.ControllerKey, c.ControllerPin)
+}
+
+func pinnedDial(pin []byte) func(string, string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := tls.Dial(network, addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return nil, err
+		}
+		certs := conn.ConnectionState().PeerCertificates
+		if len(certs) == 0 {
+			conn.Close()
+			return nil, errors.New("controller: no TLS certificate")
+		}
+		sum := sha256.Sum256(certs[0].Raw)
+		if !bytes.Equal(sum[:], pin) {
+			conn.Close()
+			return nil, errors.New("controller: TLS certificate doesn't match pin")
+		}
+		return conn, nil
+	}
+}
+
+type App struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type Release struct {
+	ID         string                  `json:"id,omitempty"`
+	ArtifactID string                  `json:"artifact,omitempty"`
+	Env        map[string]string       `json:"env,omitempty"`
+	Processes  map[string]*ProcessType `json:"processes,omitempty"`
+}
+
+type ProcessType struct {
+	Cmd   []string          `json:"cmd,omitempty"`
+	Env   map[string]string `json:"env,omitempty"`
+	Ports []*Port           `json:"ports,omitempty"`
+}
+
+type Port struct {
+	Port  int    `json:"port"`
+	Proto string `json:"proto"`
+}
+
+type Formation struct {
+	AppID     string         `json:"app,omitempty"`
+	ReleaseID string         `json:"release,omitempty"`
+	Processes map[string]int `json:"processes"`
+}
+
+func (c *ControllerClient) CreateApp(app *App) error {
+	return c.do("POST", "/apps", app, app)
+}
+
+func (c *ControllerClient) GetApp(id string) (*App, error) {
+	app := &App{}
+	return app, c.do("GET", "/apps/"+id, nil, app)
+}
+
+func (c *ControllerClient) AppList() ([]*App, error) {
+	var apps []*App
+	return apps, c.do("GET", "/apps", nil, &apps)
+}
+
+func (c *ControllerClient) DeleteApp(id string) error {
+	return c.do("DELETE", "/apps/"+id, nil, nil)
+}
+
+func (c *ControllerClient) CreateRelease(release *Release) error {
+	return c.do("POST", "/releases", release, release)
+}
+
+func (c *ControllerClient) GetAppRelease(appID string) (*Release, error) {
+	release := &Release{}
+	return release, c.do("GET", "/apps/"+appID+"/release", nil, release)
+}
+
+func (c *ControllerClient) SetAppRelease(appID, releaseID string) error {
+	return c.do("PUT", "/apps/"+appID+"/release", &Release{ID: releaseID}, nil)
+}
+
+func (c *ControllerClient) GetFormation(appID, releaseID string) (*Formation, error) {
+	formation := &Formation{}
+	return formation, c.do("GET", "/apps/"+appID+"/formations/"+releaseID, nil, formation)
+}
+
+func (c *ControllerClient) PutFormation(formation *Formation) error {
+	return c.do("PUT", "/apps/"+formation.AppID+"/formations/"+formation.ReleaseID, formation, formation)
+}
+
+func (c *ControllerClient) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.url+path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("", c.key)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("controller: unexpected status %d from %s %s", res.StatusCode, method, path)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,27 @@
+package cluster
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+var cpuSetPattern = regexp.MustCompile(`^\d+(-\d+)?(,\d+(-\d+)?)*$`)
+
+// validateCPUSet checks that set is a list of host CPUs in the format used by
+// taskset -c, for example "0-3,6".
+func validateCPUSet(set string) error {
+	if !cpuSetPattern.MatchString(set) {
+		return fmt.Errorf("invalid cpuset %q", set)
+	}
+	for _, r := range strings.Split(set, ",") {
+		for _, cpu := range strings.Split(r, "-") {
+			if n, _ := strconv.Atoi(cpu); n >= runtime.NumCPU() {
+				return fmt.Errorf("cpuset %q refers to CPU %d but the host only has %d", set, n, runtime.NumCPU())
+			}
+		}
+	}
+	return nil
+}
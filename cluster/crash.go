@@ -0,0 +1,160 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// QEMUCrash is a QEMU process which died of a signal rather than being
+// stopped, with what the host kernel logged while it ran and whether it
+// left a core dump, so that crashes caused by flaky hosts can be told apart
+// from failing tests.
+type QEMUCrash struct {
+	Instance string    `json:"instance"`
+	Signal   string    `json:"signal"`
+	Time     time.Time `json:"time"`
+
+	// Dmesg are the lines of the host kernel log since the instance started
+	// which mention QEMU, KVM or hardware and memory errors.
+	Dmesg []string `json:"dmesg,omitempty"`
+
+	// CoreDump is where the core dump of QEMU is, either a path or the
+	// coredumpctl command showing it, and CorePattern the host's
+	// kernel.core_pattern, which explains a missing dump.
+	CoreDump    string `json:"core_dump,omitempty"`
+	CorePattern string `json:"core_pattern,omitempty"`
+}
+
+var (
+	crashesMtx sync.Mutex
+	crashes    = make(map[string][]*QEMUCrash)
+)
+
+func recordCrash(runID string, c *QEMUCrash) {
+	crashesMtx.Lock()
+	defer crashesMtx.Unlock()
+	crashes[runID] = append(crashes[runID], c)
+}
+
+// RunCrashes returns the crashes of the QEMU processes of the instances
+// booted with runID, and forgets them.
+func RunCrashes(runID string) []*QEMUCrash {
+	crashesMtx.Lock()
+	defer crashesMtx.Unlock()
+	c := crashes[runID]
+	delete(crashes, runID)
+	return c
+}
+
+// exitSignal returns the signal QEMU died of. sudo kills itself with the
+// signal its command died of, so it is seen as that of sudo.
+func exitSignal(err error) (syscall.Signal, bool) {
+	ee, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, false
+	}
+	status, ok := ee.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return 0, false
+	}
+	return status.Signal(), true
+}
+
+// checkCrash records a crash of v if QEMU died of a signal it wasn't sent
+// by Kill.
+func (v *vm) checkCrash() {
+	sig, ok := exitSignal(v.exitErr)
+	if !ok || atomic.LoadInt32(&v.killing) == 1 {
+		return
+	}
+	v.statsMtx.Lock()
+	pid := v.pid
+	v.statsMtx.Unlock()
+	c := &QEMUCrash{
+		Instance: v.ID,
+		Signal:   sig.String(),
+		Time:     time.Now(),
+		Dmesg:    dmesgSince(v.started, pid),
+	}
+	c.CoreDump, c.CorePattern = coreDump(pid)
+	recordEvent(v.runID, "host", "QEMU of "+v.ID+" died of signal "+c.Signal)
+	recordCrash(v.runID, c)
+}
+
+// maxDmesgLines is the number of kernel log lines kept with a crash.
+const maxDmesgLines = 30
+
+var (
+	dmesgTime    = regexp.MustCompile(`^\[\s*(\d+\.\d+)\]`)
+	dmesgPattern = regexp.MustCompile(`(?i)qemu|kvm|segfault|general protection|oom-kill|out of memory|machine check|hardware error|mce:|edac|i/o error|blocked for more than`)
+)
+
+// dmesgSince returns the lines of the host kernel log logged since start
+// which mention QEMU, the process pid or a host fault.
+func dmesgSince(start time.Time, pid string) []string {
+	out, err := exec.Command("sudo", "-n", "dmesg").Output()
+	if err != nil {
+		return nil
+	}
+	// dmesg timestamps are seconds since boot
+	var since float64
+	if data, err := ioutil.ReadFile("/proc/uptime"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			uptime, _ := strconv.ParseFloat(fields[0], 64)
+			since = uptime - time.Since(start).Seconds()
+		}
+	}
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := dmesgTime.FindStringSubmatch(line); m != nil {
+			if t, _ := strconv.ParseFloat(m[1], 64); t < since {
+				continue
+			}
+		}
+		if dmesgPattern.MatchString(line) || pid != "" && strings.Contains(line, "["+pid+"]") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > maxDmesgLines {
+		lines = lines[len(lines)-maxDmesgLines:]
+	}
+	return lines
+}
+
+// coreDump returns where the core dump of the QEMU process pid is, if it
+// left one, and the host's core_pattern.
+func coreDump(pid string) (string, string) {
+	data, _ := ioutil.ReadFile("/proc/sys/kernel/core_pattern")
+	pattern := strings.TrimSpace(string(data))
+	if pid == "" || pattern == "" {
+		return "", pattern
+	}
+	if strings.HasPrefix(pattern, "|") {
+		// piped to a handler, only systemd-coredump can be asked for it
+		if strings.Contains(pattern, "systemd-coredump") && exec.Command("coredumpctl", "--no-pager", "list", pid).Run() == nil {
+			return "coredumpctl info " + pid, pattern
+		}
+		return "", pattern
+	}
+	glob := pattern
+	if !strings.Contains(glob, "%p") {
+		if data, err := ioutil.ReadFile("/proc/sys/kernel/core_uses_pid"); err == nil && strings.TrimSpace(string(data)) == "1" {
+			glob += ".%p"
+		}
+	}
+	glob = regexp.MustCompile(`%[^p%]`).ReplaceAllString(glob, "*")
+	glob = strings.NewReplacer("%p", pid, "%%", "%").Replace(glob)
+	if matches, _ := filepath.Glob(glob); len(matches) > 0 {
+		path, _ := filepath.Abs(matches[len(matches)-1])
+		return path, pattern
+	}
+	return "", pattern
+}
@@ -0,0 +1,145 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const guestGopath = "/var/lib/docker/flynn/go"
+
+// DevSync keeps a local checkout of a repo synced into a running builder,
+// rebuilding the repo there whenever it changes, for a fast edit-build-test
+// loop on a real build instance.
+type DevSync struct {
+	Repo string
+	Dir  string
+
+	// Test is run in the repo on the builder after each successful build.
+	Test string
+
+	b      *Builder
+	keyDir string
+}
+
+// NewDevSync authorizes a generated SSH key on the builder, which rsync uses
+// to copy dir into it as repo.
+func (b *Builder) NewDevSync(repo, dir string) (*DevSync, error) {
+	keyDir, err := ioutil.TempDir("", "devsync-")
+	if err != nil {
+		return nil, err
+	}
+	d := &DevSync{Repo: repo, Dir: dir, b: b, keyDir: keyDir}
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "rsa", "-N", "", "-f", d.key()).CombinedOutput(); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("could not generate ssh key: %s: %s", err, out)
+	}
+	pub, err := ioutil.ReadFile(d.key() + ".pub")
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	authorize := fmt.Sprintf("mkdir -p ~/.ssh && chmod 700 ~/.ssh && echo %s >> ~/.ssh/authorized_keys", shellQuote(strings.TrimSpace(string(pub))))
+	if err := b.inst.Run(authorize, attempts, b.c.out, b.c.out); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("could not authorize ssh key: %s", err)
+	}
+	return d, nil
+}
+
+func (d *DevSync) key() string {
+	return filepath.Join(d.keyDir, "id_rsa")
+}
+
+func (d *DevSync) guestDir() string {
+	return guestGopath + "/src/github.com/flynn/" + d.Repo
+}
+
+// Sync copies the checkout into the builder, deleting files which no longer
+// exist locally.
+func (d *DevSync) Sync(out io.Writer) error {
+	if err := d.b.prepare(out); err != nil {
+		return err
+	}
+	mkdir := fmt.Sprintf("sudo mkdir -p %s && sudo chown -R ubuntu:ubuntu %s", d.guestDir(), guestGopath)
+	if err := d.b.inst.Run(mkdir, attempts, out, out); err != nil {
+		return err
+	}
+	cmd := exec.Command("rsync", "-az", "--delete",
+		"-e", "ssh -o LogLevel=FATAL -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no -o IdentitiesOnly=yes -i "+d.key(),
+		strings.TrimSuffix(d.Dir, "/")+"/",
+		fmt.Sprintf("ubuntu@%s:%s/", d.b.inst.IP(), d.guestDir()),
+	)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("could not sync %s: %s", d.Dir, err)
+	}
+	return nil
+}
+
+// Build runs an incremental build of the synced checkout, followed by Test.
+func (d *DevSync) Build(out io.Writer) error {
+	script := fmt.Sprintf("set -e\nexport GOPATH=%s\ncd %s\ntest -f Makefile && make\n", guestGopath, d.guestDir())
+	if d.Test != "" {
+		script += d.Test + "\n"
+	}
+	if err := d.b.inst.Run(script, attempts, out, out); err != nil {
+		return fmt.Errorf("dev build of %s failed: %s", d.Repo, err)
+	}
+	return nil
+}
+
+// Watch syncs and builds the checkout each time a file in it changes, polling
+// every interval, until stop is closed.
+func (d *DevSync) Watch(interval time.Duration, out io.Writer, stop chan struct{}) {
+	var last time.Time
+	for {
+		changed, err := d.lastChange()
+		if err != nil {
+			fmt.Fprintf(out, "could not check %s for changes: %s\n", d.Dir, err)
+		} else if changed.After(last) {
+			last = changed
+			if err := d.Sync(out); err != nil {
+				fmt.Fprintln(out, err)
+			} else if err := d.Build(out); err != nil {
+				fmt.Fprintln(out, err)
+			} else {
+				fmt.Fprintf(out, "dev build of %s passed, waiting for changes\n", d.Repo)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// lastChange returns the latest modification time of the files in the
+// checkout, ignoring .git.
+func (d *DevSync) lastChange() (time.Time, error) {
+	var latest time.Time
+	err := filepath.Walk(d.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest, err
+}
+
+func (d *DevSync) Close() {
+	os.RemoveAll(d.keyDir)
+}
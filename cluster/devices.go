@@ -0,0 +1,36 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+var (
+	usbDevicePattern = regexp.MustCompile(`^usb:([0-9a-f]{4}):([0-9a-f]{4})$`)
+	pciDevicePattern = regexp.MustCompile(`^pci:([0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7])$`)
+)
+
+// ValidateDevice checks that dev is a host device in the form
+// usb:VENDOR:PRODUCT or pci:DOMAIN:BUS:SLOT.FUNCTION, using lower case hex.
+func ValidateDevice(dev string) error {
+	if !usbDevicePattern.MatchString(dev) && !pciDevicePattern.MatchString(dev) {
+		return fmt.Errorf("invalid device %q, expected usb:VENDOR:PRODUCT or pci:DOMAIN:BUS:SLOT.FUNCTION", dev)
+	}
+	return nil
+}
+
+// deviceArgs returns the QEMU args which pass dev through to the guest. PCI
+// devices must be bound to vfio-pci on the host.
+func deviceArgs(dev string) ([]string, error) {
+	if m := usbDevicePattern.FindStringSubmatch(dev); m != nil {
+		return []string{"-device", fmt.Sprintf("usb-host,vendorid=0x%s,productid=0x%s", m[1], m[2])}, nil
+	}
+	if m := pciDevicePattern.FindStringSubmatch(dev); m != nil {
+		if _, err := os.Stat("/sys/bus/pci/devices/" + m[1] + "/iommu_group"); err != nil {
+			return nil, fmt.Errorf("PCI device %s has no IOMMU group, is VFIO enabled on the host?", m[1])
+		}
+		return []string{"-device", "vfio-pci,host=" + m[1]}, nil
+	}
+	return nil, ValidateDevice(dev)
+}
@@ -0,0 +1,125 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Discovery is where the discoverd and etcd of a bootstrapped cluster are
+// reached. Instances booted into the cluster once layer 0 is bootstrapped
+// are given it as BootConfig.InjectDiscovery sets, so that tests can add
+// hosts which join the cluster without being told where it is over ssh.
+type Discovery struct {
+	Discoverd string `json:"discoverd"`
+	EtcdPeers string `json:"etcd_peers"`
+}
+
+// DiscoveryMethods are the ways discovery can be injected: "cmdline" appends
+// flynn.discoverd= and flynn.etcd_peers= to the kernel command line of
+// directly booted instances, "metadata" writes discovery.json and
+// discovery.env to the metadata dir of their netfs, and "dns" resolves
+// discoverd.flynn and etcd.flynn to the first instance.
+var DiscoveryMethods = []string{"cmdline", "metadata", "dns"}
+
+// parseDiscoveryMethods parses a comma separated list of DiscoveryMethods.
+func parseDiscoveryMethods(s string) (map[string]bool, error) {
+	methods := make(map[string]bool)
+	for _, m := range strings.Split(s, ",") {
+		if m = strings.TrimSpace(m); m == "" {
+			continue
+		}
+		var known bool
+		for _, k := range DiscoveryMethods {
+			known = known || m == k
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown discovery injection method %q, must be one of %s", m, strings.Join(DiscoveryMethods, ", "))
+		}
+		methods[m] = true
+	}
+	return methods, nil
+}
+
+func (d *Discovery) env() []string {
+	return []string{"DISCOVERD=" + d.Discoverd, "ETCD_PEERS=" + d.EtcdPeers}
+}
+
+func (d *Discovery) cmdline() string {
+	return fmt.Sprintf("flynn.discoverd=%s flynn.etcd_peers=%s", d.Discoverd, d.EtcdPeers)
+}
+
+// writeMetadata writes d to the metadata dir of the netfs dir.
+func (d *Discovery) writeMetadata(dir string) error {
+	dir = filepath.Join(dir, "metadata")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(d)
+	if err := ioutil.WriteFile(filepath.Join(dir, "discovery.json"), data, 0644); err != nil {
+		return err
+	}
+	env := strings.Join(d.env(), "\n") + "\n"
+	return ioutil.WriteFile(filepath.Join(dir, "discovery.env"), []byte(env), 0644)
+}
+
+// setDiscovery injects the discovery of the cluster into the instances
+// booted from now on, once layer 0 is bootstrapped on the first instance.
+func (c *Cluster) setDiscovery() error {
+	methods, err := parseDiscoveryMethods(c.bc.InjectDiscovery)
+	if err != nil {
+		return err
+	}
+	ip := c.instances[0].IP()
+	c.discovery = &Discovery{Discoverd: ip + ":1111", EtcdPeers: ip + ":7001"}
+	if c.vm != nil {
+		c.vm.Discovery = c.discovery
+		c.vm.InjectDiscovery = methods
+	}
+	if methods["dns"] && c.netServer != nil {
+		c.netServer.AddName("discoverd.flynn", net.ParseIP(ip))
+		c.netServer.AddName("etcd.flynn", net.ParseIP(ip))
+	}
+	return nil
+}
+
+// Discovery returns where the cluster's discoverd and etcd are reached, or
+// nil if it hasn't been bootstrapped.
+func (c *Cluster) Discovery() *Discovery {
+	return c.discovery
+}
+
+// AddInstance boots an instance of role into the bootstrapped cluster and
+// starts flynn-host on it, joining the cluster through the discovery it was
+// booted with.
+func (c *Cluster) AddInstance(dockerfs, role string) (Instance, error) {
+	if c.discovery == nil {
+		return nil, errors.New("cluster: instances can only be added to a bootstrapped cluster")
+	}
+	uid, gid, err := lookupUser(c.bc.User)
+	if err != nil {
+		return nil, err
+	}
+	c.log("Adding", role, "instance")
+	inst, r, err := c.startInstance(role, len(c.instances), dockerfs, nil, uid, gid)
+	if err != nil {
+		return nil, err
+	}
+	c.instances = append(c.instances, inst)
+	if err := c.provision(inst, r); err != nil {
+		return nil, fmt.Errorf("error provisioning instance: %s", err)
+	}
+	command := fmt.Sprintf(
+		"docker run -d -v=/var/run/docker.sock:/var/run/docker.sock -p=1113:1113 -e=ETCD_PEERS=%s -e=DISCOVERD=%s flynn/host -external %s -force",
+		c.discovery.EtcdPeers, c.discovery.Discoverd, inst.IP(),
+	)
+	if err := inst.Run(command, attempts, c.out, os.Stderr); err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
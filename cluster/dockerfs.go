@@ -0,0 +1,42 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var emptyFSMtx sync.Mutex
+
+// emptyDockerFS returns a sealed, empty btrfs image of size bytes, which is
+// created once and kept in the temp dir. Instances which start with an empty
+// docker fs get a COW layer of it, rather than each creating a sparse image
+// and running mkfs.btrfs. The layer is named like the dockerfs images built
+// from it so that CleanupOrphans removes those which are left behind.
+func emptyDockerFS(size int64, uid, gid int) (string, error) {
+	emptyFSMtx.Lock()
+	defer emptyFSMtx.Unlock()
+	dir := filepath.Join(os.TempDir(), "flynn-empty-fs", fmt.Sprint(size))
+	path := filepath.Join(dir, "dockerfs.img")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := createBtrfs(size, "dockerfs", uid, gid)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := sealImage(tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
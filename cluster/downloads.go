@@ -0,0 +1,52 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Download is a file fetched by the build script, such as the Go toolchain,
+// which is verified against SHA256 before it is used.
+type Download struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+
+	// Dest is the path the file is saved to, or the directory a tarball is
+	// extracted into if Extract is set.
+	Dest    string `json:"dest"`
+	Extract bool   `json:"extract"`
+}
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func (d *Download) Validate() error {
+	if d.URL == "" {
+		return errors.New("download has no url")
+	}
+	if !sha256Pattern.MatchString(d.SHA256) {
+		return fmt.Errorf("download %s has an invalid sha256 %q", d.URL, d.SHA256)
+	}
+	if !filepath.IsAbs(d.Dest) {
+		return fmt.Errorf("download %s needs an absolute dest", d.URL)
+	}
+	return nil
+}
+
+var pinnedImagePattern = regexp.MustCompile(`^[a-z0-9./_-]+(:[A-Za-z0-9._-]+)?@sha256:[0-9a-f]{64}$`)
+
+// ValidatePinnedImage checks that image is a docker image reference pinned
+// by digest, such as flynn/busybox@sha256:<digest>.
+func ValidatePinnedImage(image string) error {
+	if !pinnedImagePattern.MatchString(image) {
+		return fmt.Errorf("image %q is not pinned by a sha256 digest", image)
+	}
+	return nil
+}
+
+// imageName returns the name of a pinned image without its digest.
+func imageName(image string) string {
+	return strings.SplitN(image, "@", 2)[0]
+}
@@ -0,0 +1,138 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/flynn/go-iptables"
+)
+
+// nameservers are configured in instances if the NetServer can't serve DNS,
+// so restricted instances may always send DNS queries to them, and are
+// otherwise where the NetServer forwards queries.
+var nameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+func egressChain(bridgeName string) string {
+	return bridgeName + "-out"
+}
+
+func ingressChain(bridgeName string) string {
+	return bridgeName + "-in"
+}
+
+func egressJump(bridgeName string) []string {
+	return []string{"FORWARD", "-i", bridgeName, "-j", egressChain(bridgeName)}
+}
+
+func ingressJump(bridgeName string) []string {
+	return []string{"INPUT", "-i", bridgeName, "-j", ingressChain(bridgeName)}
+}
+
+// resolveEgress resolves the CIDRs and hostnames in allow to CIDRs.
+func resolveEgress(allow []string) ([]string, error) {
+	var nets []string
+	for _, dest := range allow {
+		if _, _, err := net.ParseCIDR(dest); err == nil {
+			nets = append(nets, dest)
+			continue
+		}
+		if ip := net.ParseIP(dest); ip != nil {
+			nets = append(nets, ip.String())
+			continue
+		}
+		ips, err := net.LookupIP(dest)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve egress destination %s: %s", dest, err)
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				nets = append(nets, ip.String())
+			}
+		}
+	}
+	return nets, nil
+}
+
+// restrictEgress limits the traffic instances on bridge may forward to the
+// destinations in allow and DNS queries, and the traffic they may send to the
+// host to replies, DHCP, DNS and netboot requests. Everything else, including the host's
+// LAN and metadata services, is dropped.
+func restrictEgress(bridgeName string, allow []string) error {
+	nets, err := resolveEgress(allow)
+	if err != nil {
+		return err
+	}
+	out := egressChain(bridgeName)
+	in := ingressChain(bridgeName)
+	rules := [][]string{
+		{"-N", out},
+		{"-A", out, "-m", "state", "--state", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+	}
+	for _, ns := range nameservers {
+		for _, proto := range []string{"udp", "tcp"} {
+			rules = append(rules, []string{"-A", out, "-d", ns, "-p", proto, "--dport", "53", "-j", "ACCEPT"})
+		}
+	}
+	for _, n := range nets {
+		rules = append(rules, []string{"-A", out, "-d", n, "-j", "ACCEPT"})
+	}
+	rules = append(rules,
+		[]string{"-A", out, "-j", "DROP"},
+		[]string{"-N", in},
+		[]string{"-A", in, "-m", "state", "--state", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+		[]string{"-A", in, "-p", "udp", "--dport", "67", "-j", "ACCEPT"},
+		[]string{"-A", in, "-p", "udp", "--dport", "53", "-j", "ACCEPT"},
+		[]string{"-A", in, "-p", "udp", "--dport", "69", "-j", "ACCEPT"},
+		[]string{"-A", in, "-j", "DROP"},
+		append([]string{"-I"}, egressJump(bridgeName)...),
+		append([]string{"-I"}, ingressJump(bridgeName)...),
+	)
+	for _, rule := range rules {
+		if output, err := iptables.Raw(rule...); err != nil {
+			removeEgress(bridgeName)
+			return fmt.Errorf("unable to restrict egress: %s", err)
+		} else if len(output) != 0 {
+			removeEgress(bridgeName)
+			return fmt.Errorf("unknown error restricting egress: %s", output)
+		}
+	}
+	return nil
+}
+
+// allowHostPort lets restricted instances connect to a TCP port on the host,
+// such as the netboot HTTP server.
+func allowHostPort(bridgeName string, port int) error {
+	if _, err := iptables.Raw("-I", ingressChain(bridgeName), "-p", "tcp", "--dport", strconv.Itoa(port), "-j", "ACCEPT"); err != nil {
+		return fmt.Errorf("unable to allow host port %d: %s", port, err)
+	}
+	return nil
+}
+
+// removeEgress removes the rules added by restrictEgress, ignoring rules
+// which don't exist.
+func removeEgress(bridgeName string) error {
+	var firstErr error
+	for _, jump := range [][]string{egressJump(bridgeName), ingressJump(bridgeName)} {
+		if iptables.Exists(jump...) {
+			if _, err := iptables.Raw(append([]string{"-D"}, jump...)...); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("unable to remove egress rule: %s", err)
+			}
+		}
+	}
+	for _, chain := range []string{egressChain(bridgeName), ingressChain(bridgeName)} {
+		if !chainExists(chain) {
+			continue
+		}
+		iptables.Raw("-F", chain)
+		if _, err := iptables.Raw("-X", chain); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("unable to remove chain %s: %s", chain, err)
+		}
+	}
+	return firstErr
+}
+
+func chainExists(chain string) bool {
+	_, err := iptables.Raw("-n", "-L", chain)
+	return err == nil
+}
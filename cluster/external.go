@@ -0,0 +1,194 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"code.google.com/p/go.crypto/ssh"
+	"github.com/flynn/flynn-test/util"
+)
+
+// errExternal is returned by the operations on the VMs of a cluster which
+// the machines of an external cluster don't support.
+var errExternal = errors.New("cluster: not supported by the machines of an external cluster")
+
+// BootExternal bootstraps Flynn on the machines at urls, given as
+// ssh://user@host[:port], rather than booting instances, so that the tests
+// can validate staging environments and bare metal installs. The machines
+// must already run docker with the Flynn images, and are dialed with
+// --ssh-key as --ssh-user unless the URL has a user. Their host keys are
+// trusted when first seen and logged.
+func (c *Cluster) BootExternal(urls []string) error {
+	if c.bc.SSHKey == "" {
+		return errors.New("cluster: an ssh key is required to reach an external cluster")
+	}
+	data, err := ioutil.ReadFile(c.bc.SSHKey)
+	if err != nil {
+		return fmt.Errorf("could not read ssh key: %s", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return fmt.Errorf("could not parse ssh key %s: %s", c.bc.SSHKey, err)
+	}
+	c.log("Bootstrapping", len(urls), "external machines")
+	for _, s := range urls {
+		h, err := newExternalHost(s, c.bc.SSHUser, signer, c.out)
+		if err != nil {
+			return err
+		}
+		c.instances = append(c.instances, h)
+	}
+	if err := c.checkPrereqs(); err != nil {
+		return err
+	}
+	c.log("Bootstrapping layer 0...")
+	c.event("bootstrapping layer 0")
+	if err := c.bootstrapGrid(); err != nil {
+		return err
+	}
+	c.log("Bootstrapping layer 1...")
+	c.event("bootstrapping layer 1")
+	return c.bootstrapFlynn()
+}
+
+// externalHost is a machine of an external cluster, which is left running
+// when the cluster is shut down.
+type externalHost struct {
+	addr   string
+	ip     string
+	config *ssh.ClientConfig
+
+	forwardMtx sync.Mutex
+	forwards   []*portForward
+}
+
+func newExternalHost(s, user string, signer ssh.Signer, out io.Writer) (*externalHost, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "ssh" || u.Host == "" {
+		return nil, fmt.Errorf("cluster: invalid external machine %q, expected ssh://user@host[:port]", s)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host, port = u.Host, "22"
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return nil, fmt.Errorf("cluster: could not resolve external machine %s: %s", host, err)
+	}
+	if u.User != nil {
+		user = u.User.Username()
+	}
+	h := &externalHost{addr: net.JoinHostPort(host, port), ip: ips[0].String()}
+	var mtx sync.Mutex
+	var hostKey []byte
+	h.config = &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			if hostKey == nil {
+				hostKey = key.Marshal()
+				sum := sha256.Sum256(hostKey)
+				fmt.Fprintf(out, "trusting host key SHA256:%s of %s\n", base64.StdEncoding.EncodeToString(sum[:]), h.addr)
+				return nil
+			}
+			if !bytes.Equal(key.Marshal(), hostKey) {
+				return errors.New("cluster: ssh host key of " + h.addr + " changed")
+			}
+			return nil
+		},
+	}
+	return h, nil
+}
+
+func (h *externalHost) DialSSH() (*ssh.Client, error) {
+	return ssh.Dial("tcp", h.addr, h.config)
+}
+
+func (h *externalHost) IP() string { return h.ip }
+
+func (h *externalHost) Run(command string, attempts util.Strategy, out io.Writer, stderr io.Writer) error {
+	var sc *ssh.Client
+	if err := attempts.Run(func() (err error) {
+		fmt.Fprintf(stderr, "Attempting to ssh to %s...\n", h.addr)
+		sc, err = h.DialSSH()
+		return
+	}); err != nil {
+		return err
+	}
+	defer sc.Close()
+	sess, err := sc.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	sess.Stdin = strings.NewReader(command)
+	sess.Stdout = out
+	sess.Stderr = stderr
+	if err := sess.Run("bash"); err != nil {
+		return fmt.Errorf("failed to run command on %s: %s", h.addr, err)
+	}
+	return nil
+}
+
+func (h *externalHost) ForwardPort(guestPort int) (string, error) {
+	sc, err := h.DialSSH()
+	if err != nil {
+		return "", err
+	}
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		sc.Close()
+		return "", err
+	}
+	f := &portForward{l: l, sc: sc}
+	h.forwardMtx.Lock()
+	h.forwards = append(h.forwards, f)
+	h.forwardMtx.Unlock()
+	go f.serve(fmt.Sprintf("127.0.0.1:%d", guestPort))
+	return l.Addr().String(), nil
+}
+
+// Kill only closes the port forwards, leaving the machine running.
+func (h *externalHost) Kill() error {
+	h.forwardMtx.Lock()
+	defer h.forwardMtx.Unlock()
+	for _, f := range h.forwards {
+		f.Close()
+	}
+	h.forwards = nil
+	return nil
+}
+
+func (h *externalHost) Upload(localPath, remotePath string) error {
+	return upload(h, localPath, remotePath)
+}
+
+func (h *externalHost) Download(remotePath, localPath string) error {
+	return download(h, remotePath, localPath)
+}
+
+func (h *externalHost) Start() error                      { return nil }
+func (h *externalHost) Wait() error                       { return nil }
+func (h *externalHost) Shutdown() error                   { return h.Kill() }
+func (h *externalHost) Drive(string) *VMDrive             { return nil }
+func (h *externalHost) Pause() error                      { return errExternal }
+func (h *externalHost) Resume() error                     { return errExternal }
+func (h *externalHost) Reset() error                      { return errExternal }
+func (h *externalHost) Snapshot(name string) error        { return errExternal }
+func (h *externalHost) RestoreSnapshot(name string) error { return errExternal }
+func (h *externalHost) OOMKills() []string                { return nil }
+func (h *externalHost) Panic() *GuestPanic                { return nil }
+func (h *externalHost) Console() io.ReadCloser            { return ioutil.NopCloser(strings.NewReader("")) }
+func (h *externalHost) ConsoleTail(n int) []string        { return nil }
+func (h *externalHost) Stats() []StatsSample              { return nil }
@@ -0,0 +1,162 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// logFanout copies output to subscribers without ever blocking on them, so
+// that a stalled reader can't wedge the writer, such as a guest whose
+// console output is no longer read. Each subscriber buffers up to its limit
+// in memory, beyond which its output is either spilled to a temp file, for
+// subscribers which need all of it such as the console log, or dropped and
+// replaced with a note of how much was lost, for followers which only need
+// to keep up.
+type logFanout struct {
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	subs   map[*logSubscriber]struct{}
+	closed bool
+}
+
+func newLogFanout() *logFanout {
+	f := &logFanout{subs: make(map[*logSubscriber]struct{})}
+	f.cond = sync.NewCond(&f.mtx)
+	return f
+}
+
+func (f *logFanout) Write(p []byte) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for s := range f.subs {
+		s.add(p)
+	}
+	f.cond.Broadcast()
+	return len(p), nil
+}
+
+// Close ends subscribers once they have read what they were sent.
+func (f *logFanout) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.closed = true
+	f.cond.Broadcast()
+	return nil
+}
+
+// subscribe returns a reader of initial followed by the output written from
+// now on, buffering up to limit bytes in memory before spilling or dropping
+// the rest.
+func (f *logFanout) subscribe(initial []byte, limit int, spill bool) *logSubscriber {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	s := &logSubscriber{f: f, limit: limit, spill: spill}
+	s.buf.Write(initial)
+	if !f.closed {
+		f.subs[s] = struct{}{}
+	}
+	return s
+}
+
+type logSubscriber struct {
+	f     *logFanout
+	limit int
+	spill bool
+	buf   bytes.Buffer
+
+	// file holds the output spilled beyond limit, from offset spillR up to
+	// spillW, which is read once buf has been.
+	file           *os.File
+	spillR, spillW int64
+
+	dropped int
+	closed  bool
+}
+
+// add is called with the fanout locked.
+func (s *logSubscriber) add(p []byte) {
+	if s.spillR == s.spillW && s.buf.Len()+len(p) <= s.limit {
+		s.noteDropped()
+		s.buf.Write(p)
+		return
+	}
+	if s.spill && s.file == nil {
+		var err error
+		if s.file, err = ioutil.TempFile("", "flynn-log-spill-"); err == nil {
+			os.Remove(s.file.Name())
+		}
+	}
+	if s.file != nil {
+		if n, err := s.file.WriteAt(p, s.spillW); err == nil {
+			s.spillW += int64(n)
+			return
+		}
+	}
+	s.dropped += len(p)
+}
+
+func (s *logSubscriber) noteDropped() {
+	if s.dropped > 0 {
+		fmt.Fprintf(&s.buf, "[%d bytes of output dropped, the reader fell behind]\n", s.dropped)
+		s.dropped = 0
+	}
+}
+
+func (s *logSubscriber) Read(p []byte) (int, error) {
+	f := s.f
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for s.buf.Len() == 0 && s.spillR == s.spillW && s.dropped == 0 && !f.closed && !s.closed {
+		f.cond.Wait()
+	}
+	if s.closed {
+		return 0, io.EOF
+	}
+	if s.buf.Len() > 0 {
+		return s.buf.Read(p)
+	}
+	if s.spillR < s.spillW {
+		if left := s.spillW - s.spillR; int64(len(p)) > left {
+			p = p[:left]
+		}
+		n, err := s.file.ReadAt(p, s.spillR)
+		s.spillR += int64(n)
+		if s.spillR == s.spillW {
+			s.spillR, s.spillW = 0, 0
+			s.file.Truncate(0)
+		}
+		if n == len(p) {
+			err = nil
+		}
+		return n, err
+	}
+	if s.dropped > 0 {
+		s.noteDropped()
+		return s.buf.Read(p)
+	}
+	s.release()
+	return 0, io.EOF
+}
+
+// Close unsubscribes, ending reads.
+func (s *logSubscriber) Close() error {
+	s.f.mtx.Lock()
+	defer s.f.mtx.Unlock()
+	s.release()
+	s.f.cond.Broadcast()
+	return nil
+}
+
+func (s *logSubscriber) release() {
+	delete(s.f.subs, s)
+	s.closed = true
+	s.buf.Reset()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
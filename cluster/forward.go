@@ -0,0 +1,79 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"code.google.com/p/go.crypto/ssh"
+)
+
+// portForward tunnels connections accepted by l to a guest address over an
+// ssh connection to the guest.
+type portForward struct {
+	l  net.Listener
+	sc *ssh.Client
+}
+
+func (f *portForward) serve(addr string) {
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			remote, err := f.sc.Dial("tcp", addr)
+			if err != nil {
+				return
+			}
+			defer remote.Close()
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(remote, conn)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(conn, remote)
+				done <- struct{}{}
+			}()
+			<-done
+		}()
+	}
+}
+
+func (f *portForward) Close() error {
+	f.l.Close()
+	return f.sc.Close()
+}
+
+// ForwardPort listens on a loopback port of the host and tunnels connections
+// to it over ssh to guestPort on the guest's loopback interface, so services
+// which only listen locally can be reached. It returns the host address,
+// which stops accepting connections once the instance is killed or exits.
+func (v *vm) ForwardPort(guestPort int) (string, error) {
+	sc, err := v.DialSSH()
+	if err != nil {
+		return "", err
+	}
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		sc.Close()
+		return "", err
+	}
+	f := &portForward{l: l, sc: sc}
+	v.forwardMtx.Lock()
+	v.forwards = append(v.forwards, f)
+	v.forwardMtx.Unlock()
+	go f.serve(fmt.Sprintf("127.0.0.1:%d", guestPort))
+	return l.Addr().String(), nil
+}
+
+func (v *vm) closeForwards() {
+	v.forwardMtx.Lock()
+	defer v.forwardMtx.Unlock()
+	for _, f := range v.forwards {
+		f.Close()
+	}
+	v.forwards = nil
+}
@@ -0,0 +1,263 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var provisionScript = template.Must(template.New("provision").Funcs(template.FuncMap{
+	"shellquote": shellQuote,
+}).Parse(`
+set -e
+{{ if .RootSize }}
+root=$(findmnt -no SOURCE /)
+disk=$(lsblk -no PKNAME "$root")
+if [ -n "$disk" ]; then
+  sudo growpart "/dev/$disk" "${root##*[!0-9]}" || true
+fi
+sudo resize2fs "$root"
+{{ end }}
+{{- if .Swap }}
+sudo fallocate -l {{ .Swap }}M /swapfile
+sudo chmod 600 /swapfile
+sudo mkswap /swapfile
+sudo swapon /swapfile
+{{ end }}
+{{- range $key, $value := .Sysctl }}
+sudo sysctl -w {{ shellquote (printf "%s=%s" $key $value) }}
+{{- end }}
+`[1:]))
+
+// provision grows the root filesystem and configures swap and sysctls in a
+// booted instance.
+func (c *Cluster) provision(inst Instance, role *Role) error {
+	if role.RootSize == 0 && role.Swap == 0 && len(role.Sysctl) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	if err := provisionScript.Execute(&b, role); err != nil {
+		return err
+	}
+	return inst.Run(b.String(), attempts, c.out, c.out)
+}
+
+var oomPattern = regexp.MustCompile(`invoked oom-killer|Out of memory: Kill(ed)? process`)
+
+// readyPattern matches the console output of a guest which has finished
+// booting: the message of the rootfs boot-ready job, a login prompt or the
+// systemd multi-user target.
+var readyPattern = regexp.MustCompile(`flynn-test: boot complete|login: ?$|Reached target (Multi-User System|Login Prompts)`)
+
+// consoleWatcher copies an instance's console output to w with each line
+// timestamped, recording kernel messages about the OOM killer and when the
+// guest has booted, and keeping the latest lines in a ring buffer.
+//
+// Output is fanned out to w and Console readers through out, so a slow
+// writer or reader never blocks the QEMU process writing to the console.
+type consoleWatcher struct {
+	// onLine is called with each line of output.
+	onLine func(string)
+
+	mtx      sync.Mutex
+	line     []byte
+	tail     *lineRing
+	oom      []string
+	panicked bool
+	closed   bool
+
+	out     *logFanout
+	drained chan struct{}
+
+	// booted matches the console output of a guest which has booted,
+	// closing ready.
+	booted    *regexp.Regexp
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+func newConsoleWatcher(w io.Writer, lines int, onLine func(string)) *consoleWatcher {
+	if lines <= 0 {
+		lines = consoleRingLines
+	} else if lines < consoleTailLines {
+		lines = consoleTailLines
+	}
+	c := &consoleWatcher{
+		onLine:  onLine,
+		tail:    newLineRing(lines),
+		out:     newLogFanout(),
+		drained: make(chan struct{}),
+		booted:  readyPattern,
+		ready:   make(chan struct{}),
+	}
+	// w is spilled to disk rather than dropped, so it gets all the output
+	sub := c.out.subscribe(nil, consoleBufferSize, true)
+	go func() {
+		defer close(c.drained)
+		if _, err := io.Copy(w, sub); err != nil {
+			sub.Close()
+		}
+	}()
+	return c
+}
+
+// consoleBufferSize is the console output buffered in memory for each of w
+// and Console readers while they fall behind.
+const consoleBufferSize = 1 << 20
+
+func (c *consoleWatcher) Write(p []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.line = append(c.line, p...)
+	for {
+		i := bytes.IndexByte(c.line, '\n')
+		if i < 0 {
+			break
+		}
+		c.writeLine(bytes.TrimRight(c.line[:i], "\r"))
+		c.line = c.line[i+1:]
+	}
+	// login prompts aren't terminated by a newline
+	if c.booted.Match(c.line) {
+		c.readyOnce.Do(func() { close(c.ready) })
+	}
+	return len(p), nil
+}
+
+func (c *consoleWatcher) writeLine(line []byte) {
+	if oomPattern.Match(line) {
+		c.oom = append(c.oom, string(bytes.TrimSpace(line)))
+	}
+	if panicPattern.Match(line) {
+		c.panicked = true
+	}
+	if c.booted.Match(line) {
+		c.readyOnce.Do(func() { close(c.ready) })
+	}
+	if c.onLine != nil {
+		c.onLine(string(line))
+	}
+	stamped := fmt.Sprintf("[%s] %s\n", time.Now().Format("15:04:05.000"), line)
+	c.tail.add(stamped[:len(stamped)-1])
+	c.out.Write([]byte(stamped))
+}
+
+// close flushes a trailing partial line once the guest has exited, ending
+// Console readers, and waits for the output to be written to w.
+func (c *consoleWatcher) close() {
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		return
+	}
+	if len(c.line) > 0 {
+		c.writeLine(c.line)
+		c.line = nil
+	}
+	c.closed = true
+	c.out.Close()
+	c.mtx.Unlock()
+	<-c.drained
+}
+
+// Reader returns a reader of the lines kept in the ring buffer followed by
+// later output, which blocks for more until the guest exits or the reader
+// is closed. Output is dropped for a reader which falls behind, rather than
+// holding up the guest.
+func (c *consoleWatcher) Reader() io.ReadCloser {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var initial bytes.Buffer
+	for _, line := range c.tail.last(0) {
+		initial.WriteString(line)
+		initial.WriteByte('\n')
+	}
+	return c.out.subscribe(initial.Bytes(), consoleBufferSize, false)
+}
+
+func (c *consoleWatcher) Tail() string {
+	return strings.Join(c.TailLines(consoleTailLines), "\n")
+}
+
+// TailLines returns the latest n timestamped lines, or as many as are kept.
+func (c *consoleWatcher) TailLines(n int) []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.tail.last(n)
+}
+
+// lineRing keeps the latest lines written to it, up to its size.
+type lineRing struct {
+	lines []string
+	next  int
+	full  bool
+}
+
+func newLineRing(size int) *lineRing {
+	return &lineRing{lines: make([]string, size)}
+}
+
+func (r *lineRing) add(line string) {
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last returns the latest n lines, oldest first.
+func (r *lineRing) last(n int) []string {
+	count := r.next
+	if r.full {
+		count = len(r.lines)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+	res := make([]string, n)
+	start := r.next - n
+	if start < 0 {
+		start += len(r.lines)
+	}
+	for i := range res {
+		res[i] = r.lines[(start+i)%len(r.lines)]
+	}
+	return res
+}
+
+func (c *consoleWatcher) Panicked() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.panicked
+}
+
+func (c *consoleWatcher) OOMKills() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]string(nil), c.oom...)
+}
+
+var panicPattern = regexp.MustCompile(`Kernel panic - not syncing`)
+
+// consoleTailLines is the number of console lines attached to guest panic
+// reports, and consoleRingLines the number kept for ConsoleTail by default.
+const (
+	consoleTailLines = 100
+	consoleRingLines = 1000
+)
+
+// GuestPanic describes a guest kernel panic, detected either by the pvpanic
+// device or on the console.
+type GuestPanic struct {
+	// Console is the tail of the console output when the panic was
+	// detected, which usually includes the backtrace.
+	Console string
+
+	// Dump is the path of a guest memory dump, if one was captured.
+	Dump string
+}
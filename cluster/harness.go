@@ -0,0 +1,123 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// harnessPath is where the guest harness is installed in instances.
+const harnessPath = "/usr/local/bin/flynn-test-harness"
+
+// GuestTest is a shell command run as a test by the guest harness, which
+// kills it if it runs for longer than Timeout.
+type GuestTest struct {
+	Name    string        `json:"name"`
+	Command string        `json:"command"`
+	Timeout time.Duration `json:"timeout"`
+}
+
+// GuestResult is the result of a GuestTest. Status is "pass", "fail" or
+// "timeout", and Output is the end of the test's combined output.
+type GuestResult struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	ExitCode int           `json:"exit_code"`
+	Duration time.Duration `json:"duration"`
+	Output   string        `json:"output"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// installHarness uploads the guest harness into inst.
+func (c *Cluster) installHarness(inst Instance) error {
+	if err := inst.Upload(c.bc.Harness, "/tmp/flynn-test-harness"); err != nil {
+		return fmt.Errorf("could not upload the guest harness: %s", err)
+	}
+	return inst.Run("sudo install -m 0755 /tmp/flynn-test-harness "+harnessPath, attempts, c.out, c.out)
+}
+
+// RunGuestTests runs tests in instance i with the guest harness, calling
+// onResult with the result of each as it finishes. If the ssh session drops,
+// the harness keeps running the tests, and the results it records are
+// collected once it is done.
+func (c *Cluster) RunGuestTests(i int, tests []*GuestTest, onResult func(*GuestResult)) error {
+	if c.bc.Harness == "" {
+		return errors.New("cluster: the guest harness isn't installed")
+	}
+	if i < 0 || i >= len(c.instances) {
+		return fmt.Errorf("cluster: no instance %d", i)
+	}
+	inst := c.instances[i]
+	input, err := json.Marshal(tests)
+	if err != nil {
+		return err
+	}
+	resultsPath := fmt.Sprintf("/tmp/flynn-test-harness-%d.json", time.Now().UnixNano())
+	seen := make(map[string]bool, len(tests))
+	err = c.streamGuestTests(inst, input, resultsPath, func(res *GuestResult) {
+		seen[res.Name] = true
+		onResult(res)
+	})
+	if err == nil {
+		return nil
+	}
+	c.logf("lost the guest harness of instance %d, collecting its results: %s\n", i, err)
+	var out bytes.Buffer
+	wait := fmt.Sprintf("while [ ! -e %s.done ]; do sleep 1; done; cat %s", resultsPath, resultsPath)
+	if err := inst.Run(wait, attempts, &out, c.out); err != nil {
+		return fmt.Errorf("could not collect guest test results: %s", err)
+	}
+	dec := json.NewDecoder(&out)
+	for {
+		res := &GuestResult{}
+		if err := dec.Decode(res); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("could not decode guest test results: %s", err)
+		}
+		if !seen[res.Name] {
+			seen[res.Name] = true
+			onResult(res)
+		}
+	}
+	if len(seen) < len(tests) {
+		return fmt.Errorf("the guest harness ran %d of %d tests", len(seen), len(tests))
+	}
+	return nil
+}
+
+func (c *Cluster) streamGuestTests(inst Instance, input []byte, resultsPath string, onResult func(*GuestResult)) error {
+	sc, err := inst.DialSSH()
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	sess, err := sc.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	sess.Stdin = bytes.NewReader(input)
+	sess.Stderr = c.out
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := sess.Start(harnessPath + " --results " + resultsPath); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(stdout)
+	for {
+		res := &GuestResult{}
+		if err := dec.Decode(res); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		onResult(res)
+	}
+	return sess.Wait()
+}
@@ -0,0 +1,60 @@
+package cluster
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const hugePagesPath = "/dev/hugepages"
+
+// hugePagesFree returns the amount of free huge page memory on the host in
+// MB.
+func hugePagesFree() (int, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var free, sizeKB int
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "HugePages_Free:":
+			free, _ = strconv.Atoi(fields[1])
+		case "Hugepagesize:":
+			sizeKB, _ = strconv.Atoi(fields[1])
+		}
+	}
+	return free * sizeKB / 1024, s.Err()
+}
+
+// memoryArgs returns the QEMU args which back the instance's memory with
+// huge pages.
+func (v *vm) memoryArgs() ([]string, error) {
+	if !v.HugePages {
+		return nil, nil
+	}
+	size, err := strconv.Atoi(v.Memory)
+	if err != nil {
+		return nil, fmt.Errorf("huge pages require memory to be set in MB, got %q", v.Memory)
+	}
+	free, err := hugePagesFree()
+	if err != nil {
+		return nil, fmt.Errorf("could not read huge page info: %s", err)
+	}
+	if free < size {
+		return nil, fmt.Errorf("instance needs %d MB of huge pages but only %d MB are free, reserve more with vm.nr_hugepages", size, free)
+	}
+	backend := fmt.Sprintf("memory-backend-file,id=mem,size=%dM,mem-path=%s,share=on", size, hugePagesPath)
+	if v.Prealloc {
+		backend += ",prealloc=on"
+	}
+	return []string{"-object", backend, "-numa", "node,memdev=mem"}, nil
+}
@@ -0,0 +1,176 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileChange is a file which differs between two images. Kind is one of
+// "added", "removed" or "changed", and for changed files Detail says what
+// changed, e.g. "size 1024 -> 2048".
+type FileChange struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type imageFile struct {
+	mode os.FileMode
+	size int64
+	link string
+}
+
+// DiffImages mounts images a and b read only with libguestfs and compares
+// their files under root by type, mode, size, symlink target and, for
+// regular files of the same size, their contents.
+func DiffImages(a, b, root string) ([]*FileChange, error) {
+	dirA, err := mountImage(a)
+	if err != nil {
+		return nil, err
+	}
+	defer unmountImage(dirA)
+	dirB, err := mountImage(b)
+	if err != nil {
+		return nil, err
+	}
+	defer unmountImage(dirB)
+
+	filesA, err := imageFiles(dirA, root)
+	if err != nil {
+		return nil, err
+	}
+	filesB, err := imageFiles(dirB, root)
+	if err != nil {
+		return nil, err
+	}
+	var changes []*FileChange
+	for path, fa := range filesA {
+		fb, ok := filesB[path]
+		if !ok {
+			changes = append(changes, &FileChange{Path: path, Kind: "removed"})
+			continue
+		}
+		detail, err := compareFiles(filepath.Join(dirA, path), filepath.Join(dirB, path), fa, fb)
+		if err != nil {
+			return nil, err
+		}
+		if detail != "" {
+			changes = append(changes, &FileChange{Path: path, Kind: "changed", Detail: detail})
+		}
+	}
+	for path := range filesB {
+		if _, ok := filesA[path]; !ok {
+			changes = append(changes, &FileChange{Path: path, Kind: "added"})
+		}
+	}
+	sort.Sort(fileChangesByPath(changes))
+	return changes, nil
+}
+
+func mountImage(image string) (string, error) {
+	dir, err := ioutil.TempDir("", "image-diff-")
+	if err != nil {
+		return "", err
+	}
+	// docker fs images are a bare btrfs filesystem without a partition table
+	if out, err := exec.Command("guestmount", "--ro", "-a", image, "-m", "/dev/sda", dir).CombinedOutput(); err != nil {
+		os.Remove(dir)
+		return "", fmt.Errorf("could not mount %s: %s: %s", image, err, out)
+	}
+	return dir, nil
+}
+
+func unmountImage(dir string) {
+	exec.Command("guestunmount", dir).Run()
+	os.Remove(dir)
+}
+
+func imageFiles(dir, root string) (map[string]*imageFile, error) {
+	files := make(map[string]*imageFile)
+	base := filepath.Join(dir, root)
+	err := filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == base {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		rel := "/" + strings.TrimPrefix(path[len(dir):], "/")
+		f := &imageFile{mode: info.Mode(), size: info.Size()}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if f.link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		if info.IsDir() {
+			f.size = 0
+		}
+		files[rel] = f
+		return nil
+	})
+	return files, err
+}
+
+func compareFiles(pathA, pathB string, a, b *imageFile) (string, error) {
+	switch {
+	case a.mode.IsDir() != b.mode.IsDir() || a.mode&os.ModeSymlink != b.mode&os.ModeSymlink:
+		return fmt.Sprintf("type %s -> %s", fileType(a.mode), fileType(b.mode)), nil
+	case a.link != b.link:
+		return fmt.Sprintf("link %s -> %s", a.link, b.link), nil
+	case a.mode != b.mode:
+		return fmt.Sprintf("mode %s -> %s", a.mode, b.mode), nil
+	case a.size != b.size:
+		return fmt.Sprintf("size %d -> %d", a.size, b.size), nil
+	case !a.mode.IsRegular():
+		return "", nil
+	}
+	sumA, err := fileSum(pathA)
+	if err != nil {
+		return "", err
+	}
+	sumB, err := fileSum(pathB)
+	if err != nil {
+		return "", err
+	}
+	if sumA != sumB {
+		return "contents", nil
+	}
+	return "", nil
+}
+
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "dir"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "file"
+	}
+}
+
+func fileSum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+type fileChangesByPath []*FileChange
+
+func (c fileChangesByPath) Len() int           { return len(c) }
+func (c fileChangesByPath) Less(i, j int) bool { return c[i].Path < c[j].Path }
+func (c fileChangesByPath) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
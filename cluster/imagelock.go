@@ -0,0 +1,48 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// imageLock is an advisory lock on a disk image, shared by every instance
+// using the image as the backing file of a COW derivation, or held
+// exclusively by an instance writing to the image directly. This stops an
+// image being written while others derive from it, including by other
+// processes sharing the image.
+type imageLock struct {
+	f *os.File
+}
+
+func lockImage(path string, exclusive bool) (*imageLock, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			if exclusive {
+				return nil, fmt.Errorf("image %s is in use by another instance", path)
+			}
+			return nil, fmt.Errorf("image %s is being written by another instance", path)
+		}
+		return nil, err
+	}
+	return &imageLock{f}, nil
+}
+
+func (l *imageLock) Release() error {
+	return l.f.Close()
+}
+
+// sealImage makes a finished image read-only so that instances deriving from
+// it can't write to it.
+func sealImage(path string) error {
+	return os.Chmod(path, 0444)
+}
@@ -0,0 +1,101 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Image references record what depends on a disk image beyond the instances
+// running on it, which hold locks on it instead: the overlays derived from
+// it which outlive their instances, such as built docker fs images, and the
+// runs which will boot it, such as builds saved to be resumed. Referenced
+// images aren't removed by the build cache or snapshot GC.
+//
+// Each reference is a file in a dir beside the image, so they are shared by
+// the processes using the image and survive restarts.
+
+func refsDir(image string) string {
+	return image + ".refs"
+}
+
+func refPath(image, ref string) string {
+	sum := sha256.Sum256([]byte(ref))
+	return filepath.Join(refsDir(image), hex.EncodeToString(sum[:8]))
+}
+
+// RefImage records that ref depends on image. A ref which is an absolute
+// path, such as that of an overlay derived from image, is dropped once
+// nothing exists at the path.
+func RefImage(image, ref string) error {
+	if err := os.MkdirAll(refsDir(image), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(refPath(image, ref), []byte(ref), 0644)
+}
+
+// UnrefImage drops a ref of image.
+func UnrefImage(image, ref string) {
+	os.Remove(refPath(image, ref))
+}
+
+// ImageRefs returns the refs of image, dropping those of paths which have
+// been removed.
+func ImageRefs(image string) []string {
+	files, _ := filepath.Glob(filepath.Join(refsDir(image), "*"))
+	var refs []string
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		ref := string(data)
+		if strings.HasPrefix(ref, "/") {
+			if _, err := os.Stat(ref); os.IsNotExist(err) {
+				os.Remove(f)
+				continue
+			}
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// RemoveImage removes image unless it is referenced or in use, returning
+// whether it was removed.
+func RemoveImage(image string) bool {
+	if len(ImageRefs(image)) > 0 {
+		return false
+	}
+	lock, err := lockImage(image, true)
+	if err != nil {
+		return false
+	}
+	defer lock.Release()
+	if err := os.Remove(image); err != nil {
+		return false
+	}
+	os.RemoveAll(refsDir(image))
+	return true
+}
+
+// refBacking refs the backing file of the overlay at path by it.
+func refBacking(backing, path string) error {
+	backing, err := filepath.Abs(backing)
+	if err != nil {
+		return err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	return RefImage(backing, path)
+}
+
+// DropRefs removes the refs of an image which is removed regardless of them.
+func DropRefs(image string) {
+	os.RemoveAll(refsDir(image))
+}
@@ -0,0 +1,174 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ImageCatalog is written by rootfs/build.sh alongside the images it builds.
+type ImageCatalog struct {
+	// KernelVersion is the version of the kernel modules installed in the
+	// rootfs, which the booted kernel must match.
+	KernelVersion string `json:"kernel_version"`
+
+	// NetworkConfig is the network manager of the rootfs, which determines
+	// the format of the network config written to the netfs of instances.
+	NetworkConfig string `json:"network_config"`
+
+	// Checksums are hex encoded SHA-256 sums keyed by image file name.
+	Checksums map[string]string `json:"checksums"`
+}
+
+func LoadImageCatalog(path string) (*ImageCatalog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c := &ImageCatalog{}
+	if err := json.NewDecoder(f).Decode(c); err != nil {
+		return nil, fmt.Errorf("invalid image catalog %s: %s", path, err)
+	}
+	return c, nil
+}
+
+// VerifyChecksum checks the file at path against the catalog entry with the
+// same name.
+func (c *ImageCatalog) VerifyChecksum(path string) error {
+	name := filepath.Base(path)
+	expected, ok := c.Checksums[name]
+	if !ok {
+		return fmt.Errorf("%s is not in the image catalog", name)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", path, expected, actual)
+	}
+	return nil
+}
+
+// VerifyKernel checks that the kernel at path is the version the rootfs was
+// built with. A mismatched kernel can't load the rootfs modules, and the
+// instance hangs during boot.
+func (c *ImageCatalog) VerifyKernel(path string) error {
+	if err := c.VerifyChecksum(path); err != nil {
+		return err
+	}
+	if c.KernelVersion == "" {
+		return nil
+	}
+	version, err := kernelVersion(path)
+	if err != nil {
+		return err
+	}
+	if version != c.KernelVersion {
+		return fmt.Errorf("kernel %s is version %s but the rootfs has modules for %s", path, version, c.KernelVersion)
+	}
+	return nil
+}
+
+// kernelVersion reads the version string from the setup header of a bzImage.
+func kernelVersion(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, 0x210)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return "", fmt.Errorf("could not read kernel header of %s: %s", path, err)
+	}
+	if string(header[0x202:0x206]) != "HdrS" {
+		return "", fmt.Errorf("%s is not a bzImage kernel", path)
+	}
+	offset := binary.LittleEndian.Uint16(header[0x20e:0x210])
+	if offset == 0 {
+		return "", errors.New("kernel has no version string")
+	}
+	version := make([]byte, 256)
+	n, err := f.ReadAt(version, int64(offset)+0x200)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	// the version string is followed by the builder and build date
+	s := string(version[:n])
+	if i := strings.IndexAny(s, " \x00"); i >= 0 {
+		s = s[:i]
+	}
+	return s, nil
+}
+
+// CheckImage runs qemu-img check on the disk image at path and returns its
+// backing chain, starting with path itself. It fails if any image in the
+// chain is missing or corrupt.
+func CheckImage(path string) ([]string, error) {
+	if out, err := exec.Command("qemu-img", "check", path).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("qemu-img check %s failed: %s: %s", path, err, strings.TrimSpace(string(out)))
+	}
+	return backingChain(path)
+}
+
+// backingChain returns the backing chain of the disk image at path, starting
+// with path itself.
+func backingChain(path string) ([]string, error) {
+	out, err := exec.Command("qemu-img", "info", "--backing-chain", "--output=json", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not read backing chain of %s: %s", path, err)
+	}
+	var infos []struct {
+		Filename string `json:"filename"`
+	}
+	if err := json.Unmarshal(out, &infos); err != nil {
+		return nil, fmt.Errorf("could not parse backing chain of %s: %s", path, err)
+	}
+	chain := make([]string, len(infos))
+	for i, info := range infos {
+		if _, err := os.Stat(info.Filename); err != nil {
+			return nil, fmt.Errorf("backing file of %s is missing: %s", path, err)
+		}
+		chain[i] = info.Filename
+	}
+	return chain, nil
+}
+
+// NewOverlay creates a COW image backed by image, so that a sealed image can
+// be used where a writable copy is expected.
+func NewOverlay(image string) (string, error) {
+	backing, err := filepath.Abs(image)
+	if err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir("", "dockerfs-")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "fs.img")
+	if out, err := exec.Command("qemu-img", "create", "-f", "qcow2", "-b", backing, path).CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("could not create overlay of %s: %s: %s", image, err, strings.TrimSpace(string(out)))
+	}
+	if err := refBacking(backing, path); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return path, nil
+}
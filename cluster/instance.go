@@ -3,90 +3,439 @@ package cluster
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
+	"text/template"
 	"time"
 
 	"code.google.com/p/go.crypto/ssh"
-	"github.com/flynn/go-flynn/attempt"
+	"code.google.com/p/go.crypto/ssh/agent"
+	"github.com/flynn/flynn-test/util"
 )
 
-func NewVMManager(bridge *Bridge) *VMManager {
-	return &VMManager{taps: &TapManager{bridge}}
+func NewVMManager(taps *TapManager) *VMManager {
+	return &VMManager{taps: taps}
 }
 
 type VMManager struct {
+	// RunID and Workdir are available to VMConfig templates as {{.RunID}}
+	// and {{.Workdir}}.
+	RunID   string
+	Workdir string
+
+	// Netboot serves boot files for instances with Netboot set, and Net
+	// answers DHCP and DNS for instances.
+	Netboot *NetbootServer
+	Net     *NetServer
+
+	// Syslog collects the syslog forwarded by instances if it is set.
+	Syslog *SyslogCollector
+
+	// NetConfig is the format of the network config written to the netfs
+	// of instances, see NetConfigFormats.
+	NetConfig string
+
+	// IPs holds IPs reserved from the tap allocator, which are written to
+	// the metadata dir of the netfs of instances if it is set.
+	IPs *IPAM
+
+	// Macvtap is a host NIC which instances get a second interface on,
+	// eth1, through a macvtap device, configured by DHCP from the NIC's
+	// network. It is for benchmarks which shouldn't be limited by the
+	// bridge and NAT.
+	Macvtap string
+
+	// Confine runs QEMU with its seccomp sandbox enabled and under an
+	// AppArmor profile generated for each instance.
+	Confine bool
+
+	// SSHUser and SSHKey are the credentials used in addition to the run's
+	// generated key, see BootConfig.
+	SSHUser string
+	SSHKey  string
+
+	// Resources limits the instances run on the host if it is set.
+	Resources *ResourcePool
+
+	// Discovery is injected into instances by InjectDiscovery, see
+	// DiscoveryMethods.
+	Discovery       *Discovery
+	InjectDiscovery map[string]bool
+
+	// ConsoleLines is the number of console lines of each instance kept in
+	// memory for ConsoleTail, defaulting to 1000.
+	ConsoleLines int
+
+	// BootTimeout and SSHTimeout override the time Run gives instances to
+	// boot and accept ssh, see BootConfig.
+	BootTimeout time.Duration
+	SSHTimeout  time.Duration
+
+	// Labels tag the instances, see Labels.
+	Labels Labels
+
 	taps   *TapManager
 	nextID uint64
+
+	keys    *sshKeys
+	keysMtx sync.Mutex
+}
+
+// templateVars are the variables available when expanding placeholders in
+// VMConfig drive paths, shared dir paths and args.
+type templateVars struct {
+	RunID         string
+	InstanceIndex uint64
+	InstanceID    string
+	Workdir       string
+}
+
+func expandTemplate(s string, vars *templateVars) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	t, err := template.New("").Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid template %q: %s", s, err)
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("invalid template %q: %s", s, err)
+	}
+	return b.String(), nil
+}
+
+func (c *VMConfig) expand(vars *templateVars) error {
+	var err error
+	for _, d := range c.Drives {
+		if d.FS, err = expandTemplate(d.FS, vars); err != nil {
+			return err
+		}
+	}
+	for tag, path := range c.SharedDirs {
+		if c.SharedDirs[tag], err = expandTemplate(path, vars); err != nil {
+			return err
+		}
+	}
+	if c.CrashDumpDir, err = expandTemplate(c.CrashDumpDir, vars); err != nil {
+		return err
+	}
+	for i, arg := range c.Args {
+		if c.Args[i], err = expandTemplate(arg, vars); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type VMConfig struct {
 	Kernel string
+	Initrd string
 	User   int
 	Group  int
 	Memory string
+	Cores  int
 	Drives map[string]*VMDrive
 	Args   []string
 	Out    io.Writer
 
+	// Boot is the boot profile of the guest, DefaultBootProfile if it is
+	// nil.
+	Boot *BootProfile
+
+	// SharedDirs are host directories exported to the guest over 9p, keyed
+	// by mount tag.
+	SharedDirs map[string]string
+
+	// AgentSocket is the path of an ssh-agent socket which is forwarded to
+	// the guest in sessions started by Run.
+	AgentSocket string
+
+	// BootOrder is passed to QEMU as -boot order=BootOrder. Netboot
+	// instances PXE boot from the cluster's NetbootServer instead of
+	// booting Kernel directly, and default to a boot order of "n".
+	BootOrder string
+	Netboot   bool
+
+	// Devices are passed through from the host.
+	Devices []string
+
+	CPU        string
+	NestedVirt bool
+	HugePages  bool
+	Prealloc   bool
+
+	// CPUSet pins the QEMU process to host CPUs using taskset.
+	CPUSet string
+
+	// CrashDumpDir is where guest memory is dumped if the guest kernel
+	// panics. Panics are still detected if it is empty.
+	CrashDumpDir string
+
 	netFS string
 }
 
+func (c *VMConfig) bootProfile() *BootProfile {
+	if c.Boot == nil {
+		return DefaultBootProfiles[DefaultBootProfile]
+	}
+	return c.Boot
+}
+
+// VMDrive is an fs image attached to an instance. Temp drives are removed
+// when the instance is killed, or only their copy-on-write layer if COW is
+// set. DiskSize is the size in bytes of the copy-on-write layer, to give the
+// guest more space than the image has, and must not be smaller than the
+// image.
 type VMDrive struct {
-	FS   string
-	COW  bool
-	Temp bool
+	FS       string
+	COW      bool
+	Temp     bool
+	DiskSize int64
 }
 
 func (v *VMManager) NewInstance(c *VMConfig) (Instance, error) {
+	inst, err := v.newVM(c)
+	if err != nil {
+		return nil, err
+	}
+	if inst.dataMAC != "" {
+		if inst.macvtap, err = v.taps.NewMacvtap(v.Macvtap, inst.dataMAC, c.User, c.Group); err != nil {
+			inst.cleanup()
+			return nil, err
+		}
+		recordTap(v.RunID, inst.macvtap.Name)
+	}
+	return inst, nil
+}
+
+// newVM allocates the ID, instance dir and tap of a new instance, which
+// backends then start in their own way.
+func (v *VMManager) newVM(c *VMConfig) (inst *vm, err error) {
+	keys, err := v.sshKeys()
+	if err != nil {
+		return nil, err
+	}
+	var res *reservation
+	if v.Resources != nil {
+		if res, err = v.Resources.acquire(c); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				res.release()
+			}
+		}()
+	}
 	id := atomic.AddUint64(&v.nextID, 1) - 1
-	inst := &vm{
-		ID:       fmt.Sprintf("flynn%d", id),
-		VMConfig: c,
+	inst = &vm{
+		keys:      keys,
+		ID:        fmt.Sprintf("flynn%d", id),
+		VMConfig:  c,
+		netboot:   v.Netboot,
+		net:       v.Net,
+		syslog:    v.Syslog,
+		netConfig: v.NetConfig,
+		ips:       v.IPs,
+		discovery: v.Discovery,
+		inject:    v.InjectDiscovery,
+		runID:     v.RunID,
+		labels:    v.Labels,
+		confined:  v.Confine,
+		resources: res,
+
+		bootTimeout: v.BootTimeout,
+		sshTimeout:  v.SSHTimeout,
+	}
+	if v.Macvtap != "" {
+		inst.dataMAC = randomMAC()
+	}
+	workdir := v.Workdir
+	if workdir == "" {
+		workdir = os.TempDir()
+	}
+	runDir, err := RunDir(workdir, v.RunID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(runDir, "instances"), 0755); err != nil {
+		return nil, err
+	}
+	if inst.dir, err = ioutil.TempDir(filepath.Join(runDir, "instances"), inst.ID+"-"); err != nil {
+		return nil, err
+	}
+	// qemu runs as another user which needs access to the instance files
+	if err := os.Chmod(inst.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := c.expand(&templateVars{
+		RunID:         v.RunID,
+		InstanceIndex: id,
+		InstanceID:    inst.ID,
+		Workdir:       workdir,
+	}); err != nil {
+		return nil, err
 	}
 	if c.Kernel == "" {
 		c.Kernel = "vmlinuz"
 	}
 	if c.Out == nil {
-		var err error
-		c.Out, err = os.Create(inst.ID + ".log")
+		c.Out, err = os.Create(filepath.Join(inst.dir, "console.log"))
 		if err != nil {
 			return nil, err
 		}
 	}
-	var err error
+	inst.console = newConsoleWatcher(c.Out, v.ConsoleLines, func(line string) {
+		recordEvent(inst.runID, inst.ID, line)
+	})
+	if inst.console.booted, err = c.bootProfile().readyPattern(); err != nil {
+		return nil, err
+	}
+	inst.taps = v.taps
 	inst.tap, err = v.taps.NewTap(c.User, c.Group)
+	if err == nil {
+		recordTap(v.RunID, inst.tap.Name)
+	}
 	return inst, err
 }
 
+// Backend provisions instances. VMManager runs QEMU directly and
+// LibvirtBackend defines libvirt domains, both on the cluster bridge.
+type Backend interface {
+	NewInstance(*VMConfig) (Instance, error)
+}
+
 type Instance interface {
 	DialSSH() (*ssh.Client, error)
 	Start() error
 	Wait() error
 	Kill() error
 	IP() string
-	Run(string, attempt.Strategy, io.Writer, io.Writer) error
+	Run(string, util.Strategy, io.Writer, io.Writer) error
 	Drive(string) *VMDrive
+
+	// Shutdown powers the guest down cleanly, killing it if it doesn't stop
+	// in time. Pause and Resume stop and continue the guest's CPUs, and
+	// Reset reboots it without it shutting down.
+	Shutdown() error
+	Pause() error
+	Resume() error
+	Reset() error
+
+	// Snapshot saves the state of the running guest and its drives as name,
+	// which RestoreSnapshot reverts it to.
+	Snapshot(name string) error
+	RestoreSnapshot(name string) error
+
+	// Upload copies a local file into the guest, and Download a file out of
+	// it.
+	Upload(localPath, remotePath string) error
+	Download(remotePath, localPath string) error
+
+	// OOMKills returns the guest kernel's OOM killer messages seen on the
+	// console.
+	OOMKills() []string
+
+	// Panic returns details of a guest kernel panic, or nil if the guest
+	// hasn't panicked.
+	Panic() *GuestPanic
+
+	// Console returns a reader of the timestamped serial console output
+	// kept in memory and then of later output, which blocks for more until
+	// the guest exits or the reader is closed.
+	Console() io.ReadCloser
+
+	// ConsoleTail returns the latest n timestamped console lines kept in
+	// memory, or all of them if n is 0.
+	ConsoleTail(n int) []string
+
+	// Stats returns the latest samples of the host resources used by the
+	// instance, oldest first.
+	Stats() []StatsSample
+
+	// ForwardPort makes guestPort on the guest's loopback interface
+	// reachable at the returned host address until the instance exits.
+	ForwardPort(guestPort int) (string, error)
 }
 
 type vm struct {
 	ID string
 	*VMConfig
-	tap *Tap
-	cmd *exec.Cmd
+	tap   *Tap
+	taps  *TapManager
+	keys  *sshKeys
+	cmd   *exec.Cmd
+	mac   string
+	runID string
+
+	// labels tag the instance, see Labels.
+	labels Labels
+
+	// dir holds the instance's temp files, under the run dir.
+	dir string
+
+	netboot   *NetbootServer
+	net       *NetServer
+	syslog    *SyslogCollector
+	netConfig string
+	ips       *IPAM
+	discovery *Discovery
+	inject    map[string]bool
+	macvtap   *Macvtap
+	dataMAC   string
+	console   *consoleWatcher
+	qmp       *qmpClient
+
+	panicMtx sync.Mutex
+	panic    *GuestPanic
+
+	statsMtx sync.Mutex
+	stats    []StatsSample
+	pid      string
 
 	tempFiles []string
+	locks     []*imageLock
+
+	forwardMtx sync.Mutex
+	forwards   []*portForward
+
+	confined bool
+	apparmor *apparmorProfile
+
+	// resources are released from the host's ResourcePool on cleanup.
+	resources *reservation
+
+	started time.Time
+
+	bootTimeout time.Duration
+	sshTimeout  time.Duration
+
+	// exited is closed once QEMU has exited with exitErr, and killing is
+	// set once Kill signals it.
+	exited  chan struct{}
+	exitErr error
+	killing int32
+
+	// host is the machine QEMU runs on for instances of a RemoteBackend,
+	// with the instance's files in remoteDir. placed is set while the
+	// instance counts towards the host's instances.
+	host      *remoteHost
+	remoteDir string
+	placed    bool
 }
 
 func (v *vm) writeInterfaceConfig() error {
-	dir, err := ioutil.TempDir("", "netfs-")
+	dir, err := ioutil.TempDir(v.dir, "netfs-")
 	if err != nil {
 		return err
 	}
@@ -98,72 +447,359 @@ func (v *vm) writeInterfaceConfig() error {
 		return err
 	}
 
-	f, err := os.Create(filepath.Join(dir, "eth0"))
-	if err != nil {
+	if err := v.keys.write(dir); err != nil {
 		os.RemoveAll(dir)
 		return err
 	}
-	defer f.Close()
+	if v.syslog != nil {
+		v.syslog.AddHost(v.IP(), v.ID)
+		if err := v.syslog.writeTarget(dir); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
 
-	return v.tap.WriteInterfaceConfig(f)
+	if v.net != nil {
+		v.net.AddHost(v.mac, *v.tap.RemoteIP, v.ID, v.Netboot)
+	}
+	if err := v.tap.WriteNetConfig(dir, v.netConfig, v.mac, v.net.Nameservers()); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if v.ips != nil {
+		if err := v.ips.addNetFS(dir); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	if v.dataMAC != "" {
+		if err := writeDataNetConfig(dir, v.netConfig, v.dataMAC); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	if v.discovery != nil && v.inject["metadata"] {
+		if err := v.discovery.writeMetadata(dir); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	return nil
+}
+
+// cmdline returns the kernel command line of the instance.
+func (v *vm) cmdline() string {
+	cmdline := v.bootProfile().cmdline()
+	if v.discovery != nil && v.inject["cmdline"] {
+		cmdline += " " + v.discovery.cmdline()
+	}
+	return cmdline
 }
 
 func (v *vm) cleanup() {
+	v.closeForwards()
+	if v.host != nil {
+		v.cleanupRemote()
+	}
+	if !v.started.IsZero() {
+		recordUsage(v.runID, v.usage())
+		v.started = time.Time{}
+	}
 	for _, f := range v.tempFiles {
-		if err := os.RemoveAll(f); err != nil {
+		if err := removeTemp(v.runID, f); err != nil {
 			fmt.Printf("could not remove temp file %s: %s\n", f, err)
 		}
 	}
-	if err := v.tap.Close(); err != nil {
+	if err := v.taps.Release(v.tap); err != nil {
 		fmt.Printf("could not close tap device %s: %s\n", v.tap.Name, err)
 	}
+	if v.macvtap != nil {
+		if err := v.macvtap.Close(); err != nil {
+			fmt.Println(err)
+		}
+		v.macvtap = nil
+	}
 	v.tempFiles = nil
+	if v.resources != nil {
+		v.resources.release()
+		v.resources = nil
+	}
+	for _, l := range v.locks {
+		l.Release()
+	}
+	v.locks = nil
+	if v.qmp != nil {
+		v.qmp.Close()
+	}
+	if v.net != nil && v.mac != "" {
+		v.net.RemoveHost(v.mac)
+	}
+	if v.apparmor != nil {
+		if err := v.apparmor.unload(); err != nil {
+			fmt.Println(err)
+		}
+		v.apparmor = nil
+	}
 }
 
 func (v *vm) Start() error {
-	v.writeInterfaceConfig()
+	v.mac = randomMAC()
+	if err := v.writeInterfaceConfig(); err != nil {
+		v.cleanup()
+		return err
+	}
+	if v.host != nil {
+		if err := v.startRemote(); err != nil {
+			v.cleanup()
+			return err
+		}
+		return nil
+	}
+
+	qmpDir, err := ioutil.TempDir(v.dir, "qmp-")
+	if err != nil {
+		v.cleanup()
+		return err
+	}
+	v.tempFiles = append(v.tempFiles, qmpDir)
+	if err := os.Chown(qmpDir, v.User, v.Group); err != nil {
+		v.cleanup()
+		return err
+	}
+	qmpSocket := filepath.Join(qmpDir, "qmp.sock")
+	if err := v.qemuArgs("unix:" + qmpSocket + ",server,nowait"); err != nil {
+		v.cleanup()
+		return err
+	}
 
-	macRand := make([]byte, 3)
-	io.ReadFull(rand.Reader, macRand)
-	macaddr := fmt.Sprintf("52:54:00:%02x:%02x:%02x", macRand[0], macRand[1], macRand[2])
+	command := []string{"-u", fmt.Sprintf("#%d", v.User), "-g", fmt.Sprintf("#%d", v.Group), "-H"}
+	if v.macvtap != nil {
+		// sudo closes inherited fds, so the macvtap device is opened as
+		// fd 3 by a shell running as the QEMU user
+		command = append(command, "sh", "-c", `exec "$@" 3<>`+v.macvtap.Dev, "sh")
+	}
+	if v.confined {
+		v.Args = append(v.Args, "-sandbox", "on")
+		if err := v.confine(qmpDir); err != nil {
+			v.cleanup()
+			return err
+		}
+		command = append(command, "aa-exec", "-p", v.apparmor.Name, "--")
+	}
+	if v.CPUSet != "" {
+		if err := validateCPUSet(v.CPUSet); err != nil {
+			v.cleanup()
+			return err
+		}
+		command = append(command, "taskset", "-c", v.CPUSet)
+	}
+	command = append(command, v.bootProfile().qemu())
+	v.cmd = exec.Command("sudo", append(command, v.Args...)...)
+	v.cmd.Stdout = v.console
+	v.cmd.Stderr = v.console
+	if err = v.cmd.Start(); err != nil {
+		v.cleanup()
+		return err
+	}
+	v.started = time.Now()
+	recordEvent(v.runID, "host", "started instance "+v.ID)
+	v.exited = make(chan struct{})
+	go func() {
+		v.exitErr = v.cmd.Wait()
+		v.checkCrash()
+		v.console.close()
+		close(v.exited)
+	}()
+	go v.watchQMP(qmpSocket)
+	go v.sampleStats()
+	return nil
+}
 
+// qemuArgs appends the QEMU args of the instance to Args, with its QMP
+// server at qmp, and prepares its drives.
+func (v *vm) qemuArgs(qmp string) error {
+	boot := v.bootProfile()
+	if !boot.Emulated {
+		v.Args = append(v.Args, "-enable-kvm")
+	}
+	if boot.Machine != "" {
+		v.Args = append(v.Args, "-machine", boot.Machine)
+	}
+	if boot.PanicDevice != "" {
+		v.Args = append(v.Args, "-device", boot.PanicDevice)
+	}
+	v.Args = append(v.Args, "-qmp", qmp)
+	v.Args = append(v.Args, v.labels.smbiosArgs()...)
+	if v.Netboot {
+		if v.netboot == nil {
+			return errors.New("netboot requested but there is no netboot server")
+		}
+		if v.BootOrder == "" {
+			v.BootOrder = "n"
+		}
+	} else {
+		v.Args = append(v.Args, "-kernel", v.Kernel, "-append", v.cmdline())
+		if v.Initrd != "" {
+			v.Args = append(v.Args, "-initrd", v.Initrd)
+		}
+	}
+	if v.BootOrder != "" {
+		v.Args = append(v.Args, "-boot", "order="+v.BootOrder)
+	}
+	nic := "nic,macaddr=" + v.mac
+	if boot.NIC != "" {
+		nic += ",model=" + boot.NIC
+	}
 	v.Args = append(v.Args,
-		"-enable-kvm",
-		"-kernel", v.Kernel,
-		"-append", `"root=/dev/sda"`,
-		"-net", "nic,macaddr="+macaddr,
+		"-net", nic,
 		"-net", "tap,ifname="+v.tap.Name+",script=no,downscript=no",
 		"-virtfs", "fsdriver=local,path="+v.netFS+",security_model=passthrough,readonly,mount_tag=netfs",
 		"-nographic",
 	)
+	if v.macvtap != nil {
+		v.Args = append(v.Args, "-netdev", "tap,id=data,fd=3", "-device", "virtio-net-pci,netdev=data,mac="+v.dataMAC)
+	}
+	for tag, path := range v.SharedDirs {
+		v.Args = append(v.Args, "-virtfs", fmt.Sprintf("fsdriver=local,path=%s,security_model=passthrough,readonly,mount_tag=%s", path, tag))
+	}
+	cpu, err := v.cpuArg()
+	if err != nil {
+		return err
+	}
+	if cpu == "" {
+		cpu = boot.CPU
+	}
+	if cpu != "" {
+		v.Args = append(v.Args, "-cpu", cpu)
+	}
+	var usb bool
+	for _, dev := range v.Devices {
+		args, err := deviceArgs(dev)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(dev, "usb:") && !usb {
+			v.Args = append(v.Args, "-usb")
+			usb = true
+		}
+		v.Args = append(v.Args, args...)
+	}
 	if v.Memory != "" {
 		v.Args = append(v.Args, "-m", v.Memory)
 	}
-	var err error
-	for i, d := range v.Drives {
+	if v.Cores > 0 {
+		v.Args = append(v.Args, "-smp", strconv.Itoa(v.Cores))
+	}
+	memArgs, err := v.memoryArgs()
+	if err != nil {
+		return err
+	}
+	v.Args = append(v.Args, memArgs...)
+	if err := v.prepareDrives(); err != nil {
+		return err
+	}
+	for name, d := range v.Drives {
+		v.Args = append(v.Args, boot.driveArgs(name, d.FS)...)
+	}
+	return nil
+}
+
+func randomMAC() string {
+	b := make([]byte, 3)
+	io.ReadFull(rand.Reader, b)
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", b[0], b[1], b[2])
+}
+
+// prepareDrives locks the drive images and creates the copy-on-write layers
+// of COW drives, pointing the drives at them.
+func (v *vm) prepareDrives() error {
+	for _, d := range v.Drives {
+		lock, err := lockImage(d.FS, !d.COW)
+		if err != nil {
+			return err
+		}
+		v.locks = append(v.locks, lock)
+		if d.Temp && !d.COW {
+			v.tempFiles = append(v.tempFiles, d.FS)
+		}
 		if d.COW {
-			fs, err := v.createCOW(d.FS, d.Temp)
+			fs, err := v.createCOW(d.FS, d.Temp, d.DiskSize)
 			if err != nil {
-				v.cleanup()
 				return err
 			}
 			d.FS = fs
 		}
-		v.Args = append(v.Args, fmt.Sprintf("-%s", i), d.FS)
+		recordImage(v.runID, d.FS)
 	}
+	return nil
+}
 
-	v.cmd = exec.Command("sudo", append([]string{"-u", fmt.Sprintf("#%d", v.User), "-g", fmt.Sprintf("#%d", v.Group), "-H", "/usr/bin/qemu-system-x86_64"}, v.Args...)...)
-	v.cmd.Stdout = v.Out
-	v.cmd.Stderr = v.Out
-	if err = v.cmd.Start(); err != nil {
-		v.cleanup()
+func (v *vm) watchQMP(socket string) {
+	qmp, err := dialQMP(socket, func(event string) {
+		if event == "GUEST_PANICKED" {
+			v.handlePanic()
+		}
+	})
+	if err != nil {
+		fmt.Fprintf(v.Out, "could not connect to QMP socket of %s: %s\n", v.ID, err)
+		return
 	}
-	return err
+	v.panicMtx.Lock()
+	v.qmp = qmp
+	v.panicMtx.Unlock()
 }
 
-func (v *vm) createCOW(image string, temp bool) (string, error) {
+// handlePanic records the console backtrace of a guest kernel panic and
+// dumps the guest memory to CrashDumpDir.
+func (v *vm) handlePanic() {
+	v.panicMtx.Lock()
+	defer v.panicMtx.Unlock()
+	if v.panic != nil {
+		return
+	}
+	v.panic = &GuestPanic{Console: v.console.Tail()}
+	recordEvent(v.runID, "host", "guest kernel panic on instance "+v.ID)
+	if v.CrashDumpDir == "" || v.qmp == nil {
+		return
+	}
+	if err := os.MkdirAll(v.CrashDumpDir, 0755); err != nil {
+		fmt.Fprintf(v.Out, "could not create crash dump dir: %s\n", err)
+		return
+	}
+	os.Chown(v.CrashDumpDir, v.User, v.Group)
+	dump := filepath.Join(v.CrashDumpDir, v.ID+".core")
+	err := v.qmp.execute("dump-guest-memory", map[string]interface{}{
+		"paging":   false,
+		"protocol": "file:" + dump,
+	})
+	if err != nil {
+		fmt.Fprintf(v.Out, "could not dump guest memory of %s: %s\n", v.ID, err)
+		return
+	}
+	v.panic.Dump = dump
+}
+
+func (v *vm) Panic() *GuestPanic {
+	if v.console.Panicked() {
+		v.handlePanic()
+	}
+	v.panicMtx.Lock()
+	defer v.panicMtx.Unlock()
+	return v.panic
+}
+
+func (v *vm) createCOW(image string, temp bool, size int64) (string, error) {
+	if v.host != nil {
+		return v.createRemoteCOW(image, temp, size)
+	}
 	name := strings.TrimSuffix(filepath.Base(image), filepath.Ext(image))
-	dir, err := ioutil.TempDir("", name+"-")
+	// images which outlive the instance, such as the built dockerfs, are
+	// kept out of the run dir
+	parent := ""
+	if temp {
+		parent = v.dir
+	}
+	dir, err := ioutil.TempDir(parent, name+"-")
 	if err != nil {
 		return "", err
 	}
@@ -174,50 +810,176 @@ func (v *vm) createCOW(image string, temp bool) (string, error) {
 		return "", err
 	}
 	path := filepath.Join(dir, "fs.img")
-	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", "-b", image, path)
+	cmdArgs := []string{"create", "-f", "qcow2", "-b", image, path}
+	if size > 0 {
+		cmdArgs = append(cmdArgs, strconv.FormatInt(size, 10))
+	}
+	cmd := exec.Command("qemu-img", cmdArgs...)
 	if err = cmd.Run(); err != nil {
 		return "", fmt.Errorf("failed to create COW filesystem: %s", err.Error())
 	}
 	if err := os.Chown(path, v.User, v.Group); err != nil {
 		return "", err
 	}
+	// the ref is only advisory, so images in dirs which can't be written
+	// to, such as the base docker fs of a shared install, are still booted
+	if !temp {
+		refBacking(image, path)
+	}
 	return path, nil
 }
 
 func (v *vm) Wait() error {
 	defer v.cleanup()
-	return v.cmd.Wait()
+	<-v.exited
+	return v.exitErr
 }
 
 func (v *vm) Kill() error {
 	defer v.cleanup()
+	select {
+	case <-v.exited:
+		return nil
+	default:
+	}
+	recordEvent(v.runID, "host", "killing instance "+v.ID)
+	atomic.StoreInt32(&v.killing, 1)
+	if v.host != nil {
+		return v.killRemote()
+	}
 	if err := v.cmd.Process.Signal(syscall.SIGTERM); err != nil {
 		return err
 	}
-	done := make(chan error)
-	go func() {
-		done <- v.cmd.Wait()
-	}()
 	select {
-	case err := <-done:
-		return err
+	case <-v.exited:
+		return v.exitErr
 	case <-time.After(5 * time.Second):
 		return v.cmd.Process.Kill()
 	}
 }
 
+var shutdownTimeout = 30 * time.Second
+
+// Shutdown sends an ACPI power down so the guest unmounts its filesystems
+// before QEMU exits, rather than leaving the docker image half written.
+func (v *vm) Shutdown() error {
+	qmp := v.qmpClient()
+	if qmp == nil {
+		return v.Kill()
+	}
+	recordEvent(v.runID, "host", "powering down instance "+v.ID)
+	if err := qmp.execute("system_powerdown", nil); err != nil {
+		fmt.Fprintf(v.Out, "could not power down %s, killing it: %s\n", v.ID, err)
+		return v.Kill()
+	}
+	select {
+	case <-v.exited:
+		v.cleanup()
+		return v.exitErr
+	case <-time.After(shutdownTimeout):
+		fmt.Fprintf(v.Out, "%s did not power down within %s, killing it\n", v.ID, shutdownTimeout)
+		return v.Kill()
+	}
+}
+
+func (v *vm) Pause() error {
+	return v.monitor(func(qmp *qmpClient) error { return qmp.execute("stop", nil) })
+}
+
+func (v *vm) Resume() error {
+	return v.monitor(func(qmp *qmpClient) error { return qmp.execute("cont", nil) })
+}
+
+func (v *vm) Reset() error {
+	recordEvent(v.runID, "host", "resetting instance "+v.ID)
+	return v.monitor(func(qmp *qmpClient) error { return qmp.execute("system_reset", nil) })
+}
+
+// Snapshot saves an internal snapshot in the instance's qcow2 drives, so it
+// fails for instances with raw drives.
+func (v *vm) Snapshot(name string) error {
+	return v.monitor(func(qmp *qmpClient) error { return qmp.humanCommand("savevm " + name) })
+}
+
+func (v *vm) RestoreSnapshot(name string) error {
+	return v.monitor(func(qmp *qmpClient) error { return qmp.humanCommand("loadvm " + name) })
+}
+
+func (v *vm) qmpClient() *qmpClient {
+	v.panicMtx.Lock()
+	defer v.panicMtx.Unlock()
+	return v.qmp
+}
+
+func (v *vm) monitor(f func(*qmpClient) error) error {
+	qmp := v.qmpClient()
+	if qmp == nil {
+		return fmt.Errorf("cluster: QMP is not connected for %s", v.ID)
+	}
+	return f(qmp)
+}
+
 func (v *vm) DialSSH() (*ssh.Client, error) {
-	return ssh.Dial("tcp", v.IP()+":22", &ssh.ClientConfig{
-		User: "ubuntu",
-		Auth: []ssh.AuthMethod{ssh.Password("ubuntu")},
-	})
+	if v.host != nil {
+		return v.host.dialGuest(v.IP()+":22", v.keys.clientConfig())
+	}
+	return ssh.Dial("tcp", v.IP()+":22", v.keys.clientConfig())
 }
 
 func (v *vm) IP() string {
 	return v.tap.RemoteIP.String()
 }
 
-func (v *vm) Run(command string, attempts attempt.Strategy, out io.Writer, stderr io.Writer) error {
+func (v *vm) Console() io.ReadCloser {
+	return v.console.Reader()
+}
+
+func (v *vm) ConsoleTail(n int) []string {
+	return v.console.TailLines(n)
+}
+
+// waitBoot waits for the console to show that the guest has booted, failing
+// if the guest exits or panics first. Guests which don't show it, such as
+// those of custom root filesystems, are given timeout before being dialed
+// anyway.
+func (v *vm) waitBoot(timeout time.Duration) error {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case <-v.console.ready:
+			return nil
+		case <-v.exited:
+			return fmt.Errorf("%s exited before booting", v.ID)
+		case <-tick.C:
+			if v.Panic() != nil {
+				return fmt.Errorf("%s panicked while booting", v.ID)
+			}
+		case <-deadline:
+			if v.bootTimeout > 0 {
+				return v.timeoutError("boot", timeout)
+			}
+			recordEvent(v.runID, "host", "boot of "+v.ID+" not seen on console, trying ssh")
+			return nil
+		}
+	}
+}
+
+func (v *vm) Run(command string, attempts util.Strategy, out io.Writer, stderr io.Writer) error {
+	bootTimeout := attempts.Total
+	if v.bootTimeout > 0 {
+		bootTimeout = v.bootTimeout
+	}
+	if err := v.waitBoot(bootTimeout); err != nil {
+		if te, ok := err.(*TimeoutError); ok {
+			te.write(stderr)
+		}
+		return err
+	}
+	if v.sshTimeout > 0 {
+		attempts.Total = v.sshTimeout
+	}
 	var sc *ssh.Client
 	err := attempts.Run(func() (err error) {
 		fmt.Fprintf(stderr, "Attempting to ssh to %s:22...\n", v.IP())
@@ -225,10 +987,27 @@ func (v *vm) Run(command string, attempts attempt.Strategy, out io.Writer, stder
 		return
 	})
 	if err != nil {
+		if v.sshTimeout > 0 {
+			te := v.timeoutError("ssh", v.sshTimeout)
+			te.write(stderr)
+			return te
+		}
 		return err
 	}
 	defer sc.Close()
 	sess, err := sc.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	if v.AgentSocket != "" {
+		if err := agent.ForwardToRemote(sc, v.AgentSocket); err != nil {
+			return fmt.Errorf("failed to forward ssh-agent to %s: %s", v.IP(), err)
+		}
+		if err := agent.RequestAgentForwarding(sess); err != nil {
+			return fmt.Errorf("failed to forward ssh-agent to %s: %s", v.IP(), err)
+		}
+	}
 	sess.Stdin = bytes.NewBufferString(command)
 	sess.Stdout = out
 	sess.Stderr = stderr
@@ -238,6 +1017,10 @@ func (v *vm) Run(command string, attempts attempt.Strategy, out io.Writer, stder
 	return nil
 }
 
+func (v *vm) OOMKills() []string {
+	return v.console.OOMKills()
+}
+
 func (v *vm) Drive(name string) *VMDrive {
 	return v.Drives[name]
 }
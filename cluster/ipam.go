@@ -0,0 +1,153 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/dotcloud/docker/daemon/networkdriver/ipallocator"
+)
+
+// IPAM reserves named IPs of a cluster's subnet, such as a router VIP, from
+// the allocator which hands out tap addresses, so instances never collide
+// with them. Reservations are saved to the run dir, resolved by the cluster's
+// DNS and written to the metadata dir of the netfs of every instance as
+// ips.json and an ips.env shell file.
+type IPAM struct {
+	bridge *Bridge
+	net    *NetServer
+	path   string
+
+	mtx      sync.Mutex
+	reserved map[string]net.IP
+	netfs    []string
+}
+
+func newIPAM(bridge *Bridge, ns *NetServer, runDir string) *IPAM {
+	return &IPAM{
+		bridge:   bridge,
+		net:      ns,
+		path:     filepath.Join(runDir, "ips-"+bridge.name+".json"),
+		reserved: make(map[string]net.IP),
+	}
+}
+
+// Reserve reserves ip under name, or any free IP if ip is nil, returning
+// the reserved IP. It fails if name is already reserved or ip is outside the
+// subnet or allocated.
+func (m *IPAM) Reserve(name string, ip net.IP) (net.IP, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.reserved[name]; ok {
+		return nil, fmt.Errorf("cluster: an IP is already reserved for %s", name)
+	}
+	var req *net.IP
+	if ip != nil {
+		if !m.bridge.ipNet.Contains(ip) || ip.Equal(m.bridge.ipAddr) {
+			return nil, fmt.Errorf("cluster: cannot reserve %s for %s, it is not a free address of %s", ip, name, m.bridge.ipNet)
+		}
+		req = &ip
+	}
+	res, err := ipallocator.RequestIP(m.bridge.ipNet, req)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: cannot reserve IP for %s: %s", name, err)
+	}
+	m.reserved[name] = *res
+	if m.net != nil {
+		m.net.AddName(name, *res)
+	}
+	m.save()
+	return *res, nil
+}
+
+// Reserved returns the reserved IPs keyed by name.
+func (m *IPAM) Reserved() map[string]string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.ips()
+}
+
+func (m *IPAM) ips() map[string]string {
+	ips := make(map[string]string, len(m.reserved))
+	for name, ip := range m.reserved {
+		ips[name] = ip.String()
+	}
+	return ips
+}
+
+// addNetFS writes the reservations to the netfs of an instance, now and
+// whenever they change.
+func (m *IPAM) addNetFS(dir string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if err := os.Mkdir(filepath.Join(dir, "metadata"), 0755); err != nil {
+		return err
+	}
+	m.netfs = append(m.netfs, dir)
+	return m.writeMetadata(dir)
+}
+
+func (m *IPAM) writeMetadata(dir string) error {
+	ips := m.ips()
+	var names []string
+	for name := range ips {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data, _ := json.Marshal(ips)
+	if err := ioutil.WriteFile(filepath.Join(dir, "metadata", "ips.json"), data, 0644); err != nil {
+		return err
+	}
+	var env []byte
+	for _, name := range names {
+		env = append(env, fmt.Sprintf("FLYNN_IP_%s=%s\n", envName(name), ips[name])...)
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "metadata", "ips.env"), env, 0644)
+}
+
+// save persists the reservations to the run dir and updates the netfs of
+// instances, forgetting those which have been removed.
+func (m *IPAM) save() {
+	data, _ := json.MarshalIndent(m.ips(), "", "  ")
+	if err := ioutil.WriteFile(m.path, data, 0644); err != nil {
+		fmt.Printf("could not save reserved IPs: %s\n", err)
+	}
+	dirs := m.netfs[:0]
+	for _, dir := range m.netfs {
+		if err := m.writeMetadata(dir); err == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	m.netfs = dirs
+}
+
+// release returns the reserved IPs to the allocator.
+func (m *IPAM) release() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for name, ip := range m.reserved {
+		ip := ip
+		ipallocator.ReleaseIP(m.bridge.ipNet, &ip)
+		delete(m.reserved, name)
+	}
+	m.netfs = nil
+}
+
+func envName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
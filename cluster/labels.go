@@ -0,0 +1,77 @@
+package cluster
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Labels tag the resources a run creates outside of the runner's own state
+// with the run they belong to, such as its ID and commit, so that tools
+// auditing costs or cleaning up orphans can attribute them without asking
+// the runner. They are set as BootConfig.Labels and written to labels.json
+// in the run dir, the alias of the cluster bridge, the SMBIOS OEM strings of
+// QEMU instances, which are on their command line, the metadata of libvirt
+// domains and labels.json beside the tags of repos pushed to the run's
+// registry.
+type Labels map[string]string
+
+// LabelNamespace prefixes labels where they share a namespace with other
+// tools, such as SMBIOS strings.
+const LabelNamespace = "flynn-test"
+
+func (l Labels) keys() []string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// String returns the labels as sorted key=value pairs separated by spaces.
+func (l Labels) String() string {
+	pairs := make([]string, 0, len(l))
+	for _, k := range l.keys() {
+		pairs = append(pairs, k+"="+l[k])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// writeFile writes the labels as labels.json in dir.
+func (l Labels) writeFile(dir string) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "labels.json"), data, 0644)
+}
+
+// smbiosArgs returns the QEMU args setting the labels as SMBIOS OEM strings,
+// which are visible in the process list of the host and to the guest.
+func (l Labels) smbiosArgs() []string {
+	if len(l) == 0 {
+		return nil
+	}
+	arg := "type=11"
+	for _, k := range l.keys() {
+		// commas are escaped by doubling them in QEMU options
+		arg += ",value=" + strings.Replace(LabelNamespace+"."+k+"="+l[k], ",", ",,", -1)
+	}
+	return []string{"-smbios", arg}
+}
+
+// setAlias sets the labels as the alias of the network interface name.
+func (l Labels) setAlias(name string) error {
+	if len(l) == 0 {
+		return nil
+	}
+	alias := LabelNamespace + " " + l.String()
+	// IFALIASZ
+	if len(alias) > 255 {
+		alias = alias[:255]
+	}
+	return ioutil.WriteFile(filepath.Join("/sys/class/net", name, "ifalias"), []byte(alias), 0644)
+}
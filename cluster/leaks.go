@@ -0,0 +1,296 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/flynn/go-iptables"
+)
+
+// hostResources are the host resources created for a run, which should all
+// be gone once its clusters are shut down.
+type hostResources struct {
+	bridges []string
+	taps    []string
+	images  []string
+	removed []*TeardownResource
+}
+
+var (
+	resourcesMtx sync.Mutex
+	resources    = make(map[string]*hostResources)
+	runDirs      = make(map[string]string)
+)
+
+// RunDir returns the directory holding the temp files of the run runID,
+// <workdir>/runs/<runID>, creating it if necessary. The system temp dir is
+// used if workdir is empty.
+func RunDir(workdir, runID string) (string, error) {
+	if workdir == "" {
+		workdir = os.TempDir()
+	}
+	dir := filepath.Join(workdir, "runs", runID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	resourcesMtx.Lock()
+	runDirs[runID] = dir
+	resourcesMtx.Unlock()
+	return dir, nil
+}
+
+// CleanupRun removes the run dir of runID, once all of its clusters have
+// been shut down.
+func CleanupRun(runID string) error {
+	resourcesMtx.Lock()
+	dir, ok := runDirs[runID]
+	delete(runDirs, runID)
+	resourcesMtx.Unlock()
+	timelineMtx.Lock()
+	delete(timelines, runID)
+	timelineMtx.Unlock()
+	if !ok {
+		return nil
+	}
+	return os.RemoveAll(dir)
+}
+
+func runResources(runID string) *hostResources {
+	r, ok := resources[runID]
+	if !ok {
+		r = &hostResources{}
+		resources[runID] = r
+	}
+	return r
+}
+
+func recordBridge(runID, name string) {
+	resourcesMtx.Lock()
+	defer resourcesMtx.Unlock()
+	r := runResources(runID)
+	r.bridges = append(r.bridges, name)
+}
+
+func recordTap(runID, name string) {
+	resourcesMtx.Lock()
+	defer resourcesMtx.Unlock()
+	r := runResources(runID)
+	for _, tap := range r.taps {
+		if tap == name {
+			// the tap was reused
+			return
+		}
+	}
+	r.taps = append(r.taps, name)
+}
+
+func recordImage(runID, path string) {
+	resourcesMtx.Lock()
+	defer resourcesMtx.Unlock()
+	r := runResources(runID)
+	r.images = append(r.images, path)
+}
+
+// recordRemoval records the removal of a temp file of a run, which failed
+// if err isn't nil.
+func recordRemoval(runID, path string, bytes int64, err error) {
+	res := &TeardownResource{Kind: "temp file", Name: path, Status: "removed", Bytes: bytes}
+	if err != nil {
+		res.Status = "leaked"
+		res.Error = err.Error()
+	}
+	resourcesMtx.Lock()
+	defer resourcesMtx.Unlock()
+	r := runResources(runID)
+	r.removed = append(r.removed, res)
+}
+
+// removeTemp removes the temp file or dir at path of the run runID,
+// recording it and the disk space it took up for the run's teardown report.
+func removeTemp(runID, path string) error {
+	bytes := diskUsage(path)
+	err := os.RemoveAll(path)
+	recordRemoval(runID, path, bytes, err)
+	return err
+}
+
+// diskUsage returns the disk space used by the files under path, which is
+// less than their size for sparse images.
+func diskUsage(path string) int64 {
+	var n int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			n += st.Blocks * 512
+		} else {
+			n += info.Size()
+		}
+		return nil
+	})
+	return n
+}
+
+// TeardownReport lists the host resources of a run and what became of each
+// once its clusters were shut down, to make cleanup auditable.
+type TeardownReport struct {
+	RunID      string              `json:"run_id"`
+	Resources  []*TeardownResource `json:"resources"`
+	BytesFreed int64               `json:"bytes_freed"`
+}
+
+// TeardownResource is a host resource of a run. Status is "released",
+// "reaped", "removed" or "deleted" if it is gone, "kept" if it was kept on
+// purpose, or "leaked".
+type TeardownResource struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Bytes  int64  `json:"bytes,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Add adds a resource to the report, such as a snapshot the caller kept or
+// deleted.
+func (t *TeardownReport) Add(kind, name, status string, bytes int64) {
+	t.Resources = append(t.Resources, &TeardownResource{Kind: kind, Name: name, Status: status, Bytes: bytes})
+	if status == "removed" || status == "deleted" {
+		t.BytesFreed += bytes
+	}
+}
+
+// Leaks returns a *LeakError listing the leaked resources, or nil if there
+// are none.
+func (t *TeardownReport) Leaks() error {
+	var leaks []string
+	for _, res := range t.Resources {
+		if res.Status == "leaked" {
+			leaks = append(leaks, res.Kind+" "+res.Name)
+		}
+	}
+	if len(leaks) == 0 {
+		return nil
+	}
+	return &LeakError{RunID: t.RunID, Leaks: leaks}
+}
+
+// Write writes a summary of the report to w.
+func (t *TeardownReport) Write(w io.Writer) {
+	counts := make(map[string]int)
+	for _, res := range t.Resources {
+		counts[res.Status]++
+		if res.Status == "leaked" || res.Status == "kept" {
+			fmt.Fprintf(w, "teardown: %s %s %s\n", res.Status, res.Kind, res.Name)
+		}
+	}
+	fmt.Fprintf(w, "teardown: %d resources, %d released, %d leaked, %d kept, %d bytes freed\n",
+		len(t.Resources), len(t.Resources)-counts["leaked"]-counts["kept"], counts["leaked"], counts["kept"], t.BytesFreed)
+}
+
+// LeakError lists the host resources of a run left behind after teardown.
+type LeakError struct {
+	RunID string
+	Leaks []string
+}
+
+func (e *LeakError) Error() string {
+	return fmt.Sprintf("run %s leaked host resources: %s", e.RunID, strings.Join(e.Leaks, ", "))
+}
+
+// VerifyTeardown checks that no taps, bridges, iptables rules, qemu processes
+// or loop devices created by clusters booted with runID remain, returning a
+// *LeakError if any do. It should be called once all of the run's clusters
+// have been shut down, and forgets the run's resources.
+func VerifyTeardown(runID string) error {
+	return Teardown(runID).Leaks()
+}
+
+// Teardown reports what became of the host resources created for runID,
+// including the temp files removed when its instances were killed. Like
+// VerifyTeardown, it should be called once all of the run's clusters have
+// been shut down, and forgets the run's resources.
+func Teardown(runID string) *TeardownReport {
+	resourcesMtx.Lock()
+	r, ok := resources[runID]
+	delete(resources, runID)
+	resourcesMtx.Unlock()
+	t := &TeardownReport{RunID: runID}
+	if !ok {
+		return t
+	}
+
+	gone := func(kind, name, status string, exists bool) {
+		if exists {
+			status = "leaked"
+		}
+		t.Add(kind, name, status, 0)
+	}
+	for _, name := range r.bridges {
+		_, err := net.InterfaceByName(name)
+		gone("bridge", name, "released", err == nil)
+		gone("iptables rule", strings.Join(forwardRule(name), " "), "deleted", iptables.Exists(forwardRule(name)...))
+		for _, chain := range []string{egressChain(name), ingressChain(name)} {
+			gone("iptables chain", chain, "deleted", chainExists(chain))
+		}
+	}
+	for _, name := range r.taps {
+		_, err := net.InterfaceByName(name)
+		gone("tap", name, "released", err == nil)
+		pids := qemuProcesses(name)
+		if len(pids) == 0 {
+			t.Add("qemu process", "of tap "+name, "reaped", 0)
+		}
+		for _, pid := range pids {
+			t.Add("qemu process", pid, "leaked", 0)
+		}
+	}
+	if len(r.images) > 0 {
+		out, _ := exec.Command("losetup", "-a").Output()
+		for _, line := range strings.Split(string(out), "\n") {
+			for _, path := range r.images {
+				if strings.Contains(line, "("+path+")") {
+					t.Add("loop device", strings.SplitN(line, ":", 2)[0], "leaked", 0)
+				}
+			}
+		}
+	}
+	for _, res := range r.removed {
+		t.Resources = append(t.Resources, res)
+		if res.Status == "removed" {
+			t.BytesFreed += res.Bytes
+		}
+	}
+	return t
+}
+
+// qemuProcesses returns the pids of qemu processes attached to tap.
+func qemuProcesses(tap string) []string {
+	cmdlines, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	var pids []string
+	for _, path := range cmdlines {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		args := strings.Split(string(data), "\x00")
+		if !strings.Contains(filepath.Base(args[0]), "qemu") {
+			continue
+		}
+		for _, arg := range args {
+			if strings.Contains(arg, "ifname="+tap+",") {
+				pids = append(pids, filepath.Base(filepath.Dir(path)))
+				break
+			}
+		}
+	}
+	return pids
+}
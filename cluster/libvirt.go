@@ -0,0 +1,380 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// LibvirtBackend starts instances as transient libvirt domains using virsh,
+// for hosts where QEMU is managed by libvirtd rather than run directly. The
+// domains are attached to the cluster's taps and share their netfs like
+// instances of the VMManager, and libvirt creates their macvtap devices.
+type LibvirtBackend struct {
+	*VMManager
+
+	// URI is the libvirt connection URI, defaulting to qemu:///system.
+	URI string
+}
+
+func (b *LibvirtBackend) NewInstance(c *VMConfig) (Instance, error) {
+	if c.Netboot || len(c.Devices) > 0 || c.HugePages || c.CPUSet != "" {
+		return nil, errors.New("cluster: netboot, devices, huge pages and cpusets are not supported by the libvirt backend")
+	}
+	if c.Boot != nil && c.Boot != DefaultBootProfiles[DefaultBootProfile] {
+		return nil, errors.New("cluster: the libvirt backend only boots the default boot profile")
+	}
+	v, err := b.newVM(c)
+	if err != nil {
+		return nil, err
+	}
+	uri := b.URI
+	if uri == "" {
+		uri = "qemu:///system"
+	}
+	return &libvirtVM{vm: v, uri: uri, domain: fmt.Sprintf("flynn-%s-%s", b.RunID, v.ID), macvtapNIC: b.Macvtap}, nil
+}
+
+// libvirtVM reuses the tap, netfs, ssh and cleanup of vm, replacing how the
+// guest is started and controlled.
+type libvirtVM struct {
+	*vm
+	uri    string
+	domain string
+
+	// macvtapNIC is the host NIC libvirt attaches the data interface to.
+	macvtapNIC string
+}
+
+type libvirtDisk struct {
+	Dev, Path, Format string
+}
+
+type libvirtDomain struct {
+	Name       string
+	Memory     int
+	Cores      int
+	Kernel     string
+	Initrd     string
+	Cmdline    string
+	BootOrder  []string
+	CPU        string
+	NestedVirt bool
+	Disks      []libvirtDisk
+	MAC        string
+	Tap        string
+	DataNIC    string
+	DataMAC    string
+	SharedDirs map[string]string
+	Console    string
+	Args       []string
+	Labels     Labels
+}
+
+var domainTemplate = template.Must(template.New("domain").Funcs(template.FuncMap{"esc": xmlEscape}).Parse(`
+<domain type='kvm' xmlns:qemu='http://libvirt.org/schemas/domain/qemu/1.0'>
+  <name>{{.Name}}</name>
+  {{if .Labels}}<metadata>
+    <flynn-test:labels xmlns:flynn-test='https://flynn.io/flynn-test/labels'>
+      {{range $k, $v := .Labels}}<flynn-test:label name='{{esc $k}}' value='{{esc $v}}'/>
+      {{end}}
+    </flynn-test:labels>
+  </metadata>{{end}}
+  <memory unit='MiB'>{{.Memory}}</memory>
+  <vcpu>{{.Cores}}</vcpu>
+  <os>
+    <type arch='x86_64'>hvm</type>
+    <kernel>{{esc .Kernel}}</kernel>
+    {{if .Initrd}}<initrd>{{esc .Initrd}}</initrd>{{end}}
+    <cmdline>root=/dev/sda console=ttyS0{{if .Cmdline}} {{esc .Cmdline}}{{end}}</cmdline>
+    {{range .BootOrder}}<boot dev='{{.}}'/>
+    {{end}}
+  </os>
+  {{if .NestedVirt}}<cpu mode='host-passthrough'/>{{else if .CPU}}<cpu mode='custom'><model>{{esc .CPU}}</model></cpu>{{end}}
+  <on_poweroff>destroy</on_poweroff>
+  <on_reboot>restart</on_reboot>
+  <on_crash>preserve</on_crash>
+  <devices>
+    {{range .Disks}}<disk type='file' device='disk'>
+      <driver name='qemu' type='{{.Format}}'/>
+      <source file='{{esc .Path}}'/>
+      <target dev='{{.Dev}}' bus='ide'/>
+    </disk>
+    {{end}}
+    <interface type='ethernet'>
+      <mac address='{{.MAC}}'/>
+      <target dev='{{.Tap}}' managed='no'/>
+      <model type='e1000'/>
+    </interface>
+    {{if .DataNIC}}<interface type='direct'>
+      <mac address='{{.DataMAC}}'/>
+      <source dev='{{esc .DataNIC}}' mode='bridge'/>
+      <model type='virtio'/>
+    </interface>{{end}}
+    {{range $tag, $path := .SharedDirs}}<filesystem type='mount' accessmode='passthrough'>
+      <source dir='{{esc $path}}'/>
+      <target dir='{{esc $tag}}'/>
+      <readonly/>
+    </filesystem>
+    {{end}}
+    <serial type='unix'>
+      <source mode='bind' path='{{esc .Console}}'/>
+      <target port='0'/>
+    </serial>
+    <panic model='isa'/>
+  </devices>
+  {{if .Args}}<qemu:commandline>
+    {{range .Args}}<qemu:arg value='{{esc .}}'/>
+    {{end}}
+  </qemu:commandline>{{end}}
+</domain>
+`))
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// bootDevs maps QEMU boot order letters to libvirt boot devices.
+var bootDevs = map[rune]string{'a': "fd", 'c': "hd", 'd': "cdrom", 'n': "network"}
+
+func (v *libvirtVM) domainConfig(console string) (*libvirtDomain, error) {
+	d := &libvirtDomain{
+		Name:       v.domain,
+		Memory:     128,
+		Cores:      1,
+		Kernel:     v.Kernel,
+		Initrd:     v.Initrd,
+		CPU:        v.CPU,
+		NestedVirt: v.NestedVirt,
+		MAC:        v.mac,
+		Tap:        v.tap.Name,
+		DataMAC:    v.dataMAC,
+		SharedDirs: map[string]string{"netfs": v.netFS},
+		Console:    console,
+		Args:       v.Args,
+		Labels:     v.labels,
+	}
+	if v.Memory != "" {
+		var err error
+		if d.Memory, err = strconv.Atoi(v.Memory); err != nil {
+			return nil, fmt.Errorf("the libvirt backend requires memory to be set in MB, got %q", v.Memory)
+		}
+	}
+	if v.dataMAC != "" {
+		d.DataNIC = v.macvtapNIC
+	}
+	if v.discovery != nil && v.inject["cmdline"] {
+		d.Cmdline = v.discovery.cmdline()
+	}
+	if v.Cores > 0 {
+		d.Cores = v.Cores
+	}
+	if v.NestedVirt {
+		if _, err := nestedVirtFlag(); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range v.BootOrder {
+		dev, ok := bootDevs[c]
+		if !ok {
+			return nil, fmt.Errorf("invalid boot order %q", v.BootOrder)
+		}
+		d.BootOrder = append(d.BootOrder, dev)
+	}
+	for tag, path := range v.SharedDirs {
+		d.SharedDirs[tag] = path
+	}
+	for dev, drive := range v.Drives {
+		format := "raw"
+		if drive.COW || strings.HasSuffix(drive.FS, ".qcow2") {
+			format = "qcow2"
+		}
+		d.Disks = append(d.Disks, libvirtDisk{Dev: dev, Path: drive.FS, Format: format})
+	}
+	return d, nil
+}
+
+func (v *libvirtVM) virsh(args ...string) (string, error) {
+	out, err := exec.Command("virsh", append([]string{"-c", v.uri}, args...)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("virsh %s %s: %s: %s", args[0], v.domain, err, bytes.TrimSpace(out))
+	}
+	return string(out), nil
+}
+
+func (v *libvirtVM) Start() error {
+	v.mac = randomMAC()
+	if err := v.writeInterfaceConfig(); err != nil {
+		v.cleanup()
+		return err
+	}
+	if err := v.prepareDrives(); err != nil {
+		v.cleanup()
+		return err
+	}
+	consoleDir, err := ioutil.TempDir(v.dir, "console-")
+	if err != nil {
+		v.cleanup()
+		return err
+	}
+	v.tempFiles = append(v.tempFiles, consoleDir)
+	// libvirt runs QEMU as its own user, which creates the console socket
+	if err := os.Chmod(consoleDir, 0777); err != nil {
+		v.cleanup()
+		return err
+	}
+	console := filepath.Join(consoleDir, "console.sock")
+	conf, err := v.domainConfig(console)
+	if err != nil {
+		v.cleanup()
+		return err
+	}
+	var b bytes.Buffer
+	if err := domainTemplate.Execute(&b, conf); err != nil {
+		v.cleanup()
+		return err
+	}
+	path := filepath.Join(v.dir, "domain.xml")
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		v.cleanup()
+		return err
+	}
+	if _, err := v.virsh("create", path); err != nil {
+		v.cleanup()
+		return err
+	}
+	v.started = time.Now()
+	recordEvent(v.runID, "host", "started instance "+v.ID)
+	v.exited = make(chan struct{})
+	go v.copyConsole(console)
+	go v.watchDomain()
+	return nil
+}
+
+// copyConsole copies the guest's serial console from the socket libvirt
+// binds for it.
+func (v *libvirtVM) copyConsole(socket string) {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		fmt.Fprintf(v.Out, "could not connect to console of %s: %s\n", v.ID, err)
+		return
+	}
+	defer conn.Close()
+	go func() {
+		<-v.exited
+		conn.Close()
+	}()
+	io.Copy(v.console, conn)
+}
+
+// watchDomain closes exited once the domain stops running. Transient domains
+// are removed by libvirt when they stop.
+func (v *libvirtVM) watchDomain() {
+	for {
+		time.Sleep(time.Second)
+		state, err := v.virsh("domstate", v.domain)
+		if err != nil || strings.TrimSpace(state) == "shut off" {
+			break
+		}
+		if strings.TrimSpace(state) == "crashed" {
+			v.handlePanic()
+		}
+	}
+	v.console.close()
+	close(v.exited)
+}
+
+func (v *libvirtVM) Wait() error {
+	defer v.cleanup()
+	<-v.exited
+	return v.exitErr
+}
+
+func (v *libvirtVM) Kill() error {
+	defer v.cleanup()
+	select {
+	case <-v.exited:
+		return nil
+	default:
+	}
+	recordEvent(v.runID, "host", "killing instance "+v.ID)
+	if _, err := v.virsh("destroy", v.domain); err != nil {
+		return err
+	}
+	<-v.exited
+	return nil
+}
+
+func (v *libvirtVM) Shutdown() error {
+	recordEvent(v.runID, "host", "powering down instance "+v.ID)
+	if _, err := v.virsh("shutdown", v.domain); err != nil {
+		fmt.Fprintf(v.Out, "could not power down %s, killing it: %s\n", v.ID, err)
+		return v.Kill()
+	}
+	select {
+	case <-v.exited:
+		v.cleanup()
+		return nil
+	case <-time.After(shutdownTimeout):
+		fmt.Fprintf(v.Out, "%s did not power down within %s, killing it\n", v.ID, shutdownTimeout)
+		return v.Kill()
+	}
+}
+
+func (v *libvirtVM) Pause() error {
+	_, err := v.virsh("suspend", v.domain)
+	return err
+}
+
+func (v *libvirtVM) Resume() error {
+	_, err := v.virsh("resume", v.domain)
+	return err
+}
+
+func (v *libvirtVM) Reset() error {
+	_, err := v.virsh("reset", v.domain)
+	return err
+}
+
+// Snapshot uses the QEMU monitor rather than libvirt snapshots, which
+// transient domains don't support.
+func (v *libvirtVM) Snapshot(name string) error {
+	_, err := v.virsh("qemu-monitor-command", v.domain, "--hmp", "savevm "+name)
+	return err
+}
+
+func (v *libvirtVM) RestoreSnapshot(name string) error {
+	_, err := v.virsh("qemu-monitor-command", v.domain, "--hmp", "loadvm "+name)
+	return err
+}
+
+// asVM returns the vm underlying an instance of any backend.
+func asVM(inst Instance) (*vm, bool) {
+	switch v := inst.(type) {
+	case *vm:
+		return v, true
+	case *libvirtVM:
+		return v.vm, true
+	}
+	return nil, false
+}
@@ -0,0 +1,70 @@
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Lock pins the external inputs of a run, mapping names such as "go",
+// "apt:curl" and "docker:flynn/slugbuilder:latest" to the Go version, package
+// version or image ID installed in the cluster's instances.
+type Lock map[string]string
+
+const lockScript = `
+command -v go >/dev/null && echo "go=$(go version | awk '{print $3}')"
+dpkg-query -W -f='apt:${Package}=${Version}\n'
+sudo docker images --no-trunc | awk 'NR > 1 && $1 != "<none>" { print "docker:" $1 ":" $2 "=" $3 }'
+`
+
+// Lock lists the external inputs installed in the first instance of the
+// cluster, which has the same root and docker filesystems as the others.
+func (c *Cluster) Lock() (Lock, error) {
+	if len(c.instances) == 0 {
+		return nil, errors.New("cluster: no instances to lock the inputs of")
+	}
+	var out, stderr bytes.Buffer
+	if err := c.instances[0].Run(lockScript, attempts, &out, &stderr); err != nil {
+		return nil, fmt.Errorf("could not list inputs: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	lock := make(Lock)
+	for _, line := range strings.Split(out.String(), "\n") {
+		if i := strings.Index(line, "="); i > 0 {
+			lock[line[:i]] = line[i+1:]
+		}
+	}
+	return lock, nil
+}
+
+// LockChange is an input which differs between two locks. Old is empty if
+// the input was added and New is empty if it was removed.
+type LockChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// Diff returns the changes from prev to l, sorted by name.
+func (l Lock) Diff(prev Lock) []*LockChange {
+	var changes []*LockChange
+	for name, version := range l {
+		if old := prev[name]; old != version {
+			changes = append(changes, &LockChange{Name: name, Old: old, New: version})
+		}
+	}
+	for name, old := range prev {
+		if _, ok := l[name]; !ok {
+			changes = append(changes, &LockChange{Name: name, Old: old})
+		}
+	}
+	sort.Sort(lockChanges(changes))
+	return changes
+}
+
+type lockChanges []*LockChange
+
+func (c lockChanges) Len() int           { return len(c) }
+func (c lockChanges) Less(i, j int) bool { return c[i].Name < c[j].Name }
+func (c lockChanges) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
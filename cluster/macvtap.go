@@ -0,0 +1,73 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/docker/libcontainer/netlink"
+	"github.com/flynn/flynn-test/util"
+)
+
+// Macvtap is a macvtap device in bridge mode on a host NIC, giving an
+// instance a second interface on the NIC's network which bypasses the
+// cluster bridge and NAT. Guests on the same NIC reach each other through
+// it, but the host itself can't, so instances keep their tap on the bridge
+// for ssh and the netfs.
+type Macvtap struct {
+	Name string
+	MAC  string
+
+	// Dev is the character device QEMU reads and writes frames through.
+	Dev string
+}
+
+// NewMacvtap creates a macvtap device with address mac on the host NIC
+// parent, with its character device owned by uid and gid.
+func (t *TapManager) NewMacvtap(parent, mac string, uid, gid int) (*Macvtap, error) {
+	t.randMtx.Lock()
+	name := "flynnmvt." + util.SeededString(t.rand, 5)
+	t.randMtx.Unlock()
+
+	out, err := exec.Command("ip", "link", "add", "link", parent, "name", name, "address", mac, "type", "macvtap", "mode", "bridge").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("could not create macvtap device on %s: %s: %s", parent, err, bytes.TrimSpace(out))
+	}
+	m := &Macvtap{Name: name, MAC: mac}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	if err := netlink.NetworkLinkUp(iface); err != nil {
+		m.Close()
+		return nil, err
+	}
+	m.Dev = fmt.Sprintf("/dev/tap%d", iface.Index)
+	// the device node is created by udev
+	for i := 0; i < 50; i++ {
+		if _, err = os.Stat(m.Dev); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	if err := os.Chown(m.Dev, uid, gid); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Macvtap) Close() error {
+	if out, err := exec.Command("ip", "link", "delete", m.Name).CombinedOutput(); err != nil {
+		return fmt.Errorf("could not delete macvtap device %s: %s: %s", m.Name, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"net/http"
+	"sync"
+)
+
+// CacheStats counts the lookups of a cache, and the bytes it served where
+// they are known.
+type CacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	Bytes  int64 `json:"bytes"`
+}
+
+var (
+	cacheStatsMtx sync.Mutex
+	cacheStats    = make(map[string]*CacheStats)
+)
+
+func cacheStat(cache string) *CacheStats {
+	s, ok := cacheStats[cache]
+	if !ok {
+		s = &CacheStats{}
+		cacheStats[cache] = s
+	}
+	return s
+}
+
+func cacheHit(cache string, bytes int64) {
+	cacheStatsMtx.Lock()
+	defer cacheStatsMtx.Unlock()
+	s := cacheStat(cache)
+	s.Hits++
+	s.Bytes += bytes
+}
+
+func cacheMiss(cache string) {
+	cacheStatsMtx.Lock()
+	defer cacheStatsMtx.Unlock()
+	cacheStat(cache).Misses++
+}
+
+// CacheMetrics returns the stats of the "git" mirrors, run "registry" and
+// "build" cache since the process started.
+func CacheMetrics() map[string]CacheStats {
+	cacheStatsMtx.Lock()
+	defer cacheStatsMtx.Unlock()
+	stats := make(map[string]CacheStats, len(cacheStats))
+	for name, s := range cacheStats {
+		stats[name] = *s
+	}
+	return stats
+}
+
+// countingWriter counts the bytes of a response.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,43 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// mirrorMtx serializes updates of the git mirrors, which are shared between
+// concurrent builds.
+var mirrorMtx sync.Mutex
+
+// updateMirrors creates or updates a bare mirror of each repo in dir, which
+// the build instance mounts and clones from with --reference.
+func updateMirrors(dir string, repos map[string]string, out io.Writer) error {
+	mirrorMtx.Lock()
+	defer mirrorMtx.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for repo := range repos {
+		path := filepath.Join(dir, repo+".git")
+		var cmd *exec.Cmd
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			cacheMiss("git")
+			cmd = exec.Command("git", "clone", "--mirror", "https://github.com/flynn/"+repo, path)
+		} else {
+			cacheHit("git", 0)
+			cmd = exec.Command("git", "--git-dir", path, "remote", "update", "--prune")
+		}
+		fmt.Fprintf(out, "updating git mirror %s\n", path)
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("could not update git mirror of %s: %s", repo, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// nestedVirtFlag checks that the host kvm module allows nested
+// virtualization, and returns the CPU flag which exposes it to guests.
+func nestedVirtFlag() (string, error) {
+	for _, m := range []struct{ module, flag string }{
+		{"kvm_intel", "vmx"},
+		{"kvm_amd", "svm"},
+	} {
+		data, err := ioutil.ReadFile("/sys/module/" + m.module + "/parameters/nested")
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		switch strings.TrimSpace(string(data)) {
+		case "Y", "1":
+			return m.flag, nil
+		}
+		return "", fmt.Errorf("nested virtualization is disabled on this host, reload %s with nested=1", m.module)
+	}
+	return "", errors.New("nested virtualization requires the kvm_intel or kvm_amd module to be loaded")
+}
+
+// cpuArg returns the value of the QEMU -cpu flag for the instance, or an
+// empty string to use the default CPU model.
+func (v *vm) cpuArg() (string, error) {
+	cpu := v.CPU
+	if !v.NestedVirt {
+		return cpu, nil
+	}
+	flag, err := nestedVirtFlag()
+	if err != nil {
+		return "", err
+	}
+	if cpu == "" {
+		cpu = "host"
+	}
+	return cpu + ",+" + flag, nil
+}
@@ -1,12 +1,15 @@
 package cluster
 
 import (
+	"errors"
 	"fmt"
-	"html/template"
-	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
 	"syscall"
 	"unsafe"
 
@@ -21,13 +24,37 @@ type Bridge struct {
 	iface  *net.Interface
 	ipAddr net.IP
 	ipNet  *net.IPNet
+
+	// mtu is the MTU of the bridge and its taps, or zero for the kernel
+	// default.
+	mtu int
+}
+
+// DefaultBridgePrefix and DefaultTapPrefix name the bridges and taps of
+// clusters whose BootConfig doesn't set prefixes.
+const (
+	DefaultBridgePrefix = "flynnbr."
+	DefaultTapPrefix    = "flynntap."
+)
+
+// ifaceName returns an interface name of prefix, or def if it is empty,
+// followed by a random suffix.
+func ifaceName(prefix, def string, r *rand.Rand) (string, error) {
+	if prefix == "" {
+		prefix = def
+	}
+	name := prefix + util.SeededString(r, 5)
+	if len(name) >= IFNAMSIZ {
+		return "", fmt.Errorf("interface prefix %q is too long, it may be at most %d bytes", prefix, IFNAMSIZ-6)
+	}
+	return name, nil
 }
 
 func (b *Bridge) IP() string {
 	return b.ipAddr.String()
 }
 
-func createBridge(name, network, natIface string) (*Bridge, error) {
+func createBridge(name, network, natIface string, mtu int) (*Bridge, error) {
 	ipAddr, ipNet, err := net.ParseCIDR(network)
 	if err != nil {
 		return nil, err
@@ -48,10 +75,29 @@ func createBridge(name, network, natIface string) (*Bridge, error) {
 	if err := ioutil.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1\n"), 0644); err != nil {
 		return nil, err
 	}
-	if err := setupIPTables(name, natIface); err != nil {
+	if err := setupIPTables(name, natIface, mtu); err != nil {
 		return nil, err
 	}
-	return &Bridge{name, iface, ipAddr, ipNet}, nil
+	return &Bridge{name: name, iface: iface, ipAddr: ipAddr, ipNet: ipNet, mtu: mtu}, nil
+}
+
+// setMTU raises the MTU of the bridge once it has taps, as the kernel keeps
+// the MTU of a bridge at most that of its ports.
+func (b *Bridge) setMTU() error {
+	if b.mtu <= 0 {
+		return nil
+	}
+	iface, err := net.InterfaceByName(b.name)
+	if err != nil {
+		return err
+	}
+	if iface.MTU == b.mtu {
+		return nil
+	}
+	if err := netlink.NetworkSetMTU(iface, b.mtu); err != nil {
+		return fmt.Errorf("could not set MTU of %s to %d: %s", b.name, b.mtu, err)
+	}
+	return nil
 }
 
 func deleteBridge(bridge *Bridge) error {
@@ -61,10 +107,34 @@ func deleteBridge(bridge *Bridge) error {
 	if err := netlink.DeleteBridge(bridge.name); err != nil {
 		return err
 	}
+	if err := removeEgress(bridge.name); err != nil {
+		return err
+	}
+	if forward := forwardRule(bridge.name); iptables.Exists(forward...) {
+		if _, err := iptables.Raw(append([]string{"-D"}, forward...)...); err != nil {
+			return fmt.Errorf("unable to remove forwarding rule: %s", err)
+		}
+	}
+	if clamp := clampRule(bridge.name); iptables.Exists(clamp...) {
+		if _, err := iptables.Raw(append([]string{"-D"}, clamp...)...); err != nil {
+			return fmt.Errorf("unable to remove MSS clamping rule: %s", err)
+		}
+	}
 	return nil
 }
 
-func setupIPTables(bridgeName, natIface string) error {
+func forwardRule(bridgeName string) []string {
+	return []string{"FORWARD", "-i", bridgeName, "-j", "ACCEPT"}
+}
+
+// clampRule clamps the MSS of TCP connections from a bridge with jumbo
+// frames to the path MTU, so that connections NATed out of a host interface
+// with standard frames don't stall.
+func clampRule(bridgeName string) []string {
+	return []string{"FORWARD", "-t", "mangle", "-i", bridgeName, "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS", "--clamp-mss-to-pmtu"}
+}
+
+func setupIPTables(bridgeName, natIface string, mtu int) error {
 	nat := []string{"POSTROUTING", "-t", "nat", "-o", natIface, "-j", "MASQUERADE"}
 	if !iptables.Exists(nat...) {
 		if output, err := iptables.Raw(append([]string{"-I"}, nat...)...); err != nil {
@@ -74,7 +144,7 @@ func setupIPTables(bridgeName, natIface string) error {
 		}
 	}
 
-	forward := []string{"FORWARD", "-i", bridgeName, "-j", "ACCEPT"}
+	forward := forwardRule(bridgeName)
 	if !iptables.Exists(forward...) {
 		if output, err := iptables.Raw(append([]string{"-I"}, forward...)...); err != nil {
 			return fmt.Errorf("unable to enable forwarding: %s", err)
@@ -83,6 +153,14 @@ func setupIPTables(bridgeName, natIface string) error {
 		}
 	}
 
+	if clamp := clampRule(bridgeName); mtu > 1500 && !iptables.Exists(clamp...) {
+		if output, err := iptables.Raw(append([]string{"-I"}, clamp...)...); err != nil {
+			return fmt.Errorf("unable to clamp MSS: %s", err)
+		} else if len(output) != 0 {
+			return fmt.Errorf("unknown error clamping MSS: %s", output)
+		}
+	}
+
 	return nil
 }
 
@@ -163,6 +241,7 @@ type Tap struct {
 	Name              string
 	LocalIP, RemoteIP *net.IP
 	bridge            *Bridge
+	uid, gid          int
 }
 
 func (t *Tap) Close() error {
@@ -178,34 +257,119 @@ func (t *Tap) Close() error {
 	return nil
 }
 
-var ifaceConfig = template.Must(template.New("eth0").Parse(`
-auto eth0
-iface eth0 inet static
-  address {{.Address}}
-  gateway {{.Gateway}}
-  netmask 255.255.255.0
-  dns-nameservers 8.8.8.8 8.8.4.4
-`[1:]))
-
-func (t *Tap) WriteInterfaceConfig(f io.Writer) error {
-	return ifaceConfig.Execute(f, map[string]string{
-		"Address": t.RemoteIP.String(),
-		"Gateway": t.bridge.IP(),
-	})
+// reset checks that the tap is no longer attached to an instance, is up and
+// is on its bridge, and flushes any addresses the last instance's traffic
+// left on it, so that it can be given to another instance.
+func (t *Tap) reset() error {
+	f, err := ioctlTap(t.Name)
+	if err != nil {
+		return fmt.Errorf("tap is busy: %s", err)
+	}
+	f.Close()
+	iface, err := net.InterfaceByName(t.Name)
+	if err != nil {
+		return err
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return errors.New("tap is down")
+	}
+	if master, err := os.Readlink("/sys/class/net/" + t.Name + "/master"); err != nil || filepath.Base(master) != t.bridge.name {
+		return errors.New("tap is not on the bridge")
+	}
+	if out, err := exec.Command("ip", "addr", "flush", "dev", t.Name).CombinedOutput(); err != nil {
+		return fmt.Errorf("could not flush addresses: %s: %s", err, out)
+	}
+	return netlink.NetworkLinkAddIp(iface, *t.LocalIP, t.bridge.ipNet)
 }
 
+// maxIdleTaps is the number of taps of stopped instances a TapManager keeps
+// to give to new instances.
+const maxIdleTaps = 16
+
+// TapManager creates the taps of instances on a bridge. Taps are recycled
+// across the instances of a run, as creating them and their routes is slow
+// and occasionally races with the kernel.
 type TapManager struct {
 	bridge *Bridge
+	prefix string
+
+	randMtx sync.Mutex
+	rand    *rand.Rand
+
+	idleMtx sync.Mutex
+	idle    []*Tap
+	closed  bool
+}
+
+// NewTapManager returns a TapManager naming taps with prefix, defaulting to
+// DefaultTapPrefix.
+func NewTapManager(bridge *Bridge, prefix string, seed int64) *TapManager {
+	return &TapManager{bridge: bridge, prefix: prefix, rand: rand.New(rand.NewSource(seed))}
+}
+
+// Release keeps the tap of a stopped instance for reuse, or closes it if
+// enough taps are idle.
+func (t *TapManager) Release(tap *Tap) error {
+	t.idleMtx.Lock()
+	if !t.closed && len(t.idle) < maxIdleTaps {
+		t.idle = append(t.idle, tap)
+		t.idleMtx.Unlock()
+		return nil
+	}
+	t.idleMtx.Unlock()
+	return tap.Close()
+}
+
+// Close closes the idle taps, and those released later.
+func (t *TapManager) Close() {
+	t.idleMtx.Lock()
+	defer t.idleMtx.Unlock()
+	for _, tap := range t.idle {
+		if err := tap.Close(); err != nil {
+			fmt.Printf("could not close tap device %s: %s\n", tap.Name, err)
+		}
+	}
+	t.idle = nil
+	t.closed = true
+}
+
+// reuse returns a healthy idle tap owned by uid and gid, closing those which
+// fail their checks, or nil if there is none.
+func (t *TapManager) reuse(uid, gid int) *Tap {
+	t.idleMtx.Lock()
+	defer t.idleMtx.Unlock()
+	for i := len(t.idle) - 1; i >= 0; i-- {
+		tap := t.idle[i]
+		if tap.uid != uid || tap.gid != gid {
+			continue
+		}
+		t.idle = append(t.idle[:i], t.idle[i+1:]...)
+		if err := tap.reset(); err != nil {
+			fmt.Printf("not reusing tap device %s: %s\n", tap.Name, err)
+			tap.Close()
+			continue
+		}
+		return tap
+	}
+	return nil
 }
 
 func (t *TapManager) NewTap(uid, gid int) (*Tap, error) {
-	tap := &Tap{Name: "flynntap." + util.RandomString(5), bridge: t.bridge}
+	if tap := t.reuse(uid, gid); tap != nil {
+		return tap, nil
+	}
+	t.randMtx.Lock()
+	name, err := ifaceName(t.prefix, DefaultTapPrefix, t.rand)
+	t.randMtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	tap := &Tap{Name: name, bridge: t.bridge, uid: uid, gid: gid}
 
 	if err := createTap(tap.Name, uid, gid); err != nil {
 		return nil, err
 	}
 
-	var err error
 	tap.LocalIP, err = ipallocator.RequestIP(t.bridge.ipNet, nil)
 	if err != nil {
 		tap.Close()
@@ -227,6 +391,12 @@ func (t *TapManager) NewTap(uid, gid int) (*Tap, error) {
 		tap.Close()
 		return nil, err
 	}
+	if t.bridge.mtu > 0 {
+		if err := netlink.NetworkSetMTU(iface, t.bridge.mtu); err != nil {
+			tap.Close()
+			return nil, fmt.Errorf("could not set MTU of %s to %d: %s", tap.Name, t.bridge.mtu, err)
+		}
+	}
 	if err := netlink.NetworkLinkUp(iface); err != nil {
 		tap.Close()
 		return nil, err
@@ -235,6 +405,10 @@ func (t *TapManager) NewTap(uid, gid int) (*Tap, error) {
 		tap.Close()
 		return nil, err
 	}
+	if err := t.bridge.setMTU(); err != nil {
+		tap.Close()
+		return nil, err
+	}
 
 	return tap, nil
 }
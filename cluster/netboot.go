@@ -0,0 +1,155 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// NetbootServer serves TFTP and HTTP on a cluster bridge so that instances
+// can PXE boot from the files in Root, which the cluster's NetServer points
+// netboot instances at.
+type NetbootServer struct {
+	Root string
+
+	// BootFile is the file handed to PXE clients over TFTP. iPXE clients are
+	// instead pointed at boot.ipxe over HTTP if it exists in Root.
+	BootFile string
+
+	bridge *Bridge
+	tftp   net.PacketConn
+	http   net.Listener
+}
+
+func NewNetbootServer(bridge *Bridge, root string) (*NetbootServer, error) {
+	s := &NetbootServer{
+		Root:     root,
+		BootFile: "pxelinux.0",
+		bridge:   bridge,
+	}
+	var err error
+	if s.tftp, err = net.ListenPacket("udp4", bridge.IP()+":69"); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("netboot: could not listen for TFTP: %s", err)
+	}
+	if s.http, err = net.Listen("tcp4", bridge.IP()+":0"); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("netboot: could not listen for HTTP: %s", err)
+	}
+	go s.serveTFTP()
+	go http.Serve(s.http, http.FileServer(http.Dir(root)))
+	return s, nil
+}
+
+func (s *NetbootServer) HTTPURL() string {
+	return "http://" + s.http.Addr().String()
+}
+
+func (s *NetbootServer) httpPort() int {
+	return s.http.Addr().(*net.TCPAddr).Port
+}
+
+func (s *NetbootServer) Close() error {
+	if s.tftp != nil {
+		s.tftp.Close()
+	}
+	if s.http != nil {
+		s.http.Close()
+	}
+	return nil
+}
+
+// bootFile is the file given to PXE clients in DHCP replies. iPXE clients
+// are pointed at boot.ipxe over HTTP if it exists.
+func (s *NetbootServer) bootFile(ipxe bool) string {
+	if _, err := os.Stat(filepath.Join(s.Root, "boot.ipxe")); ipxe && err == nil {
+		return s.HTTPURL() + "/boot.ipxe"
+	}
+	return s.BootFile
+}
+
+const (
+	tftpRRQ   = 1
+	tftpData  = 3
+	tftpAck   = 4
+	tftpError = 5
+
+	tftpBlockSize = 512
+)
+
+func (s *NetbootServer) serveTFTP() {
+	buf := make([]byte, 516)
+	for {
+		n, addr, err := s.tftp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 4 || binary.BigEndian.Uint16(buf) != tftpRRQ {
+			continue
+		}
+		parts := bytes.SplitN(buf[2:n], []byte{0}, 2)
+		go s.sendTFTP(addr, string(parts[0]))
+	}
+}
+
+// sendTFTP sends a file in octet mode from a new port, as required by the
+// protocol.
+func (s *NetbootServer) sendTFTP(addr net.Addr, name string) {
+	conn, err := net.ListenPacket("udp4", s.bridge.IP()+":0")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	f, err := os.Open(filepath.Join(s.Root, filepath.Clean("/"+name)))
+	if err != nil {
+		conn.WriteTo(tftpErrorPacket(1, "file not found"), addr)
+		return
+	}
+	defer f.Close()
+
+	packet := make([]byte, 4+tftpBlockSize)
+	for block := uint16(1); ; block++ {
+		n, err := io.ReadFull(f, packet[4:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			conn.WriteTo(tftpErrorPacket(0, err.Error()), addr)
+			return
+		}
+		binary.BigEndian.PutUint16(packet[0:], tftpData)
+		binary.BigEndian.PutUint16(packet[2:], block)
+		if !sendTFTPBlock(conn, addr, packet[:4+n], block) || n < tftpBlockSize {
+			return
+		}
+	}
+}
+
+func sendTFTPBlock(conn net.PacketConn, addr net.Addr, packet []byte, block uint16) bool {
+	ack := make([]byte, 4)
+	for retry := 0; retry < 5; retry++ {
+		conn.WriteTo(packet, addr)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			n, _, err := conn.ReadFrom(ack)
+			if err != nil {
+				break
+			}
+			if n == 4 && binary.BigEndian.Uint16(ack) == tftpAck && binary.BigEndian.Uint16(ack[2:]) == block {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func tftpErrorPacket(code uint16, msg string) []byte {
+	b := make([]byte, 4, 5+len(msg))
+	binary.BigEndian.PutUint16(b, tftpError)
+	binary.BigEndian.PutUint16(b[2:], code)
+	b = append(b, msg...)
+	return append(b, 0)
+}
@@ -0,0 +1,167 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// netConfigFormat is the network config of a guest network manager, written
+// to the root of the instance's netfs which the guest image mounts where the
+// network manager reads its config from.
+type netConfigFormat struct {
+	file     string
+	template *template.Template
+
+	// dataFile and data configure eth1 of instances with a macvtap
+	// interface by DHCP, without routing anything but its subnet over it.
+	dataFile string
+	data     *template.Template
+}
+
+// NetConfigFormats are the guest network managers which instance network
+// configs can be written for, selected by the network_config of the image
+// catalog and defaulting to ifupdown.
+var NetConfigFormats = map[string]*netConfigFormat{
+	"ifupdown": {
+		file: "eth0",
+		template: netConfigTemplate("ifupdown", `
+auto eth0
+iface eth0 inet static
+  address {{.Address}}
+  gateway {{.Gateway}}
+  netmask {{.Netmask}}
+{{if .MTU}}  mtu {{.MTU}}
+{{end}}  dns-nameservers {{join .DNS " "}}
+`[1:]),
+		dataFile: "eth1",
+		data: netConfigTemplate("ifupdown-data", `
+auto eth1
+iface eth1 inet dhcp
+  post-up ip route del default dev eth1 || true
+`[1:]),
+	},
+	"netplan": {
+		file: "60-flynn.yaml",
+		template: netConfigTemplate("netplan", `
+network:
+  version: 2
+  ethernets:
+    eth0:
+      match:
+        macaddress: "{{.MAC}}"
+      set-name: eth0
+{{if .MTU}}      mtu: {{.MTU}}
+{{end}}      addresses: ["{{.Address}}/{{.Prefix}}"]
+      gateway4: {{.Gateway}}
+      nameservers:
+        addresses: [{{join .DNS ", "}}]
+`[1:]),
+		dataFile: "61-flynn-data.yaml",
+		data: netConfigTemplate("netplan-data", `
+network:
+  version: 2
+  ethernets:
+    eth1:
+      match:
+        macaddress: "{{.MAC}}"
+      set-name: eth1
+      dhcp4: true
+      dhcp4-overrides:
+        use-routes: false
+        use-dns: false
+`[1:]),
+	},
+	"networkd": {
+		file: "60-flynn.network",
+		template: netConfigTemplate("networkd", `
+[Match]
+MACAddress={{.MAC}}
+
+[Network]
+Address={{.Address}}/{{.Prefix}}
+Gateway={{.Gateway}}
+{{range .DNS}}DNS={{.}}
+{{end}}{{if .MTU}}
+[Link]
+MTUBytes={{.MTU}}
+{{end}}`[1:]),
+		dataFile: "61-flynn-data.network",
+		data: netConfigTemplate("networkd-data", `
+[Match]
+MACAddress={{.MAC}}
+
+[Network]
+DHCP=ipv4
+
+[DHCP]
+UseRoutes=false
+UseDNS=false
+`[1:]),
+	},
+}
+
+func netConfigTemplate(name, text string) *template.Template {
+	return template.Must(template.New(name).Funcs(template.FuncMap{"join": strings.Join}).Parse(text))
+}
+
+func validateNetConfig(format string) error {
+	if format == "" {
+		return nil
+	}
+	if _, ok := NetConfigFormats[format]; !ok {
+		var formats []string
+		for name := range NetConfigFormats {
+			formats = append(formats, name)
+		}
+		sort.Strings(formats)
+		return fmt.Errorf("unknown network config %q, must be one of %s", format, strings.Join(formats, ", "))
+	}
+	return nil
+}
+
+// WriteNetConfig writes the config of the guest interface with address mac
+// and the nameservers dns to dir in the given format.
+func (t *Tap) WriteNetConfig(dir, format, mac string, dns []string) error {
+	if format == "" {
+		format = "ifupdown"
+	}
+	if err := validateNetConfig(format); err != nil {
+		return err
+	}
+	f := NetConfigFormats[format]
+	out, err := os.Create(filepath.Join(dir, f.file))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	prefix, _ := t.bridge.ipNet.Mask.Size()
+	return f.template.Execute(out, map[string]interface{}{
+		"Address": t.RemoteIP.String(),
+		"Gateway": t.bridge.IP(),
+		"Netmask": net.IP(t.bridge.ipNet.Mask).String(),
+		"Prefix":  prefix,
+		"MAC":     mac,
+		"DNS":     dns,
+		"MTU":     t.bridge.mtu,
+	})
+}
+
+// writeDataNetConfig writes the config of the macvtap interface with address
+// mac to dir in the given format.
+func writeDataNetConfig(dir, format, mac string) error {
+	if format == "" {
+		format = "ifupdown"
+	}
+	f := NetConfigFormats[format]
+	out, err := os.Create(filepath.Join(dir, f.dataFile))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return f.data.Execute(out, map[string]interface{}{"MAC": mac})
+}
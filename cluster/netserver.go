@@ -0,0 +1,336 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// GuestDomain is the DNS domain of instances, which resolve each other as
+// <instance id>.<GuestDomain>, or by the bare instance ID.
+const GuestDomain = "flynn.test"
+
+// NetServer answers DHCP and DNS on a cluster bridge, so that guest images
+// which don't read the interface config of the netfs, such as stock cloud
+// images, get their address, gateway, nameserver and hostname, and so that
+// instances can resolve each other by name. DHCP is only answered for hosts
+// which were registered with AddHost, and other DNS queries are forwarded
+// to the public nameservers.
+type NetServer struct {
+	bridge  *Bridge
+	netboot *NetbootServer
+	dhcp    net.PacketConn
+	dns     net.PacketConn
+
+	mtx   sync.RWMutex
+	hosts map[string]*guestHost
+	names map[string]net.IP
+}
+
+type guestHost struct {
+	ip      net.IP
+	name    string
+	netboot bool
+}
+
+// NewNetServer starts serving DHCP and DNS on bridge. DHCP replies to hosts
+// registered for netboot point them at the boot files of netboot, which may
+// be nil. DNS is only served if port 53 of the bridge IP is free.
+func NewNetServer(bridge *Bridge, netboot *NetbootServer) (*NetServer, error) {
+	s := &NetServer{
+		bridge:  bridge,
+		netboot: netboot,
+		hosts:   make(map[string]*guestHost),
+		names:   make(map[string]net.IP),
+	}
+	var err error
+	if s.dhcp, err = listenDHCP(bridge.name); err != nil {
+		return nil, fmt.Errorf("could not listen for DHCP: %s", err)
+	}
+	go s.serveDHCP()
+	if s.dns, err = net.ListenPacket("udp4", bridge.IP()+":53"); err == nil {
+		go s.serveDNS()
+	}
+	return s, nil
+}
+
+// Nameservers returns the nameservers instances should use, the bridge if
+// DNS is served on it.
+func (s *NetServer) Nameservers() []string {
+	if s == nil || s.dns == nil {
+		return nameservers
+	}
+	return []string{s.bridge.IP()}
+}
+
+// AddHost answers DHCP from mac with ip and the hostname name, and resolves
+// name to ip.
+func (s *NetServer) AddHost(mac string, ip net.IP, name string, netboot bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.hosts[mac] = &guestHost{ip: ip, name: name, netboot: netboot}
+	s.names[name] = ip
+}
+
+// AddName resolves name to ip without answering DHCP for it.
+func (s *NetServer) AddName(name string, ip net.IP) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.names[name] = ip
+}
+
+func (s *NetServer) RemoveHost(mac string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if h, ok := s.hosts[mac]; ok {
+		delete(s.names, h.name)
+		delete(s.hosts, mac)
+	}
+}
+
+func (s *NetServer) Close() error {
+	s.dhcp.Close()
+	if s.dns != nil {
+		s.dns.Close()
+	}
+	return nil
+}
+
+// listenDHCP listens on port 67 of iface only, so that each cluster bridge
+// can run its own server.
+func listenDHCP(iface string) (net.PacketConn, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "dhcp")
+	defer f.Close()
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
+		return nil, err
+	}
+	if err := syscall.BindToDevice(fd, iface); err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Port: 67}); err != nil {
+		return nil, err
+	}
+	return net.FilePacketConn(f)
+}
+
+var dhcpMagic = []byte{99, 130, 83, 99}
+
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+)
+
+func (s *NetServer) serveDHCP() {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := s.dhcp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		if n < 240 || req[0] != 1 || !bytes.Equal(req[236:240], dhcpMagic) {
+			continue
+		}
+		opts := parseDHCPOptions(req[240:])
+		var replyType byte
+		switch t := opts[53]; {
+		case len(t) == 1 && t[0] == dhcpDiscover:
+			replyType = dhcpOffer
+		case len(t) == 1 && t[0] == dhcpRequest:
+			replyType = dhcpAck
+		default:
+			continue
+		}
+		s.mtx.RLock()
+		host, ok := s.hosts[net.HardwareAddr(req[28:34]).String()]
+		s.mtx.RUnlock()
+		if !ok {
+			continue
+		}
+		reply := s.dhcpReply(req, replyType, host, string(opts[77]) == "iPXE")
+		s.dhcp.WriteTo(reply, &net.UDPAddr{IP: net.IPv4bcast, Port: 68})
+	}
+}
+
+func parseDHCPOptions(b []byte) map[byte][]byte {
+	opts := make(map[byte][]byte)
+	for len(b) > 0 {
+		code := b[0]
+		if code == 255 {
+			break
+		}
+		if code == 0 {
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			break
+		}
+		opts[code] = b[2 : 2+b[1]]
+		b = b[2+b[1]:]
+	}
+	return opts
+}
+
+func (s *NetServer) dhcpReply(req []byte, typ byte, host *guestHost, ipxe bool) []byte {
+	server := s.bridge.ipAddr.To4()
+	var file string
+	if host.netboot && s.netboot != nil {
+		file = s.netboot.bootFile(ipxe)
+	}
+
+	r := make([]byte, 240, 512)
+	r[0], r[1], r[2] = 2, 1, 6
+	copy(r[4:8], req[4:8])     // xid
+	copy(r[10:12], req[10:12]) // flags
+	copy(r[16:20], host.ip.To4())
+	copy(r[20:24], server)
+	copy(r[28:44], req[28:44]) // chaddr
+	copy(r[108:236], file)
+	copy(r[236:240], dhcpMagic)
+
+	option := func(code byte, data []byte) {
+		r = append(r, code, byte(len(data)))
+		r = append(r, data...)
+	}
+	option(53, []byte{typ})
+	option(54, server)
+	option(51, []byte{0, 0, 0x0e, 0x10}) // one hour lease
+	option(1, []byte(s.bridge.ipNet.Mask))
+	option(3, server)
+	var dns []byte
+	for _, ns := range s.Nameservers() {
+		dns = append(dns, net.ParseIP(ns).To4()...)
+	}
+	option(6, dns)
+	option(12, []byte(host.name))
+	option(15, []byte(GuestDomain))
+	if file != "" {
+		option(67, []byte(file))
+	}
+	return append(r, 255)
+}
+
+const (
+	dnsTypeA     = 1
+	dnsClassIN   = 1
+	dnsRcodeName = 3
+)
+
+func (s *NetServer) serveDNS() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.dns.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := append([]byte(nil), buf[:n]...)
+		name, qtype, end, ok := parseDNSQuestion(req)
+		if !ok {
+			continue
+		}
+		if ip, local := s.resolve(name); local {
+			s.dns.WriteTo(dnsReply(req[:end], qtype, ip), addr)
+			continue
+		}
+		go s.forwardDNS(req, addr)
+	}
+}
+
+// resolve looks up a guest name, reporting whether the name is in the guest
+// domain, so that unknown guests aren't looked up upstream.
+func (s *NetServer) resolve(name string) (net.IP, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	local := strings.HasSuffix(name, "."+GuestDomain)
+	name = strings.TrimSuffix(name, "."+GuestDomain)
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	ip, ok := s.names[name]
+	return ip, ok || local
+}
+
+// forwardDNS relays a query to the first public nameserver.
+func (s *NetServer) forwardDNS(req []byte, addr net.Addr) {
+	conn, err := net.Dial("udp4", nameservers[0]+":53")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(req); err != nil {
+		return
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+	s.dns.WriteTo(buf[:n], addr)
+}
+
+// parseDNSQuestion returns the name and type of the single question of a
+// DNS query, and the offset of the end of the question.
+func parseDNSQuestion(msg []byte) (string, uint16, int, bool) {
+	if len(msg) < 12 || msg[2]&0x80 != 0 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return "", 0, 0, false
+	}
+	var labels []string
+	i := 12
+	for {
+		if i >= len(msg) {
+			return "", 0, 0, false
+		}
+		l := int(msg[i])
+		i++
+		if l == 0 {
+			break
+		}
+		if l > 63 || i+l > len(msg) {
+			return "", 0, 0, false
+		}
+		labels = append(labels, string(msg[i:i+l]))
+		i += l
+	}
+	if i+4 > len(msg) {
+		return "", 0, 0, false
+	}
+	return strings.Join(labels, "."), binary.BigEndian.Uint16(msg[i:]), i + 4, true
+}
+
+// dnsReply answers the query q, which ends after its question, with an A
+// record of ip, or NXDOMAIN if ip is nil. Queries for other record types of
+// known names get an empty answer.
+func dnsReply(q []byte, qtype uint16, ip net.IP) []byte {
+	r := append([]byte(nil), q...)
+	r[2] = 0x84 | q[2]&0x01 // response, authoritative, recursion desired
+	r[3] = 0x80             // recursion available
+	binary.BigEndian.PutUint16(r[6:], 0)
+	binary.BigEndian.PutUint16(r[8:], 0)
+	binary.BigEndian.PutUint16(r[10:], 0)
+	if ip == nil {
+		r[3] |= dnsRcodeName
+		return r
+	}
+	if qtype != dnsTypeA {
+		return r
+	}
+	binary.BigEndian.PutUint16(r[6:], 1)
+	answer := []byte{0xc0, 12, 0, dnsTypeA, 0, dnsClassIN, 0, 0, 0, 60, 0, 4}
+	r = append(r, answer...)
+	return append(r, ip.To4()...)
+}
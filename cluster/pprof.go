@@ -0,0 +1,59 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/flynn/go-discoverd"
+)
+
+// FetchProfile fetches a pprof profile such as "heap" or "goroutine" from the
+// leader of a discoverd service, tunnelling the request over SSH through the
+// first instance. seconds sets the duration of "profile" (CPU) profiles.
+func (c *Cluster) FetchProfile(service, profile string, seconds int) ([]byte, error) {
+	if len(c.instances) == 0 {
+		return nil, errors.New("cluster: no instances")
+	}
+	inst := c.instances[0]
+	disc, err := discoverd.NewClientWithAddr(inst.IP() + ":1111")
+	if err != nil {
+		return nil, fmt.Errorf("cluster: could not connect to discoverd: %s", err)
+	}
+	defer disc.Close()
+	set, err := disc.NewServiceSet(service)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: could not lookup %s: %s", service, err)
+	}
+	leader := set.Leader()
+	set.Close()
+	if leader == nil {
+		return nil, fmt.Errorf("cluster: no %s leader", service)
+	}
+
+	sc, err := inst.DialSSH()
+	if err != nil {
+		return nil, err
+	}
+	defer sc.Close()
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return sc.Dial(network, addr)
+		},
+	}}
+	url := fmt.Sprintf("http://%s/debug/pprof/%s", leader.Addr, profile)
+	if profile == "profile" && seconds > 0 {
+		url += fmt.Sprintf("?seconds=%d", seconds)
+	}
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("cluster: unexpected status %d fetching %s", res.StatusCode, url)
+	}
+	return ioutil.ReadAll(res.Body)
+}
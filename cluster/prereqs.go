@@ -0,0 +1,61 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// prereqScript prints a "missing:" line for each kernel feature or service
+// flynn-host needs which the guest lacks, loading modules which aren't yet
+// loaded. The docker daemon is given time to start after boot.
+const prereqScript = `
+check() {
+  name=$1
+  shift
+  "$@" >/dev/null 2>&1 || echo "missing: $name"
+}
+check "aufs or overlay filesystem" sh -c 'grep -qwE "aufs|overlay" /proc/filesystems || sudo modprobe -q aufs || sudo modprobe -q overlay'
+check "bridge kernel module" sh -c 'test -d /sys/module/bridge || sudo modprobe -q bridge'
+check "cgroup filesystem" sh -c 'grep -qw cgroup /proc/mounts'
+for controller in cpu cpuacct devices memory; do
+  check "$controller cgroup controller" sh -c "awk '\$1 == \"$controller\" && \$4 == 1 { found = 1 } END { exit !found }' /proc/cgroups"
+done
+check "docker daemon" sh -c 'for i in $(seq 30); do sudo docker info && exit; sleep 1; done; exit 1'
+exit 0
+`
+
+// PrereqError is returned when a guest lacks what flynn-host needs, which is
+// a fault of the rootfs image rather than of the code under test.
+type PrereqError struct {
+	Instance string
+	Missing  []string
+}
+
+func (e *PrereqError) Error() string {
+	return fmt.Sprintf("guest %s is missing prerequisites of flynn-host: %s", e.Instance, strings.Join(e.Missing, ", "))
+}
+
+// checkPrereqs verifies that each instance has the kernel features and
+// running docker daemon which bootstrapping needs.
+func (c *Cluster) checkPrereqs() error {
+	c.log("Checking guest prerequisites...")
+	for _, inst := range c.instances {
+		var out bytes.Buffer
+		if err := inst.Run(prereqScript, attempts, &out, c.out); err != nil {
+			return err
+		}
+		var missing []string
+		s := bufio.NewScanner(&out)
+		for s.Scan() {
+			if line := s.Text(); strings.HasPrefix(line, "missing: ") {
+				missing = append(missing, strings.TrimPrefix(line, "missing: "))
+			}
+		}
+		if len(missing) > 0 {
+			return &PrereqError{Instance: inst.IP(), Missing: missing}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn-test/util"
+)
+
+var qmpAttempts = util.Strategy{
+	Total: 10 * time.Second,
+	Delay: 50 * time.Millisecond,
+}
+
+// qmpClient is a minimal client for the QEMU Machine Protocol.
+type qmpClient struct {
+	conn    net.Conn
+	onEvent func(string)
+
+	mtx     sync.Mutex
+	replies chan *qmpMessage
+}
+
+type qmpMessage struct {
+	Event  string          `json:"event"`
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+}
+
+// dialQMP connects to the QMP socket at path, retrying while QEMU starts.
+// onEvent is called in a new goroutine for each event received.
+func dialQMP(path string, onEvent func(string)) (*qmpClient, error) {
+	if err := util.WaitFor(util.DialCheck("unix", path), qmpAttempts, nil); err != nil {
+		return nil, fmt.Errorf("qmp: %s", err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return newQMPClient(conn, onEvent)
+}
+
+// newQMPClient negotiates the capabilities of the QMP server at the other
+// end of conn.
+func newQMPClient(conn net.Conn, onEvent func(string)) (*qmpClient, error) {
+	dec := json.NewDecoder(conn)
+	var greeting json.RawMessage
+	if err := dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp: could not read greeting: %s", err)
+	}
+	c := &qmpClient{conn: conn, onEvent: onEvent, replies: make(chan *qmpMessage, 1)}
+	go c.read(dec)
+	if err := c.execute("qmp_capabilities", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *qmpClient) read(dec *json.Decoder) {
+	defer close(c.replies)
+	for {
+		msg := &qmpMessage{}
+		if err := dec.Decode(msg); err != nil {
+			return
+		}
+		if msg.Event != "" {
+			if c.onEvent != nil {
+				go c.onEvent(msg.Event)
+			}
+			continue
+		}
+		c.replies <- msg
+	}
+}
+
+func (c *qmpClient) execute(command string, args interface{}) error {
+	_, err := c.query(command, args)
+	return err
+}
+
+// query executes command, returning its result.
+func (c *qmpClient) query(command string, args interface{}) (json.RawMessage, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	req := map[string]interface{}{"execute": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	if err := json.NewEncoder(c.conn).Encode(req); err != nil {
+		return nil, err
+	}
+	msg, ok := <-c.replies
+	if !ok {
+		return nil, errors.New("qmp: connection closed")
+	}
+	if msg.Error != nil {
+		return nil, fmt.Errorf("qmp: %s failed: %s", command, msg.Error.Desc)
+	}
+	return msg.Return, nil
+}
+
+// humanCommand runs a human monitor command, such as savevm, which has no QMP
+// equivalent. The monitor only reports errors in its output.
+func (c *qmpClient) humanCommand(line string) error {
+	res, err := c.query("human-monitor-command", map[string]string{"command-line": line})
+	if err != nil {
+		return err
+	}
+	var out string
+	json.Unmarshal(res, &out)
+	if out = strings.TrimSpace(out); out != "" {
+		return fmt.Errorf("qmp: %s failed: %s", line, out)
+	}
+	return nil
+}
+
+func (c *qmpClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,130 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// RawDisk is a sparse image on the host attached to a running instance as a
+// whole virtio disk through a loop device, for tests of volume drivers such
+// as ZFS which partition or format entire disks rather than use a
+// filesystem image.
+type RawDisk struct {
+	ID string
+
+	// Instance is the index of the instance the disk is attached to, and
+	// GuestPath the disk's device in the guest.
+	Instance  int
+	GuestPath string
+
+	image string
+	loop  string
+	vm    *vm
+}
+
+// AttachRawDisk creates a raw disk of size bytes and hot plugs it into
+// instance i. The disk is removed by DetachRawDisk or when the cluster shuts
+// down.
+func (c *Cluster) AttachRawDisk(i int, size int64) (*RawDisk, error) {
+	if i < 0 || i >= len(c.instances) {
+		return nil, fmt.Errorf("cluster: no instance %d", i)
+	}
+	v, ok := asVM(c.instances[i])
+	if !ok || v.host != nil {
+		return nil, errors.New("cluster: raw disks can only be attached to local QEMU instances")
+	}
+	runDir, err := RunDir(c.bc.Workdir, c.bc.RunID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(runDir, "disks"), 0755); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Join(runDir, "disks"), "raw-")
+	if err != nil {
+		return nil, err
+	}
+	d := &RawDisk{
+		ID:       "raw" + filepath.Base(f.Name())[len("raw-"):],
+		Instance: i,
+		image:    f.Name(),
+		vm:       v,
+	}
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		os.Remove(d.image)
+		return nil, err
+	}
+	recordImage(c.bc.RunID, d.image)
+
+	out, err := exec.Command("sudo", "losetup", "--find", "--show", d.image).CombinedOutput()
+	if err != nil {
+		os.Remove(d.image)
+		return nil, fmt.Errorf("cluster: could not create loop device: %s: %s", err, out)
+	}
+	d.loop = strings.TrimSpace(string(out))
+	if out, err := exec.Command("sudo", "chown", fmt.Sprintf("%d:%d", v.User, v.Group), d.loop).CombinedOutput(); err != nil {
+		d.release()
+		return nil, fmt.Errorf("cluster: could not chown %s: %s: %s", d.loop, err, out)
+	}
+
+	// the drive's serial names the disk in /dev/disk/by-id, which virtio
+	// truncates to 20 bytes
+	if err := v.monitor(func(qmp *qmpClient) error {
+		if err := qmp.humanCommand(fmt.Sprintf("drive_add 0 if=none,id=%s,file=%s,format=raw,cache=none", d.ID, d.loop)); err != nil {
+			return err
+		}
+		return qmp.execute("device_add", map[string]interface{}{
+			"driver": "virtio-blk-pci",
+			"id":     d.ID,
+			"drive":  d.ID,
+			"serial": d.ID,
+		})
+	}); err != nil {
+		d.release()
+		return nil, fmt.Errorf("cluster: could not attach %s to instance %d: %s", d.loop, i, err)
+	}
+	d.GuestPath = "/dev/disk/by-id/virtio-" + d.ID
+	c.event("attached raw disk %s (%s) to instance %d", d.ID, d.loop, i)
+	c.rawDisks = append(c.rawDisks, d)
+	return d, nil
+}
+
+// DetachRawDisk hot unplugs d from its instance and removes it.
+func (c *Cluster) DetachRawDisk(d *RawDisk) error {
+	for i, disk := range c.rawDisks {
+		if disk == d {
+			c.rawDisks = append(c.rawDisks[:i], c.rawDisks[i+1:]...)
+			break
+		}
+	}
+	c.event("detaching raw disk %s from instance %d", d.ID, d.Instance)
+	err := d.vm.monitor(func(qmp *qmpClient) error {
+		return qmp.execute("device_del", map[string]interface{}{"id": d.ID})
+	})
+	if rerr := d.release(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// release removes the loop device and image of d.
+func (d *RawDisk) release() error {
+	var err error
+	if d.loop != "" {
+		if out, lerr := exec.Command("sudo", "losetup", "-d", d.loop).CombinedOutput(); lerr != nil {
+			err = fmt.Errorf("cluster: could not remove loop device %s: %s: %s", d.loop, lerr, out)
+		}
+		d.loop = ""
+	}
+	if rerr := removeTemp(d.vm.runID, d.image); rerr != nil && err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,399 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Registry is a throwaway docker registry speaking the v1 API used by the
+// docker in instances. It is served on the bridge of each cluster of a run
+// which has it in its BootConfig, so the build instance can push the images
+// it builds and cluster instances pull them, rather than booting from a copy
+// of the build's docker fs. Images are stored in Dir, and the repos pushed
+// to it are tagged with Labels.
+type Registry struct {
+	Dir    string
+	Labels Labels
+
+	mtx sync.Mutex
+}
+
+func NewRegistry(dir string) (*Registry, error) {
+	for _, d := range []string{"images", "repositories"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Registry{Dir: dir}, nil
+}
+
+// Close removes the images stored by the registry.
+func (r *Registry) Close() error {
+	return os.RemoveAll(r.Dir)
+}
+
+// listen serves the registry on bridge until the returned listener is
+// closed.
+func (r *Registry) listen(bridge *Bridge) (net.Listener, error) {
+	l, err := net.Listen("tcp4", bridge.IP()+":0")
+	if err != nil {
+		return nil, fmt.Errorf("registry: could not listen: %s", err)
+	}
+	go http.Serve(l, r)
+	return l, nil
+}
+
+// Images returns the repo:tag names of the images which have been pushed.
+func (r *Registry) Images() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	var images []string
+	root := filepath.Join(r.Dir, "repositories")
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.Name() != "tags.json" {
+			return nil
+		}
+		repo, _ := filepath.Rel(root, filepath.Dir(path))
+		tags, _ := r.readTags(repo)
+		for tag := range tags {
+			images = append(images, repo+":"+tag)
+		}
+		return nil
+	})
+	sort.Strings(images)
+	return images
+}
+
+var (
+	registryIDPattern   = regexp.MustCompile(`^[a-f0-9]{64}$`)
+	registryRepoPattern = regexp.MustCompile(`^[a-z0-9_.-]+(/[a-z0-9_.-]+)?$`)
+	registryTagPattern  = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("X-Docker-Registry-Version", "0.6.0")
+	w.Header().Set("X-Docker-Registry-Standalone", "true")
+	path := strings.TrimPrefix(req.URL.Path, "/v1")
+	switch {
+	case path == "/_ping":
+		w.Write([]byte("true"))
+	case strings.HasPrefix(path, "/images/"):
+		parts := strings.Split(strings.TrimPrefix(path, "/images/"), "/")
+		if len(parts) != 2 || !registryIDPattern.MatchString(parts[0]) {
+			http.NotFound(w, req)
+			return
+		}
+		r.serveImage(w, req, parts[0], parts[1])
+	case strings.HasPrefix(path, "/repositories/"):
+		r.serveRepo(w, req, strings.TrimPrefix(path, "/repositories/"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *Registry) imagePath(id, name string) string {
+	return filepath.Join(r.Dir, "images", id, name)
+}
+
+func (r *Registry) serveImage(w http.ResponseWriter, req *http.Request, id, action string) {
+	switch {
+	case action == "json" && req.Method == "GET":
+		// images are only complete once their layer has been uploaded
+		info, err := os.Stat(r.imagePath(id, "layer"))
+		if err != nil {
+			cacheMiss("registry")
+			registryError(w, "image not found", 404)
+			return
+		}
+		data, err := ioutil.ReadFile(r.imagePath(id, "json"))
+		if err != nil {
+			registryError(w, "image not found", 404)
+			return
+		}
+		w.Header().Set("X-Docker-Size", strconv.FormatInt(info.Size(), 10))
+		if sum, err := ioutil.ReadFile(r.imagePath(id, "checksum")); err == nil {
+			w.Header().Set("X-Docker-Checksum", string(sum))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	case action == "json" && req.Method == "PUT":
+		if err := os.MkdirAll(filepath.Join(r.Dir, "images", id), 0755); err != nil {
+			registryError(w, err.Error(), 500)
+			return
+		}
+		os.Remove(r.imagePath(id, "layer"))
+		if err := writeBody(r.imagePath(id, "json"), req.Body); err != nil {
+			registryError(w, err.Error(), 500)
+			return
+		}
+		w.WriteHeader(200)
+	case action == "layer" && req.Method == "GET":
+		cw := &countingWriter{ResponseWriter: w}
+		http.ServeFile(cw, req, r.imagePath(id, "layer"))
+		cacheHit("registry", cw.n)
+	case action == "layer" && req.Method == "PUT":
+		if _, err := os.Stat(r.imagePath(id, "json")); err != nil {
+			registryError(w, "image json must be uploaded first", 404)
+			return
+		}
+		if err := writeBody(r.imagePath(id, "layer"), req.Body); err != nil {
+			registryError(w, err.Error(), 500)
+			return
+		}
+		w.WriteHeader(200)
+	case action == "checksum" && req.Method == "PUT":
+		sum := req.Header.Get("X-Docker-Checksum-Payload")
+		if sum == "" {
+			sum = req.Header.Get("X-Docker-Checksum")
+		}
+		if err := ioutil.WriteFile(r.imagePath(id, "checksum"), []byte(sum), 0644); err != nil {
+			registryError(w, err.Error(), 500)
+			return
+		}
+		w.WriteHeader(200)
+	case action == "ancestry" && req.Method == "GET":
+		ancestry, err := r.ancestry(id)
+		if err != nil {
+			registryError(w, err.Error(), 404)
+			return
+		}
+		writeJSON(w, ancestry)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// ancestry returns the IDs of id and its parents, in that order.
+func (r *Registry) ancestry(id string) ([]string, error) {
+	var ids []string
+	for id != "" {
+		data, err := ioutil.ReadFile(r.imagePath(id, "json"))
+		if err != nil {
+			return nil, fmt.Errorf("image %s not found", id)
+		}
+		ids = append(ids, id)
+		var img struct {
+			Parent string `json:"parent"`
+		}
+		if err := json.Unmarshal(data, &img); err != nil {
+			return nil, err
+		}
+		if img.Parent != "" && !registryIDPattern.MatchString(img.Parent) {
+			return nil, fmt.Errorf("image %s has an invalid parent", id)
+		}
+		id = img.Parent
+	}
+	return ids, nil
+}
+
+func (r *Registry) serveRepo(w http.ResponseWriter, req *http.Request, path string) {
+	var repo, tag, action string
+	switch {
+	case strings.Contains(path, "/tags/"):
+		i := strings.LastIndex(path, "/tags/")
+		repo, tag, action = path[:i], path[i+len("/tags/"):], "tag"
+	case strings.HasSuffix(path, "/tags"):
+		repo, action = strings.TrimSuffix(path, "/tags"), "tags"
+	case strings.HasSuffix(path, "/images"):
+		repo, action = strings.TrimSuffix(path, "/images"), "images"
+	case strings.HasSuffix(path, "/"):
+		repo, action = strings.TrimSuffix(path, "/"), "index"
+	}
+	if !registryRepoPattern.MatchString(repo) || (action == "tag" && !registryTagPattern.MatchString(tag)) {
+		http.NotFound(w, req)
+		return
+	}
+
+	switch {
+	case action == "index" && req.Method == "PUT", action == "images" && req.Method == "GET":
+		// the registry acts as its own index
+		w.Header().Set("X-Docker-Endpoints", req.Host)
+		w.Header().Set("X-Docker-Token", fmt.Sprintf(`Token signature=ephemeral,repository="%s",access=write`, repo))
+		if req.Method == "PUT" {
+			writeJSON(w, "")
+			return
+		}
+		tags, err := r.tags(repo)
+		if err != nil {
+			registryError(w, "repository not found", 404)
+			return
+		}
+		seen := make(map[string]bool)
+		images := []map[string]string{}
+		for _, id := range tags {
+			ancestry, err := r.ancestry(id)
+			if err != nil {
+				continue
+			}
+			for _, id := range ancestry {
+				if !seen[id] {
+					seen[id] = true
+					images = append(images, map[string]string{"id": id})
+				}
+			}
+		}
+		writeJSON(w, images)
+	case action == "images" && req.Method == "PUT":
+		w.WriteHeader(204)
+	case action == "tags" && req.Method == "GET":
+		tags, err := r.tags(repo)
+		if err != nil {
+			registryError(w, "repository not found", 404)
+			return
+		}
+		writeJSON(w, tags)
+	case action == "tag" && req.Method == "GET":
+		tags, err := r.tags(repo)
+		if err != nil || tags[tag] == "" {
+			registryError(w, "tag not found", 404)
+			return
+		}
+		writeJSON(w, tags[tag])
+	case action == "tag" && req.Method == "PUT":
+		var id string
+		if err := json.NewDecoder(req.Body).Decode(&id); err != nil || !registryIDPattern.MatchString(id) {
+			registryError(w, "invalid image id", 400)
+			return
+		}
+		if err := r.setTag(repo, tag, id); err != nil {
+			registryError(w, err.Error(), 500)
+			return
+		}
+		writeJSON(w, "")
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *Registry) tagsPath(repo string) string {
+	return filepath.Join(r.Dir, "repositories", filepath.FromSlash(repo), "tags.json")
+}
+
+func (r *Registry) tags(repo string) (map[string]string, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.readTags(repo)
+}
+
+func (r *Registry) readTags(repo string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(r.tagsPath(repo))
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	return tags, json.Unmarshal(data, &tags)
+}
+
+func (r *Registry) setTag(repo, tag, id string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	tags, err := r.readTags(repo)
+	if os.IsNotExist(err) {
+		tags = make(map[string]string)
+	} else if err != nil {
+		return err
+	}
+	tags[tag] = id
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	path := r.tagsPath(repo)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if len(r.Labels) > 0 {
+		if err := r.Labels.writeFile(filepath.Dir(path)); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// writeBody saves body to path, through a temp file so partial uploads are
+// never visible.
+func writeBody(path string, body io.Reader) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func registryError(w http.ResponseWriter, msg string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+var pushScript = template.Must(template.New("push").Parse(`
+set -e
+sudo start docker || true
+until sudo docker version >/dev/null 2>&1; do sleep 1; done
+for image in $(sudo docker images | awk 'NR > 1 && $1 ~ /^flynn\// && $2 != "<none>" { print $1 ":" $2 }'); do
+  sudo docker tag "${image}" "{{ . }}/${image}"
+  sudo docker push "{{ . }}/${image%:*}"
+done
+sudo stop docker
+`[1:]))
+
+var pullScript = template.Must(template.New("pull").Parse(`
+set -e
+until sudo docker version >/dev/null 2>&1; do sleep 1; done
+{{- range .Images }}
+sudo docker pull "{{ $.Addr }}/{{ . }}"
+sudo docker tag "{{ $.Addr }}/{{ . }}" "{{ . }}"
+{{- end }}
+`[1:]))
+
+// pushImages pushes the flynn images built on inst to the run's registry.
+func (c *Cluster) pushImages(inst Instance, out io.Writer) error {
+	var b bytes.Buffer
+	if err := pushScript.Execute(&b, c.registry.Addr().String()); err != nil {
+		return err
+	}
+	if err := inst.Run(b.String(), attempts, out, out); err != nil {
+		return fmt.Errorf("error pushing images to the registry: %s", err)
+	}
+	return nil
+}
+
+// pullImages pulls images from the run's registry into inst.
+func (c *Cluster) pullImages(inst Instance, images []string) error {
+	var b bytes.Buffer
+	if err := pullScript.Execute(&b, map[string]interface{}{
+		"Addr":   c.registry.Addr().String(),
+		"Images": images,
+	}); err != nil {
+		return err
+	}
+	return inst.Run(b.String(), attempts, c.out, c.out)
+}
@@ -0,0 +1,431 @@
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/go.crypto/ssh"
+	"github.com/flynn/flynn-test/util"
+)
+
+// RemoteBackend runs the QEMU of instances on another machine over SSH, so
+// that the runner can live on a small VM while instances run on a lab box
+// with the CPUs and memory for them. The runner keeps one SSH connection to
+// the remote host, runs qemu, qemu-img and ip on it with sudo over that
+// connection, and tunnels the QMP connections of instances and SSH
+// connections to them through it.
+//
+// The cluster bridge is extended to a bridge on the remote host over VXLAN,
+// so that instances are still served DHCP, DNS, netboot and syslog and are
+// NATed by the runner's host, and the remote bridge is given a reserved IP
+// of the cluster subnet so that the remote host can reach instances. The
+// network between the hosts must carry frames 50 bytes larger than the
+// cluster MTU.
+//
+// Drive images, kernels and initrds must be at the same paths on the remote
+// host, such as on a shared NFS mount, and copy-on-write layers are created
+// in the run's dir under RemoteDir, so layers which outlive their instance,
+// such as the built docker fs, are only kept until the cluster shuts down.
+// The netfs of an instance is copied to the remote host when it
+// starts, so IPs reserved after that don't reach it. Macvtap, confinement,
+// devices, huge pages and cpusets aren't supported.
+//
+// Instances are placed across the remote hosts according to placement, see
+// BootConfig.Placement.
+type RemoteBackend struct {
+	*VMManager
+	hosts     []*remoteHost
+	placement string
+
+	mtx sync.Mutex
+}
+
+// remoteHost is the machine of a RemoteBackend.
+type remoteHost struct {
+	*externalHost
+	out io.Writer
+
+	// dir is the dir of the run's instance files on the host, and bridge
+	// and vxlan name the host's end of the cluster network, the VXLAN
+	// interface having the same name on both hosts.
+	dir    string
+	bridge string
+	vxlan  string
+
+	mtx    sync.Mutex
+	client *ssh.Client
+
+	// instances counts the instances of the run on the host, see
+	// RemoteBackend.place.
+	instances int32
+}
+
+const (
+	// DefaultRemoteDir is the dir the instance files of runs are kept in on
+	// remote hosts whose BootConfig doesn't set RemoteDir.
+	DefaultRemoteDir = "/tmp/flynn-test"
+
+	// vxlanPort is the UDP port of the VXLAN tunnel between the hosts.
+	vxlanPort = 4789
+)
+
+// newRemoteHost connects to the host at url, given as
+// ssh://user@host[:port], and extends bridge to it over VXLAN, giving the
+// host's end bridgeIP.
+func newRemoteHost(url, dir string, bc *BootConfig, bridge *Bridge, bridgeIP net.IP, r *rand.Rand, out io.Writer) (*remoteHost, error) {
+	if bc.SSHKey == "" {
+		return nil, errors.New("cluster: an ssh key is required to reach the remote host")
+	}
+	data, err := ioutil.ReadFile(bc.SSHKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not read ssh key: %s", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse ssh key %s: %s", bc.SSHKey, err)
+	}
+	ext, err := newExternalHost(url, bc.SSHUser, signer, out)
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		dir = DefaultRemoteDir
+	}
+	h := &remoteHost{externalHost: ext, out: out, dir: path.Join(dir, bc.RunID)}
+	if h.client, err = ext.DialSSH(); err != nil {
+		return nil, fmt.Errorf("cluster: could not connect to remote host %s: %s", ext.addr, err)
+	}
+	if h.bridge, err = ifaceName(bc.BridgePrefix, DefaultBridgePrefix, r); err != nil {
+		h.client.Close()
+		return nil, fmt.Errorf("cluster: %s", err)
+	}
+	if h.vxlan, err = ifaceName("", "flynnvx", r); err != nil {
+		h.client.Close()
+		return nil, fmt.Errorf("cluster: %s", err)
+	}
+	if err := h.connect(bridge, bridgeIP, 1+r.Intn(1<<24-1)); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// connect creates the host's bridge and the VXLAN interfaces joining it to
+// the local bridge.
+func (h *remoteHost) connect(bridge *Bridge, bridgeIP net.IP, vni int) error {
+	// the address the remote host sees the runner's VXLAN packets from is
+	// that of the route to it
+	conn, err := net.Dial("udp", net.JoinHostPort(h.ip, strconv.Itoa(vxlanPort)))
+	if err != nil {
+		return fmt.Errorf("cluster: could not find route to remote host: %s", err)
+	}
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP.String()
+	conn.Close()
+
+	fmt.Fprintf(h.out, "extending network bridge %s to %s as %s over VXLAN %d\n", bridge.name, h.addr, h.bridge, vni)
+	id, port := strconv.Itoa(vni), strconv.Itoa(vxlanPort)
+	ones, _ := bridge.ipNet.Mask.Size()
+	mtu := []string{}
+	if bridge.mtu > 0 {
+		mtu = []string{"mtu", strconv.Itoa(bridge.mtu)}
+	}
+	for _, args := range [][]string{
+		{"mkdir", "-p", h.dir},
+		{"ip", "link", "add", h.bridge, "type", "bridge"},
+		append([]string{"ip", "link", "add", h.vxlan}, append(mtu, "type", "vxlan", "id", id, "remote", localIP, "dstport", port)...),
+		{"ip", "link", "set", h.vxlan, "master", h.bridge, "up"},
+		{"ip", "addr", "add", fmt.Sprintf("%s/%d", bridgeIP, ones), "dev", h.bridge},
+		{"ip", "link", "set", h.bridge, "up"},
+	} {
+		if err := h.sudo(args...); err != nil {
+			return err
+		}
+	}
+	local := append([]string{"link", "add", h.vxlan}, append(mtu, "type", "vxlan", "id", id, "remote", h.ip, "dstport", port)...)
+	for _, args := range [][]string{local, {"link", "set", h.vxlan, "master", bridge.name, "up"}} {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("cluster: ip %s failed: %s: %s", strings.Join(args, " "), err, out)
+		}
+	}
+	return nil
+}
+
+// command runs args on the host, returning their combined output.
+func (h *remoteHost) command(args ...string) ([]byte, error) {
+	sess, err := h.client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("cluster: could not start session on %s: %s", h.addr, err)
+	}
+	defer sess.Close()
+	return sess.CombinedOutput(shellCommand(args))
+}
+
+// sudo runs args as root on the host.
+func (h *remoteHost) sudo(args ...string) error {
+	if out, err := h.command(append([]string{"sudo", "-n"}, args...)...); err != nil {
+		return fmt.Errorf("cluster: %s on %s failed: %s: %s", strings.Join(args, " "), h.addr, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func shellCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// upload copies the local dir src to dst on the host as a tar stream.
+func (h *remoteHost) upload(src, dst string) error {
+	sess, err := h.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	tar := exec.Command("tar", "-C", src, "-c", ".")
+	if sess.Stdin, err = tar.StdoutPipe(); err != nil {
+		return err
+	}
+	if err := tar.Start(); err != nil {
+		return err
+	}
+	out, err := sess.CombinedOutput(shellCommand([]string{"sudo", "-n", "sh", "-c", `mkdir -p "$1" && tar -C "$1" -x`, "sh", dst}))
+	if werr := tar.Wait(); err == nil && werr != nil {
+		err = werr
+	}
+	if err != nil {
+		return fmt.Errorf("cluster: could not copy %s to %s:%s: %s: %s", src, h.addr, dst, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// dialGuest connects to the SSH server of an instance through the host.
+func (h *remoteHost) dialGuest(addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := h.client.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// dialQMP connects to the QMP server of an instance listening on port of
+// the host's loopback interface, retrying while QEMU starts.
+func (h *remoteHost) dialQMP(port int, onEvent func(string)) (*qmpClient, error) {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	var conn net.Conn
+	if err := qmpAttempts.Run(func() (err error) {
+		conn, err = h.client.Dial("tcp", addr)
+		return
+	}); err != nil {
+		return nil, fmt.Errorf("qmp: %s", err)
+	}
+	return newQMPClient(conn, onEvent)
+}
+
+// Close removes the run's instance files and network from the host, and
+// the local end of the VXLAN tunnel.
+func (h *remoteHost) Close() {
+	if out, err := exec.Command("ip", "link", "delete", h.vxlan).CombinedOutput(); err != nil {
+		fmt.Fprintf(h.out, "could not delete VXLAN interface %s: %s: %s\n", h.vxlan, err, bytes.TrimSpace(out))
+	}
+	for _, args := range [][]string{
+		{"ip", "link", "delete", h.vxlan},
+		{"ip", "link", "delete", h.bridge},
+		{"rm", "-rf", h.dir},
+	} {
+		if err := h.sudo(args...); err != nil {
+			fmt.Fprintln(h.out, err)
+		}
+	}
+	h.client.Close()
+}
+
+func (b *RemoteBackend) NewInstance(c *VMConfig) (Instance, error) {
+	if len(c.Devices) > 0 || c.HugePages || c.CPUSet != "" {
+		return nil, errors.New("cluster: devices, huge pages and cpusets are not supported by the remote backend")
+	}
+	if b.Macvtap != "" || b.Confine {
+		return nil, errors.New("cluster: macvtap and confinement are not supported by the remote backend")
+	}
+	v, err := b.newVM(c)
+	if err != nil {
+		return nil, err
+	}
+	if v.host, err = b.place(); err != nil {
+		return nil, err
+	}
+	v.placed = true
+	return v, nil
+}
+
+// place chooses the host of a new instance according to the placement of
+// the backend, counting the instance towards the host.
+func (b *RemoteBackend) place() (*remoteHost, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	var h *remoteHost
+	if b.placement == "colocate" {
+		h = b.hosts[0]
+	} else {
+		// the host running the fewest instances of the run
+		for _, candidate := range b.hosts {
+			if h == nil || atomic.LoadInt32(&candidate.instances) < atomic.LoadInt32(&h.instances) {
+				h = candidate
+			}
+		}
+		if b.placement == "spread" && atomic.LoadInt32(&h.instances) > 0 {
+			return nil, fmt.Errorf("cluster: can't spread more than %d instances across the remote hosts", len(b.hosts))
+		}
+	}
+	atomic.AddInt32(&h.instances, 1)
+	return h, nil
+}
+
+// startRemote starts QEMU on the remote host, attached to a remote tap
+// named like the instance's local one, which holds its IP.
+func (v *vm) startRemote() error {
+	h := v.host
+	v.remoteDir = path.Join(h.dir, filepath.Base(v.dir))
+	netFS := path.Join(v.remoteDir, "netfs")
+	if err := h.upload(v.netFS, netFS); err != nil {
+		return err
+	}
+	v.netFS = netFS
+	link := []string{"ip", "link", "set", v.tap.Name, "master", h.bridge}
+	if mtu := v.tap.bridge.mtu; mtu > 0 {
+		link = append(link, "mtu", strconv.Itoa(mtu))
+	}
+	for _, args := range [][]string{
+		{"ip", "tuntap", "add", "dev", v.tap.Name, "mode", "tap", "user", strconv.Itoa(v.User)},
+		append(link, "up"),
+	} {
+		if err := h.sudo(args...); err != nil {
+			return err
+		}
+	}
+	// QMP listens on the remote loopback interface rather than a unix
+	// socket, as it is reached through the SSH connection
+	port := 20000 + rand.Intn(20000)
+	if err := v.qemuArgs(fmt.Sprintf("tcp:127.0.0.1:%d,server,nowait", port)); err != nil {
+		return err
+	}
+	sess, err := h.client.NewSession()
+	if err != nil {
+		return err
+	}
+	sess.Stdout = v.console
+	sess.Stderr = v.console
+	// the pid of the sudo running QEMU is written to kill it with
+	command := append([]string{
+		"sudo", "-n", "sh", "-c", `echo $$ > "$1" && shift && exec "$@"`, "sh", path.Join(v.remoteDir, "qemu.pid"),
+		"sudo", "-u", fmt.Sprintf("#%d", v.User), "-g", fmt.Sprintf("#%d", v.Group), "-H", v.bootProfile().qemu(),
+	}, v.Args...)
+	if err := sess.Start(shellCommand(command)); err != nil {
+		sess.Close()
+		return err
+	}
+	v.started = time.Now()
+	recordEvent(v.runID, "host", "started instance "+v.ID+" on "+h.addr)
+	v.exited = make(chan struct{})
+	go func() {
+		v.exitErr = sess.Wait()
+		sess.Close()
+		v.console.close()
+		close(v.exited)
+	}()
+	go func() {
+		qmp, err := h.dialQMP(port, func(event string) {
+			if event == "GUEST_PANICKED" {
+				v.handlePanic()
+			}
+		})
+		if err != nil {
+			fmt.Fprintf(v.Out, "could not connect to QMP of %s on %s: %s\n", v.ID, h.addr, err)
+			return
+		}
+		v.panicMtx.Lock()
+		v.qmp = qmp
+		v.panicMtx.Unlock()
+	}()
+	return nil
+}
+
+// killRemote signals the sudo running QEMU, which relays the signal to it.
+func (v *vm) killRemote() error {
+	kill := func(sig string) error {
+		return v.host.sudo("sh", "-c", `kill -`+sig+` "$(cat "$1")"`, "sh", path.Join(v.remoteDir, "qemu.pid"))
+	}
+	if err := kill("TERM"); err != nil {
+		return err
+	}
+	select {
+	case <-v.exited:
+		return v.exitErr
+	case <-time.After(5 * time.Second):
+		return kill("KILL")
+	}
+}
+
+// createRemoteCOW creates a copy-on-write layer of image on the remote
+// host, in the instance's dir if it is temp and otherwise in the run's.
+func (v *vm) createRemoteCOW(image string, temp bool, size int64) (string, error) {
+	dir := v.host.dir
+	if temp {
+		dir = v.remoteDir
+	}
+	name := strings.TrimSuffix(filepath.Base(image), filepath.Ext(image))
+	fs := path.Join(dir, name+"-"+util.RandomString(8)+".img")
+	if err := v.host.sudo("mkdir", "-p", dir); err != nil {
+		return "", err
+	}
+	cmdArgs := []string{"qemu-img", "create", "-f", "qcow2", "-b", image, fs}
+	if size > 0 {
+		cmdArgs = append(cmdArgs, strconv.FormatInt(size, 10))
+	}
+	if err := v.host.sudo(cmdArgs...); err != nil {
+		return "", fmt.Errorf("failed to create COW filesystem: %s", err)
+	}
+	if err := v.host.sudo("chown", fmt.Sprintf("%d:%d", v.User, v.Group), fs); err != nil {
+		return "", err
+	}
+	return fs, nil
+}
+
+// cleanupRemote removes the instance's tap and files from the remote host.
+func (v *vm) cleanupRemote() {
+	if v.placed {
+		atomic.AddInt32(&v.host.instances, -1)
+		v.placed = false
+	}
+	if v.remoteDir == "" {
+		return
+	}
+	for _, args := range [][]string{
+		{"ip", "link", "delete", v.tap.Name},
+		{"rm", "-rf", v.remoteDir},
+	} {
+		if err := v.host.sudo(args...); err != nil {
+			fmt.Println(err)
+		}
+	}
+	v.remoteDir = ""
+}
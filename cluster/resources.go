@@ -0,0 +1,137 @@
+package cluster
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ResourcePool limits the instances run on the host by the VMManagers which
+// share it, so that concurrent runs can't boot more VMs than the host has
+// memory for. A zero limit is unlimited.
+type ResourcePool struct {
+	// MaxVMs limits the number of instances, and Memory their total
+	// memory in MB.
+	MaxVMs int
+	Memory int
+
+	// Cores is passed to QEMU as -smp for instances whose config doesn't
+	// set cores.
+	Cores int
+
+	// Wait makes NewInstance block until resources are released when the
+	// pool is exhausted, rather than returning an error.
+	Wait bool
+
+	mtx   sync.Mutex
+	freed *sync.Cond
+	used  Utilization
+}
+
+// Utilization is the resources of a pool used by running instances.
+type Utilization struct {
+	VMs       int `json:"vms"`
+	MaxVMs    int `json:"max_vms,omitempty"`
+	Memory    int `json:"memory"`
+	MaxMemory int `json:"max_memory,omitempty"`
+	Cores     int `json:"cores"`
+}
+
+// Full returns whether an instance with memory MB would exceed the limits.
+func (u Utilization) Full(memory int) bool {
+	return u.MaxVMs > 0 && u.VMs >= u.MaxVMs || u.MaxMemory > 0 && u.Memory+memory > u.MaxMemory
+}
+
+// defaultMemory is the memory of instances which don't set it, QEMU's
+// default.
+const defaultMemory = 128
+
+// parseMemory parses the memory of a VMConfig, in MB unless it has a QEMU
+// size suffix.
+func parseMemory(s string) (int, error) {
+	if s == "" {
+		return defaultMemory, nil
+	}
+	mult, suffix := 1, strings.ToUpper(s[len(s)-1:])
+	switch suffix {
+	case "M":
+	case "G":
+		mult = 1024
+	case "T":
+		mult = 1024 * 1024
+	default:
+		suffix = ""
+	}
+	n, err := strconv.Atoi(s[:len(s)-len(suffix)])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid memory %q", s)
+	}
+	return n * mult, nil
+}
+
+// Utilization returns the resources used by running instances.
+func (p *ResourcePool) Utilization() Utilization {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.utilization()
+}
+
+func (p *ResourcePool) utilization() Utilization {
+	u := p.used
+	u.MaxVMs, u.MaxMemory = p.MaxVMs, p.Memory
+	return u
+}
+
+// acquire reserves the resources of an instance with config c, setting its
+// cores if it has none.
+func (p *ResourcePool) acquire(c *VMConfig) (*reservation, error) {
+	memory, err := parseMemory(c.Memory)
+	if err != nil {
+		return nil, err
+	}
+	if c.Cores <= 0 && p.Cores > 0 {
+		c.Cores = p.Cores
+	}
+	cores := c.Cores
+	if cores <= 0 {
+		cores = 1
+	}
+	if p.Memory > 0 && memory > p.Memory {
+		return nil, fmt.Errorf("cluster: instance memory of %dMB exceeds the host budget of %dMB", memory, p.Memory)
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.freed == nil {
+		p.freed = sync.NewCond(&p.mtx)
+	}
+	for p.utilization().Full(memory) {
+		if !p.Wait {
+			return nil, fmt.Errorf("cluster: host resources exhausted, %d VMs using %dMB are running", p.used.VMs, p.used.Memory)
+		}
+		p.freed.Wait()
+	}
+	p.used.VMs++
+	p.used.Memory += memory
+	p.used.Cores += cores
+	return &reservation{pool: p, memory: memory, cores: cores}, nil
+}
+
+// reservation is the resources held by an instance until it is cleaned up.
+type reservation struct {
+	pool   *ResourcePool
+	memory int
+	cores  int
+}
+
+func (r *reservation) release() {
+	p := r.pool
+	p.mtx.Lock()
+	p.used.VMs--
+	p.used.Memory -= r.memory
+	p.used.Cores -= r.cores
+	if p.freed != nil {
+		p.freed.Broadcast()
+	}
+	p.mtx.Unlock()
+}
@@ -0,0 +1,62 @@
+package cluster
+
+import "fmt"
+
+// BootstrapSnapshot is the name of the snapshot set taken of a cluster once
+// it is bootstrapped, which destructive tests restore.
+const BootstrapSnapshot = "bootstrapped"
+
+// Snapshot saves the disks and memory of every instance of the cluster as
+// name. The instances are paused until every snapshot is saved so that the
+// set is consistent.
+func (c *Cluster) Snapshot(name string) error {
+	c.event("saving snapshot %s", name)
+	resume, err := c.pause()
+	defer resume()
+	if err != nil {
+		return err
+	}
+	for i, inst := range c.instances {
+		if err := inst.Snapshot(name); err != nil {
+			return fmt.Errorf("cluster: could not snapshot instance %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// Restore reverts every instance of the cluster to the snapshot set name,
+// then syncs the guest clocks, which are restored with the snapshot, to the
+// host.
+func (c *Cluster) Restore(name string) error {
+	c.event("restoring snapshot %s", name)
+	resume, err := c.pause()
+	if err != nil {
+		resume()
+		return err
+	}
+	for i, inst := range c.instances {
+		if err := inst.RestoreSnapshot(name); err != nil {
+			resume()
+			return fmt.Errorf("cluster: could not restore instance %d: %s", i, err)
+		}
+	}
+	resume()
+	return c.Run("sudo hwclock --hctosys")
+}
+
+// pause pauses every instance, returning a func resuming those it paused.
+func (c *Cluster) pause() (func(), error) {
+	var paused []Instance
+	resume := func() {
+		for _, inst := range paused {
+			inst.Resume()
+		}
+	}
+	for i, inst := range c.instances {
+		if err := inst.Pause(); err != nil {
+			return resume, fmt.Errorf("cluster: could not pause instance %d: %s", i, err)
+		}
+		paused = append(paused, inst)
+	}
+	return resume, nil
+}
@@ -0,0 +1,68 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// guestSrcDir is where the build script checks repos out on build instances.
+const guestSrcDir = "/var/lib/docker/flynn/go/src/github.com/flynn"
+
+// SourceFetcher puts the source of a repo in dir on a build instance, in
+// place of the build script cloning it from git, so that source which isn't
+// in git, such as uncommitted work, can be built.
+type SourceFetcher interface {
+	Fetch(inst Instance, dir string, out io.Writer) error
+}
+
+// NewSourceFetcher returns a fetcher of the local directory or gzipped
+// tarball at path.
+func NewSourceFetcher(path string) (SourceFetcher, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return DirSource(path), nil
+	}
+	return TarballSource(path), nil
+}
+
+// TarballSource is the path of a gzipped tarball of a repo, with the root of
+// the repo at the root of the tarball.
+type TarballSource string
+
+func (s TarballSource) Fetch(inst Instance, dir string, out io.Writer) error {
+	return extractSource(inst, string(s), dir, out)
+}
+
+// DirSource is the path of a local checkout of a repo, which is copied as
+// it is, uncommitted changes included, leaving out the .git dir.
+type DirSource string
+
+func (s DirSource) Fetch(inst Instance, dir string, out io.Writer) error {
+	f, err := ioutil.TempFile("", "source-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	cmd := exec.Command("tar", "-czf", f.Name(), "--exclude=.git", "-C", string(s), ".")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("could not archive %s: %s: %s", s, err, output)
+	}
+	return extractSource(inst, f.Name(), dir, out)
+}
+
+// extractSource uploads tarball to inst and replaces dir with its contents.
+func extractSource(inst Instance, tarball, dir string, out io.Writer) error {
+	if err := inst.Upload(tarball, "/tmp/source.tar.gz"); err != nil {
+		return err
+	}
+	d := shellQuote(dir)
+	script := fmt.Sprintf("set -e\nsudo rm -rf %s\nsudo mkdir -p %s\nsudo tar -xzf /tmp/source.tar.gz -C %s\nsudo chown -R ubuntu:ubuntu %s\nrm /tmp/source.tar.gz\n", d, d, d, d)
+	return inst.Run(script, attempts, out, out)
+}
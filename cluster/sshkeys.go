@@ -0,0 +1,116 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"code.google.com/p/go.crypto/ssh"
+)
+
+// sshKeys are generated for each run. The client key is authorized for the
+// ubuntu user and the host key installed as the guest's SSH host key, both
+// through the instance's netfs, so the host key of instances can be verified.
+type sshKeys struct {
+	client     ssh.Signer
+	clientPub  []byte
+	host       *rsa.PrivateKey
+	hostPublic ssh.PublicKey
+
+	// user is who the client key is authorized for, and extra are signers
+	// of the configured SSHKey.
+	user  string
+	extra []ssh.Signer
+}
+
+func generateSSHKeys() (*sshKeys, error) {
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	client, err := ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	hostPublic, err := ssh.NewPublicKey(&hostKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sshKeys{
+		client:     client,
+		clientPub:  ssh.MarshalAuthorizedKey(client.PublicKey()),
+		host:       hostKey,
+		hostPublic: hostPublic,
+		user:       "ubuntu",
+	}, nil
+}
+
+// sshKeys returns the keys of the manager's run, generating them the first
+// time.
+func (v *VMManager) sshKeys() (*sshKeys, error) {
+	v.keysMtx.Lock()
+	defer v.keysMtx.Unlock()
+	if v.keys == nil {
+		keys, err := generateSSHKeys()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate ssh keys: %s", err)
+		}
+		if v.SSHUser != "" {
+			keys.user = v.SSHUser
+		}
+		if v.SSHKey != "" {
+			data, err := ioutil.ReadFile(v.SSHKey)
+			if err != nil {
+				return nil, fmt.Errorf("could not read ssh key: %s", err)
+			}
+			signer, err := ssh.ParsePrivateKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse ssh key %s: %s", v.SSHKey, err)
+			}
+			keys.extra = append(keys.extra, signer)
+		}
+		v.keys = keys
+	}
+	return v.keys, nil
+}
+
+// write saves the authorized key and host key to the ssh dir of the netfs,
+// from which the guest installs them on boot. They are kept out of the netfs
+// root as it is the guest's interfaces.d.
+func (k *sshKeys) write(netfs string) error {
+	dir := filepath.Join(netfs, "ssh")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "authorized_keys"), k.clientPub, 0644); err != nil {
+		return err
+	}
+	hostPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k.host)})
+	// qemu runs as another user which needs to read the key to export it
+	return ioutil.WriteFile(filepath.Join(dir, "ssh_host_rsa_key"), hostPEM, 0644)
+}
+
+func (k *sshKeys) clientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User: k.user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(append([]ssh.Signer{k.client}, k.extra...)...)},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if !bytes.Equal(key.Marshal(), k.hostPublic.Marshal()) {
+				return errors.New("cluster: ssh host key mismatch for " + hostname)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,155 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsSample is a sample of the host resources used by an instance's QEMU
+// process: CPU as a percentage of one core since the previous sample, and
+// resident and swapped out memory in bytes. A guest stalled on a host which
+// is short of memory shows up as swap with little CPU.
+type StatsSample struct {
+	Time time.Time `json:"time"`
+	CPU  float64   `json:"cpu"`
+	RSS  int64     `json:"rss"`
+	Swap int64     `json:"swap"`
+}
+
+// statsInterval is how often instances are sampled, and statsSamples the
+// number of samples kept of each.
+const (
+	statsInterval = 5 * time.Second
+	statsSamples  = 120
+)
+
+// clockTicks is the kernel's USER_HZ, the unit of CPU times in /proc.
+const clockTicks = 100
+
+// sampleStats samples the QEMU process of v until it exits.
+func (v *vm) sampleStats() {
+	var pid string
+	var lastCPU int64
+	var lastTime time.Time
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-v.exited:
+			return
+		case <-ticker.C:
+		}
+		// QEMU is started by sudo, so find it by its tap
+		if pid == "" {
+			pids := qemuProcesses(v.tap.Name)
+			if len(pids) == 0 {
+				continue
+			}
+			pid = pids[0]
+			v.statsMtx.Lock()
+			v.pid = pid
+			v.statsMtx.Unlock()
+		}
+		cpu, err := processCPU(pid)
+		if err != nil {
+			continue
+		}
+		now := time.Now()
+		s := StatsSample{Time: now}
+		if !lastTime.IsZero() {
+			s.CPU = float64(cpu-lastCPU) / clockTicks / now.Sub(lastTime).Seconds() * 100
+		}
+		lastCPU, lastTime = cpu, now
+		s.RSS, s.Swap = processMemory(pid)
+		v.statsMtx.Lock()
+		if v.stats = append(v.stats, s); len(v.stats) > statsSamples {
+			v.stats = v.stats[len(v.stats)-statsSamples:]
+		}
+		v.statsMtx.Unlock()
+	}
+}
+
+func (v *vm) Stats() []StatsSample {
+	v.statsMtx.Lock()
+	defer v.statsMtx.Unlock()
+	return append([]StatsSample(nil), v.stats...)
+}
+
+// processCPU returns the user and system CPU time of a process in clock
+// ticks.
+func processCPU(pid string) (int64, error) {
+	data, err := ioutil.ReadFile("/proc/" + pid + "/stat")
+	if err != nil {
+		return 0, err
+	}
+	// the command name may contain spaces, so skip past it
+	if i := bytes.LastIndex(data, []byte(")")); i >= 0 {
+		data = data[i+1:]
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 13 {
+		return 0, os.ErrInvalid
+	}
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	return utime + stime, nil
+}
+
+// processMemory returns the resident and swapped out memory of a process in
+// bytes.
+func processMemory(pid string) (rss, swap int64) {
+	f, err := os.Open("/proc/" + pid + "/status")
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, _ := strconv.ParseInt(fields[1], 10, 64)
+		switch fields[0] {
+		case "VmRSS:":
+			rss = kb * 1024
+		case "VmSwap:":
+			swap = kb * 1024
+		}
+	}
+	return rss, swap
+}
+
+// Stats returns the latest samples of each instance, keyed by IP.
+func (c *Cluster) Stats() map[string][]StatsSample {
+	stats := make(map[string][]StatsSample, len(c.instances))
+	for _, inst := range c.instances {
+		stats[inst.IP()] = inst.Stats()
+	}
+	return stats
+}
+
+// RunStats returns the latest samples of the instances of the running
+// clusters booted with runID, keyed by IP, or nil if there are none.
+func RunStats(runID string) map[string][]StatsSample {
+	liveMtx.Lock()
+	defer liveMtx.Unlock()
+	var stats map[string][]StatsSample
+	for c := range liveClusters {
+		if c.bc.RunID != runID {
+			continue
+		}
+		if stats == nil {
+			stats = make(map[string][]StatsSample)
+		}
+		for ip, samples := range c.Stats() {
+			stats[ip] = samples
+		}
+	}
+	return stats
+}
@@ -0,0 +1,158 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyslogEntry is a syslog message forwarded by an instance.
+type SyslogEntry struct {
+	// Time is when the host received the entry, as guest clocks may be off.
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	Facility int       `json:"facility"`
+	Severity int       `json:"severity"`
+	Tag      string    `json:"tag"`
+	Message  string    `json:"message"`
+}
+
+// SyslogCollector receives the syslog of instances over TCP on a cluster
+// bridge, and appends the entries to a file as JSON lines tagged with the ID
+// of the instance which sent them.
+type SyslogCollector struct {
+	l net.Listener
+
+	mtx   sync.Mutex
+	hosts map[string]string
+	f     *os.File
+	enc   *json.Encoder
+}
+
+func NewSyslogCollector(bridge *Bridge, path string) (*SyslogCollector, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp4", bridge.IP()+":0")
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("syslog: could not listen: %s", err)
+	}
+	s := &SyslogCollector{
+		l:     l,
+		hosts: make(map[string]string),
+		f:     f,
+		enc:   json.NewEncoder(f),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *SyslogCollector) Addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *SyslogCollector) port() int {
+	return s.l.Addr().(*net.TCPAddr).Port
+}
+
+// AddHost tags entries received from ip with the instance id.
+func (s *SyslogCollector) AddHost(ip, id string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.hosts[ip] = id
+}
+
+// writeTarget saves the address of the collector to the syslog dir of an
+// instance's netfs, from which the guest configures rsyslog on boot.
+func (s *SyslogCollector) writeTarget(netfs string) error {
+	dir := filepath.Join(netfs, "syslog")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "target"), []byte(s.Addr()+"\n"), 0644)
+}
+
+func (s *SyslogCollector) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *SyslogCollector) handle(conn net.Conn) {
+	defer conn.Close()
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		e := parseSyslog(scanner.Text())
+		e.Time = time.Now()
+		s.mtx.Lock()
+		e.Instance = s.hosts[ip]
+		if e.Instance == "" {
+			e.Instance = ip
+		}
+		if s.enc != nil {
+			s.enc.Encode(e)
+		}
+		s.mtx.Unlock()
+	}
+}
+
+// parseSyslog parses a line in rsyslog's traditional forwarding format,
+// "<PRI>Mmm dd hh:mm:ss hostname tag: message", keeping the whole line as
+// the message if it isn't in that format.
+func parseSyslog(line string) *SyslogEntry {
+	e := &SyslogEntry{Message: line}
+	end := strings.Index(line, ">")
+	if !strings.HasPrefix(line, "<") || end < 0 {
+		return e
+	}
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil {
+		return e
+	}
+	e.Facility, e.Severity = pri/8, pri%8
+	// skip the timestamp and hostname
+	rest := line[end+1:]
+	if len(rest) < 16 {
+		e.Message = rest
+		return e
+	}
+	rest = rest[16:]
+	if i := strings.Index(rest, " "); i >= 0 {
+		rest = rest[i+1:]
+	}
+	e.Message = rest
+	if i := strings.Index(rest, ": "); i >= 0 && !strings.Contains(rest[:i], " ") {
+		e.Tag = rest[:i]
+		if j := strings.Index(e.Tag, "["); j >= 0 {
+			e.Tag = e.Tag[:j]
+		}
+		e.Message = rest[i+2:]
+	}
+	return e
+}
+
+func (s *SyslogCollector) Close() error {
+	s.l.Close()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.enc = nil
+	return s.f.Close()
+}
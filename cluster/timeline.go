@@ -0,0 +1,109 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TimelineEvent is a console line of an instance or an event on the host,
+// such as an injected fault, timestamped by the host so that the events of
+// all instances of a run can be interleaved.
+type TimelineEvent struct {
+	Time time.Time `json:"time"`
+
+	// Offset is the time since the run's first event, measured with the
+	// monotonic clock so it isn't affected by clock adjustments.
+	Offset time.Duration `json:"offset"`
+
+	// Source is "host" or the ID of the instance.
+	Source  string `json:"source"`
+	Message string `json:"message"`
+}
+
+// maxTimelineEvents limits the memory used by the timeline of a run with
+// noisy consoles, dropping later console lines but not host events.
+const maxTimelineEvents = 200000
+
+type timeline struct {
+	start   time.Time
+	events  []*TimelineEvent
+	dropped int
+}
+
+var (
+	timelineMtx sync.Mutex
+	timelines   = make(map[string]*timeline)
+)
+
+func recordEvent(runID, source, msg string) {
+	now := time.Now()
+	timelineMtx.Lock()
+	defer timelineMtx.Unlock()
+	t, ok := timelines[runID]
+	if !ok {
+		t = &timeline{start: now}
+		timelines[runID] = t
+	}
+	if len(t.events) >= maxTimelineEvents && source != "host" {
+		t.dropped++
+		return
+	}
+	t.events = append(t.events, &TimelineEvent{
+		Time:    now,
+		Offset:  now.Sub(t.start),
+		Source:  source,
+		Message: msg,
+	})
+}
+
+// RecordEvent adds a host event, such as a test starting, to the timeline of
+// runID.
+func RecordEvent(runID, format string, a ...interface{}) {
+	recordEvent(runID, "host", fmt.Sprintf(format, a...))
+}
+
+func (c *Cluster) event(format string, a ...interface{}) {
+	RecordEvent(c.bc.RunID, format, a...)
+}
+
+type eventsByOffset []*TimelineEvent
+
+func (e eventsByOffset) Len() int           { return len(e) }
+func (e eventsByOffset) Less(i, j int) bool { return e[i].Offset < e[j].Offset }
+func (e eventsByOffset) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// RunTimeline returns the events recorded for runID in order, and forgets
+// them.
+func RunTimeline(runID string) []*TimelineEvent {
+	timelineMtx.Lock()
+	t, ok := timelines[runID]
+	delete(timelines, runID)
+	timelineMtx.Unlock()
+	if !ok {
+		return nil
+	}
+	sort.Stable(eventsByOffset(t.events))
+	if t.dropped > 0 {
+		last := t.events[len(t.events)-1]
+		t.events = append(t.events, &TimelineEvent{
+			Time:    last.Time,
+			Offset:  last.Offset,
+			Source:  "host",
+			Message: fmt.Sprintf("%d console lines dropped from the timeline", t.dropped),
+		})
+	}
+	return t.events
+}
+
+// WriteTimeline writes events as lines of their offset, source and message.
+func WriteTimeline(w io.Writer, events []*TimelineEvent) error {
+	for _, e := range events {
+		if _, err := fmt.Fprintf(w, "+%10.3fs %-12s %s\n", e.Offset.Seconds(), e.Source, e.Message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// timeoutConsoleLines is the number of console lines kept with a
+// TimeoutError.
+const timeoutConsoleLines = 50
+
+// TimeoutError is returned when an instance doesn't finish a phase, one of
+// boot, ssh and build, in time, with its latest console output.
+type TimeoutError struct {
+	Phase    string
+	Instance string
+	Timeout  time.Duration
+	Console  []string
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s of %s timed out after %s", e.Phase, e.Instance, e.Timeout)
+}
+
+func (e *TimeoutError) write(out io.Writer) {
+	fmt.Fprintf(out, "%s, latest console output:\n", e)
+	for _, line := range e.Console {
+		fmt.Fprintln(out, line)
+	}
+}
+
+func (v *vm) timeoutError(phase string, timeout time.Duration) *TimeoutError {
+	recordEvent(v.runID, "host", fmt.Sprintf("%s of %s timed out after %s", phase, v.ID, timeout))
+	return &TimeoutError{Phase: phase, Instance: v.IP(), Timeout: timeout, Console: v.ConsoleTail(timeoutConsoleLines)}
+}
+
+// runWithTimeout runs fn, which runs phase on inst, killing inst if it
+// doesn't return within timeout, in which case a *TimeoutError is returned
+// and its console output written to the cluster's output.
+func (c *Cluster) runWithTimeout(inst Instance, phase string, timeout time.Duration, fn func() error) error {
+	if timeout <= 0 {
+		return fn()
+	}
+	fired := make(chan *TimeoutError, 1)
+	timer := time.AfterFunc(timeout, func() {
+		te := &TimeoutError{Phase: phase, Instance: inst.IP(), Timeout: timeout, Console: inst.ConsoleTail(timeoutConsoleLines)}
+		recordEvent(c.bc.RunID, "host", te.Error())
+		te.write(c.out)
+		inst.Kill()
+		fired <- te
+	})
+	err := fn()
+	if timer.Stop() {
+		return err
+	}
+	return <-fired
+}
@@ -0,0 +1,150 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Upload copies the local file to remotePath in the guest with the scp
+// protocol, keeping its mode.
+func (v *vm) Upload(localPath, remotePath string) error {
+	return upload(v, localPath, remotePath)
+}
+
+// Download copies the file at remotePath in the guest to localPath with the
+// scp protocol.
+func (v *vm) Download(remotePath, localPath string) error {
+	return download(v, remotePath, localPath)
+}
+
+func upload(inst Instance, localPath, remotePath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("cluster: cannot upload directory %s", localPath)
+	}
+	return scp(inst, "-t", remotePath, func(w io.Writer, r *bufio.Reader) error {
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "C%04o %d %s\n", info.Mode().Perm(), info.Size(), path.Base(remotePath))
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, f); err != nil {
+			return err
+		}
+		w.Write([]byte{0})
+		return scpAck(r)
+	})
+}
+
+func download(inst Instance, remotePath, localPath string) error {
+	return scp(inst, "-f", remotePath, func(w io.Writer, r *bufio.Reader) error {
+		w.Write([]byte{0})
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if len(line) > 0 && (line[0] == 1 || line[0] == 2) {
+			return fmt.Errorf("scp: %s", strings.TrimSpace(line[1:]))
+		}
+		// C<mode> <size> <name>
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+		if len(fields) != 3 || !strings.HasPrefix(fields[0], "C") {
+			return fmt.Errorf("scp: unexpected response %q, %s is not a file", line, remotePath)
+		}
+		mode, err := strconv.ParseUint(fields[0][1:], 8, 32)
+		if err != nil {
+			return fmt.Errorf("scp: invalid mode %q", fields[0])
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("scp: invalid size %q", fields[1])
+		}
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w.Write([]byte{0})
+		if _, err := io.CopyN(f, r, size); err != nil {
+			return err
+		}
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		w.Write([]byte{0})
+		return nil
+	})
+}
+
+// scp runs scp in the given mode on the guest, with fn speaking the protocol
+// over its stdin and stdout.
+func scp(inst Instance, mode, remotePath string, fn func(io.Writer, *bufio.Reader) error) error {
+	sc, err := inst.DialSSH()
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	sess, err := sc.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	w, err := sess.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := sess.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := sess.Start(fmt.Sprintf("scp %s %s", mode, shellQuote(remotePath))); err != nil {
+		return err
+	}
+	if err := fn(w, bufio.NewReader(out)); err != nil {
+		w.Close()
+		sess.Wait()
+		return fmt.Errorf("cluster: could not copy %s on %s: %s", remotePath, inst.IP(), err)
+	}
+	w.Close()
+	if err := sess.Wait(); err != nil {
+		return fmt.Errorf("cluster: could not copy %s on %s: %s", remotePath, inst.IP(), err)
+	}
+	return nil
+}
+
+// scpAck reads the status byte scp responds to each message with, followed
+// by a message if it is a warning or an error.
+func scpAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := r.ReadString('\n')
+	if msg = strings.TrimSpace(msg); msg == "" {
+		return errors.New("scp: unknown error")
+	}
+	return fmt.Errorf("scp: %s", msg)
+}
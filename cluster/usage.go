@@ -0,0 +1,72 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Usage is the resources used by the instances of a run.
+type Usage struct {
+	VMHours     float64 `json:"vm_hours"`
+	DiskGBHours float64 `json:"disk_gb_hours"`
+	EgressBytes int64   `json:"egress_bytes"`
+}
+
+func (u *Usage) Add(o Usage) {
+	u.VMHours += o.VMHours
+	u.DiskGBHours += o.DiskGBHours
+	u.EgressBytes += o.EgressBytes
+}
+
+var (
+	usageMtx sync.Mutex
+	usage    = make(map[string]*Usage)
+)
+
+func recordUsage(runID string, u Usage) {
+	usageMtx.Lock()
+	defer usageMtx.Unlock()
+	total, ok := usage[runID]
+	if !ok {
+		total = &Usage{}
+		usage[runID] = total
+	}
+	total.Add(u)
+}
+
+// RunUsage returns the resources used by the instances booted with runID
+// which have stopped, and forgets them.
+func RunUsage(runID string) Usage {
+	usageMtx.Lock()
+	defer usageMtx.Unlock()
+	u, ok := usage[runID]
+	delete(usage, runID)
+	if !ok {
+		return Usage{}
+	}
+	return *u
+}
+
+// usage measures the resources used by v since it started. Disk usage is the
+// space allocated to its drives, so the shared backing images of COW drives
+// aren't counted, and egress is the traffic sent by the guest on its tap.
+func (v *vm) usage() Usage {
+	hours := time.Since(v.started).Hours()
+	var disk int64
+	for _, d := range v.Drives {
+		if info, err := os.Stat(d.FS); err == nil {
+			disk += info.Sys().(*syscall.Stat_t).Blocks * 512
+		}
+	}
+	u := Usage{VMHours: hours, DiskGBHours: float64(disk) / (1 << 30) * hours}
+	// the host receives what the guest sends
+	if data, err := ioutil.ReadFile("/sys/class/net/" + v.tap.Name + "/statistics/rx_bytes"); err == nil {
+		u.EgressBytes, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	return u
+}
@@ -0,0 +1,1378 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/util"
+)
+
+type Config struct {
+	// Flags sets the defaults of command line flags, such as "kernel",
+	// "rootfs" or "ssh-user", which flags given on the command line
+	// override.
+	Flags map[string]string `json:"flags"`
+
+	// DefaultProfile is used when a build doesn't select a profile.
+	DefaultProfile string              `json:"default_profile"`
+	Profiles       map[string]*Profile `json:"profiles"`
+
+	// Labels maps pull request labels to the profile they select.
+	Labels map[string]string `json:"labels"`
+
+	// LabelFeatures maps pull request labels to feature flags they set,
+	// on top of those of the profile.
+	LabelFeatures map[string]Features `json:"label_features"`
+
+	// Branches overrides which profiles are run for pushes and pull
+	// requests of matching branches.
+	Branches []*BranchOverride `json:"branches"`
+
+	Schedules []*Schedule `json:"schedules"`
+
+	// Roles overrides the default resources of instance roles.
+	Roles map[string]*cluster.Role `json:"roles"`
+
+	// BootProfiles adds boot profiles of guest OSes which roles may boot,
+	// see cluster.BootProfile.
+	BootProfiles map[string]*cluster.BootProfile `json:"boot_profiles"`
+
+	// Kernels is a catalog of kernels which profiles may boot their
+	// clusters with instead of the runner's, keyed by name.
+	Kernels map[string]*KernelImage `json:"kernels"`
+
+	// SSHAgent forwards the runner's ssh-agent into the build instance, and
+	// DeployKey is the path of a private key installed in it, for cloning
+	// private repos.
+	SSHAgent  bool   `json:"ssh_agent"`
+	DeployKey string `json:"deploy_key"`
+
+	// Downloads and PinnedImages are fetched and verified by the build
+	// script before repos are built.
+	Downloads    []*cluster.Download `json:"downloads"`
+	PinnedImages []string            `json:"pinned_images"`
+
+	// TrustedUsers may approve builds of pull requests from forks, along
+	// with members of the flynn organization, and their own pull requests
+	// run without approval.
+	TrustedUsers []string `json:"trusted_users"`
+
+	// UntrustedEgress lists the CIDRs and hostnames, such as package and
+	// git mirrors, which the instances of untrusted builds may reach.
+	UntrustedEgress []string `json:"untrusted_egress"`
+
+	// Secrets are exported to the build scripts of trusted builds, such as
+	// registry credentials.
+	Secrets []*Secret `json:"secrets"`
+
+	// EphemeralRegistry runs a docker registry on the host for each build,
+	// which the build instance pushes the images it builds to and cluster
+	// instances pull them from.
+	EphemeralRegistry bool `json:"ephemeral_registry"`
+
+	// WarmInterval is how often the runner refreshes the docker fs builds
+	// start from, pulling the base images the build depends on into a new
+	// copy of it.
+	WarmInterval Duration `json:"warm_interval"`
+
+	// PublishImages uploads the images built by passing trusted builds of
+	// master.
+	PublishImages bool `json:"publish_images"`
+
+	// Promotion makes new base images candidates which builds only start
+	// from once a validation run against them passes, see Promotion.
+	Promotion *Promotion `json:"promotion"`
+
+	// AllowedDevices lists the host devices which roles may pass through to
+	// instances.
+	AllowedDevices []string `json:"allowed_devices"`
+
+	Pprof *PprofConfig `json:"pprof"`
+
+	Builders *BuilderConfig `json:"builders"`
+
+	// DashboardTeams maps flynn org teams to the "viewer" or "operator"
+	// role of dashboard users signed in with GitHub. Org members are viewers
+	// by default.
+	DashboardTeams map[string]string `json:"dashboard_teams"`
+
+	// SnapshotRetention is how long build snapshots are kept to resume
+	// builds which failed to bootstrap, and cached builds are kept unused,
+	// defaulting to a week. Snapshots which nothing refers to are removed
+	// sooner, see cluster.RefImage.
+	SnapshotRetention Duration `json:"snapshot_retention"`
+
+	// DeliveryMaxAge rejects webhook deliveries of events older than it,
+	// defaulting to an hour, so captured deliveries can't be replayed.
+	DeliveryMaxAge Duration `json:"delivery_max_age"`
+
+	// Webhooks receive signed JSON events as builds start and finish.
+	Webhooks []*Webhook `json:"webhooks"`
+
+	// Hooks run host commands before and after the phases of runs.
+	Hooks []*Hook `json:"hooks"`
+
+	// Plugins add custom phases, notifiers and artifact stores to the
+	// runner.
+	Plugins []*Plugin `json:"plugins"`
+
+	// RepoPolicy allows builds to be tweaked by a RepoConfigFile in the
+	// commit under test.
+	RepoPolicy *RepoPolicy `json:"repo_policy"`
+
+	Update *UpdateConfig `json:"update"`
+
+	Artifacts *ArtifactsConfig `json:"artifacts"`
+
+	// Costs are the prices of the resources runs use, in dollars.
+	Costs *CostConfig `json:"costs"`
+
+	Collect *CollectConfig `json:"collect"`
+
+	Export *ExportConfig `json:"export"`
+
+	Archive *ArchiveConfig `json:"archive"`
+
+	Flaky *FlakyConfig `json:"flaky"`
+
+	// FailureIssues files issues for tests which keep failing on master.
+	FailureIssues *FailureIssuesConfig `json:"failure_issues"`
+
+	Disk *DiskConfig `json:"disk"`
+
+	Resources *ResourcesConfig `json:"resources"`
+
+	// Projects are the projects other than flynn which share the runner,
+	// such as flynn-devbox or demo apps, by name. Repos which belong to no
+	// project are built as flynn components with the settings above.
+	Projects map[string]*Project `json:"projects"`
+}
+
+// Project is a set of repos built with their own build script, images and
+// secrets, whose run history is kept apart from that of other projects so
+// that their tests are scored separately.
+type Project struct {
+	Name  string   `json:"-"`
+	Repos []string `json:"repos"`
+
+	// DefaultProfile is used when a build of the project doesn't select a
+	// profile, instead of the runner's default profile.
+	DefaultProfile string `json:"default_profile"`
+
+	// BuildScript, RootFS and Kernel replace the runner's build script
+	// template, root fs and kernel for the project's instances.
+	BuildScript string `json:"build_script"`
+	RootFS      string `json:"rootfs"`
+	Kernel      string `json:"kernel"`
+
+	// Images are the repos built along with the repo under test, by ref,
+	// like those of a profile, which takes precedence.
+	Images map[string]string `json:"images"`
+
+	// Downloads and PinnedImages replace those of the runner if set.
+	Downloads    []*cluster.Download `json:"downloads"`
+	PinnedImages []string            `json:"pinned_images"`
+
+	// Secrets are exported to the project's builds instead of the
+	// runner's secrets, and are read from the project's subdirectory of
+	// the secrets dir.
+	Secrets []*Secret `json:"secrets"`
+}
+
+// Isolated reports whether the project's builds differ from those of flynn
+// in more than the repos they build, so can't share build instances or
+// cached builds with them.
+func (p *Project) Isolated() bool {
+	return p.BuildScript != "" || p.RootFS != "" || p.Kernel != "" || p.Downloads != nil || p.PinnedImages != nil
+}
+
+var projectName = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+type Webhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+
+	// Events lists the events sent to the webhook, "run.start" and/or
+	// "run.finish", defaulting to all events.
+	Events []string `json:"events"`
+}
+
+// RunPhases are the phases of a run, in order, which hooks run around. The
+// steps of a profile's pipeline are phases of their type.
+var RunPhases = []string{"prepare", "build", "snapshot", "boot-cluster", "bootstrap", "test", "collect", "teardown", "script", "layer", "publish"}
+
+// Hook runs Command on the host before ("pre") or after ("post") a phase of
+// every run, with the run and phase in its environment. A failing hook fails
+// its phase if Required is set, and is otherwise only logged. Timeout
+// defaults to five minutes.
+type Hook struct {
+	Phase    string   `json:"phase"`
+	When     string   `json:"when"`
+	Command  []string `json:"command"`
+	Timeout  Duration `json:"timeout"`
+	Required bool     `json:"required"`
+}
+
+// Plugin is a host command the runner calls with a JSON request on stdin,
+// reading a JSON response from stdout, with its stderr going to the run's
+// log. It runs each of Phases after the built-in phase the phase follows,
+// is sent the run events in Events like a webhook, and stores artifacts if
+// the artifact store is "plugin" and names it. Timeout limits each call,
+// defaulting to five minutes.
+type Plugin struct {
+	Name    string         `json:"name"`
+	Command []string       `json:"command"`
+	Timeout Duration       `json:"timeout"`
+	Phases  []*PluginPhase `json:"phases"`
+	Events  []string       `json:"events"`
+}
+
+// PluginPhase is a custom phase run after the phase After succeeds. A
+// failing phase fails the run if Required is set, and is otherwise only
+// logged.
+type PluginPhase struct {
+	Name     string `json:"name"`
+	After    string `json:"after"`
+	Required bool   `json:"required"`
+}
+
+// Plugin returns the plugin called name, or nil if there is none.
+func (c *Config) Plugin(name string) *Plugin {
+	for _, p := range c.Plugins {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+var WebhookEvents = []string{"run.start", "run.finish", "disk.warn", "disk.full", "disk.ok"}
+
+func (w *Webhook) Subscribed(event string) bool {
+	return len(w.Events) == 0 || contains(w.Events, event)
+}
+
+// Secret is read from the file Name in the runner's secrets dir and exported
+// as Env, which defaults to Name.
+type Secret struct {
+	Name string `json:"name"`
+	Env  string `json:"env"`
+
+	// MasterOnly withholds the secret from pull requests and other
+	// branches.
+	MasterOnly bool `json:"master_only"`
+}
+
+func (s *Secret) EnvName() string {
+	if s.Env == "" {
+		return s.Name
+	}
+	return s.Env
+}
+
+// BuilderConfig selects how build instances are managed. Policy is one of:
+//
+//   - "ephemeral" boots a new build instance for every build (the default)
+//   - "warm" keeps a spare build instance booted, so builds still get a
+//     fresh instance but don't wait for it to boot
+//   - "pool" keeps PoolSize build instances running and reuses them, along
+//     with their checkouts and caches, for every build
+type BuilderConfig struct {
+	Policy   string `json:"policy"`
+	PoolSize int    `json:"pool_size"`
+}
+
+var BuilderPolicies = []string{"ephemeral", "warm", "pool"}
+
+// ArtifactsConfig selects where build logs, reports, test artifacts and
+// images are stored. Local and SFTP stores are not served by the runner, URL
+// is the base URL at which Dir is exposed.
+type ArtifactsConfig struct {
+	Store  string `json:"store"`
+	Bucket string `json:"bucket"`
+	Dir    string `json:"dir"`
+	URL    string `json:"url"`
+
+	// Host, User and Key are the SFTP server and the path of the private
+	// key to authenticate with.
+	Host string `json:"host"`
+	User string `json:"user"`
+	Key  string `json:"key"`
+
+	// Plugin names the plugin of the "plugin" store.
+	Plugin string `json:"plugin"`
+}
+
+// CollectConfig selects the guest paths which are collected from each
+// instance once the tests have run, along with its console log, and whether
+// the logs of its docker containers, which include the flynn components, are
+// collected too.
+type CollectConfig struct {
+	Paths      []string `json:"paths"`
+	DockerLogs bool     `json:"docker_logs"`
+}
+
+// ExportConfig periodically sends the records of finished runs and their
+// tests to an analytics sink, either "csv" files in Dir or JSON POSTed to URL
+// with the "http" sink. The csv sink is the default.
+type ExportConfig struct {
+	Sink     string   `json:"sink"`
+	Dir      string   `json:"dir"`
+	URL      string   `json:"url"`
+	Interval Duration `json:"interval"`
+}
+
+// ArchiveConfig moves the details of builds older than After to the artifact
+// store, checking for builds to archive every Interval.
+type ArchiveConfig struct {
+	After    Duration `json:"after"`
+	Interval Duration `json:"interval"`
+}
+
+// DiskConfig watches the disks the runner writes to every Interval. When one
+// is fuller than Warn, webhooks are alerted, and when one is fuller than Full
+// new runs wait and the build cache and oldest local artifacts are pruned
+// until it isn't. Both are fractions of the disk's size. Paths are watched
+// along with the workdir, build cache, local artifacts and db. Interval
+// defaults to a minute.
+type DiskConfig struct {
+	Warn     float64  `json:"warn"`
+	Full     float64  `json:"full"`
+	Interval Duration `json:"interval"`
+	Paths    []string `json:"paths"`
+}
+
+// ResourcesConfig limits the instances of all runs on the host to MaxVMs
+// and a total of Memory MB, with Cores CPUs for roles which don't set them.
+// Booting an instance beyond the limits fails unless Wait is set, in which
+// case it waits for other instances to stop.
+type ResourcesConfig struct {
+	MaxVMs int  `json:"max_vms"`
+	Memory int  `json:"memory"`
+	Cores  int  `json:"cores"`
+	Wait   bool `json:"wait"`
+}
+
+// FlakyConfig configures how tests are scored for flakiness from the run
+// history of master, and how known flaky tests are treated.
+type FlakyConfig struct {
+	// Window is the number of recent master runs tests are scored over,
+	// defaulting to 20.
+	Window int `json:"window"`
+
+	// RetryScore is the flakiness score, between 0 and 1, at which failed
+	// tests are rerun once even if they have no retry budget.
+	RetryScore float64 `json:"retry_score"`
+}
+
+// FailureIssuesConfig opens an issue in a repo once a test has failed in
+// After consecutive master runs of it, defaulting to 3, labelled with Labels.
+// Later failures are added to the issue as comments, and the issue is closed
+// once the test passes on master again.
+type FailureIssuesConfig struct {
+	After  int      `json:"after"`
+	Labels []string `json:"labels"`
+}
+
+func (c *Config) FailureIssuesAfter() int {
+	if c.FailureIssues == nil || c.FailureIssues.After <= 0 {
+		return 3
+	}
+	return c.FailureIssues.After
+}
+
+func (c *Config) SnapshotMaxAge() time.Duration {
+	if c.SnapshotRetention <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return time.Duration(c.SnapshotRetention)
+}
+
+func (c *Config) MaxDeliveryAge() time.Duration {
+	if c.DeliveryMaxAge <= 0 {
+		return time.Hour
+	}
+	return time.Duration(c.DeliveryMaxAge)
+}
+
+func (c *Config) FlakyWindow() int {
+	if c.Flaky == nil || c.Flaky.Window <= 0 {
+		return 20
+	}
+	return c.Flaky.Window
+}
+
+// CostConfig prices the resources used by the instances of a run.
+type CostConfig struct {
+	VMHour     float64 `json:"vm_hour"`
+	DiskGBHour float64 `json:"disk_gb_hour"`
+	EgressGB   float64 `json:"egress_gb"`
+}
+
+// Cost returns the price of u.
+func (c *CostConfig) Cost(u cluster.Usage) float64 {
+	if c == nil {
+		return 0
+	}
+	return u.VMHours*c.VMHour + u.DiskGBHours*c.DiskGBHour + float64(u.EgressBytes)/(1<<30)*c.EgressGB
+}
+
+var ArtifactStores = []string{"s3", "local", "sftp", "plugin"}
+
+// ArtifactStore returns the configured artifact store.
+func (c *Config) ArtifactStore() string {
+	if c.Artifacts == nil || c.Artifacts.Store == "" {
+		return "s3"
+	}
+	return c.Artifacts.Store
+}
+
+// BuilderPolicy returns the configured builder policy.
+func (c *Config) BuilderPolicy() string {
+	if c.Builders == nil || c.Builders.Policy == "" {
+		return "ephemeral"
+	}
+	return c.Builders.Policy
+}
+
+// PprofConfig selects pprof profiles which are fetched from cluster services
+// when tests fail or time out, and saved as build artifacts.
+type PprofConfig struct {
+	// Services are discoverd service names, such as "flynn-controller".
+	Services []string `json:"services"`
+
+	// Profiles are pprof profile names, such as "heap", "goroutine" or
+	// "profile" for a CPU profile lasting CPUSeconds.
+	Profiles   []string `json:"profiles"`
+	CPUSeconds int      `json:"cpu_seconds"`
+
+	// On lists when profiles are collected, "failure" and/or "timeout".
+	On []string `json:"on"`
+}
+
+func (p *PprofConfig) CollectOn(event string) bool {
+	return contains(p.On, event)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+type Profile struct {
+	Name        string `json:"-"`
+	ClusterSize int    `json:"cluster_size"`
+
+	// Roles lists the role of each instance in the cluster, taking
+	// precedence over ClusterSize.
+	Roles []string `json:"roles"`
+
+	// TestFilter is a regular expression matched against test names, using
+	// the same syntax as gocheck's -check.f flag.
+	TestFilter string `json:"test_filter"`
+
+	// Timeout limits the duration of the test phase.
+	Timeout Duration `json:"timeout"`
+
+	// Images pins repos other than the one under test to specific refs.
+	Images map[string]string `json:"images"`
+
+	// Shards splits the suite across this many clusters which run in
+	// parallel.
+	Shards int `json:"shards"`
+
+	// Parallelism distributes the suite's tests across queues run on up to
+	// this many clusters in parallel, each shut down once its queue drains.
+	Parallelism int `json:"parallelism"`
+
+	// Chaos injects random faults into the cluster while the suite runs.
+	Chaos *ChaosConfig `json:"chaos"`
+
+	// ReservedIPs maps names, such as "router", to IPs of the cluster
+	// subnet which are kept free of instances. An empty IP reserves any
+	// free one.
+	ReservedIPs map[string]string `json:"reserved_ips"`
+
+	// Macvtap attaches instances to this host NIC as a second interface,
+	// bypassing the cluster bridge and NAT, for benchmarks such as router
+	// throughput tests.
+	Macvtap string `json:"macvtap"`
+
+	// Retry reruns failed tests beyond the retry budgets the tests declare.
+	Retry *RetryPolicy `json:"retry"`
+
+	Timeouts *Timeouts `json:"timeouts"`
+
+	// SnapshotRestore snapshots the cluster once it is bootstrapped, and
+	// restores the snapshot before each destructive test rather than
+	// tearing down the fixtures the test invalidates.
+	SnapshotRestore bool `json:"snapshot_restore"`
+
+	// Soak keeps the cluster running instead of running the test suite.
+	Soak *SoakConfig `json:"soak"`
+
+	// DependencyUpdate runs the suite against the latest commits of the
+	// flynn components rather than the refs they are pinned to.
+	DependencyUpdate *DependencyUpdate `json:"dependency_update"`
+
+	// Placement is how the instances of the profile's clusters are placed
+	// across several remote hosts, "colocate" or "spread", see
+	// cluster.BootConfig.Placement.
+	Placement string `json:"placement"`
+
+	// Mutexes names exclusive resources, such as "benchmark-host", which a
+	// run holds while it runs, so that runs of profiles sharing a mutex
+	// never overlap on a host.
+	Mutexes []string `json:"mutexes"`
+
+	// Features are feature flags set for the tests of the run.
+	Features Features `json:"features"`
+
+	// Kernel names a kernel of the catalog to boot the cluster with, to
+	// cover kernel dependent behaviour such as that of newer overlayfs.
+	// Combined with TestFilter it runs individual tests on that kernel.
+	Kernel string `json:"kernel"`
+
+	// Pipeline replaces the phases which follow the build, booting a
+	// cluster and running the test suite, with these steps, for workflows
+	// such as building release images or soak tests.
+	Pipeline []*Step `json:"pipeline"`
+}
+
+// KernelImage is a kernel and its initrd in the kernel catalog. RootFS lists
+// the root fs images it is known to work with, e.g. those its modules were
+// built for, and is empty if it works with any.
+type KernelImage struct {
+	Kernel string   `json:"kernel"`
+	Initrd string   `json:"initrd"`
+	RootFS []string `json:"rootfs"`
+}
+
+// ResolveKernel returns the catalog's kernel called name and the root fs to
+// boot it with, which is rootfs if they are compatible and otherwise the
+// first root fs the kernel lists.
+func (c *Config) ResolveKernel(name, rootfs string) (*KernelImage, string, error) {
+	k, ok := c.Kernels[name]
+	if !ok {
+		return nil, "", fmt.Errorf("config: unknown kernel %q", name)
+	}
+	if len(k.RootFS) == 0 || contains(k.RootFS, rootfs) {
+		return k, rootfs, nil
+	}
+	return k, k.RootFS[0], nil
+}
+
+// StepTypes are the kinds of step a pipeline is composed of.
+var StepTypes = []string{"boot-cluster", "script", "snapshot", "layer", "publish"}
+
+// Step is a step of a profile's pipeline, run in order on the image the run
+// built:
+//
+//	boot-cluster boots a cluster of Roles, or of the profile's roles, from
+//	the image, replacing any cluster booted by an earlier step.
+//
+//	script runs Script over ssh on each instance of the cluster.
+//
+//	snapshot saves the docker fs of the cluster's first instance as the
+//	image of the steps which follow.
+//
+//	layer uploads the difference of the image from the runner's base docker
+//	fs as a qcow2 layer backed by base.img, along with the base, so other
+//	environments can boot the image of the commit from them.
+//
+//	publish uploads the image.
+//
+// Only trusted builds of master may run layer and publish steps.
+type Step struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Roles  []string `json:"roles"`
+	Script string   `json:"script"`
+}
+
+// Timeouts are deadlines of the phases of a run, on top of the profile's
+// Timeout of the whole test phase. An instance which doesn't boot, accept
+// ssh or finish the build in time is killed, failing the run with its latest
+// console output. A test which runs for longer than Test kills the suite,
+// after which the failed tests are rerun if OnTestTimeout is "retry", or
+// the run fails if it is "abort", the default. Run shuts down the clusters
+// of a run which takes longer.
+type Timeouts struct {
+	Boot  Duration `json:"boot"`
+	SSH   Duration `json:"ssh"`
+	Build Duration `json:"build"`
+	Test  Duration `json:"test"`
+	Run   Duration `json:"run"`
+
+	OnTestTimeout string `json:"on_test_timeout"`
+}
+
+// RetryOnTestTimeout returns whether failed tests are rerun once a test has
+// timed out.
+func (t *Timeouts) RetryOnTestTimeout() bool {
+	return t != nil && t.OnTestTimeout == "retry"
+}
+
+// TestTimeout returns the deadline of each test, if any.
+func (t *Timeouts) TestTimeout() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return time.Duration(t.Test)
+}
+
+// RetryPolicy reruns each failed test matching Tests, or every failed test
+// if it is empty, up to Attempts times on a freshly booted cluster, waiting
+// Delay before each round of reruns. A test is only failed if every attempt
+// fails.
+type RetryPolicy struct {
+	Attempts int      `json:"attempts"`
+	Tests    string   `json:"tests"`
+	Delay    Duration `json:"delay"`
+}
+
+// Budget returns the number of reruns the policy allows the test name.
+func (p *RetryPolicy) Budget(name string) int {
+	if p == nil {
+		return 0
+	}
+	if p.Tests != "" {
+		if ok, _ := regexp.MatchString(p.Tests, name); !ok {
+			return 0
+		}
+	}
+	return p.Attempts
+}
+
+// Size returns the number of instances in the profile's cluster.
+func (p *Profile) Size() int {
+	if len(p.Roles) > 0 {
+		return len(p.Roles)
+	}
+	if p.ClusterSize > 0 {
+		return p.ClusterSize
+	}
+	return 1
+}
+
+// SoakConfig keeps the bootstrapped cluster of a run running for Duration,
+// checking its health and running the Load script over ssh on its first
+// instance every Interval, and recording the memory use and restarts of
+// Flynn's components. The run fails if a health check fails, a component's
+// memory grows by more than MaxMemoryGrowth times its first sample, or a
+// component restarts more than MaxRestarts times. Schedule a soak profile
+// weekly to soak master.
+type SoakConfig struct {
+	Duration Duration `json:"duration"`
+	Interval Duration `json:"interval"`
+	Load     string   `json:"load"`
+
+	MaxMemoryGrowth float64 `json:"max_memory_growth"`
+	MaxRestarts     int     `json:"max_restarts"`
+}
+
+// DependencyUpdate validates a dependency bump before it is merged. The run
+// pins every flynn component which the profile, its project and the run's
+// own repo don't pin to the commit its ref in the devbox manifest,
+// util.Repos, is at upstream, builds and tests against those pins, and
+// opens an issue in the flynn repo ReportRepo, defaulting to the run's repo, reporting the
+// pins and the results with Labels. Schedule a dependency update profile
+// nightly to find out which upstream changes break the suite.
+type DependencyUpdate struct {
+	ReportRepo string   `json:"report_repo"`
+	Labels     []string `json:"labels"`
+}
+
+// ChaosConfig configures the faults injected by a chaos profile. Every
+// Interval a random fault is injected on random instances, and reverted after
+// Duration.
+type ChaosConfig struct {
+	// Faults lists the kinds of fault to inject, "restart", "partition"
+	// and/or "latency".
+	Faults   []string `json:"faults"`
+	Interval Duration `json:"interval"`
+	Duration Duration `json:"duration"`
+	Latency  Duration `json:"latency"`
+
+	// Seed overrides the run's seed for choosing faults.
+	Seed int64 `json:"seed"`
+}
+
+var ChaosFaults = []string{"restart", "partition", "latency"}
+
+// BranchOverride applies to builds of branches matching Pattern, a glob such
+// as "release/*", which don't select a profile with a label. The first
+// matching override is used.
+type BranchOverride struct {
+	Pattern string `json:"pattern"`
+
+	// Profiles are each run in a separate build, or no build is run if
+	// Skip is set.
+	Profiles []string `json:"profiles"`
+	Skip     bool     `json:"skip"`
+}
+
+// BranchOverride returns the first override matching branch, or nil.
+func (c *Config) BranchOverride(branch string) *BranchOverride {
+	for _, o := range c.Branches {
+		if ok, _ := path.Match(o.Pattern, branch); ok {
+			return o
+		}
+	}
+	return nil
+}
+
+// Schedule periodically triggers a build of Repo at Ref using Profile.
+type Schedule struct {
+	Profile  string   `json:"profile"`
+	Repo     string   `json:"repo"`
+	Ref      string   `json:"ref"`
+	Interval Duration `json:"interval"`
+}
+
+// Promotion validates candidate root and docker fs images with a run of
+// Profile, defaulting to smoke, building Repo at Ref, defaulting to flynn at
+// master, before promoting them to the stable images builds start from.
+// Warmed docker fs images are only candidates when it is set, otherwise
+// builds start from them straight away.
+type Promotion struct {
+	Profile string `json:"profile"`
+	Repo    string `json:"repo"`
+	Ref     string `json:"ref"`
+}
+
+// Run returns the profile, repo and ref of validation runs.
+func (p *Promotion) Run() (profile, repo, ref string) {
+	profile, repo, ref = "smoke", "flynn", "master"
+	if p == nil {
+		return
+	}
+	if p.Profile != "" {
+		profile = p.Profile
+	}
+	if p.Repo != "" {
+		repo = p.Repo
+	}
+	if p.Ref != "" {
+		ref = p.Ref
+	}
+	return
+}
+
+// UpdateConfig points the runner at its release artifact. URL+".manifest" is
+// a JSON manifest of the artifact's version, SHA256 and size, and
+// URL+".manifest.sig" an RSA PKCS#1 v1.5 signature of the manifest's SHA256,
+// checked against the PEM encoded public key at PublicKey. Only releases with
+// a higher version than the running runner are installed. If Interval is set
+// the runner checks for a new release periodically, otherwise only when asked
+// to.
+type UpdateConfig struct {
+	URL       string   `json:"url"`
+	PublicKey string   `json:"public_key"`
+	Interval  Duration `json:"interval"`
+}
+
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func Default() *Config {
+	c := &Config{
+		DefaultProfile: "full",
+		Profiles: map[string]*Profile{
+			"smoke":     {ClusterSize: 1, TestFilter: "BasicSuite", Timeout: Duration(15 * time.Minute)},
+			"full":      {ClusterSize: 1, Timeout: Duration(time.Hour)},
+			"nightly":   {ClusterSize: 3, Timeout: Duration(3 * time.Hour)},
+			"upgrade":   {ClusterSize: 3, TestFilter: "Upgrade", Timeout: Duration(2 * time.Hour)},
+			"benchmark": {ClusterSize: 3, TestFilter: "Benchmark", Timeout: Duration(2 * time.Hour)},
+			"chaos": {ClusterSize: 3, Timeout: Duration(3 * time.Hour), Chaos: &ChaosConfig{
+				Faults:   ChaosFaults,
+				Interval: Duration(5 * time.Minute),
+				Duration: Duration(time.Minute),
+				Latency:  Duration(200 * time.Millisecond),
+			}},
+		},
+		Labels:  map[string]string{},
+		Collect: &CollectConfig{Paths: []string{"/var/log"}, DockerLogs: true},
+	}
+	c.setNames()
+	return c
+}
+
+// Load reads a JSON config file from path. Profiles which are not defined in
+// the file keep their defaults.
+func Load(path string) (*Config, error) {
+	c := Default()
+	if path == "" {
+		return c, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var fileConf Config
+	if err := json.NewDecoder(f).Decode(&fileConf); err != nil {
+		return nil, fmt.Errorf("config: error parsing %s: %s", path, err)
+	}
+	if fileConf.DefaultProfile != "" {
+		c.DefaultProfile = fileConf.DefaultProfile
+	}
+	for name, p := range fileConf.Profiles {
+		c.Profiles[name] = p
+	}
+	for label, profile := range fileConf.Labels {
+		c.Labels[label] = profile
+	}
+	c.LabelFeatures = fileConf.LabelFeatures
+	c.Flags = fileConf.Flags
+	c.Schedules = fileConf.Schedules
+	c.Branches = fileConf.Branches
+	c.Roles = fileConf.Roles
+	c.BootProfiles = fileConf.BootProfiles
+	c.Kernels = fileConf.Kernels
+	c.SSHAgent = fileConf.SSHAgent
+	c.DeployKey = fileConf.DeployKey
+	c.Downloads = fileConf.Downloads
+	c.PinnedImages = fileConf.PinnedImages
+	c.WarmInterval = fileConf.WarmInterval
+	c.TrustedUsers = fileConf.TrustedUsers
+	c.DeliveryMaxAge = fileConf.DeliveryMaxAge
+	c.SnapshotRetention = fileConf.SnapshotRetention
+	c.UntrustedEgress = fileConf.UntrustedEgress
+	c.Secrets = fileConf.Secrets
+	c.PublishImages = fileConf.PublishImages
+	c.Promotion = fileConf.Promotion
+	c.EphemeralRegistry = fileConf.EphemeralRegistry
+	c.AllowedDevices = fileConf.AllowedDevices
+	c.Pprof = fileConf.Pprof
+	c.Builders = fileConf.Builders
+	c.Webhooks = fileConf.Webhooks
+	c.Hooks = fileConf.Hooks
+	c.Plugins = fileConf.Plugins
+	c.DashboardTeams = fileConf.DashboardTeams
+	c.RepoPolicy = fileConf.RepoPolicy
+	c.Update = fileConf.Update
+	c.Artifacts = fileConf.Artifacts
+	c.Costs = fileConf.Costs
+	c.Export = fileConf.Export
+	c.Archive = fileConf.Archive
+	c.Flaky = fileConf.Flaky
+	c.FailureIssues = fileConf.FailureIssues
+	c.Disk = fileConf.Disk
+	c.Resources = fileConf.Resources
+	c.Projects = fileConf.Projects
+	if fileConf.Collect != nil {
+		c.Collect = fileConf.Collect
+	}
+	if err := c.setNames(); err != nil {
+		return nil, err
+	}
+	return c, c.validate()
+}
+
+// setNames names the profiles and projects after their keys, failing if one
+// is null in the config file.
+func (c *Config) setNames() error {
+	for name, p := range c.Profiles {
+		if p == nil {
+			return fmt.Errorf("config: profile %s is null", name)
+		}
+		p.Name = name
+	}
+	for name, p := range c.Projects {
+		if p == nil {
+			return fmt.Errorf("config: project %s is null", name)
+		}
+		p.Name = name
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if _, ok := c.Profiles[c.DefaultProfile]; !ok {
+		return fmt.Errorf("config: unknown default profile %q", c.DefaultProfile)
+	}
+	for label, profile := range c.Labels {
+		if _, ok := c.Profiles[profile]; !ok {
+			return fmt.Errorf("config: label %q refers to unknown profile %q", label, profile)
+		}
+	}
+	for label, features := range c.LabelFeatures {
+		if err := features.validate(); err != nil {
+			return fmt.Errorf("config: label %q: %s", label, err)
+		}
+	}
+	for _, dev := range c.AllowedDevices {
+		if err := cluster.ValidateDevice(dev); err != nil {
+			return fmt.Errorf("config: %s", err)
+		}
+	}
+	for name, role := range c.Roles {
+		if role == nil {
+			return fmt.Errorf("config: role %s is null", name)
+		}
+		if role.Boot != "" {
+			bc := cluster.BootConfig{BootProfiles: c.BootProfiles}
+			if _, err := bc.BootProfile(role.Boot); err != nil {
+				return fmt.Errorf("config: role %s: %s", name, err)
+			}
+		}
+		for _, after := range role.After {
+			if _, ok := c.Roles[after]; ok {
+				continue
+			}
+			if _, ok := cluster.DefaultRoles[after]; !ok {
+				return fmt.Errorf("config: role %s is booted after unknown role %q", name, after)
+			}
+		}
+		for drive := range role.Drives {
+			if drive == "hda" || drive == "hdb" {
+				return fmt.Errorf("config: role %s uses drive %s which holds the root or docker fs", name, drive)
+			}
+		}
+		for _, dev := range role.Devices {
+			if !c.deviceAllowed(dev) {
+				return fmt.Errorf("config: role %s uses device %q which is not in allowed_devices", name, dev)
+			}
+		}
+	}
+	for name, k := range c.Kernels {
+		if k.Kernel == "" {
+			return fmt.Errorf("config: kernel %s has no kernel image", name)
+		}
+	}
+	for name, p := range c.Profiles {
+		if _, ok := c.Kernels[p.Kernel]; p.Kernel != "" && !ok {
+			return fmt.Errorf("config: profile %s refers to unknown kernel %q", name, p.Kernel)
+		}
+		if p.Shards > 1 && p.Parallelism > 1 {
+			return fmt.Errorf("config: profile %s sets both shards and parallelism", name)
+		}
+		roles := p.Roles
+		for _, step := range p.Pipeline {
+			if !contains(StepTypes, step.Type) {
+				return fmt.Errorf("config: profile %s has pipeline step of unknown type %q", name, step.Type)
+			}
+			if step.Type == "script" && step.Script == "" {
+				return fmt.Errorf("config: profile %s has script step with no script", name)
+			}
+			roles = append(roles, step.Roles...)
+		}
+		for _, role := range roles {
+			if _, ok := c.Roles[role]; ok {
+				continue
+			}
+			if _, ok := cluster.DefaultRoles[role]; !ok {
+				return fmt.Errorf("config: profile %s refers to unknown role %q", name, role)
+			}
+		}
+		if len(p.Pipeline) > 0 && (p.Shards > 1 || p.Parallelism > 1) {
+			return fmt.Errorf("config: profile %s sets a pipeline, which can't be sharded or parallel", name)
+		}
+		if p.Retry != nil {
+			if p.Retry.Attempts < 1 {
+				return fmt.Errorf("config: profile %s retry needs at least one attempt", name)
+			}
+			if _, err := regexp.Compile(p.Retry.Tests); err != nil {
+				return fmt.Errorf("config: profile %s has invalid retry tests: %s", name, err)
+			}
+		}
+		if p.Placement != "" && p.Placement != "colocate" && p.Placement != "spread" {
+			return fmt.Errorf("config: profile %s has unknown placement %q", name, p.Placement)
+		}
+		if t := p.Timeouts; t != nil && t.OnTestTimeout != "" && t.OnTestTimeout != "abort" && t.OnTestTimeout != "retry" {
+			return fmt.Errorf("config: profile %s has unknown on_test_timeout %q", name, t.OnTestTimeout)
+		}
+		if err := p.Features.validate(); err != nil {
+			return fmt.Errorf("config: profile %s: %s", name, err)
+		}
+		for ipName, ip := range p.ReservedIPs {
+			if ip != "" && net.ParseIP(ip) == nil {
+				return fmt.Errorf("config: profile %s reserves invalid IP %q for %s", name, ip, ipName)
+			}
+		}
+	}
+	if c.Builders != nil {
+		if !contains(BuilderPolicies, c.BuilderPolicy()) {
+			return fmt.Errorf("config: unknown builder policy %q", c.Builders.Policy)
+		}
+		if c.Builders.Policy == "pool" && c.Builders.PoolSize < 1 {
+			return errors.New("config: builder pool needs a pool_size of at least 1")
+		}
+	}
+	if c.Artifacts != nil {
+		a := c.Artifacts
+		if !contains(ArtifactStores, c.ArtifactStore()) {
+			return fmt.Errorf("config: unknown artifact store %q", a.Store)
+		}
+		switch a.Store {
+		case "local":
+			if a.Dir == "" || a.URL == "" {
+				return errors.New("config: local artifact store needs a dir and url")
+			}
+		case "sftp":
+			if a.Host == "" || a.Dir == "" || a.URL == "" {
+				return errors.New("config: sftp artifact store needs a host, dir and url")
+			}
+		case "plugin":
+			if c.Plugin(a.Plugin) == nil || a.URL == "" {
+				return errors.New("config: plugin artifact store needs a known plugin and url")
+			}
+		}
+	}
+	if c.Costs != nil && (c.Costs.VMHour < 0 || c.Costs.DiskGBHour < 0 || c.Costs.EgressGB < 0) {
+		return errors.New("config: costs cannot be negative")
+	}
+	if e := c.Export; e != nil {
+		switch e.Sink {
+		case "", "csv":
+			if e.Dir == "" {
+				return errors.New("config: csv export sink needs a dir")
+			}
+		case "http":
+			if e.URL == "" {
+				return errors.New("config: http export sink needs a url")
+			}
+		default:
+			return fmt.Errorf("config: unknown export sink %q", e.Sink)
+		}
+		if e.Interval <= 0 {
+			return errors.New("config: export needs an interval")
+		}
+	}
+	if c.Archive != nil && (c.Archive.After <= 0 || c.Archive.Interval <= 0) {
+		return errors.New("config: archive needs an after and interval")
+	}
+	if c.Disk != nil && (c.Disk.Full <= 0 || c.Disk.Full > 1 || c.Disk.Warn < 0 || c.Disk.Warn > c.Disk.Full) {
+		return errors.New("config: disk full must be between 0 and 1, and warn between 0 and full")
+	}
+	if c.Resources != nil && (c.Resources.MaxVMs < 0 || c.Resources.Memory < 0 || c.Resources.Cores < 0) {
+		return errors.New("config: resources limits can't be negative")
+	}
+	if c.Flaky != nil && (c.Flaky.RetryScore < 0 || c.Flaky.RetryScore > 1) {
+		return errors.New("config: flaky retry_score must be between 0 and 1")
+	}
+	if c.Update != nil && (c.Update.URL == "" || c.Update.PublicKey == "") {
+		return errors.New("config: update needs a url and public_key")
+	}
+	for team, role := range c.DashboardTeams {
+		if role != "viewer" && role != "operator" {
+			return fmt.Errorf("config: team %s has unknown dashboard role %q", team, role)
+		}
+	}
+	for _, hook := range c.Hooks {
+		if !contains(RunPhases, hook.Phase) {
+			return fmt.Errorf("config: hook has unknown phase %q", hook.Phase)
+		}
+		if hook.When != "pre" && hook.When != "post" {
+			return fmt.Errorf("config: hook of phase %s must run pre or post, not %q", hook.Phase, hook.When)
+		}
+		if len(hook.Command) == 0 {
+			return fmt.Errorf("config: hook of phase %s has no command", hook.Phase)
+		}
+	}
+	plugins := make(map[string]bool, len(c.Plugins))
+	for _, p := range c.Plugins {
+		if p.Name == "" || plugins[p.Name] {
+			return fmt.Errorf("config: plugin names must be unique and not empty, got %q", p.Name)
+		}
+		plugins[p.Name] = true
+		if len(p.Command) == 0 {
+			return fmt.Errorf("config: plugin %s has no command", p.Name)
+		}
+		for _, phase := range p.Phases {
+			if phase.Name == "" || contains(RunPhases, phase.Name) {
+				return fmt.Errorf("config: plugin %s has a phase without a name of its own", p.Name)
+			}
+			if !contains(RunPhases, phase.After) {
+				return fmt.Errorf("config: plugin %s phase %s follows unknown phase %q", p.Name, phase.Name, phase.After)
+			}
+		}
+		for _, event := range p.Events {
+			if !contains(WebhookEvents, event) {
+				return fmt.Errorf("config: plugin %s subscribes to unknown event %q", p.Name, event)
+			}
+		}
+	}
+	for _, hook := range c.Webhooks {
+		if hook.URL == "" {
+			return errors.New("config: webhook has no url")
+		}
+		for _, e := range hook.Events {
+			if !contains(WebhookEvents, e) {
+				return fmt.Errorf("config: webhook %s has unknown event %q", hook.URL, e)
+			}
+		}
+	}
+	for name, p := range c.Profiles {
+		if s := p.Soak; s != nil && (s.Duration <= 0 || s.Interval <= 0 || s.MaxMemoryGrowth < 0 || s.MaxRestarts < 0) {
+			return fmt.Errorf("config: profile %s soak needs a duration and interval", name)
+		}
+		if p.Soak != nil && (p.Shards > 1 || p.Parallelism > 1 || len(p.Pipeline) > 0) {
+			return fmt.Errorf("config: profile %s soaks, so can't be sharded, parallel or a pipeline", name)
+		}
+		if p.DependencyUpdate != nil && (p.Soak != nil || len(p.Pipeline) > 0) {
+			return fmt.Errorf("config: profile %s validates a dependency update, so must run the test suite", name)
+		}
+		if p.Chaos == nil {
+			continue
+		}
+		if p.Chaos.Interval <= 0 {
+			return fmt.Errorf("config: profile %s has no chaos interval", name)
+		}
+		for _, f := range p.Chaos.Faults {
+			if !contains(ChaosFaults, f) {
+				return fmt.Errorf("config: profile %s has unknown chaos fault %q", name, f)
+			}
+		}
+	}
+	for _, o := range c.Branches {
+		if _, err := path.Match(o.Pattern, ""); err != nil {
+			return fmt.Errorf("config: invalid branch pattern %q: %s", o.Pattern, err)
+		}
+		for _, profile := range o.Profiles {
+			if _, ok := c.Profiles[profile]; !ok {
+				return fmt.Errorf("config: branch pattern %q refers to unknown profile %q", o.Pattern, profile)
+			}
+		}
+	}
+	for _, d := range c.Downloads {
+		if err := d.Validate(); err != nil {
+			return fmt.Errorf("config: %s", err)
+		}
+	}
+	for _, image := range c.PinnedImages {
+		if err := cluster.ValidatePinnedImage(image); err != nil {
+			return fmt.Errorf("config: %s", err)
+		}
+	}
+	for _, s := range c.Secrets {
+		if s.Name == "" || strings.ContainsAny(s.Name, "/=") {
+			return fmt.Errorf("config: invalid secret name %q", s.Name)
+		}
+	}
+	if c.RepoPolicy != nil {
+		for _, profile := range c.RepoPolicy.Profiles {
+			if _, ok := c.Profiles[profile]; !ok {
+				return fmt.Errorf("config: repo policy refers to unknown profile %q", profile)
+			}
+		}
+	}
+	if c.Promotion != nil {
+		if profile, _, _ := c.Promotion.Run(); c.Profiles[profile] == nil {
+			return fmt.Errorf("config: promotion refers to unknown profile %q", profile)
+		}
+	}
+	for _, s := range c.Schedules {
+		if _, ok := c.Profiles[s.Profile]; !ok {
+			return fmt.Errorf("config: schedule refers to unknown profile %q", s.Profile)
+		}
+		if s.Interval <= 0 {
+			return fmt.Errorf("config: schedule for %s has no interval", s.Repo)
+		}
+	}
+	projects := make(map[string]string)
+	for name, p := range c.Projects {
+		if !projectName.MatchString(name) {
+			return fmt.Errorf("config: invalid project name %q", name)
+		}
+		if len(p.Repos) == 0 {
+			return fmt.Errorf("config: project %s has no repos", name)
+		}
+		for _, repo := range p.Repos {
+			if _, ok := util.Repos[repo]; ok {
+				return fmt.Errorf("config: project %s claims flynn component %s", name, repo)
+			}
+			if other, ok := projects[repo]; ok {
+				return fmt.Errorf("config: repo %s is in both projects %s and %s", repo, other, name)
+			}
+			projects[repo] = name
+		}
+		if _, ok := c.Profiles[p.DefaultProfile]; p.DefaultProfile != "" && !ok {
+			return fmt.Errorf("config: project %s refers to unknown profile %q", name, p.DefaultProfile)
+		}
+		for _, d := range p.Downloads {
+			if err := d.Validate(); err != nil {
+				return fmt.Errorf("config: project %s: %s", name, err)
+			}
+		}
+		for _, image := range p.PinnedImages {
+			if err := cluster.ValidatePinnedImage(image); err != nil {
+				return fmt.Errorf("config: project %s: %s", name, err)
+			}
+		}
+		for _, s := range p.Secrets {
+			if s.Name == "" || strings.ContainsAny(s.Name, "/=") {
+				return fmt.Errorf("config: project %s has invalid secret name %q", name, s.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// ProjectOf returns the project repo belongs to, or nil if it is a flynn
+// component.
+func (c *Config) ProjectOf(repo string) *Project {
+	for _, p := range c.Projects {
+		if contains(p.Repos, repo) {
+			return p
+		}
+	}
+	return nil
+}
+
+// KnownRepo reports whether the runner builds repo, as either a flynn
+// component or a repo of a project.
+func (c *Config) KnownRepo(repo string) bool {
+	if _, ok := util.Repos[repo]; ok {
+		return true
+	}
+	return c.ProjectOf(repo) != nil
+}
+
+// Repos returns the repos the runner builds, sorted.
+func (c *Config) Repos() []string {
+	repos := make([]string, 0, len(util.Repos))
+	for repo := range util.Repos {
+		repos = append(repos, repo)
+	}
+	for _, p := range c.Projects {
+		repos = append(repos, p.Repos...)
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+func (c *Config) deviceAllowed(dev string) bool {
+	for _, allowed := range c.AllowedDevices {
+		if dev == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Profile returns the named profile, or the default profile if name is empty.
+func (c *Config) Profile(name string) (*Profile, error) {
+	if name == "" {
+		name = c.DefaultProfile
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("config: unknown profile %q", name)
+	}
+	return p, nil
+}
+
+// FeaturesForLabels returns the feature flags set by labels, later labels
+// taking precedence.
+func (c *Config) FeaturesForLabels(labels []string) Features {
+	var f Features
+	for _, l := range labels {
+		f = f.Merge(c.LabelFeatures[l])
+	}
+	return f
+}
+
+// LabelProfile returns the profile selected by the first matching label.
+func (c *Config) LabelProfile(labels []string) string {
+	for _, l := range labels {
+		if p, ok := c.Labels[l]; ok {
+			return p
+		}
+	}
+	return ""
+}
+
+// Features are feature flags which tests query to only exercise behaviour
+// which is behind a flag, such as a new router, when it is set. A flag set
+// without a value is "true".
+type Features map[string]string
+
+// ParseFeatures parses flags in the format of Features.String, such as
+// "router-v2,log-level=debug".
+func ParseFeatures(s string) (Features, error) {
+	f := make(Features)
+	if s == "" {
+		return f, nil
+	}
+	for _, flag := range strings.Split(s, ",") {
+		name, value := flag, "true"
+		if i := strings.Index(flag, "="); i >= 0 {
+			name, value = flag[:i], flag[i+1:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("invalid feature flag %q", flag)
+		}
+		f[name] = value
+	}
+	return f, nil
+}
+
+func (f Features) String() string {
+	flags := make([]string, 0, len(f))
+	for name, value := range f {
+		flags = append(flags, name+"="+value)
+	}
+	sort.Strings(flags)
+	return strings.Join(flags, ",")
+}
+
+// Enabled returns whether the flag name is set to anything but "false".
+func (f Features) Enabled(name string) bool {
+	value, ok := f[name]
+	return ok && value != "false"
+}
+
+// Merge returns the flags of f overridden by those of o.
+func (f Features) Merge(o Features) Features {
+	if len(o) == 0 {
+		return f
+	}
+	res := make(Features, len(f)+len(o))
+	for name, value := range f {
+		res[name] = value
+	}
+	for name, value := range o {
+		res[name] = value
+	}
+	return res
+}
+
+func (f Features) validate() error {
+	for name, value := range f {
+		if name == "" || strings.ContainsAny(name, ",=") || strings.Contains(value, ",") {
+			return fmt.Errorf("invalid feature flag %q=%q", name, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadNullEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		conf, err string
+	}{
+		{`{"profiles": {"smoke": null}}`, "config: profile smoke is null"},
+		{`{"projects": {"flynn": null}}`, "config: project flynn is null"},
+		{`{"roles": {"worker": null}}`, "config: role worker is null"},
+	} {
+		path := filepath.Join(dir, "config.json")
+		if err := ioutil.WriteFile(path, []byte(test.conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil || err.Error() != test.err {
+			t.Errorf("Load(%s) returned %v, expected %q", test.conf, err, test.err)
+		}
+	}
+}
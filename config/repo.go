@@ -0,0 +1,144 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// RepoConfigFile is the path, relative to the root of a repo, of the config
+// file read from the commit under test.
+const RepoConfigFile = ".flynn-ci.toml"
+
+// RepoConfig is read from RepoConfigFile, and tweaks the profile of builds of
+// the commit it is in within the limits set by RepoPolicy.
+//
+//	profile = "smoke"
+//	test_filter = "BasicSuite"
+//	timeout = "30m"
+//	cluster_size = 3
+//
+//	[env]
+//	GOFLAGS = "-race"
+type RepoConfig struct {
+	Profile     string            `toml:"profile"`
+	TestFilter  string            `toml:"test_filter"`
+	Timeout     string            `toml:"timeout"`
+	ClusterSize int               `toml:"cluster_size"`
+	Env         map[string]string `toml:"env"`
+}
+
+// RepoPolicy limits what repo configs may change. Repo configs are ignored
+// unless a policy is configured.
+type RepoPolicy struct {
+	// Profiles lists the profiles a repo config may select, defaulting to
+	// none.
+	Profiles []string `json:"profiles"`
+
+	// MaxTimeout and MaxClusterSize cap the timeout and cluster size a repo
+	// config may set, defaulting to those of the profile.
+	MaxTimeout     Duration `json:"max_timeout"`
+	MaxClusterSize int      `json:"max_cluster_size"`
+
+	// AllowedEnv lists the environment variables a repo config may set for
+	// the build script, defaulting to none.
+	AllowedEnv []string `json:"allowed_env"`
+}
+
+// RepoOverrides is the result of applying a repo config to a profile.
+type RepoOverrides struct {
+	Profile *Profile
+
+	// Env is a list of KEY=VALUE variables for the build script.
+	Env []string
+
+	// Rejected describes the directives which were ignored because they
+	// exceed the policy.
+	Rejected []string
+}
+
+func (o *RepoOverrides) reject(format string, a ...interface{}) {
+	o.Rejected = append(o.Rejected, fmt.Sprintf(format, a...))
+}
+
+// ParseRepoConfig parses the contents of a RepoConfigFile.
+func ParseRepoConfig(data []byte) (*RepoConfig, error) {
+	rc := &RepoConfig{}
+	md, err := toml.Decode(string(data), rc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", RepoConfigFile, err)
+	}
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return nil, fmt.Errorf("%s: unknown key %q", RepoConfigFile, keys[0].String())
+	}
+	return rc, nil
+}
+
+// ApplyRepoConfig applies the directives of rc which are allowed by the
+// policy to a copy of p. selected is set if the build already selected a
+// profile, which rc may then not change.
+func (c *Config) ApplyRepoConfig(p *Profile, rc *RepoConfig, selected bool) *RepoOverrides {
+	o := &RepoOverrides{Profile: p}
+	policy := c.RepoPolicy
+	if policy == nil {
+		return o
+	}
+	if rc.Profile != "" && rc.Profile != p.Name {
+		if selected {
+			o.reject("profile %q: profile %s was already selected", rc.Profile, p.Name)
+		} else if !contains(policy.Profiles, rc.Profile) {
+			o.reject("profile %q: not allowed", rc.Profile)
+		} else {
+			p = c.Profiles[rc.Profile]
+		}
+	}
+	res := *p
+	o.Profile = &res
+	if rc.TestFilter != "" {
+		res.TestFilter = rc.TestFilter
+	}
+	if rc.Timeout != "" {
+		max := policy.MaxTimeout
+		if max == 0 {
+			max = p.Timeout
+		}
+		timeout, err := time.ParseDuration(rc.Timeout)
+		if err != nil || timeout <= 0 {
+			o.reject("timeout %q: invalid duration", rc.Timeout)
+		} else if max > 0 && Duration(timeout) > max {
+			o.reject("timeout %q: exceeds the limit of %s", rc.Timeout, time.Duration(max))
+		} else {
+			res.Timeout = Duration(timeout)
+		}
+	}
+	if rc.ClusterSize != 0 {
+		max := policy.MaxClusterSize
+		if max == 0 {
+			max = p.Size()
+		}
+		if len(p.Roles) > 0 {
+			// the profile's roles are what its tests rely on, and they
+			// can't be resized
+			o.reject("cluster_size %d: profile %s assigns roles to its instances", rc.ClusterSize, p.Name)
+		} else if rc.ClusterSize < 0 || rc.ClusterSize > max {
+			o.reject("cluster_size %d: must be between 1 and %d", rc.ClusterSize, max)
+		} else {
+			res.ClusterSize = rc.ClusterSize
+		}
+	}
+	keys := make([]string, 0, len(rc.Env))
+	for k := range rc.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !contains(policy.AllowedEnv, k) {
+			o.reject("env %s: not allowed", k)
+			continue
+		}
+		o.Env = append(o.Env, k+"="+rc.Env[k])
+	}
+	return o
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyRepoConfig(t *testing.T) {
+	c := &Config{
+		Profiles: map[string]*Profile{
+			"smoke":  {Name: "smoke", ClusterSize: 1, Timeout: Duration(15 * time.Minute)},
+			"full":   {Name: "full", ClusterSize: 3, Timeout: Duration(time.Hour)},
+			"secret": {Name: "secret", ClusterSize: 1},
+			"roles":  {Name: "roles", Roles: []string{"controller", "worker"}},
+		},
+		RepoPolicy: &RepoPolicy{
+			Profiles:   []string{"smoke", "full"},
+			MaxTimeout: Duration(2 * time.Hour),
+			AllowedEnv: []string{"GOFLAGS"},
+		},
+	}
+	for _, test := range []struct {
+		name     string
+		profile  string
+		selected bool
+		rc       RepoConfig
+		expected Profile
+		env      []string
+		rejected []string
+	}{
+		{
+			name:     "no directives",
+			profile:  "smoke",
+			expected: *c.Profiles["smoke"],
+		},
+		{
+			name:     "allowed directives",
+			profile:  "smoke",
+			rc:       RepoConfig{Profile: "full", TestFilter: "BasicSuite", Timeout: "90m", ClusterSize: 2, Env: map[string]string{"GOFLAGS": "-race"}},
+			expected: Profile{Name: "full", ClusterSize: 2, TestFilter: "BasicSuite", Timeout: Duration(90 * time.Minute)},
+			env:      []string{"GOFLAGS=-race"},
+		},
+		{
+			name:     "profile not allowed",
+			profile:  "smoke",
+			rc:       RepoConfig{Profile: "secret"},
+			expected: *c.Profiles["smoke"],
+			rejected: []string{`profile "secret": not allowed`},
+		},
+		{
+			name:     "profile already selected",
+			profile:  "smoke",
+			selected: true,
+			rc:       RepoConfig{Profile: "full"},
+			expected: *c.Profiles["smoke"],
+			rejected: []string{`profile "full": profile smoke was already selected`},
+		},
+		{
+			name:     "limits exceeded",
+			profile:  "full",
+			rc:       RepoConfig{Timeout: "3h", ClusterSize: 4},
+			expected: *c.Profiles["full"],
+			rejected: []string{`timeout "3h": exceeds the limit of 2h0m0s`, "cluster_size 4: must be between 1 and 3"},
+		},
+		{
+			name:     "invalid values",
+			profile:  "full",
+			rc:       RepoConfig{Timeout: "-1m", ClusterSize: -1},
+			expected: *c.Profiles["full"],
+			rejected: []string{`timeout "-1m": invalid duration`, "cluster_size -1: must be between 1 and 3"},
+		},
+		{
+			name:     "cluster size of profile with roles",
+			profile:  "roles",
+			rc:       RepoConfig{ClusterSize: 1},
+			expected: *c.Profiles["roles"],
+			rejected: []string{"cluster_size 1: profile roles assigns roles to its instances"},
+		},
+		{
+			name:     "env not allowed",
+			profile:  "smoke",
+			rc:       RepoConfig{Env: map[string]string{"GOFLAGS": "-race", "PATH": "/tmp"}},
+			expected: *c.Profiles["smoke"],
+			env:      []string{"GOFLAGS=-race"},
+			rejected: []string{"env PATH: not allowed"},
+		},
+	} {
+		rc := test.rc
+		o := c.ApplyRepoConfig(c.Profiles[test.profile], &rc, test.selected)
+		if !reflect.DeepEqual(*o.Profile, test.expected) {
+			t.Errorf("%s: got profile %+v, expected %+v", test.name, *o.Profile, test.expected)
+		}
+		if !reflect.DeepEqual(o.Env, test.env) {
+			t.Errorf("%s: got env %q, expected %q", test.name, o.Env, test.env)
+		}
+		if !reflect.DeepEqual(o.Rejected, test.rejected) {
+			t.Errorf("%s: got rejected %q, expected %q", test.name, o.Rejected, test.rejected)
+		}
+	}
+	if !reflect.DeepEqual(*c.Profiles["smoke"], Profile{Name: "smoke", ClusterSize: 1, Timeout: Duration(15 * time.Minute)}) {
+		t.Errorf("the configured profile was modified: %+v", *c.Profiles["smoke"])
+	}
+}
+
+func TestApplyRepoConfigWithoutPolicy(t *testing.T) {
+	c := &Config{}
+	p := &Profile{Name: "smoke", ClusterSize: 1}
+	o := c.ApplyRepoConfig(p, &RepoConfig{ClusterSize: 3, TestFilter: "BasicSuite"}, false)
+	if o.Profile != p || o.Env != nil || o.Rejected != nil {
+		t.Errorf("repo config was applied without a policy: %+v", o)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"regexp"
+
+	"github.com/flynn/flynn-test/cluster"
+	c "gopkg.in/check.v1"
+)
+
+// controller is a client for the controller of the cluster under test, or
+// nil with controllerErr saying why if it couldn't be created. Tests get it
+// with requireController.
+var (
+	controller    *cluster.ControllerClient
+	controllerErr error
+)
+
+// requireController returns the controller client, failing the test if
+// there is none.
+func requireController(t *c.C) *cluster.ControllerClient {
+	if controller == nil {
+		t.Fatalf("no controller client: %s", controllerErr)
+	}
+	return controller
+}
+
+var flynnrcPattern = regexp.MustCompile(`^\s*(url|key|tls_pin)\s*=\s*"(.*)"`)
+
+// controllerFromFlynnrc creates a controller client from the first server in
+// a flynnrc written by `flynn server-add`.
+func controllerFromFlynnrc(path string) (*cluster.ControllerClient, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	conf := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if m := flynnrcPattern.FindStringSubmatch(s.Text()); m != nil {
+			if _, ok := conf[m[1]]; !ok {
+				conf[m[1]] = m[2]
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if conf["url"] == "" || conf["key"] == "" {
+		return nil, errors.New("flynnrc has no server")
+	}
+	return cluster.NewControllerClient(conf["url"], conf["key"], conf["tls_pin"])
+}
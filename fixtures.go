@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/flynn/flynn-test/cluster"
+	c "gopkg.in/check.v1"
+)
+
+// fixture is cluster state, such as a deployed app, which is set up the first
+// time a test requires it and then shared by later tests, across suites,
+// until it is invalidated by a destructive test.
+type fixture struct {
+	name     string
+	requires []*fixture
+	setup    func() error
+	teardown func()
+
+	mtx   sync.Mutex
+	ready bool
+}
+
+var (
+	fixturesMtx sync.Mutex
+	fixtures    []*fixture
+)
+
+// newFixture registers a fixture. Fixtures in requires are set up before
+// this one, and torn down after it.
+func newFixture(name string, setup func() error, teardown func(), requires ...*fixture) *fixture {
+	f := &fixture{name: name, requires: requires, setup: setup, teardown: teardown}
+	fixturesMtx.Lock()
+	fixtures = append(fixtures, f)
+	fixturesMtx.Unlock()
+	return f
+}
+
+// Require sets up the fixture and its dependencies if they aren't ready,
+// failing the test if any setup fails.
+func (f *fixture) Require(t *c.C) {
+	if err := f.ensure(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *fixture) ensure() error {
+	for _, dep := range f.requires {
+		if err := dep.ensure(); err != nil {
+			return err
+		}
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.ready {
+		return nil
+	}
+	if err := f.setup(); err != nil {
+		return fmt.Errorf("fixture %s setup failed: %s", f.name, err)
+	}
+	f.ready = true
+	return nil
+}
+
+func (f *fixture) reset() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.ready && f.teardown != nil {
+		f.teardown()
+	}
+	f.ready = false
+}
+
+// restoreCluster restores the snapshot of the cluster taken once it was
+// bootstrapped, if the profile snapshots it.
+var restoreCluster func() error
+
+// addHost boots an instance of role into the cluster, which joins it through
+// the discovery injected into it, returning its IP. It is nil for clusters
+// which weren't booted by the tests, such as external ones.
+var addHost func(role string) (string, error)
+
+// attachRawDisk attaches a blank raw disk of size bytes to instance i of the
+// cluster as a whole disk, returning its device in the guest, for tests of
+// volume drivers which need entire disks. Like addHost, it is nil for
+// clusters which weren't booted by the tests.
+var attachRawDisk func(i int, size int64) (string, error)
+
+// runGuestTests runs commands as tests inside instance i with the guest
+// harness, which enforces their timeouts in the guest. It is nil unless the
+// tests booted the cluster with --harness.
+var runGuestTests func(i int, tests []*cluster.GuestTest) ([]*cluster.GuestResult, error)
+
+// destructive marks the calling test as one which changes cluster state that
+// fixtures depend on. The cluster is restored to its bootstrapped snapshot
+// if there is one, otherwise fixtures are torn down, and they will be set up
+// again when next required.
+func destructive(t *c.C) {
+	if restoreCluster != nil {
+		t.Log("destructive test, restoring cluster snapshot")
+		if err := restoreCluster(); err != nil {
+			t.Fatalf("could not restore cluster snapshot: %s", err)
+		}
+		forgetFixtures()
+		return
+	}
+	t.Log("destructive test, tearing down fixtures")
+	teardownFixtures()
+}
+
+// requestRestore asks the runner at url to restore the cluster snapshot.
+func requestRestore(url string) error {
+	res, err := http.Post(url, "", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("runner could not restore cluster: %s", res.Status)
+	}
+	return nil
+}
+
+// forgetFixtures marks every fixture as not set up without tearing it down,
+// as the cluster was restored to a snapshot taken before any were.
+func forgetFixtures() {
+	fixturesMtx.Lock()
+	defer fixturesMtx.Unlock()
+	for _, f := range fixtures {
+		f.mtx.Lock()
+		f.ready = false
+		f.mtx.Unlock()
+	}
+}
+
+// teardownFixtures tears down every fixture which is set up, dependents
+// before the fixtures they require.
+func teardownFixtures() {
+	fixturesMtx.Lock()
+	defer fixturesMtx.Unlock()
+	// fixtures are registered after those they require
+	for i := len(fixtures) - 1; i >= 0; i-- {
+		fixtures[i].reset()
+	}
+}
@@ -0,0 +1,147 @@
+// flynn-test-harness runs test commands inside a guest, one after another,
+// reading them as a JSON array from stdin and writing a JSON result per test
+// to stdout as each finishes. Each test's timeout is enforced in the guest by
+// killing its process group, so a hung test can't outlive the run even if
+// the ssh session driving the harness drops. Results are also appended to
+// --results, from which they are collected after such a drop once the
+// harness creates the file named like it with a .done suffix.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// test and result mirror cluster.GuestTest and cluster.GuestResult.
+type test struct {
+	Name    string        `json:"name"`
+	Command string        `json:"command"`
+	Timeout time.Duration `json:"timeout"`
+}
+
+type result struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	ExitCode int           `json:"exit_code"`
+	Duration time.Duration `json:"duration"`
+	Output   string        `json:"output"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func main() {
+	resultsPath := flag.String("results", "", "file to also append results to")
+	maxOutput := flag.Int("max-output", 64*1024, "bytes of output kept from the end of each test's output")
+	flag.Parse()
+
+	// keep running tests if the ssh session goes away
+	signal.Ignore(syscall.SIGHUP, syscall.SIGPIPE)
+
+	var tests []*test
+	if err := json.NewDecoder(os.Stdin).Decode(&tests); err != nil {
+		log.Fatalf("could not decode tests: %s", err)
+	}
+	var file *json.Encoder
+	if *resultsPath != "" {
+		f, err := os.OpenFile(*resultsPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		file = json.NewEncoder(f)
+	}
+	out := json.NewEncoder(os.Stdout)
+	for _, t := range tests {
+		res := run(t, *maxOutput)
+		if file != nil {
+			file.Encode(res)
+		}
+		out.Encode(res)
+	}
+	if *resultsPath != "" {
+		if f, err := os.Create(*resultsPath + ".done"); err == nil {
+			f.Close()
+		}
+	}
+}
+
+func run(t *test, maxOutput int) *result {
+	res := &result{Name: t.Name}
+	out := &tailBuffer{max: maxOutput}
+	cmd := exec.Command("/bin/sh", "-c", t.Command)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		res.Status = "fail"
+		res.ExitCode = -1
+		res.Error = err.Error()
+		return res
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var timeout <-chan time.Time
+	if t.Timeout > 0 {
+		timer := time.NewTimer(t.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case err = <-done:
+	case <-timeout:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		res.Status = "timeout"
+		res.ExitCode = -1
+		res.Error = fmt.Sprintf("timed out after %s", t.Timeout)
+	}
+	res.Duration = time.Since(start)
+	res.Output = out.String()
+	if res.Status != "" {
+		return res
+	}
+	if err == nil {
+		res.Status = "pass"
+		return res
+	}
+	res.Status = "fail"
+	res.ExitCode = -1
+	res.Error = err.Error()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			res.ExitCode = status.ExitStatus()
+		}
+	}
+	return res
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	buf     []byte
+	max     int
+	dropped int
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.dropped += len(b.buf) - b.max
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.max:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	if b.dropped > 0 {
+		return fmt.Sprintf("[%d bytes of output dropped]\n%s", b.dropped, b.buf)
+	}
+	return string(b.buf)
+}
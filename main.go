@@ -5,19 +5,24 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	mathrand "math/rand"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
 	"text/template"
+	"time"
 
 	"code.google.com/p/go.crypto/ssh"
 	"github.com/flynn/flynn-test/arg"
 	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/config"
 	"github.com/flynn/flynn-test/util"
 	"gopkg.in/check.v1"
 )
@@ -33,36 +38,182 @@ var gitEnv []string
 var args *arg.Args
 var flynnrc string
 
+// random is seeded with --seed so that the random names used by tests can
+// be reproduced.
+var random *mathrand.Rand
+
+// features are the feature flags of the run, set by the profile and
+// --features, which tests query to only exercise behaviour behind a flag
+// when it is set:
+//
+//	if !features.Enabled("router-v2") {
+//		t.Skip("router-v2 is not enabled")
+//	}
+var features config.Features
+
 func init() {
 	args = arg.Parse()
 	log.SetFlags(log.Lshortfile)
 }
 
 func main() {
+	if args.ListRetries {
+		json.NewEncoder(os.Stdout).Encode(retryBudgets)
+		return
+	}
+	if args.ListOwners {
+		json.NewEncoder(os.Stdout).Encode(testOwners)
+		return
+	}
+	if args.Cleanup {
+		if err := cluster.CleanupOrphans(args.BootConfig, args.DockerFS, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if args.ListTests {
+		json.NewEncoder(os.Stdout).Encode(check.ListAll(&check.RunConf{Filter: args.Filter}))
+		return
+	}
+
+	cluster.HandleSignals()
+	defer cluster.CleanupOnPanic()
+
+	// registered first so it runs after the other deferred cleanup
+	var failed bool
+	defer func() {
+		if failed {
+			os.Exit(1)
+		}
+	}()
+
+	conf, err := args.Config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	profile, err := conf.Profile(args.Profile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	flags, err := config.ParseFeatures(args.Features)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if features = profile.Features.Merge(flags); len(features) > 0 {
+		fmt.Printf("using feature flags %s\n", features)
+	}
+	filter := args.Filter
+	if filter == "" {
+		filter = profile.TestFilter
+	}
+	seed := args.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	fmt.Printf("using seed %d\n", seed)
+	random = mathrand.New(mathrand.NewSource(seed))
+	if args.Shard != "" {
+		if filter, err = shardFilter(args.Shard, filter, args.Seed); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var restore func() error
 	flynnrc = args.Flynnrc
 	if flynnrc == "" {
-		c := cluster.New(args.BootConfig, os.Stdout)
-		dockerfs := args.DockerFS
-		if dockerfs == "" {
-			var err error
-			if dockerfs, err = c.BuildFlynn("", util.Repos); err != nil {
-				log.Fatal("could not build flynn:", err)
+		bc := args.BootConfig
+		bc.Roles = conf.Roles
+		bc.BootProfiles = conf.BootProfiles
+		if profile.Placement != "" && bc.Placement == "" {
+			bc.Placement = profile.Placement
+		}
+		bc.Seed = seed
+		bc.RunID = util.SeededString(random, 8)
+		if args.Kill {
+			defer cluster.CleanupRun(bc.RunID)
+		}
+		c := cluster.New(bc, os.Stdout)
+		c.ForwardAgent = conf.SSHAgent
+		c.DeployKey = conf.DeployKey
+		c.Downloads = conf.Downloads
+		c.PinnedImages = conf.PinnedImages
+		if args.External != "" {
+			if profile.SnapshotRestore {
+				log.Fatal("snapshot restore is not supported with an external cluster")
 			}
-			if !args.KeepDockerFS {
-				defer os.RemoveAll(dockerfs)
+			if err := c.BootExternal(strings.Split(args.External, ",")); err != nil {
+				log.Fatal("could not bootstrap external cluster: ", err)
+			}
+		} else {
+			dockerfs := args.DockerFS
+			if dockerfs == "" {
+				var err error
+				if dockerfs, err = c.BuildFlynn("", util.Repos); err != nil {
+					log.Fatal("could not build flynn:", err)
+				}
+				if !args.KeepDockerFS {
+					defer os.RemoveAll(dockerfs)
+				}
+			}
+			roles := profile.Roles
+			if args.ClusterSize > 0 {
+				roles = cluster.WorkerRoles(args.ClusterSize)
+			} else if len(roles) == 0 {
+				size := profile.ClusterSize
+				if size == 0 {
+					size = 1
+				}
+				roles = cluster.WorkerRoles(size)
+			}
+			if err := c.BootRoles(dockerfs, roles); err != nil {
+				log.Fatal("could not boot cluster: ", err)
+			}
+			addHost = func(role string) (string, error) {
+				inst, err := c.AddInstance(dockerfs, role)
+				if err != nil {
+					return "", err
+				}
+				return inst.IP(), nil
+			}
+			attachRawDisk = func(i int, size int64) (string, error) {
+				d, err := c.AttachRawDisk(i, size)
+				if err != nil {
+					return "", err
+				}
+				return d.GuestPath, nil
+			}
+			if bc.Harness != "" {
+				runGuestTests = func(i int, tests []*cluster.GuestTest) ([]*cluster.GuestResult, error) {
+					var results []*cluster.GuestResult
+					err := c.RunGuestTests(i, tests, func(res *cluster.GuestResult) {
+						results = append(results, res)
+					})
+					return results, err
+				}
 			}
-		}
-		if err := c.Boot(dockerfs, 1); err != nil {
-			log.Fatal("could not boot cluster: ", err)
 		}
 		if args.Kill {
 			defer c.Shutdown()
 		}
 
+		// the sandbox is removed even if the cluster is kept
+		defer c.RemoveCLI()
 		if err := createFlynnrc(c); err != nil {
 			log.Fatal(err)
 		}
-		defer os.RemoveAll(flynnrc)
+		if profile.SnapshotRestore {
+			if err := c.Snapshot(cluster.BootstrapSnapshot); err != nil {
+				log.Fatal("could not snapshot cluster: ", err)
+			}
+			restore = func() error { return c.Restore(cluster.BootstrapSnapshot) }
+		}
+	} else if args.RestoreURL != "" {
+		restore = func() error { return requestRestore(args.RestoreURL) }
+	}
+
+	// only the tests using the client fail without it
+	if controller, controllerErr = controllerFromFlynnrc(flynnrc); controllerErr != nil {
+		fmt.Printf("could not create controller client: %s\n", controllerErr)
 	}
 
 	ssh, err := genSSHKey()
@@ -76,13 +227,58 @@ func main() {
 	if keyAdd.Err != nil {
 		log.Fatalf("Error during `%s`:\n%s%s", strings.Join(keyAdd.Cmd, " "), keyAdd.Output, keyAdd.Err)
 	}
+	if restore != nil {
+		restoreCluster = func() error {
+			if err := restore(); err != nil {
+				return err
+			}
+			// the snapshot was taken before the key was added
+			if res := flynn("", "key-add", ssh.Pub); res.Err != nil {
+				return fmt.Errorf("could not add key: %s: %s", res.Err, res.Output)
+			}
+			return nil
+		}
+	}
 
 	res := check.RunAll(&check.RunConf{
 		Stream:      true,
 		Verbose:     true,
+		Filter:      filter,
 		KeepWorkDir: args.Debug,
 	})
+	teardownFixtures()
 	fmt.Println(res)
+	failed = !res.Passed()
+}
+
+// shardFilter returns a filter matching the tests in shard "i/n" of the tests
+// matching filter. Tests are shuffled before being assigned to shards if seed
+// is set, which every shard must be given.
+func shardFilter(shard, filter string, seed int64) (string, error) {
+	var i, n int
+	if _, err := fmt.Sscanf(shard, "%d/%d", &i, &n); err != nil || n < 1 || i < 0 || i >= n {
+		return "", fmt.Errorf("invalid shard %q, expected i/n", shard)
+	}
+	all := check.ListAll(&check.RunConf{Filter: filter})
+	if seed != 0 {
+		perm := mathrand.New(mathrand.NewSource(seed)).Perm(len(all))
+		shuffled := make([]string, len(all))
+		for j, k := range perm {
+			shuffled[j] = all[k]
+		}
+		all = shuffled
+	}
+	var names []string
+	for j, name := range all {
+		if j%n == i {
+			names = append(names, regexp.QuoteMeta(name))
+		}
+	}
+	if len(names) == 0 {
+		// match nothing rather than everything
+		return "^$", nil
+	}
+	return "^(" + strings.Join(names, "|") + ")$", nil
 }
 
 type sshData struct {
@@ -146,15 +342,11 @@ func genSSHKey() (*sshData, error) {
 }
 
 func createFlynnrc(c *cluster.Cluster) error {
-	tmpfile, err := ioutil.TempFile("", "flynnrc-")
-	if err != nil {
+	if err := c.InstallCLI(args.CLI); err != nil {
 		return err
 	}
-	flynnrc = tmpfile.Name()
-
-	githost := fmt.Sprintf("%s:2222", c.ControllerDomain)
-	url := fmt.Sprintf("https://%s:443", c.ControllerDomain)
-	return flynn("", "server-add", "-g", githost, "-p", c.ControllerPin, "default", url, c.ControllerKey).Err
+	flynnrc = c.Flynnrc()
+	return nil
 }
 
 type CmdResult struct {
@@ -163,9 +355,19 @@ type CmdResult struct {
 	Err    error
 }
 
+// cmdError describes a failed command with its output.
+func cmdError(res *CmdResult) error {
+	return fmt.Errorf("`%s` failed: %s\n%s", strings.Join(res.Cmd, " "), res.Err, res.Output)
+}
+
+// flynn runs the CLI of the cluster's sandbox, or args.CLI if the flynnrc
+// wasn't created in one, such as a flynnrc given with --flynnrc by hand.
 func flynn(dir string, cmdArgs ...string) *CmdResult {
-	cmd := exec.Command(args.CLI, cmdArgs...)
-	cmd.Env = append(os.Environ(), "FLYNNRC="+flynnrc)
+	cmd := cluster.SandboxCommand(flynnrc, cmdArgs...)
+	if cmd == nil {
+		cmd = exec.Command(args.CLI, cmdArgs...)
+		cmd.Env = append(os.Environ(), "FLYNNRC="+flynnrc)
+	}
 	cmd.Dir = dir
 	return run(cmd)
 }
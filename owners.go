@@ -0,0 +1,17 @@
+package main
+
+// testOwners maps tests, or whole suites, to the GitHub users and teams, such
+// as "titanous" or "flynn/core", who own them. The runner mentions the owners
+// of tests which fail on master or in a pull request, and shows owners in
+// its dashboard.
+var testOwners = make(map[string][]string)
+
+// owners sets the owners of a test, or of every test of a suite which doesn't
+// have its own, and is intended to be used at the package level next to the
+// test or suite:
+//
+//	var _ = owners("BasicSuite", "flynn/core")
+func owners(test string, handles ...string) bool {
+	testOwners[test] = handles
+	return true
+}
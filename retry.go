@@ -0,0 +1,15 @@
+package main
+
+// retryBudgets maps test names to the number of times the runner may rerun
+// the test on a fresh cluster if it fails. A test which passes on a rerun is
+// reported as flaky rather than passed.
+var retryBudgets = make(map[string]int)
+
+// retry sets the retry budget of a test, and is intended to be used at the
+// package level next to the test:
+//
+//	var _ = retry("BasicSuite.TestBasic", 2)
+func retry(test string, budget int) bool {
+	retryBudgets[test] = budget
+	return true
+}
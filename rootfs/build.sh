@@ -21,7 +21,24 @@ curl -L http://cdimage.ubuntu.com/ubuntu-core/releases/14.04/release/ubuntu-core
 sudo chroot $dir bash < "$src_dir/setup.sh"
 
 sudo cp $dir/boot/vmlinuz-* $build_dir/vmlinuz
+sudo cp $dir/boot/initrd.img-* $build_dir/initrd.img
+kernel_version=$(ls $dir/lib/modules | head -n 1)
 
 cleanup
 
 zerofree $build_dir/rootfs.img
+
+# write the image catalog used to verify the kernel and initrd before boot
+checksum() {
+  sha256sum $build_dir/$1 | cut -d " " -f 1
+}
+cat > $build_dir/images.json <<EOF
+{
+  "kernel_version": "$kernel_version",
+  "network_config": "ifupdown",
+  "checksums": {
+    "vmlinuz": "$(checksum vmlinuz)",
+    "initrd.img": "$(checksum initrd.img)"
+  }
+}
+EOF
@@ -24,6 +24,10 @@ echo "LABEL=rootfs / ext4 defaults 0 1" > /etc/fstab
 echo "LABEL=dockerfs /var/lib/docker btrfs defaults 0 0" >> /etc/fstab
 echo "netfs /etc/network/interfaces.d 9p trans=virtio 0 0" >> /etc/fstab
 
+# report kernel panics to the host via the pvpanic device
+echo pvpanic >> /etc/modules
+echo "kernel.panic_on_oops = 1" > /etc/sysctl.d/60-panic.conf
+
 # configure hosts and dns resolution
 echo "127.0.0.1 localhost localhost.localdomain" > /etc/hosts
 echo -e "nameserver 8.8.8.8\nnameserver 8.8.4.4" > /etc/resolv.conf
@@ -54,16 +58,66 @@ apt-get install linux-generic-lts-trusty -y -o Dpkg::Options::='--force-confdef'
 # install ssh server and go deps
 apt-get install -y apt-transport-https openssh-server mercurial git make curl
 rm /etc/ssh/ssh_host_*
+sed -i 's/^#\?PasswordAuthentication .*/PasswordAuthentication no/' /etc/ssh/sshd_config
 
-# add script that regenerates missing ssh host keys on boot
+# add script that installs the ssh host key and authorized key generated by
+# the runner for each run, or regenerates missing ssh host keys on boot
 cat >/etc/init/ssh-hostkeys.conf <<EOF
 start on starting ssh
 
 script
-  test -f /etc/ssh/ssh_host_dsa_key || dpkg-reconfigure openssh-server
+  keys=/etc/network/interfaces.d/ssh
+  if [ -f \$keys/ssh_host_rsa_key ]; then
+    # only offer the host key the runner verifies
+    rm -f /etc/ssh/ssh_host_*
+    install -m 600 \$keys/ssh_host_rsa_key /etc/ssh/ssh_host_rsa_key
+    sed -i '/^HostKey /d' /etc/ssh/sshd_config
+    echo "HostKey /etc/ssh/ssh_host_rsa_key" >> /etc/ssh/sshd_config
+  else
+    test -f /etc/ssh/ssh_host_dsa_key || dpkg-reconfigure openssh-server
+  fi
+  if [ -f \$keys/authorized_keys ]; then
+    install -d -m 700 -o ubuntu -g ubuntu /home/ubuntu/.ssh
+    install -m 600 -o ubuntu -g ubuntu \$keys/authorized_keys /home/ubuntu/.ssh/authorized_keys
+  fi
+end script
+EOF
+
+# add script that forwards syslog to the collector of the runner, if the
+# runner configured one
+cat >/etc/init/syslog-forward.conf <<EOF
+start on starting rsyslog
+
+script
+  target=/etc/network/interfaces.d/syslog/target
+  if [ -f \$target ]; then
+    cat > /etc/rsyslog.d/60-forward.conf <<CONF
+\\$ActionQueueType LinkedList
+\\$ActionResumeRetryCount -1
+*.* @@\$(cat \$target)
+CONF
+  else
+    rm -f /etc/rsyslog.d/60-forward.conf
+  fi
 end script
 EOF
 
+# announce on the serial console once sshd has started, which the runner
+# waits for before connecting, and run a getty on it for debugging
+cat >/etc/init/boot-ready.conf <<EOF
+start on started ssh
+
+task
+exec echo "flynn-test: boot complete" > /dev/ttyS0
+EOF
+cat >/etc/init/ttyS0.conf <<EOF
+start on stopped rc RUNLEVEL=[2345]
+stop on runlevel [!2345]
+
+respawn
+exec /sbin/getty -L 115200 ttyS0 vt102
+EOF
+
 # install docker
 # apparmor is required - see https://github.com/dotcloud/docker/issues/4734
 apt-key adv --keyserver hkp://keyserver.ubuntu.com:80 --recv-keys 36A1D7869245C8950F966E92D8576A8BA88D21E9
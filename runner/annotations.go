@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Annotation is a note left on a run by a person, such as "known infra
+// outage". Runs with labelled annotations are left out of flakiness scores.
+// Annotations are kept apart from builds so that a running build saving its
+// progress doesn't drop them.
+type Annotation struct {
+	Author  string    `json:"author,omitempty"`
+	Note    string    `json:"note,omitempty"`
+	Labels  []string  `json:"labels,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func getAnnotations(tx *bolt.Tx, id string) []*Annotation {
+	var list []*Annotation
+	if v := tx.Bucket([]byte("annotations")).Get([]byte(id)); v != nil {
+		json.Unmarshal(v, &list)
+	}
+	return list
+}
+
+// excluded returns whether a run with the given annotations is left out of
+// statistics.
+func excluded(list []*Annotation) bool {
+	for _, a := range list {
+		if len(a.Labels) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Runner) annotate(id string, a *Annotation) error {
+	a.Note = strings.TrimSpace(a.Note)
+	var labels []string
+	for _, l := range a.Labels {
+		if l = strings.TrimSpace(l); l != "" {
+			labels = append(labels, l)
+		}
+	}
+	a.Labels = labels
+	if a.Note == "" && len(a.Labels) == 0 {
+		return errors.New("an annotation needs a note or labels")
+	}
+	a.Created = time.Now()
+	return r.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("builds")).Get([]byte(id)) == nil {
+			return fmt.Errorf("build %s not found", id)
+		}
+		list := append(getAnnotations(tx, id), a)
+		val, err := json.Marshal(list)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("annotations")).Put([]byte(id), val)
+	})
+}
+
+// loadAnnotations sets the annotations of builds.
+func (r *Runner) loadAnnotations(builds ...*Build) {
+	r.db.View(func(tx *bolt.Tx) error {
+		for _, b := range builds {
+			b.Annotations = getAnnotations(tx, b.Id)
+		}
+		return nil
+	})
+}
+
+// buildAnnotations lists the annotations of a build, or adds one from a JSON
+// body or the dashboard form, in which labels are comma separated.
+func (r *Runner) buildAnnotations(w http.ResponseWriter, req *http.Request, id string) {
+	if req.Method == "GET" {
+		var list []*Annotation
+		r.db.View(func(tx *bolt.Tx) error {
+			list = getAnnotations(tx, id)
+			return nil
+		})
+		if list == nil {
+			list = []*Annotation{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed\n", 405)
+		return
+	}
+	a := &Annotation{}
+	isJSON := strings.HasPrefix(req.Header.Get("Content-Type"), "application/json")
+	if isJSON {
+		if err := json.NewDecoder(req.Body).Decode(a); err != nil {
+			http.Error(w, fmt.Sprintf("invalid JSON: %s\n", err), 400)
+			return
+		}
+	} else {
+		a.Note = req.FormValue("note")
+		a.Labels = strings.Split(req.FormValue("labels"), ",")
+	}
+	if r.oauth != nil {
+		if s := r.oauth.session(req); s != nil {
+			a.Author = s.User
+		}
+	}
+	if err := r.annotate(id, a); err != nil {
+		http.Error(w, err.Error()+"\n", 400)
+		return
+	}
+	if !isJSON {
+		http.Redirect(w, req, "/runs/"+id, 303)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// approveCommand is commented on a pull request by a trusted user to run the
+// builds of a fork which are awaiting approval.
+const approveCommand = "/flynn-ci approve"
+
+// untrusted reports whether e is a pull request from a fork by a user who is
+// not trusted, whose builds must be approved before they run arbitrary code
+// on the runner.
+func (r *Runner) untrusted(e *PullRequestEvent) bool {
+	return fromFork(e) && !r.trusted(e.PullRequest.User.Login)
+}
+
+// fromFork reports whether the head of e is not in the repo itself, including
+// when GitHub does not say where it is.
+func fromFork(e *PullRequestEvent) bool {
+	head := e.PullRequest.Head.Repo
+	return head == nil || head.Id != e.Repository.Id
+}
+
+// gitlabUntrusted reports whether e is a merge request whose source branch is
+// not in the project itself, including when GitLab does not say where it is.
+func gitlabUntrusted(e *GitlabMergeRequestEvent) bool {
+	src := e.ObjectAttributes.Source
+	return src == nil || e.Project == nil || src.PathWithNamespace != e.Project.PathWithNamespace
+}
+
+// trusted reports whether user is a member of the flynn organization or one
+// of the configured trusted users.
+func (r *Runner) trusted(user string) bool {
+	for _, u := range r.config.TrustedUsers {
+		if u == user {
+			return true
+		}
+	}
+	member, err := r.github.orgMember("flynn", user)
+	if err != nil {
+		log.Printf("could not check membership of %s: %s\n", user, err)
+	}
+	return member
+}
+
+func (g *githubClient) orgMember(org, user string) (bool, error) {
+	err := g.request("GET", fmt.Sprintf("/orgs/%s/members/%s", org, user), nil, nil)
+	if err == errNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// startBuild runs b, or holds it until it is approved if it is untrusted.
+func (r *Runner) startBuild(b *Build) {
+	if !b.Untrusted || b.ApprovedBy != "" {
+		if err := r.enqueue(b); err != nil {
+			log.Printf("could not queue build of %s[%s], it will not survive a restart: %s\n", b.Repo, b.Commit, err)
+			go r.runBuild(b)
+		}
+		return
+	}
+	if err := r.awaitApproval(b); err != nil {
+		log.Printf("could not hold build of %s[%s] for approval: %s\n", b.Repo, b.Commit, err)
+		return
+	}
+	log.Printf("build %s of %s[%s] is awaiting approval\n", b.Id, b.Repo, b.Commit)
+	r.postComment(b, map[string]interface{}{
+		"Marker":           commentMarker,
+		"AwaitingApproval": true,
+		"Commit":           b.Commit,
+		"Command":          approveCommand,
+	})
+}
+
+func (r *Runner) awaitApproval(b *Build) error {
+	b.State = "awaiting_approval"
+	if err := r.save(b); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		val, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("awaiting-approval")).Put([]byte(b.Id), val)
+	})
+}
+
+func (r *Runner) awaitingApproval() []*Build {
+	var builds []*Build
+	r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("awaiting-approval")).ForEach(func(k, v []byte) error {
+			b := &Build{}
+			if err := json.Unmarshal(v, b); err == nil {
+				builds = append(builds, b)
+			}
+			return nil
+		})
+	})
+	return builds
+}
+
+// approve runs the build with the given id which is awaiting approval.
+func (r *Runner) approve(id, approver string) (*Build, error) {
+	var b *Build
+	if err := r.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte("awaiting-approval"))
+		val := bkt.Get([]byte(id))
+		if val == nil {
+			return nil
+		}
+		b = &Build{}
+		if err := json.Unmarshal(val, b); err != nil {
+			return err
+		}
+		return bkt.Delete([]byte(id))
+	}); err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, fmt.Errorf("build %s is not awaiting approval", id)
+	}
+	log.Printf("build %s approved by %s\n", b.Id, approver)
+	b.ApprovedBy = approver
+	if err := r.enqueue(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// handleComment approves the builds of a pull request awaiting approval when
+// a trusted user comments approveCommand on it.
+func (r *Runner) handleComment(e *IssueCommentEvent) {
+	if e.Action != "created" || e.Issue.PullRequest == nil {
+		return
+	}
+	if strings.TrimSpace(e.Comment.Body) != approveCommand {
+		return
+	}
+	user := e.Comment.User.Login
+	if !r.trusted(user) {
+		log.Printf("ignoring approval of %s#%d by untrusted user %s\n", e.Repo(), e.Issue.Number, user)
+		return
+	}
+	for _, b := range r.awaitingApproval() {
+		if b.Repo == e.Repo() && b.PullRequest == e.Issue.Number {
+			if _, err := r.approve(b.Id, user); err != nil {
+				log.Printf("could not approve build %s: %s\n", b.Id, err)
+			}
+		}
+	}
+}
+
+var awaitingTemplate = template.Must(template.New("awaiting").Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Builds awaiting approval - flynn-test</title>
+</head>
+<body>
+<h1>Builds awaiting approval</h1>
+{{range .}}
+<form method="POST" action="/builds/{{.Id}}/approve">
+<p>{{.Repo}}#{{.PullRequest}} {{.Commit}} <input type="submit" value="Approve"></p>
+</form>
+{{else}}
+<p>No builds are awaiting approval.</p>
+{{end}}
+</body>
+</html>
+`[1:]))
+
+func (r *Runner) listAwaiting(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := awaitingTemplate.Execute(w, r.awaitingApproval()); err != nil {
+		log.Println("dashboard: error rendering builds awaiting approval:", err)
+	}
+}
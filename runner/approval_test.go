@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flynn/flynn-test/config"
+)
+
+func TestUntrusted(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/orgs/flynn/members/member" {
+			w.WriteHeader(204)
+			return
+		}
+		http.NotFound(w, req)
+	}))
+	defer srv.Close()
+	defer func(api string) { githubAPI = api }(githubAPI)
+	githubAPI = srv.URL
+
+	r := &Runner{
+		config: &config.Config{TrustedUsers: []string{"friend"}},
+		github: &githubClient{token: "token"},
+	}
+	fork, base := &Repository{Id: 2}, &Repository{Id: 1}
+	for _, test := range []struct {
+		name      string
+		head      *Repository
+		user      string
+		fork      bool
+		untrusted bool
+	}{
+		{"branch by outsider", base, "outsider", false, false},
+		{"fork by member", fork, "member", true, false},
+		{"fork by trusted user", fork, "friend", true, false},
+		{"fork by outsider", fork, "outsider", true, true},
+		{"deleted fork by outsider", nil, "outsider", true, true},
+	} {
+		e := &PullRequestEvent{
+			PullRequest: &PullRequest{User: &PRUser{Login: test.user}, Head: &PRBranch{Repo: test.head}},
+			Repository:  base,
+		}
+		if f := fromFork(e); f != test.fork {
+			t.Errorf("%s: fromFork returned %t", test.name, f)
+		}
+		if u := r.untrusted(e); u != test.untrusted {
+			t.Errorf("%s: untrusted returned %t", test.name, u)
+		}
+		// the VMs of every fork's builds are restricted
+		b := &Build{Fork: test.fork, Untrusted: test.untrusted}
+		if b.restricted() != test.fork {
+			t.Errorf("%s: restricted returned %t", test.name, b.restricted())
+		}
+	}
+}
+
+func TestGitlabUntrusted(t *testing.T) {
+	project := &GitlabProject{PathWithNamespace: "flynn/flynn"}
+	for _, test := range []struct {
+		name      string
+		source    *GitlabProject
+		project   *GitlabProject
+		untrusted bool
+	}{
+		{"branch", &GitlabProject{PathWithNamespace: "flynn/flynn"}, project, false},
+		{"fork", &GitlabProject{PathWithNamespace: "someone/flynn"}, project, true},
+		{"unknown source", nil, project, true},
+		{"unknown project", &GitlabProject{PathWithNamespace: "flynn/flynn"}, nil, true},
+	} {
+		e := &GitlabMergeRequestEvent{
+			Project:          test.project,
+			ObjectAttributes: &GitlabMergeRequestAttr{Source: test.source},
+		}
+		if u := gitlabUntrusted(e); u != test.untrusted {
+			t.Errorf("%s: gitlabUntrusted returned %t", test.name, u)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// archiveBatch limits the builds archived at a time, so the db isn't held up
+// by a large backlog.
+var archiveBatch = 100
+
+func archiveName(id string) string {
+	return "private/archive/builds/" + id + ".json"
+}
+
+// startArchival periodically archives builds older than the configured
+// retention.
+func (r *Runner) startArchival() {
+	conf := r.config.Archive
+	if conf == nil {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(conf.Interval)) {
+			if err := r.archive(time.Now().Add(-time.Duration(conf.After))); err != nil {
+				log.Printf("archival failed: %s\n", err)
+			}
+		}
+	}()
+}
+
+// archive moves the details of finished builds created before cutoff to the
+// artifact store, keeping a summary of them in the db.
+func (r *Runner) archive(cutoff time.Time) error {
+	var builds []*Build
+	if err := r.db.View(func(tx *bolt.Tx) error {
+		all := tx.Bucket([]byte("builds"))
+		c := tx.Bucket([]byte(createdIndex)).Cursor()
+		upper := []byte(createdKey(cutoff))
+		for k, id := c.First(); k != nil && bytes.Compare(k, upper) < 0 && len(builds) < archiveBatch; k, id = c.Next() {
+			val := all.Get(id)
+			if val == nil {
+				continue
+			}
+			b := &Build{}
+			if err := json.Unmarshal(val, b); err != nil {
+				return err
+			}
+			if b.Archive == "" && b.State != "pending" && b.State != "awaiting_approval" {
+				builds = append(builds, b)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, b := range builds {
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		name := archiveName(b.Id)
+		if err := r.store.Put(name, bytes.NewReader(data), "application/json", false, runLabels(b)); err != nil {
+			return err
+		}
+		if err := r.save(b.summary(name)); err != nil {
+			return err
+		}
+	}
+	if len(builds) > 0 {
+		log.Printf("archived %d builds\n", len(builds))
+	}
+	return nil
+}
+
+// summary returns the compact record of b kept once it has been archived as
+// name, with the fields builds are listed and filtered by.
+func (b *Build) summary(name string) *Build {
+	s := *b
+	s.Archive = name
+	s.Results = nil
+	s.Instances = nil
+	s.Env = nil
+	s.RepoEnv = nil
+	s.RejectedDirectives = nil
+	s.Usage = nil
+	return &s
+}
+
+// loadArchived returns the archived record of the summary b, or b itself if
+// it can't be loaded.
+func (r *Runner) loadArchived(b *Build) *Build {
+	data, err := r.store.Get(b.Archive)
+	if err != nil {
+		log.Printf("could not load archived build %s: %s\n", b.Id, err)
+		return b
+	}
+	archived := &Build{}
+	if err := json.Unmarshal(data, archived); err != nil {
+		log.Printf("could not load archived build %s: %s\n", b.Id, err)
+		return b
+	}
+	return archived
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Artifact struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+// uploadArtifacts uploads the files tests saved to dir, attaching them to
+// the result of the test which saved them.
+func (r *Runner) uploadArtifacts(dir string, m *manifest, results []*TestResult) []*Artifact {
+	byTest := make(map[string]*TestResult, len(results))
+	for _, res := range results {
+		byTest[res.Name] = res
+	}
+	var artifacts []*Artifact
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("could not read artifact %s: %s\n", rel, err)
+			return nil
+		}
+		defer f.Close()
+		contentType := mime.TypeByExtension(filepath.Ext(path))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		url, err := r.putBlob(m, "artifacts/"+filepath.ToSlash(rel), f, contentType, true)
+		if err != nil {
+			log.Printf("could not upload artifact %s: %s\n", rel, err)
+			return nil
+		}
+		a := &Artifact{Name: rel, Url: url}
+		artifacts = append(artifacts, a)
+		// artifacts are saved in a directory named after the test
+		if res, ok := byTest[strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]]; ok {
+			res.Artifacts = append(res.Artifacts, a)
+		}
+		return nil
+	})
+	return artifacts
+}
+
+// artifactsCmd downloads the artifacts of a run whose names match pattern,
+// or all of them, resuming partial downloads and verifying them against the
+// checksums of their blobs:
+//
+//	runner artifacts get [--url http://localhost] [--out DIR] <run-id> [pattern]
+func artifactsCmd(cmdArgs []string) error {
+	if len(cmdArgs) == 0 || cmdArgs[0] != "get" {
+		return errors.New("usage: runner artifacts get [--url URL] [--out DIR] <run-id> [pattern]")
+	}
+	fs := flag.NewFlagSet("artifacts", flag.ExitOnError)
+	u := fs.String("url", "http://localhost", "URL of the runner")
+	outDir := fs.String("out", "", "directory to download the artifacts to, defaulting to the run ID")
+	fs.Parse(cmdArgs[1:])
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errors.New("usage: runner artifacts get [--url URL] [--out DIR] <run-id> [pattern]")
+	}
+	id, pattern := fs.Arg(0), fs.Arg(1)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %s", pattern, err)
+	}
+	if *outDir == "" {
+		*outDir = id
+	}
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", *u+"/builds/"+id, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("", os.Getenv("API_TOKEN"))
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	b := &Build{}
+	err = json.NewDecoder(res.Body).Decode(b)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("could not get run %s: %s", id, res.Status)
+	}
+	if err != nil {
+		return err
+	}
+	if b.LogUrl == "" {
+		return fmt.Errorf("run %s has no uploaded artifacts", id)
+	}
+
+	// the manifest and blobs are stored beside the log
+	base := b.LogUrl[:strings.LastIndex(b.LogUrl, "/")+1]
+	res, err = http.Get(strings.TrimSuffix(b.LogUrl, ".html") + ".manifest.json")
+	if err != nil {
+		return err
+	}
+	m := &manifest{}
+	err = json.NewDecoder(res.Body).Decode(m)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("could not get the artifact manifest of run %s: %s", id, res.Status)
+	}
+	if err != nil {
+		return err
+	}
+
+	var n int
+	for _, e := range m.Artifacts {
+		if matched, _ := path.Match(pattern, e.Name); pattern != "" && !matched && !strings.HasPrefix(e.Name, pattern+"/") {
+			continue
+		}
+		n++
+		if strings.HasPrefix(e.Blob, "private/") {
+			fmt.Fprintf(os.Stderr, "skipping %s, which is private\n", e.Name)
+			continue
+		}
+		dst := filepath.Join(*outDir, filepath.FromSlash(e.Name))
+		if err := downloadBlob(base+e.Blob, dst, e); err != nil {
+			return fmt.Errorf("could not download %s: %s", e.Name, err)
+		}
+	}
+	if n == 0 {
+		return fmt.Errorf("no artifacts of run %s match %q", id, pattern)
+	}
+	return nil
+}
+
+// downloadAttempts is how many times a download is resumed after the
+// connection drops before giving up.
+const downloadAttempts = 10
+
+// downloadBlob downloads the blob of e from url to dst, through dst.part so
+// that an interrupted download resumes where it left off, and checks it
+// against the SHA256 the blob is named after.
+func downloadBlob(url, dst string, e *manifestEntry) error {
+	if sum, err := fileSHA256(dst); err == nil && "blobs/sha256/"+sum == e.Blob {
+		fmt.Printf("%s already downloaded\n", e.Name)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	part := dst + ".part"
+	var err error
+	for i := 0; i < downloadAttempts; i++ {
+		if i > 0 {
+			fmt.Fprintf(os.Stderr, "download of %s interrupted, resuming: %s\n", e.Name, err)
+			time.Sleep(time.Second)
+		}
+		if err = resumeDownload(url, part, e); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	sum, err := fileSHA256(part)
+	if err != nil {
+		return err
+	}
+	if "blobs/sha256/"+sum != e.Blob {
+		os.Remove(part)
+		return fmt.Errorf("checksum mismatch, got sha256 %s for %s", sum, e.Blob)
+	}
+	fmt.Printf("downloaded %s (%d bytes)\n", e.Name, e.Size)
+	return os.Rename(part, dst)
+}
+
+// resumeDownload appends the rest of url to part, starting over if the
+// server doesn't support ranges.
+func resumeDownload(url, part string, e *manifestEntry) error {
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if offset == e.Size {
+		return nil
+	}
+	if offset > e.Size {
+		offset = 0
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 206:
+	case 200:
+		offset = 0
+	default:
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, os.SEEK_SET); err != nil {
+		return err
+	}
+	_, err = io.Copy(f, res.Body)
+	return err
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
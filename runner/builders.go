@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// pooledBuilder is a build instance kept by the runner under the warm and
+// pool builder policies.
+type pooledBuilder struct {
+	*cluster.Builder
+	id      int
+	network string
+
+	// project is the project the builder has built for, as pooled
+	// builders are only reused by builds of the same project.
+	project string
+}
+
+// startBuilders boots the build instances kept by the builder policy.
+func (r *Runner) startBuilders() {
+	switch r.config.BuilderPolicy() {
+	case "warm":
+		r.builders = make(chan *pooledBuilder, 1)
+		go r.bootBuilder(0)
+	case "pool":
+		n := r.config.Builders.PoolSize
+		r.builders = make(chan *pooledBuilder, n)
+		for i := 0; i < n; i++ {
+			go r.bootBuilder(i)
+		}
+	}
+}
+
+// bootBuilder boots a build instance and adds it to r.builders, retrying
+// until it succeeds.
+func (r *Runner) bootBuilder(id int) {
+	for {
+		b, err := r.newBuilder(id)
+		if err == nil {
+			r.builders <- b
+			return
+		}
+		log.Printf("could not boot builder %d: %s\n", id, err)
+		time.Sleep(time.Minute)
+	}
+}
+
+func (r *Runner) newBuilder(id int) (*pooledBuilder, error) {
+	bc := r.bc
+	bc.Roles = r.config.Roles
+	bc.BootProfiles = r.config.BootProfiles
+	bc.RootFS = r.baseRootFS()
+	network, err := r.allocateNet()
+	if err != nil {
+		return nil, err
+	}
+	bc.Network = network
+	c := cluster.New(bc, os.Stdout)
+	c.ForwardAgent = r.config.SSHAgent
+	c.DeployKey = r.config.DeployKey
+	c.Downloads = r.config.Downloads
+	c.PinnedImages = r.config.PinnedImages
+	builder, err := c.NewBuilder(r.baseDockerFS())
+	if err != nil {
+		c.Shutdown()
+		r.releaseNet(network)
+		return nil, err
+	}
+	return &pooledBuilder{Builder: builder, id: id, network: network}, nil
+}
+
+func (r *Runner) closeBuilder(b *pooledBuilder) {
+	b.Close()
+	r.releaseNet(b.network)
+}
+
+// closeBuilders closes the idle build instances.
+func (r *Runner) closeBuilders() {
+	for r.builders != nil && len(r.builders) > 0 {
+		r.closeBuilder(<-r.builders)
+	}
+}
+
+// buildFlynn builds repos for b on a build instance chosen by the builder
+// policy, which is logged to out for the build report.
+func (r *Runner) buildFlynn(b *Build, bc cluster.BootConfig, repos map[string]string, out io.Writer) (string, error) {
+	var urls map[string]string
+	if b.CloneUrl != "" {
+		urls = map[string]string{b.Repo: b.CloneUrl}
+	}
+	secrets, err := r.secretEnv(b, out)
+	if err != nil {
+		return "", err
+	}
+	env := append(b.buildEnv(), secrets...)
+	policy := r.config.BuilderPolicy()
+	if b.restricted() {
+		// shared builders are neither restricted nor safe to reuse
+		policy = "ephemeral"
+	}
+	project := r.project(b)
+	isolated := project != nil && project.Isolated()
+	if isolated {
+		// shared builders boot the runner's images and build script
+		policy = "ephemeral"
+	}
+	base := r.baseDockerFS()
+	if b.Image != "" {
+		// pooled builders start from the stable images
+		policy = "ephemeral"
+		if img, err := r.loadBaseImage(b.Image); err == nil && img.Kind == "dockerfs" {
+			base = img.Path
+		}
+	}
+	var sources map[string]cluster.SourceFetcher
+	if b.Source != "" {
+		src, err := cluster.NewSourceFetcher(b.Source)
+		if err != nil {
+			return "", fmt.Errorf("invalid source: %s", err)
+		}
+		sources = map[string]cluster.SourceFetcher{b.Repo: src}
+		// sources can't be cached by ref, and shared builders don't fetch
+		// them
+		policy = "ephemeral"
+	}
+	switch policy {
+	case "warm":
+		builder := <-r.builders
+		go r.bootBuilder(builder.id + 1)
+		defer r.closeBuilder(builder)
+		fmt.Fprintf(out, "builder policy: warm, using fresh builder %d\n", builder.id)
+		return builder.Build(repos, urls, env, out)
+	case "pool":
+		builder := <-r.builders
+		if builder.Builds() > 0 && builder.project != b.Project {
+			fmt.Fprintf(out, "builder %d has built project %q, replacing it with a fresh one\n", builder.id, builder.project)
+			r.closeBuilder(builder)
+			id := builder.id
+			if builder, err = r.newBuilder(id); err != nil {
+				go r.bootBuilder(id)
+				return "", fmt.Errorf("could not boot builder %d: %s", id, err)
+			}
+		}
+		builder.project = b.Project
+		defer func() { r.builders <- builder }()
+		fmt.Fprintf(out, "builder policy: pool, using builder %d after %d previous builds\n", builder.id, builder.Builds())
+		return builder.Build(repos, urls, env, out)
+	default:
+		fmt.Fprintln(out, "builder policy: ephemeral")
+		if r.cache != nil && sources == nil && b.Image == "" && !isolated {
+			image, exact := r.cache.Lookup(repos, env)
+			if exact {
+				fmt.Fprintf(out, "using cached build %s\n", image)
+				return cluster.NewOverlay(image)
+			}
+			if image != "" {
+				fmt.Fprintf(out, "building on cached build %s\n", image)
+				base = image
+			}
+		}
+		builder := cluster.New(bc, out)
+		builder.RepoURLs = urls
+		builder.Sources = sources
+		builder.BuildEnv = env
+		builder.Downloads = r.config.Downloads
+		builder.PinnedImages = r.config.PinnedImages
+		if project != nil && project.Downloads != nil {
+			builder.Downloads = project.Downloads
+		}
+		if project != nil && project.PinnedImages != nil {
+			builder.PinnedImages = project.PinnedImages
+		}
+		if !b.Untrusted {
+			builder.ForwardAgent = r.config.SSHAgent
+			builder.DeployKey = r.config.DeployKey
+		}
+		var fs string
+		if b.KeepOnFail {
+			fs, err = r.buildKeepingBuilder(b, builder, base, repos, urls, env, out)
+		} else {
+			fs, err = builder.BuildFlynn(base, repos)
+			builder.Shutdown()
+		}
+		// builds of untrusted code, on candidate images or of isolated
+		// projects aren't reused by other builds
+		if err == nil && r.cache != nil && !b.Untrusted && sources == nil && b.Image == "" && !isolated {
+			if err := r.cache.Put(repos, env, fs); err != nil {
+				fmt.Fprintf(out, "could not cache build: %s\n", err)
+			}
+		}
+		return fs, err
+	}
+}
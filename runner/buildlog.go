@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn-test/ansi"
+)
+
+// logCheckpointInterval is how often the log of a running build is uploaded
+// so that it can be linked to before the build finishes.
+var logCheckpointInterval = time.Minute
+
+// buildLog is the output of a running build. Followers read it from an
+// offset, so one which disconnects can resume from where it left off.
+type buildLog struct {
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func newBuildLog() *buildLog {
+	l := &buildLog{}
+	l.cond = sync.NewCond(&l.mtx)
+	return l
+}
+
+func (l *buildLog) Write(p []byte) (int, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.cond.Broadcast()
+	return l.buf.Write(p)
+}
+
+// Bytes returns a copy of the log so far.
+func (l *buildLog) Bytes() []byte {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return append([]byte(nil), l.buf.Bytes()...)
+}
+
+// Close marks the log as finished, ending any follows.
+func (l *buildLog) Close() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
+}
+
+// next waits until there is output after offset or the log is closed, and
+// returns the output along with whether the log is closed.
+func (l *buildLog) next(offset int) ([]byte, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for l.buf.Len() <= offset && !l.closed {
+		l.cond.Wait()
+	}
+	if offset >= l.buf.Len() {
+		return nil, l.closed
+	}
+	return append([]byte(nil), l.buf.Bytes()[offset:]...), false
+}
+
+func (r *Runner) addLog(id string, l *buildLog) {
+	r.logsMtx.Lock()
+	defer r.logsMtx.Unlock()
+	r.logs[id] = l
+}
+
+func (r *Runner) removeLog(id string) {
+	r.logsMtx.Lock()
+	defer r.logsMtx.Unlock()
+	delete(r.logs, id)
+}
+
+func (r *Runner) runningLog(id string) *buildLog {
+	r.logsMtx.Lock()
+	defer r.logsMtx.Unlock()
+	return r.logs[id]
+}
+
+// checkpointLog periodically uploads the log of b so far until stop is
+// closed, recording the checkpoint in the build and linking to it from the
+// pull request comment.
+func (r *Runner) checkpointLog(b *Build, l *buildLog, name string, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(logCheckpointInterval):
+		}
+		data := l.Bytes()
+		if len(data) == b.LogCheckpoint {
+			continue
+		}
+		first := b.PartialLogUrl == ""
+		b.PartialLogUrl = r.putArtifact(name+".partial.txt", ansi.Plain(data), "text/plain", runLabels(b))
+		b.LogCheckpoint = len(data)
+		if err := r.save(b); err != nil {
+			log.Printf("could not save log checkpoint of build %s: %s\n", b.Id, err)
+		}
+		if first && b.PullRequest != 0 {
+			r.commentProgress(b)
+		}
+	}
+}
+
+// followLog streams the log of a running build from the offset query
+// parameter, until the build finishes.
+func (r *Runner) followLog(w http.ResponseWriter, req *http.Request, id string) {
+	l := r.runningLog(id)
+	if l == nil {
+		http.Error(w, fmt.Sprintf("build %s is not running\n", id), 404)
+		return
+	}
+	offset, _ := strconv.Atoi(req.FormValue("offset"))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Log-Offset", strconv.Itoa(offset))
+	flusher, _ := w.(http.Flusher)
+	for {
+		data, closed := l.next(offset)
+		if closed {
+			return
+		}
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		offset += len(data)
+	}
+}
+
+// logs follows the log of a running build, reconnecting from the last offset
+// received if the connection drops:
+//
+//	runner logs [--url http://localhost] [--offset N] <run-id>
+func logs(cmdArgs []string) error {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	url := fs.String("url", "http://localhost", "URL of the runner")
+	offset := fs.Int("offset", 0, "offset to start following the log from")
+	fs.Parse(cmdArgs)
+	if fs.NArg() != 1 {
+		return errors.New("usage: runner logs [--url URL] [--offset N] <run-id>")
+	}
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+	for {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/builds/%s/log?offset=%d", *url, fs.Arg(0), *offset), nil)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth("", os.Getenv("API_TOKEN"))
+		res, err := client.Do(req)
+		if err == nil && res.StatusCode != 200 {
+			res.Body.Close()
+			return fmt.Errorf("could not follow log: %s", res.Status)
+		}
+		if err == nil {
+			var n int64
+			n, err = io.Copy(os.Stdout, res.Body)
+			res.Body.Close()
+			*offset += int(n)
+			if err == nil {
+				return nil
+			}
+		}
+		fmt.Fprintf(os.Stderr, "log follow interrupted at offset %d, reconnecting: %s\n", *offset, err)
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/config"
+)
+
+// startChaos injects the faults configured by conf into c until the returned
+// function is called, which waits for any outstanding fault to be reverted.
+// The faults are chosen by an RNG seeded with seed, unless the config sets
+// its own, which is logged so the sequence of faults can be reproduced.
+func startChaos(c *cluster.Cluster, conf *config.ChaosConfig, seed int64, out io.Writer) func() {
+	if conf.Seed != 0 {
+		seed = conf.Seed
+	}
+	fmt.Fprintf(out, "chaos: injecting %v every %s with seed %d\n", conf.Faults, time.Duration(conf.Interval), seed)
+	rng := rand.New(rand.NewSource(seed))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Duration(conf.Interval)):
+			}
+			revert := injectFault(c, conf, rng, out)
+			if revert == nil {
+				continue
+			}
+			select {
+			case <-stop:
+			case <-time.After(time.Duration(conf.Duration)):
+			}
+			revert()
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// injectFault injects a random fault, returning a function which reverts it
+// if it lasts until reverted.
+func injectFault(c *cluster.Cluster, conf *config.ChaosConfig, rng *rand.Rand, out io.Writer) func() {
+	size := c.Size()
+	if len(conf.Faults) == 0 || size == 0 {
+		return nil
+	}
+	fault := conf.Faults[rng.Intn(len(conf.Faults))]
+	i := rng.Intn(size)
+	switch fault {
+	case "restart":
+		fmt.Fprintf(out, "chaos: restarting instance %d\n", i)
+		if err := c.RestartInstance(i); err != nil {
+			fmt.Fprintf(out, "chaos: error restarting instance %d: %s\n", i, err)
+		}
+	case "partition":
+		if size < 2 {
+			return nil
+		}
+		j := (i + 1 + rng.Intn(size-1)) % size
+		fmt.Fprintf(out, "chaos: partitioning instances %d and %d\n", i, j)
+		if err := c.Partition(i, j); err != nil {
+			fmt.Fprintf(out, "chaos: error partitioning instances %d and %d: %s\n", i, j, err)
+		}
+		return func() {
+			fmt.Fprintf(out, "chaos: healing partition between instances %d and %d\n", i, j)
+			if err := c.Heal(i, j); err != nil {
+				fmt.Fprintf(out, "chaos: error healing partition between instances %d and %d: %s\n", i, j, err)
+			}
+		}
+	case "latency":
+		latency := time.Duration(conf.Latency)
+		if latency == 0 {
+			latency = 200 * time.Millisecond
+		}
+		fmt.Fprintf(out, "chaos: adding %s latency to instance %d\n", latency, i)
+		if err := c.AddLatency(i, latency); err != nil {
+			fmt.Fprintf(out, "chaos: error adding latency to instance %d: %s\n", i, err)
+		}
+		return func() {
+			fmt.Fprintf(out, "chaos: removing latency from instance %d\n", i)
+			if err := c.RemoveLatency(i); err != nil {
+				fmt.Fprintf(out, "chaos: error removing latency from instance %d: %s\n", i, err)
+			}
+		}
+	}
+	return nil
+}
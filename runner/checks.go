@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var phases = []string{"build", "bootstrap", "tests"}
+
+var phaseTitles = map[string]string{
+	"build":     "Build Flynn",
+	"bootstrap": "Boot and bootstrap cluster",
+	"tests":     "Run integration tests",
+}
+
+// checks reports the progress of a build to GitHub as one check run per
+// phase. Check runs can only be created by a GitHub App, so without one, or
+// if creating them fails, the phases are reported as commit statuses instead.
+type checks struct {
+	gh         *githubClient
+	repo       string
+	detailsUrl string
+
+	// statuses is set when phases are reported as commit statuses, and
+	// posted holds the state last reported for each phase.
+	statuses bool
+	posted   map[string]string
+
+	mtx     sync.Mutex
+	runs    map[string]*CheckRun
+	results []*TestResult
+}
+
+func (r *Runner) newChecks(b *Build, detailsUrl string) *checks {
+	c := &checks{
+		gh:         r.checksGithub,
+		repo:       b.Repo,
+		detailsUrl: detailsUrl,
+		posted:     make(map[string]string, len(phases)),
+		runs:       make(map[string]*CheckRun, len(phases)),
+	}
+	for _, phase := range phases {
+		c.runs[phase] = &CheckRun{
+			Name:       "flynn/" + phase,
+			HeadSha:    b.Commit,
+			Status:     "queued",
+			DetailsUrl: detailsUrl,
+		}
+	}
+	if !b.fromGithub() {
+		return c
+	}
+	if c.gh == nil {
+		c.useStatuses(r.github)
+		return c
+	}
+	for _, phase := range phases {
+		if err := c.gh.createCheckRun(c.repo, c.runs[phase]); err != nil {
+			log.Printf("checks: could not create %s check run, reporting phases as commit statuses: %s\n", phase, err)
+			c.useStatuses(r.github)
+			break
+		}
+	}
+	return c
+}
+
+// useStatuses switches to reporting phases as commit statuses with gh,
+// cancelling any check runs already created so they aren't left queued.
+func (c *checks) useStatuses(gh *githubClient) {
+	now := time.Now()
+	for _, phase := range phases {
+		run := c.runs[phase]
+		if run.Id == 0 {
+			continue
+		}
+		run.Status = "completed"
+		run.Conclusion = "cancelled"
+		run.CompletedAt = &now
+		run.Output = &CheckOutput{Title: phaseTitles[phase], Summary: "Reported as a commit status instead"}
+		if err := c.gh.updateCheckRun(c.repo, run); err != nil {
+			log.Printf("checks: could not cancel %s check run: %s\n", phase, err)
+		}
+		run.Id = 0
+		run.Status, run.Conclusion, run.CompletedAt, run.Output = "queued", "", nil, nil
+	}
+	c.gh = gh
+	c.statuses = true
+	for _, phase := range phases {
+		c.update(phase)
+	}
+}
+
+func (c *checks) update(phase string) {
+	run := c.runs[phase]
+	if c.statuses {
+		c.updateStatus(phase)
+		return
+	}
+	if run.Id == 0 {
+		return
+	}
+	if err := c.gh.updateCheckRun(c.repo, run); err != nil {
+		log.Printf("checks: could not update %s check run: %s\n", phase, err)
+	}
+}
+
+var checkStatusStates = map[string]string{
+	"success":   "success",
+	"failure":   "failure",
+	"cancelled": "error",
+}
+
+// updateStatus reports phase as a commit status if its state changed since it
+// was last reported.
+func (c *checks) updateStatus(phase string) {
+	run := c.runs[phase]
+	state := "pending"
+	if run.Status == "completed" {
+		state = checkStatusStates[run.Conclusion]
+	}
+	if c.posted[phase] == state {
+		return
+	}
+	description := phaseTitles[phase]
+	if run.Output != nil && run.Output.Summary != "" {
+		description = run.Output.Summary
+	}
+	// GitHub limits descriptions to 140 characters
+	if len(description) > 140 {
+		description = description[:137] + "..."
+	}
+	status := &CommitStatus{
+		State:       state,
+		TargetUrl:   c.detailsUrl,
+		Description: description,
+		Context:     run.Name,
+	}
+	if err := c.gh.createStatus(c.repo, run.HeadSha, status); err != nil {
+		log.Printf("checks: could not create %s commit status: %s\n", phase, err)
+		return
+	}
+	c.posted[phase] = state
+}
+
+func (c *checks) start(phase string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now()
+	run := c.runs[phase]
+	run.Status = "in_progress"
+	run.StartedAt = &now
+	run.Output = &CheckOutput{Title: phaseTitles[phase], Summary: "In progress"}
+	c.update(phase)
+}
+
+func (c *checks) finish(phase string, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now()
+	run := c.runs[phase]
+	if run.Status == "completed" {
+		return
+	}
+	run.Status = "completed"
+	run.CompletedAt = &now
+	if run.Output == nil {
+		run.Output = &CheckOutput{Title: phaseTitles[phase]}
+	}
+	if err != nil {
+		run.Conclusion = "failure"
+		run.Output.Summary = err.Error()
+	} else {
+		run.Conclusion = "success"
+		run.Output.Summary = "Passed"
+	}
+	if phase == "tests" {
+		run.Output.Summary = c.testSummary() + "\n\n" + run.Output.Summary
+	}
+	c.update(phase)
+}
+
+// failed reports whether phase finished with an error.
+func (c *checks) failed(phase string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.runs[phase].Conclusion == "failure"
+}
+
+// cancel marks every phase which was not completed as cancelled, for example
+// because an earlier phase failed.
+func (c *checks) cancel() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now()
+	for _, phase := range phases {
+		run := c.runs[phase]
+		if run.Status == "completed" {
+			continue
+		}
+		run.Status = "completed"
+		run.Conclusion = "cancelled"
+		run.CompletedAt = &now
+		run.Output = &CheckOutput{Title: phaseTitles[phase], Summary: "Skipped because an earlier phase failed"}
+		c.update(phase)
+	}
+}
+
+func (c *checks) testResult(res *TestResult) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.results = append(c.results, res)
+	run := c.runs["tests"]
+	run.Output.Summary = c.testSummary()
+	// annotations are appended by GitHub, so only send new ones
+	run.Output.Annotations = nil
+	if res.Failed() {
+		run.Output.Annotations = []*CheckAnnotation{{
+			Path:            res.File,
+			StartLine:       res.Line,
+			EndLine:         res.Line,
+			AnnotationLevel: "failure",
+			Title:           res.Name,
+			Message:         res.Output,
+		}}
+	}
+	c.update("tests")
+	run.Output.Annotations = nil
+}
+
+func (c *checks) testSummary() string {
+	counts := make(map[string]int)
+	for _, res := range c.results {
+		counts[res.Status]++
+	}
+	summary := fmt.Sprintf("%d passed, %d failed, %d skipped", counts["pass"], counts["fail"]+counts["panic"], counts["skip"]+counts["miss"])
+	if counts["flaky"] > 0 {
+		summary += fmt.Sprintf(", %d flaky", counts["flaky"])
+	}
+	return summary
+}
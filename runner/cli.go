@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// printJSON writes v to stdout for subcommands given --json, which print the
+// API types they receive rather than tables, for scripting.
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Printf("%s\n", data)
+	return err
+}
+
+// wantsJSON returns whether the client of an endpoint which responds with
+// text by default asked for JSON.
+func wantsJSON(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+// runsCmd lists runs, newest first:
+//
+//	runner runs [--url http://localhost] [--project NAME] [--repo REPO] [--branch BRANCH] [--state STATE] [--limit N] [--json]
+func runsCmd(cmdArgs []string) error {
+	fs := flag.NewFlagSet("runs", flag.ExitOnError)
+	u := fs.String("url", "http://localhost", "URL of the runner")
+	project := fs.String("project", "", "only list runs of this project")
+	repo := fs.String("repo", "", "only list runs of this repo")
+	branch := fs.String("branch", "", "only list runs of this branch")
+	state := fs.String("state", "", "only list runs in this state")
+	limit := fs.Int("limit", 20, "number of runs to list")
+	asJSON := fs.Bool("json", false, "print the runs as JSON")
+	fs.Parse(cmdArgs)
+	if fs.NArg() != 0 {
+		return errors.New("usage: runner runs [--url URL] [--project NAME] [--repo REPO] [--branch BRANCH] [--state STATE] [--limit N] [--json]")
+	}
+	query := url.Values{"limit": {strconv.Itoa(*limit)}}
+	for name, value := range map[string]string{"project": *project, "repo": *repo, "branch": *branch, "state": *state} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", *u+"/builds?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("", os.Getenv("API_TOKEN"))
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("could not list runs: %s", res.Status)
+	}
+	list := &buildList{}
+	if err := json.NewDecoder(res.Body).Decode(list); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(list)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN\tREPO\tCOMMIT\tBRANCH\tSTATE\tPASSED\tFAILED\tQUEUED\tDURATION\tCREATED")
+	for _, b := range list.Builds {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n", b.Id, b.Repo, b.Commit, b.Branch, b.State, b.Passed, b.Failed, truncate(b.QueueWait), truncate(b.Duration), b.Created.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// collectInstances saves the configured paths and logs of the cluster's
+// instances to dir before it is shut down.
+func (r *Runner) collectInstances(c *cluster.Cluster, dir string, out io.Writer) {
+	conf := r.config.Collect
+	if conf == nil {
+		return
+	}
+	fmt.Fprintln(out, "collecting instance logs")
+	if _, err := c.CollectArtifacts(dir, conf.Paths, conf.DockerLogs); err != nil {
+		fmt.Fprintf(out, "could not collect instance logs: %s\n", err)
+	}
+}
+
+// saveTimeline saves the interleaved console lines and host events of the
+// run to dir, as text and JSON.
+func saveTimeline(runID, dir string) {
+	events := cluster.RunTimeline(runID)
+	if len(events) == 0 || dir == "" {
+		return
+	}
+	var text bytes.Buffer
+	cluster.WriteTimeline(&text, events)
+	if err := ioutil.WriteFile(filepath.Join(dir, "timeline.txt"), text.Bytes(), 0644); err != nil {
+		log.Printf("could not save timeline of %s: %s\n", runID, err)
+		return
+	}
+	data, err := json.Marshal(events)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "timeline.json"), data, 0644)
+	}
+	if err != nil {
+		log.Printf("could not save timeline of %s: %s\n", runID, err)
+	}
+}
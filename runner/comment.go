@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/flynn/flynn-test/ansi"
+)
+
+// commentMarker identifies the results comment so it is updated in place
+// rather than a new comment being posted for every build.
+const commentMarker = "<!-- flynn-ci-results -->"
+
+// snippetLines is the number of trailing output lines included for each
+// failing test.
+const snippetLines = 40
+
+type IssueComment struct {
+	Id   int64   `json:"id,omitempty"`
+	Body string  `json:"body"`
+	User *PRUser `json:"user,omitempty"`
+
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+func (g *githubClient) listComments(repo string, number int) ([]*IssueComment, error) {
+	var comments []*IssueComment
+	path := fmt.Sprintf("/repos/flynn/%s/issues/%d/comments?per_page=100", repo, number)
+	for path != "" {
+		var page []*IssueComment
+		next, err := g.requestPage("GET", path, nil, &page)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, page...)
+		path = next
+	}
+	return comments, nil
+}
+
+func (g *githubClient) createComment(repo string, number int, body string) error {
+	return g.request("POST", fmt.Sprintf("/repos/flynn/%s/issues/%d/comments", repo, number), &IssueComment{Body: body}, nil)
+}
+
+func (g *githubClient) updateComment(repo string, id int64, body string) error {
+	return g.request("PATCH", fmt.Sprintf("/repos/flynn/%s/issues/comments/%d", repo, id), &IssueComment{Body: body}, nil)
+}
+
+var commentTemplate = template.Must(template.New("comment").Funcs(template.FuncMap{
+	"duration": formatDuration,
+	"delta":    formatDelta,
+	"mentions": mentions,
+}).Parse(`
+{{.Marker}}
+{{if .AwaitingApproval}}### Flynn CI :lock: awaiting approval for {{.Commit}}
+
+Builds of pull requests from forks run once a maintainer comments ` + "`{{.Command}}`" + `.
+{{else if .InProgress}}### Flynn CI :hourglass: running for {{.Commit}}
+
+[Build log so far]({{.LogUrl}})
+{{else}}### Flynn CI {{if .Passed}}:white_check_mark: passed{{else}}:x: failed{{end}} for {{.Commit}}
+
+{{if .Error}}` + "`{{.Error}}`" + `
+
+{{end}}{{if .Rejected}}Rejected ` + "`.flynn-ci.toml`" + ` directives:
+{{range .Rejected}}
+- {{.}}{{end}}
+
+{{end}}{{if .Results}}| Test | Result | Duration | vs master |
+|------|--------|----------|-----------|
+{{range .Results}}| {{.Name}}{{range .Artifacts}} [{{.Name}}]({{.Url}}){{end}} | {{.StatusText}} | {{duration .Duration}} | {{delta .Duration .Master}} |
+{{end}}
+{{end}}{{range .Failures}}<details><summary>{{.Name}} output{{if .Owners}}, owned by {{mentions .Owners}}{{end}}</summary>
+
+{{.Fence}}
+{{.Snippet}}
+{{.Fence}}
+</details>
+
+{{end}}[Full build log]({{.LogUrl}})
+{{end}}`[1:]))
+
+type commentResult struct {
+	*TestResult
+	Master  time.Duration
+	Snippet string
+
+	// Fence is the code fence around Snippet, which is longer than any run
+	// of backticks in it so the output can't end the code block.
+	Fence string
+}
+
+func (r *Runner) commentResults(b *Build, results []*TestResult, logUrl string, buildErr error) {
+	master := r.masterDurations()
+	data := map[string]interface{}{
+		"Marker":   commentMarker,
+		"Passed":   buildErr == nil,
+		"Commit":   b.Commit,
+		"LogUrl":   logUrl,
+		"Rejected": b.RejectedDirectives,
+	}
+	if buildErr != nil {
+		data["Error"] = buildErr.Error()
+	}
+	var rows, failures []*commentResult
+	for _, res := range results {
+		row := &commentResult{TestResult: res, Master: master[res.Name]}
+		rows = append(rows, row)
+		if res.Failed() {
+			row.Snippet = tail(string(ansi.Plain([]byte(res.Output))), snippetLines)
+			row.Fence = codeFence(row.Snippet)
+			failures = append(failures, row)
+		}
+	}
+	data["Results"] = rows
+	data["Failures"] = failures
+
+	r.postComment(b, data)
+}
+
+// commentProgress links to the log of a running build from the results
+// comment, which is replaced with the results when the build finishes.
+func (r *Runner) commentProgress(b *Build) {
+	r.postComment(b, map[string]interface{}{
+		"Marker":     commentMarker,
+		"InProgress": true,
+		"Commit":     b.Commit,
+		"LogUrl":     b.PartialLogUrl,
+	})
+}
+
+// postComment renders data with commentTemplate as the results comment of
+// the pull request of b, updating the existing comment if there is one.
+func (r *Runner) postComment(b *Build, data map[string]interface{}) {
+	if !b.fromGithub() {
+		return
+	}
+	var body bytes.Buffer
+	if err := commentTemplate.Execute(&body, data); err != nil {
+		log.Printf("commentResults: could not render comment: %s\n", err)
+		return
+	}
+
+	login, err := r.github.login()
+	if err != nil {
+		log.Printf("commentResults: could not get GitHub user: %s\n", err)
+		return
+	}
+	comments, err := r.github.listComments(b.Repo, b.PullRequest)
+	if err != nil {
+		log.Printf("commentResults: could not list comments: %s\n", err)
+		return
+	}
+	for _, c := range comments {
+		// anyone can post a comment starting with the marker
+		if c.User != nil && c.User.Login == login && strings.HasPrefix(c.Body, commentMarker) {
+			if err := r.github.updateComment(b.Repo, c.Id, body.String()); err != nil {
+				log.Printf("commentResults: could not update comment: %s\n", err)
+			}
+			return
+		}
+	}
+	if err := r.github.createComment(b.Repo, b.PullRequest, body.String()); err != nil {
+		log.Printf("commentResults: could not create comment: %s\n", err)
+	}
+}
+
+func (r *Runner) saveMasterDurations(results []*TestResult) {
+	if err := r.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte("master-durations"))
+		for _, res := range results {
+			if res.Status != "pass" {
+				continue
+			}
+			val, err := json.Marshal(res.Duration)
+			if err != nil {
+				return err
+			}
+			if err := bkt.Put([]byte(res.Name), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Printf("could not save master durations: %s\n", err)
+	}
+}
+
+func (r *Runner) masterDurations() map[string]time.Duration {
+	durations := make(map[string]time.Duration)
+	r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("master-durations")).ForEach(func(k, v []byte) error {
+			var d time.Duration
+			if err := json.Unmarshal(v, &d); err == nil {
+				durations[string(k)] = d
+			}
+			return nil
+		})
+	})
+	return durations
+}
+
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return truncate(d).String()
+}
+
+func formatDelta(d, master time.Duration) string {
+	if d == 0 || master == 0 {
+		return "-"
+	}
+	delta := d - master
+	sign := "+"
+	if delta < 0 {
+		sign = "-"
+		delta = -delta
+	}
+	return fmt.Sprintf("%s%s (%+.0f%%)", sign, truncate(delta), float64(d-master)/float64(master)*100)
+}
+
+func truncate(d time.Duration) time.Duration {
+	return d - d%(10*time.Millisecond)
+}
+
+// codeFence returns a backtick fence longer than the longest run of backticks
+// in s, and at least three long.
+func codeFence(s string) string {
+	longest, run := 0, 0
+	for _, c := range s {
+		if c != '`' {
+			run = 0
+			continue
+		}
+		if run++; run > longest {
+			longest = run
+		}
+	}
+	if longest < 3 {
+		return "```"
+	}
+	return strings.Repeat("`", longest+1)
+}
+
+func tail(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestCodeFence(t *testing.T) {
+	for _, test := range []struct {
+		snippet, fence string
+	}{
+		{"", "```"},
+		{"FAIL: `x` != `y`", "```"},
+		{"``", "```"},
+		{"```\nFAIL", "````"},
+		{"a ````` b ``` c", "``````"},
+	} {
+		if fence := codeFence(test.snippet); fence != test.fence {
+			t.Errorf("codeFence(%q) = %q, want %q", test.snippet, fence, test.fence)
+		}
+	}
+}
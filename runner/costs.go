@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// monthlyCost is the total usage and cost of the runs finished in a month.
+type monthlyCost struct {
+	Month string        `json:"month"`
+	Runs  int           `json:"runs"`
+	Usage cluster.Usage `json:"usage"`
+	Cost  float64       `json:"cost"`
+}
+
+// recordCost prices the resources used by the instances of b, adding them to
+// the build report and the rollup of the month.
+func (r *Runner) recordCost(b *Build, out io.Writer) {
+	u := cluster.RunUsage(b.Id)
+	b.Usage = &u
+	b.Cost = r.config.Costs.Cost(u)
+	fmt.Fprintf(out, "resource usage: %.2f VM-hours, %.2f disk GB-hours, %d bytes of egress", u.VMHours, u.DiskGBHours, u.EgressBytes)
+	if r.config.Costs != nil {
+		fmt.Fprintf(out, ", costing $%.2f", b.Cost)
+	}
+	fmt.Fprintln(out)
+
+	if err := r.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte("run-costs"))
+		month := &monthlyCost{Month: time.Now().Format("2006-01")}
+		if v := bkt.Get([]byte(month.Month)); v != nil {
+			if err := json.Unmarshal(v, month); err != nil {
+				return err
+			}
+		}
+		month.Runs++
+		month.Usage.Add(u)
+		month.Cost += b.Cost
+		val, err := json.Marshal(month)
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(month.Month), val)
+	}); err != nil {
+		log.Printf("could not save cost of build %s: %s\n", b.Id, err)
+	}
+}
+
+// listCosts returns the monthly cost rollups as JSON, or only the month
+// given as ?month=YYYY-MM.
+func (r *Runner) listCosts(w http.ResponseWriter, req *http.Request) {
+	months := make([]*monthlyCost, 0)
+	filter := req.FormValue("month")
+	if err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("run-costs")).ForEach(func(k, v []byte) error {
+			if filter != "" && string(k) != filter {
+				return nil
+			}
+			month := &monthlyCost{}
+			if err := json.Unmarshal(v, month); err != nil {
+				return err
+			}
+			months = append(months, month)
+			return nil
+		})
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("could not load costs: %s\n", err), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(months)
+}
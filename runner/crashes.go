@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// hostCrashes counts the runs on a host and the QEMU crashes among them,
+// so that hosts with flaky hardware stand out.
+type hostCrashes struct {
+	Host        string         `json:"host"`
+	Runs        int            `json:"runs"`
+	CrashedRuns int            `json:"crashed_runs"`
+	Crashes     int            `json:"crashes"`
+	Signals     map[string]int `json:"signals,omitempty"`
+	LastCrash   time.Time      `json:"last_crash,omitempty"`
+	LastRun     string         `json:"last_run,omitempty"`
+}
+
+// Rate is the percentage of runs on the host in which QEMU crashed.
+func (h *hostCrashes) Rate() float64 {
+	if h.Runs == 0 {
+		return 0
+	}
+	return float64(h.CrashedRuns) / float64(h.Runs) * 100
+}
+
+type hostsByCrashes []*hostCrashes
+
+func (h hostsByCrashes) Len() int           { return len(h) }
+func (h hostsByCrashes) Less(i, j int) bool { return h[i].Crashes > h[j].Crashes }
+func (h hostsByCrashes) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+// recordCrashes attaches the QEMU crashes of b's instances to it, writing
+// them to the build log, and counts them against the runner host.
+func (r *Runner) recordCrashes(b *Build, out io.Writer) []*cluster.QEMUCrash {
+	crashes := cluster.RunCrashes(b.Id)
+	b.Crashes = crashes
+	for _, c := range crashes {
+		fmt.Fprintf(out, "QEMU of instance %s died of signal %s at %s\n", c.Instance, c.Signal, c.Time.Format(time.RFC3339))
+		for _, line := range c.Dmesg {
+			fmt.Fprintf(out, "  dmesg: %s\n", line)
+		}
+		if c.CoreDump != "" {
+			fmt.Fprintf(out, "  core dump: %s\n", c.CoreDump)
+		} else {
+			fmt.Fprintf(out, "  no core dump found, core_pattern is %q\n", c.CorePattern)
+		}
+	}
+
+	if err := r.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte("host-crashes"))
+		h := &hostCrashes{Host: hostname}
+		if v := bkt.Get([]byte(hostname)); v != nil {
+			if err := json.Unmarshal(v, h); err != nil {
+				return err
+			}
+		}
+		h.Runs++
+		if len(crashes) > 0 {
+			h.CrashedRuns++
+			h.Crashes += len(crashes)
+			if h.Signals == nil {
+				h.Signals = make(map[string]int)
+			}
+			for _, c := range crashes {
+				h.Signals[c.Signal]++
+			}
+			h.LastCrash = crashes[len(crashes)-1].Time
+			h.LastRun = b.Id
+		}
+		val, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(hostname), val)
+	}); err != nil {
+		log.Printf("could not save QEMU crashes of build %s: %s\n", b.Id, err)
+	}
+	return crashes
+}
+
+// loadHostCrashes returns the crash counts of the hosts which have had QEMU
+// crashes, the most crashes first.
+func (r *Runner) loadHostCrashes() ([]*hostCrashes, error) {
+	var hosts []*hostCrashes
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("host-crashes")).ForEach(func(k, v []byte) error {
+			h := &hostCrashes{}
+			if err := json.Unmarshal(v, h); err != nil {
+				return err
+			}
+			if h.Crashes > 0 {
+				hosts = append(hosts, h)
+			}
+			return nil
+		})
+	})
+	sort.Sort(hostsByCrashes(hosts))
+	return hosts, err
+}
+
+// listHostCrashes returns the crash counts of the hosts as JSON.
+func (r *Runner) listHostCrashes(w http.ResponseWriter, req *http.Request) {
+	hosts, err := r.loadHostCrashes()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not load host crashes: %s\n", err), 500)
+		return
+	}
+	if hosts == nil {
+		hosts = make([]*hostCrashes, 0)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hosts)
+}
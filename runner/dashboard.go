@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+func (r *Runner) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", r.httpEventHandler)
+	if r.oauth != nil {
+		mux.HandleFunc("/auth/login", r.oauth.login)
+		mux.HandleFunc("/auth/callback", r.oauth.callback)
+	}
+	mux.Handle("/builds/new", r.authenticated(http.HandlerFunc(r.newBuildForm)))
+	mux.Handle("/builds", r.authenticated(http.HandlerFunc(r.createBuild)))
+	mux.Handle("/builds/awaiting", r.authenticated(http.HandlerFunc(r.listAwaiting)))
+	mux.Handle("/builds/", r.authenticated(http.HandlerFunc(r.buildAction)))
+	mux.Handle("/runs", r.authenticated(http.HandlerFunc(r.runsPage)))
+	mux.Handle("/runs/", r.authenticated(http.HandlerFunc(r.runsPage)))
+	mux.Handle("/gantt", r.authenticated(http.HandlerFunc(r.ganttHandler)))
+	mux.Handle("/tests", r.authenticated(http.HandlerFunc(r.listTestHistory)))
+	mux.Handle("/costs", r.authenticated(http.HandlerFunc(r.listCosts)))
+	mux.Handle("/crashes", r.authenticated(http.HandlerFunc(r.listHostCrashes)))
+	mux.Handle("/update", r.authenticated(http.HandlerFunc(r.updateHandler)))
+	mux.Handle("/images", r.authenticated(http.HandlerFunc(r.imagesHandler)))
+	mux.Handle("/images/", r.authenticated(http.HandlerFunc(r.imageAction)))
+	mux.Handle("/drain", r.authenticated(http.HandlerFunc(r.drainHandler)))
+	mux.Handle("/metrics", r.authenticated(http.HandlerFunc(r.serveMetrics)))
+	mux.Handle("/events/stream", r.authenticated(http.HandlerFunc(r.subscribeEvents)))
+	return mux
+}
+
+// authenticated requires requests to provide API_TOKEN as the HTTP basic
+// auth password, or to be signed in with GitHub if OAuth is configured. If
+// neither is configured the endpoints are disabled.
+func (r *Runner) authenticated(h http.Handler) http.Handler {
+	token := os.Getenv("API_TOKEN")
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-r.ready:
+		default:
+			http.Error(w, "waiting for the previous runner to drain\n", 503)
+			return
+		}
+		if r.oauth != nil {
+			if s := r.oauth.session(req); s != nil {
+				if req.Method != "GET" && s.Role != "operator" {
+					http.Error(w, "operator role required\n", 403)
+					return
+				}
+				if req.Method != "GET" && !sameOrigin(req) {
+					http.Error(w, "cross-origin request refused\n", 403)
+					return
+				}
+				h.ServeHTTP(w, req)
+				return
+			}
+			if _, _, ok := req.BasicAuth(); !ok {
+				http.Redirect(w, req, "/auth/login?next="+url.QueryEscape(req.URL.RequestURI()), 302)
+				return
+			}
+		}
+		if token == "" {
+			http.Error(w, "API_TOKEN not set\n", 404)
+			return
+		}
+		if _, password, ok := req.BasicAuth(); !ok || !checkToken(token, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="flynn-test"`)
+			http.Error(w, "unauthorized\n", 401)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+var newBuildTemplate = template.Must(template.New("new-build").Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Trigger build - flynn-test</title>
+</head>
+<body>
+<h1>Trigger build</h1>
+<form method="POST" action="/builds" enctype="multipart/form-data">
+<p><label>Repo <select name="repo">{{range .Repos}}<option>{{.}}</option>{{end}}</select></label></p>
+<p><label>Branch or SHA <input name="commit" value="master"></label></p>
+<p><label>Clone URL <input name="clone_url" placeholder="https://github.com/flynn/&lt;repo&gt;"></label></p>
+<p><label>Source tarball, built in place of the branch <input name="source" type="file"></label></p>
+<p><label>Profile <input name="profile"></label></p>
+<p><label>Cluster size <input name="cluster_size" type="number" min="0" placeholder="profile default"></label></p>
+<p><label>Seed <input name="seed" placeholder="random"></label></p>
+<p><label>Build env (KEY=VALUE per line)<br><textarea name="env" rows="4" cols="60"></textarea></label></p>
+<p><label><input name="keep_on_fail" type="checkbox" value="true"> Keep cluster running on failure</label></p>
+<p><input type="submit" value="Trigger"></p>
+</form>
+</body>
+</html>
+`[1:]))
+
+func (r *Runner) newBuildForm(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := newBuildTemplate.Execute(w, map[string]interface{}{"Repos": r.config.Repos()}); err != nil {
+		log.Println("dashboard: error rendering form:", err)
+	}
+}
+
+// buildRequest is the JSON body of a manual build request, holding only the
+// fields a client may set.
+type buildRequest struct {
+	Repo        string   `json:"repo"`
+	Commit      string   `json:"commit"`
+	CloneUrl    string   `json:"clone_url"`
+	Profile     string   `json:"profile"`
+	ClusterSize int      `json:"cluster_size"`
+	Env         []string `json:"env"`
+	KeepOnFail  bool     `json:"keep_on_fail"`
+	Seed        int64    `json:"seed"`
+}
+
+// createBuild triggers a build from either a JSON body or the dashboard form.
+func (r *Runner) createBuild(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		r.listBuilds(w, req)
+		return
+	}
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed\n", 405)
+		return
+	}
+	b := &Build{}
+	isJSON := strings.HasPrefix(req.Header.Get("Content-Type"), "application/json")
+	if isJSON {
+		var br buildRequest
+		if err := json.NewDecoder(req.Body).Decode(&br); err != nil {
+			http.Error(w, fmt.Sprintf("invalid JSON: %s\n", err), 400)
+			return
+		}
+		b.Repo = br.Repo
+		b.Commit = br.Commit
+		b.CloneUrl = br.CloneUrl
+		b.Profile = br.Profile
+		b.ClusterSize = br.ClusterSize
+		b.Env = br.Env
+		b.KeepOnFail = br.KeepOnFail
+		b.Seed = br.Seed
+	} else {
+		b.Repo = req.FormValue("repo")
+		b.Commit = strings.TrimSpace(req.FormValue("commit"))
+		b.CloneUrl = strings.TrimSpace(req.FormValue("clone_url"))
+		b.Profile = strings.TrimSpace(req.FormValue("profile"))
+		b.KeepOnFail = req.FormValue("keep_on_fail") == "true"
+		if size := req.FormValue("cluster_size"); size != "" {
+			n, err := strconv.Atoi(size)
+			if err != nil {
+				http.Error(w, "invalid cluster size\n", 400)
+				return
+			}
+			b.ClusterSize = n
+		}
+		if seed := strings.TrimSpace(req.FormValue("seed")); seed != "" {
+			n, err := strconv.ParseInt(seed, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid seed\n", 400)
+				return
+			}
+			b.Seed = n
+		}
+		for _, line := range strings.Split(req.FormValue("env"), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				b.Env = append(b.Env, line)
+			}
+		}
+		var err error
+		if b.Source, err = saveSource(req); err != nil {
+			http.Error(w, fmt.Sprintf("could not save source: %s\n", err), 500)
+			return
+		}
+	}
+	if err := r.validateManualBuild(b); err != nil {
+		removeUploadedSource(b)
+		http.Error(w, err.Error()+"\n", 400)
+		return
+	}
+	if b.Source != "" {
+		b.Commit = "source"
+	}
+	b.Id = ""
+	b.Provider = "manual"
+	b.Branch = b.Commit
+	b.Project = r.projectName(b.Repo)
+	log.Printf("manual build of %s[%s] requested\n", b.Repo, b.Commit)
+
+	// save synchronously so the build id can be returned
+	if err := r.enqueue(b); err != nil {
+		http.Error(w, fmt.Sprintf("could not save build: %s\n", err), 500)
+		return
+	}
+
+	if isJSON || wantsJSON(req) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "build %s triggered\n", b.Id)
+}
+
+// getBuild serves the build with the given id as JSON, loading it from the
+// archive if it has been archived.
+func (r *Runner) getBuild(w http.ResponseWriter, id string) {
+	b, err := r.loadBuild(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not load build: %s\n", err), 500)
+		return
+	}
+	if b == nil {
+		http.Error(w, fmt.Sprintf("build %s not found\n", id), 404)
+		return
+	}
+	if b.Archive != "" {
+		b = r.loadArchived(b)
+	}
+	r.loadAnnotations(b)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+func (r *Runner) validateManualBuild(b *Build) error {
+	if !r.config.KnownRepo(b.Repo) {
+		return fmt.Errorf("unknown repo %q", b.Repo)
+	}
+	if b.Source != "" {
+		if _, err := os.Stat(b.Source); err != nil {
+			return fmt.Errorf("invalid source: %s", err)
+		}
+	} else if b.Commit == "" {
+		return fmt.Errorf("branch or SHA required")
+	} else if err := checkBuildSource(b.Commit, b.CloneUrl); err != nil {
+		return err
+	} else if shaPattern.MatchString(b.Commit) && len(b.Commit) != 40 {
+		// git can't fetch abbreviated SHAs
+		return fmt.Errorf("invalid SHA %q, expected 40 hex digits", b.Commit)
+	}
+	if _, err := r.config.Profile(b.Profile); err != nil {
+		return err
+	}
+	// a cluster size of 0 is the profile's own
+	if b.ClusterSize < 0 || b.ClusterSize > maxClusterSize {
+		return fmt.Errorf("cluster size must be between 1 and %d, or 0 for the profile's", maxClusterSize)
+	}
+	for _, env := range b.Env {
+		if !strings.Contains(env, "=") {
+			return fmt.Errorf("invalid env %q, expected KEY=VALUE", env)
+		}
+	}
+	return nil
+}
+
+var maxClusterSize = 5
+
+var shaPattern = regexp.MustCompile(`^[0-9a-f]{7,}$`)
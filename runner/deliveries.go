@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// verifySignature checks the HMAC of the body of a GitHub delivery signed
+// with secret, preferring the SHA-256 signature GitHub sends alongside the
+// SHA-1 one, and leaves the body to be read again.
+func verifySignature(req *http.Request, secret string) error {
+	sig, newHash := req.Header.Get("X-Hub-Signature-256"), sha256.New
+	prefix := "sha256="
+	if sig == "" {
+		sig, newHash, prefix = req.Header.Get("X-Hub-Signature"), sha1.New, "sha1="
+	}
+	if !strings.HasPrefix(sig, prefix) {
+		return unauthorized("missing X-Hub-Signature-256")
+	}
+	expected, err := hex.DecodeString(sig[len(prefix):])
+	if err != nil {
+		return unauthorized("invalid webhook signature")
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return badRequest("could not read payload: %s", err)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if !hmac.Equal(expected, signBody(newHash, secret, body)) {
+		return unauthorized("invalid webhook signature")
+	}
+	return nil
+}
+
+func signBody(newHash func() hash.Hash, secret string, body []byte) []byte {
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// deliveryID returns an id unique to each webhook delivery, or an empty
+// string if there is none. GitHub deliveries are identified by a hash of
+// their body and its signature rather than by X-Github-Delivery, which is not
+// signed and so could be changed to replay a delivery. It must be called
+// before the body is read.
+func deliveryID(req *http.Request) (string, error) {
+	if sig := req.Header.Get("X-Hub-Signature-256") + req.Header.Get("X-Hub-Signature"); sig != "" {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return "", badRequest("could not read payload: %s", err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h := sha256.New()
+		h.Write(body)
+		h.Write([]byte(sig))
+		return "github:" + hex.EncodeToString(h.Sum(nil)), nil
+	}
+	if id := req.Header.Get("X-Gitlab-Event-Uuid"); id != "" {
+		return "gitlab:" + id, nil
+	}
+	return "", nil
+}
+
+// seenDelivery records a delivery, returning whether it was seen before. Until
+// the db is open the delivery is only remembered in memory.
+func (r *Runner) seenDelivery(id string) (bool, error) {
+	r.deliveryMtx.Lock()
+	defer r.deliveryMtx.Unlock()
+	if r.earlyDeliveries != nil {
+		_, seen := r.earlyDeliveries[id]
+		r.earlyDeliveries[id] = struct{}{}
+		return seen, nil
+	}
+	return r.recordDelivery(id)
+}
+
+// forgetDelivery removes a delivery which was refused from the delivery
+// cache, so that it is accepted when it is redelivered.
+func (r *Runner) forgetDelivery(id string) {
+	r.deliveryMtx.Lock()
+	defer r.deliveryMtx.Unlock()
+	if r.earlyDeliveries != nil {
+		delete(r.earlyDeliveries, id)
+		return
+	}
+	if err := r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("webhook-deliveries")).Delete([]byte(id))
+	}); err != nil {
+		log.Printf("could not forget delivery %s: %s\n", id, err)
+	}
+}
+
+// recordEarlyDeliveries adds the deliveries received before the db was open
+// to the delivery cache, which seenDelivery uses from then on.
+func (r *Runner) recordEarlyDeliveries() {
+	r.deliveryMtx.Lock()
+	defer r.deliveryMtx.Unlock()
+	for id := range r.earlyDeliveries {
+		if _, err := r.recordDelivery(id); err != nil {
+			log.Printf("could not record delivery %s: %s\n", id, err)
+		}
+	}
+	r.earlyDeliveries = nil
+}
+
+// recordDelivery adds a delivery to the delivery cache, returning whether it
+// was already there. Deliveries are forgotten after twice the max delivery
+// age, by when replays of them are rejected as stale.
+func (r *Runner) recordDelivery(id string) (bool, error) {
+	var seen bool
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("webhook-deliveries"))
+		if b.Get([]byte(id)) != nil {
+			seen = true
+			return nil
+		}
+		cutoff := time.Now().Add(-2 * r.config.MaxDeliveryAge())
+		var old [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if t, err := time.Parse(time.RFC3339, string(v)); err != nil || t.Before(cutoff) {
+				old = append(old, k)
+			}
+		}
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte(id), []byte(time.Now().Format(time.RFC3339)))
+	})
+	return seen, err
+}
+
+// eventTime returns when the event happened, or a zero time if the event
+// doesn't say.
+func eventTime(event Event) time.Time {
+	var t *time.Time
+	switch e := event.(type) {
+	case *PushEvent:
+		if e.Repository != nil {
+			t = (*time.Time)(e.Repository.PushedAt)
+		}
+	case *PullRequestEvent:
+		if e.PullRequest != nil {
+			t = e.PullRequest.UpdatedAt
+		}
+	case *IssueCommentEvent:
+		if e.Comment != nil {
+			t = e.Comment.CreatedAt
+		}
+	}
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+// timestamp is a time which GitHub sends as either unix seconds or RFC 3339,
+// depending on the event.
+type timestamp time.Time
+
+func (t *timestamp) UnmarshalJSON(data []byte) error {
+	if n, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+		*t = timestamp(time.Unix(n, 0))
+		return nil
+	}
+	return (*time.Time)(t).UnmarshalJSON(data)
+}
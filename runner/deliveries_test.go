@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func webhookRequest(body string, header map[string]string) *http.Request {
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func TestVerifySignature(t *testing.T) {
+	const body = `{"ref":"refs/heads/master"}`
+	sha256Sig := "sha256=" + hex.EncodeToString(signBody(sha256.New, "secret", []byte(body)))
+	sha1Sig := "sha1=" + hex.EncodeToString(signBody(sha1.New, "secret", []byte(body)))
+	for _, test := range []struct {
+		name   string
+		body   string
+		header map[string]string
+		ok     bool
+	}{
+		{"sha256", body, map[string]string{"X-Hub-Signature-256": sha256Sig}, true},
+		{"sha1", body, map[string]string{"X-Hub-Signature": sha1Sig}, true},
+		{"sha256 preferred", body, map[string]string{"X-Hub-Signature-256": sha256Sig, "X-Hub-Signature": "sha1=00"}, true},
+		{"unsigned", body, nil, false},
+		{"wrong secret", body, map[string]string{"X-Hub-Signature-256": "sha256=" + hex.EncodeToString(signBody(sha256.New, "other", []byte(body)))}, false},
+		{"modified body", body + " ", map[string]string{"X-Hub-Signature-256": sha256Sig}, false},
+		{"wrong algorithm", body, map[string]string{"X-Hub-Signature-256": "sha1=" + sha256Sig[7:]}, false},
+		{"invalid hex", body, map[string]string{"X-Hub-Signature-256": "sha256=zz"}, false},
+	} {
+		req := webhookRequest(test.body, test.header)
+		err := verifySignature(req, "secret")
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s: verifySignature returned %v", test.name, err)
+			continue
+		}
+		if e, isProviderError := err.(*providerError); err != nil && (!isProviderError || e.status != 401) {
+			t.Errorf("%s: expected a 401 error, got %v", test.name, err)
+		}
+		if data, _ := ioutil.ReadAll(req.Body); string(data) != test.body && test.header != nil {
+			t.Errorf("%s: body was not left to be read again, got %q", test.name, data)
+		}
+	}
+}
+
+func TestDeliveryID(t *testing.T) {
+	id := func(body string, header map[string]string) string {
+		req := webhookRequest(body, header)
+		id, err := deliveryID(req)
+		if err != nil {
+			t.Fatalf("deliveryID returned %s", err)
+		}
+		if data, _ := ioutil.ReadAll(req.Body); string(data) != body {
+			t.Fatalf("body was not left to be read again, got %q", data)
+		}
+		return id
+	}
+	signed := map[string]string{"X-Hub-Signature-256": "sha256=01"}
+	for _, test := range []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"redelivery", id("a", signed), id("a", signed), true},
+		{"other body", id("a", signed), id("b", signed), false},
+		{"other signature", id("a", signed), id("a", map[string]string{"X-Hub-Signature-256": "sha256=02"}), false},
+		{"gitlab redelivery", id("a", map[string]string{"X-Gitlab-Event-Uuid": "1"}), id("b", map[string]string{"X-Gitlab-Event-Uuid": "1"}), true},
+		{"gitlab delivery", id("a", map[string]string{"X-Gitlab-Event-Uuid": "1"}), id("a", map[string]string{"X-Gitlab-Event-Uuid": "2"}), false},
+	} {
+		if same := test.a == test.b; same != test.same {
+			t.Errorf("%s: ids %q and %q, expected them to be the same: %t", test.name, test.a, test.b, test.same)
+		}
+	}
+	if got := id("a", nil); got != "" {
+		t.Errorf("expected no id for an unsigned delivery, got %q", got)
+	}
+}
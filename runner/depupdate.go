@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/flynn/flynn-test/config"
+	"github.com/flynn/flynn-test/util"
+)
+
+type githubCommit struct {
+	Sha string `json:"sha"`
+}
+
+// commitSHA returns the commit ref of repo is at.
+func (g *githubClient) commitSHA(repo, ref string) (string, error) {
+	var c githubCommit
+	if err := g.request("GET", fmt.Sprintf("/repos/flynn/%s/commits/%s", repo, ref), nil, &c); err != nil {
+		return "", err
+	}
+	return c.Sha, nil
+}
+
+type IssueRequest struct {
+	Number int      `json:"number,omitempty"`
+	Title  string   `json:"title"`
+	Body   string   `json:"body"`
+	Labels []string `json:"labels,omitempty"`
+	Url    string   `json:"html_url,omitempty"`
+}
+
+func (g *githubClient) createIssue(repo string, issue *IssueRequest) error {
+	return g.request("POST", fmt.Sprintf("/repos/flynn/%s/issues", repo), issue, issue)
+}
+
+// pinDependencies pins the flynn components missing from repos to the
+// latest commit of their ref in util.Repos, recording the pins in b so that
+// a rerun of the build tests the same commits.
+func (r *Runner) pinDependencies(b *Build, repos map[string]string, out io.Writer) error {
+	if b.Pins == nil {
+		pins := make(map[string]string)
+		for repo, ref := range util.Repos {
+			if _, ok := repos[repo]; ok {
+				continue
+			}
+			sha, err := r.github.commitSHA(repo, ref)
+			if err != nil {
+				return fmt.Errorf("could not resolve %s[%s]: %s", repo, ref, err)
+			}
+			pins[repo] = sha
+		}
+		b.Pins = pins
+	}
+	names := make([]string, 0, len(b.Pins))
+	for repo := range b.Pins {
+		names = append(names, repo)
+	}
+	sort.Strings(names)
+	for _, repo := range names {
+		fmt.Fprintf(out, "pinning %s[%s] to %s\n", repo, util.Repos[repo], b.Pins[repo])
+		repos[repo] = b.Pins[repo]
+	}
+	return nil
+}
+
+type dependencyPin struct {
+	Repo   string
+	Ref    string
+	Commit string
+}
+
+var dependencyReportTemplate = template.Must(template.New("dependency-report").Parse(`
+Flynn CI ran the suite against the latest commits of the flynn components, pinned as follows:
+
+| Repo | Ref | Commit |
+|------|-----|--------|
+{{range .Pins}}| {{.Repo}} | {{.Ref}} | [{{.Commit}}](https://github.com/flynn/{{.Repo}}/commit/{{.Commit}}) |
+{{end}}
+{{if .Error}}The run failed: ` + "`{{.Error}}`" + `
+
+{{end}}{{.Passed}} tests passed and {{.Failed}} failed.
+{{range .Failures}}
+- {{.}}{{end}}
+
+[Full build log]({{.LogUrl}})
+`[1:]))
+
+// reportDependencyUpdate opens an issue reporting the pins and results of
+// a dependency update run.
+func (r *Runner) reportDependencyUpdate(b *Build, d *config.DependencyUpdate, results []*TestResult, logUrl string, buildErr error) {
+	data := map[string]interface{}{
+		"Passed": b.Passed,
+		"Failed": b.Failed,
+		"LogUrl": logUrl,
+	}
+	if buildErr != nil {
+		data["Error"] = buildErr.Error()
+	}
+	var pins []*dependencyPin
+	for repo, commit := range b.Pins {
+		pins = append(pins, &dependencyPin{Repo: repo, Ref: util.Repos[repo], Commit: commit})
+	}
+	sort.Sort(dependencyPinsByRepo(pins))
+	data["Pins"] = pins
+	var failures []string
+	for _, res := range results {
+		if res.Failed() {
+			failures = append(failures, res.Name)
+		}
+	}
+	data["Failures"] = failures
+
+	var body bytes.Buffer
+	if err := dependencyReportTemplate.Execute(&body, data); err != nil {
+		log.Printf("reportDependencyUpdate: could not render report: %s\n", err)
+		return
+	}
+	result := "passed"
+	if buildErr != nil {
+		result = "failed"
+	}
+	repo := d.ReportRepo
+	if repo == "" {
+		repo = b.Repo
+	}
+	issue := &IssueRequest{
+		Title:  fmt.Sprintf("Dependency update %s on %s", result, time.Now().Format("2006-01-02")),
+		Body:   body.String(),
+		Labels: d.Labels,
+	}
+	if err := r.github.createIssue(repo, issue); err != nil {
+		log.Printf("reportDependencyUpdate: could not open issue: %s\n", err)
+		return
+	}
+	log.Printf("reported dependency update %s in %s#%d\n", b.Id, repo, issue.Number)
+}
+
+type dependencyPinsByRepo []*dependencyPin
+
+func (p dependencyPinsByRepo) Len() int           { return len(p) }
+func (p dependencyPinsByRepo) Less(i, j int) bool { return p[i].Repo < p[j].Repo }
+func (p dependencyPinsByRepo) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
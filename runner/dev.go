@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/util"
+)
+
+// dev boots a build instance and keeps a local checkout of a repo synced into
+// it, rebuilding the repo on each change until interrupted:
+//
+//	runner dev [--repo flynn-host] [--test CMD] [--interval 1s] <dir>
+//
+// The instance uses the boot flags of the runner, and a COW of --dockerfs if
+// it is set, otherwise all repos are built first.
+func dev(cmdArgs []string) error {
+	fs := flag.NewFlagSet("dev", flag.ExitOnError)
+	repo := fs.String("repo", "", "repo the checkout is of, defaults to the name of dir")
+	test := fs.String("test", "", "command run in the repo on the build instance after each build")
+	interval := fs.Duration("interval", time.Second, "how often to check the checkout for changes")
+	fs.Parse(cmdArgs)
+	if fs.NArg() != 1 {
+		return errors.New("usage: runner dev [--repo REPO] [--test CMD] [--interval 1s] <dir>")
+	}
+	dir, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *repo == "" {
+		*repo = filepath.Base(dir)
+	}
+	if _, ok := util.Repos[*repo]; !ok {
+		return fmt.Errorf("unknown repo %q, set --repo", *repo)
+	}
+	conf, err := args.Config()
+	if err != nil {
+		return err
+	}
+
+	bc := args.BootConfig
+	bc.Roles = conf.Roles
+	bc.BootProfiles = conf.BootProfiles
+	c := cluster.New(bc, os.Stdout)
+	c.ForwardAgent = conf.SSHAgent
+	c.DeployKey = conf.DeployKey
+	builder, err := c.NewBuilder(args.DockerFS)
+	if err != nil {
+		c.Shutdown()
+		return err
+	}
+	defer builder.Close()
+	if args.DockerFS == "" {
+		// the copy of the docker fs isn't needed
+		dockerfs, err := builder.Build(util.Repos, nil, nil, os.Stdout)
+		if err != nil {
+			return err
+		}
+		os.RemoveAll(filepath.Dir(dockerfs))
+	}
+
+	ds, err := builder.NewDevSync(*repo, dir)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	ds.Test = *test
+
+	stop := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		close(stop)
+	}()
+	fmt.Printf("syncing %s into the build instance as %s, interrupt to stop\n", dir, *repo)
+	ds.Watch(*interval, os.Stdout, stop)
+	return nil
+}
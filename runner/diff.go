@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// diffCmd prints the files which differ between two docker fs images, each
+// given either as a path or as a commit of an image in the build cache, to
+// see what changed in the built image between two commits:
+//
+//	runner diff [--root /var/lib/docker] [--json] A B
+func diffCmd(cmdArgs []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	root := fs.String("root", "/", "only compare files under this directory")
+	asJSON := fs.Bool("json", false, "print the changes as JSON")
+	fs.Parse(cmdArgs)
+	if fs.NArg() != 2 {
+		return errors.New("usage: runner diff [--root DIR] [--json] IMAGE|COMMIT IMAGE|COMMIT")
+	}
+	a, err := resolveImage(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := resolveImage(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	changes, err := cluster.DiffImages(a, b, *root)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if changes == nil {
+			changes = []*cluster.FileChange{}
+		}
+		return printJSON(changes)
+	}
+	for _, c := range changes {
+		switch c.Kind {
+		case "added":
+			fmt.Printf("+ %s\n", c.Path)
+		case "removed":
+			fmt.Printf("- %s\n", c.Path)
+		default:
+			fmt.Printf("~ %s (%s)\n", c.Path, c.Detail)
+		}
+	}
+	return nil
+}
+
+// resolveImage returns ref if it is a path, otherwise the image built from
+// commit ref in the build cache.
+func resolveImage(ref string) (string, error) {
+	if _, err := os.Stat(ref); err == nil {
+		return ref, nil
+	}
+	if args.BuildCache == "" {
+		return "", fmt.Errorf("%s is not an image, and there is no --build-cache to look up commits in", ref)
+	}
+	cache, err := cluster.NewBuildCache(args.BuildCache, args.CacheSize)
+	if err != nil {
+		return "", err
+	}
+	image := cache.Find(ref)
+	if image == "" {
+		return "", fmt.Errorf("no image built from %s in the build cache", ref)
+	}
+	return image, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// diskUsage is the usage of the disk holding Path.
+type diskUsage struct {
+	Path string  `json:"path"`
+	Size uint64  `json:"size"`
+	Free uint64  `json:"free"`
+	Used float64 `json:"used"`
+
+	dev uint64
+}
+
+func statDisk(path string) (*diskUsage, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return nil, err
+	}
+	d := &diskUsage{
+		Path: path,
+		Size: fs.Blocks * uint64(fs.Bsize),
+		Free: fs.Bavail * uint64(fs.Bsize),
+		dev:  uint64(info.Sys().(*syscall.Stat_t).Dev),
+	}
+	if d.Size > 0 {
+		d.Used = 1 - float64(d.Free)/float64(d.Size)
+	}
+	return d, nil
+}
+
+// diskPaths returns the directories the runner writes to.
+func (r *Runner) diskPaths() []string {
+	workdir := r.bc.Workdir
+	if workdir == "" {
+		workdir = os.TempDir()
+	}
+	paths := []string{workdir, filepath.Dir(args.DBPath)}
+	if r.cache != nil {
+		paths = append(paths, r.cache.Dir)
+	}
+	if s, ok := r.store.(*localStore); ok {
+		paths = append(paths, s.dir)
+	}
+	return append(paths, r.config.Disk.Paths...)
+}
+
+// fullestDisk returns the usage of the fullest disk the runner writes to.
+func (r *Runner) fullestDisk() *diskUsage {
+	var fullest *diskUsage
+	for _, path := range r.diskPaths() {
+		d, err := statDisk(path)
+		if err != nil {
+			log.Printf("could not check disk usage of %s: %s\n", path, err)
+			continue
+		}
+		if fullest == nil || d.Used > fullest.Used {
+			fullest = d
+		}
+	}
+	return fullest
+}
+
+// startDiskWatch periodically checks the runner's disks if the config sets
+// disk thresholds.
+func (r *Runner) startDiskWatch() {
+	if r.config.Disk == nil {
+		return
+	}
+	interval := time.Duration(r.config.Disk.Interval)
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	r.checkDisks()
+	go func() {
+		for range time.Tick(interval) {
+			r.checkDisks()
+		}
+	}()
+}
+
+// checkDisks alerts webhooks as the fullest disk crosses the thresholds, and
+// pauses new runs while it is full, pruning what it can to free it.
+func (r *Runner) checkDisks() {
+	conf := r.config.Disk
+	d := r.fullestDisk()
+	if d == nil {
+		return
+	}
+	if d.Used > conf.Full {
+		if !r.setDiskFull(true) {
+			log.Printf("disk holding %s is %.0f%% full, pausing new runs and pruning\n", d.Path, d.Used*100)
+			r.notifyWebhooks(&RunEvent{Event: "disk.full", Disk: d})
+		}
+		d = r.pruneDisk(d)
+	}
+	if d.Used <= conf.Full && r.setDiskFull(false) {
+		log.Printf("disk holding %s is %.0f%% full, resuming runs\n", d.Path, d.Used*100)
+		r.notifyWebhooks(&RunEvent{Event: "disk.ok", Disk: d})
+	}
+	warned := r.diskWarned
+	r.diskWarned = conf.Warn > 0 && d.Used > conf.Warn
+	if r.diskWarned && !warned && d.Used <= conf.Full {
+		log.Printf("disk holding %s is %.0f%% full\n", d.Path, d.Used*100)
+		r.notifyWebhooks(&RunEvent{Event: "disk.warn", Disk: d})
+	}
+}
+
+// setDiskFull records whether a disk is full, returning whether it already
+// was.
+func (r *Runner) setDiskFull(full bool) bool {
+	r.diskMtx.Lock()
+	defer r.diskMtx.Unlock()
+	was := r.diskFull
+	r.diskFull = full
+	return was
+}
+
+func (r *Runner) isDiskFull() bool {
+	r.diskMtx.Lock()
+	defer r.diskMtx.Unlock()
+	return r.diskFull
+}
+
+// waitForDisk holds back b until there is disk space for it.
+func (r *Runner) waitForDisk(b *Build) {
+	if !r.isDiskFull() {
+		return
+	}
+	log.Printf("disk is full, build %s waits for space\n", b.Id)
+	for r.isDiskFull() {
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// pruneDisk removes the least recently used build cache images and then the
+// oldest local artifacts on the full disk d until it is no longer full,
+// returning its usage. Images in use and archived builds are kept.
+func (r *Runner) pruneDisk(d *diskUsage) *diskUsage {
+	full := func() bool {
+		if u, err := statDisk(d.Path); err == nil {
+			d = u
+		}
+		return d.Used > r.config.Disk.Full
+	}
+	onDisk := func(dir string) bool {
+		u, err := statDisk(dir)
+		return err == nil && u.dev == d.dev
+	}
+	var pruned int
+	if r.cache != nil && onDisk(r.cache.Dir) {
+		for full() && r.cache.PruneOldest() {
+			pruned++
+		}
+	}
+	if s, ok := r.store.(*localStore); ok && onDisk(s.dir) && full() {
+		for _, f := range s.oldest() {
+			if strings.HasPrefix(f, "private/archive/") {
+				continue
+			}
+			if err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(f))); err == nil {
+				pruned++
+			}
+			if !full() {
+				break
+			}
+		}
+	}
+	if pruned > 0 {
+		log.Printf("pruned %d files, disk holding %s is %.0f%% full\n", pruned, d.Path, d.Used*100)
+	}
+	return d
+}
+
+// oldest returns the names of the stored artifacts, oldest first.
+func (s *localStore) oldest() []string {
+	var files []*storedFile
+	filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if rel, err := filepath.Rel(s.dir, path); err == nil {
+			files = append(files, &storedFile{filepath.ToSlash(rel), info.ModTime()})
+		}
+		return nil
+	})
+	sort.Sort(storedByModified(files))
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.name
+	}
+	return names
+}
+
+type storedFile struct {
+	name string
+	mod  time.Time
+}
+
+type storedByModified []*storedFile
+
+func (s storedByModified) Len() int           { return len(s) }
+func (s storedByModified) Less(i, j int) bool { return s[i].mod.Before(s[j].mod) }
+func (s storedByModified) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
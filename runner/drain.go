@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// defaultDrainTimeout is how long a drain waits for running builds before
+// shutting their clusters down.
+const defaultDrainTimeout = 2 * time.Hour
+
+// drainStatus is the progress of a drain, served by GET /drain.
+type drainStatus struct {
+	Draining  bool          `json:"draining"`
+	Started   time.Time     `json:"started,omitempty"`
+	Deadline  time.Time     `json:"deadline,omitempty"`
+	Remaining time.Duration `json:"remaining,omitempty"`
+	Running   []string      `json:"running"`
+	Done      bool          `json:"done"`
+}
+
+func (r *Runner) drainStatus() *drainStatus {
+	r.drainMtx.Lock()
+	s := &drainStatus{
+		Draining: r.draining,
+		Started:  r.drainStarted,
+		Deadline: r.drainDeadline,
+		Done:     r.drained,
+	}
+	r.drainMtx.Unlock()
+	if !s.Deadline.IsZero() && !s.Done {
+		if s.Remaining = s.Deadline.Sub(time.Now()); s.Remaining < 0 {
+			s.Remaining = 0
+		}
+	}
+	r.logsMtx.Lock()
+	s.Running = make([]string, 0, len(r.logs))
+	for id := range r.logs {
+		s.Running = append(s.Running, id)
+	}
+	r.logsMtx.Unlock()
+	sort.Strings(s.Running)
+	return s
+}
+
+// startDrain puts the runner in maintenance mode for a host reboot or
+// upgrade: new builds are left pending for the next runner, and once running
+// builds finish, or timeout passes and their clusters are shut down, the
+// runner stops serving and exits.
+func (r *Runner) startDrain(timeout time.Duration) error {
+	r.drainMtx.Lock()
+	if r.draining {
+		r.drainMtx.Unlock()
+		return errors.New("runner is already draining")
+	}
+	r.draining = true
+	r.drainStarted = time.Now()
+	r.drainDeadline = r.drainStarted.Add(timeout)
+	r.drainMtx.Unlock()
+	log.Printf("draining running builds for maintenance, deadline %s\n", r.drainDeadline.Format(time.RFC3339))
+
+	go func() {
+		done := make(chan struct{})
+		go func() {
+			r.running.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			log.Printf("drain deadline passed, shutting down clusters of builds %s\n", strings.Join(r.drainStatus().Running, ", "))
+			cluster.ShutdownAll()
+			select {
+			case <-done:
+			case <-time.After(time.Minute):
+				log.Println("builds did not finish after their clusters were shut down")
+			}
+		}
+		r.drainMtx.Lock()
+		r.drained = true
+		r.drainMtx.Unlock()
+		log.Println("drain finished, no longer serving")
+		r.listener.Close()
+	}()
+	return nil
+}
+
+func (r *Runner) isDrained() bool {
+	r.drainMtx.Lock()
+	defer r.drainMtx.Unlock()
+	return r.drained
+}
+
+// drainHandler starts a drain, with an optional timeout, or reports its
+// progress:
+//
+//	POST /drain?timeout=2h
+//	GET /drain
+func (r *Runner) drainHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST":
+		timeout := defaultDrainTimeout
+		if s := req.FormValue("timeout"); s != "" {
+			var err error
+			if timeout, err = time.ParseDuration(s); err != nil || timeout <= 0 {
+				http.Error(w, "invalid timeout\n", 400)
+				return
+			}
+		}
+		if err := r.startDrain(timeout); err != nil {
+			http.Error(w, err.Error()+"\n", 409)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed\n", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.drainStatus())
+}
+
+// drainCmd drains a runner before the host is rebooted or upgraded, printing
+// the builds still running until the runner exits, or each status it polls
+// as JSON with --json:
+//
+//	runner drain [--url http://localhost] [--timeout 2h] [--no-wait] [--json]
+func drainCmd(cmdArgs []string) error {
+	fs := flag.NewFlagSet("drain", flag.ExitOnError)
+	url := fs.String("url", "http://localhost", "URL of the runner")
+	timeout := fs.Duration("timeout", defaultDrainTimeout, "time to wait for running builds before shutting their clusters down")
+	noWait := fs.Bool("no-wait", false, "don't wait for the drain to finish")
+	asJSON := fs.Bool("json", false, "print the drain status as JSON")
+	fs.Parse(cmdArgs)
+	if fs.NArg() != 0 {
+		return errors.New("usage: runner drain [--url URL] [--timeout DURATION] [--no-wait] [--json]")
+	}
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+	do := func(method string) (*drainStatus, error) {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s/drain?timeout=%s", *url, *timeout), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth("", os.Getenv("API_TOKEN"))
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			return nil, fmt.Errorf("could not drain runner: %s", res.Status)
+		}
+		s := &drainStatus{}
+		return s, json.NewDecoder(res.Body).Decode(s)
+	}
+	s, err := do("POST")
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		for {
+			if err := printJSON(s); err != nil {
+				return err
+			}
+			if *noWait || s.Done {
+				return nil
+			}
+			time.Sleep(10 * time.Second)
+			if s, err = do("GET"); err != nil {
+				// the runner stops serving once drained
+				return printJSON(&drainStatus{Done: true})
+			}
+		}
+	}
+	fmt.Printf("draining until %s\n", s.Deadline.Format(time.RFC3339))
+	for !*noWait {
+		if s.Done {
+			fmt.Println("drained, the runner has exited")
+			return nil
+		}
+		fmt.Printf("%d builds running, %s until deadline: %s\n", len(s.Running), truncate(s.Remaining), strings.Join(s.Running, " "))
+		time.Sleep(10 * time.Second)
+		if s, err = do("GET"); err != nil {
+			// the runner stops serving once drained
+			fmt.Printf("runner stopped responding, assuming it drained and exited: %s\n", err)
+			return nil
+		}
+	}
+	return nil
+}
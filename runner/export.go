@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/flynn/flynn-test/config"
+)
+
+// exportRun and exportTest are the records of finished builds and their tests
+// sent to the analytics sink.
+type exportRun struct {
+	Id       string    `json:"id"`
+	Repo     string    `json:"repo"`
+	Branch   string    `json:"branch"`
+	Commit   string    `json:"commit"`
+	Author   string    `json:"author"`
+	Profile  string    `json:"profile"`
+	State    string    `json:"state"`
+	Created  time.Time `json:"created"`
+	Duration float64   `json:"duration_seconds"`
+	Passed   int       `json:"passed"`
+	Failed   int       `json:"failed"`
+	Skipped  int       `json:"skipped"`
+	Cost     float64   `json:"cost"`
+}
+
+type exportTest struct {
+	Run      string    `json:"run"`
+	Repo     string    `json:"repo"`
+	Branch   string    `json:"branch"`
+	Created  time.Time `json:"created"`
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	Duration float64   `json:"duration_seconds"`
+	Attempts int       `json:"attempts"`
+}
+
+// exportSink receives batches of records.
+type exportSink interface {
+	Export(runs []*exportRun, tests []*exportTest) error
+}
+
+func newExportSink(conf *config.ExportConfig) exportSink {
+	switch conf.Sink {
+	case "http":
+		return &httpSink{url: conf.URL}
+	default:
+		return &csvSink{dir: conf.Dir}
+	}
+}
+
+// csvSink appends records to runs.csv and tests.csv in dir.
+type csvSink struct {
+	dir string
+}
+
+var exportRunHeader = []string{"id", "repo", "branch", "commit", "author", "profile", "state", "created", "duration_seconds", "passed", "failed", "skipped", "cost"}
+var exportTestHeader = []string{"run", "repo", "branch", "created", "name", "status", "duration_seconds", "attempts"}
+
+func (s *csvSink) Export(runs []*exportRun, tests []*exportTest) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	var runRows, testRows [][]string
+	for _, r := range runs {
+		runRows = append(runRows, []string{
+			r.Id, r.Repo, r.Branch, r.Commit, r.Author, r.Profile, r.State,
+			r.Created.UTC().Format(time.RFC3339),
+			strconv.FormatFloat(r.Duration, 'f', 3, 64),
+			strconv.Itoa(r.Passed), strconv.Itoa(r.Failed), strconv.Itoa(r.Skipped),
+			strconv.FormatFloat(r.Cost, 'f', 4, 64),
+		})
+	}
+	for _, t := range tests {
+		testRows = append(testRows, []string{
+			t.Run, t.Repo, t.Branch, t.Created.UTC().Format(time.RFC3339), t.Name, t.Status,
+			strconv.FormatFloat(t.Duration, 'f', 3, 64),
+			strconv.Itoa(t.Attempts),
+		})
+	}
+	if err := appendCSV(filepath.Join(s.dir, "runs.csv"), exportRunHeader, runRows); err != nil {
+		return err
+	}
+	return appendCSV(filepath.Join(s.dir, "tests.csv"), exportTestHeader, testRows)
+}
+
+func appendCSV(path string, header []string, rows [][]string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	if info.Size() == 0 {
+		w.Write(header)
+	}
+	w.WriteAll(rows)
+	return w.Error()
+}
+
+// httpSink POSTs records as JSON, for loading into BigQuery or other
+// analytics stores.
+type httpSink struct {
+	url string
+}
+
+func (s *httpSink) Export(runs []*exportRun, tests []*exportTest) error {
+	data, err := json.Marshal(map[string]interface{}{"runs": runs, "tests": tests})
+	if err != nil {
+		return err
+	}
+	res, err := http.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("export to %s failed: %s", s.url, res.Status)
+	}
+	return nil
+}
+
+// queueExport queues a finished build to be sent to the analytics sink.
+func (r *Runner) queueExport(b *Build) {
+	if r.config.Export == nil {
+		return
+	}
+	if err := r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("export-queue")).Put([]byte(b.Id), []byte{})
+	}); err != nil {
+		log.Printf("could not queue build %s for export: %s\n", b.Id, err)
+	}
+}
+
+// startExports periodically sends the queued builds to the analytics sink.
+func (r *Runner) startExports() {
+	conf := r.config.Export
+	if conf == nil {
+		return
+	}
+	sink := newExportSink(conf)
+	go func() {
+		for range time.Tick(time.Duration(conf.Interval)) {
+			if err := r.export(sink); err != nil {
+				log.Printf("export failed: %s\n", err)
+			}
+		}
+	}()
+}
+
+// export sends the queued builds to sink, leaving them queued if it fails.
+func (r *Runner) export(sink exportSink) error {
+	var ids [][]byte
+	var runs []*exportRun
+	var tests []*exportTest
+	if err := r.db.View(func(tx *bolt.Tx) error {
+		builds := tx.Bucket([]byte("builds"))
+		return tx.Bucket([]byte("export-queue")).ForEach(func(k, v []byte) error {
+			ids = append(ids, append([]byte{}, k...))
+			val := builds.Get(k)
+			if val == nil {
+				return nil
+			}
+			b := &Build{}
+			if err := json.Unmarshal(val, b); err != nil {
+				return err
+			}
+			report := newResultsReport(b, b.Results)
+			run := &exportRun{
+				Id:       b.Id,
+				Repo:     b.Repo,
+				Branch:   b.Branch,
+				Commit:   b.Commit,
+				Author:   b.Author,
+				Profile:  b.Profile,
+				State:    b.State,
+				Created:  b.Created,
+				Duration: b.Duration.Seconds(),
+				Passed:   report.Passed,
+				Failed:   report.Failed,
+				Skipped:  report.Skipped,
+				Cost:     b.Cost,
+			}
+			for _, res := range b.Results {
+				tests = append(tests, &exportTest{
+					Run:      b.Id,
+					Repo:     b.Repo,
+					Branch:   b.Branch,
+					Created:  b.Created,
+					Name:     res.Name,
+					Status:   res.Status,
+					Duration: res.Duration.Seconds(),
+					Attempts: res.Attempts,
+				})
+			}
+			runs = append(runs, run)
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := sink.Export(runs, tests); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket([]byte("export-queue"))
+		for _, id := range ids {
+			if err := queue.Delete(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cupcake/goamz/s3"
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// externalService guards the calls the runner makes to an external API, such
+// as GitHub, the artifact store or a webhook. Calls which fail transiently
+// are retried with exponential backoff, waiting out rate limits the API
+// reports, and once calls have failed breakerThreshold times in a row the
+// circuit breaker opens and calls fail fast for breakerCooldown, so that an
+// outage degrades the runner rather than holding up every run.
+type externalService struct {
+	name string
+
+	mtx       sync.Mutex
+	failures  int
+	openUntil time.Time
+	limited   time.Time
+}
+
+const (
+	serviceAttempts  = 5
+	minBackoff       = 500 * time.Millisecond
+	maxBackoff       = 30 * time.Second
+	breakerThreshold = 5
+	breakerCooldown  = time.Minute
+
+	// maxRateLimitWait is the longest a call waits for a rate limit to
+	// reset before failing.
+	maxRateLimitWait = 2 * time.Minute
+)
+
+var (
+	servicesMtx sync.Mutex
+	services    = make(map[string]*externalService)
+)
+
+// service returns the externalService called name, shared by the callers of
+// the same API.
+func service(name string) *externalService {
+	servicesMtx.Lock()
+	defer servicesMtx.Unlock()
+	s, ok := services[name]
+	if !ok {
+		s = &externalService{name: name}
+		services[name] = s
+	}
+	return s
+}
+
+// permanentError is an error which retrying won't fix, such as a 404, and
+// which doesn't count against the circuit breaker.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// rateLimitError is a call refused by the rate limit of an API until Reset.
+type rateLimitError struct {
+	err   error
+	Reset time.Time
+}
+
+func (e *rateLimitError) Error() string {
+	return e.err.Error()
+}
+
+// call calls f until it succeeds, returns a permanentError or has been tried
+// serviceAttempts times.
+func (s *externalService) call(f func() error) error {
+	s.mtx.Lock()
+	open, limited := s.openUntil, s.limited
+	s.mtx.Unlock()
+	if time.Now().Before(open) {
+		return fmt.Errorf("%s: circuit open until %s after %d failures", s.name, open.Format(time.RFC3339), breakerThreshold)
+	}
+	if wait := limited.Sub(time.Now()); wait > maxRateLimitWait {
+		return fmt.Errorf("%s: rate limited until %s", s.name, limited.Format(time.RFC3339))
+	} else if wait > 0 {
+		time.Sleep(wait)
+	}
+
+	var err error
+	backoff := minBackoff
+	for i := 0; i < serviceAttempts; i++ {
+		if i > 0 {
+			// jitter so that callers don't retry in lockstep
+			time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+		if err = f(); err == nil {
+			s.succeeded()
+			return nil
+		}
+		switch e := err.(type) {
+		case *permanentError:
+			s.succeeded()
+			return e.err
+		case *rateLimitError:
+			s.mtx.Lock()
+			s.limited = e.Reset
+			s.mtx.Unlock()
+			wait := e.Reset.Sub(time.Now())
+			if wait > maxRateLimitWait {
+				return err
+			}
+			if wait > backoff {
+				time.Sleep(wait - backoff)
+			}
+		}
+	}
+	s.failed()
+	return err
+}
+
+func (s *externalService) succeeded() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.failures = 0
+}
+
+func (s *externalService) failed() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	// a call let through once the breaker has cooled down reopens it if it
+	// fails
+	if s.failures++; s.failures >= breakerThreshold {
+		if s.openUntil.IsZero() || time.Now().After(s.openUntil) {
+			log.Printf("%s: opening circuit for %s after %d failures\n", s.name, breakerCooldown, s.failures)
+		}
+		s.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+// serviceState is the state of an externalService for /metrics.
+type serviceState struct {
+	Name     string
+	Failures int
+	Open     bool
+}
+
+func serviceStates() []serviceState {
+	servicesMtx.Lock()
+	defer servicesMtx.Unlock()
+	states := make([]serviceState, 0, len(services))
+	for name, s := range services {
+		s.mtx.Lock()
+		states = append(states, serviceState{Name: name, Failures: s.failures, Open: time.Now().Before(s.openUntil)})
+		s.mtx.Unlock()
+	}
+	sort.Sort(serviceStatesByName(states))
+	return states
+}
+
+type serviceStatesByName []serviceState
+
+func (s serviceStatesByName) Len() int           { return len(s) }
+func (s serviceStatesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s serviceStatesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// statusError returns the error of an unsuccessful HTTP response, which is
+// permanent unless it is a server error, a timeout or a rate limit. GitHub
+// signals its rate limit with a 403 and X-RateLimit-Remaining of 0.
+func statusError(res *http.Response, err error) error {
+	if reset := rateLimitReset(res); !reset.IsZero() {
+		return &rateLimitError{err: err, Reset: reset}
+	}
+	if res.StatusCode >= 500 || res.StatusCode == 408 {
+		return err
+	}
+	return &permanentError{err}
+}
+
+// rateLimitReset returns when the rate limit an API refused res by resets,
+// or the zero time if res wasn't refused by a rate limit.
+func rateLimitReset(res *http.Response) time.Time {
+	if res.StatusCode != 429 && res.StatusCode != 403 {
+		return time.Time{}
+	}
+	if s := res.Header.Get("Retry-After"); s != "" {
+		if secs, err := strconv.Atoi(s); err == nil {
+			return time.Now().Add(time.Duration(secs) * time.Second)
+		}
+	}
+	if res.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return time.Unix(reset, 0)
+		}
+	}
+	if res.StatusCode == 429 {
+		return time.Now().Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+// noteRateLimit records the rate limit reported by a successful response,
+// so that calls wait for it to reset once it is used up instead of being
+// refused.
+func (s *externalService) noteRateLimit(res *http.Response) {
+	if res.Header.Get("X-RateLimit-Remaining") != "0" {
+		return
+	}
+	if reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		s.mtx.Lock()
+		s.limited = time.Unix(reset, 0)
+		s.mtx.Unlock()
+	}
+}
+
+// externalStore retries the calls to a remote artifact store through an
+// externalService.
+type externalStore struct {
+	ArtifactStore
+	service *externalService
+}
+
+func (s *externalStore) Put(name string, data io.ReadSeeker, contentType string, public bool, labels cluster.Labels) error {
+	return s.service.call(func() error {
+		if _, err := data.Seek(0, os.SEEK_SET); err != nil {
+			return &permanentError{err}
+		}
+		return storeError(s.ArtifactStore.Put(name, data, contentType, public, labels))
+	})
+}
+
+func (s *externalStore) Exists(name string) (exists bool, err error) {
+	err = s.service.call(func() error {
+		exists, err = s.ArtifactStore.Exists(name)
+		return storeError(err)
+	})
+	return
+}
+
+func (s *externalStore) Get(name string) (data []byte, err error) {
+	err = s.service.call(func() error {
+		data, err = s.ArtifactStore.Get(name)
+		return storeError(err)
+	})
+	return
+}
+
+// storeError marks the client errors of S3, such as a missing key or denied
+// access, as permanent.
+func storeError(err error) error {
+	if e, ok := err.(*s3.Error); ok && e.StatusCode >= 400 && e.StatusCode < 500 && e.StatusCode != 408 && e.StatusCode != 429 {
+		return &permanentError{err}
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/flynn/flynn-test/ansi"
+)
+
+// FailureSummary pins the most likely root cause of a failed run above its
+// megabytes of logs. Clues are the first line of each kind found in each
+// log collected from the run: the build log, failed tests' output, the
+// console tails of instances and the text artifacts.
+type FailureSummary struct {
+	Cause *FailureClue   `json:"cause"`
+	Clues []*FailureClue `json:"clues"`
+}
+
+// FailureClue is a line which may explain a failure, with the lines
+// following it, found in Source at Line.
+type FailureClue struct {
+	Kind    string `json:"kind"`
+	Source  string `json:"source"`
+	Line    int    `json:"line,omitempty"`
+	Text    string `json:"text"`
+	Excerpt string `json:"excerpt,omitempty"`
+}
+
+// failureKinds are the kinds of clues in the order they are picked as the
+// cause: panics and fatal errors are usually where a failure starts, while
+// failed tests and non-zero exits tend to follow from them, and the error
+// the run ended with is the least specific.
+var failureKinds = []string{"panic", "fatal", "test", "exit", "error"}
+
+var failurePatterns = []struct {
+	kind    string
+	pattern *regexp.Regexp
+}{
+	{"panic", regexp.MustCompile(`\bpanic: |\bfatal error: |Kernel panic - not syncing`)},
+	{"fatal", regexp.MustCompile(`\bFATAL\b|level=fatal|^fatal: |^F\d{4} \d\d:\d\d`)},
+	{"exit", regexp.MustCompile(`(?i)exit (?:status|code):? [1-9]\d*|exited with (?:code|status) [1-9]\d*|non-zero exit`)},
+}
+
+const (
+	// excerptLines is the number of lines following a clue kept with it,
+	// enough for the start of a stack trace.
+	excerptLines = 8
+
+	// maxClueLine truncates long lines of clues.
+	maxClueLine = 300
+
+	// maxScannedArtifact skips artifacts too large to be logs.
+	maxScannedArtifact = 64 << 20
+)
+
+// scanClues returns the first clue of each kind in the log read from r.
+func scanClues(source string, r io.Reader) []*FailureClue {
+	var clues []*FailureClue
+	found := make(map[string]bool)
+	var open []*FailureClue
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if line == "" && err != nil {
+			break
+		}
+		line = truncateLine(strings.TrimRight(line, "\r\n"))
+		for i := 0; i < len(open); i++ {
+			c := open[i]
+			c.Excerpt += "\n" + line
+			if strings.Count(c.Excerpt, "\n") >= excerptLines {
+				open = append(open[:i], open[i+1:]...)
+				i--
+			}
+		}
+		for _, p := range failurePatterns {
+			if found[p.kind] || !p.pattern.MatchString(line) {
+				continue
+			}
+			found[p.kind] = true
+			c := &FailureClue{Kind: p.kind, Source: source, Line: n, Text: line, Excerpt: line}
+			clues = append(clues, c)
+			open = append(open, c)
+		}
+		if err != nil || len(found) == len(failurePatterns) && len(open) == 0 {
+			break
+		}
+	}
+	return clues
+}
+
+func truncateLine(s string) string {
+	if len(s) > maxClueLine {
+		return s[:maxClueLine] + "..."
+	}
+	return s
+}
+
+// failureSummary applies the heuristics to the logs of a failed run, the
+// plain build log, the console tails of its instances and the artifacts in
+// artifactsDir, returning nil if the run passed.
+func failureSummary(buildLog []byte, results []*TestResult, consoleTails map[string][]string, artifactsDir string, runErr error) *FailureSummary {
+	var failed *TestResult
+	for _, res := range results {
+		if res.Failed() {
+			failed = res
+			break
+		}
+	}
+	if runErr == nil && failed == nil {
+		return nil
+	}
+	s := &FailureSummary{}
+	s.Clues = append(s.Clues, scanClues("build log", bytes.NewReader(ansi.Plain(buildLog)))...)
+	if failed != nil {
+		c := &FailureClue{Kind: "test", Source: failed.Name, Text: fmt.Sprintf("%s %s", failed.Name, failed.Status)}
+		if failed.File != "" {
+			c.Text = fmt.Sprintf("%s %s at %s:%d", failed.Name, failed.Status, failed.File, failed.Line)
+		}
+		c.Excerpt = excerpt(failed.Output)
+		s.Clues = append(s.Clues, c)
+	}
+	for _, res := range results {
+		if res.Failed() {
+			s.Clues = append(s.Clues, scanClues("test "+res.Name, strings.NewReader(res.Output))...)
+		}
+	}
+	ips := make([]string, 0, len(consoleTails))
+	for ip := range consoleTails {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		s.Clues = append(s.Clues, scanClues("console "+ip, strings.NewReader(strings.Join(consoleTails[ip], "\n")))...)
+	}
+	if artifactsDir != "" {
+		filepath.Walk(artifactsDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || info.Size() > maxScannedArtifact || !isTextArtifact(path) {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return nil
+			}
+			defer f.Close()
+			rel, _ := filepath.Rel(artifactsDir, path)
+			s.Clues = append(s.Clues, scanClues(filepath.ToSlash(rel), f)...)
+			return nil
+		})
+	}
+	if runErr != nil {
+		s.Clues = append(s.Clues, &FailureClue{Kind: "error", Source: "run", Text: truncateLine(runErr.Error())})
+	}
+	for _, kind := range failureKinds {
+		for _, c := range s.Clues {
+			if c.Kind == kind {
+				s.Cause = c
+				return s
+			}
+		}
+	}
+	return s
+}
+
+func excerpt(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) > excerptLines {
+		lines = lines[:excerptLines]
+	}
+	for i, l := range lines {
+		lines[i] = truncateLine(l)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func isTextArtifact(path string) bool {
+	switch filepath.Ext(path) {
+	case ".log", ".txt", ".out", "":
+		return true
+	}
+	return false
+}
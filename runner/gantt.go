@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/flynn/flynn-test/config"
+)
+
+// ganttWindow is how long the phases of runs are kept for the gantt view.
+const ganttWindow = 24 * time.Hour
+
+// phaseSpan is a phase of a run on a host, from Start until End, which is
+// zero while the phase runs. Runs waiting for a build slot are in the
+// "queued" phase.
+type phaseSpan struct {
+	Build  string    `json:"build"`
+	Repo   string    `json:"repo"`
+	Branch string    `json:"branch"`
+	Phase  string    `json:"phase"`
+	Host   string    `json:"host"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end,omitempty"`
+}
+
+var hostname, _ = os.Hostname()
+
+// startSpan records the start of a phase of b, returning a func to record
+// its end.
+func (r *Runner) startSpan(b *Build, phase string) func() {
+	s := &phaseSpan{
+		Build:  b.Id,
+		Repo:   b.Repo,
+		Branch: b.Branch,
+		Phase:  phase,
+		Host:   hostname,
+		Start:  time.Now(),
+	}
+	r.spansMtx.Lock()
+	// forget spans which ended before the window
+	cutoff := time.Now().Add(-ganttWindow)
+	spans := r.spans[:0]
+	for _, old := range r.spans {
+		if old.End.IsZero() || old.End.After(cutoff) {
+			spans = append(spans, old)
+		}
+	}
+	r.spans = append(spans, s)
+	r.spansMtx.Unlock()
+	return func() {
+		r.spansMtx.Lock()
+		s.End = time.Now()
+		r.spansMtx.Unlock()
+	}
+}
+
+// phaseSpans returns copies of the spans which overlap the period since.
+func (r *Runner) phaseSpans(since time.Time) []*phaseSpan {
+	r.spansMtx.Lock()
+	defer r.spansMtx.Unlock()
+	var spans []*phaseSpan
+	for _, s := range r.spans {
+		if s.End.IsZero() || s.End.After(since) {
+			c := *s
+			spans = append(spans, &c)
+		}
+	}
+	return spans
+}
+
+// ganttRow is a run in the gantt view, with its phases as bars.
+type ganttRow struct {
+	Build string
+	Label string
+	Host  string
+	Y     int
+	Bars  []*ganttBar
+}
+
+type ganttBar struct {
+	Phase string
+	Title string
+	X, W  float64
+}
+
+const (
+	ganttWidth     = 1200
+	ganttRowHeight = 18
+	ganttLabelW    = 260
+)
+
+var ganttColors = map[string]string{
+	"queued":       "#ccc",
+	"prepare":      "#9ecae1",
+	"build":        "#3182bd",
+	"snapshot":     "#6baed6",
+	"boot-cluster": "#fd8d3c",
+	"bootstrap":    "#e6550d",
+	"test":         "#31a354",
+	"collect":      "#a1d99b",
+	"teardown":     "#969696",
+	"script":       "#756bb1",
+	"layer":        "#9e9ac8",
+	"publish":      "#bcbddc",
+}
+
+func phaseColor(phase string) string {
+	if c, ok := ganttColors[phase]; ok {
+		return c
+	}
+	return "#999"
+}
+
+var ganttTemplate = template.Must(template.New("gantt").Funcs(templateFuncs).Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>Timeline - flynn-test</title>
+<style>
+body { font-family: sans-serif; }
+svg text { font-size: 11px; }
+.key span { display: inline-block; padding: 0 6px; margin-right: 4px; }
+</style>
+</head>
+<body>
+<p><a href="/runs">All runs</a></p>
+<h1>Runs since {{.Since.Format "2006-01-02 15:04"}}</h1>
+<p class="key">{{range .Phases}}<span style="background: {{color .}}">{{.}}</span>{{end}}</p>
+{{if .Rows}}
+<svg width="{{.Width}}" height="{{.Height}}">
+{{range .Ticks}}<line x1="{{.X}}" y1="0" x2="{{.X}}" y2="{{$.Height}}" stroke="#eee"/><text x="{{.X}}" y="{{$.Height}}" dx="2" dy="-2">{{.Label}}</text>
+{{end}}
+{{range .Rows}}<a href="/runs/{{.Build}}"><text x="0" y="{{.Y}}" dy="13">{{.Host}} {{.Label}}</text></a>
+{{$y := .Y}}{{range .Bars}}<rect x="{{.X}}" y="{{$y}}" width="{{.W}}" height="15" fill="{{color .Phase}}"><title>{{.Title}}</title></rect>
+{{end}}{{end}}
+</svg>
+{{else}}
+<p>No runs in this period.</p>
+{{end}}
+</body>
+</html>
+`[1:]))
+
+type ganttTick struct {
+	X     float64
+	Label string
+}
+
+// ganttHandler shows the phases of the runs of the last hours, default 6, as
+// a gantt chart with a row per run grouped by host, or serves them as JSON
+// if format is json:
+//
+//	GET /gantt?hours=6&format=json
+func (r *Runner) ganttHandler(w http.ResponseWriter, req *http.Request) {
+	window := 6 * time.Hour
+	if s := req.FormValue("hours"); s != "" {
+		d, err := time.ParseDuration(s + "h")
+		if err != nil || d <= 0 || d > ganttWindow {
+			http.Error(w, "hours must be between 0 and 24\n", 400)
+			return
+		}
+		window = d
+	}
+	now := time.Now()
+	since := now.Add(-window)
+	spans := r.phaseSpans(since)
+	if req.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(spans)
+		return
+	}
+
+	sort.Sort(spansByHost(spans))
+	scale := float64(ganttWidth-ganttLabelW) / float64(window)
+	x := func(t time.Time) float64 {
+		if t.IsZero() || t.After(now) {
+			t = now
+		}
+		if t.Before(since) {
+			t = since
+		}
+		return ganttLabelW + float64(t.Sub(since))*scale
+	}
+	var rows []*ganttRow
+	byBuild := make(map[string]*ganttRow)
+	for _, s := range spans {
+		row, ok := byBuild[s.Build]
+		if !ok {
+			row = &ganttRow{Build: s.Build, Label: s.Repo + " " + s.Branch, Host: s.Host, Y: len(rows) * ganttRowHeight}
+			byBuild[s.Build] = row
+			rows = append(rows, row)
+		}
+		end := "running"
+		if !s.End.IsZero() {
+			end = truncate(s.End.Sub(s.Start)).String()
+		}
+		bar := &ganttBar{Phase: s.Phase, Title: s.Phase + ": " + end, X: x(s.Start)}
+		if bar.W = x(s.End) - bar.X; bar.W < 1 {
+			bar.W = 1
+		}
+		row.Bars = append(row.Bars, bar)
+	}
+	height := (len(rows) + 1) * ganttRowHeight
+	var ticks []*ganttTick
+	step := time.Hour
+	if window <= 2*time.Hour {
+		step = 15 * time.Minute
+	}
+	for t := since.Truncate(step).Add(step); t.Before(now); t = t.Add(step) {
+		ticks = append(ticks, &ganttTick{X: x(t), Label: t.Format("15:04")})
+	}
+	phases := append([]string{"queued"}, config.RunPhases...)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := ganttTemplate.Execute(w, map[string]interface{}{
+		"Since":  since,
+		"Rows":   rows,
+		"Ticks":  ticks,
+		"Phases": phases,
+		"Width":  ganttWidth,
+		"Height": height,
+	}); err != nil {
+		log.Println("dashboard: error rendering gantt:", err)
+	}
+}
+
+type spansByHost []*phaseSpan
+
+func (s spansByHost) Len() int      { return len(s) }
+func (s spansByHost) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s spansByHost) Less(i, j int) bool {
+	if s[i].Host != s[j].Host {
+		return s[i].Host < s[j].Host
+	}
+	return s[i].Start.Before(s[j].Start)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var githubAPI = "https://api.github.com"
+
+var errNotFound = errors.New("github: not found")
+
+type githubClient struct {
+	token string
+
+	// app, if set, authenticates requests as a GitHub App installation
+	// instead of with token.
+	app *githubApp
+
+	// user is the login token belongs to, see login.
+	user    string
+	userMtx sync.Mutex
+}
+
+// request calls the GitHub API through the "github" externalService.
+func (g *githubClient) request(method, path string, body, res interface{}) error {
+	_, err := g.requestPage(method, path, body, res)
+	return err
+}
+
+// requestPage is request for paginated lists, also returning the path of the
+// next page, or an empty string if there is none.
+func (g *githubClient) requestPage(method, path string, body, res interface{}) (string, error) {
+	var next string
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return "", err
+		}
+	}
+	err := service("github").call(func() error {
+		var buf io.Reader
+		if data != nil {
+			buf = bytes.NewReader(data)
+		}
+		req, err := http.NewRequest(method, githubAPI+path, buf)
+		if err != nil {
+			return &permanentError{err}
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/vnd.github.antiope-preview+json")
+		token := g.token
+		if g.app != nil {
+			if token, err = g.app.installationToken(); err != nil {
+				return &permanentError{err}
+			}
+		}
+		req.Header.Set("Authorization", "token "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == 404 {
+			return &permanentError{errNotFound}
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return statusError(resp, fmt.Errorf("github: %s %s failed: %d", method, path, resp.StatusCode))
+		}
+		service("github").noteRateLimit(resp)
+		next = nextPage(resp.Header.Get("Link"))
+		if res != nil {
+			if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+				return &permanentError{err}
+			}
+		}
+		return nil
+	})
+	return next, err
+}
+
+// nextPage returns the API path of the rel="next" URL of a Link header.
+func nextPage(link string) string {
+	for _, l := range strings.Split(link, ",") {
+		parts := strings.Split(l, ";")
+		if len(parts) < 2 || strings.TrimSpace(parts[1]) != `rel="next"` {
+			continue
+		}
+		u := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+		return strings.TrimPrefix(u, githubAPI)
+	}
+	return ""
+}
+
+// login returns the login of the user the token belongs to.
+func (g *githubClient) login() (string, error) {
+	g.userMtx.Lock()
+	defer g.userMtx.Unlock()
+	if g.user != "" {
+		return g.user, nil
+	}
+	var user PRUser
+	if err := g.request("GET", "/user", nil, &user); err != nil {
+		return "", err
+	}
+	g.user = user.Login
+	return g.user, nil
+}
+
+type CheckRun struct {
+	Id          int64        `json:"id,omitempty"`
+	Name        string       `json:"name,omitempty"`
+	HeadSha     string       `json:"head_sha,omitempty"`
+	Status      string       `json:"status,omitempty"`
+	Conclusion  string       `json:"conclusion,omitempty"`
+	DetailsUrl  string       `json:"details_url,omitempty"`
+	StartedAt   *time.Time   `json:"started_at,omitempty"`
+	CompletedAt *time.Time   `json:"completed_at,omitempty"`
+	Output      *CheckOutput `json:"output,omitempty"`
+}
+
+type CheckOutput struct {
+	Title       string             `json:"title"`
+	Summary     string             `json:"summary"`
+	Annotations []*CheckAnnotation `json:"annotations,omitempty"`
+}
+
+type CheckAnnotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"`
+	Title           string `json:"title,omitempty"`
+	Message         string `json:"message"`
+}
+
+func (g *githubClient) createCheckRun(repo string, run *CheckRun) error {
+	return g.request("POST", fmt.Sprintf("/repos/flynn/%s/check-runs", repo), run, run)
+}
+
+func (g *githubClient) updateCheckRun(repo string, run *CheckRun) error {
+	id := run.Id
+	run.Id = 0
+	defer func() { run.Id = id }()
+	return g.request("PATCH", fmt.Sprintf("/repos/flynn/%s/check-runs/%d", repo, id), run, nil)
+}
+
+// CommitStatus is the overall result of a build, shown on the commit and
+// its pull requests alongside the check runs of each phase.
+type CommitStatus struct {
+	State       string `json:"state"`
+	TargetUrl   string `json:"target_url,omitempty"`
+	Description string `json:"description,omitempty"`
+	Context     string `json:"context"`
+}
+
+func (g *githubClient) createStatus(repo, sha string, s *CommitStatus) error {
+	return g.request("POST", fmt.Sprintf("/repos/flynn/%s/statuses/%s", repo, sha), s, nil)
+}
+
+type fileContent struct {
+	Encoding string `json:"encoding"`
+	Content  string `json:"content"`
+}
+
+// fileContents returns the contents of path in repo at ref, or nil if it
+// doesn't exist.
+func (g *githubClient) fileContents(repo, path, ref string) ([]byte, error) {
+	var f fileContent
+	err := g.request("GET", fmt.Sprintf("/repos/flynn/%s/contents/%s?ref=%s", repo, path, ref), nil, &f)
+	if err == errNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if f.Encoding != "base64" {
+		return nil, fmt.Errorf("github: unexpected encoding %q of %s", f.Encoding, path)
+	}
+	return base64.StdEncoding.DecodeString(f.Content)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// githubApp authenticates as an installation of a GitHub App, which the
+// Checks API requires, exchanging a JWT signed with the app's private key for
+// an installation token.
+type githubApp struct {
+	id           string
+	installation string
+	key          *rsa.PrivateKey
+
+	mtx     sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newGithubApp returns the GitHub App configured by GITHUB_APP_ID,
+// GITHUB_APP_INSTALLATION_ID and GITHUB_APP_KEY, the path of its PEM encoded
+// private key, or nil if GITHUB_APP_ID is not set.
+func newGithubApp() (*githubApp, error) {
+	id := os.Getenv("GITHUB_APP_ID")
+	if id == "" {
+		return nil, nil
+	}
+	installation := os.Getenv("GITHUB_APP_INSTALLATION_ID")
+	if installation == "" {
+		return nil, errors.New("GITHUB_APP_ID is set without GITHUB_APP_INSTALLATION_ID")
+	}
+	path := os.Getenv("GITHUB_APP_KEY")
+	if path == "" {
+		return nil, errors.New("GITHUB_APP_ID is set without GITHUB_APP_KEY")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse GitHub App key %s: %s", path, err)
+	}
+	return &githubApp{id: id, installation: installation, key: key}, nil
+}
+
+// jwt returns a token authenticating as the app itself, valid for the
+// maximum of ten minutes less some slack for clock drift.
+func (a *githubApp) jwt() (string, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.id,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// installationToken returns a token of the app's installation, requesting a
+// new one when the current one is about to expire.
+func (a *githubApp) installationToken() (string, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.token != "" && time.Now().Add(5*time.Minute).Before(a.expires) {
+		return a.token, nil
+	}
+	jwt, err := a.jwt()
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	path := fmt.Sprintf("/app/installations/%s/access_tokens", a.installation)
+	err = service("github").call(func() error {
+		req, err := http.NewRequest("POST", githubAPI+path, nil)
+		if err != nil {
+			return &permanentError{err}
+		}
+		req.Header.Set("Accept", "application/vnd.github.machine-man-preview+json")
+		req.Header.Set("Authorization", "Bearer "+jwt)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return statusError(resp, fmt.Errorf("github: POST %s failed: %d", path, resp.StatusCode))
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return &permanentError{err}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not get GitHub App installation token: %s", err)
+	}
+	a.token, a.expires = res.Token, res.ExpiresAt
+	return a.token, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+)
+
+// handoffSocket is the unix socket on which the runner hands its listener to
+// a new runner started alongside it with the same database.
+func handoffSocket() string {
+	return args.DBPath + ".handoff"
+}
+
+// takeOver asks the runner already running with the same database for its
+// listener, returning false if there is no such runner. The previous runner
+// refuses new builds and exits once its running builds have drained, leaving
+// the database to this one.
+func (r *Runner) takeOver() (bool, error) {
+	conn, err := net.Dial("unix", handoffSocket())
+	if err != nil {
+		return false, nil
+	}
+	defer conn.Close()
+	uc := conn.(*net.UnixConn)
+	if _, err := uc.Write([]byte("handoff\n")); err != nil {
+		return false, fmt.Errorf("could not request handoff: %s", err)
+	}
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return false, fmt.Errorf("could not receive listener: %s", err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return false, fmt.Errorf("could not receive listener: %s", err)
+	}
+	if len(msgs) != 1 {
+		return false, errors.New("could not receive listener: no file descriptor sent")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return false, errors.New("could not receive listener: no file descriptor sent")
+	}
+	f := os.NewFile(uintptr(fds[0]), "listener")
+	defer f.Close()
+	if r.listener, err = net.FileListener(f); err != nil {
+		return false, err
+	}
+	log.Println("took over listener, waiting for the previous runner to drain")
+	return true, nil
+}
+
+// serveHandoff accepts a single handoff request from a new runner.
+func (r *Runner) serveHandoff() error {
+	path := handoffSocket()
+	// remove the socket of a runner which didn't exit cleanly
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("could not listen for handoff: %s", err)
+	}
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			err = r.handOff(conn.(*net.UnixConn))
+			conn.Close()
+			if err == nil {
+				return
+			}
+			log.Printf("handoff failed: %s\n", err)
+		}
+	}()
+	return nil
+}
+
+// handOff sends the listener to the new runner on conn and stops accepting
+// connections, which makes serve return.
+func (r *Runner) handOff(conn *net.UnixConn) error {
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "handoff\n" {
+		return errors.New("invalid handoff request")
+	}
+	f, err := r.listener.(*net.TCPListener).File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(f.Fd())), nil); err != nil {
+		return err
+	}
+	r.drainMtx.Lock()
+	r.draining = true
+	r.handedOff = true
+	r.drainMtx.Unlock()
+	log.Println("handed listener over to new runner, refusing new builds")
+	return r.listener.Close()
+}
+
+func (r *Runner) isHandedOff() bool {
+	r.drainMtx.Lock()
+	defer r.drainMtx.Unlock()
+	return r.handedOff
+}
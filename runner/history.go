@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// runRecord is the entry of a finished run in the run history, which is kept
+// when the build itself is archived so that tests can be scored over many
+// runs without loading them.
+type runRecord struct {
+	Build    string                 `json:"build"`
+	Repo     string                 `json:"repo"`
+	Commit   string                 `json:"commit"`
+	Branch   string                 `json:"branch"`
+	Created  time.Time              `json:"created"`
+	Duration time.Duration          `json:"duration"`
+	Passed   bool                   `json:"passed"`
+	LogUrl   string                 `json:"log_url,omitempty"`
+	Tests    map[string]*testRecord `json:"tests"`
+}
+
+type testRecord struct {
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+}
+
+func (t *testRecord) failed() bool {
+	return t.Status == "fail" || t.Status == "panic"
+}
+
+// historyBucket is the bucket of the run history of project, so that the
+// tests of a project are only scored over its own runs.
+func historyBucket(project string) []byte {
+	if project == "" {
+		return []byte("run-history")
+	}
+	return []byte("run-history-" + project)
+}
+
+// recordHistory adds a finished run to the run history of its project, keyed
+// by creation time so that the latest runs are read first.
+func (r *Runner) recordHistory(b *Build, results []*TestResult, err error) {
+	rec := &runRecord{
+		Build:    b.Id,
+		Repo:     b.Repo,
+		Commit:   b.Commit,
+		Branch:   b.Branch,
+		Created:  b.Created,
+		Duration: b.Duration,
+		Passed:   err == nil,
+		LogUrl:   b.LogUrl,
+		Tests:    make(map[string]*testRecord, len(results)),
+	}
+	for _, res := range results {
+		rec.Tests[res.Name] = &testRecord{Status: res.Status, Duration: res.Duration}
+	}
+	val, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("could not record history of build %s: %s\n", b.Id, err)
+		return
+	}
+	if err := r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyBucket(b.Project)).Put(indexKey("", b), val)
+	}); err != nil {
+		log.Printf("could not record history of build %s: %s\n", b.Id, err)
+	}
+}
+
+// history returns the latest n runs of project on branch, or on every branch
+// if it is empty, newest first. Runs with labelled annotations are skipped.
+func (r *Runner) history(project, branch string, n int) ([]*runRecord, error) {
+	var runs []*runRecord
+	err := r.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(historyBucket(project))
+		if bkt == nil {
+			return fmt.Errorf("unknown project %q", project)
+		}
+		c := bkt.Cursor()
+		for k, v := c.Last(); k != nil && len(runs) < n; k, v = c.Prev() {
+			rec := &runRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				continue
+			}
+			if (branch == "" || rec.Branch == branch) && !excluded(getAnnotations(tx, rec.Build)) {
+				runs = append(runs, rec)
+			}
+		}
+		return nil
+	})
+	return runs, err
+}
+
+// testHistory summarises a test over a window of runs. Its flakiness score
+// is the share of the runs it ran in which it either only passed on a rerun
+// or changed between passing and failing since the previous run, so a test
+// which broke once scores low while one which keeps flipping scores high.
+type testHistory struct {
+	Name       string  `json:"name"`
+	Runs       int     `json:"runs"`
+	Failures   int     `json:"failures"`
+	Flaky      int     `json:"flaky"`
+	Flips      int     `json:"flips"`
+	Score      float64 `json:"score"`
+	LastFailed string  `json:"last_failed,omitempty"`
+
+	// Owners are the owners of the test, which failures are routed to.
+	Owners []string `json:"owners,omitempty"`
+}
+
+// testHistories scores the tests which ran in runs, which are newest first.
+func testHistories(runs []*runRecord) []*testHistory {
+	tests := make(map[string]*testHistory)
+	last := make(map[string]bool)
+	for i := len(runs) - 1; i >= 0; i-- {
+		for name, t := range runs[i].Tests {
+			if t.Status == "skip" || t.Status == "miss" {
+				continue
+			}
+			h, ok := tests[name]
+			if !ok {
+				h = &testHistory{Name: name}
+				tests[name] = h
+			}
+			h.Runs++
+			failed := t.failed()
+			if failed {
+				h.Failures++
+				h.LastFailed = runs[i].Build
+			}
+			if t.Status == "flaky" {
+				h.Flaky++
+			}
+			if prev, ok := last[name]; ok && prev != failed {
+				h.Flips++
+			}
+			last[name] = failed
+		}
+	}
+	list := make([]*testHistory, 0, len(tests))
+	for _, h := range tests {
+		h.Score = float64(h.Flaky+h.Flips) / float64(h.Runs)
+		if h.Score > 1 {
+			h.Score = 1
+		}
+		list = append(list, h)
+	}
+	sort.Sort(testHistoriesByScore(list))
+	return list
+}
+
+type testHistoriesByScore []*testHistory
+
+func (t testHistoriesByScore) Len() int      { return len(t) }
+func (t testHistoriesByScore) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t testHistoriesByScore) Less(i, j int) bool {
+	if t[i].Score != t[j].Score {
+		return t[i].Score > t[j].Score
+	}
+	if t[i].Failures != t[j].Failures {
+		return t[i].Failures > t[j].Failures
+	}
+	return t[i].Name < t[j].Name
+}
+
+// flakyTests returns the flakiness scores of tests over the latest master
+// runs of project.
+func (r *Runner) flakyTests(project string) map[string]float64 {
+	runs, err := r.history(project, "master", r.config.FlakyWindow())
+	if err != nil {
+		log.Printf("could not load run history: %s\n", err)
+		return nil
+	}
+	scores := make(map[string]float64)
+	for _, h := range testHistories(runs) {
+		scores[h.Name] = h.Score
+	}
+	return scores
+}
+
+// listTestHistory serves the tests which ran in the latest runs of a branch
+// as JSON, the flakiest first, or only those which failed if failed is set.
+// The runs are those of flynn unless project is set:
+//
+//	GET /tests?branch=master&runs=20&failed=true&project=devbox
+func (r *Runner) listTestHistory(w http.ResponseWriter, req *http.Request) {
+	n := r.config.FlakyWindow()
+	if s := req.FormValue("runs"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "invalid runs\n", 400)
+			return
+		}
+	}
+	branch := req.FormValue("branch")
+	if _, ok := req.Form["branch"]; !ok {
+		branch = "master"
+	}
+	project := req.FormValue("project")
+	if _, ok := r.config.Projects[project]; project != "" && !ok {
+		http.Error(w, fmt.Sprintf("unknown project %q\n", project), 400)
+		return
+	}
+	runs, err := r.history(project, branch, n)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not load run history: %s\n", err), 500)
+		return
+	}
+	tests := testHistories(runs)
+	if owners, err := testOwners(); err != nil {
+		log.Printf("could not get test owners: %s\n", err)
+	} else {
+		for _, t := range tests {
+			t.Owners = ownersOf(owners, t.Name)
+		}
+	}
+	if req.FormValue("failed") == "true" {
+		failed := tests[:0]
+		for _, t := range tests {
+			if t.Failures > 0 {
+				failed = append(failed, t)
+			}
+		}
+		tests = failed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tests)
+}
+
+// flaky lists the flakiest tests of the latest runs of a branch, or the tests
+// which failed in them:
+//
+//	runner flaky [--url http://localhost] [--branch master] [--project NAME] [--runs N] [--failed] [--json]
+func flaky(cmdArgs []string) error {
+	fs := flag.NewFlagSet("flaky", flag.ExitOnError)
+	url := fs.String("url", "http://localhost", "URL of the runner")
+	branch := fs.String("branch", "master", "branch whose runs to score, or all branches if empty")
+	project := fs.String("project", "", "project whose runs to score, defaulting to flynn")
+	runs := fs.Int("runs", 0, "number of runs to score, defaulting to the runner's flaky window")
+	failed := fs.Bool("failed", false, "only list tests which failed")
+	asJSON := fs.Bool("json", false, "print the tests as JSON")
+	fs.Parse(cmdArgs)
+	if fs.NArg() != 0 {
+		return errors.New("usage: runner flaky [--url URL] [--branch BRANCH] [--project NAME] [--runs N] [--failed] [--json]")
+	}
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/tests?branch=%s&failed=%t", *url, *branch, *failed)
+	if *runs > 0 {
+		u += fmt.Sprintf("&runs=%d", *runs)
+	}
+	if *project != "" {
+		u += "&project=" + *project
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("", os.Getenv("API_TOKEN"))
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("could not list tests: %s", res.Status)
+	}
+	var tests []*testHistory
+	if err := json.NewDecoder(res.Body).Decode(&tests); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(tests)
+	}
+	printTestHistory(os.Stdout, tests)
+	return nil
+}
+
+func printTestHistory(out io.Writer, tests []*testHistory) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SCORE\tRUNS\tFAILURES\tFLAKY\tFLIPS\tLAST FAILED\tOWNERS\tTEST")
+	for _, t := range tests {
+		fmt.Fprintf(w, "%.2f\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n", t.Score, t.Runs, t.Failures, t.Flaky, t.Flips, t.LastFailed, strings.Join(t.Owners, ","), t.Name)
+	}
+	w.Flush()
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// infraError is a build failure caused by the runner host rather than the
+// code under test, such as host resources leaked by a cluster.
+type infraError struct {
+	err error
+}
+
+func (e *infraError) Error() string {
+	return "infrastructure failure: " + e.err.Error()
+}
+
+// bootError is the error of a cluster which failed to boot, which is an
+// infrastructure failure if the rootfs lacks prerequisites of flynn-host or
+// keeps a skewed clock.
+func bootError(err error) error {
+	switch err.(type) {
+	case *cluster.PrereqError, *cluster.ClockSkewError:
+		return &infraError{err}
+	}
+	return fmt.Errorf("could not boot cluster: %s", err)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+// failureIssue is an open issue of a test which keeps failing on master,
+// kept in the failure-issues bucket keyed by repo and test.
+type failureIssue struct {
+	Number int `json:"number"`
+}
+
+func failureIssueKey(repo, test string) []byte {
+	return []byte(repo + " " + test)
+}
+
+func (g *githubClient) closeIssue(repo string, number int) error {
+	return g.request("PATCH", fmt.Sprintf("/repos/flynn/%s/issues/%d", repo, number), map[string]string{"state": "closed"}, nil)
+}
+
+// fileFailureIssues opens an issue in the repo of a finished master run for
+// each test which has failed in the latest FailureIssuesAfter runs of the
+// repo, comments on the open issues of tests which failed again and closes
+// those of tests which passed.
+func (r *Runner) fileFailureIssues(b *Build, results []*TestResult) {
+	after := r.config.FailureIssuesAfter()
+	window := r.config.FlakyWindow()
+	if window < after {
+		window = after
+	}
+	runs, err := r.history(b.Project, "master", window)
+	if err != nil {
+		log.Printf("could not load run history to file issues: %s\n", err)
+		return
+	}
+	var repoRuns []*runRecord
+	for _, run := range runs {
+		if run.Repo == b.Repo {
+			repoRuns = append(repoRuns, run)
+		}
+	}
+
+	for _, res := range results {
+		key := failureIssueKey(b.Repo, res.Name)
+		issue := r.failureIssue(key)
+		switch {
+		case res.Failed() && issue != nil:
+			r.commentFailureIssue(b, issue, fmt.Sprintf("%s failed again in %s.", res.Name, runLink(b.Id, b.Commit, b.LogUrl))+failureCause(b))
+		case res.Failed():
+			failing := consecutiveFailures(repoRuns, res.Name)
+			if len(failing) < after {
+				continue
+			}
+			issue, err := r.openFailureIssue(b, res.Name, failing)
+			if err != nil {
+				log.Printf("could not open issue for %s: %s\n", res.Name, err)
+				continue
+			}
+			r.saveFailureIssue(key, issue)
+		case issue != nil && res.Status == "pass":
+			r.commentFailureIssue(b, issue, fmt.Sprintf("%s passed in %s, closing.", res.Name, runLink(b.Id, b.Commit, b.LogUrl)))
+			if err := r.github.closeIssue(b.Repo, issue.Number); err != nil {
+				log.Printf("could not close issue %s#%d: %s\n", b.Repo, issue.Number, err)
+				continue
+			}
+			r.saveFailureIssue(key, nil)
+		}
+	}
+}
+
+// consecutiveFailures returns the latest runs test failed in before a run
+// it passed in, skipping runs it didn't run in.
+func consecutiveFailures(runs []*runRecord, test string) []*runRecord {
+	var failing []*runRecord
+	for _, run := range runs {
+		t, ok := run.Tests[test]
+		if !ok || t.Status == "skip" || t.Status == "miss" {
+			continue
+		}
+		if !t.failed() {
+			break
+		}
+		failing = append(failing, run)
+	}
+	return failing
+}
+
+func (r *Runner) openFailureIssue(b *Build, test string, runs []*runRecord) (*failureIssue, error) {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "%s has failed in the latest %d master runs of %s:\n\n", test, len(runs), b.Repo)
+	for _, run := range runs {
+		fmt.Fprintf(&body, "- %s\n", runLink(run.Build, run.Commit, run.LogUrl))
+	}
+	body.WriteString(failureCause(b))
+	body.WriteString("\n\nFlynn CI comments on this issue when the test fails again, and closes it once the test passes.\n")
+	req := &IssueRequest{
+		Title: test + " is failing on master",
+		Body:  body.String(),
+	}
+	if r.config.FailureIssues != nil {
+		req.Labels = r.config.FailureIssues.Labels
+	}
+	if err := r.github.createIssue(b.Repo, req); err != nil {
+		return nil, err
+	}
+	log.Printf("opened %s#%d for %s failing on master\n", b.Repo, req.Number, test)
+	return &failureIssue{Number: req.Number}, nil
+}
+
+func (r *Runner) commentFailureIssue(b *Build, issue *failureIssue, body string) {
+	if err := r.github.createComment(b.Repo, issue.Number, body); err != nil {
+		log.Printf("could not comment on %s#%d: %s\n", b.Repo, issue.Number, err)
+	}
+}
+
+// runLink links to the log of a run.
+func runLink(build, commit, logUrl string) string {
+	if len(commit) > 10 {
+		commit = commit[:10]
+	}
+	if logUrl == "" {
+		return fmt.Sprintf("run %s at %s", build, commit)
+	}
+	return fmt.Sprintf("[run %s](%s) at %s", build, logUrl, commit)
+}
+
+// failureCause describes the classified cause of the failure of b.
+func failureCause(b *Build) string {
+	if b.Failure == nil || b.Failure.Cause == nil {
+		return ""
+	}
+	c := b.Failure.Cause
+	return fmt.Sprintf("\n\nLikely cause (%s, %s):\n\n```\n%s\n```", c.Kind, c.Source, c.Text)
+}
+
+func (r *Runner) failureIssue(key []byte) *failureIssue {
+	var issue *failureIssue
+	r.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("failure-issues")).Get(key); v != nil {
+			issue = &failureIssue{}
+			if err := json.Unmarshal(v, issue); err != nil {
+				issue = nil
+			}
+		}
+		return nil
+	})
+	return issue
+}
+
+// saveFailureIssue records the open issue of key, or removes it if issue is
+// nil.
+func (r *Runner) saveFailureIssue(key []byte, issue *failureIssue) {
+	if err := r.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte("failure-issues"))
+		if issue == nil {
+			return bkt.Delete(key)
+		}
+		val, err := json.Marshal(issue)
+		if err != nil {
+			return err
+		}
+		return bkt.Put(key, val)
+	}); err != nil {
+		log.Printf("could not save failure issue %s: %s\n", key, err)
+	}
+}
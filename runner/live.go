@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/flynn/flynn-test/ansi"
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// setPhase records the phase of a running build, one of building, booting,
+// testing and done, which is also the status of each of its instances.
+func (r *Runner) setPhase(b *Build, phase string) {
+	b.Phase = phase
+	for _, inst := range b.Instances {
+		inst.Status = phase
+	}
+	if err := r.save(b); err != nil {
+		log.Printf("could not save phase of build %s: %s\n", b.Id, err)
+	}
+	build := *b
+	build.Env, build.RepoEnv = nil, nil
+	r.stream.publish(&RunEvent{Event: "run.phase", Build: &build, Time: time.Now()})
+}
+
+func (r *Runner) loadBuild(id string) (*Build, error) {
+	var b *Build
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("builds")).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		b = &Build{}
+		return json.Unmarshal(v, b)
+	})
+	return b, err
+}
+
+// runningBuilds returns the builds which have a live log, newest first.
+func (r *Runner) runningBuilds() []*Build {
+	r.logsMtx.Lock()
+	ids := make([]string, 0, len(r.logs))
+	for id := range r.logs {
+		ids = append(ids, id)
+	}
+	r.logsMtx.Unlock()
+	builds := make([]*Build, 0, len(ids))
+	for _, id := range ids {
+		if b, err := r.loadBuild(id); err == nil && b != nil {
+			builds = append(builds, b)
+		}
+	}
+	sort.Sort(sort.Reverse(buildsByCreated(builds)))
+	return builds
+}
+
+type buildsByCreated []*Build
+
+func (b buildsByCreated) Len() int           { return len(b) }
+func (b buildsByCreated) Less(i, j int) bool { return b[i].Created.Before(b[j].Created) }
+func (b buildsByCreated) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+var runsTemplate = template.Must(template.New("runs").Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>Runs - flynn-test</title>
+<style>
+td, th { padding: 2px 8px; text-align: left; }
+.label { background: #eee; border-radius: 3px; padding: 0 4px; }
+</style>
+</head>
+<body>
+<p><a href="/gantt">Timeline</a></p>
+<h1>Running</h1>
+{{if .Running}}
+<table>
+<tr><th>Run</th><th>Repo</th><th>Commit</th><th>Branch</th><th>Phase</th><th>Started</th></tr>
+{{range .Running}}<tr><td><a href="/runs/{{.Id}}">{{.Id}}</a></td><td>{{.Repo}}</td><td>{{.Commit}}</td><td>{{.Branch}}</td><td>{{.Phase}}{{if .Waiting}} waiting for {{range .Waiting}}<span class="label">{{.}}</span> {{end}}{{end}}</td><td>{{.Created.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No runs in progress.</p>
+{{end}}
+{{if .Mutexes}}
+<h2>Mutexes</h2>
+<table>
+<tr><th>Mutex</th><th>Held by</th></tr>
+{{range .Mutexes}}<tr><td>{{.Name}}</td><td><a href="/runs/{{.Build}}">{{.Build}}</a></td></tr>
+{{end}}
+</table>
+{{end}}
+{{if .HostCrashes}}
+<h2>QEMU crashes</h2>
+<table>
+<tr><th>Host</th><th>Runs</th><th>Crashed runs</th><th>Rate</th><th>Crashes</th><th>Signals</th><th>Last</th></tr>
+{{range .HostCrashes}}<tr><td>{{.Host}}</td><td>{{.Runs}}</td><td>{{.CrashedRuns}}</td><td>{{printf "%.1f%%" .Rate}}</td><td>{{.Crashes}}</td><td>{{range $sig, $n := .Signals}}<span class="label">{{$sig}} &times;{{$n}}</span> {{end}}</td><td><a href="/runs/{{.LastRun}}">{{.LastCrash.Format "2006-01-02 15:04"}}</a></td></tr>
+{{end}}
+</table>
+{{end}}
+<h1>Recent</h1>
+<table>
+<tr><th>Run</th><th>Repo</th><th>Commit</th><th>Branch</th><th>State</th><th>Passed</th><th>Failed</th><th>Queued</th><th>Duration</th><th>Report</th><th>Labels</th></tr>
+{{range .Recent}}<tr><td><a href="/runs/{{.Id}}">{{.Id}}</a></td><td>{{if .Project}}<a href="/runs?project={{.Project}}">{{.Project}}</a>/{{end}}{{.Repo}}</td><td>{{.Commit}}</td><td>{{.Branch}}</td><td>{{.State}}</td><td>{{.Passed}}</td><td>{{.Failed}}</td><td>{{.QueueWait}}</td><td>{{.Duration}}</td><td>{{if .LogUrl}}<a href="{{.LogUrl}}">log</a>{{end}}</td><td>{{range .Annotations}}{{range .Labels}}<span class="label">{{.}}</span> {{end}}{{end}}</td></tr>
+{{end}}
+</table>
+{{if .NextOffset}}<p><a href="/runs?offset={{.NextOffset}}">Older</a></p>{{end}}
+</body>
+</html>
+`[1:]))
+
+var runTemplate = template.Must(template.New("run").Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Run {{.Id}} - flynn-test</title>
+<style>
+td, th { padding: 2px 8px; text-align: left; }
+pre { background: #111; color: #ddd; padding: 8px; white-space: pre-wrap; }
+.failure { border: 1px solid #cf222e; padding: 0 8px; }
+</style>
+</head>
+<body>
+<p><a href="/runs">All runs</a></p>
+<h1>{{.Repo}} {{.Commit}}</h1>
+<p>Run {{.Id}} of {{.Branch}}{{if .Profile}} with profile {{.Profile}}{{end}}{{if .Features}} and features {{.Features}}{{end}}: <b id="state">{{.State}}</b> <span id="phase">{{.Phase}}</span></p>
+{{with .Failure}}<div class="failure">
+<h2>Likely cause: {{.Cause.Kind}} in {{.Cause.Source}}{{if .Cause.Line}} line {{.Cause.Line}}{{end}}</h2>
+<pre>{{or .Cause.Excerpt .Cause.Text}}</pre>
+<table>
+<tr><th>Clue</th><th>Where</th><th>Line</th></tr>
+{{range .Clues}}<tr><td>{{.Kind}}</td><td>{{.Source}}{{if .Line}}:{{.Line}}{{end}}</td><td>{{.Text}}</td></tr>
+{{end}}</table>
+</div>
+{{end}}{{if .Crashes}}<div class="failure">
+<h2>QEMU crashes</h2>
+{{range .Crashes}}<p>Instance {{.Instance}} died of signal {{.Signal}} at {{.Time.Format "2006-01-02 15:04:05"}}, {{if .CoreDump}}core dump at <code>{{.CoreDump}}</code>{{else}}no core dump found (core_pattern <code>{{.CorePattern}}</code>){{end}}</p>
+{{if .Dmesg}}<pre>{{range .Dmesg}}{{.}}
+{{end}}</pre>{{end}}{{end}}</div>
+{{end}}<table id="instances">
+<tr><th>Instance</th><th>Role</th><th>IP</th><th>Status</th></tr>
+{{range $i, $inst := .Instances}}<tr><td>{{$i}}</td><td>{{$inst.Role}}</td><td>{{$inst.IP}}</td><td>{{$inst.Status}}</td></tr>
+{{end}}
+</table>
+{{if .Running}}<table id="stats"></table>{{end}}
+{{if .LogUrl}}<p><a href="{{.LogUrl}}">Report</a></p>{{end}}
+<h2>Annotations</h2>
+{{range .Annotations}}<p>{{.Created.Format "2006-01-02 15:04"}}{{if .Author}} {{.Author}}{{end}}: {{range .Labels}}<b>[{{.}}]</b> {{end}}{{.Note}}</p>
+{{else}}<p>None. Runs with labels are left out of flakiness scores.</p>
+{{end}}
+<form method="POST" action="/builds/{{.Id}}/annotations">
+<p><label>Note <input name="note" size="60"></label> <label>Labels <input name="labels" placeholder="known infra outage, reverted commit"></label> <input type="submit" value="Annotate"></p>
+</form>
+{{if or .Running .Log}}<pre id="log">{{.Log}}</pre>{{end}}
+{{if .Running}}
+<script>
+var log = document.getElementById("log");
+var events = new EventSource("/builds/{{.Id}}/events");
+events.addEventListener("log", function(e) {
+  var follow = window.innerHeight + window.scrollY >= document.body.offsetHeight - 20;
+  log.appendChild(document.createTextNode(e.data));
+  if (follow) window.scrollTo(0, document.body.scrollHeight);
+});
+events.addEventListener("done", function() {
+  events.close();
+});
+function sparkline(values, max) {
+  var ns = "http://www.w3.org/2000/svg", svg = document.createElementNS(ns, "svg"), line = document.createElementNS(ns, "polyline");
+  svg.setAttribute("width", 120);
+  svg.setAttribute("height", 20);
+  line.setAttribute("fill", "none");
+  line.setAttribute("stroke", "#3182bd");
+  line.setAttribute("points", values.map(function(v, i) {
+    return (i * 120 / Math.max(values.length - 1, 1)) + "," + (20 - 20 * v / (max || 1));
+  }).join(" "));
+  svg.appendChild(line);
+  return svg;
+}
+function mb(bytes) {
+  return Math.round(bytes / 1048576) + "MB";
+}
+events.addEventListener("stats", function(e) {
+  var stats = JSON.parse(e.data), rows = document.getElementById("stats");
+  while (rows.rows.length) rows.deleteRow(0);
+  var head = rows.insertRow(-1);
+  ["Instance", "CPU", "", "Memory", "", "Swap"].forEach(function(v) {
+    var th = document.createElement("th");
+    th.textContent = v;
+    head.appendChild(th);
+  });
+  Object.keys(stats).sort().forEach(function(ip) {
+    var samples = stats[ip] || [];
+    if (!samples.length) return;
+    var last = samples[samples.length - 1], row = rows.insertRow(-1);
+    var rss = samples.map(function(s) { return s.rss; });
+    row.insertCell(-1).textContent = ip;
+    row.insertCell(-1).appendChild(sparkline(samples.map(function(s) { return s.cpu; }), 100 * Math.ceil(Math.max.apply(null, samples.map(function(s) { return s.cpu; }).concat(1)) / 100)));
+    row.insertCell(-1).textContent = Math.round(last.cpu) + "%";
+    row.insertCell(-1).appendChild(sparkline(rss, Math.max.apply(null, rss)));
+    row.insertCell(-1).textContent = mb(last.rss);
+    var swap = row.insertCell(-1);
+    swap.textContent = mb(last.swap);
+    if (last.swap > 0) swap.style.color = "#de2d26";
+  });
+});
+function refresh() {
+  var req = new XMLHttpRequest();
+  req.open("GET", "/builds/{{.Id}}");
+  req.onload = function() {
+    var b = JSON.parse(req.responseText);
+    document.getElementById("state").textContent = b.state;
+    document.getElementById("phase").textContent = b.phase || "";
+    var rows = document.getElementById("instances");
+    while (rows.rows.length > 1) rows.deleteRow(1);
+    (b.instances || []).forEach(function(inst, i) {
+      var row = rows.insertRow(-1);
+      [i, inst.role, inst.ip, inst.status || ""].forEach(function(v) {
+        row.insertCell(-1).textContent = v;
+      });
+    });
+    if (b.phase != "done") setTimeout(refresh, 5000);
+  };
+  req.send();
+}
+setTimeout(refresh, 5000);
+</script>
+{{end}}
+</body>
+</html>
+`[1:]))
+
+// runsPage lists the runs in progress and the most recent runs, which can be
+// filtered like GET /builds.
+func (r *Runner) runsPage(w http.ResponseWriter, req *http.Request) {
+	if id := strings.TrimPrefix(req.URL.Path, "/runs/"); id != req.URL.Path && id != "" {
+		r.runPage(w, req, id)
+		return
+	}
+	q, err := parseBuildQuery(req)
+	if err != nil {
+		http.Error(w, err.Error()+"\n", 400)
+		return
+	}
+	recent, more, err := r.findBuilds(q)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not list builds: %s\n", err), 500)
+		return
+	}
+	running := r.runningBuilds()
+	r.loadAnnotations(running...)
+	r.loadAnnotations(recent...)
+	data := map[string]interface{}{"Running": running, "Recent": recent, "Mutexes": r.mutexes.list()}
+	if hosts, err := r.loadHostCrashes(); err != nil {
+		log.Printf("dashboard: could not load host crashes: %s\n", err)
+	} else {
+		data["HostCrashes"] = hosts
+	}
+	if more {
+		data["NextOffset"] = q.Offset + q.Limit
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := runsTemplate.Execute(w, data); err != nil {
+		log.Println("dashboard: error rendering runs:", err)
+	}
+}
+
+// runPage shows a run and its instances, following its log while it runs.
+func (r *Runner) runPage(w http.ResponseWriter, req *http.Request, id string) {
+	b, err := r.loadBuild(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not load build: %s\n", err), 500)
+		return
+	}
+	if b == nil {
+		http.Error(w, fmt.Sprintf("build %s not found\n", id), 404)
+		return
+	}
+	if b.Archive != "" {
+		b = r.loadArchived(b)
+	}
+	r.loadAnnotations(b)
+	data := struct {
+		*Build
+		Running bool
+		Log     string
+	}{Build: b}
+	if l := r.runningLog(id); l != nil {
+		data.Running = true
+	} else if b.LogUrl == "" {
+		data.Log = "The run has not started."
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := runTemplate.Execute(w, data); err != nil {
+		log.Println("dashboard: error rendering run:", err)
+	}
+}
+
+// streamEvents streams the log of a running build as server-sent "log"
+// events, followed by a "done" event once the build finishes. Each event's
+// ID is the log offset after it, so reconnecting clients resume from where
+// they left off. The stats of the build's instances are sent as "stats"
+// events in between, see cluster.RunStats.
+func (r *Runner) streamEvents(w http.ResponseWriter, req *http.Request, id string) {
+	l := r.runningLog(id)
+	if l == nil {
+		http.Error(w, fmt.Sprintf("build %s is not running\n", id), 404)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported\n", 500)
+		return
+	}
+	offset, _ := strconv.Atoi(req.Header.Get("Last-Event-ID"))
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	type chunk struct {
+		data   []byte
+		closed bool
+	}
+	chunks := make(chan chunk)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for offset := offset; ; {
+			data, closed := l.next(offset)
+			offset += len(data)
+			select {
+			case chunks <- chunk{data, closed}:
+			case <-done:
+				return
+			}
+			if closed {
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(statsEventInterval)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case c := <-chunks:
+			if c.closed {
+				fmt.Fprint(w, "event: done\ndata: \n\n")
+				flusher.Flush()
+				return
+			}
+			offset += len(c.data)
+			text := strings.Replace(string(ansi.Plain(c.data)), "\r", "", -1)
+			_, err = fmt.Fprintf(w, "event: log\nid: %d\ndata: %s\n\n", offset, strings.Replace(text, "\n", "\ndata: ", -1))
+		case <-ticker.C:
+			stats := cluster.RunStats(id)
+			if stats == nil {
+				continue
+			}
+			data, _ := json.Marshal(stats)
+			_, err = fmt.Fprintf(w, "event: stats\ndata: %s\n\n", data)
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// statsEventInterval is how often the stats of a running build's instances
+// are streamed to the dashboard.
+var statsEventInterval = 5 * time.Second
+
+// instanceStats serves the latest stats samples of the instances of a
+// running build as JSON, keyed by instance IP:
+//
+//	GET /builds/<id>/stats
+func (r *Runner) instanceStats(w http.ResponseWriter, req *http.Request, id string) {
+	stats := cluster.RunStats(id)
+	if stats == nil {
+		http.Error(w, fmt.Sprintf("build %s has no running instances\n", id), 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// consoleTails serves the latest console lines of the instances of a running
+// build as JSON, keyed by instance IP:
+//
+//	GET /builds/<id>/console?lines=100
+func (r *Runner) consoleTails(w http.ResponseWriter, req *http.Request, id string) {
+	n := failureConsoleLines
+	if s := req.FormValue("lines"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			http.Error(w, "invalid lines\n", 400)
+			return
+		}
+	}
+	tails := cluster.RunConsoleTails(id, n)
+	if tails == nil {
+		http.Error(w, fmt.Sprintf("build %s has no running instances\n", id), 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tails)
+}
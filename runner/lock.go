@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// lockInputs records the external inputs of the booted cluster c, saving
+// them as lock.json in the artifacts dir.
+func (r *Runner) lockInputs(c *cluster.Cluster, artifactsDir string, out io.Writer) cluster.Lock {
+	lock, err := c.Lock()
+	if err != nil {
+		fmt.Fprintf(out, "could not lock external inputs: %s\n", err)
+		return nil
+	}
+	if artifactsDir != "" {
+		data, _ := json.MarshalIndent(lock, "", "  ")
+		if err := ioutil.WriteFile(filepath.Join(artifactsDir, "lock.json"), data, 0644); err != nil {
+			fmt.Fprintf(out, "could not save lock: %s\n", err)
+		}
+	}
+	return lock
+}
+
+// diffLock writes the inputs which changed since the last successful master
+// run to out and returns them.
+func (r *Runner) diffLock(lock cluster.Lock, out io.Writer) []*cluster.LockChange {
+	if lock == nil {
+		return nil
+	}
+	master := r.masterLock()
+	if master == nil {
+		return nil
+	}
+	changes := lock.Diff(master)
+	if len(changes) == 0 {
+		fmt.Fprintln(out, "external inputs are unchanged since the last master run")
+		return nil
+	}
+	fmt.Fprintf(out, "%d external inputs changed since the last master run:\n", len(changes))
+	for _, c := range changes {
+		from, to := c.Old, c.New
+		if from == "" {
+			from = "(added)"
+		}
+		if to == "" {
+			to = "(removed)"
+		}
+		fmt.Fprintf(out, "  %s: %s => %s\n", c.Name, from, to)
+	}
+	return changes
+}
+
+func (r *Runner) saveMasterLock(lock cluster.Lock) {
+	if lock == nil {
+		return
+	}
+	if err := r.db.Update(func(tx *bolt.Tx) error {
+		val, err := json.Marshal(lock)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("master-lock")).Put([]byte("lock"), val)
+	}); err != nil {
+		log.Printf("could not save master lock: %s\n", err)
+	}
+}
+
+func (r *Runner) masterLock() cluster.Lock {
+	var lock cluster.Lock
+	r.db.View(func(tx *bolt.Tx) error {
+		if val := tx.Bucket([]byte("master-lock")).Get([]byte("lock")); val != nil {
+			json.Unmarshal(val, &lock)
+		}
+		return nil
+	})
+	return lock
+}
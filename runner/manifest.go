@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// manifest lists the artifacts of a build. Artifacts are stored once per
+// content as blobs named after their SHA256, so unchanged logs, test output
+// and images of different builds share storage.
+type manifest struct {
+	Build     string           `json:"build"`
+	Labels    cluster.Labels   `json:"labels,omitempty"`
+	Artifacts []*manifestEntry `json:"artifacts"`
+}
+
+type manifestEntry struct {
+	Name        string `json:"name"`
+	Blob        string `json:"blob"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+// putBlob stores data as a blob unless a blob with the same content is
+// already stored, adds it to m as name and returns its URL.
+func (r *Runner) putBlob(m *manifest, name string, data io.ReadSeeker, contentType string, public bool) (string, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, data)
+	if err != nil {
+		return "", err
+	}
+	if _, err := data.Seek(0, os.SEEK_SET); err != nil {
+		return "", err
+	}
+	blob := fmt.Sprintf("blobs/sha256/%x", h.Sum(nil))
+	if !public {
+		blob = "private/" + blob
+	}
+	exists, err := r.store.Exists(blob)
+	if err != nil {
+		log.Printf("could not check for blob %s, uploading it: %s\n", blob, err)
+	}
+	if !exists {
+		if err := r.store.Put(blob, data, contentType, public, m.Labels); err != nil {
+			return "", err
+		}
+	}
+	m.Artifacts = append(m.Artifacts, &manifestEntry{Name: name, Blob: blob, Size: n, ContentType: contentType})
+	return r.store.URL(blob), nil
+}
+
+// uploadManifest stores m alongside the build log.
+func (r *Runner) uploadManifest(m *manifest, logName string) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		log.Printf("could not encode manifest: %s\n", err)
+		return
+	}
+	r.putArtifact(logName+".manifest.json", data, "application/json", m.Labels)
+}
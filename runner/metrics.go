@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// serveMetrics serves the hits, misses and bytes served of the git mirrors,
+// run registries and build cache, the QEMU crashes per host, the circuit
+// breakers of external APIs and the host resources used by instances, in
+// the Prometheus text format.
+func (r *Runner) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	stats := cluster.CacheMetrics()
+	var caches []string
+	for name := range stats {
+		caches = append(caches, name)
+	}
+	sort.Strings(caches)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name, help string
+		value      func(cluster.CacheStats) int64
+	}{
+		{"flynn_test_cache_hits_total", "Lookups served from a cache.", func(s cluster.CacheStats) int64 { return s.Hits }},
+		{"flynn_test_cache_misses_total", "Lookups which missed a cache.", func(s cluster.CacheStats) int64 { return s.Misses }},
+		{"flynn_test_cache_served_bytes_total", "Bytes served from a cache.", func(s cluster.CacheStats) int64 { return s.Bytes }},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+		for _, cache := range caches {
+			fmt.Fprintf(w, "%s{cache=%q} %d\n", m.name, cache, m.value(stats[cache]))
+		}
+	}
+	if hosts, err := r.loadHostCrashes(); err == nil && len(hosts) > 0 {
+		fmt.Fprint(w, "# HELP flynn_test_qemu_crashes_total QEMU processes which died of a signal.\n# TYPE flynn_test_qemu_crashes_total counter\n")
+		for _, h := range hosts {
+			fmt.Fprintf(w, "flynn_test_qemu_crashes_total{host=%q} %d\n", h.Host, h.Crashes)
+		}
+	}
+	states := serviceStates()
+	fmt.Fprint(w, "# HELP flynn_test_external_failures Consecutive failed calls to an external API.\n# TYPE flynn_test_external_failures gauge\n")
+	for _, s := range states {
+		fmt.Fprintf(w, "flynn_test_external_failures{service=%q} %d\n", s.Name, s.Failures)
+	}
+	fmt.Fprint(w, "# HELP flynn_test_external_circuit_open Whether calls to an external API fail fast.\n# TYPE flynn_test_external_circuit_open gauge\n")
+	for _, s := range states {
+		open := 0
+		if s.Open {
+			open = 1
+		}
+		fmt.Fprintf(w, "flynn_test_external_circuit_open{service=%q} %d\n", s.Name, open)
+	}
+	if r.bc.Resources == nil {
+		return
+	}
+	u := r.bc.Resources.Utilization()
+	for _, m := range []struct {
+		name, help string
+		value      int
+	}{
+		{"flynn_test_vms", "Instances running on the host.", u.VMs},
+		{"flynn_test_vms_max", "Limit of instances running on the host, 0 if unlimited.", u.MaxVMs},
+		{"flynn_test_vm_memory_mb", "Memory of the instances running on the host.", u.Memory},
+		{"flynn_test_vm_memory_max_mb", "Limit of the memory of instances running on the host, 0 if unlimited.", u.MaxMemory},
+		{"flynn_test_vm_cores", "CPUs of the instances running on the host.", u.Cores},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", m.name, m.help, m.name, m.name, m.value)
+	}
+}
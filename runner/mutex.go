@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// runMutexes are the mutexes of run profiles held by running builds, see
+// config.Profile.Mutexes.
+type runMutexes struct {
+	mtx   sync.Mutex
+	freed *sync.Cond
+	held  map[string]string
+}
+
+func newRunMutexes() *runMutexes {
+	m := &runMutexes{held: make(map[string]string)}
+	m.freed = sync.NewCond(&m.mtx)
+	return m
+}
+
+// acquire waits until none of names are held, then holds them all for the
+// build id, so that builds waiting on overlapping mutexes can't deadlock.
+// waiting is called with the mutexes held by other builds each time the
+// build has to wait.
+func (m *runMutexes) acquire(id string, names []string, waiting func([]string)) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for {
+		var busy []string
+		for _, name := range names {
+			if holder, ok := m.held[name]; ok && holder != id {
+				busy = append(busy, name)
+			}
+		}
+		if len(busy) == 0 {
+			break
+		}
+		waiting(busy)
+		m.freed.Wait()
+	}
+	for _, name := range names {
+		m.held[name] = id
+	}
+}
+
+func (m *runMutexes) release(id string, names []string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, name := range names {
+		if m.held[name] == id {
+			delete(m.held, name)
+		}
+	}
+	m.freed.Broadcast()
+}
+
+// heldMutex is a mutex and the build holding it.
+type heldMutex struct {
+	Name  string `json:"name"`
+	Build string `json:"build"`
+}
+
+func (m *runMutexes) list() []*heldMutex {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	list := make([]*heldMutex, 0, len(m.held))
+	for name, id := range m.held {
+		list = append(list, &heldMutex{Name: name, Build: id})
+	}
+	sort.Sort(mutexesByName(list))
+	return list
+}
+
+type mutexesByName []*heldMutex
+
+func (m mutexesByName) Len() int           { return len(m) }
+func (m mutexesByName) Less(i, j int) bool { return m[i].Name < m[j].Name }
+func (m mutexesByName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// waitForMutexes gives up the build slot of b while it waits for the
+// mutexes of its profile, recording what it waits for so the queue shows
+// it, and then takes a slot again.
+func (r *Runner) waitForMutexes(b *Build, names []string, out io.Writer) {
+	r.buildCh <- struct{}{}
+	queued := r.startSpan(b, "queued")
+	r.mutexes.acquire(b.Id, names, func(busy []string) {
+		fmt.Fprintf(out, "waiting for mutexes %s\n", strings.Join(busy, ", "))
+		b.Waiting = busy
+		if err := r.save(b); err != nil {
+			log.Printf("could not save build %s: %s\n", b.Id, err)
+		}
+	})
+	if b.Waiting != nil {
+		b.Waiting = nil
+		if err := r.save(b); err != nil {
+			log.Printf("could not save build %s: %s\n", b.Id, err)
+		}
+	}
+	<-r.buildCh
+	queued()
+}
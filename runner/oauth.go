@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie = "flynn-ci-session"
+	stateCookie   = "flynn-ci-oauth-state"
+	sessionTTL    = 24 * time.Hour
+)
+
+var githubOAuthURL = "https://github.com/login/oauth"
+
+// oauth signs dashboard users in with GitHub. Members of the flynn org are
+// viewers, who may only make GET requests, unless one of their teams maps to
+// the operator role.
+type oauth struct {
+	clientID     string
+	clientSecret string
+	key          []byte
+	teams        map[string]string
+}
+
+// newOAuth returns nil unless GITHUB_CLIENT_ID and GITHUB_CLIENT_SECRET are
+// set. Sessions are signed with SESSION_KEY, or a random key which
+// invalidates sessions when the runner restarts.
+func newOAuth(teams map[string]string) (*oauth, error) {
+	o := &oauth{
+		clientID:     os.Getenv("GITHUB_CLIENT_ID"),
+		clientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
+		key:          []byte(os.Getenv("SESSION_KEY")),
+		teams:        teams,
+	}
+	if o.clientID == "" || o.clientSecret == "" {
+		return nil, nil
+	}
+	if len(o.key) == 0 {
+		o.key = make([]byte, 32)
+		if _, err := rand.Read(o.key); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+type session struct {
+	User    string    `json:"user"`
+	Role    string    `json:"role"`
+	Expires time.Time `json:"expires"`
+}
+
+func (o *oauth) sign(data string) string {
+	mac := hmac.New(sha256.New, o.key)
+	mac.Write([]byte(data))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (o *oauth) setSession(w http.ResponseWriter, s *session) {
+	data, _ := json.Marshal(s)
+	value := base64.URLEncoding.EncodeToString(data)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value + "." + o.sign(value),
+		Path:     "/",
+		Expires:  s.Expires,
+		HttpOnly: true,
+	})
+}
+
+// session returns the signed in user of req, or nil.
+func (o *oauth) session(req *http.Request) *session {
+	cookie, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(o.sign(parts[0])), []byte(parts[1])) {
+		return nil
+	}
+	data, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil
+	}
+	s := &session{}
+	if err := json.Unmarshal(data, s); err != nil || time.Now().After(s.Expires) {
+		return nil
+	}
+	return s
+}
+
+// login redirects to GitHub to authorize the dashboard, remembering the page
+// to return to.
+func (o *oauth) login(w http.ResponseWriter, req *http.Request) {
+	state := make([]byte, 16)
+	if _, err := rand.Read(state); err != nil {
+		http.Error(w, "could not generate state\n", 500)
+		return
+	}
+	next := req.FormValue("next")
+	if !localPath(next) {
+		next = "/builds/new"
+	}
+	value := base64.URLEncoding.EncodeToString(state) + "|" + next
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Value: value, Path: "/auth", HttpOnly: true})
+	http.Redirect(w, req, githubOAuthURL+"/authorize?"+url.Values{
+		"client_id": {o.clientID},
+		"scope":     {"read:org"},
+		"state":     {strings.SplitN(value, "|", 2)[0]},
+	}.Encode(), 302)
+}
+
+// callback exchanges the code from GitHub for a token, and starts a session if
+// the user is a member of the flynn org.
+func (o *oauth) callback(w http.ResponseWriter, req *http.Request) {
+	cookie, err := req.Cookie(stateCookie)
+	if err != nil {
+		http.Error(w, "missing OAuth state\n", 400)
+		return
+	}
+	parts := strings.SplitN(cookie.Value, "|", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[0]), []byte(req.FormValue("state"))) {
+		http.Error(w, "invalid OAuth state\n", 400)
+		return
+	}
+	token, err := o.exchange(req.FormValue("code"))
+	if err != nil {
+		log.Printf("oauth: %s\n", err)
+		http.Error(w, "could not sign in with GitHub\n", 400)
+		return
+	}
+	s, err := o.newSession(&githubClient{token: token})
+	if err != nil {
+		log.Printf("oauth: %s\n", err)
+		http.Error(w, err.Error()+"\n", 403)
+		return
+	}
+	log.Printf("oauth: %s signed in as %s\n", s.User, s.Role)
+	o.setSession(w, s)
+	if !localPath(parts[1]) {
+		parts[1] = "/builds/new"
+	}
+	http.Redirect(w, req, parts[1], 302)
+}
+
+func (o *oauth) exchange(code string) (string, error) {
+	res, err := http.PostForm(githubOAuthURL+"/access_token", url.Values{
+		"client_id":     {o.clientID},
+		"client_secret": {o.clientSecret},
+		"code":          {code},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	body, err := url.ParseQuery(string(data))
+	if err != nil {
+		return "", fmt.Errorf("could not parse access token response: %s", err)
+	}
+	if e := body.Get("error"); e != "" {
+		return "", fmt.Errorf("access token exchange failed: %s", e)
+	}
+	return body.Get("access_token"), nil
+}
+
+// localPath reports whether next is a path on the dashboard, which is safe to
+// redirect to. Browsers treat backslashes as slashes, so "/\evil.com" would
+// leave the dashboard.
+func localPath(next string) bool {
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Opaque != "" {
+		return false
+	}
+	return strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(u.Path, "//") && !strings.Contains(next, "\\")
+}
+
+type githubTeam struct {
+	Slug         string `json:"slug"`
+	Organization struct {
+		Login string `json:"login"`
+	} `json:"organization"`
+}
+
+// newSession determines the role of the user gh is authorized as from their
+// teams in the flynn org.
+func (o *oauth) newSession(gh *githubClient) (*session, error) {
+	var user PRUser
+	if err := gh.request("GET", "/user", nil, &user); err != nil {
+		return nil, fmt.Errorf("could not get GitHub user: %s", err)
+	}
+	var teams []*githubTeam
+	if err := gh.request("GET", "/user/teams?per_page=100", nil, &teams); err != nil {
+		return nil, fmt.Errorf("could not get teams of %s: %s", user.Login, err)
+	}
+	s := &session{User: user.Login, Expires: time.Now().Add(sessionTTL)}
+	for _, t := range teams {
+		if t.Organization.Login != "flynn" {
+			continue
+		}
+		if s.Role == "" {
+			s.Role = "viewer"
+		}
+		if o.teams[t.Slug] == "operator" {
+			s.Role = "operator"
+		}
+	}
+	if s.Role == "" {
+		var membership struct {
+			State string `json:"state"`
+		}
+		if err := gh.request("GET", "/user/memberships/orgs/flynn", nil, &membership); err != nil || membership.State != "active" {
+			return nil, errors.New(user.Login + " is not a member of the flynn org")
+		}
+		s.Role = "viewer"
+	}
+	return s, nil
+}
+
+// sameOrigin reports whether req was sent by a page of the dashboard, so
+// that other sites can't submit forms with a user's session.
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		origin = req.Referer()
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// testOwners asks the tests binary who owns each test and suite.
+func testOwners() (map[string][]string, error) {
+	out, err := exec.Command(args.TestsPath, "--list-owners").Output()
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string][]string)
+	return owners, json.Unmarshal(out, &owners)
+}
+
+// ownersOf returns the owners of test, falling back to those of its suite.
+func ownersOf(owners map[string][]string, test string) []string {
+	if o, ok := owners[test]; ok {
+		return o
+	}
+	if i := strings.Index(test, "."); i > 0 {
+		return owners[test[:i]]
+	}
+	return nil
+}
+
+// setOwners sets the owners of results.
+func setOwners(results []*TestResult) {
+	if len(results) == 0 {
+		return
+	}
+	owners, err := testOwners()
+	if err != nil {
+		log.Printf("could not get test owners: %s\n", err)
+		return
+	}
+	for _, res := range results {
+		res.Owners = ownersOf(owners, res.Name)
+	}
+}
+
+// failedByOwner returns the failed tests of results keyed by their owners.
+func failedByOwner(results []*TestResult) map[string][]string {
+	failed := make(map[string][]string)
+	for _, res := range results {
+		if !res.Failed() {
+			continue
+		}
+		for _, owner := range res.Owners {
+			failed[owner] = append(failed[owner], res.Name)
+		}
+	}
+	return failed
+}
+
+// mentions returns the owners as GitHub mentions.
+func mentions(owners []string) string {
+	m := make([]string, len(owners))
+	for i, o := range owners {
+		m[i] = "@" + o
+	}
+	return strings.Join(m, " ")
+}
+
+func (g *githubClient) createCommitComment(repo, sha, body string) error {
+	return g.request("POST", fmt.Sprintf("/repos/flynn/%s/commits/%s/comments", repo, sha), &IssueComment{Body: body}, nil)
+}
+
+// notifyOwners mentions the owners of the tests which failed on master in
+// a comment on the commit, so that the failures reach them rather than
+// whoever happens to look at master.
+func (r *Runner) notifyOwners(b *Build, results []*TestResult, logUrl string) {
+	failed := failedByOwner(results)
+	if len(failed) == 0 {
+		return
+	}
+	owners := make([]string, 0, len(failed))
+	for owner := range failed {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "Flynn CI :x: tests failed on %s at %s:\n\n", b.Branch, b.Commit)
+	for _, owner := range owners {
+		fmt.Fprintf(&body, "- @%s: %s\n", owner, strings.Join(failed[owner], ", "))
+	}
+	fmt.Fprintf(&body, "\n[Full build log](%s)\n", logUrl)
+	if err := r.github.createCommitComment(b.Repo, b.Commit, body.String()); err != nil {
+		log.Printf("could not notify owners of failed tests: %s\n", err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/config"
+	"github.com/flynn/flynn-test/util"
+)
+
+// defaultTestDuration is the expected duration of tests which haven't passed
+// on master yet.
+var defaultTestDuration = time.Minute
+
+// testJob is a test run by the parallel scheduler.
+type testJob struct {
+	name     string
+	expected time.Duration
+}
+
+type jobsByExpected []*testJob
+
+func (j jobsByExpected) Len() int           { return len(j) }
+func (j jobsByExpected) Less(a, b int) bool { return j[a].expected > j[b].expected }
+func (j jobsByExpected) Swap(a, b int)      { j[a], j[b] = j[b], j[a] }
+
+// listTests asks the tests binary for the names of the tests matching filter.
+func listTests(filter string) ([]string, error) {
+	out, err := exec.Command(args.TestsPath, "--list", "--filter", filter).Output()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	return names, json.Unmarshal(out, &names)
+}
+
+// planQueues distributes tests across at most n queues, handing out the
+// longest tests first to the queue with the least expected work so that the
+// queues drain at about the same time.
+func planQueues(names []string, durations map[string]time.Duration, n int) [][]*testJob {
+	if n > len(names) {
+		n = len(names)
+	}
+	jobs := make([]*testJob, len(names))
+	for i, name := range names {
+		expected, ok := durations[name]
+		if !ok {
+			expected = defaultTestDuration
+		}
+		jobs[i] = &testJob{name: name, expected: expected}
+	}
+	sort.Stable(jobsByExpected(jobs))
+	queues := make([][]*testJob, n)
+	work := make([]time.Duration, n)
+	for _, job := range jobs {
+		min := 0
+		for i := range queues {
+			if work[i] < work[min] {
+				min = i
+			}
+		}
+		queues[min] = append(queues[min], job)
+		work[min] += job.expected
+	}
+	return queues
+}
+
+// runParallel boots a cluster per queue of tests, and runs the tests of each
+// queue one at a time against its cluster, shutting the cluster down once its
+// queue drains. Only the first cluster uses bc.Network, the rest allocate
+// their own. onBoot is called with the first cluster once they have all
+// booted. If every test ran but some failed, retry is called.
+func (r *Runner) runParallel(bc cluster.BootConfig, dockerfs string, roles []string, profile *config.Profile, checks *checks, out io.Writer, onResult func(*TestResult), retry func() error, onBoot func(*cluster.Cluster), artifactsDir string) error {
+	checks.start("bootstrap")
+	names, err := listTests(profile.TestFilter)
+	if err != nil {
+		err = fmt.Errorf("could not list tests: %s", err)
+		checks.finish("bootstrap", err)
+		return err
+	}
+	queues := planQueues(names, r.masterDurations(), profile.Parallelism)
+	n := len(queues)
+	fmt.Fprintf(out, "running %d tests on %d clusters\n", len(names), n)
+
+	clusters := make([]*cluster.Cluster, n)
+	flynnrcs := make([]string, n)
+	outs := make([]io.Writer, n)
+	var networks []string
+	defer func() {
+		for _, c := range clusters {
+			if c == nil {
+				continue
+			}
+			c.Shutdown()
+			c.RemoveCLI()
+		}
+		for _, network := range networks {
+			r.releaseNet(network)
+		}
+	}()
+
+	var outMtx sync.Mutex
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		outs[i] = &prefixWriter{w: out, mtx: &outMtx, prefix: fmt.Sprintf("[queue %d] ", i)}
+		queueBC := bc
+		if i > 0 {
+			network, err := r.allocateNet()
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			networks = append(networks, network)
+			queueBC.Network = network
+		}
+		clusters[i] = cluster.New(queueBC, outs[i])
+		instancesDir := filepath.Join(artifactsDir, fmt.Sprintf("instances-queue-%d", i))
+		out := outs[i]
+		clusters[i].OnBootFailure = func(c *cluster.Cluster) { r.collectInstances(c, instancesDir, out) }
+		clusters[i].SyslogPath = filepath.Join(instancesDir, "syslog.json")
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := clusters[i].BootRoles(dockerfs, roles); err != nil {
+				errs[i] = bootError(err)
+				return
+			}
+			var err error
+			if flynnrcs[i], err = createFlynnrc(clusters[i]); err != nil {
+				errs[i] = fmt.Errorf("could not create flynnrc: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			err = fmt.Errorf("queue %d: %s", i, err)
+			checks.finish("bootstrap", err)
+			return err
+		}
+	}
+	checks.finish("bootstrap", nil)
+	onBoot(clusters[0])
+
+	checks.start("tests")
+	var deadline util.Instant
+	if profile.Timeout > 0 {
+		deadline = util.Deadline(time.Duration(profile.Timeout))
+	}
+	seed := strconv.FormatInt(bc.Seed, 10)
+	var resultMtx sync.Mutex
+	completed := true
+	panics := make([][]int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := clusters[i]
+			stopChaos := func() {}
+			if profile.Chaos != nil {
+				stopChaos = startChaos(c, profile.Chaos, bc.Seed, outs[i])
+			}
+			var err error
+			done := true
+			for j, job := range queues[i] {
+				var timeout time.Duration
+				if deadline != 0 {
+					if timeout = deadline.Remaining(); timeout <= 0 {
+						err = fmt.Errorf("timed out with %d tests left", len(queues[i])-j)
+						done = false
+						break
+					}
+				}
+				filter := "^" + regexp.QuoteMeta(job.name) + "$"
+				jobDone, jobErr := runTests(flynnrcs[i], filter, timeout, profile.Timeouts.TestTimeout(), outs[i], func(res *TestResult) {
+					resultMtx.Lock()
+					defer resultMtx.Unlock()
+					onResult(res)
+				}, "--artifacts", artifactsDir, "--seed", seed, "--features", profile.Features.String())
+				if jobErr != nil {
+					err = jobErr
+				}
+				if !jobDone {
+					done = false
+					break
+				}
+			}
+			stopChaos()
+
+			// tear the cluster down as soon as its queue drains
+			r.collectProfiles(c, err, filepath.Join(artifactsDir, fmt.Sprintf("pprof-queue-%d", i)), outs[i])
+			r.collectInstances(c, filepath.Join(artifactsDir, fmt.Sprintf("instances-queue-%d", i)), outs[i])
+			panics[i] = c.GuestPanics()
+			c.Shutdown()
+			fmt.Fprintln(outs[i], "queue drained, cluster shut down")
+
+			resultMtx.Lock()
+			defer resultMtx.Unlock()
+			errs[i] = err
+			completed = completed && done
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range clusters {
+		if len(panics[i]) > 0 {
+			err := fmt.Errorf("guest kernel panic on queue %d instances %v", i, panics[i])
+			checks.finish("tests", err)
+			return err
+		}
+		if errs[i] != nil {
+			err = fmt.Errorf("queue %d: %s", i, errs[i])
+		}
+	}
+	if err != nil && completed {
+		err = retry()
+	}
+	checks.finish("tests", err)
+	return err
+}
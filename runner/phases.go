@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn-test/config"
+)
+
+const defaultHookTimeout = 5 * time.Minute
+
+// runPhase runs fn as the named phase of b, see config.RunPhases, running
+// the phase's pre hooks before it and its post hooks after it, followed by
+// the plugin phases which follow it if it succeeded.
+func (r *Runner) runPhase(b *Build, name string, out io.Writer, fn func() error) error {
+	if err := r.runHooks(b, name, "pre", nil, out); err != nil {
+		return err
+	}
+	end := r.startSpan(b, name)
+	err := fn()
+	end()
+	if hookErr := r.runHooks(b, name, "post", err, out); hookErr != nil && err == nil {
+		err = hookErr
+	}
+	if err == nil {
+		err = r.runPluginPhases(b, name, out)
+	}
+	return err
+}
+
+// runHooks runs the hooks of phase which run when, returning the error of
+// the first required hook which fails. phaseErr is the error the phase
+// failed with, which post hooks get as FLYNN_TEST_PHASE_ERROR.
+func (r *Runner) runHooks(b *Build, phase, when string, phaseErr error, out io.Writer) error {
+	for _, hook := range r.config.Hooks {
+		if hook.Phase != phase || hook.When != when {
+			continue
+		}
+		err := runHook(hook, b, phaseErr, out)
+		if err == nil {
+			continue
+		}
+		if hook.Required {
+			return err
+		}
+		fmt.Fprintf(out, "ignoring failed hook: %s\n", err)
+	}
+	return nil
+}
+
+func runHook(hook *config.Hook, b *Build, phaseErr error, out io.Writer) error {
+	name := fmt.Sprintf("%s %s hook %s", hook.When, hook.Phase, strings.Join(hook.Command, " "))
+	fmt.Fprintf(out, "running %s\n", name)
+	cmd := exec.Command(hook.Command[0], hook.Command[1:]...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Env = append(os.Environ(),
+		"FLYNN_TEST_RUN_ID="+b.Id,
+		"FLYNN_TEST_REPO="+b.Repo,
+		"FLYNN_TEST_COMMIT="+b.Commit,
+		"FLYNN_TEST_BRANCH="+b.Branch,
+		"FLYNN_TEST_PULL_REQUEST="+strconv.Itoa(b.PullRequest),
+		"FLYNN_TEST_PROFILE="+b.Profile,
+		"FLYNN_TEST_PHASE="+hook.Phase,
+		"FLYNN_TEST_HOOK="+hook.When,
+	)
+	if phaseErr != nil {
+		cmd.Env = append(cmd.Env, "FLYNN_TEST_PHASE_ERROR="+phaseErr.Error())
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	timeout := time.Duration(hook.Timeout)
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		return nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("%s: timed out after %s", name, timeout)
+	}
+}
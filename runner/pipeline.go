@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/config"
+)
+
+// runPipeline runs the steps of the profile's pipeline on the image the run
+// built, in place of booting a cluster and running the test suite.
+func (r *Runner) runPipeline(b *Build, bc cluster.BootConfig, image string, profile *config.Profile, m *manifest, out io.Writer) (err error) {
+	var c *cluster.Cluster
+	var saved []string
+	defer func() {
+		if c != nil {
+			c.Shutdown()
+		}
+		for _, fs := range saved {
+			os.RemoveAll(filepath.Dir(fs))
+		}
+	}()
+	for i, step := range profile.Pipeline {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("%d-%s", i, step.Type)
+		}
+		fmt.Fprintf(out, "running pipeline step %s\n", name)
+		cluster.RecordEvent(b.Id, "pipeline step %s", name)
+		err := r.runPhase(b, step.Type, out, func() error {
+			switch step.Type {
+			case "boot-cluster":
+				if c != nil {
+					c.Shutdown()
+				}
+				roles := step.Roles
+				if len(roles) == 0 {
+					roles = clusterRoles(b, profile)
+				}
+				r.setPhase(b, "booting")
+				c = cluster.New(bc, out)
+				return c.BootRoles(image, roles)
+			case "script":
+				if c == nil {
+					return errors.New("no cluster has been booted")
+				}
+				r.setPhase(b, "testing")
+				return c.Run(step.Script)
+			case "snapshot":
+				if c == nil {
+					return errors.New("no cluster has been booted")
+				}
+				fs, err := c.SaveDockerFS()
+				if err != nil {
+					return err
+				}
+				saved = append(saved, fs)
+				image = fs
+				return nil
+			case "layer":
+				if !b.privileged() {
+					return errors.New("only trusted builds of master may publish images")
+				}
+				base := r.baseDockerFS()
+				if base == "" {
+					return errors.New("there is no base docker fs to layer the image on")
+				}
+				layer, err := cluster.DiffImage(base, image, "base.img")
+				if err != nil {
+					return err
+				}
+				defer os.RemoveAll(filepath.Dir(layer))
+				layerURL, err := r.uploadImage(b, layer, "layer", m)
+				if err != nil {
+					return err
+				}
+				// the base is content addressed, so is only stored once
+				baseURL, err := r.uploadPrivate(m, "images/base.img", base)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "published layer to %s, which is booted with %s saved beside it as base.img\n", layerURL, baseURL)
+				return nil
+			case "publish":
+				if !b.privileged() {
+					return errors.New("only trusted builds of master may publish images")
+				}
+				url, err := r.uploadImage(b, image, step.Name, m)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "published image to %s\n", url)
+				return nil
+			}
+			return fmt.Errorf("unknown step type %q", step.Type)
+		})
+		if err != nil {
+			return fmt.Errorf("pipeline step %s failed: %s", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/config"
+)
+
+// pluginRequest is the JSON a plugin reads from stdin. Type is "phase" to run
+// Phase of Build, "event" to handle Event, or "put", "get" or "exists" to
+// store the artifact Name, whose contents are in the file Path for put and
+// are written to it for get.
+type pluginRequest struct {
+	Type  string    `json:"type"`
+	Phase string    `json:"phase,omitempty"`
+	Build *Build    `json:"build,omitempty"`
+	Event *RunEvent `json:"event,omitempty"`
+
+	Name        string         `json:"name,omitempty"`
+	Path        string         `json:"path,omitempty"`
+	ContentType string         `json:"content_type,omitempty"`
+	Public      bool           `json:"public,omitempty"`
+	Labels      cluster.Labels `json:"labels,omitempty"`
+}
+
+// pluginResponse is the JSON a plugin writes to stdout, which may be empty if
+// it succeeded and has nothing to return.
+type pluginResponse struct {
+	Error  string `json:"error,omitempty"`
+	Exists bool   `json:"exists,omitempty"`
+}
+
+// callPlugin runs p with req, writing its stderr to out.
+func callPlugin(p *config.Plugin, req *pluginRequest, out io.Writer) (*pluginResponse, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var stdout bytes.Buffer
+	cmd := exec.Command(p.Command[0], p.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("plugin %s: %s", p.Name, err)
+	}
+	timeout := time.Duration(p.Timeout)
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %s", p.Name, err)
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		return nil, fmt.Errorf("plugin %s: timed out after %s", p.Name, timeout)
+	}
+	res := &pluginResponse{}
+	if len(bytes.TrimSpace(stdout.Bytes())) > 0 {
+		if err := json.Unmarshal(stdout.Bytes(), res); err != nil {
+			return nil, fmt.Errorf("plugin %s: invalid response: %s", p.Name, err)
+		}
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("plugin %s: %s", p.Name, res.Error)
+	}
+	return res, nil
+}
+
+// pluginBuild returns a copy of b without its env, which may hold secrets.
+func pluginBuild(b *Build) *Build {
+	build := *b
+	build.Env = nil
+	build.RepoEnv = nil
+	return &build
+}
+
+// runPluginPhases runs the plugin phases which follow the phase after,
+// returning the error of the first required one which fails.
+func (r *Runner) runPluginPhases(b *Build, after string, out io.Writer) error {
+	for _, p := range r.config.Plugins {
+		for _, phase := range p.Phases {
+			if phase.After != after {
+				continue
+			}
+			fmt.Fprintf(out, "running phase %s of plugin %s\n", phase.Name, p.Name)
+			end := r.startSpan(b, phase.Name)
+			_, err := callPlugin(p, &pluginRequest{Type: "phase", Phase: phase.Name, Build: pluginBuild(b)}, out)
+			end()
+			if err == nil {
+				continue
+			}
+			if phase.Required {
+				return err
+			}
+			fmt.Fprintf(out, "ignoring failed phase %s: %s\n", phase.Name, err)
+		}
+	}
+	return nil
+}
+
+// notifyPlugins sends e to every plugin subscribed to it in the background.
+func (r *Runner) notifyPlugins(e *RunEvent) {
+	for _, p := range r.config.Plugins {
+		if !containsString(p.Events, e.Event) {
+			continue
+		}
+		go func(p *config.Plugin) {
+			if err := service("plugin " + p.Name).call(func() error {
+				_, err := callPlugin(p, &pluginRequest{Type: "event", Event: e}, os.Stderr)
+				return err
+			}); err != nil {
+				log.Printf("plugins: could not deliver %s event to %s: %s\n", e.Event, p.Name, err)
+			}
+		}(p)
+	}
+}
+
+// pluginStore stores artifacts with a plugin, which serves them at url.
+type pluginStore struct {
+	plugin *config.Plugin
+	url    string
+}
+
+func (s *pluginStore) Put(name string, data io.ReadSeeker, contentType string, public bool, labels cluster.Labels) error {
+	tmp, err := ioutil.TempFile("", "artifact-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := data.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, data); err != nil {
+		return err
+	}
+	_, err = callPlugin(s.plugin, &pluginRequest{
+		Type:        "put",
+		Name:        name,
+		Path:        tmp.Name(),
+		ContentType: contentType,
+		Public:      public,
+		Labels:      labels,
+	}, os.Stderr)
+	return err
+}
+
+func (s *pluginStore) Exists(name string) (bool, error) {
+	res, err := callPlugin(s.plugin, &pluginRequest{Type: "exists", Name: name}, os.Stderr)
+	if err != nil {
+		return false, err
+	}
+	return res.Exists, nil
+}
+
+func (s *pluginStore) Get(name string) ([]byte, error) {
+	tmp, err := ioutil.TempFile("", "artifact-")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if _, err := callPlugin(s.plugin, &pluginRequest{Type: "get", Name: name, Path: tmp.Name()}, os.Stderr); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(tmp.Name())
+}
+
+func (s *pluginStore) URL(name string) string {
+	return strings.TrimSuffix(s.url, "/") + "/" + name
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/flynn/flynn-test/cluster"
+)
+
+var (
+	errTestsTimedOut = errors.New("tests timed out")
+	errTestTimedOut  = errors.New("a test timed out")
+)
+
+// collectProfiles saves pprof profiles from the cluster's services to dir if
+// the config asks for them after this kind of test failure.
+func (r *Runner) collectProfiles(c *cluster.Cluster, testErr error, dir string, out io.Writer) {
+	p := r.config.Pprof
+	if p == nil || testErr == nil {
+		return
+	}
+	event := "failure"
+	if testErr == errTestsTimedOut || testErr == errTestTimedOut {
+		event = "timeout"
+	}
+	if !p.CollectOn(event) {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintf(out, "could not create pprof dir: %s\n", err)
+		return
+	}
+	fmt.Fprintf(out, "collecting pprof profiles after test %s\n", event)
+	for _, service := range p.Services {
+		for _, profile := range p.Profiles {
+			data, err := c.FetchProfile(service, profile, p.CPUSeconds)
+			if err != nil {
+				fmt.Fprintf(out, "could not fetch %s profile from %s: %s\n", profile, service, err)
+				continue
+			}
+			path := filepath.Join(dir, fmt.Sprintf("%s-%s.pprof", service, profile))
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				fmt.Fprintf(out, "could not save %s: %s\n", path, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/util"
+)
+
+// Base images go through promotion before builds start from them: a new
+// root or docker fs image is a candidate until it passes a self test and a
+// validation run against it, when it is promoted to stable, retiring the
+// stable image of its kind, which is kept so it can be rolled back to.
+const (
+	imageCandidate  = "candidate"
+	imageValidating = "validating"
+	imageStable     = "stable"
+	imageFailed     = "failed"
+	imageRetired    = "retired"
+	imageRejected   = "rejected"
+)
+
+// keepRetired is the number of retired warmed images of each kind kept to
+// roll back to, older ones are removed.
+const keepRetired = 2
+
+// BaseImage is a root or docker fs image builds start from, or a candidate
+// for one. Validation is the build which validated it.
+type BaseImage struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	Path       string    `json:"path"`
+	State      string    `json:"state"`
+	Source     string    `json:"source,omitempty"`
+	Created    time.Time `json:"created"`
+	Validation string    `json:"validation,omitempty"`
+	Promoted   time.Time `json:"promoted,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type sortBaseImages []*BaseImage
+
+func (s sortBaseImages) Len() int           { return len(s) }
+func (s sortBaseImages) Less(i, j int) bool { return s[i].Created.After(s[j].Created) }
+func (s sortBaseImages) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func validImageKind(kind string) bool {
+	return kind == "rootfs" || kind == "dockerfs"
+}
+
+func (r *Runner) baseRootFS() string {
+	r.dockerFSMtx.Lock()
+	defer r.dockerFSMtx.Unlock()
+	return r.rootFS
+}
+
+func (r *Runner) saveBaseImage(img *BaseImage) error {
+	val, err := json.Marshal(img)
+	if err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("base-images")).Put([]byte(img.ID), val)
+	})
+}
+
+func (r *Runner) loadBaseImage(id string) (*BaseImage, error) {
+	var img *BaseImage
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("base-images")).Get([]byte(id))
+		if v == nil {
+			return fmt.Errorf("unknown image %s", id)
+		}
+		img = &BaseImage{}
+		return json.Unmarshal(v, img)
+	})
+	return img, err
+}
+
+// listBaseImages returns the images of kind, or of both kinds if it is
+// empty, newest first.
+func (r *Runner) listBaseImages(kind string) ([]*BaseImage, error) {
+	var images []*BaseImage
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("base-images")).ForEach(func(k, v []byte) error {
+			img := &BaseImage{}
+			if err := json.Unmarshal(v, img); err != nil {
+				log.Printf("could not decode image %s: %s\n", k, err)
+				return nil
+			}
+			if kind == "" || img.Kind == kind {
+				images = append(images, img)
+			}
+			return nil
+		})
+	})
+	sort.Sort(sortBaseImages(images))
+	return images, err
+}
+
+// loadPromotedImages makes builds start from the stable images recorded by a
+// previous runner, and validates the candidates it left. Candidates being
+// validated are left to their runs, which are pending.
+func (r *Runner) loadPromotedImages() {
+	images, err := r.listBaseImages("")
+	if err != nil {
+		log.Printf("could not load images: %s\n", err)
+		return
+	}
+	for _, img := range images {
+		switch img.State {
+		case imageStable:
+			if _, err := os.Stat(img.Path); err != nil {
+				log.Printf("not using stable %s %s: %s\n", img.Kind, img.Path, err)
+				continue
+			}
+			r.useImage(img)
+		case imageCandidate:
+			go r.validateImage(img)
+		}
+	}
+}
+
+// useImage makes builds start from img.
+func (r *Runner) useImage(img *BaseImage) {
+	r.dockerFSMtx.Lock()
+	defer r.dockerFSMtx.Unlock()
+	if img.Kind == "rootfs" {
+		r.rootFS = img.Path
+	} else {
+		r.dockerFS = img.Path
+	}
+}
+
+// isBaseImage returns whether path is a recorded image, which is kept when
+// the runner exits.
+func (r *Runner) isBaseImage(path string) bool {
+	images, _ := r.listBaseImages("")
+	for _, img := range images {
+		if img.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// addCandidate records the image at path as a candidate and validates it.
+func (r *Runner) addCandidate(kind, path, source string) (*BaseImage, error) {
+	if !validImageKind(kind) {
+		return nil, fmt.Errorf("unknown image kind %q", kind)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	img := &BaseImage{
+		ID:      util.RandomString(8),
+		Kind:    kind,
+		Path:    path,
+		State:   imageCandidate,
+		Source:  source,
+		Created: time.Now(),
+	}
+	if err := r.saveBaseImage(img); err != nil {
+		return nil, err
+	}
+	log.Printf("added candidate %s %s as image %s\n", kind, path, img.ID)
+	go r.validateImage(img)
+	return img, nil
+}
+
+// selfTest checks img is intact before a run boots it.
+func selfTest(img *BaseImage) error {
+	if img.Kind == "dockerfs" {
+		_, err := cluster.CheckImage(img.Path)
+		return err
+	}
+	info, err := os.Stat(img.Path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%s is empty", img.Path)
+	}
+	return nil
+}
+
+// validateImage self tests img and then triggers its validation run, which
+// promotes it once it passes, see finishValidation.
+func (r *Runner) validateImage(img *BaseImage) {
+	if err := selfTest(img); err != nil {
+		r.failImage(img, fmt.Errorf("self test failed: %s", err))
+		return
+	}
+	profile, repo, ref := r.config.Promotion.Run()
+	b := &Build{
+		Repo:     repo,
+		Commit:   ref,
+		Branch:   ref,
+		Provider: "promotion",
+		Profile:  profile,
+		Image:    img.ID,
+		FromRepo: true,
+	}
+	if err := r.save(b); err != nil {
+		log.Printf("could not save validation run of image %s: %s\n", img.ID, err)
+		return
+	}
+	img.State, img.Validation = imageValidating, b.Id
+	if err := r.saveBaseImage(img); err != nil {
+		log.Printf("could not save image %s: %s\n", img.ID, err)
+	}
+	log.Printf("validating %s %s with %s run %s\n", img.Kind, img.Path, profile, b.Id)
+	r.runBuild(b)
+}
+
+// finishValidation promotes the candidate validated by b if it passed.
+func (r *Runner) finishValidation(b *Build, err error) {
+	img, loadErr := r.loadBaseImage(b.Image)
+	if loadErr != nil {
+		log.Printf("could not load image validated by %s: %s\n", b.Id, loadErr)
+		return
+	}
+	if img.State != imageValidating || img.Validation != b.Id {
+		return
+	}
+	if err != nil {
+		r.failImage(img, fmt.Errorf("validation run %s failed: %s", b.Id, err))
+		return
+	}
+	if err := r.promoteImage(img); err != nil {
+		log.Printf("could not promote image %s: %s\n", img.ID, err)
+	}
+}
+
+func (r *Runner) failImage(img *BaseImage, err error) {
+	log.Printf("not promoting %s %s: %s\n", img.Kind, img.Path, err)
+	img.State, img.Error = imageFailed, err.Error()
+	if err := r.saveBaseImage(img); err != nil {
+		log.Printf("could not save image %s: %s\n", img.ID, err)
+	}
+	if img.Source == "warm" {
+		os.RemoveAll(filepath.Dir(img.Path))
+	}
+}
+
+// promoteImage makes img the stable image of its kind, retiring the current
+// one.
+func (r *Runner) promoteImage(img *BaseImage) error {
+	if img.State == imageStable {
+		return nil
+	}
+	if _, err := os.Stat(img.Path); err != nil {
+		return err
+	}
+	images, err := r.listBaseImages(img.Kind)
+	if err != nil {
+		return err
+	}
+	for _, other := range images {
+		if other.State == imageStable {
+			other.State = imageRetired
+			if err := r.saveBaseImage(other); err != nil {
+				return err
+			}
+		}
+	}
+	img.State, img.Promoted, img.Error = imageStable, time.Now(), ""
+	if err := r.saveBaseImage(img); err != nil {
+		return err
+	}
+	r.useImage(img)
+	log.Printf("promoted %s %s, builds now start from it\n", img.Kind, img.Path)
+	r.pruneRetired(img.Kind)
+	return nil
+}
+
+// rollbackImage rejects the stable image of kind and promotes the one it
+// retired.
+func (r *Runner) rollbackImage(kind string) (*BaseImage, error) {
+	images, err := r.listBaseImages(kind)
+	if err != nil {
+		return nil, err
+	}
+	var current, previous *BaseImage
+	for _, img := range images {
+		switch img.State {
+		case imageStable:
+			current = img
+		case imageRetired:
+			if _, err := os.Stat(img.Path); err == nil && (previous == nil || img.Promoted.After(previous.Promoted)) {
+				previous = img
+			}
+		}
+	}
+	if current == nil {
+		return nil, fmt.Errorf("there is no stable %s to roll back", kind)
+	}
+	if previous == nil {
+		return nil, fmt.Errorf("there is no retired %s to roll back to", kind)
+	}
+	current.State = imageRejected
+	if err := r.saveBaseImage(current); err != nil {
+		return nil, err
+	}
+	previous.State, previous.Promoted = imageStable, time.Now()
+	if err := r.saveBaseImage(previous); err != nil {
+		return nil, err
+	}
+	r.useImage(previous)
+	log.Printf("rolled %s back from %s to %s\n", kind, current.Path, previous.Path)
+	return previous, nil
+}
+
+// pruneRetired removes the warmed images of kind retired before the latest
+// keepRetired, as running builds may still be booting from those.
+func (r *Runner) pruneRetired(kind string) {
+	images, err := r.listBaseImages(kind)
+	if err != nil {
+		return
+	}
+	var retired int
+	for _, img := range images {
+		if img.State != imageRetired || img.Source != "warm" {
+			continue
+		}
+		if retired++; retired > keepRetired {
+			os.RemoveAll(filepath.Dir(img.Path))
+		}
+	}
+}
+
+// imagesHandler lists images, or adds a candidate given its kind and path on
+// the runner host:
+//
+//	GET /images
+//	POST /images?kind=rootfs&path=/var/lib/flynn-test/rootfs.img
+func (r *Runner) imagesHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		images, err := r.listBaseImages(req.FormValue("kind"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not list images: %s\n", err), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(images)
+	case "POST":
+		img, err := r.addCandidate(req.FormValue("kind"), req.FormValue("path"), "api")
+		if err != nil {
+			http.Error(w, err.Error()+"\n", 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(img)
+	default:
+		http.Error(w, "method not allowed\n", 405)
+	}
+}
+
+// imageAction promotes an image regardless of its validation, or rolls a
+// kind of image back to the one its stable image retired:
+//
+//	POST /images/<id>/promote
+//	POST /images/rollback?kind=dockerfs
+func (r *Runner) imageAction(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed\n", 405)
+		return
+	}
+	var img *BaseImage
+	var err error
+	switch parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/images/"), "/"); {
+	case len(parts) == 1 && parts[0] == "rollback":
+		kind := req.FormValue("kind")
+		if !validImageKind(kind) {
+			http.Error(w, fmt.Sprintf("unknown image kind %q\n", kind), 400)
+			return
+		}
+		img, err = r.rollbackImage(kind)
+	case len(parts) == 2 && parts[1] == "promote":
+		if img, err = r.loadBaseImage(parts[0]); err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		err = r.promoteImage(img)
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error()+"\n", 409)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(img)
+}
+
+// imagesCmd lists base images and their promotion state, adds candidates,
+// and promotes or rolls back images:
+//
+//	runner images [--url http://localhost] [--kind KIND] [--json]
+//	runner images add [--url http://localhost] [--json] KIND PATH
+//	runner images promote [--url http://localhost] [--json] ID
+//	runner images rollback [--url http://localhost] [--json] KIND
+func imagesCmd(cmdArgs []string) error {
+	action := "list"
+	if len(cmdArgs) > 0 && !strings.HasPrefix(cmdArgs[0], "-") {
+		action, cmdArgs = cmdArgs[0], cmdArgs[1:]
+	}
+	fs := flag.NewFlagSet("images", flag.ExitOnError)
+	u := fs.String("url", "http://localhost", "URL of the runner")
+	kind := fs.String("kind", "", "only list images of this kind")
+	asJSON := fs.Bool("json", false, "print the images as JSON")
+	fs.Parse(cmdArgs)
+	usage := errors.New("usage: runner images [add KIND PATH | promote ID | rollback KIND] [--url URL] [--kind KIND] [--json]")
+
+	method, path := "POST", ""
+	switch {
+	case action == "list" && fs.NArg() == 0:
+		method, path = "GET", "/images?kind="+url.QueryEscape(*kind)
+	case action == "add" && fs.NArg() == 2:
+		path = "/images?" + url.Values{"kind": {fs.Arg(0)}, "path": {fs.Arg(1)}}.Encode()
+	case action == "promote" && fs.NArg() == 1:
+		path = "/images/" + fs.Arg(0) + "/promote"
+	case action == "rollback" && fs.NArg() == 1:
+		path = "/images/rollback?kind=" + url.QueryEscape(fs.Arg(0))
+	default:
+		return usage
+	}
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, *u+path, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("", os.Getenv("API_TOKEN"))
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 201 {
+		return fmt.Errorf("could not %s images: %s", action, res.Status)
+	}
+	var images []*BaseImage
+	if action == "list" {
+		err = json.NewDecoder(res.Body).Decode(&images)
+	} else {
+		img := &BaseImage{}
+		err = json.NewDecoder(res.Body).Decode(img)
+		images = []*BaseImage{img}
+	}
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if action == "list" {
+			return printJSON(images)
+		}
+		return printJSON(images[0])
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tKIND\tSTATE\tVALIDATION\tCREATED\tPATH")
+	for _, img := range images {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", img.ID, img.Kind, img.State, img.Validation, img.Created.Format(time.RFC3339), img.Path)
+	}
+	return w.Flush()
+}
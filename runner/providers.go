@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// provider parses webhook requests from a particular source into events.
+type provider interface {
+	Name() string
+	Detect(req *http.Request) bool
+	ParseEvent(req *http.Request) (Event, error)
+}
+
+type providerError struct {
+	status int
+	msg    string
+}
+
+func (e *providerError) Error() string {
+	return e.msg
+}
+
+func badRequest(format string, a ...interface{}) error {
+	return &providerError{400, fmt.Sprintf(format, a...)}
+}
+
+func unauthorized(format string, a ...interface{}) error {
+	return &providerError{401, fmt.Sprintf(format, a...)}
+}
+
+func decodeEvent(req *http.Request, event Event, name string) (Event, error) {
+	if err := json.NewDecoder(req.Body).Decode(event); err != nil && err != io.EOF {
+		return nil, badRequest("invalid JSON payload for %s event", name)
+	}
+	return event, nil
+}
+
+func checkToken(expected, actual string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
+
+// newProviders returns the GitHub provider plus any providers enabled by the
+// presence of their secret in the environment.
+func newProviders() []provider {
+	secret := os.Getenv("GITHUB_WEBHOOK_SECRET")
+	if secret == "" {
+		log.Println("GITHUB_WEBHOOK_SECRET not set, GitHub webhooks are refused")
+	}
+	providers := []provider{githubProvider{secret}}
+	if token := os.Getenv("GITLAB_TOKEN"); token != "" {
+		providers = append(providers, gitlabProvider{token})
+	}
+	if token := os.Getenv("TRIGGER_TOKEN"); token != "" {
+		providers = append(providers, genericProvider{token})
+	}
+	return providers
+}
+
+// githubProvider verifies that deliveries are signed with secret, refusing
+// all of them if it is not set.
+type githubProvider struct {
+	secret string
+}
+
+func (githubProvider) Name() string { return "github" }
+
+func (githubProvider) Detect(req *http.Request) bool {
+	return req.Header.Get("X-Github-Event") != ""
+}
+
+func (p githubProvider) ParseEvent(req *http.Request) (Event, error) {
+	if p.secret == "" {
+		return nil, unauthorized("GitHub webhooks are not accepted without a webhook secret")
+	}
+	if err := verifySignature(req, p.secret); err != nil {
+		return nil, err
+	}
+	name := req.Header.Get("X-Github-Event")
+	switch name {
+	case "push":
+		return decodeEvent(req, &PushEvent{}, name)
+	case "pull_request":
+		return decodeEvent(req, &PullRequestEvent{}, name)
+	case "issue_comment":
+		return decodeEvent(req, &IssueCommentEvent{}, name)
+	default:
+		return nil, badRequest("Unknown X-Github-Event: %s", name)
+	}
+}
+
+type gitlabProvider struct {
+	token string
+}
+
+func (gitlabProvider) Name() string { return "gitlab" }
+
+func (gitlabProvider) Detect(req *http.Request) bool {
+	return req.Header.Get("X-Gitlab-Event") != ""
+}
+
+func (p gitlabProvider) ParseEvent(req *http.Request) (Event, error) {
+	if !checkToken(p.token, req.Header.Get("X-Gitlab-Token")) {
+		return nil, unauthorized("invalid X-Gitlab-Token")
+	}
+	name := req.Header.Get("X-Gitlab-Event")
+	switch name {
+	case "Push Hook":
+		return decodeEvent(req, &GitlabPushEvent{}, name)
+	case "Merge Request Hook":
+		return decodeEvent(req, &GitlabMergeRequestEvent{}, name)
+	default:
+		return nil, badRequest("Unknown X-Gitlab-Event: %s", name)
+	}
+}
+
+// genericProvider accepts a plain JSON POST to /trigger, for mirrors which
+// can't send GitHub or GitLab formatted webhooks.
+type genericProvider struct {
+	token string
+}
+
+func (genericProvider) Name() string { return "generic" }
+
+func (genericProvider) Detect(req *http.Request) bool {
+	return req.URL.Path == "/trigger"
+}
+
+func (p genericProvider) ParseEvent(req *http.Request) (Event, error) {
+	event := &TriggerEvent{}
+	if _, err := decodeEvent(req, event, "trigger"); err != nil {
+		return nil, err
+	}
+	if !checkToken(p.token, event.Token) {
+		return nil, unauthorized("invalid trigger token")
+	}
+	if event.Name == "" || event.Ref == "" || event.Url == "" {
+		return nil, badRequest("trigger requires repo, ref and clone_url")
+	}
+	return event, nil
+}
+
+// maxWebhookSize is the largest webhook body accepted, the most GitHub sends.
+const maxWebhookSize = 25 << 20
+
+func (r *Runner) httpEventHandler(w http.ResponseWriter, req *http.Request) {
+	// bodies are read before they are authenticated
+	req.Body = http.MaxBytesReader(w, req.Body, maxWebhookSize)
+	var p provider
+	for _, candidate := range r.providers {
+		if candidate.Detect(req) {
+			p = candidate
+			break
+		}
+	}
+	if p == nil {
+		log.Println("webhook: request from unknown provider")
+		http.Error(w, "unknown webhook provider\n", 400)
+		return
+	}
+
+	id, err := deliveryID(req)
+	if err != nil {
+		log.Printf("webhook: %s: %s\n", p.Name(), err)
+		http.Error(w, err.Error()+"\n", 400)
+		return
+	}
+	event, err := p.ParseEvent(req)
+	if err != nil {
+		log.Printf("webhook: %s: %s\n", p.Name(), err)
+		status := 400
+		if e, ok := err.(*providerError); ok {
+			status = e.status
+		}
+		http.Error(w, err.Error()+"\n", status)
+		return
+	}
+	repo := event.Repo()
+	if !r.config.KnownRepo(repo) {
+		log.Println("webhook: unknown repo", repo)
+		http.Error(w, fmt.Sprintf("unknown repo %s", repo), 400)
+		return
+	}
+	if _, comment := event.(*IssueCommentEvent); !comment && needsBuild(event) {
+		if err := checkBuildSource(event.Commit(), event.CloneUrl()); err != nil {
+			log.Printf("webhook: %s: %s\n", p.Name(), err)
+			http.Error(w, err.Error()+"\n", 400)
+			return
+		}
+	}
+	if t := eventTime(event); !t.IsZero() && time.Since(t) > r.config.MaxDeliveryAge() {
+		log.Printf("webhook: %s: rejecting stale delivery of an event from %s\n", p.Name(), t.Format(time.RFC3339))
+		http.Error(w, "stale delivery\n", 400)
+		return
+	}
+	if id != "" {
+		if seen, err := r.seenDelivery(id); err != nil {
+			log.Printf("webhook: could not record delivery %s: %s\n", id, err)
+		} else if seen {
+			log.Printf("webhook: %s: ignoring duplicate delivery %s\n", p.Name(), id)
+			http.Error(w, "duplicate delivery\n", 409)
+			return
+		}
+	}
+	// events queue up while a takeover waits for the previous runner to
+	// drain, so once the queue is full deliveries are refused for the
+	// sender to redeliver rather than held until the sender times out
+	select {
+	case r.events <- event:
+	default:
+		if id != "" {
+			r.forgetDelivery(id)
+		}
+		log.Printf("webhook: %s: event queue full, refusing delivery\n", p.Name())
+		http.Error(w, "event queue full, try again later\n", 503)
+		return
+	}
+	logEvent(event)
+	io.WriteString(w, "ok\n")
+}
+
+func eventProvider(event Event) string {
+	switch event.(type) {
+	case *GitlabPushEvent, *GitlabMergeRequestEvent:
+		return "gitlab"
+	case *TriggerEvent:
+		return "generic"
+	default:
+		return "github"
+	}
+}
+
+// eventAuthor returns the user who pushed or opened the pull request.
+func eventAuthor(event Event) string {
+	switch e := event.(type) {
+	case *PushEvent:
+		if e.Pusher != nil {
+			return e.Pusher.Name
+		}
+	case *PullRequestEvent:
+		if e.PullRequest.User != nil {
+			return e.PullRequest.User.Login
+		}
+	case *GitlabPushEvent:
+		return e.UserName
+	case *GitlabMergeRequestEvent:
+		if e.User != nil {
+			return e.User.Username
+		}
+	}
+	return ""
+}
+
+func trimRef(ref string) string {
+	return strings.TrimPrefix(ref, "refs/heads/")
+}
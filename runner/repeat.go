@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/config"
+	"github.com/flynn/flynn-test/util"
+)
+
+// repeat runs a single test over and over on fresh clusters to hunt down
+// flaky failures, keeping the output and artifacts of failed runs only, and
+// printing a repeatSummary with --json:
+//
+//	runner [flags] repeat --test BasicSuite.TestBasic --count 20 [--json]
+func repeat(cmdArgs []string) error {
+	fs := flag.NewFlagSet("repeat", flag.ExitOnError)
+	test := fs.String("test", "", "name of the test to run, e.g. BasicSuite.TestBasic")
+	count := fs.Int("count", 10, "number of times to run the test, 0 to run until it fails")
+	untilFailure := fs.Bool("until-failure", false, "stop at the first failure")
+	outDir := fs.String("out", "repeat", "directory to save the output and artifacts of failed runs to")
+	asJSON := fs.Bool("json", false, "print a summary of the runs as JSON")
+	fs.Parse(cmdArgs)
+	if *test == "" {
+		return errors.New("repeat: --test is required")
+	}
+	if *count == 0 {
+		*untilFailure = true
+	}
+
+	conf, err := args.Config()
+	if err != nil {
+		return err
+	}
+	profile, err := conf.Profile(args.Profile)
+	if err != nil {
+		return err
+	}
+	bc := args.BootConfig
+	bc.Roles = conf.Roles
+	bc.BootProfiles = conf.BootProfiles
+	bc.Seed = args.Seed
+	cluster.HandleSignals()
+
+	dockerfs := args.DockerFS
+	if dockerfs == "" {
+		if dockerfs, err = cluster.BuildFlynn(bc, "", util.Repos, os.Stdout); err != nil {
+			return fmt.Errorf("could not build flynn: %s", err)
+		}
+		defer os.RemoveAll(dockerfs)
+	}
+	roles := clusterRoles(&Build{}, profile)
+	filter := "^" + regexp.QuoteMeta(*test) + "$"
+
+	var runs, failures int
+	summary := &repeatSummary{Test: *test}
+	for i := 0; *count == 0 || i < *count; i++ {
+		runs++
+		bc.RunID = fmt.Sprintf("repeat-%d-%s", i, util.RandomString(8))
+		runDir := filepath.Join(*outDir, fmt.Sprintf("run-%d", i))
+		err := repeatOnce(bc, dockerfs, roles, filter, profile, runDir)
+		if leakErr := cluster.VerifyTeardown(bc.RunID); leakErr != nil && err == nil {
+			err = &infraError{leakErr}
+		}
+		if err == nil {
+			log.Printf("run %d: pass\n", i)
+			summary.Runs = append(summary.Runs, &repeatRun{Run: i, Passed: true})
+			continue
+		}
+		failures++
+		log.Printf("run %d: fail: %s, output saved to %s\n", i, err, runDir)
+		summary.Runs = append(summary.Runs, &repeatRun{Run: i, Error: err.Error(), Output: runDir})
+		if *untilFailure {
+			break
+		}
+	}
+	log.Printf("%s passed %d/%d runs (%.1f%%)\n", *test, runs-failures, runs, 100*float64(runs-failures)/float64(runs))
+	summary.Failures = failures
+	if *asJSON {
+		if err := printJSON(summary); err != nil {
+			return err
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("%s failed %d of %d runs", *test, failures, runs)
+	}
+	return nil
+}
+
+type repeatSummary struct {
+	Test     string       `json:"test"`
+	Failures int          `json:"failures"`
+	Runs     []*repeatRun `json:"runs"`
+}
+
+// repeatRun is the result of a run of repeat, with the dir its output was
+// saved to if it failed.
+type repeatRun struct {
+	Run    int    `json:"run"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+	Output string `json:"output,omitempty"`
+}
+
+// moveDir renames src to dst, copying it and removing src if they are on
+// different filesystems, as the run dir and the output dir may be.
+func moveDir(src, dst string) error {
+	err := os.Rename(src, dst)
+	if e, ok := err.(*os.LinkError); !ok || e.Err != syscall.EXDEV {
+		return err
+	}
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyRegular(path, target, info.Mode().Perm())
+		}
+		return nil
+	})
+	if err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+func copyRegular(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// repeatOnce runs the tests matching filter on a fresh cluster, saving the
+// output and artifacts to dir if they fail.
+func repeatOnce(bc cluster.BootConfig, dockerfs string, roles []string, filter string, profile *config.Profile, dir string) (err error) {
+	runDir, err := cluster.RunDir(bc.Workdir, bc.RunID)
+	if err != nil {
+		return err
+	}
+	defer cluster.CleanupRun(bc.RunID)
+	artifactsDir, err := ioutil.TempDir(runDir, "artifacts-")
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	defer func() {
+		if err == nil {
+			return
+		}
+		fmt.Fprintf(&out, "run error: %s\n", err)
+		if e := os.MkdirAll(filepath.Dir(dir), 0755); e != nil {
+			log.Printf("could not save run output: %s\n", e)
+			return
+		}
+		if e := moveDir(artifactsDir, dir); e != nil {
+			log.Printf("could not save run artifacts: %s\n", e)
+			os.MkdirAll(dir, 0755)
+		}
+		if e := ioutil.WriteFile(filepath.Join(dir, "output.txt"), out.Bytes(), 0644); e != nil {
+			log.Printf("could not save run output: %s\n", e)
+		}
+	}()
+
+	c := cluster.New(bc, &out)
+	defer c.Shutdown()
+	if err := c.BootRoles(dockerfs, roles); err != nil {
+		return bootError(err)
+	}
+	flynnrc, err := createFlynnrc(c)
+	if err != nil {
+		return fmt.Errorf("could not create flynnrc: %s", err)
+	}
+	defer c.RemoveCLI()
+	var ran bool
+	_, err = runTests(flynnrc, filter, time.Duration(profile.Timeout), profile.Timeouts.TestTimeout(), &out, func(*TestResult) { ran = true }, "--artifacts", artifactsDir, "--seed", strconv.FormatInt(bc.Seed, 10), "--features", profile.Features.String())
+	if err == nil && !ran {
+		return errors.New("no test matched")
+	}
+	return err
+}
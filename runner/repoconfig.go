@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/flynn/flynn-test/config"
+)
+
+// loadRepoConfig reads the repo config file from the commit being built, or
+// returns nil if there is no file, no repo policy is configured or the build
+// is of a source rather than a commit.
+func (r *Runner) loadRepoConfig(b *Build) (*config.RepoConfig, error) {
+	if r.config.RepoPolicy == nil || b.Source != "" {
+		return nil, nil
+	}
+	var data []byte
+	var err error
+	if b.fromGithub() || b.CloneUrl == "" {
+		data, err = r.github.fileContents(b.Repo, config.RepoConfigFile, b.Commit)
+	} else {
+		data, err = fileFromClone(b.CloneUrl, b.Commit, config.RepoConfigFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch %s: %s", config.RepoConfigFile, err)
+	}
+	if data == nil {
+		return nil, nil
+	}
+	return config.ParseRepoConfig(data)
+}
+
+// fileFromClone fetches commit from url into a temporary repo and returns the
+// contents of path, or nil if it doesn't exist.
+func fileFromClone(url, commit, path string) ([]byte, error) {
+	if err := checkCloneURL(url); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "repo-config-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	for _, args := range [][]string{{"init", "-q"}, {"fetch", "-q", "--depth", "1", "--", url, commit}} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("git %s failed: %s: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+	}
+	cmd := exec.Command("git", "cat-file", "blob", "FETCH_HEAD:"+path)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		// the file doesn't exist in the commit
+		return nil, nil
+	}
+	return out, nil
+}
+
+// checkCloneURL refuses clone URLs which git could take as an option or which
+// use a transport other than https, git or ssh, such as ext:: running a
+// command.
+func checkCloneURL(cloneURL string) error {
+	if strings.HasPrefix(cloneURL, "-") {
+		return fmt.Errorf("invalid clone URL %q", cloneURL)
+	}
+	u, err := url.Parse(cloneURL)
+	if err != nil {
+		return fmt.Errorf("invalid clone URL %q: %s", cloneURL, err)
+	}
+	switch u.Scheme {
+	case "https", "git", "ssh":
+		return nil
+	default:
+		return fmt.Errorf("clone URL %q does not use https, git or ssh", cloneURL)
+	}
+}
+
+var refPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_./-]*$`)
+
+// checkRef refuses refs, which are passed to git by the build script, which
+// git could take as an option or which aren't plain branch names or SHAs.
+func checkRef(ref string) error {
+	if !refPattern.MatchString(ref) || strings.Contains(ref, "..") {
+		return fmt.Errorf("invalid ref %q", ref)
+	}
+	return nil
+}
+
+// checkBuildSource checks the ref and clone URL of a build when it is
+// accepted, an empty clone URL being that of the repo itself.
+func checkBuildSource(ref, cloneURL string) error {
+	if err := checkRef(ref); err != nil {
+		return err
+	}
+	if cloneURL == "" {
+		return nil
+	}
+	return checkCloneURL(cloneURL)
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestCheckBuildSource(t *testing.T) {
+	for _, test := range []struct {
+		ref, url string
+		ok       bool
+	}{
+		{"master", "", true},
+		{"0123456789abcdef0123456789abcdef01234567", "https://github.com/flynn/flynn.git", true},
+		{"refs/heads/feature/x", "git://mirror.local/flynn.git", true},
+		{"master", "ssh://git@mirror.local/flynn.git", true},
+		{"master", "-uhttps://github.com/flynn/flynn.git", false},
+		{"master", "--upload-pack=touch /tmp/x", false},
+		{"master", "ext::sh -c touch% /tmp/x", false},
+		{"master", "file:///etc", false},
+		{"master", "/srv/git/flynn.git", false},
+		{"master", "http://github.com/flynn/flynn.git", false},
+		{"", "", false},
+		{"-b", "", false},
+		{"--upload-pack=x", "", false},
+		{"master; rm -rf /", "", false},
+		{"$(id)", "", false},
+		{"a'b", "", false},
+		{"master..other", "", false},
+		{"/master", "", false},
+	} {
+		if err := checkBuildSource(test.ref, test.url); (err == nil) != test.ok {
+			t.Errorf("checkBuildSource(%q, %q) returned %v", test.ref, test.url, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"sort"
+	"time"
+)
+
+// maxChartTests limits the timings chart of the HTML report to the slowest
+// tests.
+const maxChartTests = 40
+
+var reportTemplate = template.Must(template.New("report").Funcs(templateFuncs).Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Build.Repo}} {{.Build.Commit}} - flynn-test run {{.Build.Id}}</title>
+<style>
+body { font-family: sans-serif; margin: 20px; }
+td, th { padding: 2px 8px; text-align: left; }
+pre { background: #f4f4f4; padding: 8px; overflow-x: auto; }
+.pass, .flaky { color: #1a7f37; }
+.fail, .panic { color: #cf222e; }
+.skip, .miss { color: #777; }
+</style>
+</head>
+<body>
+<h1>{{.Build.Repo}} {{.Build.Commit}}</h1>
+<table>
+<tr><th>Run</th><td>{{.Build.Id}}</td></tr>
+{{if .Build.Branch}}<tr><th>Branch</th><td>{{.Build.Branch}}{{if .Build.PullRequest}} (pull request #{{.Build.PullRequest}}){{end}}</td></tr>{{end}}
+{{if .Build.Profile}}<tr><th>Profile</th><td>{{.Build.Profile}}</td></tr>{{end}}
+<tr><th>Seed</th><td>{{.Build.Seed}}</td></tr>
+{{if .Build.Features}}<tr><th>Features</th><td>{{.Build.Features}}</td></tr>{{end}}
+<tr><th>Started</th><td>{{.Build.Created.UTC.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Duration</th><td>{{duration .Build.Duration}}</td></tr>
+<tr><th>Tests</th><td><span class="pass">{{.Report.Passed}} passed</span>{{if .Flaky}} ({{.Flaky}} flaky){{end}}, <span class="fail">{{.Report.Failed}} failed</span>, <span class="skip">{{.Report.Skipped}} skipped</span></td></tr>
+</table>
+{{if .Chart}}
+<h2>Timings</h2>
+<svg width="{{.ChartWidth}}" height="{{.ChartHeight}}" xmlns="http://www.w3.org/2000/svg" font-size="12" font-family="sans-serif">
+{{range .Chart}}<g transform="translate(0,{{.Y}})">
+<text x="{{$.LabelWidth}}" y="12" text-anchor="end" dx="-6">{{.Name}}</text>
+<rect x="{{$.LabelWidth}}" width="{{.Width}}" height="14" fill="{{.Color}}"><title>{{.Name}}: {{duration .Duration}}</title></rect>
+<text x="{{$.LabelWidth}}" y="12" dx="{{.Width}}"><tspan dx="4">{{duration .Duration}}</tspan></text>
+</g>
+{{end}}</svg>
+{{end}}
+{{if .Failures}}
+<h2>Failures</h2>
+{{range .Failures}}<h3 class="{{.Status}}" id="{{.Name}}">{{.Name}} ({{.Status}})</h3>
+{{if .File}}<p>{{.File}}:{{.Line}}</p>{{end}}
+{{if .Owners}}<p>Owned by {{join .Owners ", "}}</p>{{end}}
+<pre>{{.Output}}</pre>
+{{end}}
+{{end}}
+<h2>Tests</h2>
+<table>
+<tr><th>Test</th><th>Status</th><th>Duration</th><th>Owners</th></tr>
+{{range .Report.Tests}}<tr><td>{{.Name}}</td><td class="{{.Status}}">{{.StatusText}}</td><td>{{duration .Duration}}</td><td>{{join .Owners ", "}}</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`[1:]))
+
+type reportBar struct {
+	Name     string
+	Duration time.Duration
+	Y, Width int
+	Color    string
+}
+
+var reportColors = map[string]string{
+	"pass":  "#2da44e",
+	"flaky": "#bf8700",
+	"fail":  "#cf222e",
+	"panic": "#cf222e",
+}
+
+// html renders the report as a standalone page, with a chart of the slowest
+// tests and the output of failed tests inline, so that it can be shared
+// without access to the runner.
+func (report *resultsReport) html(b *Build) ([]byte, error) {
+	const labelWidth, barWidth, rowHeight = 360, 400, 18
+	data := map[string]interface{}{
+		"Build":      b,
+		"Report":     report,
+		"LabelWidth": labelWidth,
+		"ChartWidth": labelWidth + barWidth + 80,
+	}
+	var timed []*TestResult
+	var failures []*TestResult
+	flaky := 0
+	for _, res := range report.Tests {
+		if res.Duration > 0 {
+			timed = append(timed, res)
+		}
+		if res.Failed() {
+			failures = append(failures, res)
+		}
+		if res.Status == "flaky" {
+			flaky++
+		}
+	}
+	sort.Sort(sort.Reverse(resultsByDuration(timed)))
+	if len(timed) > maxChartTests {
+		timed = timed[:maxChartTests]
+	}
+	bars := make([]*reportBar, len(timed))
+	for i, res := range timed {
+		color, ok := reportColors[res.Status]
+		if !ok {
+			color = "#8c959f"
+		}
+		bars[i] = &reportBar{
+			Name:     res.Name,
+			Duration: res.Duration,
+			Y:        i * rowHeight,
+			Width:    int(int64(barWidth) * int64(res.Duration) / int64(timed[0].Duration)),
+			Color:    color,
+		}
+	}
+	data["Chart"] = bars
+	data["ChartHeight"] = len(bars) * rowHeight
+	data["Failures"] = failures
+	data["Flaky"] = flaky
+	var buf bytes.Buffer
+	err := reportTemplate.Execute(&buf, data)
+	return buf.Bytes(), err
+}
+
+type resultsByDuration []*TestResult
+
+func (r resultsByDuration) Len() int           { return len(r) }
+func (r resultsByDuration) Less(i, j int) bool { return r[i].Duration < r[j].Duration }
+func (r resultsByDuration) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// buildKeepingBuilder builds on a new build instance of c which is kept
+// running if the build fails, so that its steps can be rerun while debugging
+// the failure.
+func (r *Runner) buildKeepingBuilder(b *Build, c *cluster.Cluster, base string, repos, urls map[string]string, env []string, out io.Writer) (string, error) {
+	builder, err := c.NewBuilder(base)
+	if err != nil {
+		c.Shutdown()
+		return "", err
+	}
+	fs, err := builder.Build(repos, urls, env, out)
+	if err != nil {
+		r.keptMtx.Lock()
+		r.keptBuilders[b.Id] = builder
+		r.keptMtx.Unlock()
+		fmt.Fprintf(out, "keeping build instance for debugging, rerun a step with: runner rerun %s <repo>\n", b.Id)
+		return "", err
+	}
+	builder.Close()
+	return fs, nil
+}
+
+func (r *Runner) keptBuilder(id string) *cluster.Builder {
+	r.keptMtx.Lock()
+	defer r.keptMtx.Unlock()
+	return r.keptBuilders[id]
+}
+
+// rerunStep reruns the build step given as ?step=<repo> on the kept build
+// instance of a build, streaming its output.
+func (r *Runner) rerunStep(w http.ResponseWriter, req *http.Request, id string) {
+	builder := r.keptBuilder(id)
+	if builder == nil {
+		http.Error(w, fmt.Sprintf("build %s has no kept build instance\n", id), 404)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	out := &flushWriter{w: w}
+	out.flusher, _ = w.(http.Flusher)
+	if err := builder.RunStep(req.FormValue("step"), out); err != nil {
+		fmt.Fprintf(out, "build step failed: %s\n", err)
+		return
+	}
+	fmt.Fprintln(out, "build step passed")
+}
+
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if f.flusher != nil {
+		f.flusher.Flush()
+	}
+	return n, err
+}
+
+// rerun asks a running runner to rerun the build of a repo on the build
+// instance kept after a build with keep_on_fail failed to build:
+//
+//	runner rerun [--url http://localhost] <run-id> <repo>
+func rerun(cmdArgs []string) error {
+	fs := flag.NewFlagSet("rerun", flag.ExitOnError)
+	u := fs.String("url", "http://localhost", "URL of the runner")
+	fs.Parse(cmdArgs)
+	if fs.NArg() != 2 {
+		return errors.New("usage: runner rerun [--url URL] <run-id> <repo>")
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/builds/%s/rerun?step=%s", *u, fs.Arg(0), url.QueryEscape(fs.Arg(1))), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("", os.Getenv("API_TOKEN"))
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("could not rerun build step: %s", res.Status)
+	}
+	_, err = io.Copy(os.Stdout, res.Body)
+	return err
+}
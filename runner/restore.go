@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/config"
+)
+
+// snapshotForRestore snapshots c if the profile restores snapshots, serving
+// the restore requests of the tests binary on a local port. It returns the
+// args which point the tests binary at it, and a func to stop serving.
+// Destructive tests fall back to tearing down fixtures if the cluster can't
+// be snapshotted.
+func snapshotForRestore(c *cluster.Cluster, profile *config.Profile, out io.Writer) ([]string, func()) {
+	if !profile.SnapshotRestore {
+		return nil, func() {}
+	}
+	start := time.Now()
+	if err := c.Snapshot(cluster.BootstrapSnapshot); err != nil {
+		fmt.Fprintf(out, "could not snapshot cluster, destructive tests won't restore it: %s\n", err)
+		return nil, func() {}
+	}
+	fmt.Fprintf(out, "snapshotted cluster in %s\n", truncate(time.Since(start)))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintf(out, "could not serve cluster restores: %s\n", err)
+		return nil, func() {}
+	}
+	var mtx sync.Mutex
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "method not allowed\n", 405)
+			return
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		start := time.Now()
+		if err := c.Restore(cluster.BootstrapSnapshot); err != nil {
+			fmt.Fprintf(out, "could not restore cluster snapshot: %s\n", err)
+			http.Error(w, err.Error()+"\n", 500)
+			return
+		}
+		fmt.Fprintf(out, "restored cluster snapshot in %s\n", truncate(time.Since(start)))
+	}))
+	return []string{"--restore-url", "http://" + l.Addr().String()}, func() { l.Close() }
+}
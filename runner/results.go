@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"strconv"
+	"time"
+)
+
+// resultsReport is the JSON report of a build's test results, which is
+// stable across runs so reports of different builds can be diffed.
+type resultsReport struct {
+	Build    string        `json:"build"`
+	Repo     string        `json:"repo"`
+	Commit   string        `json:"commit"`
+	Passed   int           `json:"passed"`
+	Failed   int           `json:"failed"`
+	Skipped  int           `json:"skipped"`
+	Duration time.Duration `json:"duration"`
+	Tests    []*TestResult `json:"tests"`
+}
+
+func newResultsReport(b *Build, results []*TestResult) *resultsReport {
+	report := &resultsReport{Build: b.Id, Repo: b.Repo, Commit: b.Commit, Tests: results}
+	if report.Tests == nil {
+		report.Tests = []*TestResult{}
+	}
+	for _, res := range results {
+		switch {
+		case res.Failed():
+			report.Failed++
+		case res.Status == "skip" || res.Status == "miss":
+			report.Skipped++
+		default:
+			report.Passed++
+		}
+		report.Duration += res.Duration
+	}
+	return report
+}
+
+type junitTestSuite struct {
+	XMLName  xml.Name         `xml:"testsuite"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Cases    []*junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Line      int           `xml:"line,attr,omitempty"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// junit renders the report as JUnit XML. Panicked tests are reported as
+// errors, and missed tests, which didn't run as a fixture failed, as skipped.
+func (report *resultsReport) junit() ([]byte, error) {
+	suite := &junitTestSuite{
+		Name:  report.Repo,
+		Tests: len(report.Tests),
+		Time:  junitSeconds(report.Duration),
+	}
+	for _, res := range report.Tests {
+		tc := &junitTestCase{
+			Name:      res.Name,
+			ClassName: report.Repo,
+			File:      res.File,
+			Line:      res.Line,
+			Time:      junitSeconds(res.Duration),
+		}
+		switch res.Status {
+		case "fail":
+			tc.Failure = &junitMessage{Message: "test failed", Body: res.Output}
+			suite.Failures++
+		case "panic":
+			tc.Error = &junitMessage{Message: "test panicked", Body: res.Output}
+			suite.Errors++
+		case "skip", "miss":
+			tc.Skipped = &junitMessage{Message: res.StatusText()}
+			suite.Skipped++
+		default:
+			tc.SystemOut = res.Output
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	data, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// uploadResults uploads the JSON, JUnit and HTML reports of the results of b.
+func (r *Runner) uploadResults(b *Build, m *manifest, results []*TestResult) []*Artifact {
+	report := newResultsReport(b, results)
+	var artifacts []*Artifact
+	upload := func(name, contentType string, data []byte, err error) {
+		if err != nil {
+			log.Printf("could not render %s: %s\n", name, err)
+			return
+		}
+		url, err := r.putBlob(m, name, bytes.NewReader(data), contentType, true)
+		if err != nil {
+			log.Printf("could not upload %s: %s\n", name, err)
+			return
+		}
+		artifacts = append(artifacts, &Artifact{Name: name, Url: url})
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	upload("results.json", "application/json", data, err)
+	data, err = report.junit()
+	upload("results.xml", "application/xml", data, err)
+	data, err = report.html(b)
+	upload("report.html", "text/html", data, err)
+	return artifacts
+}
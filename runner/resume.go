@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// snapshotManifest describes a build snapshot, and is saved alongside it
+// with its hash so that stale or corrupt snapshots aren't booted.
+type snapshotManifest struct {
+	Build        string    `json:"build"`
+	Repo         string    `json:"repo"`
+	Commit       string    `json:"commit"`
+	BackingChain []string  `json:"backing_chain"`
+	Created      time.Time `json:"created"`
+}
+
+type snapshotMeta struct {
+	Manifest json.RawMessage `json:"manifest"`
+	SHA256   string          `json:"sha256"`
+}
+
+func snapshotMetaPath(snapshot string) string {
+	return strings.TrimSuffix(snapshot, filepath.Ext(snapshot)) + ".json"
+}
+
+// saveSnapshot moves the dockerfs built for b into the snapshot dir, so that
+// the build can be resumed from the bootstrap phase if that fails.
+func (r *Runner) saveSnapshot(b *Build, dockerfs string) (string, error) {
+	if err := os.MkdirAll(args.SnapshotDir, 0755); err != nil {
+		return "", err
+	}
+	path, err := filepath.Abs(filepath.Join(args.SnapshotDir, b.Id+".img"))
+	if err != nil {
+		return "", err
+	}
+	// mv rather than os.Rename as the snapshot dir may be on another device
+	if out, err := exec.Command("mv", dockerfs, path).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%s: %s", err, out)
+	}
+	chain, err := cluster.CheckImage(path)
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	manifest, err := json.Marshal(&snapshotManifest{
+		Build:        b.Id,
+		Repo:         b.Repo,
+		Commit:       b.Commit,
+		BackingChain: chain,
+		Created:      time.Now(),
+	})
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	// the snapshot is kept for the build until it is resumed or expires,
+	// and keeps the cached build it may be an overlay of
+	if err := cluster.RefImage(path, snapshotRef(b.Id)); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	if len(chain) > 1 {
+		cluster.RefImage(chain[1], path)
+	}
+	sum := sha256.Sum256(manifest)
+	meta, _ := json.Marshal(&snapshotMeta{Manifest: manifest, SHA256: hex.EncodeToString(sum[:])})
+	if err := ioutil.WriteFile(snapshotMetaPath(path), meta, 0644); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// verifySnapshot checks the snapshot of b against its manifest before it is
+// booted, and that the image and its backing files aren't corrupt.
+func verifySnapshot(b *Build) error {
+	data, err := ioutil.ReadFile(snapshotMetaPath(b.Snapshot))
+	if err != nil {
+		return fmt.Errorf("could not read snapshot manifest: %s", err)
+	}
+	var meta snapshotMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("invalid snapshot manifest: %s", err)
+	}
+	if sum := sha256.Sum256(meta.Manifest); hex.EncodeToString(sum[:]) != meta.SHA256 {
+		return errors.New("snapshot manifest hash mismatch")
+	}
+	var manifest snapshotManifest
+	if err := json.Unmarshal(meta.Manifest, &manifest); err != nil {
+		return fmt.Errorf("invalid snapshot manifest: %s", err)
+	}
+	if manifest.Build != b.Id || manifest.Commit != b.Commit {
+		return fmt.Errorf("snapshot is of build %s[%s], not %s[%s]", manifest.Build, manifest.Commit, b.Id, b.Commit)
+	}
+	chain, err := cluster.CheckImage(b.Snapshot)
+	if err != nil {
+		return err
+	}
+	if strings.Join(chain, "\n") != strings.Join(manifest.BackingChain, "\n") {
+		return fmt.Errorf("snapshot backing chain changed from %v to %v", manifest.BackingChain, chain)
+	}
+	return nil
+}
+
+// removeSnapshot removes a snapshot and its manifest.
+func removeSnapshot(snapshot string) {
+	os.Remove(snapshot)
+	os.Remove(snapshotMetaPath(snapshot))
+	cluster.DropRefs(snapshot)
+}
+
+func snapshotRef(id string) string {
+	return "build " + id
+}
+
+// snapshotGCInterval is how often unreferenced snapshots are removed.
+const snapshotGCInterval = time.Hour
+
+func (r *Runner) startSnapshotGC() {
+	go func() {
+		for {
+			r.gcSnapshots()
+			time.Sleep(snapshotGCInterval)
+		}
+	}()
+}
+
+// gcSnapshots forgets the resumable builds of snapshots older than the
+// snapshot retention, then removes the snapshots and cached builds which
+// nothing references or uses.
+func (r *Runner) gcSnapshots() {
+	maxAge := r.config.SnapshotMaxAge()
+	snapshots, _ := filepath.Glob(filepath.Join(args.SnapshotDir, "*.img"))
+	var removed int
+	for _, snapshot := range snapshots {
+		// the manifest is written once the snapshot is saved
+		info, err := os.Stat(snapshotMetaPath(snapshot))
+		if err != nil {
+			continue
+		}
+		id := strings.TrimSuffix(filepath.Base(snapshot), ".img")
+		if time.Since(info.ModTime()) > maxAge && r.runningLog(id) == nil {
+			if err := r.forgetResumable(id); err != nil {
+				log.Printf("could not forget resumable build %s: %s\n", id, err)
+				continue
+			}
+			cluster.UnrefImage(snapshot, snapshotRef(id))
+		}
+		if cluster.RemoveImage(snapshot) {
+			os.Remove(snapshotMetaPath(snapshot))
+			removed++
+		}
+	}
+	if r.cache != nil {
+		removed += r.cache.GC(maxAge)
+	}
+	if removed > 0 {
+		log.Printf("removed %d unreferenced snapshots and cached builds\n", removed)
+	}
+}
+
+// saveResumable records a build which failed to bootstrap so it can later be
+// resumed with its snapshot.
+func (r *Runner) saveResumable(b *Build) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		val, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("resumable-builds")).Put([]byte(b.Id), val)
+	})
+}
+
+func (r *Runner) forgetResumable(id string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("resumable-builds")).Delete([]byte(id))
+	})
+}
+
+// resumeBuild reruns a build which failed to bootstrap from its snapshot,
+// skipping the build phase.
+func (r *Runner) resumeBuild(id string) (*Build, error) {
+	var b *Build
+	if err := r.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket([]byte("resumable-builds")).Get([]byte(id))
+		if val == nil {
+			return nil
+		}
+		b = &Build{}
+		return json.Unmarshal(val, b)
+	}); err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, fmt.Errorf("build %s is not resumable", id)
+	}
+	if err := verifySnapshot(b); err != nil {
+		r.forgetResumable(id)
+		removeSnapshot(b.Snapshot)
+		return nil, fmt.Errorf("snapshot of build %s is invalid, trigger a new build: %s", id, err)
+	}
+	if err := r.forgetResumable(id); err != nil {
+		return nil, err
+	}
+	log.Printf("resuming build %s from snapshot %s\n", b.Id, b.Snapshot)
+	b.Queued = time.Time{}
+	if err := r.enqueue(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// buildAction handles GET /builds/<id>, POST /builds/<id>/resume,
+// POST /builds/<id>/approve, POST /builds/<id>/rerun and GET /builds/<id>/log.
+func (r *Runner) buildAction(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/builds/"), "/")
+	if len(parts) == 1 && req.Method == "GET" {
+		r.getBuild(w, parts[0])
+		return
+	}
+	if len(parts) == 2 && parts[1] == "log" {
+		r.followLog(w, req, parts[0])
+		return
+	}
+	if len(parts) == 2 && parts[1] == "events" {
+		r.streamEvents(w, req, parts[0])
+		return
+	}
+	if len(parts) == 2 && parts[1] == "console" {
+		r.consoleTails(w, req, parts[0])
+		return
+	}
+	if len(parts) == 2 && parts[1] == "stats" {
+		r.instanceStats(w, req, parts[0])
+		return
+	}
+	if len(parts) == 2 && parts[1] == "annotations" {
+		r.buildAnnotations(w, req, parts[0])
+		return
+	}
+	if len(parts) != 2 || (parts[1] != "resume" && parts[1] != "approve" && parts[1] != "rerun") {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed\n", 405)
+		return
+	}
+	if parts[1] == "rerun" {
+		r.rerunStep(w, req, parts[0])
+		return
+	}
+	if parts[1] == "approve" {
+		b, err := r.approve(parts[0], "dashboard")
+		if err != nil {
+			http.Error(w, err.Error()+"\n", 400)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "build %s approved\n", b.Id)
+		return
+	}
+	b, err := r.resumeBuild(parts[0])
+	if err != nil {
+		http.Error(w, err.Error()+"\n", 400)
+		return
+	}
+	if wantsJSON(req) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "build %s resumed from the bootstrap phase\n", b.Id)
+}
+
+// resume asks a running runner to resume a build which failed to bootstrap:
+//
+//	runner resume [--url http://localhost] [--json] <run-id>
+func resume(cmdArgs []string) error {
+	fs := flag.NewFlagSet("resume", flag.ExitOnError)
+	url := fs.String("url", "http://localhost", "URL of the runner")
+	asJSON := fs.Bool("json", false, "print the resumed build as JSON")
+	fs.Parse(cmdArgs)
+	if fs.NArg() != 1 {
+		return errors.New("usage: runner resume [--url URL] [--json] <run-id>")
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/builds/%s/resume", *url, fs.Arg(0)), nil)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		req.Header.Set("Accept", "application/json")
+	}
+	req.SetBasicAuth("", os.Getenv("API_TOKEN"))
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 {
+		return fmt.Errorf("could not resume build: %s", strings.TrimSpace(string(body)))
+	}
+	os.Stdout.Write(body)
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/config"
+)
+
+// retryBudgets asks the tests binary how many times each test may be rerun
+// after failing.
+func retryBudgets() (map[string]int, error) {
+	out, err := exec.Command(args.TestsPath, "--list-retries").Output()
+	if err != nil {
+		return nil, err
+	}
+	budgets := make(map[string]int)
+	return budgets, json.Unmarshal(out, &budgets)
+}
+
+// retryFailures reruns the failed tests which have a retry budget, either
+// declared by the test or given by the profile's retry policy, or which are
+// known to be flaky on master, booting a fresh cluster with fresh copies of
+// the images for each round of reruns. Tests which pass on a rerun are marked
+// as flaky, and an error is returned if any test still fails.
+func (r *Runner) retryFailures(b *Build, bc cluster.BootConfig, dockerfs string, roles []string, profile *config.Profile, results []*TestResult, out io.Writer, testArgs ...string) error {
+	failed := make(map[string]*TestResult)
+	for _, res := range results {
+		if res.Failed() {
+			failed[res.Name] = res
+		}
+	}
+	budgets, err := retryBudgets()
+	if err != nil {
+		fmt.Fprintf(out, "could not get retry budgets: %s\n", err)
+		if profile.Retry == nil {
+			return fmt.Errorf("%d tests failed", len(failed))
+		}
+		budgets = make(map[string]int)
+	}
+	for name := range failed {
+		if n := profile.Retry.Budget(name); n > budgets[name] {
+			budgets[name] = n
+		}
+	}
+	if r.config.Flaky != nil && r.config.Flaky.RetryScore > 0 {
+		scores := r.flakyTests(b.Project)
+		for name := range failed {
+			if budgets[name] < 1 && scores[name] >= r.config.Flaky.RetryScore {
+				fmt.Fprintf(out, "%s is flaky on master (score %.2f), allowing a rerun\n", name, scores[name])
+				budgets[name] = 1
+			}
+		}
+	}
+
+	for attempt := 1; len(failed) > 0; attempt++ {
+		var names []string
+		for name := range failed {
+			if budgets[name] >= attempt {
+				names = append(names, regexp.QuoteMeta(name))
+			}
+		}
+		if len(names) == 0 {
+			break
+		}
+		if profile.Retry != nil && profile.Retry.Delay > 0 {
+			time.Sleep(time.Duration(profile.Retry.Delay))
+		}
+		fmt.Fprintf(out, "retrying %d failed tests on a fresh cluster, attempt %d\n", len(names), attempt)
+		filter := "^(" + strings.Join(names, "|") + ")$"
+		err := r.rerunTests(bc, dockerfs, roles, filter, profile, out, testArgs, func(res *TestResult) {
+			orig, ok := failed[res.Name]
+			if !ok {
+				return
+			}
+			orig.Attempts = attempt + 1
+			if res.Status == "pass" {
+				orig.Status = "flaky"
+				delete(failed, res.Name)
+			}
+		})
+		if err != nil {
+			fmt.Fprintf(out, "could not retry tests: %s\n", err)
+			break
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d tests failed", len(failed))
+	}
+	return nil
+}
+
+func (r *Runner) rerunTests(bc cluster.BootConfig, dockerfs string, roles []string, filter string, profile *config.Profile, out io.Writer, testArgs []string, onResult func(*TestResult)) error {
+	c := cluster.New(bc, out)
+	defer c.Shutdown()
+	if err := c.BootRoles(dockerfs, roles); err != nil {
+		return bootError(err)
+	}
+	flynnrc, err := createFlynnrc(c)
+	if err != nil {
+		return fmt.Errorf("could not create flynnrc: %s", err)
+	}
+	defer c.RemoveCLI()
+	completed, err := runTests(flynnrc, filter, time.Duration(profile.Timeout), profile.Timeouts.TestTimeout(), out, onResult, testArgs...)
+	if !completed {
+		return err
+	}
+	return nil
+}
@@ -4,62 +4,353 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"html/template"
 	"io"
+	"io/ioutil"
 	"log"
-	"net/http"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/boltdb/bolt"
-	"github.com/cupcake/goamz/aws"
-	"github.com/cupcake/goamz/s3"
+	"github.com/flynn/flynn-test/ansi"
 	"github.com/flynn/flynn-test/arg"
 	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/config"
 	"github.com/flynn/flynn-test/util"
-	"github.com/flynn/go-flynn/attempt"
 	"github.com/gorilla/handlers"
 )
 
-var logBucket = "flynn-ci-logs"
-
 type Build struct {
-	Id     string `json:"id"`
-	Repo   string `json:"repo"`
-	Commit string `json:"commit"`
-	State  string `json:"state"`
+	Id          string   `json:"id"`
+	Repo        string   `json:"repo"`
+	Commit      string   `json:"commit"`
+	Branch      string   `json:"branch,omitempty"`
+	CloneUrl    string   `json:"clone_url,omitempty"`
+	Provider    string   `json:"provider,omitempty"`
+	Profile     string   `json:"profile,omitempty"`
+	ClusterSize int      `json:"cluster_size,omitempty"`
+	Env         []string `json:"env,omitempty"`
+	KeepOnFail  bool     `json:"keep_on_fail,omitempty"`
+	PullRequest int      `json:"pull_request,omitempty"`
+	Seed        int64    `json:"seed,omitempty"`
+	State       string   `json:"state"`
+
+	// Features are the feature flags set for the tests by the labels of the
+	// pull request and then by the profile, see config.Features.
+	Features config.Features `json:"features,omitempty"`
+
+	// Project is the project the repo belongs to, see config.Project, or
+	// empty for flynn components.
+	Project string `json:"project,omitempty"`
+
+	// Pins are the commits the flynn components were pinned to by a
+	// dependency update profile, see config.DependencyUpdate.
+	Pins map[string]string `json:"pins,omitempty"`
+
+	// Source is a directory or gzipped tarball on the runner host which the
+	// repo is built from rather than a commit, to test uncommitted work.
+	Source string `json:"source,omitempty"`
+
+	// Phase is the step a running build is at, see setPhase.
+	Phase string `json:"phase,omitempty"`
+
+	// Waiting lists the mutexes of the build's profile held by other
+	// builds while it waits for them.
+	Waiting []string `json:"waiting,omitempty"`
+
+	// Author is the user who pushed or opened the pull request, Created
+	// when the build was triggered and Duration how long it ran for once
+	// it has finished.
+	Author   string        `json:"author,omitempty"`
+	Created  time.Time     `json:"created"`
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// Queued is when the build was queued to run, which is kept across
+	// restarts of the runner, and QueueWait how long it waited for a build
+	// slot once it started.
+	Queued    time.Time     `json:"queued,omitempty"`
+	QueueWait time.Duration `json:"queue_wait,omitempty"`
+
+	// LogCheckpoint is the length of the log uploaded to PartialLogUrl
+	// while the build runs.
+	LogCheckpoint int    `json:"log_checkpoint,omitempty"`
+	PartialLogUrl string `json:"partial_log_url,omitempty"`
+
+	// Snapshot is the dockerfs of a build which failed to bootstrap, which
+	// it is resumed from.
+	Snapshot string `json:"snapshot,omitempty"`
+
+	// Image is the candidate base image the build validates, which it
+	// starts from rather than the stable one, see BaseImage.
+	Image string `json:"image,omitempty"`
+
+	// RepoEnv is set for the build script by the repo config file of the
+	// commit, and RejectedDirectives lists its directives which exceeded
+	// the runner's policy.
+	RepoEnv            []string `json:"repo_env,omitempty"`
+	RejectedDirectives []string `json:"rejected_directives,omitempty"`
+
+	// Untrusted is set for pull requests from forks by untrusted users,
+	// which only run once approved.
+	Untrusted  bool   `json:"untrusted,omitempty"`
+	ApprovedBy string `json:"approved_by,omitempty"`
+
+	// Fork is set for pull requests from forks whoever opened them, whose
+	// VMs' egress is restricted like untrusted builds'.
+	Fork bool `json:"fork,omitempty"`
+
+	// FromRepo is set for builds of code known to come from the repo
+	// itself: pushes to the repo, and scheduled and validation runs of its
+	// default clone URL. Only they may be privileged.
+	FromRepo bool `json:"from_repo,omitempty"`
+
+	// LogUrl is the report of the build once it has finished.
+	LogUrl string `json:"log_url,omitempty"`
+
+	// Instances are the instances of the cluster the tests run against, and
+	// Results the results of the tests once they have finished.
+	Instances []*BuildInstance `json:"instances,omitempty"`
+	Results   []*TestResult    `json:"results,omitempty"`
+	Passed    int              `json:"passed,omitempty"`
+	Failed    int              `json:"failed,omitempty"`
+
+	// Usage is the resources used by the build's instances, and Cost their
+	// price.
+	Usage *cluster.Usage `json:"usage,omitempty"`
+	Cost  float64        `json:"cost,omitempty"`
+
+	// Archive is the artifact the full record of the build was moved to
+	// once it was archived, leaving this summary of it.
+	Archive string `json:"archive,omitempty"`
+
+	// Failure is the likely cause of the failure of a finished build, see
+	// FailureSummary.
+	Failure *FailureSummary `json:"failure,omitempty"`
+
+	// Crashes are the QEMU processes of the build's instances which died of
+	// a signal, which make its failure an infrastructure failure.
+	Crashes []*cluster.QEMUCrash `json:"crashes,omitempty"`
+
+	// Teardown is what became of the host resources of the build once its
+	// clusters were shut down, unless they were kept for debugging.
+	Teardown *cluster.TeardownReport `json:"teardown,omitempty"`
+
+	// Annotations are only set when builds are served, see Annotation.
+	Annotations []*Annotation `json:"annotations,omitempty"`
+}
+
+type BuildInstance struct {
+	Role   string `json:"role"`
+	IP     string `json:"ip"`
+	Status string `json:"status,omitempty"`
+}
+
+// buildEnv returns the environment of the build script.
+func (b *Build) buildEnv() []string {
+	return append(append([]string{}, b.Env...), b.RepoEnv...)
+}
+
+// restricted reports whether the egress of the build's VMs is restricted,
+// which it is for all pull requests from forks.
+func (b *Build) restricted() bool {
+	return b.Untrusted || b.Fork
+}
+
+// fromGithub reports whether the build was triggered by GitHub, and so
+// whether results should be reported back to it.
+func (b *Build) fromGithub() bool {
+	return b.Provider == "" || b.Provider == "github"
 }
 
 type Runner struct {
-	bc          cluster.BootConfig
-	events      chan Event
-	dockerFS    string
-	githubToken string
-	s3Bucket    *s3.Bucket
-	networks    map[string]struct{}
-	netMtx      sync.Mutex
-	db          *bolt.DB
-	buildCh     chan struct{}
+	bc        cluster.BootConfig
+	events    chan Event
+	dockerFS  string
+	github    *githubClient
+	store     ArtifactStore
+	networks  map[string]struct{}
+	netMtx    sync.Mutex
+	db        *bolt.DB
+	buildCh   chan struct{}
+	mutexes   *runMutexes
+	providers []provider
+	config    *config.Config
+	builders  chan *pooledBuilder
+	logs      map[string]*buildLog
+	logsMtx   sync.Mutex
+	oauth     *oauth
+	listener  net.Listener
+
+	// running tracks builds so the runner can drain them before updating
+	// or for maintenance.
+	running       sync.WaitGroup
+	draining      bool
+	handedOff     bool
+	drained       bool
+	drainStarted  time.Time
+	drainDeadline time.Time
+	drainMtx      sync.Mutex
+
+	// diskFull pauses new runs while a disk is being pruned.
+	diskFull   bool
+	diskWarned bool
+	diskMtx    sync.Mutex
+
+	// spans are the phases of recent runs, shown by the gantt view.
+	spans    []*phaseSpan
+	spansMtx sync.Mutex
+
+	// checksGithub is authenticated as a GitHub App to create check runs,
+	// which can't be created with a personal token. It is nil if no app is
+	// configured.
+	checksGithub *githubClient
+
+	// ready is closed once the db is open.
+	ready chan struct{}
+
+	// earlyDeliveries are the ids of webhook deliveries received during a
+	// takeover before the db is open, nil once they are recorded in it.
+	earlyDeliveries map[string]struct{}
+	deliveryMtx     sync.Mutex
+
+	// stream serves run events to WebSocket clients, see subscribeEvents.
+	stream *eventStream
+
+	keptBuilders map[string]*cluster.Builder
+	keptMtx      sync.Mutex
+
+	cache *cluster.BuildCache
+
+	// dockerFSMtx guards dockerFS and rootFS once they are replaced by
+	// warm-ups or promotion. warmedFS is the current warmed docker fs, and
+	// staleFS the one it superseded, which is removed by the next warm-up.
+	dockerFSMtx sync.Mutex
+	rootFS      string
+	warmedFS    string
+	staleFS     string
 }
 
 var args *arg.Args
 var maxBuilds = 10
 
+// failureConsoleLines is the number of console lines of each instance sent
+// with the finish event of a failed run.
+const failureConsoleLines = 50
+
 func init() {
-	args = arg.Parse()
 	log.SetFlags(log.Lshortfile)
 }
 
 func main() {
+	// flags are parsed in main rather than init so the tests can run
+	args = arg.Parse()
+	if args.Cleanup {
+		if err := cluster.CleanupOrphans(args.BootConfig, args.DockerFS, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	switch flag.Arg(0) {
+	case "repeat":
+		if err := repeat(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "resume":
+		if err := resume(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "logs":
+		if err := logs(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "dev":
+		if err := dev(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "rerun":
+		if err := rerun(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "update":
+		if err := updateCmd(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "flaky":
+		if err := flaky(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "drain":
+		if err := drainCmd(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "runs":
+		if err := runsCmd(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "images":
+		if err := imagesCmd(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "submit":
+		if err := submit(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "artifacts":
+		if err := artifactsCmd(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "diff":
+		if err := diffCmd(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "setup":
+		if err := setupCmd(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := overrideTemplates(); err != nil {
+		log.Fatal(err)
+	}
+
+	cluster.HandleSignals()
+	defer cluster.CleanupOnPanic()
 	runner := &Runner{
-		bc:       args.BootConfig,
-		events:   make(chan Event, 10),
-		dockerFS: args.DockerFS,
-		networks: make(map[string]struct{}),
-		buildCh:  make(chan struct{}, maxBuilds),
+		events:    make(chan Event, 100),
+		networks:  make(map[string]struct{}),
+		buildCh:   make(chan struct{}, maxBuilds),
+		mutexes:   newRunMutexes(),
+		providers: newProviders(),
+		logs:      make(map[string]*buildLog),
+		ready:     make(chan struct{}),
+		stream:    newEventStream(),
+
+		earlyDeliveries: make(map[string]struct{}),
+
+		keptBuilders: make(map[string]*cluster.Builder),
 	}
 	if err := runner.start(); err != nil {
 		log.Fatal(err)
@@ -67,17 +358,50 @@ func main() {
 }
 
 func (r *Runner) start() error {
-	r.githubToken = os.Getenv("GITHUB_TOKEN")
-	if r.githubToken == "" {
-		return errors.New("GITHUB_TOKEN not set")
+	var err error
+	if r.config, err = args.Config(); err != nil {
+		return err
+	}
+	r.bc = args.BootConfig
+	r.dockerFS = args.DockerFS
+	r.rootFS = r.bc.RootFS
+	if res := r.config.Resources; res != nil {
+		r.bc.Resources = &cluster.ResourcePool{MaxVMs: res.MaxVMs, Memory: res.Memory, Cores: res.Cores, Wait: res.Wait}
 	}
 
-	awsAuth, err := aws.EnvAuth()
+	githubToken := os.Getenv("GITHUB_TOKEN")
+	if githubToken == "" {
+		return errors.New("GITHUB_TOKEN not set")
+	}
+	r.github = &githubClient{token: githubToken}
+	app, err := newGithubApp()
 	if err != nil {
 		return err
 	}
-	r.s3Bucket = s3.New(awsAuth, aws.USEast).Bucket(logBucket)
+	if app != nil {
+		r.checksGithub = &githubClient{app: app}
+	} else {
+		log.Println("GITHUB_APP_ID not set, reporting build phases as commit statuses rather than check runs")
+	}
+	if r.oauth, err = newOAuth(r.config.DashboardTeams); err != nil {
+		return err
+	}
+
+	if r.store, err = newArtifactStore(r.config); err != nil {
+		return err
+	}
 
+	if args.BuildCache != "" {
+		if r.cache, err = cluster.NewBuildCache(args.BuildCache, args.CacheSize); err != nil {
+			return err
+		}
+	}
+	if r.dockerFS != "" {
+		if _, err := cluster.CheckImage(r.dockerFS); err != nil {
+			log.Printf("not using dockerfs %s, rebuilding: %s\n", r.dockerFS, err)
+			r.dockerFS = ""
+		}
+	}
 	if r.dockerFS == "" {
 		var err error
 		bc := r.bc
@@ -92,7 +416,26 @@ func (r *Runner) start() error {
 		defer os.RemoveAll(r.dockerFS)
 	}
 
-	db, err := bolt.Open(args.DBPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	handler := handlers.CombinedLoggingHandler(os.Stdout, r.httpHandler())
+	takeover, err := r.takeOver()
+	if err != nil {
+		return err
+	}
+	served := make(chan error, 1)
+	if takeover {
+		// accept webhooks while the previous runner drains, queueing events
+		// until it releases the db. Nothing served touches the db before
+		// it is open, see seenDelivery and authenticated.
+		go func() { served <- r.serve(handler) }()
+	}
+
+	var db *bolt.DB
+	for {
+		db, err = bolt.Open(args.DBPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+		if err != bolt.ErrTimeout || !takeover {
+			break
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("could not open db: %s", err)
 	}
@@ -100,158 +443,807 @@ func (r *Runner) start() error {
 	defer r.db.Close()
 
 	if err := r.db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("pending-builds"))
-		return err
+		for _, name := range []string{"pending-builds", "master-durations", "resumable-builds", "awaiting-approval", "run-costs", "builds", createdIndex, "export-queue", "master-lock", "run-history", "annotations", "webhook-deliveries", "base-images", "host-crashes", "failure-issues"} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("could not create %s bucket: %s", name, err)
+			}
+		}
+		for name := range r.config.Projects {
+			if _, err := tx.CreateBucketIfNotExists(historyBucket(name)); err != nil {
+				return fmt.Errorf("could not create history bucket of project %s: %s", name, err)
+			}
+		}
+		for name := range buildIndexes {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("could not create %s bucket: %s", name, err)
+			}
+		}
+		return nil
 	}); err != nil {
-		return fmt.Errorf("could not create pending-builds bucket: %s", err)
+		return err
 	}
+	r.recordEarlyDeliveries()
 
 	for i := 0; i < maxBuilds; i++ {
 		r.buildCh <- struct{}{}
 	}
 
+	r.loadPromotedImages()
+	r.startBuilders()
 	if err := r.buildPending(); err != nil {
 		log.Printf("could not build pending builds: %s", err)
 	}
 
 	go r.watchEvents()
+	r.startSchedules()
+	r.startWarmups()
+	r.startUpdates()
+	r.startExports()
+	r.startArchival()
+	r.startDiskWatch()
+	r.startSnapshotGC()
+	close(r.ready)
 
-	http.Handle("/", handlers.CombinedLoggingHandler(os.Stdout, http.HandlerFunc(r.httpEventHandler)))
-	log.Println("Listening on :80...")
-	if err := http.ListenAndServe(":80", nil); err != nil {
-		return fmt.Errorf("ListenAndServer: %s", err)
+	if err := r.serveHandoff(); err != nil {
+		return err
 	}
-	return nil
+	if !takeover {
+		go func() { served <- r.serve(handler) }()
+	}
+	err = <-served
+	if r.isHandedOff() {
+		r.drain()
+		r.closeBuilders()
+		log.Println("running builds drained, exiting")
+		return nil
+	}
+	if r.isDrained() {
+		r.closeBuilders()
+		log.Println("drained for maintenance, exiting")
+		return nil
+	}
+	return fmt.Errorf("ListenAndServe: %s", err)
 }
 
 func (r *Runner) watchEvents() {
 	for event := range r.events {
+		if e, ok := event.(*IssueCommentEvent); ok {
+			r.handleComment(e)
+			continue
+		}
 		if !needsBuild(event) {
 			continue
 		}
-		go func() {
-			b := &Build{
-				Repo:   event.Repo(),
-				Commit: event.Commit(),
+		b := &Build{
+			Repo:     event.Repo(),
+			Commit:   event.Commit(),
+			Branch:   event.Branch(),
+			CloneUrl: event.CloneUrl(),
+			Provider: eventProvider(event),
+			Author:   eventAuthor(event),
+			Project:  r.projectName(event.Repo()),
+		}
+		switch e := event.(type) {
+		case *PushEvent:
+			b.FromRepo = true
+		case *GitlabPushEvent:
+			b.FromRepo = true
+		case *PullRequestEvent:
+			b.PullRequest = e.Number
+			labels := make([]string, len(e.PullRequest.Labels))
+			for i, l := range e.PullRequest.Labels {
+				labels[i] = l.Name
 			}
-			if err := r.build(b); err != nil {
-				log.Printf("build %s failed: %s\n", b.Id, err)
-				return
+			b.Profile = r.config.LabelProfile(labels)
+			b.Features = r.config.FeaturesForLabels(labels)
+			b.Fork = fromFork(e)
+			b.Untrusted = r.untrusted(e)
+		case *GitlabMergeRequestEvent:
+			b.PullRequest = e.ObjectAttributes.Iid
+			b.Untrusted = gitlabUntrusted(e)
+			b.Fork = b.Untrusted
+		case *TriggerEvent:
+			b.Profile = e.Profile
+		}
+		if o := r.config.BranchOverride(b.Branch); o != nil && b.Profile == "" {
+			if o.Skip {
+				log.Printf("skipping build of %s[%s], branch %s matches %q\n", b.Repo, b.Commit, b.Branch, o.Pattern)
+				continue
 			}
-			log.Printf("build %s passed!\n", b.Id)
-		}()
+			for _, profile := range o.Profiles {
+				pb := *b
+				pb.Profile = profile
+				r.startBuild(&pb)
+			}
+			continue
+		}
+		r.startBuild(b)
 	}
 }
 
+// runLabels returns the labels tagging the resources created by b outside
+// of the runner, see cluster.Labels.
+func runLabels(b *Build) cluster.Labels {
+	l := cluster.Labels{"run": b.Id, "repo": b.Repo, "commit": b.Commit}
+	if b.Branch != "" {
+		l["branch"] = b.Branch
+	}
+	if b.Profile != "" {
+		l["profile"] = b.Profile
+	}
+	if b.PullRequest != 0 {
+		l["pull-request"] = strconv.Itoa(b.PullRequest)
+	}
+	if b.Project != "" {
+		l["project"] = b.Project
+	}
+	return l
+}
+
+// projectName returns the name of the project repo belongs to, or "" if it
+// is a flynn component.
+func (r *Runner) projectName(repo string) string {
+	if p := r.config.ProjectOf(repo); p != nil {
+		return p.Name
+	}
+	return ""
+}
+
+// project returns the project of b, or nil if it builds a flynn component.
+func (r *Runner) project(b *Build) *config.Project {
+	return r.config.Projects[b.Project]
+}
+
+// enqueue saves b as pending before running it, so that it is run if the
+// runner restarts before it starts.
+func (r *Runner) enqueue(b *Build) error {
+	b.State = "pending"
+	if b.Queued.IsZero() {
+		b.Queued = time.Now()
+	}
+	if err := r.save(b); err != nil {
+		return err
+	}
+	go r.runBuild(b)
+	return nil
+}
+
+func (r *Runner) runBuild(b *Build) {
+	if !r.track() {
+		// left pending for the updated runner to build
+		log.Printf("runner is draining, deferring build of %s[%s]\n", b.Repo, b.Commit)
+		r.updateStatus(b, "pending")
+		return
+	}
+	defer r.running.Done()
+	if err := r.build(b); err != nil {
+		log.Printf("build %s failed: %s\n", b.Id, err)
+		return
+	}
+	log.Printf("build %s passed!\n", b.Id)
+}
+
 func (r *Runner) build(b *Build) (err error) {
-	r.updateStatus(b, "pending", "")
+	if b.Queued.IsZero() {
+		b.Queued = time.Now()
+	}
+	r.updateStatus(b, "pending")
 
+	logName := fmt.Sprintf("%s-build-%s-%s-%s", b.Repo, b.Id, b.Commit, time.Now().Format("2006-01-02-15-04-05"))
+	b.LogUrl = r.store.URL(logName + ".html")
+	checks := r.newChecks(b, b.LogUrl)
+	m := &manifest{Build: b.Id, Labels: runLabels(b)}
+
+	queued := r.startSpan(b, "queued")
+	r.waitForDisk(b)
 	<-r.buildCh
+	queued()
+	start := time.Now()
+	b.QueueWait = start.Sub(b.Queued)
+	var mutexes []string
 	defer func() {
+		r.mutexes.release(b.Id, mutexes)
 		r.buildCh <- struct{}{}
 	}()
 
-	var buildLog bytes.Buffer
+	buildLog := newBuildLog()
+	r.addLog(b.Id, buildLog)
+	defer r.removeLog(b.Id)
+	fmt.Fprintf(buildLog, "waited %s in the queue\n", b.QueueWait)
+	stopCheckpoints := make(chan struct{})
+	go r.checkpointLog(b, buildLog, logName, stopCheckpoints)
+	var results []*TestResult
+	var lock cluster.Lock
+	var artifactsDir string
+	if runDir, err := cluster.RunDir(r.bc.Workdir, b.Id); err != nil {
+		log.Printf("could not create run dir: %s\n", err)
+	} else if artifactsDir, err = ioutil.TempDir(runDir, "artifacts-"); err != nil {
+		log.Printf("could not create artifacts dir: %s\n", err)
+	}
+	var keep bool
+	var consoleTails map[string][]string
+	var depUpdate *config.DependencyUpdate
+	var runTimedOut int32
 	defer func() {
+		// runs once all of the build's clusters have been shut down
+		if atomic.LoadInt32(&runTimedOut) == 1 && err != nil {
+			err = fmt.Errorf("run timed out: %s", err)
+		}
+		if hookErr := r.runHooks(b, "teardown", "pre", err, buildLog); hookErr != nil && err == nil {
+			err = hookErr
+		}
+		if !keep {
+			report := cluster.Teardown(b.Id)
+			if b.Snapshot != "" {
+				if info, err := os.Stat(b.Snapshot); err == nil {
+					report.Add("snapshot", b.Snapshot, "kept", info.Size())
+				} else {
+					report.Add("snapshot", b.Snapshot, "deleted", 0)
+				}
+			}
+			report.Write(buildLog)
+			b.Teardown = report
+			if leakErr := report.Leaks(); leakErr != nil {
+				log.Printf("build %s: %s\n", b.Id, leakErr)
+				if err == nil {
+					err = &infraError{leakErr}
+				}
+			}
+		}
+		if crashes := r.recordCrashes(b, buildLog); len(crashes) > 0 && err != nil {
+			if _, ok := err.(*infraError); !ok {
+				err = &infraError{fmt.Errorf("QEMU of instance %s died of signal %s: %s", crashes[0].Instance, crashes[0].Signal, err)}
+			}
+		}
 		if err != nil {
-			fmt.Fprintf(&buildLog, "build error: %s\n", err)
+			fmt.Fprintf(buildLog, "build error: %s\n", err)
 		}
-		url := r.uploadToS3(buildLog, b)
-		if err == nil {
-			r.updateStatus(b, "success", url)
+		setOwners(results)
+		b.Results = results
+		b.Duration = time.Since(start)
+		r.recordCost(b, buildLog)
+		lockDiff := r.diffLock(lock, buildLog)
+		close(stopCheckpoints)
+		buildLog.Close()
+		saveTimeline(b.Id, artifactsDir)
+		b.Failure = failureSummary(buildLog.Bytes(), results, consoleTails, artifactsDir, err)
+		artifacts := r.uploadArtifacts(artifactsDir, m, results)
+		artifacts = append(artifacts, r.uploadResults(b, m, results)...)
+		logUrl := r.uploadLog(buildLog.Bytes(), logName, artifacts, lockDiff, b.Failure, m)
+		finish := &RunEvent{Event: "run.finish", Build: b, LogUrl: logUrl}
+		if err != nil {
+			finish.Error = err.Error()
+			finish.Console = consoleTails
+		}
+		for _, res := range results {
+			if res.Failed() {
+				finish.Failed++
+			} else if res.Status != "skip" && res.Status != "miss" {
+				finish.Passed++
+			}
+		}
+		b.Passed, b.Failed = finish.Passed, finish.Failed
+		if owned := failedByOwner(results); len(owned) > 0 {
+			finish.Owners = owned
+		}
+		b.Phase = "done"
+		for _, inst := range b.Instances {
+			inst.Status = "done"
+		}
+		r.recordHistory(b, results, err)
+		checks.cancel()
+		if b.PullRequest != 0 {
+			r.commentResults(b, results, logUrl, err)
+		} else if b.Branch == "master" && err == nil && b.Pins == nil {
+			r.saveMasterDurations(results)
+			r.saveMasterLock(lock)
+		} else if b.Branch == "master" && b.Pins == nil && b.fromGithub() {
+			r.notifyOwners(b, results, logUrl)
+		}
+		if b.PullRequest == 0 && b.Branch == "master" && b.Pins == nil && b.fromGithub() && r.config.FailureIssues != nil {
+			r.fileFailureIssues(b, results)
+		}
+		if depUpdate != nil && b.Pins != nil {
+			r.reportDependencyUpdate(b, depUpdate, results, logUrl, err)
+		}
+		if _, ok := err.(*infraError); ok {
+			r.updateStatus(b, "error")
+		} else if err == nil {
+			r.updateStatus(b, "success")
 		} else {
-			r.updateStatus(b, "failure", url)
+			r.updateStatus(b, "failure")
+		}
+		if b.Image != "" {
+			r.finishValidation(b, err)
+		}
+		r.notifyWebhooks(finish)
+		r.queueExport(b)
+		removeUploadedSource(b)
+		if !keep {
+			cluster.CleanupRun(b.Id)
 		}
+		// the build log is closed by now
+		r.runHooks(b, "teardown", "post", err, os.Stdout)
 	}()
 
-	log.Printf("building %s[%s]\n", b.Repo, b.Commit)
+	var profile *config.Profile
+	if err := r.runPhase(b, "prepare", buildLog, func() error {
+		var err error
+		name := b.Profile
+		if p := r.project(b); p != nil && name == "" {
+			name = p.DefaultProfile
+		}
+		if profile, err = r.config.Profile(name); err != nil {
+			return err
+		}
+		b.RepoEnv, b.RejectedDirectives = nil, nil
+		if rc, err := r.loadRepoConfig(b); err != nil {
+			fmt.Fprintf(buildLog, "ignoring %s: %s\n", config.RepoConfigFile, err)
+		} else if rc != nil {
+			o := r.config.ApplyRepoConfig(profile, rc, b.Profile != "")
+			profile, b.RepoEnv, b.RejectedDirectives = o.Profile, o.Env, o.Rejected
+			fmt.Fprintf(buildLog, "applied %s\n", config.RepoConfigFile)
+			for _, d := range o.Rejected {
+				fmt.Fprintf(buildLog, "rejected %s directive %s\n", config.RepoConfigFile, d)
+			}
+		}
+		if features := profile.Features.Merge(b.Features); len(features) > 0 {
+			p := *profile
+			p.Features = features
+			profile = &p
+			b.Features = features
+			fmt.Fprintf(buildLog, "using feature flags %s\n", features)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(profile.Mutexes) > 0 {
+		// the profile is only known once the repo config is loaded
+		r.waitForMutexes(b, profile.Mutexes, buildLog)
+		mutexes = profile.Mutexes
+		fmt.Fprintf(buildLog, "holding mutexes %s\n", strings.Join(mutexes, ", "))
+	}
+	log.Printf("building %s[%s] with profile %s\n", b.Repo, b.Commit, profile.Name)
+	r.notifyWebhooks(&RunEvent{Event: "run.start", Build: b})
+	if b.Seed == 0 {
+		b.Seed = time.Now().UnixNano()
+	}
+	fmt.Fprintf(buildLog, "using seed %d, trigger a build with this seed to replay it\n", b.Seed)
+	seed := strconv.FormatInt(b.Seed, 10)
 
-	out := io.MultiWriter(os.Stdout, &buildLog)
+	out := io.MultiWriter(os.Stdout, buildLog)
 	repos := map[string]string{b.Repo: b.Commit}
+	project := r.project(b)
+	if project != nil {
+		for repo, ref := range project.Images {
+			repos[repo] = ref
+		}
+	}
+	for repo, ref := range profile.Images {
+		repos[repo] = ref
+	}
+	repos[b.Repo] = b.Commit
+	if profile.DependencyUpdate != nil {
+		depUpdate = profile.DependencyUpdate
+		if err := r.pinDependencies(b, repos, buildLog); err != nil {
+			return err
+		}
+	}
 	bc := r.bc
+	bc.Roles = r.config.Roles
+	bc.BootProfiles = r.config.BootProfiles
+	bc.RootFS = r.baseRootFS()
+	if project != nil {
+		fmt.Fprintf(buildLog, "building project %s\n", project.Name)
+		if project.BuildScript != "" {
+			bc.BuildScript = project.BuildScript
+		}
+		if project.RootFS != "" {
+			bc.RootFS = project.RootFS
+		}
+		if project.Kernel != "" {
+			bc.Kernel = project.Kernel
+		}
+	}
+	if b.Image != "" {
+		img, err := r.loadBaseImage(b.Image)
+		if err != nil {
+			return err
+		}
+		if img.Kind == "rootfs" {
+			bc.RootFS = img.Path
+		}
+		fmt.Fprintf(buildLog, "validating candidate %s %s\n", img.Kind, img.Path)
+	}
+	bc.RunID = b.Id
+	bc.Labels = runLabels(b)
+	bc.Seed = b.Seed
+	bc.ReservedIPs = profile.ReservedIPs
+	if profile.Macvtap != "" {
+		bc.Macvtap = profile.Macvtap
+	}
+	if profile.Placement != "" {
+		bc.Placement = profile.Placement
+	}
+	if t := profile.Timeouts; t != nil {
+		bc.BootTimeout = time.Duration(t.Boot)
+		bc.SSHTimeout = time.Duration(t.SSH)
+		bc.BuildTimeout = time.Duration(t.Build)
+		if t.Run > 0 {
+			timer := time.AfterFunc(time.Duration(t.Run), func() {
+				atomic.StoreInt32(&runTimedOut, 1)
+				fmt.Fprintf(buildLog, "run timed out after %s, shutting down its clusters\n", time.Duration(t.Run))
+				for ip, lines := range cluster.RunConsoleTails(b.Id, failureConsoleLines) {
+					fmt.Fprintf(buildLog, "latest console output of %s:\n%s\n", ip, strings.Join(lines, "\n"))
+				}
+				cluster.ShutdownRun(b.Id)
+			})
+			defer timer.Stop()
+		}
+	}
+	if b.restricted() {
+		bc.RestrictEgress = true
+		bc.EgressAllow = r.config.UntrustedEgress
+	}
 	bc.Network, err = r.allocateNet()
 	if err != nil {
 		return err
 	}
-	defer r.releaseNet(bc.Network)
-	newDockerfs, err := cluster.BuildFlynn(bc, r.dockerFS, repos, out)
-	defer os.RemoveAll(newDockerfs)
-	if err != nil {
-		msg := fmt.Sprintf("could not build flynn: %s\n", err)
-		buildLog.WriteString(msg)
-		return errors.New(msg)
+	defer func() {
+		if !keep {
+			r.releaseNet(bc.Network)
+		}
+	}()
+	if r.config.EphemeralRegistry {
+		dir, err := ioutil.TempDir("", "registry-"+b.Id+"-")
+		if err != nil {
+			return err
+		}
+		if bc.Registry, err = cluster.NewRegistry(dir); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		bc.Registry.Labels = bc.Labels
+		defer bc.Registry.Close()
+	}
+
+	if b.Snapshot != "" {
+		if err := verifySnapshot(b); err != nil {
+			fmt.Fprintf(out, "invalid snapshot %s, rebuilding: %s\n", b.Snapshot, err)
+			removeSnapshot(b.Snapshot)
+			b.Snapshot = ""
+		}
+	}
+	checks.start("build")
+	r.setPhase(b, "building")
+	var newDockerfs string
+	if b.Snapshot != "" {
+		fmt.Fprintf(out, "resuming from snapshot %s\n", b.Snapshot)
+		newDockerfs = b.Snapshot
+	} else {
+		if err = r.runPhase(b, "build", out, func() error {
+			var err error
+			newDockerfs, err = r.buildFlynn(b, bc, repos, out)
+			return err
+		}); err != nil {
+			if r.keptBuilder(b.Id) != nil {
+				keep = true
+			}
+			os.RemoveAll(newDockerfs)
+			msg := fmt.Sprintf("could not build flynn: %s\n", err)
+			io.WriteString(buildLog, msg)
+			checks.finish("build", err)
+			return errors.New(msg)
+		}
+		if err = r.runPhase(b, "snapshot", out, func() error {
+			if snapshot, err := r.saveSnapshot(b, newDockerfs); err != nil {
+				fmt.Fprintf(out, "could not save build snapshot: %s\n", err)
+			} else {
+				b.Snapshot, newDockerfs = snapshot, snapshot
+			}
+			return nil
+		}); err != nil {
+			os.RemoveAll(newDockerfs)
+			checks.finish("build", err)
+			return err
+		}
+	}
+	defer func() {
+		if err != nil && b.Snapshot != "" && checks.failed("bootstrap") {
+			if err := r.saveResumable(b); err == nil {
+				fmt.Fprintf(out, "build snapshot kept, resume from the bootstrap phase with: runner resume %s\n", b.Id)
+				return
+			}
+		}
+		if err == nil {
+			r.publishImage(b, newDockerfs, m, out)
+		}
+		if newDockerfs == b.Snapshot {
+			removeSnapshot(newDockerfs)
+		} else {
+			os.RemoveAll(newDockerfs)
+		}
+	}()
+	checks.finish("build", nil)
+
+	if profile.Kernel != "" {
+		k, rootfs, err := r.config.ResolveKernel(profile.Kernel, bc.RootFS)
+		if err != nil {
+			return err
+		}
+		if rootfs != bc.RootFS {
+			fmt.Fprintf(out, "kernel %s is not known to work with root fs %s, using %s\n", profile.Kernel, bc.RootFS, rootfs)
+		}
+		fmt.Fprintf(out, "booting the cluster with kernel %s (%s)\n", profile.Kernel, k.Kernel)
+		bc.Kernel, bc.Initrd, bc.RootFS = k.Kernel, k.Initrd, rootfs
+	}
+
+	if len(profile.Pipeline) > 0 {
+		// the pipeline's steps are reported as the bootstrap and tests phases
+		checks.start("bootstrap")
+		checks.start("tests")
+		err = r.runPipeline(b, bc, newDockerfs, profile, m, out)
+		checks.finish("bootstrap", err)
+		checks.finish("tests", err)
+		return err
 	}
 
+	roles := clusterRoles(b, profile)
+	onResult := func(res *TestResult) {
+		cluster.RecordEvent(b.Id, "test %s: %s", res.Name, res.StatusText())
+		results = append(results, res)
+		checks.testResult(res)
+	}
+	retry := func() error {
+		return r.retryFailures(b, bc, newDockerfs, roles, profile, results, out, "--artifacts", artifactsDir, "--seed", seed, "--features", profile.Features.String())
+	}
+	onBoot := func(c *cluster.Cluster) {
+		lock = r.lockInputs(c, artifactsDir, out)
+	}
+	// sharded and parallel runs boot their clusters in the test phase
+	if profile.Shards > 1 {
+		return r.runPhase(b, "test", out, func() error {
+			return r.runShards(bc, newDockerfs, roles, profile, checks, out, onResult, retry, onBoot, artifactsDir)
+		})
+	}
+	if profile.Parallelism > 1 {
+		return r.runPhase(b, "test", out, func() error {
+			return r.runParallel(bc, newDockerfs, roles, profile, checks, out, onResult, retry, onBoot, artifactsDir)
+		})
+	}
+
+	checks.start("bootstrap")
+	b.Instances = make([]*BuildInstance, len(roles))
+	for i, role := range roles {
+		b.Instances[i] = &BuildInstance{Role: role}
+	}
+	r.setPhase(b, "booting")
+	c := cluster.New(bc, out)
+	instancesDir := filepath.Join(artifactsDir, "instances")
+	c.OnBootFailure = func(c *cluster.Cluster) { r.collectInstances(c, instancesDir, out) }
+	c.SyslogPath = filepath.Join(instancesDir, "syslog.json")
+	defer func() {
+		if err != nil {
+			consoleTails = c.ConsoleTails(failureConsoleLines)
+		}
+		if err != nil && b.KeepOnFail {
+			keep = true
+			fmt.Fprintf(out, "keeping cluster on %s for debugging\n", bc.Network)
+			return
+		}
+		c.Shutdown()
+	}()
+	if err = r.runPhase(b, "boot-cluster", out, func() error {
+		return c.BootRoles(newDockerfs, roles)
+	}); err != nil {
+		checks.finish("bootstrap", err)
+		return bootError(err)
+	}
+	for i, inst := range c.Instances() {
+		b.Instances[i].IP = inst.IP()
+	}
+	var flynnrc string
+	if err = r.runPhase(b, "bootstrap", out, func() error {
+		var err error
+		if flynnrc, err = createFlynnrc(c); err != nil {
+			return fmt.Errorf("could not create flynnrc: %s", err)
+		}
+		onBoot(c)
+		return nil
+	}); err != nil {
+		c.RemoveCLI()
+		checks.finish("bootstrap", err)
+		return err
+	}
+	defer c.RemoveCLI()
+	checks.finish("bootstrap", nil)
+
+	checks.start("tests")
+	r.setPhase(b, "testing")
+	var completed bool
+	var panicked []int
+	err = r.runPhase(b, "test", out, func() error {
+		restoreArgs, stopRestore := snapshotForRestore(c, profile, out)
+		defer stopRestore()
+		stopChaos := func() {}
+		if profile.Chaos != nil {
+			stopChaos = startChaos(c, profile.Chaos, b.Seed, out)
+		}
+		var err error
+		if profile.Soak != nil {
+			err = runSoak(c, profile.Soak, artifactsDir, out, onResult)
+		} else {
+			completed, err = runTests(flynnrc, profile.TestFilter, time.Duration(profile.Timeout), profile.Timeouts.TestTimeout(), out, onResult, append([]string{"--artifacts", artifactsDir, "--seed", seed, "--features", profile.Features.String()}, restoreArgs...)...)
+		}
+		stopChaos()
+		if panicked = c.GuestPanics(); len(panicked) > 0 {
+			err = fmt.Errorf("guest kernel panic on instances %v", panicked)
+		}
+		return err
+	})
+	collectErr := r.runPhase(b, "collect", out, func() error {
+		r.collectProfiles(c, err, filepath.Join(artifactsDir, "pprof"), out)
+		r.collectInstances(c, instancesDir, out)
+		return nil
+	})
+	if err == errTestTimedOut && profile.Timeouts.RetryOnTestTimeout() {
+		completed = true
+	}
+	if err != nil && completed && len(panicked) == 0 && !b.KeepOnFail {
+		c.Shutdown()
+		err = retry()
+	}
+	if err == nil {
+		err = collectErr
+	}
+	checks.finish("tests", err)
+	return err
+}
+
+// runTests runs the tests binary against the cluster configured in flynnrc,
+// returning whether the suite ran to completion along with its exit error.
+// The suite is killed once it runs for longer than timeout, or a test runs
+// for longer than testTimeout.
+func runTests(flynnrc, filter string, timeout, testTimeout time.Duration, out io.Writer, onResult func(*TestResult), extraArgs ...string) (bool, error) {
 	cmd := exec.Command(
 		args.TestsPath,
-		"--user", r.bc.User,
-		"--rootfs", r.bc.RootFS,
-		"--dockerfs", newDockerfs,
-		"--kernel", r.bc.Kernel,
-		"--cli", args.CLI,
-		"--network", bc.Network,
-		"--nat", r.bc.NatIface,
-		"--debug",
+		append([]string{
+			"--flynnrc", flynnrc,
+			"--cli", args.CLI,
+			"--filter", filter,
+			"--debug",
+		}, extraArgs...)...,
 	)
-	cmd.Stdout = out
+	watcher := &testWatcher{onResult: onResult}
+	cmd.Stdout = io.MultiWriter(out, watcher)
 	cmd.Stderr = out
-	return cmd.Run()
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	// set from the timer and the watchdog goroutine
+	var timedOut, testTimedOut int32
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			fmt.Fprintf(out, "tests timed out after %s, killing\n", timeout)
+			atomic.StoreInt32(&timedOut, 1)
+			cmd.Process.Kill()
+		})
+		defer timer.Stop()
+	}
+	stop := make(chan struct{})
+	if testTimeout > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+				}
+				if name := watcher.timeout(testTimeout); name != "" {
+					fmt.Fprintf(out, "test %s timed out after %s, killing\n", name, testTimeout)
+					atomic.StoreInt32(&testTimedOut, 1)
+					cmd.Process.Kill()
+					return
+				}
+			}
+		}()
+	}
+	err := cmd.Wait()
+	close(stop)
+	if atomic.LoadInt32(&timedOut) == 1 {
+		err = errTestsTimedOut
+	} else if atomic.LoadInt32(&testTimedOut) == 1 {
+		err = errTestTimedOut
+	}
+	return watcher.completed, err
 }
 
-var s3attempts = attempt.Strategy{
-	Min:   5,
-	Total: time.Minute,
-	Delay: time.Second,
+func clusterRoles(b *Build, profile *config.Profile) []string {
+	if b.ClusterSize == 0 && len(profile.Roles) > 0 {
+		return profile.Roles
+	}
+	size := b.ClusterSize
+	if size == 0 {
+		size = profile.ClusterSize
+	}
+	if size == 0 {
+		size = 1
+	}
+	return cluster.WorkerRoles(size)
 }
 
-func (r *Runner) uploadToS3(buildLog bytes.Buffer, b *Build) string {
-	name := fmt.Sprintf("%s-build-%s-%s-%s.txt", b.Repo, b.Id, b.Commit, time.Now().Format("2006-01-02-15-04-05"))
-	url := fmt.Sprintf("https://s3.amazonaws.com/%s/%s", logBucket, name)
-	log.Printf("uploading build log to S3: %s\n", url)
-	if err := s3attempts.Run(func() error {
-		return r.s3Bucket.Put(name, buildLog.Bytes(), "text/plain", "public-read")
-	}); err != nil {
-		log.Printf("failed to upload build output to S3: %s\n", err)
+func createFlynnrc(c *cluster.Cluster) (string, error) {
+	if err := c.InstallCLI(args.CLI); err != nil {
+		return "", err
 	}
-	return url
+	return c.Flynnrc(), nil
 }
 
-func (r *Runner) httpEventHandler(w http.ResponseWriter, req *http.Request) {
-	header, ok := req.Header["X-Github-Event"]
-	if !ok {
-		log.Println("webhook: request missing X-Github-Event header")
-		http.Error(w, "missing X-Github-Event header\n", 400)
-		return
-	}
+var logTemplate = template.Must(template.New("log").Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { background-color: #000000; color: #e5e5e5; }
+.failure { border: 1px solid #cf222e; padding: 0 8px; }
+{{.CSS}}
+</style>
+</head>
+<body>
+{{with .Failure}}<div class="failure">
+<h3>Likely cause: {{.Cause.Kind}} in {{.Cause.Source}}{{if .Cause.Line}} line {{.Cause.Line}}{{end}}</h3>
+<pre>{{or .Cause.Excerpt .Cause.Text}}</pre>
+<table>
+{{range .Clues}}<tr><td>{{.Kind}}</td><td>{{.Source}}{{if .Line}}:{{.Line}}{{end}}</td><td>{{.Text}}</td></tr>
+{{end}}</table>
+</div>
+{{end}}{{if .Artifacts}}<ul>
+{{range .Artifacts}}<li><a href="{{.Url}}">{{.Name}}</a></li>
+{{end}}</ul>
+{{end}}{{if .LockDiff}}<h3>Inputs changed since the last master run</h3>
+<table>
+<tr><th>Input</th><th>Master</th><th>This run</th></tr>
+{{range .LockDiff}}<tr><td>{{.Name}}</td><td>{{or .Old "-"}}</td><td>{{or .New "-"}}</td></tr>
+{{end}}</table>
+{{end}}<pre>{{.Log}}</pre>
+</body>
+</html>
+`[1:]))
 
-	name := strings.Join(header, " ")
-	var event Event
-	switch name {
-	case "push":
-		event = &PushEvent{}
-	case "pull_request":
-		event = &PullRequestEvent{}
-	default:
-		log.Println("webhook: unknown X-Github-Event:", name)
-		http.Error(w, fmt.Sprintf("Unknown X-Github-Event: %s\n", name), 400)
-		return
+// uploadLog uploads the plain text log as a blob, followed by the manifest
+// of the build and the HTML report.
+func (r *Runner) uploadLog(buildLog []byte, name string, artifacts []*Artifact, lockDiff []*cluster.LockChange, failure *FailureSummary, m *manifest) string {
+	var page bytes.Buffer
+	if err := logTemplate.Execute(&page, map[string]interface{}{
+		"Title":     name,
+		"Artifacts": artifacts,
+		"LockDiff":  lockDiff,
+		"Failure":   failure,
+		"CSS":       template.CSS(ansi.CSS),
+		"Log":       template.HTML(ansi.HTML(buildLog)),
+	}); err != nil {
+		log.Printf("failed to render build log: %s\n", err)
 	}
 
-	dec := json.NewDecoder(req.Body)
-	if err := dec.Decode(&event); err != nil && err != io.EOF {
-		log.Println("webhook: error decoding JSON", err)
-		http.Error(w, fmt.Sprintf("invalid JSON payload for %s event", name), 400)
-		return
+	if _, err := r.putBlob(m, "log.txt", bytes.NewReader(ansi.Plain(buildLog)), "text/plain", true); err != nil {
+		log.Printf("failed to upload build log: %s\n", err)
 	}
-	repo := event.Repo()
-	if _, ok := util.Repos[repo]; !ok {
-		log.Println("webhook: unknown repo", repo)
-		http.Error(w, fmt.Sprintf("unknown repo %s", repo), 400)
-		return
+	r.uploadManifest(m, name)
+	return r.putArtifact(name+".html", page.Bytes(), "text/html", m.Labels)
+}
+
+func (r *Runner) putArtifact(name string, data []byte, contentType string, labels cluster.Labels) string {
+	url := r.store.URL(name)
+	log.Printf("uploading build output: %s\n", url)
+	if err := r.store.Put(name, bytes.NewReader(data), contentType, true, labels); err != nil {
+		log.Printf("failed to upload build output: %s\n", err)
 	}
-	logEvent(event)
-	r.events <- event
-	io.WriteString(w, "ok\n")
+	return url
 }
 
 func logEvent(event Event) {
@@ -275,6 +1267,31 @@ func logEvent(event Event) {
 			e.Action,
 			e.Sender.Login,
 		)
+	case *GitlabPushEvent:
+		e := event.(*GitlabPushEvent)
+		log.Printf(
+			"received gitlab push of %s[%s] by %s: %s => %s\n",
+			e.Repo(),
+			e.Ref,
+			e.UserName,
+			e.Before,
+			e.After,
+		)
+	case *GitlabMergeRequestEvent:
+		e := event.(*GitlabMergeRequestEvent)
+		log.Printf(
+			"gitlab merge request %s/%d %s by %s\n",
+			e.Repo(),
+			e.ObjectAttributes.Iid,
+			e.ObjectAttributes.Action,
+			e.User.Username,
+		)
+	case *TriggerEvent:
+		e := event.(*TriggerEvent)
+		log.Printf("received trigger of %s[%s] from %s\n", e.Repo(), e.Ref, e.Url)
+	case *IssueCommentEvent:
+		e := event.(*IssueCommentEvent)
+		log.Printf("comment %s on %s/%d by %s\n", e.Action, e.Repo(), e.Issue.Number, e.Comment.User.Login)
 	}
 }
 
@@ -282,62 +1299,37 @@ func needsBuild(event Event) bool {
 	if e, ok := event.(*PullRequestEvent); ok && e.Action == "closed" {
 		return false
 	}
+	if e, ok := event.(*GitlabMergeRequestEvent); ok && (e.ObjectAttributes.Action == "close" || e.ObjectAttributes.Action == "merge") {
+		return false
+	}
 	return true
 }
 
-type Status struct {
-	State       string `json:"state"`
-	TargetUrl   string `json:"target_url,omitempty"`
-	Description string `json:"description,omitempty"`
-	Context     string `json:"context,omitempty"`
-}
-
-var descriptions = map[string]string{
-	"pending": "The Flynn CI build is in progress",
-	"success": "The Flynn CI build passed",
-	"failure": "The Flynn CI build failed",
-}
-
-func (r *Runner) updateStatus(b *Build, state, targetUrl string) {
-	go func() {
-		log.Printf("updateStatus: %s %s[%s]\n", state, b.Repo, b.Commit)
-
-		b.State = state
-		if err := r.save(b); err != nil {
-			log.Printf("updateStatus: could not save build: %s", err)
-		}
+func (r *Runner) updateStatus(b *Build, state string) {
+	log.Printf("updateStatus: %s %s[%s]\n", state, b.Repo, b.Commit)
 
-		url := fmt.Sprintf("https://api.github.com/repos/flynn/%s/statuses/%s", b.Repo, b.Commit)
-		status := Status{
+	b.State = state
+	if err := r.save(b); err != nil {
+		log.Printf("updateStatus: could not save build: %s", err)
+	}
+	if b.fromGithub() {
+		status := &CommitStatus{
 			State:       state,
-			TargetUrl:   targetUrl,
-			Description: descriptions[state],
-			Context:     "flynn",
+			TargetUrl:   b.LogUrl,
+			Description: statusDescriptions[state],
+			Context:     "flynn/ci",
 		}
-		body := &bytes.Buffer{}
-		if err := json.NewEncoder(body).Encode(status); err != nil {
-			log.Printf("updateStatus: could not encode status: %+v\n", status)
-			return
+		if err := r.github.createStatus(b.Repo, b.Commit, status); err != nil {
+			log.Printf("updateStatus: could not create commit status: %s\n", err)
 		}
+	}
+}
 
-		req, err := http.NewRequest("POST", url, body)
-		if err != nil {
-			log.Printf("updateStatus: could not create request: %s\n", err)
-			return
-		}
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "token "+r.githubToken)
-
-		res, err := http.DefaultClient.Do(req)
-		defer res.Body.Close()
-		if err != nil {
-			log.Printf("updateStatus: could not send request: %s\n", err)
-			return
-		}
-		if res.StatusCode != 201 {
-			log.Printf("updateStatus: request failed: %d\n", res.StatusCode)
-		}
-	}()
+var statusDescriptions = map[string]string{
+	"pending": "The build is pending",
+	"success": "The build passed",
+	"failure": "The build failed",
+	"error":   "The build errored",
 }
 
 func (r *Runner) allocateNet() (string, error) {
@@ -375,29 +1367,53 @@ func (r *Runner) buildPending() error {
 		})
 	})
 
+	// restart the queue in the order it was in
+	sort.Sort(buildsByQueued(pending))
+	if len(pending) > 0 {
+		log.Printf("restarting %d queued builds\n", len(pending))
+	}
 	for _, b := range pending {
-		go func() {
-			if err := r.build(b); err != nil {
-				log.Printf("build %s failed: %s\n", b.Id, err)
-				return
-			}
-			log.Printf("build %s passed!\n", b.Id)
-		}()
+		go r.runBuild(b)
 	}
 	return nil
 }
 
+type buildsByQueued []*Build
+
+func (b buildsByQueued) Len() int           { return len(b) }
+func (b buildsByQueued) Less(i, j int) bool { return b[i].Queued.Before(b[j].Queued) }
+func (b buildsByQueued) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// save records b, keeping it in pending-builds while it is pending so that
+// it is built if the runner restarts.
 func (r *Runner) save(b *Build) error {
 	if b.Id == "" {
 		b.Id = util.RandomString(8)
 	}
+	if b.Created.IsZero() {
+		b.Created = time.Now()
+	}
+	val, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
 	return r.db.Update(func(tx *bolt.Tx) error {
+		builds := tx.Bucket([]byte("builds"))
+		var old *Build
+		if v := builds.Get([]byte(b.Id)); v != nil {
+			old = &Build{}
+			if err := json.Unmarshal(v, old); err != nil {
+				old = nil
+			}
+		}
+		if err := indexBuild(tx, old, b); err != nil {
+			return err
+		}
+		if err := builds.Put([]byte(b.Id), val); err != nil {
+			return err
+		}
 		bkt := tx.Bucket([]byte("pending-builds"))
 		if b.State == "pending" {
-			val, err := json.Marshal(b)
-			if err != nil {
-				return err
-			}
 			return bkt.Put([]byte(b.Id), val)
 		} else {
 			return bkt.Delete([]byte(b.Id))
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// builds are indexed by creation time, and by project, branch, author and
+// state followed by creation time, so that listing the latest builds
+// matching a filter doesn't decode every build ever run.
+var buildIndexes = map[string]func(*Build) string{
+	"builds-by-project": func(b *Build) string { return b.Project },
+	"builds-by-branch":  func(b *Build) string { return b.Branch },
+	"builds-by-author":  func(b *Build) string { return b.Author },
+	"builds-by-state":   func(b *Build) string { return b.State },
+}
+
+const createdIndex = "builds-by-created"
+
+// createdKey is the sortable creation time used in index keys.
+func createdKey(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+func indexKey(prefix string, b *Build) []byte {
+	return []byte(prefix + createdKey(b.Created) + "\x00" + b.Id)
+}
+
+func indexPrefix(value string) string {
+	return value + "\x00"
+}
+
+// indexBuild replaces the index entries of old, the previously saved
+// version of b if any, with those of b.
+func indexBuild(tx *bolt.Tx, old, b *Build) error {
+	if old != nil {
+		if err := tx.Bucket([]byte(createdIndex)).Delete(indexKey("", old)); err != nil {
+			return err
+		}
+		for name, field := range buildIndexes {
+			if err := tx.Bucket([]byte(name)).Delete(indexKey(indexPrefix(field(old)), old)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.Bucket([]byte(createdIndex)).Put(indexKey("", b), []byte(b.Id)); err != nil {
+		return err
+	}
+	for name, field := range buildIndexes {
+		if err := tx.Bucket([]byte(name)).Put(indexKey(indexPrefix(field(b)), b), []byte(b.Id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildQuery filters, sorts and paginates builds.
+type buildQuery struct {
+	Project     string
+	Repo        string
+	Branch      string
+	Author      string
+	State       string
+	Since       time.Time
+	Until       time.Time
+	MinDuration time.Duration
+	MaxDuration time.Duration
+
+	// Sort is one of created and duration, descending unless Ascending.
+	Sort      string
+	Ascending bool
+
+	Offset int
+	Limit  int
+}
+
+var maxListLimit = 500
+
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+func parseBuildQuery(req *http.Request) (*buildQuery, error) {
+	q := &buildQuery{
+		Project: req.FormValue("project"),
+		Repo:    req.FormValue("repo"),
+		Branch:  req.FormValue("branch"),
+		Author:  req.FormValue("author"),
+		State:   req.FormValue("state"),
+		Sort:    req.FormValue("sort"),
+		Limit:   50,
+	}
+	var err error
+	if s := req.FormValue("since"); s != "" {
+		if q.Since, err = parseTime(s); err != nil {
+			return nil, fmt.Errorf("invalid since: %s", err)
+		}
+	}
+	if s := req.FormValue("until"); s != "" {
+		if q.Until, err = parseTime(s); err != nil {
+			return nil, fmt.Errorf("invalid until: %s", err)
+		}
+	}
+	if s := req.FormValue("min_duration"); s != "" {
+		if q.MinDuration, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("invalid min_duration: %s", err)
+		}
+	}
+	if s := req.FormValue("max_duration"); s != "" {
+		if q.MaxDuration, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("invalid max_duration: %s", err)
+		}
+	}
+	if len(q.Sort) > 0 && q.Sort[0] == '-' {
+		q.Sort = q.Sort[1:]
+	} else if q.Sort != "" {
+		q.Ascending = true
+	}
+	if q.Sort == "" {
+		q.Sort = "created"
+	}
+	if q.Sort != "created" && q.Sort != "duration" {
+		return nil, fmt.Errorf("invalid sort %q, expected created or duration", q.Sort)
+	}
+	if s := req.FormValue("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 1 || q.Limit > maxListLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+	}
+	if s := req.FormValue("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil || q.Offset < 0 {
+			return nil, fmt.Errorf("invalid offset %q", s)
+		}
+	}
+	return q, nil
+}
+
+func (q *buildQuery) match(b *Build) bool {
+	d := b.Duration
+	return (q.Project == "" || b.Project == q.Project) &&
+		(q.Repo == "" || b.Repo == q.Repo) &&
+		(q.Branch == "" || b.Branch == q.Branch) &&
+		(q.Author == "" || b.Author == q.Author) &&
+		(q.State == "" || b.State == q.State) &&
+		(q.MinDuration == 0 || d >= q.MinDuration) &&
+		(q.MaxDuration == 0 || d <= q.MaxDuration)
+}
+
+// index returns the index bucket and key prefix to scan for q.
+func (q *buildQuery) index() (string, string) {
+	switch {
+	case q.Project != "":
+		return "builds-by-project", indexPrefix(q.Project)
+	case q.Branch != "":
+		return "builds-by-branch", indexPrefix(q.Branch)
+	case q.Author != "":
+		return "builds-by-author", indexPrefix(q.Author)
+	case q.State != "":
+		return "builds-by-state", indexPrefix(q.State)
+	}
+	return createdIndex, ""
+}
+
+type buildsByDuration []*Build
+
+func (s buildsByDuration) Len() int           { return len(s) }
+func (s buildsByDuration) Less(i, j int) bool { return s[i].Duration < s[j].Duration }
+func (s buildsByDuration) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// findBuilds returns the page of builds matching q, and whether there are
+// more.
+func (r *Runner) findBuilds(q *buildQuery) ([]*Build, bool, error) {
+	name, prefix := q.index()
+	lower := []byte(prefix)
+	if !q.Since.IsZero() {
+		lower = []byte(prefix + createdKey(q.Since))
+	}
+	upper := []byte(prefix + "\xff")
+	if !q.Until.IsZero() {
+		upper = []byte(prefix + createdKey(q.Until))
+	}
+	// builds are scanned in creation order, so only sorting by duration
+	// needs every matching build
+	want := q.Offset + q.Limit + 1
+	if q.Sort != "created" {
+		want = -1
+	}
+
+	var builds []*Build
+	err := r.db.View(func(tx *bolt.Tx) error {
+		all := tx.Bucket([]byte("builds"))
+		c := tx.Bucket([]byte(name)).Cursor()
+		var k, id []byte
+		if q.Ascending {
+			k, id = c.Seek(lower)
+		} else if k, id = c.Seek(upper); k == nil || bytes.Compare(k, upper) >= 0 {
+			k, id = c.Prev()
+		}
+		for k != nil && bytes.Compare(k, lower) >= 0 && bytes.Compare(k, upper) < 0 {
+			if val := all.Get(id); val != nil {
+				b := &Build{}
+				if err := json.Unmarshal(val, b); err != nil {
+					return err
+				}
+				if q.match(b) {
+					builds = append(builds, b)
+					if len(builds) == want {
+						return nil
+					}
+				}
+			}
+			if q.Ascending {
+				k, id = c.Next()
+			} else {
+				k, id = c.Prev()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if q.Sort == "duration" {
+		if q.Ascending {
+			sort.Stable(buildsByDuration(builds))
+		} else {
+			sort.Stable(sort.Reverse(buildsByDuration(builds)))
+		}
+	}
+	if q.Offset >= len(builds) {
+		return []*Build{}, false, nil
+	}
+	builds = builds[q.Offset:]
+	if len(builds) > q.Limit {
+		return builds[:q.Limit], true, nil
+	}
+	return builds, false, nil
+}
+
+type buildList struct {
+	Builds []*Build `json:"builds"`
+
+	// NextOffset is the offset of the next page, if there is one.
+	NextOffset int `json:"next_offset,omitempty"`
+}
+
+// listBuilds handles GET /builds, which takes the repo, branch, author and
+// state filters, since and until dates, min_duration and max_duration, sort
+// (created or duration, prefixed with - for descending order, the default
+// being -created), limit and offset.
+func (r *Runner) listBuilds(w http.ResponseWriter, req *http.Request) {
+	q, err := parseBuildQuery(req)
+	if err != nil {
+		http.Error(w, err.Error()+"\n", 400)
+		return
+	}
+	builds, more, err := r.findBuilds(q)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not list builds: %s\n", err), 500)
+		return
+	}
+	r.loadAnnotations(builds...)
+	list := &buildList{Builds: builds}
+	if more {
+		list.NextOffset = q.Offset + q.Limit
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/flynn/flynn-test/config"
+)
+
+// startSchedules periodically triggers the builds defined in the config
+// schedules.
+func (r *Runner) startSchedules() {
+	for _, s := range r.config.Schedules {
+		go r.runSchedule(s)
+	}
+}
+
+func (r *Runner) runSchedule(s *config.Schedule) {
+	for range time.Tick(time.Duration(s.Interval)) {
+		log.Printf("scheduled %s build of %s[%s]\n", s.Profile, s.Repo, s.Ref)
+		go r.runBuild(&Build{
+			Repo:     s.Repo,
+			Commit:   s.Ref,
+			Branch:   s.Ref,
+			Provider: "schedule",
+			Profile:  s.Profile,
+			Project:  r.projectName(s.Repo),
+			FromRepo: true,
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// privileged reports whether b is a trusted build of master from the repo
+// itself, which may use every secret and publish its image. The branch name
+// alone is no proof, as a fork's branch may be called master too.
+func (b *Build) privileged() bool {
+	return b.FromRepo && !b.Untrusted && b.PullRequest == 0 && b.Branch == "master"
+}
+
+// secretEnv returns the secrets b may use as KEY=VALUE variables for the
+// build script, reading them from the secrets dir. Untrusted builds get no
+// secrets, and secrets marked master_only are only given to privileged
+// builds. Builds of a project only get the project's secrets, which are
+// read from its subdirectory of the secrets dir.
+func (r *Runner) secretEnv(b *Build, out io.Writer) ([]string, error) {
+	var env []string
+	var withheld []string
+	secrets, dir := r.config.Secrets, args.SecretsDir
+	if p := r.project(b); p != nil {
+		secrets, dir = p.Secrets, filepath.Join(args.SecretsDir, p.Name)
+	}
+	for _, s := range secrets {
+		if b.Untrusted || s.MasterOnly && !b.privileged() {
+			withheld = append(withheld, s.Name)
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, s.Name))
+		if err != nil {
+			return nil, fmt.Errorf("could not read secret %s: %s", s.Name, err)
+		}
+		env = append(env, s.EnvName()+"="+string(bytes.TrimRight(data, "\r\n")))
+	}
+	if len(withheld) > 0 {
+		fmt.Fprintf(out, "withholding secrets from this build: %s\n", strings.Join(withheld, ", "))
+	}
+	return env, nil
+}
+
+// publishImage uploads the image built by a passing privileged build if image
+// publishing is enabled.
+func (r *Runner) publishImage(b *Build, image string, m *manifest, out io.Writer) {
+	if !r.config.PublishImages {
+		return
+	}
+	if !b.privileged() {
+		fmt.Fprintln(out, "not publishing the image of an unprivileged build")
+		return
+	}
+	url, err := r.uploadImage(b, image, "", m)
+	if err != nil {
+		fmt.Fprintf(out, "could not publish image: %s\n", err)
+		return
+	}
+	fmt.Fprintf(out, "published image to %s\n", url)
+}
+
+// uploadImage uploads image as the image of b, with suffix appended to its
+// name if set, returning its URL.
+func (r *Runner) uploadImage(b *Build, image, suffix string, m *manifest) (string, error) {
+	name := fmt.Sprintf("images/%s-%s", b.Repo, b.Commit)
+	if suffix != "" {
+		name += "-" + suffix
+	}
+	return r.uploadPrivate(m, name+".img", image)
+}
+
+// uploadPrivate uploads the file at path as the private artifact name,
+// returning its URL.
+func (r *Runner) uploadPrivate(m *manifest, name, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return r.putBlob(m, name, f, "application/octet-stream", false)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/flynn/flynn-test/arg"
+	"github.com/flynn/flynn-test/config"
+)
+
+func TestPrivileged(t *testing.T) {
+	master := Build{FromRepo: true, Branch: "master"}
+	for _, test := range []struct {
+		name       string
+		build      Build
+		privileged bool
+	}{
+		{"master push", master, true},
+		{"other branch", Build{FromRepo: true, Branch: "feature"}, false},
+		{"fork branch called master", Build{Branch: "master", CloneUrl: "https://github.com/someone/flynn.git"}, false},
+		{"manual build of master", Build{Branch: "master", Provider: "manual"}, false},
+		{"pull request from master", Build{FromRepo: true, Branch: "master", PullRequest: 1}, false},
+		{"untrusted", Build{FromRepo: true, Branch: "master", Untrusted: true}, false},
+	} {
+		if p := test.build.privileged(); p != test.privileged {
+			t.Errorf("%s: privileged returned %t", test.name, p)
+		}
+	}
+}
+
+func TestSecretEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runner-secrets-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, value := range map[string]string{"token": "t0ken\n", "registry": "r3gistry"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(a *arg.Args) { args = a }(args)
+	args = &arg.Args{SecretsDir: dir}
+	r := &Runner{config: &config.Config{Secrets: []*config.Secret{
+		{Name: "token", Env: "TOKEN"},
+		{Name: "registry", MasterOnly: true},
+	}}}
+	for _, test := range []struct {
+		name  string
+		build Build
+		env   []string
+	}{
+		{"privileged", Build{FromRepo: true, Branch: "master"}, []string{"TOKEN=t0ken", "registry=r3gistry"}},
+		{"unprivileged", Build{FromRepo: true, Branch: "feature"}, []string{"TOKEN=t0ken"}},
+		{"untrusted", Build{Branch: "master", Untrusted: true}, nil},
+	} {
+		env, err := r.secretEnv(&test.build, ioutil.Discard)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !reflect.DeepEqual(env, test.env) {
+			t.Errorf("%s: got %q, expected %q", test.name, env, test.env)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/flynn/flynn-test/assets"
+)
+
+// setupCmd provisions the host to run the runner as a service with the
+// scripts embedded in the runner, installing the runner itself and a config
+// file, so deploying to a new host is copying the binary and the config:
+//
+//	runner setup [--config config.json]
+func setupCmd(cmdArgs []string) error {
+	fs := flag.NewFlagSet("setup", flag.ExitOnError)
+	configPath := fs.String("config", "", "config file to install for the service")
+	fs.Parse(cmdArgs)
+	if fs.NArg() != 0 {
+		return errors.New("usage: runner setup [--config FILE]")
+	}
+	exe, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return err
+	}
+	env := append(os.Environ(), "FLYNN_TEST_RUNNER_BIN="+exe)
+	if *configPath != "" {
+		path, err := filepath.Abs(*configPath)
+		if err != nil {
+			return err
+		}
+		env = append(env, "FLYNN_TEST_CONFIG="+path)
+	}
+	dir, err := ioutil.TempDir("", "flynn-test-setup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := assets.Extract(dir); err != nil {
+		return fmt.Errorf("could not extract assets: %s", err)
+	}
+	cmd := exec.Command(filepath.Join(dir, "scripts", "setup.sh"))
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
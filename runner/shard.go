@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/config"
+)
+
+// runShards boots a cluster per shard in parallel, then runs a slice of the
+// suite against each cluster. Only the first shard uses bc.Network, the rest
+// allocate their own. onBoot is called with the first cluster once they have
+// all booted. If the suite completes with failures the clusters are
+// shut down and retry is called.
+func (r *Runner) runShards(bc cluster.BootConfig, dockerfs string, roles []string, profile *config.Profile, checks *checks, out io.Writer, onResult func(*TestResult), retry func() error, onBoot func(*cluster.Cluster), artifactsDir string) error {
+	n := profile.Shards
+	clusters := make([]*cluster.Cluster, n)
+	flynnrcs := make([]string, n)
+	outs := make([]io.Writer, n)
+	var networks []string
+	defer func() {
+		for i, c := range clusters {
+			if c == nil {
+				continue
+			}
+			c.Shutdown()
+			os.RemoveAll(flynnrcs[i])
+		}
+		for _, network := range networks {
+			r.releaseNet(network)
+		}
+	}()
+
+	var outMtx sync.Mutex
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	checks.start("bootstrap")
+	for i := 0; i < n; i++ {
+		outs[i] = &prefixWriter{w: out, mtx: &outMtx, prefix: fmt.Sprintf("[shard %d] ", i)}
+		shardBC := bc
+		if i > 0 {
+			network, err := r.allocateNet()
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			networks = append(networks, network)
+			shardBC.Network = network
+		}
+		clusters[i] = cluster.New(shardBC, outs[i])
+		instancesDir := filepath.Join(artifactsDir, fmt.Sprintf("instances-shard-%d", i))
+		out := outs[i]
+		clusters[i].OnBootFailure = func(c *cluster.Cluster) { r.collectInstances(c, instancesDir, out) }
+		clusters[i].SyslogPath = filepath.Join(instancesDir, "syslog.json")
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := clusters[i].BootRoles(dockerfs, roles); err != nil {
+				errs[i] = bootError(err)
+				return
+			}
+			var err error
+			if flynnrcs[i], err = createFlynnrc(clusters[i]); err != nil {
+				errs[i] = fmt.Errorf("could not create flynnrc: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			err = fmt.Errorf("shard %d: %s", i, err)
+			checks.finish("bootstrap", err)
+			return err
+		}
+	}
+	checks.finish("bootstrap", nil)
+	onBoot(clusters[0])
+
+	checks.start("tests")
+	var resultMtx sync.Mutex
+	completed := true
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shard := fmt.Sprintf("%d/%d", i, n)
+			restoreArgs, stopRestore := snapshotForRestore(clusters[i], profile, outs[i])
+			defer stopRestore()
+			if profile.Chaos != nil {
+				defer startChaos(clusters[i], profile.Chaos, bc.Seed, outs[i])()
+			}
+			done, err := runTests(flynnrcs[i], profile.TestFilter, time.Duration(profile.Timeout), profile.Timeouts.TestTimeout(), outs[i], func(res *TestResult) {
+				resultMtx.Lock()
+				defer resultMtx.Unlock()
+				onResult(res)
+			}, append([]string{"--shard", shard, "--artifacts", artifactsDir, "--seed", strconv.FormatInt(bc.Seed, 10), "--features", profile.Features.String()}, restoreArgs...)...)
+			resultMtx.Lock()
+			defer resultMtx.Unlock()
+			errs[i] = err
+			completed = completed && done
+		}(i)
+	}
+	wg.Wait()
+
+	for i, c := range clusters {
+		r.collectProfiles(c, errs[i], filepath.Join(artifactsDir, fmt.Sprintf("pprof-shard-%d", i)), outs[i])
+		r.collectInstances(c, filepath.Join(artifactsDir, fmt.Sprintf("instances-shard-%d", i)), outs[i])
+	}
+	var err error
+	for i, c := range clusters {
+		if panicked := c.GuestPanics(); len(panicked) > 0 {
+			err = fmt.Errorf("guest kernel panic on shard %d instances %v", i, panicked)
+			checks.finish("tests", err)
+			return err
+		}
+		if errs[i] != nil {
+			err = fmt.Errorf("shard %d: %s", i, errs[i])
+		}
+	}
+	if err != nil && completed {
+		for _, c := range clusters {
+			c.Shutdown()
+		}
+		err = retry()
+	}
+	checks.finish("tests", err)
+	return err
+}
+
+// prefixWriter prefixes each line written to w, and serializes writes from
+// multiple prefixWriters sharing mtx.
+type prefixWriter struct {
+	w      io.Writer
+	mtx    *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if _, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.buf[:i]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/config"
+	"github.com/flynn/flynn-test/util"
+)
+
+// soakSample is a health check of a soaking cluster.
+type soakSample struct {
+	Time       time.Time                 `json:"time"`
+	Error      string                    `json:"error,omitempty"`
+	Components []*cluster.ComponentStats `json:"components"`
+}
+
+// runSoak keeps c running for the soak's duration, sampling its health every
+// interval, and reports the checks as the results of the SoakSuite. The
+// samples are saved as soak.json in dir.
+func runSoak(c *cluster.Cluster, conf *config.SoakConfig, dir string, out io.Writer, onResult func(*TestResult)) error {
+	start, began := time.Now(), util.Now()
+	var samples []*soakSample
+	defer func() {
+		if data, err := json.MarshalIndent(samples, "", "  "); err == nil {
+			ioutil.WriteFile(filepath.Join(dir, "soak.json"), data, 0644)
+		}
+	}()
+	var healthErr error
+	for {
+		s := sampleSoak(c, conf)
+		samples = append(samples, s)
+		var memory int64
+		var restarts int
+		for _, cs := range s.Components {
+			memory += cs.Memory
+			restarts += cs.Restarts
+		}
+		fmt.Fprintf(out, "soak %s: %d components using %dMB, %d restarts\n", truncate(time.Since(start)), len(s.Components), memory>>20, restarts)
+		if s.Error != "" {
+			fmt.Fprintf(out, "soak health check failed: %s\n", s.Error)
+			healthErr = fmt.Errorf("health check failed after %s: %s", truncate(time.Since(start)), s.Error)
+			break
+		}
+		if began.Elapsed()+time.Duration(conf.Interval) > time.Duration(conf.Duration) {
+			break
+		}
+		time.Sleep(time.Duration(conf.Interval))
+	}
+
+	results := []*TestResult{
+		soakResult("TestHealth", start, healthErr),
+		soakResult("TestMemoryGrowth", start, checkMemoryGrowth(samples, conf.MaxMemoryGrowth)),
+		soakResult("TestRestarts", start, checkRestarts(samples, conf.MaxRestarts)),
+	}
+	var failed []string
+	for _, res := range results {
+		onResult(res)
+		if res.Failed() {
+			failed = append(failed, res.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("soak failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+var soakAttempts = util.Strategy{
+	Min:   3,
+	Total: time.Minute,
+	Delay: 5 * time.Second,
+}
+
+// sampleSoak checks that the controller is serving, runs the load script and
+// records the stats of the cluster's components.
+func sampleSoak(c *cluster.Cluster, conf *config.SoakConfig) *soakSample {
+	s := &soakSample{Time: time.Now()}
+	err := soakAttempts.Run(func() error {
+		out, err := c.FlynnCLI("apps")
+		if err != nil {
+			return fmt.Errorf("flynn apps: %s: %s", err, out)
+		}
+		return nil
+	})
+	if err == nil && conf.Load != "" {
+		var out bytes.Buffer
+		if err = c.Instances()[0].Run(conf.Load, soakAttempts, &out, &out); err != nil {
+			err = fmt.Errorf("load script: %s: %s", err, out.String())
+		}
+	}
+	if err == nil {
+		s.Components, err = c.ComponentStats()
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// checkMemoryGrowth fails if a component's memory grew by more than max
+// times its first sample.
+func checkMemoryGrowth(samples []*soakSample, max float64) error {
+	if max == 0 || len(samples) < 2 {
+		return nil
+	}
+	first := soakComponents(samples[0])
+	var grown []string
+	for _, cs := range samples[len(samples)-1].Components {
+		f, ok := first[cs.Instance+"/"+cs.Component]
+		if !ok || f.Memory == 0 {
+			continue
+		}
+		if growth := float64(cs.Memory) / float64(f.Memory); growth > max {
+			grown = append(grown, fmt.Sprintf("%s on %s grew %.1fx from %dMB to %dMB", cs.Component, cs.Instance, growth, f.Memory>>20, cs.Memory>>20))
+		}
+	}
+	if len(grown) > 0 {
+		return fmt.Errorf("memory grew by more than %.1fx:\n%s", max, strings.Join(grown, "\n"))
+	}
+	return nil
+}
+
+// checkRestarts fails if a component restarted more than max times since
+// the first sample.
+func checkRestarts(samples []*soakSample, max int) error {
+	if len(samples) < 2 {
+		return nil
+	}
+	first := soakComponents(samples[0])
+	var restarted []string
+	for _, cs := range samples[len(samples)-1].Components {
+		n := cs.Restarts
+		if f, ok := first[cs.Instance+"/"+cs.Component]; ok {
+			n -= f.Restarts
+		}
+		if n > max {
+			restarted = append(restarted, fmt.Sprintf("%s on %s restarted %d times", cs.Component, cs.Instance, n))
+		}
+	}
+	if len(restarted) > 0 {
+		return fmt.Errorf("components restarted more than %d times:\n%s", max, strings.Join(restarted, "\n"))
+	}
+	return nil
+}
+
+func soakComponents(s *soakSample) map[string]*cluster.ComponentStats {
+	components := make(map[string]*cluster.ComponentStats, len(s.Components))
+	for _, cs := range s.Components {
+		components[cs.Instance+"/"+cs.Component] = cs
+	}
+	return components
+}
+
+func soakResult(name string, start time.Time, err error) *TestResult {
+	res := &TestResult{
+		Name:     "SoakSuite." + name,
+		File:     "soak",
+		Status:   "pass",
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		res.Status = "fail"
+		res.Output = err.Error() + "\n"
+	}
+	return res
+}
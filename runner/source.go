@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// sourcesDir is where source tarballs uploaded to POST /builds are kept
+// until their builds finish.
+func sourcesDir() string {
+	return filepath.Join(filepath.Dir(args.DBPath), "sources")
+}
+
+// saveSource saves the source tarball uploaded with a build request,
+// returning its path, or an empty path if there is none.
+func saveSource(req *http.Request) (string, error) {
+	src, _, err := req.FormFile("source")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	if err := os.MkdirAll(sourcesDir(), 0755); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(sourcesDir(), "source-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, src); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// removeUploadedSource removes the source tarball of b once it has been
+// built if it was uploaded, rather than being a path on the runner host.
+func removeUploadedSource(b *Build) {
+	if b.Source != "" && filepath.Dir(b.Source) == sourcesDir() {
+		os.Remove(b.Source)
+	}
+}
+
+// submit triggers a run of a local checkout, uncommitted changes included,
+// or of a gzipped tarball of one, by uploading it to the runner:
+//
+//	runner submit [--url http://localhost] [--repo flynn-host] [--profile NAME] [--json] <dir|tarball>
+func submit(cmdArgs []string) error {
+	fs := flag.NewFlagSet("submit", flag.ExitOnError)
+	url := fs.String("url", "http://localhost", "URL of the runner")
+	repo := fs.String("repo", "", "repo the source is of, defaults to the name of the dir")
+	profile := fs.String("profile", "", "run profile to use")
+	asJSON := fs.Bool("json", false, "print the triggered build as JSON")
+	fs.Parse(cmdArgs)
+	if fs.NArg() != 1 {
+		return errors.New("usage: runner submit [--url URL] [--repo REPO] [--profile NAME] [--json] <dir|tarball>")
+	}
+	path, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if *repo == "" {
+		*repo = strings.TrimSuffix(filepath.Base(path), ".tar.gz")
+	}
+	var source io.Reader
+	if info.IsDir() {
+		var out bytes.Buffer
+		cmd := exec.Command("tar", "-cz", "--exclude=.git", "-C", path, ".")
+		cmd.Stdout = &out
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("could not archive %s: %s", path, err)
+		}
+		source = &out
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		source = f
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("repo", *repo)
+	w.WriteField("profile", *profile)
+	part, err := w.CreateFormFile("source", *repo+".tar.gz")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, source); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", *url+"/builds", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if *asJSON {
+		req.Header.Set("Accept", "application/json")
+	}
+	req.SetBasicAuth("", os.Getenv("API_TOKEN"))
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	msg, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 {
+		return fmt.Errorf("could not submit %s: %s: %s", path, res.Status, bytes.TrimSpace(msg))
+	}
+	fmt.Print(string(msg))
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/cupcake/goamz/aws"
+	"github.com/cupcake/goamz/s3"
+	"github.com/flynn/flynn-test/cluster"
+	"github.com/flynn/flynn-test/config"
+)
+
+var logBucket = "flynn-ci-logs"
+
+// ArtifactStore stores build logs, reports, test artifacts and images.
+type ArtifactStore interface {
+	// Put stores data as name, tagged with labels where the store supports
+	// it. Private artifacts, such as images, are only readable with the
+	// store's credentials.
+	Put(name string, data io.ReadSeeker, contentType string, public bool, labels cluster.Labels) error
+
+	// Exists reports whether an artifact is stored as name.
+	Exists(name string) (bool, error)
+
+	// Get returns the artifact stored as name.
+	Get(name string) ([]byte, error)
+
+	// URL returns the URL of the artifact stored as name.
+	URL(name string) string
+}
+
+func newArtifactStore(conf *config.Config) (ArtifactStore, error) {
+	a := conf.Artifacts
+	if a == nil {
+		a = &config.ArtifactsConfig{}
+	}
+	switch conf.ArtifactStore() {
+	case "local":
+		return &localStore{dir: a.Dir, url: a.URL}, nil
+	case "sftp":
+		return &externalStore{&sftpStore{host: a.Host, user: a.User, key: a.Key, dir: a.Dir, url: a.URL}, service("sftp")}, nil
+	case "plugin":
+		p := conf.Plugin(a.Plugin)
+		if p == nil {
+			return nil, fmt.Errorf("unknown artifact store plugin %q", a.Plugin)
+		}
+		return &externalStore{&pluginStore{plugin: p, url: a.URL}, service("plugin " + p.Name)}, nil
+	default:
+		auth, err := aws.EnvAuth()
+		if err != nil {
+			return nil, err
+		}
+		bucket := a.Bucket
+		if bucket == "" {
+			bucket = logBucket
+		}
+		return &externalStore{&s3Store{s3.New(auth, aws.USEast).Bucket(bucket)}, service("s3")}, nil
+	}
+}
+
+func size(data io.Seeker) (int64, error) {
+	n, err := data.Seek(0, os.SEEK_END)
+	if err != nil {
+		return 0, err
+	}
+	_, err = data.Seek(0, os.SEEK_SET)
+	return n, err
+}
+
+type s3Store struct {
+	bucket *s3.Bucket
+}
+
+// Put stores the labels as the object's x-amz-meta-flynn-test-* metadata.
+func (s *s3Store) Put(name string, data io.ReadSeeker, contentType string, public bool, labels cluster.Labels) error {
+	n, err := size(data)
+	if err != nil {
+		return err
+	}
+	acl := s3.Private
+	if public {
+		acl = s3.PublicRead
+	}
+	meta := make(map[string][]string, len(labels))
+	for k, v := range labels {
+		meta[cluster.LabelNamespace+"-"+k] = []string{v}
+	}
+	return s.bucket.PutReaderWithOptions(name, data, n, contentType, acl, s3.Options{Meta: meta})
+}
+
+func (s *s3Store) Exists(name string) (bool, error) {
+	res, err := s.bucket.List(name, "", "", 1)
+	if err != nil {
+		return false, err
+	}
+	return len(res.Contents) == 1 && res.Contents[0].Key == name, nil
+}
+
+func (s *s3Store) Get(name string) ([]byte, error) {
+	return s.bucket.Get(name)
+}
+
+func (s *s3Store) URL(name string) string {
+	return fmt.Sprintf("https://s3.amazonaws.com/%s/%s", s.bucket.Name, name)
+}
+
+type localStore struct {
+	dir string
+	url string
+}
+
+// Put stores the labels as user.flynn-test.* extended attributes of the
+// file, if the filesystem supports them.
+func (s *localStore) Put(name string, data io.ReadSeeker, contentType string, public bool, labels cluster.Labels) error {
+	p := filepath.Join(s.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if _, err := data.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	mode := os.FileMode(0600)
+	if public {
+		mode = 0644
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, data); err != nil {
+		return err
+	}
+	for k, v := range labels {
+		syscall.Setxattr(p, "user."+cluster.LabelNamespace+"."+k, []byte(v), 0)
+	}
+	return nil
+}
+
+func (s *localStore) Exists(name string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *localStore) Get(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(s.dir, filepath.FromSlash(name)))
+}
+
+func (s *localStore) URL(name string) string {
+	return strings.TrimSuffix(s.url, "/") + "/" + name
+}
+
+// sftpStore uploads artifacts with the sftp command in batch mode.
+type sftpStore struct {
+	host string
+	user string
+	key  string
+	dir  string
+	url  string
+}
+
+// Put can't store labels, which are dropped.
+func (s *sftpStore) Put(name string, data io.ReadSeeker, contentType string, public bool, labels cluster.Labels) error {
+	tmp, err := ioutil.TempFile("", "artifact-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := data.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, data); err != nil {
+		return err
+	}
+
+	remote := path.Join(s.dir, name)
+	var dirs []string
+	for dir := path.Dir(remote); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	var batch bytes.Buffer
+	// sftp has no mkdir -p, and the "-" prefix ignores existing dirs
+	for _, dir := range dirs {
+		fmt.Fprintf(&batch, "-mkdir %q\n", dir)
+	}
+	mode := "600"
+	if public {
+		mode = "644"
+	}
+	fmt.Fprintf(&batch, "put %q %q\nchmod %s %q\n", tmp.Name(), remote, mode, remote)
+	if out, err := s.run(&batch); err != nil {
+		return fmt.Errorf("sftp upload of %s failed: %s: %s", name, err, out)
+	}
+	return nil
+}
+
+// Exists lists name, which fails if it doesn't exist or the server can't be
+// reached, in which case the artifact is uploaded again.
+func (s *sftpStore) Exists(name string) (bool, error) {
+	_, err := s.run(strings.NewReader(fmt.Sprintf("ls %q\n", path.Join(s.dir, name))))
+	return err == nil, nil
+}
+
+func (s *sftpStore) Get(name string) ([]byte, error) {
+	tmp, err := ioutil.TempFile("", "artifact-")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if out, err := s.run(strings.NewReader(fmt.Sprintf("get %q %q\n", path.Join(s.dir, name), tmp.Name()))); err != nil {
+		return nil, fmt.Errorf("sftp download of %s failed: %s: %s", name, err, out)
+	}
+	return ioutil.ReadFile(tmp.Name())
+}
+
+// run runs the sftp commands in batch, returning the output.
+func (s *sftpStore) run(batch io.Reader) (string, error) {
+	cmdArgs := []string{"-b", "-", "-o", "BatchMode=yes"}
+	if s.key != "" {
+		cmdArgs = append(cmdArgs, "-i", s.key)
+	}
+	host := s.host
+	if s.user != "" {
+		host = s.user + "@" + host
+	}
+	cmd := exec.Command("sftp", append(cmdArgs, host)...)
+	cmd.Stdin = batch
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
+
+func (s *sftpStore) URL(name string) string {
+	return strings.TrimSuffix(s.url, "/") + "/" + name
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The event stream serves the run events posted to webhooks, along with the
+// phases of running builds, to bots over a WebSocket so that they can follow
+// CI progress without polling GET /builds:
+//
+//	GET /events/stream?branch=master&pull_request=12&events=run.finish&resume=TOKEN
+//
+// Every event is sent as a JSON text message with a token, which resumes
+// the stream after that event when given as resume on reconnecting. The
+// runner keeps the latest streamBacklog events in memory, and a stream
+// resumed from a token which is no longer kept, such as one from before the
+// runner restarted, starts with a stream.reset event telling the client to
+// reload the runs it follows.
+
+const (
+	streamBacklog = 1000
+
+	// streamBuffer is the number of events queued for a subscriber which
+	// isn't keeping up before it is disconnected, which it recovers from
+	// by resuming.
+	streamBuffer = 100
+
+	streamPingInterval = 30 * time.Second
+)
+
+type eventStream struct {
+	mtx     sync.Mutex
+	epoch   string
+	seq     uint64
+	backlog []*streamEvent
+	subs    map[*streamSub]struct{}
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{
+		epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
+		subs:  make(map[*streamSub]struct{}),
+	}
+}
+
+// streamEvent is an event encoded when it is published, as the build it
+// refers to keeps changing.
+type streamEvent struct {
+	seq   uint64
+	event string
+	build Build
+	data  []byte
+}
+
+type streamSub struct {
+	filter *streamFilter
+	ch     chan *streamEvent
+}
+
+func (s *eventStream) token(seq uint64) string {
+	return fmt.Sprintf("%s-%d", s.epoch, seq)
+}
+
+// publish sends e to the subscribers whose filter it matches.
+func (s *eventStream) publish(e *RunEvent) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.seq++
+	se := &streamEvent{seq: s.seq, event: e.Event}
+	if e.Build != nil {
+		se.build = *e.Build
+	}
+	data, err := json.Marshal(struct {
+		Token string `json:"token"`
+		*RunEvent
+	}{s.token(s.seq), e})
+	if err != nil {
+		log.Printf("stream: could not encode %s event: %s\n", e.Event, err)
+		return
+	}
+	se.data = data
+	if s.backlog = append(s.backlog, se); len(s.backlog) > streamBacklog {
+		s.backlog = s.backlog[len(s.backlog)-streamBacklog:]
+	}
+	for sub := range s.subs {
+		if !sub.filter.match(se) {
+			continue
+		}
+		select {
+		case sub.ch <- se:
+		default:
+			close(sub.ch)
+			delete(s.subs, sub)
+		}
+	}
+}
+
+// subscribe adds a subscriber to the events matching f, returning the kept
+// events matching f published after the event of the token resume, if set,
+// and whether events may have been missed since then.
+func (s *eventStream) subscribe(f *streamFilter, resume string) (*streamSub, []*streamEvent, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	sub := &streamSub{filter: f, ch: make(chan *streamEvent, streamBuffer)}
+	s.subs[sub] = struct{}{}
+	if resume == "" {
+		return sub, nil, false
+	}
+	var seq uint64
+	var err error
+	if i := strings.LastIndex(resume, "-"); i >= 0 && resume[:i] == s.epoch {
+		seq, err = strconv.ParseUint(resume[i+1:], 10, 64)
+	} else {
+		err = fmt.Errorf("token %q is from another runner", resume)
+	}
+	if err != nil || seq > s.seq || len(s.backlog) > 0 && seq+1 < s.backlog[0].seq {
+		return sub, nil, true
+	}
+	var missed []*streamEvent
+	for _, e := range s.backlog {
+		if e.seq > seq && f.match(e) {
+			missed = append(missed, e)
+		}
+	}
+	return sub, missed, false
+}
+
+func (s *eventStream) unsubscribe(sub *streamSub) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.subs, sub)
+}
+
+// resetEvent returns the stream.reset event, whose token resumes the stream
+// after the latest event.
+func (s *eventStream) resetEvent() []byte {
+	s.mtx.Lock()
+	token := s.token(s.seq)
+	s.mtx.Unlock()
+	data, _ := json.Marshal(map[string]interface{}{"token": token, "event": "stream.reset", "time": time.Now()})
+	return data
+}
+
+// streamFilter selects the events of a stream. Events which aren't of a
+// build, such as disk events, only match filters which select no builds.
+type streamFilter struct {
+	Build       string
+	Project     string
+	Repo        string
+	Branch      string
+	PullRequest int
+	Events      []string
+}
+
+func parseStreamFilter(req *http.Request) (*streamFilter, error) {
+	f := &streamFilter{
+		Build:   req.FormValue("build"),
+		Project: req.FormValue("project"),
+		Repo:    req.FormValue("repo"),
+		Branch:  req.FormValue("branch"),
+	}
+	if s := req.FormValue("pull_request"); s != "" {
+		var err error
+		if f.PullRequest, err = strconv.Atoi(s); err != nil || f.PullRequest < 1 {
+			return nil, fmt.Errorf("invalid pull_request %q", s)
+		}
+	}
+	if s := req.FormValue("events"); s != "" {
+		f.Events = strings.Split(s, ",")
+	}
+	return f, nil
+}
+
+func (f *streamFilter) match(e *streamEvent) bool {
+	if len(f.Events) > 0 && !containsString(f.Events, e.event) {
+		return false
+	}
+	b := &e.build
+	if b.Id == "" {
+		return f.Build == "" && f.Project == "" && f.Repo == "" && f.Branch == "" && f.PullRequest == 0
+	}
+	return (f.Build == "" || b.Id == f.Build) &&
+		(f.Project == "" || b.Project == f.Project) &&
+		(f.Repo == "" || b.Repo == f.Repo) &&
+		(f.Branch == "" || b.Branch == f.Branch) &&
+		(f.PullRequest == 0 || b.PullRequest == f.PullRequest)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribeEvents serves the event stream to a WebSocket client.
+func (r *Runner) subscribeEvents(w http.ResponseWriter, req *http.Request) {
+	f, err := parseStreamFilter(req)
+	if err != nil {
+		http.Error(w, err.Error()+"\n", 400)
+		return
+	}
+	// the upgrade is a GET authenticated by the session cookie, so any site
+	// could open it from a signed in browser, which always sends Origin
+	if req.Header.Get("Origin") != "" && !sameOrigin(req) {
+		http.Error(w, "cross-origin request refused\n", 403)
+		return
+	}
+	ws, err := upgradeWebSocket(w, req)
+	if ws == nil {
+		http.Error(w, err.Error()+"\n", 400)
+		return
+	}
+	defer ws.conn.Close()
+	if err != nil {
+		return
+	}
+	sub, missed, reset := r.stream.subscribe(f, req.FormValue("resume"))
+	defer r.stream.unsubscribe(sub)
+
+	// the client's frames are read only to answer its pings and notice it
+	// closing the connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			op, payload, err := ws.readFrame()
+			if err != nil {
+				return
+			}
+			switch op {
+			case wsPing:
+				ws.writeFrame(wsPong, payload)
+			case wsClose:
+				ws.writeFrame(wsClose, payload)
+				return
+			}
+		}
+	}()
+
+	if reset {
+		if err := ws.writeFrame(wsText, r.stream.resetEvent()); err != nil {
+			return
+		}
+	}
+	for _, e := range missed {
+		if err := ws.writeFrame(wsText, e.data); err != nil {
+			return
+		}
+	}
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case e, ok := <-sub.ch:
+			if !ok {
+				ws.close(1013, "too slow, resume from the last token")
+				return
+			}
+			if err := ws.writeFrame(wsText, e.data); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := ws.writeFrame(wsPing, nil); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
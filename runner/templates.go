@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn-test/assets"
+)
+
+// templateFuncs are the funcs of the dashboard templates, which templates
+// overriding them can use.
+var templateFuncs = template.FuncMap{
+	"duration": func(d time.Duration) string { return truncate(d).String() },
+	"color":    phaseColor,
+	"join":     strings.Join,
+}
+
+// dashboardTemplates are the HTML templates of the dashboard and reports,
+// which assets named templates/NAME.html replace.
+var dashboardTemplates = map[string]**template.Template{
+	"runs":      &runsTemplate,
+	"run":       &runTemplate,
+	"gantt":     &ganttTemplate,
+	"new-build": &newBuildTemplate,
+	"awaiting":  &awaitingTemplate,
+	"log":       &logTemplate,
+	"report":    &reportTemplate,
+}
+
+// overrideTemplates replaces the dashboard templates which are in the assets
+// dir, so that the pages can be changed without rebuilding the runner.
+func overrideTemplates() error {
+	for name, t := range dashboardTemplates {
+		data, err := assets.Asset("templates/" + name + ".html")
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		tmpl, err := template.New(name).Funcs(templateFuncs).Parse(string(data))
+		if err != nil {
+			return fmt.Errorf("invalid %s template: %s", name, err)
+		}
+		*t = tmpl
+	}
+	return nil
+}
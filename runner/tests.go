@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn-test/util"
+)
+
+type TestResult struct {
+	Name     string        `json:"name"`
+	File     string        `json:"file"`
+	Line     int           `json:"line"`
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+	Output   string        `json:"output,omitempty"`
+
+	// Attempts is the number of times a test was run, if it was retried.
+	Attempts int `json:"attempts,omitempty"`
+
+	Artifacts []*Artifact `json:"artifacts,omitempty"`
+
+	// Owners are the GitHub users and teams who own the test.
+	Owners []string `json:"owners,omitempty"`
+}
+
+var testLinePattern = regexp.MustCompile(`^(START|PASS|FAIL|SKIP|PANIC|MISS): (\S+):(\d+): (\S+)(?:\t(\S+))?`)
+
+// summaryPattern matches the line printed once the whole suite has run.
+var summaryPattern = regexp.MustCompile(`^(OK|OOPS): \d+ passed`)
+
+// testWatcher parses the streamed output of the gocheck suite, calling
+// onResult as each test finishes.
+type testWatcher struct {
+	onResult func(*TestResult)
+
+	mtx     sync.Mutex
+	buf     []byte
+	current string
+	started util.Instant
+	output  bytes.Buffer
+
+	// completed is set once the suite summary has been seen.
+	completed bool
+}
+
+func (w *testWatcher) Write(p []byte) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *testWatcher) line(l string) {
+	if summaryPattern.MatchString(l) {
+		w.completed = true
+	}
+	m := testLinePattern.FindStringSubmatch(l)
+	if m == nil {
+		if w.current != "" {
+			w.output.WriteString(l)
+			w.output.WriteByte('\n')
+		}
+		return
+	}
+	if m[1] == "START" {
+		w.current = m[4]
+		w.started = util.Now()
+		w.output.Reset()
+		return
+	}
+	res := &TestResult{
+		Name:   m[4],
+		File:   m[2],
+		Status: strings.ToLower(m[1]),
+	}
+	res.Line, _ = strconv.Atoi(m[3])
+	if m[5] != "" {
+		res.Duration, _ = time.ParseDuration(m[5])
+	}
+	if w.current == res.Name {
+		res.Output = w.output.String()
+	}
+	w.current = ""
+	w.output.Reset()
+	if w.onResult != nil {
+		w.onResult(res)
+	}
+}
+
+// timeout fails the running test if it has run for longer than d, returning
+// its name.
+func (w *testWatcher) timeout(d time.Duration) string {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.current == "" || w.started.Elapsed() < d {
+		return ""
+	}
+	res := &TestResult{
+		Name:     w.current,
+		Status:   "fail",
+		Duration: w.started.Elapsed(),
+		Output:   fmt.Sprintf("%stest timed out after %s\n", w.output.String(), d),
+	}
+	w.current = ""
+	w.output.Reset()
+	if w.onResult != nil {
+		w.onResult(res)
+	}
+	return res.Name
+}
+
+func (r *TestResult) Failed() bool {
+	return r.Status == "fail" || r.Status == "panic"
+}
+
+func (r *TestResult) StatusText() string {
+	if r.Status == "flaky" {
+		return fmt.Sprintf("flaky pass after %d attempts", r.Attempts)
+	}
+	return r.Status
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serve serves the API, dashboard and webhooks over HTTPS on :443 if a
+// certificate is configured or self-signed certificates are enabled, and over
+// plain HTTP on :80 otherwise.
+func (r *Runner) serve(handler http.Handler) error {
+	certFile, keyFile := args.TLSCert, args.TLSKey
+	if certFile == "" && !args.TLSSelfSigned {
+		ln, err := r.listen(":80")
+		if err != nil {
+			return err
+		}
+		return http.Serve(ln, handler)
+	}
+	if args.TLSSelfSigned {
+		if certFile == "" {
+			certFile = "runner-cert.pem"
+		}
+		if keyFile == "" {
+			keyFile = "runner-key.pem"
+		}
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			log.Printf("generating self-signed certificate %s\n", certFile)
+			if err := generateCert(certFile, keyFile); err != nil {
+				return fmt.Errorf("could not generate certificate: %s", err)
+			}
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load certificate: %s", err)
+	}
+	if err := logPins(cert); err != nil {
+		return err
+	}
+	ln, err := r.listen(":443")
+	if err != nil {
+		return err
+	}
+	return http.Serve(tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}}), handler)
+}
+
+// listen listens on addr, or uses the listener inherited from the runner
+// which re-executed this one during an update or handed its listener over.
+func (r *Runner) listen(addr string) (net.Listener, error) {
+	if r.listener != nil {
+		// taken over from the previous runner
+		return r.listener, nil
+	}
+	var err error
+	if fd := os.Getenv("RUNNER_LISTEN_FD"); fd != "" {
+		os.Unsetenv("RUNNER_LISTEN_FD")
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RUNNER_LISTEN_FD: %s", err)
+		}
+		log.Printf("Listening on inherited %s...\n", addr)
+		r.listener, err = net.FileListener(os.NewFile(uintptr(n), "listener"))
+		return r.listener, err
+	}
+	log.Printf("Listening on %s...\n", addr)
+	r.listener, err = net.Listen("tcp", addr)
+	return r.listener, err
+}
+
+// logPins prints the fingerprint and public key pin of cert so that clients
+// of a self-signed runner can verify it.
+func logPins(cert tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("could not parse certificate: %s", err)
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	pin := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	log.Printf("TLS certificate SHA-256 fingerprint: %s\n", strings.Join(hex, ":"))
+	log.Printf("TLS public key pin: sha256/%s\n", base64.StdEncoding.EncodeToString(pin[:]))
+	return nil
+}
+
+// generateCert writes a self-signed certificate valid for the host's name and
+// localhost, which clients can trust directly by setting RUNNER_CA.
+func generateCert(certFile, keyFile string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hosts := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[len(hosts)-1]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(5 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              hosts,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyOut, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer keyOut.Close()
+	if err := pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// apiClient returns the client used by subcommands to call the runner API,
+// trusting the certificate in $RUNNER_CA if it is set, such as the runner's
+// self-signed certificate.
+func apiClient() (*http.Client, error) {
+	caFile := os.Getenv("RUNNER_CA")
+	if caFile == "" {
+		return http.DefaultClient, nil
+	}
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}, nil
+}
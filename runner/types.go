@@ -7,6 +7,8 @@ import (
 type Event interface {
 	Repo() string
 	Commit() string
+	Branch() string
+	CloneUrl() string
 }
 
 type PushEvent struct {
@@ -27,6 +29,14 @@ func (e *PushEvent) Commit() string {
 	return e.HeadCommit.Id
 }
 
+func (e *PushEvent) Branch() string {
+	return trimRef(e.Ref)
+}
+
+func (e *PushEvent) CloneUrl() string {
+	return e.Repository.CloneUrl
+}
+
 type PullRequestEvent struct {
 	Action      string       `json:"action"`
 	Number      int          `json:"number"`
@@ -43,6 +53,51 @@ func (e *PullRequestEvent) Commit() string {
 	return e.PullRequest.Head.Sha
 }
 
+func (e *PullRequestEvent) Branch() string {
+	return e.PullRequest.Head.Ref
+}
+
+func (e *PullRequestEvent) CloneUrl() string {
+	if e.PullRequest.Head.Repo != nil {
+		return e.PullRequest.Head.Repo.CloneUrl
+	}
+	return e.Repository.CloneUrl
+}
+
+// IssueCommentEvent is only used to approve the builds of pull requests, so
+// it has no commit to build.
+type IssueCommentEvent struct {
+	Action     string        `json:"action"`
+	Issue      *Issue        `json:"issue"`
+	Comment    *IssueComment `json:"comment"`
+	Repository *Repository   `json:"repository"`
+}
+
+func (e *IssueCommentEvent) Repo() string {
+	return e.Repository.Name
+}
+
+func (e *IssueCommentEvent) Commit() string {
+	return ""
+}
+
+func (e *IssueCommentEvent) Branch() string {
+	return ""
+}
+
+func (e *IssueCommentEvent) CloneUrl() string {
+	return ""
+}
+
+type Issue struct {
+	Number int `json:"number"`
+
+	// PullRequest is only set for comments on pull requests.
+	PullRequest *struct {
+		Url string `json:"url"`
+	} `json:"pull_request"`
+}
+
 type Commit struct {
 	Id        string     `json:"id"`
 	Distinct  bool       `json:"distinct"`
@@ -60,7 +115,11 @@ type Repository struct {
 	Id          int    `json:"id"`
 	Name        string `json:"name"`
 	Url         string `json:"url"`
+	CloneUrl    string `json:"clone_url"`
 	Description string `json:"description"`
+
+	// PushedAt is only set for push events.
+	PushedAt *timestamp `json:"pushed_at,omitempty"`
 }
 
 type User struct {
@@ -79,6 +138,11 @@ type PullRequest struct {
 	UpdatedAt *time.Time `json:"updated_at"`
 	Head      *PRBranch  `json:"head"`
 	Base      *PRBranch  `json:"base"`
+	Labels    []*PRLabel `json:"labels"`
+}
+
+type PRLabel struct {
+	Name string `json:"name"`
 }
 
 type PRUser struct {
@@ -92,3 +156,112 @@ type PRBranch struct {
 	User  *PRUser     `json:"user"`
 	Repo  *Repository `json:"repo"`
 }
+
+type GitlabPushEvent struct {
+	ObjectKind  string         `json:"object_kind"`
+	Ref         string         `json:"ref"`
+	Before      string         `json:"before"`
+	After       string         `json:"after"`
+	CheckoutSha string         `json:"checkout_sha"`
+	UserName    string         `json:"user_name"`
+	Project     *GitlabProject `json:"project"`
+}
+
+func (e *GitlabPushEvent) Repo() string {
+	return e.Project.Name
+}
+
+func (e *GitlabPushEvent) Commit() string {
+	if e.CheckoutSha != "" {
+		return e.CheckoutSha
+	}
+	return e.After
+}
+
+func (e *GitlabPushEvent) Branch() string {
+	return trimRef(e.Ref)
+}
+
+func (e *GitlabPushEvent) CloneUrl() string {
+	return e.Project.GitHttpUrl
+}
+
+type GitlabMergeRequestEvent struct {
+	ObjectKind       string                  `json:"object_kind"`
+	User             *GitlabUser             `json:"user"`
+	Project          *GitlabProject          `json:"project"`
+	ObjectAttributes *GitlabMergeRequestAttr `json:"object_attributes"`
+}
+
+func (e *GitlabMergeRequestEvent) Repo() string {
+	return e.Project.Name
+}
+
+func (e *GitlabMergeRequestEvent) Commit() string {
+	return e.ObjectAttributes.LastCommit.Id
+}
+
+func (e *GitlabMergeRequestEvent) Branch() string {
+	return e.ObjectAttributes.SourceBranch
+}
+
+func (e *GitlabMergeRequestEvent) CloneUrl() string {
+	if e.ObjectAttributes.Source != nil {
+		return e.ObjectAttributes.Source.GitHttpUrl
+	}
+	return e.Project.GitHttpUrl
+}
+
+type GitlabProject struct {
+	Name              string `json:"name"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	GitHttpUrl        string `json:"git_http_url"`
+}
+
+type GitlabUser struct {
+	Name     string `json:"name"`
+	Username string `json:"username"`
+}
+
+type GitlabMergeRequestAttr struct {
+	Iid          int            `json:"iid"`
+	Action       string         `json:"action"`
+	State        string         `json:"state"`
+	SourceBranch string         `json:"source_branch"`
+	TargetBranch string         `json:"target_branch"`
+	Source       *GitlabProject `json:"source"`
+	LastCommit   *GitlabCommit  `json:"last_commit"`
+}
+
+type GitlabCommit struct {
+	Id string `json:"id"`
+}
+
+// TriggerEvent is the payload accepted by the generic trigger endpoint.
+type TriggerEvent struct {
+	Name    string `json:"repo"`
+	Ref     string `json:"ref"`
+	Sha     string `json:"sha"`
+	Url     string `json:"clone_url"`
+	Profile string `json:"profile"`
+	Token   string `json:"token"`
+}
+
+func (e *TriggerEvent) Repo() string {
+	return e.Name
+}
+
+func (e *TriggerEvent) Commit() string {
+	if e.Sha != "" {
+		return e.Sha
+	}
+	return e.Ref
+}
+
+func (e *TriggerEvent) Branch() string {
+	return trimRef(e.Ref)
+}
+
+func (e *TriggerEvent) CloneUrl() string {
+	return e.Url
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var errUpToDate = errors.New("runner is up to date")
+
+// version is the release number of the runner, set at link time with
+// -ldflags "-X main.version=N". Only releases with a higher number are
+// installed.
+var version = "0"
+
+const (
+	maxManifestSize = 64 * 1024
+	maxReleaseSize  = 256 * 1024 * 1024
+)
+
+// releaseManifest describes a release artifact. It is what the release
+// signature covers, so the version can't be replayed with another artifact.
+type releaseManifest struct {
+	Version int64  `json:"version"`
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+}
+
+// track registers a build with the running builds, returning false if the
+// runner is draining and the build should be left for the updated runner.
+func (r *Runner) track() bool {
+	r.drainMtx.Lock()
+	defer r.drainMtx.Unlock()
+	if r.draining {
+		return false
+	}
+	r.running.Add(1)
+	return true
+}
+
+// drain stops new builds from starting and waits for running builds to
+// finish.
+func (r *Runner) drain() {
+	r.drainMtx.Lock()
+	r.draining = true
+	r.drainMtx.Unlock()
+	log.Println("draining running builds")
+	r.running.Wait()
+}
+
+// startUpdates periodically checks for a new runner release.
+func (r *Runner) startUpdates() {
+	if r.config.Update == nil || r.config.Update.Interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(r.config.Update.Interval)) {
+			if err := r.update(); err != nil && err != errUpToDate {
+				log.Printf("update failed: %s\n", err)
+			}
+		}
+	}()
+}
+
+// update replaces the runner binary with the signed release artifact if it
+// is newer, then drains running builds and re-executes the runner, which
+// inherits the listener socket and builds the pending builds.
+func (r *Runner) update() error {
+	if r.config.Update == nil {
+		return errors.New("updates are not configured")
+	}
+	exe, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return err
+	}
+	path, v, err := r.fetchRelease(exe)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(path, exe); err != nil {
+		os.Remove(path)
+		return err
+	}
+	log.Printf("installed runner release %d from %s\n", v, r.config.Update.URL)
+
+	r.drain()
+	r.closeBuilders()
+	if fs := r.baseDockerFS(); fs != args.DockerFS && !r.isBaseImage(fs) {
+		os.RemoveAll(fs)
+	}
+	return r.reexec(exe)
+}
+
+// fetchRelease verifies the signed manifest of the release and downloads the
+// release artifact it describes next to exe, returning its path and version,
+// or errUpToDate if it is not newer than the running runner.
+func (r *Runner) fetchRelease(exe string) (string, int64, error) {
+	conf := r.config.Update
+	pub, err := loadPublicKey(conf.PublicKey)
+	if err != nil {
+		return "", 0, err
+	}
+	data, err := download(conf.URL+".manifest", maxManifestSize)
+	if err != nil {
+		return "", 0, err
+	}
+	sig, err := download(conf.URL+".manifest.sig", maxManifestSize)
+	if err != nil {
+		return "", 0, err
+	}
+	sum := sha256.Sum256(data)
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+		return "", 0, fmt.Errorf("invalid signature of %s.manifest: %s", conf.URL, err)
+	}
+	var manifest releaseManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", 0, fmt.Errorf("invalid release manifest: %s", err)
+	}
+	current, _ := strconv.ParseInt(version, 10, 64)
+	if manifest.Version <= current {
+		return "", 0, errUpToDate
+	}
+	if manifest.Size <= 0 || manifest.Size > maxReleaseSize {
+		return "", 0, fmt.Errorf("release %d has invalid size %d", manifest.Version, manifest.Size)
+	}
+	release, err := download(conf.URL, manifest.Size)
+	if err != nil {
+		return "", 0, err
+	}
+	if sum := sha256.Sum256(release); hex.EncodeToString(sum[:]) != manifest.SHA256 {
+		return "", 0, fmt.Errorf("release %d does not match its manifest", manifest.Version)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(exe), ".runner-update-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	if _, err := f.Write(release); err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	if err := f.Chmod(0755); err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	return f.Name(), manifest.Version, nil
+}
+
+// download returns the body at url, failing if it is larger than limit.
+func download(url string, limit int64) ([]byte, error) {
+	res, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("could not download %s: %s", url, res.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes", url, limit)
+	}
+	return data, nil
+}
+
+func loadPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA public key", path)
+	}
+	return pub, nil
+}
+
+// reexec replaces the process with exe, passing it the listener socket.
+func (r *Runner) reexec(exe string) error {
+	f, err := r.listener.(*net.TCPListener).File()
+	if err != nil {
+		return err
+	}
+	// the duplicated fd must survive the exec
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFD, 0); errno != 0 {
+		return errno
+	}
+	env := append(os.Environ(), fmt.Sprintf("RUNNER_LISTEN_FD=%d", f.Fd()))
+	r.db.Close()
+	log.Printf("re-executing %s\n", exe)
+	err = syscall.Exec(exe, os.Args, env)
+	log.Fatalf("could not re-execute runner: %s", err)
+	return err
+}
+
+func (r *Runner) updateHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed\n", 405)
+		return
+	}
+	if r.config.Update == nil {
+		http.Error(w, "updates are not configured\n", 404)
+		return
+	}
+	go func() {
+		if err := r.update(); err != nil {
+			log.Printf("update failed: %s\n", err)
+		}
+	}()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "checking for an update, the runner restarts once running builds finish if there is one\n")
+}
+
+// updateCmd asks a running runner to update itself:
+//
+//	runner update [--url http://localhost]
+func updateCmd(cmdArgs []string) error {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	url := fs.String("url", "http://localhost", "URL of the runner")
+	fs.Parse(cmdArgs)
+	req, err := http.NewRequest("POST", *url+"/update", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("", os.Getenv("API_TOKEN"))
+	client, err := apiClient()
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 {
+		return fmt.Errorf("could not update runner: %s", strings.TrimSpace(string(body)))
+	}
+	os.Stdout.Write(body)
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flynn/flynn-test/config"
+)
+
+func TestFetchRelease(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "runner-update-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPath := filepath.Join(dir, "runner.pub")
+	if err := ioutil.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(k *rsa.PrivateKey, data []byte) []byte {
+		sum := sha256.Sum256(data)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	manifest := func(m releaseManifest) []byte {
+		data, _ := json.Marshal(m)
+		return data
+	}
+	release := []byte("runner release")
+	sum := sha256.Sum256(release)
+	valid := releaseManifest{Version: 6, SHA256: hex.EncodeToString(sum[:]), Size: int64(len(release))}
+
+	files := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, ok := files[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+	r := &Runner{config: &config.Config{Update: &config.UpdateConfig{URL: srv.URL + "/runner", PublicKey: pubPath}}}
+
+	defer func(v string) { version = v }(version)
+	version = "5"
+
+	for _, test := range []struct {
+		name     string
+		manifest []byte
+		sig      []byte
+		release  []byte
+		err      string
+	}{
+		{
+			name:     "valid",
+			manifest: manifest(valid),
+			sig:      sign(key, manifest(valid)),
+			release:  release,
+		},
+		{
+			name:     "signed by another key",
+			manifest: manifest(valid),
+			sig:      sign(otherKey, manifest(valid)),
+			release:  release,
+			err:      "invalid signature of " + srv.URL + "/runner.manifest",
+		},
+		{
+			name:     "manifest modified after signing",
+			manifest: manifest(releaseManifest{Version: 7, SHA256: valid.SHA256, Size: valid.Size}),
+			sig:      sign(key, manifest(valid)),
+			release:  release,
+			err:      "invalid signature of " + srv.URL + "/runner.manifest",
+		},
+		{
+			name:     "not newer",
+			manifest: manifest(releaseManifest{Version: 5, SHA256: valid.SHA256, Size: valid.Size}),
+			sig:      sign(key, manifest(releaseManifest{Version: 5, SHA256: valid.SHA256, Size: valid.Size})),
+			release:  release,
+			err:      errUpToDate.Error(),
+		},
+		{
+			name:     "invalid size",
+			manifest: manifest(releaseManifest{Version: 6, SHA256: valid.SHA256}),
+			sig:      sign(key, manifest(releaseManifest{Version: 6, SHA256: valid.SHA256})),
+			release:  release,
+			err:      "release 6 has invalid size 0",
+		},
+		{
+			name:     "release does not match",
+			manifest: manifest(valid),
+			sig:      sign(key, manifest(valid)),
+			release:  []byte("runner RELEASE"),
+			err:      "release 6 does not match its manifest",
+		},
+		{
+			name:     "release larger than its manifest",
+			manifest: manifest(valid),
+			sig:      sign(key, manifest(valid)),
+			release:  append(release, '!'),
+			err:      srv.URL + "/runner is larger than 14 bytes",
+		},
+	} {
+		files["/runner.manifest"] = test.manifest
+		files["/runner.manifest.sig"] = test.sig
+		files["/runner"] = test.release
+		path, v, err := r.fetchRelease(filepath.Join(dir, "runner"))
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			if path != "" {
+				os.Remove(path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		os.Remove(path)
+		if err != nil {
+			t.Errorf("%s: could not read release: %s", test.name, err)
+		} else if v != valid.Version || string(data) != string(release) {
+			t.Errorf("%s: got release %d %q, expected %d %q", test.name, v, data, valid.Version, release)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/flynn/flynn-test/cluster"
+)
+
+// startWarmups periodically refreshes the base docker fs if the config sets
+// a warm interval.
+func (r *Runner) startWarmups() {
+	if r.config.WarmInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(r.config.WarmInterval)) {
+			if err := r.warmImages(); err != nil {
+				log.Printf("could not warm docker fs: %s\n", err)
+			}
+		}
+	}()
+}
+
+func (r *Runner) baseDockerFS() string {
+	r.dockerFSMtx.Lock()
+	defer r.dockerFSMtx.Unlock()
+	return r.dockerFS
+}
+
+// warmImages pre-pulls images into a copy of the base docker fs and makes
+// builds start from the copy, once it is promoted if the config sets
+// promotion. Superseded warmed images are kept for a warm interval, as
+// running builds may still be booting from them.
+func (r *Runner) warmImages() error {
+	bc := r.bc
+	bc.Roles = r.config.Roles
+	bc.BootProfiles = r.config.BootProfiles
+	bc.RootFS = r.baseRootFS()
+	network, err := r.allocateNet()
+	if err != nil {
+		return err
+	}
+	defer r.releaseNet(network)
+	bc.Network = network
+	log.Println("warming docker fs")
+	fs, err := cluster.WarmImages(bc, r.baseDockerFS(), os.Stdout)
+	if err != nil {
+		return err
+	}
+	if r.config.Promotion != nil {
+		if _, err := r.addCandidate("dockerfs", fs, "warm"); err != nil {
+			os.RemoveAll(filepath.Dir(fs))
+			return err
+		}
+		return nil
+	}
+
+	r.dockerFSMtx.Lock()
+	stale := r.staleFS
+	r.staleFS = r.warmedFS
+	r.dockerFS, r.warmedFS = fs, fs
+	r.dockerFSMtx.Unlock()
+	if stale != "" {
+		os.RemoveAll(filepath.Dir(stale))
+	}
+	log.Printf("builds now start from warmed docker fs %s\n", fs)
+	return nil
+}
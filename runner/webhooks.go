@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn-test/config"
+)
+
+// RunEvent is the JSON body posted to outbound webhooks.
+type RunEvent struct {
+	Event  string    `json:"event"`
+	Build  *Build    `json:"build,omitempty"`
+	Time   time.Time `json:"time"`
+	LogUrl string    `json:"log_url,omitempty"`
+	Error  string    `json:"error,omitempty"`
+
+	Passed int `json:"passed,omitempty"`
+	Failed int `json:"failed,omitempty"`
+
+	// Owners maps the owners of the tests which failed to their tests, so
+	// that chat bots can mention them.
+	Owners map[string][]string `json:"owners,omitempty"`
+
+	// Console is the latest console lines of each instance, keyed by IP,
+	// of runs which failed while their cluster was up.
+	Console map[string][]string `json:"console,omitempty"`
+
+	// Disk is the usage of the disk of disk.* events.
+	Disk *diskUsage `json:"disk,omitempty"`
+}
+
+// notifyWebhooks posts e to every webhook subscribed to it, in the
+// background, and publishes it to the event stream. The body is signed with
+// the webhook's secret, as the hex encoded HMAC-SHA256 in the
+// X-Flynn-CI-Signature header.
+func (r *Runner) notifyWebhooks(e *RunEvent) {
+	e.Time = time.Now()
+	// the build env may hold secrets
+	if e.Build != nil {
+		build := *e.Build
+		build.Env = nil
+		build.RepoEnv = nil
+		e.Build = &build
+	}
+	r.stream.publish(e)
+	r.notifyPlugins(e)
+	if len(r.config.Webhooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("webhooks: could not encode %s event: %s\n", e.Event, err)
+		return
+	}
+	for _, hook := range r.config.Webhooks {
+		if !hook.Subscribed(e.Event) {
+			continue
+		}
+		go func(hook *config.Webhook) {
+			if err := service("webhook " + hook.URL).call(func() error {
+				return postWebhook(hook, body)
+			}); err != nil {
+				log.Printf("webhooks: could not deliver %s event to %s: %s\n", e.Event, hook.URL, err)
+			}
+		}(hook)
+	}
+}
+
+func postWebhook(hook *config.Webhook, body []byte) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Flynn-CI-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return statusError(res, fmt.Errorf("unexpected status %d", res.StatusCode))
+	}
+	return nil
+}
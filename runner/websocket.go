@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsConn is the server side of a WebSocket connection. It only implements
+// what the event stream needs of RFC 6455, sending text messages and pings
+// and answering the control frames of the client, whose messages are
+// discarded.
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	// writeMtx serializes frames written by the sender and by the reader
+	// answering pings.
+	writeMtx sync.Mutex
+}
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsText  = 1
+	wsClose = 8
+	wsPing  = 9
+	wsPong  = 10
+
+	wsWriteTimeout = 10 * time.Second
+
+	// wsMaxPayload is the largest frame accepted from clients, which only
+	// need to send control frames.
+	wsMaxPayload = 64 * 1024
+)
+
+var errNotWebSocket = errors.New("expected a WebSocket handshake")
+
+// upgradeWebSocket completes the opening handshake of a WebSocket request.
+// If it returns an error without a connection the response hasn't been
+// written, otherwise the connection has been taken over and must be closed.
+func upgradeWebSocket(w http.ResponseWriter, req *http.Request) (*wsConn, error) {
+	if req.Method != "GET" || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || !headerHasToken(req.Header, "Connection", "upgrade") {
+		return nil, errNotWebSocket
+	}
+	if v := req.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		return nil, fmt.Errorf("unsupported WebSocket version %q", v)
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection can't be upgraded")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	h := sha1.New()
+	io.WriteString(h, key+wsGUID)
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	c := &wsConn{conn: conn, rw: rw}
+	return c, rw.Flush()
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeFrame writes an unfragmented frame, which servers send unmasked.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	header := []byte{0x80 | op, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	c.rw.Write(header)
+	c.rw.Write(payload)
+	return c.rw.Flush()
+}
+
+// readFrame reads a frame from the client, unmasking its payload.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.rw, header[:]); err != nil {
+		return 0, nil, err
+	}
+	op := header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		return 0, nil, errors.New("unmasked frame from client")
+	}
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxPayload {
+		return 0, nil, fmt.Errorf("frame of %d bytes is too large", n)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+// close sends a close frame with code and reason and closes the connection.
+func (c *wsConn) close(code uint16, reason string) {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	c.writeFrame(wsClose, append(payload, reason...))
+	c.conn.Close()
+}
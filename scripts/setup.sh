@@ -29,17 +29,24 @@ main() {
     $src_dir/rootfs/build.sh $build_dir
   fi
 
-  if ! which godep >/dev/null; then
-    install_godep
-  fi
-
-  if [ ! -f "$bin_dir/flynn-test" ]; then
+  if [ -n "$FLYNN_TEST_RUNNER_BIN" ]; then
+    # run by "flynn-test-runner setup" with the scripts embedded in the runner
+    install -m 755 "$FLYNN_TEST_RUNNER_BIN" $bin_dir/flynn-test-runner
+    [ ! -f "$bin_dir/flynn-test" ] && echo "WARNING: copy the flynn-test tests binary to $bin_dir"
+  elif [ ! -f "$bin_dir/flynn-test" ]; then
+    if ! which godep >/dev/null; then
+      install_godep
+    fi
     pushd $src_dir >/dev/null
     make
     cp flynn-test flynn-test-runner $bin_dir
     popd >/dev/null
   fi
 
+  if [ -n "$FLYNN_TEST_CONFIG" ]; then
+    cp "$FLYNN_TEST_CONFIG" $dir/config.json
+  fi
+
   rsync -avz "$src_dir/apps" $dir
 
   chown -R $user:$user $dir
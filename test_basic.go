@@ -2,26 +2,19 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 
+	"github.com/flynn/flynn-test/cluster"
 	"github.com/flynn/flynn-test/util"
-	"github.com/flynn/go-flynn/attempt"
 	c "gopkg.in/check.v1"
 )
 
-func initApp(t *c.C, app string) string {
-	dir := filepath.Join(t.MkDir(), "app")
-	t.Assert(run(exec.Command("cp", "-r", filepath.Join("apps", app), dir)), Succeeds)
-	t.Assert(git(dir, "init"), Succeeds)
-	t.Assert(git(dir, "add", "."), Succeeds)
-	t.Assert(git(dir, "commit", "-am", "init"), Succeeds)
-	return dir
-}
-
 type appSuite struct {
 	appDir string
 }
@@ -34,27 +27,78 @@ func (s *appSuite) Git(args ...string) *CmdResult {
 	return git(s.appDir, args...)
 }
 
+// deployedApp is an example app which has been created and pushed to the
+// cluster.
+type deployedApp struct {
+	Dir    string
+	Name   string
+	Create *CmdResult
+	Push   *CmdResult
+}
+
+// deploy copies the example app into a new git repo, then creates and pushes
+// it.
+func (a *deployedApp) deploy(app string) error {
+	dir, err := ioutil.TempDir("", "flynn-test-app-")
+	if err != nil {
+		return err
+	}
+	a.Dir = filepath.Join(dir, "app")
+	if res := run(exec.Command("cp", "-r", filepath.Join("apps", app), a.Dir)); res.Err != nil {
+		return cmdError(res)
+	}
+	for _, args := range [][]string{{"init"}, {"add", "."}, {"commit", "-am", "init"}} {
+		if res := git(a.Dir, args...); res.Err != nil {
+			return cmdError(res)
+		}
+	}
+	a.Name = util.SeededString(random, 30)
+	if a.Create = flynn(a.Dir, "create", a.Name); a.Create.Err != nil {
+		return cmdError(a.Create)
+	}
+	if a.Push = git(a.Dir, "push", "flynn", "master"); a.Push.Err != nil {
+		return cmdError(a.Push)
+	}
+	return nil
+}
+
+func (a *deployedApp) remove() {
+	if controller != nil && a.Name != "" {
+		if err := controller.DeleteApp(a.Name); err != nil {
+			fmt.Printf("could not delete app %s: %s\n", a.Name, err)
+		}
+	}
+	os.RemoveAll(filepath.Dir(a.Dir))
+}
+
+// basicApp is the basic example app, deployed once and shared by the tests
+// which need a running app.
+var (
+	basicApp        deployedApp
+	basicAppFixture = newFixture("basic app", func() error { return basicApp.deploy("basic") }, basicApp.remove)
+)
+
 type BasicSuite struct {
 	appSuite
 }
 
 var _ = c.Suite(&BasicSuite{})
 
-func (s *BasicSuite) SetUpSuite(t *c.C) {
-	s.appDir = initApp(t, "basic")
+func (s *BasicSuite) SetUpTest(t *c.C) {
+	basicAppFixture.Require(t)
+	s.appDir = basicApp.Dir
 }
 
-var Attempts = attempt.Strategy{
+var Attempts = util.Strategy{
 	Min:   5,
 	Total: 10 * time.Second,
 	Delay: 500 * time.Millisecond,
 }
 
 func (s *BasicSuite) TestBasic(t *c.C) {
-	name := util.RandomString(30)
-	t.Assert(s.Flynn("create", name), Outputs, fmt.Sprintf("Created %s\n", name))
+	t.Assert(basicApp.Create, Outputs, fmt.Sprintf("Created %s\n", basicApp.Name))
 
-	push := s.Git("push", "flynn", "master")
+	push := basicApp.Push
 	t.Assert(push, OutputContains, "Node.js app detected")
 	t.Assert(push, OutputContains, "Downloading and installing node")
 	t.Assert(push, OutputContains, "Installing dependencies")
@@ -63,9 +107,20 @@ func (s *BasicSuite) TestBasic(t *c.C) {
 	t.Assert(push, OutputContains, "Application deployed")
 	t.Assert(push, OutputContains, "* [new branch]      master -> master")
 
-	t.Assert(s.Flynn("scale", "web=3"), Succeeds)
-
-	newRoute := s.Flynn("route-add-http", util.RandomString(32)+".dev")
+	client := requireController(t)
+	app, err := client.GetApp(basicApp.Name)
+	t.Assert(err, c.IsNil)
+	t.Assert(app.Name, c.Equals, basicApp.Name)
+	release, err := client.GetAppRelease(app.ID)
+	t.Assert(err, c.IsNil)
+	t.Assert(release.Processes["web"], c.NotNil)
+	t.Assert(client.PutFormation(&cluster.Formation{
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		Processes: map[string]int{"web": 3},
+	}), c.IsNil)
+
+	newRoute := s.Flynn("route-add-http", util.SeededString(random, 32)+".dev")
 	t.Assert(newRoute, Succeeds)
 
 	t.Assert(s.Flynn("routes"), OutputContains, strings.TrimSpace(newRoute.Output))
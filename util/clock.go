@@ -0,0 +1,70 @@
+package util
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Timeouts are measured on the kernel's monotonic clock rather than with
+// time.Now, so that NTP stepping the host's wall clock during a long run
+// can't expire a timeout early or extend it.
+
+const clockMonotonic = 1
+
+// Instant is a reading of the monotonic clock, which only means anything
+// relative to other readings.
+type Instant time.Duration
+
+// Now reads the monotonic clock.
+func Now() Instant {
+	var ts syscall.Timespec
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0); errno != 0 {
+		panic("util: could not read monotonic clock: " + errno.Error())
+	}
+	return Instant(time.Duration(ts.Nano()))
+}
+
+// Deadline returns the instant d from now.
+func Deadline(d time.Duration) Instant {
+	return Now().Add(d)
+}
+
+func (i Instant) Add(d time.Duration) Instant {
+	return i + Instant(d)
+}
+
+// Elapsed returns the time since i.
+func (i Instant) Elapsed() time.Duration {
+	return time.Duration(Now() - i)
+}
+
+// Remaining returns the time until i, which is negative once it has passed.
+func (i Instant) Remaining() time.Duration {
+	return time.Duration(i - Now())
+}
+
+// Strategy is like attempt.Strategy, retrying a func at least Min times
+// with Delay between attempts until Total has passed, but measures Total on
+// the monotonic clock.
+type Strategy struct {
+	Min   int
+	Total time.Duration
+	Delay time.Duration
+}
+
+// Run calls f until it succeeds or the strategy is exhausted, returning the
+// last error.
+func (s Strategy) Run(f func() error) error {
+	deadline := Deadline(s.Total)
+	for n := 1; ; n++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if n >= s.Min && deadline.Remaining() < s.Delay {
+			return err
+		}
+		time.Sleep(s.Delay)
+	}
+}
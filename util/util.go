@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"io"
+	mathrand "math/rand"
 )
 
 var Repos = map[string]string{
@@ -28,3 +29,13 @@ func RandomString(size int) string {
 	}
 	return hex.EncodeToString(data)[:size]
 }
+
+// SeededString is like RandomString but reads from r, so that the string can
+// be reproduced from r's seed.
+func SeededString(r *mathrand.Rand, size int) string {
+	data := make([]byte, size/2+1)
+	for i := range data {
+		data[i] = byte(r.Intn(256))
+	}
+	return hex.EncodeToString(data)[:size]
+}
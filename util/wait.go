@@ -0,0 +1,83 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+var ErrWaitCancelled = errors.New("util: wait cancelled")
+
+// Check reports whether an endpoint is ready, returning nil once it is.
+type Check func() error
+
+// HTTPCheck returns a Check which GETs url and passes the response to
+// predicate. A nil predicate requires a 200 response.
+func HTTPCheck(url string, predicate func(*http.Response) error) Check {
+	if predicate == nil {
+		predicate = StatusOK
+	}
+	return func() error {
+		res, err := http.Get(url)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		return predicate(res)
+	}
+}
+
+func StatusOK(res *http.Response) error {
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// DialCheck returns a Check which succeeds once addr accepts connections
+// on network, e.g. "tcp" or "unix".
+func DialCheck(network, addr string) Check {
+	return func() error {
+		conn, err := net.DialTimeout(network, addr, time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// TCPCheck returns a Check which succeeds once host:port accepts TCP
+// connections.
+func TCPCheck(host string, port int) Check {
+	return DialCheck("tcp", fmt.Sprintf("%s:%d", host, port))
+}
+
+// WaitFor runs check until it succeeds, backing off from s.Delay by doubling
+// the delay after each failure. It gives up once s.Total has elapsed and at
+// least s.Min attempts were made, returning the last error, or
+// ErrWaitCancelled if stop is closed first.
+func WaitFor(check Check, s Strategy, stop <-chan struct{}) error {
+	start := Now()
+	delay := s.Delay
+	for n := 1; ; n++ {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if start.Elapsed()+delay > s.Total && n >= s.Min {
+			return fmt.Errorf("gave up after %d attempts: %s", n, err)
+		}
+		select {
+		case <-stop:
+			return ErrWaitCancelled
+		case <-time.After(delay):
+		}
+		if remaining := s.Total - start.Elapsed(); delay*2 < remaining {
+			delay *= 2
+		} else if remaining > 0 {
+			delay = remaining
+		}
+	}
+}